@@ -0,0 +1,182 @@
+// Command kvctl is a command-line client for the key-value store.
+//
+// Usage:
+//
+//	kvctl [flags] get KEY
+//	kvctl [flags] put KEY [VALUE]      (reads the value from -f FILE or stdin if omitted)
+//	kvctl [flags] del KEY
+//	kvctl [flags] keys [--prefix P]
+//	kvctl [flags] export > dump.jsonl
+//	kvctl [flags] export -format resp | redis-cli --pipe
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/kvclient"
+	"io"
+	"os"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK       = 0
+	exitError    = 1 // Transport or server errors
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return def
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	server := fs.String("server", envOr("KV_SERVER", "http://localhost:8080"), "server base URL (env KV_SERVER)")
+	apiKey := fs.String("api-key", os.Getenv("KV_API_KEY"), "API key sent in X-API-Key (env KV_API_KEY)")
+	bucket := fs.String("bucket", os.Getenv("KV_BUCKET"), "bucket to operate on; empty is the default bucket (env KV_BUCKET)")
+
+	timeout := 10 * time.Second
+	if v := os.Getenv("KV_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(stderr, "kvctl: invalid KV_TIMEOUT: %v\n", err)
+			return exitUsage
+		}
+		timeout = d
+	}
+	fs.DurationVar(&timeout, "timeout", timeout, "request timeout (env KV_TIMEOUT)")
+
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: kvctl [flags] get|put|del|keys|export ...")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c := kvclient.New(*server, kvclient.WithTimeout(timeout), kvclient.WithAPIKey(*apiKey))
+	ctx := context.Background()
+
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+
+	var err error
+
+	switch cmd {
+	case "get":
+		if len(cmdArgs) != 1 {
+			return usage(stderr, "get KEY")
+		}
+
+		var value string
+		if value, err = c.BucketGet(ctx, *bucket, cmdArgs[0]); err == nil {
+			fmt.Fprint(stdout, value)
+		}
+	case "put":
+		pfs := flag.NewFlagSet("put", flag.ContinueOnError)
+		pfs.SetOutput(stderr)
+		file := pfs.String("f", "", "read the value from this file")
+		if err := pfs.Parse(cmdArgs); err != nil {
+			return exitUsage
+		}
+
+		var value string
+		switch {
+		case pfs.NArg() == 2 && *file == "":
+			value = pfs.Arg(1)
+		case pfs.NArg() == 1:
+			var b []byte
+			if *file != "" {
+				b, err = os.ReadFile(*file)
+			} else {
+				b, err = io.ReadAll(stdin)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "kvctl: %v\n", err)
+				return exitError
+			}
+			value = string(b)
+		default:
+			return usage(stderr, "put KEY [VALUE | -f FILE]")
+		}
+
+		err = c.BucketPut(ctx, *bucket, pfs.Arg(0), value)
+	case "del":
+		if len(cmdArgs) != 1 {
+			return usage(stderr, "del KEY")
+		}
+
+		err = c.BucketDelete(ctx, *bucket, cmdArgs[0])
+	case "keys":
+		kfs := flag.NewFlagSet("keys", flag.ContinueOnError)
+		kfs.SetOutput(stderr)
+		prefix := kfs.String("prefix", "", "only list keys starting with this prefix")
+		if err := kfs.Parse(cmdArgs); err != nil {
+			return exitUsage
+		}
+		if kfs.NArg() != 0 {
+			return usage(stderr, "keys [--prefix P]")
+		}
+
+		var keys []string
+		if keys, err = c.BucketKeys(ctx, *bucket, *prefix); err == nil {
+			for _, k := range keys {
+				fmt.Fprintln(stdout, k)
+			}
+		}
+	case "export":
+		efs := flag.NewFlagSet("export", flag.ContinueOnError)
+		efs.SetOutput(stderr)
+		format := efs.String("format", "jsonl", "jsonl, every bucket as JSON lines, or resp, the keys of -bucket as a Redis mass-insert file")
+		if err := efs.Parse(cmdArgs); err != nil {
+			return exitUsage
+		}
+		if efs.NArg() != 0 || *format != "jsonl" && *format != "resp" {
+			return usage(stderr, "export [-format jsonl|resp]")
+		}
+
+		if *format == "resp" {
+			err = c.ExportRESP(ctx, *bucket, stdout)
+		} else {
+			err = c.Export(ctx, stdout)
+		}
+	default:
+		fs.Usage()
+		return exitUsage
+	}
+
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, kvclient.ErrorNoSuchKey):
+		fmt.Fprintln(stderr, "kvctl: no such key")
+		return exitNotFound
+	default:
+		fmt.Fprintf(stderr, "kvctl: %v\n", err)
+		return exitError
+	}
+}
+
+func usage(stderr io.Writer, synopsis string) int {
+	fmt.Fprintf(stderr, "usage: kvctl [flags] %s\n", synopsis)
+	return exitUsage
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startServer returns an httptest server running the real handlers,
+// configured by cfg, over a store logged to a temporary directory.
+func startServer(t *testing.T, cfg api.Config) *httptest.Server {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close(context.Background()) })
+
+	srv := httptest.NewServer(api.NewRouter(api.NewServer(st, cfg)))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// kvctl runs the command with args and stdin, and returns its exit code,
+// stdout and stderr.
+func kvctl(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	srv := startServer(t, api.Config{AdminKey: "sekret"})
+
+	file := filepath.Join(t.TempDir(), "value")
+	if err := os.WriteFile(file, []byte("from a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := "-server=" + srv.URL
+
+	tests := []struct {
+		name   string
+		stdin  string
+		args   []string
+		code   int
+		stdout string
+	}{
+		{"put a value", "", []string{server, "put", "a", "one"}, exitOK, ""},
+		{"put from a file", "", []string{server, "put", "-f", file, "b"}, exitOK, ""},
+		{"put from stdin", "from stdin", []string{server, "put", "c"}, exitOK, ""},
+		{"put in a bucket", "", []string{server, "-bucket=other", "put", "a", "two"}, exitOK, ""},
+		{"get", "", []string{server, "get", "a"}, exitOK, "one"},
+		{"get the file's value", "", []string{server, "get", "b"}, exitOK, "from a file"},
+		{"get stdin's value", "", []string{server, "get", "c"}, exitOK, "from stdin"},
+		{"get in a bucket", "", []string{server, "-bucket=other", "get", "a"}, exitOK, "two"},
+		{"keys", "", []string{server, "keys"}, exitOK, "a\nb\nc\n"},
+		{"keys with a prefix", "", []string{server, "keys", "-prefix", "b"}, exitOK, "b\n"},
+		{"del", "", []string{server, "del", "a"}, exitOK, ""},
+		{"get a deleted key", "", []string{server, "get", "a"}, exitNotFound, ""},
+		{"del a missing key", "", []string{server, "del", "a"}, exitOK, ""},
+		{"export without the admin key", "", []string{server, "export"}, exitError, ""},
+		{"no command", "", []string{server}, exitUsage, ""},
+		{"unknown command", "", []string{server, "frob"}, exitUsage, ""},
+		{"get without a key", "", []string{server, "get"}, exitUsage, ""},
+		{"put with a value and a file", "", []string{server, "put", "-f", file, "a", "v"}, exitUsage, ""},
+	}
+
+	for _, tt := range tests {
+		code, stdout, stderr := kvctl(tt.stdin, tt.args...)
+		if code != tt.code || stdout != tt.stdout {
+			t.Errorf("%s: exit %d, stdout %q, want %d, %q; stderr: %s", tt.name, code, stdout, tt.code, tt.stdout, stderr)
+		}
+	}
+
+	code, stdout, stderr := kvctl("", server, "-api-key=sekret", "export")
+	if code != exitOK {
+		t.Fatalf("export: exit %d: %s", code, stderr)
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 3 || !strings.Contains(stdout, `"from stdin"`) {
+		t.Errorf("export: %q, want the three keys left as JSON lines", stdout)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	srv := startServer(t, api.Config{AdminKey: "sekret"})
+
+	t.Setenv("KV_SERVER", srv.URL)
+	t.Setenv("KV_API_KEY", "sekret")
+	t.Setenv("KV_BUCKET", "env")
+
+	if code, _, stderr := kvctl("", "put", "k", "v"); code != exitOK {
+		t.Fatalf("put: exit %d: %s", code, stderr)
+	}
+	if code, stdout, stderr := kvctl("", "-bucket=env", "-server="+srv.URL, "get", "k"); code != exitOK || stdout != "v" {
+		t.Errorf("get from the bucket named by KV_BUCKET: exit %d, %q: %s", code, stdout, stderr)
+	}
+	if code, _, stderr := kvctl("", "export"); code != exitOK {
+		t.Errorf("export with KV_API_KEY: exit %d: %s", code, stderr)
+	}
+
+	// Flags take precedence
+	if code, _, _ := kvctl("", "-api-key=wrong", "export"); code != exitError {
+		t.Errorf("export with -api-key overriding KV_API_KEY: exit %d, want %d", code, exitError)
+	}
+
+	t.Setenv("KV_TIMEOUT", "soon")
+	if code, _, _ := kvctl("", "get", "k"); code != exitUsage {
+		t.Errorf("with an invalid KV_TIMEOUT: exit %d, want %d", code, exitUsage)
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	srv.Close()
+
+	code, _, stderr := kvctl("", "-server="+srv.URL, "-timeout=1s", "get", "k")
+	if code != exitError {
+		t.Errorf("get from a closed server: exit %d, want %d", code, exitError)
+	}
+	if !strings.HasPrefix(stderr, "kvctl: ") {
+		t.Errorf("stderr %q, want the error", stderr)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr returns an address on the loopback interface that nothing is
+// listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestAdminListener(t *testing.T) {
+	binary := buildBinary(t)
+	dir := t.TempDir()
+
+	now := time.Now()
+	dataCert, dataKey := filepath.Join(dir, "data.pem"), filepath.Join(dir, "data-key.pem")
+	adminCert, adminKey := filepath.Join(dir, "admin.pem"), filepath.Join(dir, "admin-key.pem")
+	writeCert(t, dataCert, dataKey, "data.example", now.Add(-time.Hour), now.Add(24*time.Hour))
+	writeCert(t, adminCert, adminKey, "admin.example", now.Add(-time.Hour), now.Add(24*time.Hour))
+
+	dataAddr, adminAddr := freeAddr(t), freeAddr(t)
+
+	var output syncBuffer
+	cmd := exec.Command(binary,
+		"-data-dir", t.TempDir(),
+		"-admin-key", "secret",
+		"-listen", dataAddr, "-tls-cert", dataCert, "-tls-key", dataKey,
+		"-admin-listen", adminAddr, "-admin-tls-cert", adminCert, "-admin-tls-key", adminKey,
+	)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Stdout, cmd.Stderr = &output, &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Kill()
+		<-done
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	// get returns the status of an admin GET of path on addr
+	get := func(addr, path string) int {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", "https://"+addr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", "secret")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// Readiness is on the admin listener only
+	deadline := time.Now().Add(time.Minute)
+	for {
+		req, _ := http.NewRequest("GET", "https://"+adminAddr+"/readyz", nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the admin listener wasn't ready:\n%s", output.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Each listener presents its own certificate
+	if name, _ := servedName(t, dataAddr); name != "data.example" {
+		t.Errorf("the data listener presented %s", name)
+	}
+	if name, _ := servedName(t, adminAddr); name != "admin.example" {
+		t.Errorf("the admin listener presented %s", name)
+	}
+
+	// And serves its own routes, answering 404 for the other's
+	for _, path := range []string{"/readyz", "/metrics", "/v1/stats", "/v1/export", "/v1/admin/maintenance", "/debug/pprof/"} {
+		if code := get(adminAddr, path); code != http.StatusOK {
+			t.Errorf("GET %s on the admin listener: %d", path, code)
+		}
+		if code := get(dataAddr, path); code != http.StatusNotFound {
+			t.Errorf("GET %s on the data listener: %d, want 404", path, code)
+		}
+	}
+
+	req, _ := http.NewRequest("PUT", "https://"+dataAddr+"/v1/key/k", strings.NewReader("v"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("PUT k on the data listener: %d", resp.StatusCode)
+	}
+	if code := get(dataAddr, "/v1/key/k"); code != http.StatusOK {
+		t.Errorf("GET k on the data listener: %d", code)
+	}
+	if code := get(adminAddr, "/v1/key/k"); code != http.StatusNotFound {
+		t.Errorf("GET k on the admin listener: %d, want 404", code)
+	}
+
+	// A shutdown stops both listeners
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		done <- err
+		if err != nil {
+			t.Errorf("exited with %v after SIGTERM:\n%s", err, output.String())
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("still running 30s after SIGTERM:\n%s", output.String())
+	}
+	for _, addr := range []string{dataAddr, adminAddr} {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after shutdown", addr)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"os"
+	"strings"
+)
+
+// loadAPIKeys reads the API keys of the file at path, one per line as the
+// key and the id of its principal, optionally followed by its scopes as
+// parseScopes reads them, such as "s3cret ops=admin+unlimited". Blank lines
+// and lines starting with # are skipped.
+func loadAPIKeys(path string) (map[string]api.Principal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]api.Principal)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key and an id", path, n)
+		}
+
+		key, id := fields[0], fields[1]
+		p := api.Principal{ID: id}
+
+		if strings.Contains(id, "=") {
+			scopes, err := parseScopes(id)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			for id, s := range scopes {
+				p = api.Principal{ID: id, Scopes: s}
+			}
+		}
+
+		if _, ok := keys[key]; ok {
+			return nil, fmt.Errorf("%s:%d: key given twice", path, n)
+		}
+		keys[key] = p
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	keys := "# Operators\nops-key ops=admin+unlimited\n\nuser-key user\n"
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := got["ops-key"]; p.ID != "ops" || !slices.Equal(p.Scopes, []string{"admin", "unlimited"}) {
+		t.Errorf("ops-key is %+v", p)
+	}
+	if p := got["user-key"]; p.ID != "user" || len(p.Scopes) != 0 {
+		t.Errorf("user-key is %+v", p)
+	}
+	if len(got) != 2 {
+		t.Errorf("%d keys, want 2", len(got))
+	}
+
+	for _, bad := range []string{"lonely-key\n", "k a\nk b\n", "k ops=root\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAPIKeys(path); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"github.com/sheritzs/key-value-store/kvclient"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Entries of a backup archive. The log and snapshot are named as in a data
+// directory.
+const (
+	logFileName      = translog.LogFileName
+	snapshotFileName = store.SnapshotFileName
+	manifestFileName = "manifest.json"
+)
+
+// manifest describes a backup archive. The snapshot includes the events up
+// to SnapshotSequence and the log holds the ones after it, up to Sequence.
+type manifest struct {
+	Sequence         uint64                `json:"sequence"`
+	SnapshotSequence uint64                `json:"snapshot_sequence"`
+	Created          time.Time             `json:"created"`
+	Source           string                `json:"source"`
+	Files            map[string]fileDigest `json:"files"`
+}
+
+type fileDigest struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func digest(b []byte) fileDigest {
+	sum := sha256.Sum256(b)
+	return fileDigest{Size: int64(len(b)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// backup implements "kvstore backup", which archives a running instance
+// through its API, or a stopped one from its data directory.
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("o", "", "archive to write (required)")
+	server := flags.String("server", "", "base URL of a running instance to back up; if empty, -data-dir is read directly")
+	apiKey := flags.String("api-key", os.Getenv("KV_ADMIN_KEY"), "admin API key of the instance given by -server")
+	dataDir := flags.String("data-dir", ".", "data directory of a stopped instance to back up")
+	timeout := flags.Duration("timeout", time.Minute, "how long to wait for a running instance's snapshot")
+	flags.Parse(args)
+
+	if *out == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore backup -o FILE [-server URL | -data-dir DIR]")
+	}
+
+	var snapshot, tail []byte
+	var source string
+	var err error
+
+	if *server != "" {
+		// A live snapshot is consistent on its own; the log tail is empty
+		source = *server
+		snapshot, err = fetchSnapshot(*server, *apiKey, *timeout)
+	} else {
+		source = *dataDir
+		snapshot, tail, err = readDataDir(*dataDir)
+
+		// A live snapshot reads blobs back, but the files of a stopped
+		// instance only refer to them
+		if _, serr := os.Stat(filepath.Join(*dataDir, blob.DirName)); serr == nil {
+			log.Printf("WARNING: the blobs in %s aren't archived; copy them along, or back up the running instance with -server\n", filepath.Join(*dataDir, blob.DirName))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	m := manifest{
+		Created: time.Now().UTC(),
+		Source:  source,
+		Files: map[string]fileDigest{
+			snapshotFileName: digest(snapshot),
+			logFileName:      digest(tail),
+		},
+	}
+
+	if m.SnapshotSequence, err = snapshotSequence(snapshot); err != nil {
+		return err
+	}
+
+	m.Sequence = m.SnapshotSequence
+	if last, err := lastSequence(tail); err != nil {
+		return err
+	} else if last > m.Sequence {
+		m.Sequence = last
+	}
+
+	manifestJSON, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeArchive(*out, map[string][]byte{
+		manifestFileName: manifestJSON,
+		snapshotFileName: snapshot,
+		logFileName:      tail,
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("backed up %s at sequence %d to %s\n", source, m.Sequence, *out)
+
+	return nil
+}
+
+// fetchSnapshot downloads a snapshot from a running instance.
+func fetchSnapshot(server, apiKey string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c := kvclient.New(server, kvclient.WithAPIKey(apiKey), kvclient.WithTimeout(timeout))
+
+	var buf bytes.Buffer
+	if err := c.Snapshot(ctx, &buf); err != nil {
+		return nil, fmt.Errorf("fetching snapshot: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readDataDir returns the snapshot in dataDir, or an empty one if it has
+// none, and the log events after the snapshot.
+func readDataDir(dataDir string) (snapshot, tail []byte, err error) {
+	snapshot, err = os.ReadFile(filepath.Join(dataDir, snapshotFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		var buf bytes.Buffer
+		err = store.New(translog.NewNopTransactionLogger(), store.Options{}).Snapshot(&buf)
+		snapshot = buf.Bytes()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	after, err := snapshotSequence(snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := translog.SegmentFiles(filepath.Join(dataDir, logFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Lines are copied verbatim, so the restored log is byte-for-byte the
+	// original's tail, with its rotated segments and any events spilled at
+	// shutdown joined into one file
+	var buf bytes.Buffer
+
+	files = append(files, filepath.Join(dataDir, translog.PendingFileName))
+
+	for _, name := range files {
+		if err := copyLogTail(&buf, name, after); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return snapshot, buf.Bytes(), nil
+}
+
+// copyLogTail appends to buf the lines of the log file name that come after
+// sequence after. A missing file has no lines.
+func copyLogTail(buf *bytes.Buffer, name string, after uint64) error {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			if line != "" {
+				return fmt.Errorf("%s: truncated last line", f.Name())
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		seq, err := translog.LineSequence(line)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name(), err)
+		}
+
+		if seq > after {
+			buf.WriteString(line)
+		}
+	}
+}
+
+// snapshotSequence returns the sequence in a snapshot's header.
+func snapshotSequence(snapshot []byte) (uint64, error) {
+	line, _, _ := bytes.Cut(snapshot, []byte("\n"))
+
+	var header store.SnapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return 0, fmt.Errorf("invalid snapshot header: %w", err)
+	}
+
+	return header.Sequence, nil
+}
+
+// lastSequence returns the sequence of the last line of a log, or 0 if it is
+// empty.
+func lastSequence(lines []byte) (uint64, error) {
+	lines = bytes.TrimSuffix(lines, []byte("\n"))
+	if len(lines) == 0 {
+		return 0, nil
+	}
+
+	if i := bytes.LastIndexByte(lines, '\n'); i >= 0 {
+		lines = lines[i+1:]
+	}
+
+	return translog.LineSequence(string(lines))
+}
+
+// writeArchive writes files to a gzipped tar archive at path, the manifest
+// first.
+func writeArchive(path string, files map[string][]byte) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	for _, name := range []string{manifestFileName, snapshotFileName, logFileName} {
+		b := files[name]
+
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// restore implements "kvstore restore", which unpacks a backup into a data
+// directory that an instance then starts from.
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := flags.String("i", "", "archive to restore (required)")
+	dataDir := flags.String("data-dir", "", "data directory to restore into (required)")
+	force := flags.Bool("force", false, "overwrite the snapshot and log of a data directory that isn't empty")
+	flags.Parse(args)
+
+	if *in == "" || *dataDir == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore restore -i FILE -data-dir DIR [-force]")
+	}
+
+	if !*force {
+		entries, err := os.ReadDir(*dataDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("data directory %s is not empty; use -force to overwrite it", *dataDir)
+		}
+	}
+
+	files, err := readArchive(*in)
+	if err != nil {
+		return err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(files[manifestFileName], &m); err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	for _, name := range []string{snapshotFileName, logFileName} {
+		want, ok := m.Files[name]
+		if !ok {
+			return fmt.Errorf("manifest doesn't list %s", name)
+		}
+		if got := digest(files[name]); got != want {
+			return fmt.Errorf("%s doesn't match its checksum in the manifest", name)
+		}
+	}
+
+	// Check that the snapshot loads before replacing anything
+	if err := store.New(translog.NewNopTransactionLogger(), store.Options{}).Restore(bytes.NewReader(files[snapshotFileName])); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		return err
+	}
+
+	// Numbering resumes after the last sequence of a log being overwritten,
+	// rather than reusing numbers its followers may have seen
+	highWater, err := translog.HighWater(filepath.Join(*dataDir, logFileName))
+	if err != nil {
+		return err
+	}
+
+	// Segments rotated out of a log being overwritten would otherwise be
+	// replayed ahead of the restored one, and spilled events after it
+	segments, err := translog.SegmentFiles(filepath.Join(*dataDir, logFileName))
+	if err != nil {
+		return err
+	}
+	stale := append(segments[:len(segments)-1], filepath.Join(*dataDir, translog.PendingFileName))
+	for _, name := range stale {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	for _, name := range []string{snapshotFileName, logFileName} {
+		if err := writeFileAtomic(filepath.Join(*dataDir, name), files[name]); err != nil {
+			return err
+		}
+	}
+
+	// The log's tail starts after the snapshot, which is where numbering
+	// continues from even if the tail is empty
+	meta := translog.LogMeta{After: m.SnapshotSequence, Compacted: m.Created}
+	if highWater > m.Sequence {
+		meta.HighWater = highWater
+	}
+	if err := translog.WriteLogMeta(filepath.Join(*dataDir, logFileName), meta); err != nil {
+		return err
+	}
+
+	log.Printf("restored backup of %s at sequence %d into %s\n", m.Source, m.Sequence, *dataDir)
+
+	return nil
+}
+
+// readArchive returns the files of a backup archive by name. Entries other
+// than the expected files are rejected.
+func readArchive(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		switch hdr.Name {
+		case manifestFileName, snapshotFileName, logFileName:
+		default:
+			return nil, fmt.Errorf("%s: unexpected entry %q", path, hdr.Name)
+		}
+
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if _, ok := files[manifestFileName]; !ok {
+		return nil, fmt.Errorf("%s: no manifest", path)
+	}
+
+	return files, nil
+}
+
+// writeFileAtomic replaces the file at path with b, so a failed restore
+// never leaves a partially written file behind.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openLogged returns a store loaded from the data directory dir, logging to
+// a file in it, and a function closing the log once everything written is
+// durable.
+func openLogged(t *testing.T, dir string) (*store.Store, func()) {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return st, func() {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := l.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// write puts keys k0 to k9 n times over, deleting one now and then, and
+// calls snapshot, if not nil, halfway through.
+func write(t *testing.T, st *store.Store, n int, snapshot func()) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for i := range n {
+		if i == n/2 && snapshot != nil {
+			snapshot()
+		}
+
+		key := fmt.Sprintf("k%d", i%10)
+
+		var err error
+		if i%7 == 6 {
+			err = st.DeleteCtx(ctx, key)
+		} else {
+			err = st.PutCtx(ctx, key, fmt.Sprintf("v%d", i))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// contents returns every key of st with its value.
+func contents(t *testing.T, st *store.Store) map[string]string {
+	t.Helper()
+
+	keys, _, err := st.Keys(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make(map[string]string)
+	for _, k := range keys {
+		if m[k], err = st.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return m
+}
+
+// checkRestored opens the data directory dir and checks it holds want, at
+// sequence seq, and numbers new writes after it.
+func checkRestored(t *testing.T, dir string, want map[string]string, seq uint64) {
+	t.Helper()
+
+	st, closeLog := openLogged(t, dir)
+	defer closeLog()
+
+	if got := contents(t, st); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+	if st.Sequence() != seq {
+		t.Errorf("restored at sequence %d, want %d", st.Sequence(), seq)
+	}
+
+	if err := st.PutCtx(context.Background(), "new", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if st.Sequence() <= seq {
+		t.Errorf("a write after the restore got sequence %d, not after %d", st.Sequence(), seq)
+	}
+}
+
+func TestBackupRestoreDataDir(t *testing.T) {
+	dir := t.TempDir()
+	st, closeLog := openLogged(t, dir)
+
+	// The data directory has a snapshot half way through the log
+	write(t, st, 60, func() {
+		f, err := os.Create(filepath.Join(dir, store.SnapshotFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := st.Snapshot(f); err != nil {
+			t.Fatal(err)
+		}
+	})
+	closeLog()
+
+	want, seq := contents(t, st), st.Sequence()
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := backup([]string{"-o", archive, "-data-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := readArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(files[logFileName]), "\n"); n != 30 {
+		t.Errorf("archived a log tail of %d events, want the 30 after the snapshot", n)
+	}
+
+	restored := filepath.Join(t.TempDir(), "data")
+	if err := restore([]string{"-i", archive, "-data-dir", restored}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRestored(t, restored, want, seq)
+}
+
+func TestBackupRestoreRunningInstance(t *testing.T) {
+	dir := t.TempDir()
+	st, closeLog := openLogged(t, dir)
+	defer closeLog()
+
+	srv := httptest.NewServer(api.NewRouter(api.NewServer(st, api.Config{AdminKey: "secret"})))
+	defer srv.Close()
+
+	write(t, st, 40, nil)
+	want, seq := contents(t, st), st.Sequence()
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := backup([]string{"-o", archive, "-server", srv.URL, "-api-key", "wrong"}); err == nil {
+		t.Fatal("backed up with a wrong API key")
+	}
+	if err := backup([]string{"-o", archive, "-server", srv.URL, "-api-key", "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(t.TempDir(), "data")
+	if err := restore([]string{"-i", archive, "-data-dir", restored}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRestored(t, restored, want, seq)
+}
+
+func TestRestoreNeedsForceOverData(t *testing.T) {
+	dir := t.TempDir()
+	st, closeLog := openLogged(t, dir)
+	write(t, st, 20, nil)
+	closeLog()
+
+	want, seq := contents(t, st), st.Sequence()
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := backup([]string{"-o", archive, "-data-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A data directory with data of its own is left alone
+	other := t.TempDir()
+	st, closeLog = openLogged(t, other)
+	if err := st.PutCtx(context.Background(), "other", "data"); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	before, err := os.ReadFile(filepath.Join(other, translog.LogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore([]string{"-i", archive, "-data-dir", other}); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Fatalf("restore over a data directory: %v, want an error asking for -force", err)
+	}
+	if after, _ := os.ReadFile(filepath.Join(other, translog.LogFileName)); string(after) != string(before) {
+		t.Fatal("a refused restore changed the log")
+	}
+
+	// With -force it's replaced, numbering new writes after everything the
+	// old log numbered
+	if err := restore([]string{"-i", archive, "-data-dir", other, "-force"}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRestored(t, other, want, seq)
+}
+
+func TestRestoreChecksArchive(t *testing.T) {
+	dir := t.TempDir()
+	st, closeLog := openLogged(t, dir)
+	write(t, st, 20, nil)
+	closeLog()
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := backup([]string{"-o", archive, "-data-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backup([]string{"-o", archive, "-data-dir", dir}); err == nil {
+		t.Error("backup overwrote an existing archive")
+	}
+
+	files, err := readArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A log that doesn't match the manifest is refused, and nothing written
+	files[logFileName] = files[logFileName][:len(files[logFileName])/2]
+
+	tampered := filepath.Join(t.TempDir(), "tampered.tar.gz")
+	if err := writeArchive(tampered, files); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(t.TempDir(), "data")
+	if err := restore([]string{"-i", tampered, "-data-dir", restored}); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("restore of a tampered archive: %v, want a checksum error", err)
+	}
+	if _, err := os.Stat(restored); err == nil {
+		t.Error("a refused restore created the data directory")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxReportedDamage bounds the damaged records listed in the boot report;
+// any more are only counted.
+const maxReportedDamage = 100
+
+// recordDamage returns a function adding the damaged records replay finds
+// to r. Every record but a torn last line is skipped, or fails the replay.
+func recordDamage(r *api.BootReport) func(translog.Damage) {
+	return func(d translog.Damage) {
+		if len(r.Damage) < maxReportedDamage {
+			r.Damage = append(r.Damage, d)
+		}
+
+		// The logger has already warned of a torn line
+		if !d.Torn {
+			r.Skipped++
+			log.Printf("WARNING: damaged transaction log record: %s\n", d)
+		}
+	}
+}
+
+// replayAdvice explains what to do about a replay that failed.
+func replayAdvice(mode string, r *api.BootReport) string {
+	if mode == "strict" && r.Skipped > 0 {
+		return "Nothing was changed. Check the data directory with \"kvstore fsck\", restore a backup, " +
+			"or start with -boot-mode=permissive to skip damaged records and serve what can be recovered."
+	}
+
+	return "Nothing was changed. Check the data directory with \"kvstore fsck\", or restore a backup."
+}
+
+// logSize returns the total size of the file log's segments in dataDir.
+func logSize(dataDir string) int64 {
+	files, err := translog.SegmentFiles(filepath.Join(dataDir, translog.LogFileName))
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, name := range files {
+		if fi, err := os.Stat(name); err == nil {
+			size += fi.Size()
+		}
+	}
+
+	return size
+}
+
+// logBootReport logs r as one line of key=value fields, followed by a
+// warning if the instance starts degraded.
+func logBootReport(r *api.BootReport) {
+	log.Printf("startup: mode=%s backend=%s events_replayed=%d last_sequence=%d duration=%s log_bytes=%d gaps=%d skipped_records=%d degraded=%t\n",
+		r.Mode, r.Backend, r.Events, r.LastSequence, r.Duration.Round(time.Millisecond), r.LogBytes, r.Gaps, r.Skipped, r.Degraded)
+
+	if r.Degraded {
+		log.Printf("WARNING: started degraded, skipping %d damaged transaction log records; "+
+			"their writes are lost and later events may depend on them\n", r.Skipped)
+	}
+}
+
+// dataPaths returns where an instance with the given backend, data
+// directory, blob directory and keyring keeps its data, made absolute, by
+// what it is. The blob directory and keyring are left out if empty.
+func dataPaths(backend, dataDir, blobDir, keyring string) map[string]string {
+	paths := map[string]string{
+		"data_dir": dataDir,
+		"snapshot": filepath.Join(dataDir, store.SnapshotFileName),
+	}
+
+	if backend == "file" {
+		paths["log"] = filepath.Join(dataDir, translog.LogFileName)
+	}
+	if blobDir != "" {
+		paths["blob_dir"] = blobDir
+	}
+	if keyring != "" {
+		paths["keyring"] = keyring
+	}
+
+	for name, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil {
+			paths[name] = abs
+		}
+	}
+
+	return paths
+}
+
+// logInstanceInfo logs the description of the instance s serves as one line
+// of key=value fields: the build, the backend, the paths of the data, where
+// the log starts, the snapshot the store was loaded from and the flags set,
+// as name=value pairs.
+func logInstanceInfo(s *api.Server) {
+	info, err := s.Info()
+	if err != nil {
+		log.Printf("WARNING: the startup description leaves the log out: %v\n", err)
+	}
+
+	var b strings.Builder
+
+	for _, name := range slices.Sorted(maps.Keys(info.Paths)) {
+		fmt.Fprintf(&b, " %s=%q", name, info.Paths[name])
+	}
+
+	compacted := "never"
+	if !info.LastCompaction.IsZero() {
+		compacted = info.LastCompaction.Format(time.RFC3339)
+	}
+
+	checkpoint := "none"
+	if len(info.Checkpoints) > 0 {
+		c := info.Checkpoints[0]
+		checkpoint = fmt.Sprintf("%d@%s", c.Sequence, c.Taken.Format(time.RFC3339))
+	}
+
+	var features []string
+	for _, name := range slices.Sorted(maps.Keys(info.Features)) {
+		features = append(features, name+"="+info.Features[name])
+	}
+
+	log.Printf("instance: version=%s commit=%s date=%s modified=%t go=%s backend=%s%s record_version=%d sequence=%d log_starts_after=%d last_compaction=%s checkpoint=%s features=%q\n",
+		info.Build.Version, info.Build.Commit, info.Build.Date, info.Build.Modified, info.Build.GoVersion, info.Backend, b.String(),
+		info.RecordVersion, info.Sequence, info.LogStartsAfter, compacted, checkpoint, strings.Join(features, ","))
+}
+
+// logStartupPhases logs how long each phase of startup took, and the time
+// until ready, as one line of key=value fields.
+func logStartupPhases(r *api.BootReport) {
+	var b strings.Builder
+
+	for _, p := range r.Phases {
+		fmt.Fprintf(&b, " %s=%s", p.Name, p.Duration.Round(time.Microsecond))
+	}
+
+	log.Printf("startup phases:%s replay_events_per_second=%.0f ready=%s\n", b.String(), r.ReplayRate, r.Ready.Round(time.Microsecond))
+}
+
+// maxListedCollisions bounds the sets of colliding keys a refused
+// -key-folding lists; any more are only counted.
+const maxListedCollisions = 100
+
+// listCollisions lists the sets of keys that fold to the same key, one per
+// line.
+func listCollisions(collisions []store.KeyCollision) string {
+	var b strings.Builder
+
+	for i, c := range collisions {
+		if i == maxListedCollisions {
+			fmt.Fprintf(&b, "  and %d more\n", len(collisions)-i)
+			break
+		}
+
+		fmt.Fprintf(&b, "  %s\n", c)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/testharness"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// corruptLine replaces line n of the log in dataDir with garbage.
+func corruptLine(t *testing.T, dataDir string, n int) {
+	t.Helper()
+
+	path := filepath.Join(dataDir, translog.LogFileName)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	lines[n-1] = "not an event\n"
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getJSON decodes the body of an admin GET of url into v.
+func getJSON(t *testing.T, url string, v any) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", "admin")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func TestBootModesWithACorruptedRecord(t *testing.T) {
+	binary := buildBinary(t)
+
+	// Of 15 events, the 10th, the only write of k0, is damaged
+	dataDir := t.TempDir()
+	writeHistory(t, dataDir, time.Now().Add(-time.Hour), 15)
+	corruptLine(t, dataDir, 10)
+
+	before, err := os.ReadFile(filepath.Join(dataDir, translog.LogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Strict mode refuses to start, saying where the damage is and what to
+	// do, and leaves the log alone
+	_, stderr, ok := runBinary(t, binary, nil, "-data-dir", dataDir, "-listen", "127.0.0.1:0", "-boot-mode", "strict")
+	if ok {
+		t.Fatal("started in strict mode with a damaged record")
+	}
+	for _, want := range []string{"startup replay failed in strict boot mode", "line 10", "-boot-mode=permissive"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("strict mode's error doesn't say %q:\n%s", want, stderr)
+		}
+	}
+	if after, _ := os.ReadFile(filepath.Join(dataDir, translog.LogFileName)); string(after) != string(before) {
+		t.Error("strict mode changed the log it refused")
+	}
+
+	// Permissive mode starts with every other record, degraded
+	var output syncBuffer
+	p, err := testharness.StartProcess(context.Background(), testharness.ProcessConfig{
+		Binary:   binary,
+		DataDir:  dataDir,
+		AdminKey: "admin",
+		Args:     []string{"-boot-mode", "permissive"},
+		Output:   &output,
+	})
+	if err != nil {
+		t.Fatalf("permissive mode didn't start: %v\n%s", err, output.String())
+	}
+	defer p.Close()
+
+	for key, want := range map[string]int{"k0": http.StatusNotFound, "k1": http.StatusOK, "k5": http.StatusOK} {
+		if code := status(t, "GET", p.URL()+"/v1/key/"+key, ""); code != want {
+			t.Errorf("GET %s: %d, want %d", key, code, want)
+		}
+	}
+
+	var ready struct {
+		Degraded bool `json:"degraded"`
+	}
+	getJSON(t, p.URL()+"/readyz", &ready)
+	if !ready.Degraded {
+		t.Error("/readyz doesn't report the instance degraded")
+	}
+
+	var stats struct {
+		Boot api.BootReport `json:"boot"`
+	}
+	getJSON(t, p.URL()+"/v1/stats", &stats)
+
+	b := stats.Boot
+	if b.Mode != "permissive" || b.Backend != "file" || !b.Degraded || b.Skipped != 1 || b.Events != 14 || b.LastSequence != 15 {
+		t.Errorf("boot report %+v; want 14 events replayed to sequence 15, 1 skipped, degraded", b)
+	}
+	if len(b.Damage) != 1 || b.Damage[0].Line != 10 {
+		t.Errorf("boot report lists damage %v, want line 10", b.Damage)
+	}
+	if !strings.Contains(output.String(), "skipped_records=1 degraded=true") {
+		t.Errorf("the startup report isn't logged:\n%s", output.String())
+	}
+}
+
+// scrape returns the samples of /metrics at url, by metric name and labels
+// as exported, such as `kv_startup_phase_seconds{phase="replay"}`.
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(map[string]float64)
+	for line := range strings.Lines(string(b)) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			samples[fields[0]] = v
+		}
+	}
+
+	return samples
+}
+
+func TestStartupPhaseMetrics(t *testing.T) {
+	binary := buildBinary(t)
+
+	const events = 100000
+
+	dataDir := t.TempDir()
+	st, closeLog := openLogged(t, dataDir)
+	for i := range events {
+		if err := st.PutCtx(context.Background(), fmt.Sprintf("k%d", i%1000), fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeLog()
+
+	var output syncBuffer
+	p, err := testharness.StartProcess(context.Background(), testharness.ProcessConfig{
+		Binary:   binary,
+		DataDir:  dataDir,
+		AdminKey: "admin",
+		Output:   &output,
+	})
+	if err != nil {
+		t.Fatalf("didn't start: %v\n%s", err, output.String())
+	}
+	defer p.Close()
+
+	samples := scrape(t, p.URL())
+
+	// Every phase ran, and none took longer than the whole startup
+	ready := samples["kv_startup_ready_seconds"]
+	if ready <= 0 || ready > 60 {
+		t.Errorf("kv_startup_ready_seconds %v", ready)
+	}
+
+	var total float64
+	for _, phase := range []string{api.BootPhaseOpenLog, api.BootPhaseReplay, api.BootPhaseWarm, api.BootPhaseListen} {
+		v, ok := samples[`kv_startup_phase_seconds{phase="`+phase+`"}`]
+		if !ok || v <= 0 || v > ready {
+			t.Errorf("kv_startup_phase_seconds{phase=%q} %v, of %vs to ready", phase, v, ready)
+		}
+		total += v
+	}
+	if total > ready {
+		t.Errorf("the phases took %vs, more than the %vs to ready", total, ready)
+	}
+
+	// The rate of replay is that of the events in the log over the replay
+	// phase
+	replay := samples[`kv_startup_phase_seconds{phase="replay"}`]
+	rate := samples["kv_startup_replay_events_per_second"]
+	if want := events / replay; replay <= 0 || math.Abs(rate-want) > want/100 {
+		t.Errorf("kv_startup_replay_events_per_second %v, want %v for %d events in %vs", rate, want, events, replay)
+	}
+	t.Logf("replayed %d events in %.3fs, at %.0f events/s; ready after %.3fs", events, replay, rate, ready)
+
+	var stats struct {
+		Boot api.BootReport `json:"boot"`
+	}
+	getJSON(t, p.URL()+"/v1/stats", &stats)
+	if b := stats.Boot; b.Events != events || len(b.Phases) != 4 || b.Ready <= 0 {
+		t.Errorf("boot report %+v", b)
+	}
+	if !strings.Contains(output.String(), "startup phases:") {
+		t.Errorf("the startup phases aren't logged:\n%s", output.String())
+	}
+}
+
+func TestInstanceInfo(t *testing.T) {
+	const pkg = "github.com/sheritzs/key-value-store/internal/version"
+	binary := buildBinary(t, "-ldflags", "-X "+pkg+".Version=v9.8.7 -X "+pkg+".Commit=0123abc -X "+pkg+".Date=2026-02-03T04:05:06Z")
+
+	out, err := exec.Command(binary, "-version").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); !strings.HasPrefix(got, "kvstore v9.8.7 commit 0123abc built 2026-02-03T04:05:06Z with go") {
+		t.Errorf("-version printed %q", got)
+	}
+
+	// A data directory whose log was compacted up to sequence 20
+	dataDir := t.TempDir()
+	writeHistory(t, dataDir, time.Now().Add(-time.Hour), 30)
+	if _, err := recoverDataDir(dataDir, store.ReplayLimit{Sequence: 20}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// start runs the binary on the data directory, returning it with its
+	// description of itself
+	start := func() (*testharness.Process, *syncBuffer, api.InstanceInfo) {
+		t.Helper()
+
+		var output syncBuffer
+		p, err := testharness.StartProcess(context.Background(), testharness.ProcessConfig{
+			Binary:   binary,
+			DataDir:  dataDir,
+			AdminKey: "admin",
+			Args:     []string{"-max-value-size", "4096"},
+			Output:   &output,
+		})
+		if err != nil {
+			t.Fatalf("didn't start: %v\n%s", err, output.String())
+		}
+
+		var info api.InstanceInfo
+		getJSON(t, p.URL()+api.InfoPath, &info)
+		return p, &output, info
+	}
+
+	p, output, info := start()
+
+	if info.Build.Version != "v9.8.7" || info.Build.Commit != "0123abc" || info.Build.Date != "2026-02-03T04:05:06Z" || !strings.HasPrefix(info.Build.GoVersion, "go") {
+		t.Errorf("build %+v, not the one linked in", info.Build)
+	}
+	if abs, _ := filepath.Abs(dataDir); info.Backend != "file" || info.Paths["data_dir"] != abs || info.Paths["log"] != filepath.Join(abs, translog.LogFileName) {
+		t.Errorf("backend %q with paths %v", info.Backend, info.Paths)
+	}
+	if info.Features["max-value-size"] != "4096" || info.Features["admin-key"] != "REDACTED" {
+		t.Errorf("features %v", info.Features)
+	}
+	if info.RecordVersion != translog.RecordVersion || info.Sequence < 20 {
+		t.Errorf("record version %d at sequence %d", info.RecordVersion, info.Sequence)
+	}
+
+	// The log starts after the compaction, and the store from the snapshot
+	// it left
+	if info.LogStartsAfter != 20 || info.LastCompaction.IsZero() || len(info.Checkpoints) != 1 || info.Checkpoints[0].Sequence != 20 {
+		t.Errorf("after compacting to 20: log starts after %d, compacted at %s, checkpoints %+v", info.LogStartsAfter, info.LastCompaction, info.Checkpoints)
+	}
+	first := info.LastCompaction
+
+	if line := output.String(); !strings.Contains(line, "instance: version=v9.8.7 commit=0123abc") ||
+		!strings.Contains(line, "backend=file") || !strings.Contains(line, "log_starts_after=20") || !strings.Contains(line, " checkpoint=20@") {
+		t.Errorf("the startup line doesn't describe the instance:\n%s", line)
+	}
+
+	// Writes after it, then another compaction while the instance is down
+	for i := range 5 {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s/v1/key/new%d", p.URL(), i), strings.NewReader("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			t.Fatalf("PUT new%d: %d", i, resp.StatusCode)
+		}
+	}
+	getJSON(t, p.URL()+api.InfoPath, &info)
+	want := info.Sequence
+	if want <= 30 || info.LogStartsAfter != 20 {
+		t.Errorf("after 5 writes: sequence %d, log starts after %d", want, info.LogStartsAfter)
+	}
+	p.Close()
+
+	time.Sleep(time.Second) // The compactions move the log aside to directories named by the second
+	if _, err := recoverDataDir(dataDir, store.ReplayLimit{Sequence: math.MaxUint64}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restarted instance boots from the new checkpoint
+	p, output, info = start()
+	defer p.Close()
+
+	if info.Sequence != want || info.LogStartsAfter != want || !info.LastCompaction.After(first) || len(info.Checkpoints) != 1 || info.Checkpoints[0].Sequence != want {
+		t.Errorf("after compacting to %d: at %d, log starts after %d, compacted at %s, checkpoints %+v", want, info.Sequence, info.LogStartsAfter, info.LastCompaction, info.Checkpoints)
+	}
+	if line := output.String(); !strings.Contains(line, fmt.Sprintf("log_starts_after=%d", want)) || !strings.Contains(line, fmt.Sprintf(" checkpoint=%d@", want)) {
+		t.Errorf("the startup line after the compaction:\n%s", line)
+	}
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reloadableFlags are the flags whose settings in the -config file are
+// applied again on SIGHUP. The others take effect only at startup.
+var reloadableFlags = map[string]bool{
+	"admin-key":           true,
+	"ip-rules":            true,
+	"limit-policy":        true,
+	"limit-wait":          true,
+	"max-inflight-reads":  true,
+	"max-inflight-writes": true,
+}
+
+// Config is the layout of a YAML or JSON -config file. Each setting has the
+// type of, and is applied as, the flag named by its flag tag.
+type Config struct {
+	Listen     ListenConfig     `yaml:"listen"`
+	API        APIConfig        `yaml:"api"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Durability DurabilityConfig `yaml:"durability"`
+	Log        LogConfig        `yaml:"log"`
+	Postgres   PostgresConfig   `yaml:"postgres"`
+	Audit      AuditConfig      `yaml:"audit"`
+	Follow     FollowConfig     `yaml:"follow"`
+	Standby    StandbyConfig    `yaml:"standby"`
+	Mirror     MirrorConfig     `yaml:"mirror"`
+	Cluster    ClusterConfig    `yaml:"cluster"`
+	Seed       SeedConfig       `yaml:"seed"`
+	Relay      RelayConfig      `yaml:"relay"`
+	Notify     NotifyConfig     `yaml:"notify"`
+	Retention  RetentionConfig  `yaml:"retention"`
+	Expiry     ExpiryConfig     `yaml:"expiry"`
+	Quotas     QuotasConfig     `yaml:"quotas"`
+	Eviction   EvictionConfig   `yaml:"eviction"`
+	Usage      UsageConfig      `yaml:"usage"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Shadow     ShadowConfig     `yaml:"shadow"`
+	Drift      DriftConfig      `yaml:"drift"`
+	Chaos      ChaosConfig      `yaml:"chaos"`
+	Recovery   RecoveryConfig   `yaml:"recovery"`
+	Latency    LatencyConfig    `yaml:"latency"`
+	HotKeys    HotKeysConfig    `yaml:"hot_keys"`
+	Scaling    ScalingConfig    `yaml:"scaling"`
+}
+
+// ListenConfig sets where the server listens.
+type ListenConfig struct {
+	TCP      string    `yaml:"tcp" flag:"listen"`
+	Unix     string    `yaml:"unix" flag:"listen-unix"`
+	UnixMode string    `yaml:"unix_mode" flag:"unix-mode"`
+	TLS      TLSConfig `yaml:"tls"`
+
+	Admin AdminListenConfig `yaml:"admin"`
+}
+
+// AdminListenConfig sets the separate listener of the operational endpoints.
+type AdminListenConfig struct {
+	TCP string         `yaml:"tcp" flag:"admin-listen"`
+	TLS AdminTLSConfig `yaml:"tls"`
+}
+
+// AdminTLSConfig sets the certificate the admin listener is served with,
+// which is reloaded as often as TLSConfig's.
+type AdminTLSConfig struct {
+	Cert string `yaml:"cert" flag:"admin-tls-cert"`
+	Key  string `yaml:"key" flag:"admin-tls-key"`
+}
+
+// TLSConfig sets the certificate TCP connections are served with.
+type TLSConfig struct {
+	Cert           string        `yaml:"cert" flag:"tls-cert"`
+	Key            string        `yaml:"key" flag:"tls-key"`
+	ReloadInterval time.Duration `yaml:"reload_interval" flag:"tls-reload-interval"`
+	ClientCA       string        `yaml:"client_ca" flag:"tls-client-ca"`
+}
+
+// APIConfig sets how the versions of the key API answer.
+type APIConfig struct {
+	V1Compat         string `yaml:"v1_compat" flag:"v1-compat"`
+	ChangesInlineMax int    `yaml:"changes_inline_max" flag:"changes-inline-max"`
+	MaxValueSize     int64  `yaml:"max_value_size" flag:"max-value-size"`
+}
+
+// LimitsConfig sets the limits on concurrent requests.
+type LimitsConfig struct {
+	MaxInflightReads  int           `yaml:"max_inflight_reads" flag:"max-inflight-reads"`
+	MaxInflightWrites int           `yaml:"max_inflight_writes" flag:"max-inflight-writes"`
+	Policy            string        `yaml:"policy" flag:"limit-policy"`
+	Wait              time.Duration `yaml:"wait" flag:"limit-wait"`
+	MinSequenceWait   time.Duration `yaml:"min_sequence_wait" flag:"min-sequence-wait"`
+	MaxDeadline       time.Duration `yaml:"max_deadline" flag:"max-deadline"`
+	ScanCacheBytes    int64         `yaml:"scan_cache_bytes" flag:"scan-cache-bytes"`
+	ScanCacheTTL      time.Duration `yaml:"scan_cache_ttl" flag:"scan-cache-ttl"`
+}
+
+// AuthConfig sets who may use the server.
+type AuthConfig struct {
+	AdminKey   string `yaml:"admin_key" flag:"admin-key"`
+	IPRules    string `yaml:"ip_rules" flag:"ip-rules"`
+	Mode       string `yaml:"mode" flag:"auth"`
+	APIKeys    string `yaml:"api_keys" flag:"api-keys"`
+	MTLSScopes string `yaml:"mtls_scopes" flag:"mtls-scopes"`
+}
+
+// StorageConfig sets how the store keeps its data.
+type StorageConfig struct {
+	DataDir           string `yaml:"data_dir" flag:"data-dir"`
+	InitialKeys       int    `yaml:"initial_keys" flag:"initial-keys"`
+	PageValues        bool   `yaml:"page_values" flag:"page-values"`
+	PageCacheBytes    int64  `yaml:"page_cache_bytes" flag:"page-cache-bytes"`
+	Compress          string `yaml:"compress" flag:"compress"`
+	CompressThreshold int    `yaml:"compress_threshold" flag:"compress-threshold"`
+	BlobThreshold     int    `yaml:"blob_threshold" flag:"blob-threshold"`
+	BlobDir           string `yaml:"blob_dir" flag:"blob-dir"`
+	StrictWrites      bool   `yaml:"strict_writes" flag:"strict-writes"`
+	SkipNoopWrites    bool   `yaml:"skip_noop_writes" flag:"skip-noop-writes"`
+	KeyFolding        string `yaml:"key_folding" flag:"key-folding"`
+	BootMode          string `yaml:"boot_mode" flag:"boot-mode"`
+}
+
+// DurabilityConfig sets how durable the writes clients ask for may be.
+type DurabilityConfig struct {
+	Default      string        `yaml:"default" flag:"durability-default"`
+	Max          string        `yaml:"max" flag:"durability-max"`
+	Keys         string        `yaml:"keys" flag:"durability-keys"`
+	FlushTimeout time.Duration `yaml:"flush_timeout" flag:"durability-flush-timeout"`
+}
+
+// LogConfig sets the transaction log backend.
+type LogConfig struct {
+	Backend          string `yaml:"backend" flag:"log-backend"`
+	FailureThreshold int    `yaml:"failure_threshold" flag:"log-failure-threshold"`
+	FailurePolicy    string `yaml:"failure_policy" flag:"log-failure-policy"`
+	Routes           string `yaml:"routes" flag:"log-routes"`
+
+	ConflictResolution string `yaml:"conflict_resolution" flag:"conflict-resolution"`
+}
+
+// LatencyConfig sets how the phases of writes are timed.
+type LatencyConfig struct {
+	Histograms      bool          `yaml:"histograms" flag:"latency-histograms"`
+	SlowOpThreshold time.Duration `yaml:"slow_op_threshold" flag:"slow-op-threshold"`
+	SlowOpHashKeys  bool          `yaml:"slow_op_hash_keys" flag:"slow-op-hash-keys"`
+}
+
+// HotKeysConfig sets the counting of the operations on each key, to find
+// the hot ones.
+type HotKeysConfig struct {
+	Enabled    bool    `yaml:"enabled" flag:"hot-keys"`
+	Capacity   int     `yaml:"capacity" flag:"hot-keys-capacity"`
+	SampleRate float64 `yaml:"sample_rate" flag:"hot-keys-sample"`
+	HashKeys   bool    `yaml:"hash_keys" flag:"hot-keys-hash-keys"`
+}
+
+// ScalingConfig sets what one instance is meant to handle, for the replicas
+// the scaling signals suggest.
+type ScalingConfig struct {
+	TargetRPS      float64       `yaml:"target_rps" flag:"scaling-target-rps"`
+	TargetP99      time.Duration `yaml:"target_p99" flag:"scaling-target-p99"`
+	TargetLogQueue int64         `yaml:"target_log_queue" flag:"scaling-target-log-queue"`
+	TargetMemory   uint64        `yaml:"target_memory" flag:"scaling-target-memory"`
+}
+
+// PostgresConfig sets the connection of the postgres backends.
+type PostgresConfig struct {
+	Host     string `yaml:"host" flag:"pg-host"`
+	DB       string `yaml:"db" flag:"pg-db"`
+	User     string `yaml:"user" flag:"pg-user"`
+	Password string `yaml:"password" flag:"pg-password"`
+	Table    string `yaml:"table" flag:"pg-table"`
+}
+
+// AuditConfig sets the audit log.
+type AuditConfig struct {
+	Path       string `yaml:"path" flag:"audit-log"`
+	MaxSize    int64  `yaml:"max_size" flag:"audit-max-size"`
+	MaxBackups int    `yaml:"max_backups" flag:"audit-max-backups"`
+	Buffer     int    `yaml:"buffer" flag:"audit-buffer"`
+	Reads      bool   `yaml:"reads" flag:"audit-reads"`
+}
+
+// FollowConfig sets the leader to replicate from.
+type FollowConfig struct {
+	URL    string `yaml:"url" flag:"follow"`
+	APIKey string `yaml:"api_key" flag:"follow-api-key"`
+}
+
+// StandbyConfig sets the snapshot shipping between a primary and a warm
+// standby.
+type StandbyConfig struct {
+	Enabled      bool          `yaml:"enabled" flag:"standby"`
+	ShipTo       string        `yaml:"ship_to" flag:"ship-to"`
+	ShipAPIKey   string        `yaml:"ship_api_key" flag:"ship-api-key"`
+	ShipInterval time.Duration `yaml:"ship_interval" flag:"ship-interval"`
+}
+
+// MirrorConfig sets the log of another process to serve read-only.
+type MirrorConfig struct {
+	Of string `yaml:"of" flag:"mirror-of"`
+}
+
+// ClusterConfig sets the Raft cluster the instance is a member of.
+type ClusterConfig struct {
+	Peers  string `yaml:"peers" flag:"peers"`
+	ID     string `yaml:"id" flag:"cluster-id"`
+	Writes string `yaml:"writes" flag:"cluster-writes"`
+}
+
+// SeedConfig sets the export loaded at startup.
+type SeedConfig struct {
+	Source string `yaml:"source" flag:"seed"`
+	Format string `yaml:"format" flag:"seed-format"`
+	APIKey string `yaml:"api_key" flag:"seed-api-key"`
+	Merge  bool   `yaml:"merge" flag:"seed-merge"`
+}
+
+// RelayConfig sets where logged events are relayed to.
+type RelayConfig struct {
+	Webhook string `yaml:"webhook" flag:"relay-webhook"`
+	Cursor  string `yaml:"cursor" flag:"relay-cursor"`
+}
+
+// NotifyConfig sets how the notifications of bulk operations are
+// coalesced.
+type NotifyConfig struct {
+	Rate    int           `yaml:"rate" flag:"notify-rate"`
+	Window  time.Duration `yaml:"window" flag:"notify-window"`
+	Webhook string        `yaml:"webhook" flag:"notify-webhook"`
+}
+
+// RetentionConfig sets which keys are deleted for not being written.
+type RetentionConfig struct {
+	MaxAge   time.Duration `yaml:"max_age" flag:"retention-max-age"`
+	Prefixes string        `yaml:"prefixes" flag:"retention-prefixes"`
+	Interval time.Duration `yaml:"interval" flag:"retention-interval"`
+	Rate     int           `yaml:"rate" flag:"retention-rate"`
+	DryRun   bool          `yaml:"dry_run" flag:"retention-dry-run"`
+}
+
+// ExpiryConfig sets how often the keys put with a TTL are deleted once
+// they expire.
+type ExpiryConfig struct {
+	Interval time.Duration `yaml:"interval" flag:"expiry-interval"`
+}
+
+// QuotasConfig sets the limits on the size of buckets.
+type QuotasConfig struct {
+	Buckets      string        `yaml:"buckets" flag:"bucket-quotas"`
+	WarnRatio    float64       `yaml:"warn_ratio" flag:"quota-warn-ratio"`
+	WarnInterval time.Duration `yaml:"warn_interval" flag:"quota-warn-interval"`
+}
+
+// EvictionConfig sets the limits on the size of the whole store, past which
+// the keys used longest ago are evicted.
+type EvictionConfig struct {
+	MaxKeys  int   `yaml:"max_keys" flag:"evict-max-keys"`
+	MaxBytes int64 `yaml:"max_bytes" flag:"evict-max-bytes"`
+}
+
+// UsageConfig sets the accounting of what each principal uses, for
+// billing.
+type UsageConfig struct {
+	Backend   string        `yaml:"backend" flag:"usage"`
+	File      string        `yaml:"file" flag:"usage-file"`
+	Retention time.Duration `yaml:"retention" flag:"usage-retention"`
+	Interval  time.Duration `yaml:"interval" flag:"usage-interval"`
+	Owners    string        `yaml:"owners" flag:"usage-owners"`
+}
+
+// EncryptionConfig sets the keys values are encrypted with.
+type EncryptionConfig struct {
+	MasterKey     string `yaml:"master_key" flag:"master-key"`
+	MasterKeyFile string `yaml:"master_key_file" flag:"master-key-file"`
+	Keyring       string `yaml:"keyring" flag:"keyring"`
+}
+
+// ShadowConfig sets the store verified against the one in use before a
+// migration.
+type ShadowConfig struct {
+	Backend       string        `yaml:"backend" flag:"shadow-backend"`
+	DataDir       string        `yaml:"data_dir" flag:"shadow-data-dir"`
+	SamplePercent float64       `yaml:"sample_percent" flag:"shadow-sample-percent"`
+	Budget        time.Duration `yaml:"budget" flag:"shadow-budget"`
+}
+
+// DriftConfig sets the sampler spot-checking the store against its
+// transaction log.
+type DriftConfig struct {
+	SampleKeys     int           `yaml:"sample_keys" flag:"drift-sample-keys"`
+	SampleInterval time.Duration `yaml:"sample_interval" flag:"drift-sample-interval"`
+	Window         int64         `yaml:"window" flag:"drift-window"`
+	Threshold      int           `yaml:"threshold" flag:"drift-threshold"`
+}
+
+// ChaosConfig sets the fault injection for testing clients.
+type ChaosConfig struct {
+	Enabled bool   `yaml:"enabled" flag:"chaos"`
+	Rules   string `yaml:"rules" flag:"chaos-rules"`
+}
+
+// RecoveryConfig sets the point in the log the store is recovered to.
+type RecoveryConfig struct {
+	UntilSeq  uint64 `yaml:"until_seq" flag:"replay-until-seq"`
+	UntilTime string `yaml:"until_time" flag:"replay-until-time"`
+	Compact   bool   `yaml:"compact" flag:"replay-compact"`
+}
+
+// secretFlags are the flags whose values -print-config redacts.
+var secretFlags = map[string]bool{
+	"admin-key":      true,
+	"follow-api-key": true,
+	"master-key":     true,
+	"ship-api-key":   true,
+	"seed-api-key":   true,
+	"pg-password":    true,
+}
+
+// envPrefix starts the name of the environment variable setting each flag,
+// which continues with the flag's name in upper case with dashes as
+// underscores: KV_ADMIN_KEY sets -admin-key.
+const envPrefix = "KV_"
+
+// applyEnv sets the flags given by environment variables, which take
+// precedence over the command line, and adds their names to fixed.
+func applyEnv(fixed map[string]bool) error {
+	var err error
+
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+
+		if err = f.Value.Set(value); err != nil {
+			err = fmt.Errorf("%s: invalid value %q: %w", name, value, err)
+			return
+		}
+
+		fixed[f.Name] = true
+	})
+
+	return err
+}
+
+// configSetting is a flag's setting in a -config file.
+type configSetting struct {
+	value string
+	key   string // Name of the setting in the file
+	pos   string // File and line of the setting, for error messages
+}
+
+// configFile sets the flags not given on the command line or by the
+// environment from a file. Files named *.yaml, *.yml or *.json hold a Config;
+// any other file holds "name=value" lines of flag settings, where blank lines
+// and lines starting with # are skipped.
+type configFile struct {
+	path    string
+	fixed   map[string]bool   // Flags given on the command line or by the environment, which the file can't override
+	applied map[string]string // Settings taken from the file, by flag name
+}
+
+// newConfigFile returns the configFile at path, which leaves the flags in
+// fixed alone.
+func newConfigFile(path string, fixed map[string]bool) *configFile {
+	return &configFile{path: path, fixed: fixed}
+}
+
+// read parses the file into settings by flag name.
+func (c *configFile) read() (map[string]configSetting, error) {
+	switch strings.ToLower(filepath.Ext(c.path)) {
+	case ".yaml", ".yml", ".json":
+		return c.readStructured()
+	default:
+		return c.readLines()
+	}
+}
+
+// readLines parses a file of name=value lines.
+func (c *configFile) readLines() (map[string]configSetting, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	settings := make(map[string]configSetting)
+	scanner := bufio.NewScanner(f)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected name=value", c.path, lineNo)
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", c.path, lineNo, name)
+		}
+
+		settings[name] = configSetting{
+			value: strings.TrimSpace(value),
+			key:   name,
+			pos:   fmt.Sprintf("%s:%d", c.path, lineNo),
+		}
+	}
+
+	return settings, scanner.Err()
+}
+
+// readStructured parses a YAML file, or a JSON one, as JSON is also YAML,
+// checking it against the layout of Config. Unknown settings are errors, so
+// that a misspelt one isn't silently ignored.
+func (c *configFile) readStructured() (map[string]configSetting, error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.path, err)
+	}
+
+	settings := make(map[string]configSetting)
+
+	// An empty file has no content
+	if len(doc.Content) == 0 {
+		return settings, nil
+	}
+
+	if err := c.walk(doc.Content[0], reflect.TypeOf(Config{}), "", settings); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// walk adds the settings in node, a mapping laid out like the struct type t,
+// to settings. prefix is the dotted name of the mapping in the file.
+func (c *configFile) walk(node *yaml.Node, t reflect.Type, prefix string, settings map[string]configSetting) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: %s: expected a mapping of settings", c.path, node.Line, strings.TrimSuffix(prefix, "."))
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		key := prefix + keyNode.Value
+
+		field, ok := configField(t, keyNode.Value)
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown setting %q", c.path, keyNode.Line, key)
+		}
+
+		name := field.Tag.Get("flag")
+		if name == "" {
+			if err := c.walk(valueNode, field.Type, key+".", settings); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if valueNode.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%s:%d: %s: expected a single value", c.path, valueNode.Line, key)
+		}
+		if _, ok := settings[name]; ok {
+			return fmt.Errorf("%s:%d: %s is set twice", c.path, keyNode.Line, key)
+		}
+
+		value := valueNode.Value
+		if valueNode.Tag == "!!null" {
+			value = ""
+		}
+
+		settings[name] = configSetting{value: value, key: key, pos: fmt.Sprintf("%s:%d", c.path, valueNode.Line)}
+	}
+
+	return nil
+}
+
+// configField returns the field of the struct type t named key in a file.
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Tag.Get("yaml") == key {
+			return f, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// set sets a flag to its setting in the file.
+func (c *configFile) set(name string, s configSetting) error {
+	if err := flag.Set(name, s.value); err != nil {
+		return fmt.Errorf("%s: %s: invalid value %q: %w", s.pos, s.key, s.value, err)
+	}
+
+	return nil
+}
+
+// printConfig writes the settings in effect to w as a YAML -config file,
+// with secrets redacted.
+func printConfig(w io.Writer) error {
+	var cfg Config
+	fillConfig(reflect.ValueOf(&cfg).Elem())
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// fillConfig sets every setting in v, a Config or one of its sections, from
+// its flag.
+func fillConfig(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("flag")
+		if name == "" {
+			fillConfig(v.Field(i))
+			continue
+		}
+
+		value := flag.Lookup(name).Value.(flag.Getter).Get()
+		if secretFlags[name] && value != "" {
+			value = "REDACTED"
+		}
+
+		v.Field(i).Set(reflect.ValueOf(value).Convert(v.Field(i).Type()))
+	}
+}
+
+// changedFlags returns the values of the flags set to other than their
+// default, by name, with secrets redacted.
+func changedFlags() map[string]string {
+	changed := make(map[string]string)
+
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == f.DefValue {
+			return
+		}
+
+		if secretFlags[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+		changed[f.Name] = value
+	})
+
+	return changed
+}
+
+// load applies every setting in the file, at startup.
+func (c *configFile) load() error {
+	settings, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	c.applied = make(map[string]string)
+
+	for name, s := range settings {
+		if c.fixed[name] {
+			continue
+		}
+
+		if err := c.set(name, s); err != nil {
+			return err
+		}
+
+		c.applied[name] = s.value
+	}
+
+	return nil
+}
+
+// reload re-reads the file and applies its reloadable settings, then calls
+// apply to put them into effect. A reloadable setting removed from the file
+// reverts to its default, and changes to the other settings are logged as
+// ignored. If anything fails, the flags are left as they were.
+func (c *configFile) reload(apply func() error) error {
+	settings, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]string)
+	for name := range reloadableFlags {
+		previous[name] = flag.Lookup(name).Value.String()
+	}
+
+	restore := func() {
+		for name, value := range previous {
+			flag.Set(name, value)
+		}
+	}
+
+	for name := range reloadableFlags {
+		if c.fixed[name] {
+			continue
+		}
+
+		s, ok := settings[name]
+		if !ok {
+			s = configSetting{value: flag.Lookup(name).DefValue, key: name, pos: c.path}
+		}
+
+		if err := c.set(name, s); err != nil {
+			restore()
+			return err
+		}
+	}
+
+	if err := apply(); err != nil {
+		restore()
+		return err
+	}
+
+	for name, s := range settings {
+		if !reloadableFlags[name] && !c.fixed[name] && s.value != c.applied[name] {
+			log.Printf("config reload: ignoring the change to -%s, which needs a restart\n", name)
+		}
+	}
+
+	applied := make(map[string]string)
+	for name, value := range c.applied {
+		if !reloadableFlags[name] {
+			applied[name] = value
+		}
+	}
+	for name, s := range settings {
+		if reloadableFlags[name] && !c.fixed[name] {
+			applied[name] = s.value
+		}
+	}
+	c.applied = applied
+
+	return nil
+}
+
+// reloadOnSignal rotates the transaction log and calls reload each time the
+// process receives SIGHUP, until ctx is done. A failed reload keeps the
+// previous settings.
+func reloadOnSignal(ctx context.Context, logger translog.TransactionLogger, reload func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			if r, ok := logger.(translog.Rotator); ok {
+				if err := r.Rotate(ctx); err != nil {
+					log.Printf("transaction log rotation failed: %v\n", err)
+				} else {
+					log.Println("transaction log rotated")
+				}
+			}
+
+			if err := reload(); err != nil {
+				log.Printf("config reload failed, keeping previous settings: %v\n", err)
+				continue
+			}
+
+			log.Println("config reloaded")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runBinary runs the binary with args and the KV_* variables of env only,
+// returning its standard output, its standard error, and whether it
+// succeeded.
+func runBinary(t *testing.T, binary string, env []string, args ...string) (string, string, bool) {
+	t.Helper()
+
+	cmd := exec.Command(binary, args...)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+
+	return stdout.String(), stderr.String(), err == nil
+}
+
+// writeConfig writes a config file named name with content, returning its
+// path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	binary := buildBinary(t)
+
+	t.Run("precedence", func(t *testing.T) {
+		path := writeConfig(t, "kv.yaml", `
+limits:
+  max_inflight_reads: 5
+  max_inflight_writes: 6
+  policy: reject
+  wait: 3s
+auth:
+  admin_key: from-the-file
+`)
+
+		// The environment overrides the command line, which overrides the
+		// file, which overrides the defaults
+		stdout, stderr, ok := runBinary(t, binary,
+			[]string{"KV_MAX_INFLIGHT_READS=9", "KV_LIMIT_WAIT=2s"},
+			"-config", path, "-max-inflight-writes", "7", "-limit-wait", "1s", "-print-config")
+		if !ok {
+			t.Fatalf("-print-config failed: %s", stderr)
+		}
+
+		var cfg Config
+		if err := yaml.Unmarshal([]byte(stdout), &cfg); err != nil {
+			t.Fatalf("-print-config printed an invalid file: %v\n%s", err, stdout)
+		}
+
+		l := cfg.Limits
+		if l.MaxInflightReads != 9 || l.MaxInflightWrites != 7 || l.Policy != "reject" || l.Wait.String() != "2s" {
+			t.Errorf("limits %+v; want reads 9 from the environment, writes 7 from the command line, policy reject from the file and wait 2s from the environment", l)
+		}
+		if cfg.Limits.ScanCacheTTL == 0 || cfg.Storage.DataDir != "." {
+			t.Errorf("settings set nowhere don't have their defaults: %+v, %+v", cfg.Limits, cfg.Storage)
+		}
+		if cfg.Auth.AdminKey != "REDACTED" || strings.Contains(stdout, "from-the-file") {
+			t.Errorf("-print-config didn't redact the admin key:\n%s", stdout)
+		}
+
+		// What it prints is a file that sets the same
+		again, stderr, ok := runBinary(t, binary, nil, "-config", writeConfig(t, "printed.yaml", stdout), "-print-config")
+		if !ok || again != stdout {
+			t.Errorf("the printed config loads as\n%s\nnot\n%s%s", again, stdout, stderr)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			content string
+			want    string
+		}{
+			{"kv.yaml", "limits:\n  max_inflight_read: 5\n", `kv.yaml:2: unknown setting "limits.max_inflight_read"`},
+			{"kv.yaml", "limit:\n  wait: 1s\n", `kv.yaml:1: unknown setting "limit"`},
+			{"kv.yaml", "limits:\n  policy: reject\n  wait: soon\n", `kv.yaml:3: limits.wait: invalid value "soon"`},
+			{"kv.yaml", "limits: 5\n", `kv.yaml:1: limits: expected a mapping of settings`},
+			{"kv.json", `{"limits": {"max_inflight_reads": "many"}}`, `kv.json:1: limits.max_inflight_reads: invalid value "many"`},
+			{"kv.conf", "# comment\nmax-inflight-read=5\n", `kv.conf:2: unknown flag "max-inflight-read"`},
+		}
+
+		for _, tt := range tests {
+			path := writeConfig(t, tt.name, tt.content)
+
+			_, stderr, ok := runBinary(t, binary, nil, "-config", path, "-print-config")
+			if ok || !strings.Contains(stderr, tt.want) {
+				t.Errorf("%s with %q: succeeded %v, output %q; want it to fail with %q", tt.name, tt.content, ok, stderr, tt.want)
+			}
+		}
+
+		// So do bad values in the environment
+		_, stderr, ok := runBinary(t, binary, []string{"KV_LIMIT_WAIT=soon"}, "-print-config")
+		if ok || !strings.Contains(stderr, `KV_LIMIT_WAIT: invalid value "soon"`) {
+			t.Errorf("KV_LIMIT_WAIT=soon: succeeded %v, output %q", ok, stderr)
+		}
+	})
+}
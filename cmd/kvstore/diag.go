@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/kvclient"
+	"log"
+	"os"
+	"time"
+)
+
+// maxLogErrors bounds the logger errors kept for diagnostics bundles.
+const maxLogErrors = 100
+
+// diag implements "kvstore diag", which saves the diagnostics bundle of a
+// running instance, to share with support without sharing its data.
+func diag(args []string) error {
+	flags := flag.NewFlagSet("diag", flag.ExitOnError)
+	out := flags.String("o", "", "bundle to write; defaults to kvstore-diag-TIME.tar.gz in the current directory")
+	server := flags.String("server", "", "base URL of the running instance (required)")
+	apiKey := flags.String("api-key", os.Getenv("KV_ADMIN_KEY"), "admin API key of the instance")
+	events := flags.Int("events", 100, "number of the last transaction log events to include, obfuscated")
+	timeout := flags.Duration("timeout", time.Minute, "how long to wait for the bundle")
+	flags.Parse(args)
+
+	if *server == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore diag -server URL [-o FILE] [-events N]")
+	}
+
+	if *out == "" {
+		*out = fmt.Sprintf("kvstore-diag-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	c := kvclient.New(*server, kvclient.WithAPIKey(*apiKey), kvclient.WithTimeout(*timeout))
+
+	var buf bytes.Buffer
+	if err := c.Diag(ctx, *events, &buf); err != nil {
+		return fmt.Errorf("fetching the bundle of %s: %w", *server, err)
+	}
+
+	if err := writeFileAtomic(*out, buf.Bytes()); err != nil {
+		return err
+	}
+
+	log.Printf("wrote the diagnostics bundle of %s to %s (%d bytes)\n", *server, *out, buf.Len())
+
+	return nil
+}
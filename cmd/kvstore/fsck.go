@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"github.com/sheritzs/key-value-store/kvclient"
+	"log"
+	"os"
+	"time"
+)
+
+// fsck implements "kvstore fsck", which checks a running instance against
+// its transaction log through its API, or a snapshot file against the data
+// directory it was taken from. The JSON report goes to stdout and a summary
+// to stderr; divergence is an error, so the exit code is non-zero.
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	server := flags.String("server", "", "base URL of a running instance to check; if empty, -snapshot is checked against -data-dir")
+	apiKey := flags.String("api-key", os.Getenv("KV_ADMIN_KEY"), "admin API key of the instance given by -server")
+	dataDir := flags.String("data-dir", ".", "data directory whose log the snapshot is checked against")
+	snapshot := flags.String("snapshot", "", "snapshot file to check")
+	repair := flags.Bool("repair", false, "reset divergent keys to the log's values; a checked snapshot file is rewritten")
+	timeout := flags.Duration("timeout", time.Minute, "how long to wait for a running instance's check")
+	flags.Parse(args)
+
+	if (*server == "") == (*snapshot == "") || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore fsck [-repair] (-server URL | -snapshot FILE [-data-dir DIR])")
+	}
+
+	var report store.CheckReport
+	var err error
+
+	if *server != "" {
+		report, err = fsckServer(*server, *apiKey, *timeout, *repair)
+	} else {
+		report, err = fsckSnapshot(*snapshot, *dataDir, *repair)
+	}
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	counts := make(map[string]int)
+	for _, d := range report.Divergences {
+		counts[d.Kind]++
+	}
+
+	log.Printf("checked %d keys at sequence %d: %d differ, %d missing, %d extra, %d repaired\n",
+		report.Keys, report.Sequence, counts[store.DivergenceDiffers], counts[store.DivergenceMissing],
+		counts[store.DivergenceExtra], report.Repaired)
+
+	if len(report.Divergences) > 0 {
+		return fmt.Errorf("%d keys diverge from the transaction log", len(report.Divergences))
+	}
+
+	return nil
+}
+
+// fsckServer runs a check on a running instance.
+func fsckServer(server, apiKey string, timeout time.Duration, repair bool) (store.CheckReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c := kvclient.New(server, kvclient.WithAPIKey(apiKey), kvclient.WithTimeout(timeout))
+
+	var report store.CheckReport
+	var buf bytes.Buffer
+
+	if err := c.Fsck(ctx, repair, &buf); err != nil {
+		return report, fmt.Errorf("checking %s: %w", server, err)
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		return report, fmt.Errorf("invalid check report: %w", err)
+	}
+
+	return report, nil
+}
+
+// fsckSnapshot checks a snapshot file against the replay of dataDir up to
+// the snapshot's sequence, and with repair set replaces it with the replay.
+func fsckSnapshot(path, dataDir string, repair bool) (store.CheckReport, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return store.CheckReport{}, err
+	}
+
+	snap := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	if err := snap.Restore(bytes.NewReader(b)); err != nil {
+		return store.CheckReport{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	ref, err := store.Replay(dataDir, snap.Sequence())
+	if err != nil {
+		return store.CheckReport{}, err
+	}
+
+	report := snap.Compare(ref)
+
+	if repair && len(report.Divergences) > 0 {
+		var buf bytes.Buffer
+		if err := ref.Snapshot(&buf); err != nil {
+			return report, err
+		}
+
+		if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+			return report, err
+		}
+
+		report.Repaired = len(report.Divergences)
+	}
+
+	return report, nil
+}
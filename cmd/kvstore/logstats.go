@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"github.com/sheritzs/key-value-store/kvclient"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// logScanner returns the function reading the log of the named backend,
+// file or postgres, for log stats. The file backend keeps its log in
+// dataDir.
+func logScanner(backend, dataDir string, pgParams translog.PostgresdDBParams) func(fn func(translog.Event) error) error {
+	if backend == "postgres" {
+		return func(fn func(translog.Event) error) error {
+			return translog.ScanPostgres(pgParams, fn)
+		}
+	}
+
+	path := filepath.Join(dataDir, translog.LogFileName)
+
+	return func(fn func(translog.Event) error) error {
+		return translog.ScanLog(path, fn)
+	}
+}
+
+// logStats implements "kvstore log-stats", which reports how much of a
+// transaction log is still needed, as translog.LogStats describes, to tell
+// whether it's worth compacting. It asks a running instance through its
+// API, or reads the log itself, streaming it, from -data-dir or Postgres;
+// either way the log's writer isn't disturbed. The JSON stats go to stdout
+// and a summary to stderr.
+func logStats(args []string) error {
+	flags := flag.NewFlagSet("log-stats", flag.ExitOnError)
+	server := flags.String("server", "", "base URL of a running instance to ask; if empty, the log is read from -data-dir or Postgres")
+	apiKey := flags.String("api-key", os.Getenv("KV_ADMIN_KEY"), "admin API key of the instance given by -server")
+	timeout := flags.Duration("timeout", 10*time.Minute, "how long to wait for a running instance's analysis")
+	backend := &choiceValue{value: "file", choices: []string{"file", "postgres"}}
+	flags.Var(backend, "log-backend", "transaction log backend to read: file or postgres")
+	dataDir := flags.String("data-dir", ".", "data directory of the file log")
+	top := flags.Int("top", translog.DefaultTopChurners, "number of keys with the most records to list")
+
+	var pgParams translog.PostgresdDBParams
+	flags.StringVar(&pgParams.Host, "pg-host", "localhost", "Postgres host for the postgres backend")
+	flags.StringVar(&pgParams.DBName, "pg-db", "kvs", "Postgres database for the postgres backend")
+	flags.StringVar(&pgParams.User, "pg-user", "kvs", "Postgres user for the postgres backend")
+	flags.StringVar(&pgParams.Password, "pg-password", "", "Postgres password for the postgres backend")
+	flags.StringVar(&pgParams.Table, "pg-table", translog.DefaultPostgresTable, "table of the postgres backend")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || *top < 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore log-stats [-top N] (-server URL | [-log-backend file|postgres] [-data-dir DIR])")
+	}
+
+	var stats translog.LogStats
+
+	if *server != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+
+		c := kvclient.New(*server, kvclient.WithAPIKey(*apiKey), kvclient.WithTimeout(*timeout))
+
+		var buf bytes.Buffer
+		if err := c.LogStats(ctx, *top, &buf); err != nil {
+			return fmt.Errorf("analyzing the log of %s: %w", *server, err)
+		}
+
+		if err := json.Unmarshal(buf.Bytes(), &stats); err != nil {
+			return fmt.Errorf("invalid log stats: %w", err)
+		}
+	} else {
+		a := translog.NewLogAnalyzer(0)
+		if err := logScanner(backend.value, *dataDir, pgParams)(a.Add); err != nil {
+			return err
+		}
+
+		stats = a.Stats(*top)
+	}
+
+	out, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	log.Printf("%d records, %d bytes, up to sequence %d: %d live keys of %d, about %d bytes once compacted (%.2fx)\n",
+		stats.Records, stats.Bytes, stats.Sequence, stats.LiveKeys, stats.DistinctKeys,
+		stats.EstimatedCompactedBytes, stats.Amplification)
+
+	return nil
+}
@@ -0,0 +1,1222 @@
+// Command kvstore runs the key-value store's HTTP server.
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/cluster"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/crypt"
+	"github.com/sheritzs/key-value-store/internal/hotkeys"
+	"github.com/sheritzs/key-value-store/internal/pgstate"
+	"github.com/sheritzs/key-value-store/internal/relay"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"github.com/sheritzs/key-value-store/internal/usage"
+	"github.com/sheritzs/key-value-store/internal/version"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// newTransactionLogger creates the logger for the named backend. The file
+// backend keeps its log in dataDir.
+func newTransactionLogger(backend, dataDir string, pgParams translog.PostgresdDBParams, health *translog.Health) (translog.TransactionLogger, error) {
+	switch backend {
+	case "file":
+		return translog.NewFileTransactionLogger(filepath.Join(dataDir, translog.LogFileName), health)
+	case "postgres":
+		return translog.NewPostgresTransactionLogger(pgParams, health)
+	default:
+		return nil, fmt.Errorf("unknown log backend %q", backend)
+	}
+}
+
+// choiceValue is a string flag restricted to a set of values, so that a bad
+// value is rejected wherever it's set from.
+type choiceValue struct {
+	value   string
+	choices []string
+}
+
+func (c *choiceValue) Set(s string) error {
+	if !slices.Contains(c.choices, s) {
+		return fmt.Errorf("must be one of %s", strings.Join(c.choices, ", "))
+	}
+
+	c.value = s
+
+	return nil
+}
+
+func (c *choiceValue) String() string { return c.value }
+
+func (c *choiceValue) Get() any { return c.value }
+
+// choiceFlag defines a string flag that can only be set to one of choices.
+func choiceFlag(name, value, usage string, choices ...string) *string {
+	c := &choiceValue{value: value, choices: choices}
+	flag.Var(c, name, usage)
+
+	return &c.value
+}
+
+// subcommands run instead of the server when named by the first argument.
+// processStart is about when the process started: package variables are
+// initialized before main runs.
+var processStart = time.Now()
+
+var subcommands = map[string]func(args []string) error{
+	"backup":         backup,
+	"restore":        restore,
+	"fsck":           fsck,
+	"restore-to":     restoreTo,
+	"diag":           diag,
+	"selftest":       selftest,
+	"verify-install": verifyInstall,
+	"log-stats":      logStats,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	listenAddr := flag.String("listen", ":8080", "TCP address to listen on; empty disables TCP")
+	unixPath := flag.String("listen-unix", "", "path of a Unix domain socket to listen on")
+	unixMode := flag.String("unix-mode", "0660", "permissions of the Unix domain socket file")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve TCP connections over TLS with, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "PEM private key of the -tls-cert")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", 30*time.Second, "how often to check the -tls-cert and -tls-key files for a new certificate")
+	adminListenAddr := flag.String("admin-listen", "", "TCP address of a separate listener for readiness, metrics, profiles, stats and the admin, export and replication endpoints, which the -listen addresses then stop serving")
+	adminTLSCert := flag.String("admin-tls-cert", "", "PEM certificate to serve the -admin-listen address over TLS with, reloaded when it changes")
+	adminTLSKey := flag.String("admin-tls-key", "", "PEM private key of the -admin-tls-cert")
+	maxReads := flag.Int("max-inflight-reads", 0, "maximum concurrent GET/HEAD requests; 0 is unlimited")
+	maxWrites := flag.Int("max-inflight-writes", 0, "maximum concurrent write requests; 0 is unlimited")
+	limitPolicy := choiceFlag("limit-policy", "wait", "what to do with requests over the limit: wait or reject", "wait", "reject")
+	limitWait := flag.Duration("limit-wait", 100*time.Millisecond, "how long a request over the limit waits for a slot under the wait policy")
+	minSequenceWait := flag.Duration("min-sequence-wait", time.Second, "how long a read waits for the sequence in its X-KV-Min-Sequence header to be applied; 0 rejects it at once")
+	maxDeadline := flag.Duration("max-deadline", api.DefaultMaxDeadline, "longest deadline a request's X-KV-Deadline-Ms header may ask for; longer ones are cut to it")
+	scanCacheBytes := flag.Int64("scan-cache-bytes", 0, "memory budget in bytes of a cache of key listings and snapshot reads, which any write invalidates, for dashboards repeating the same scans; 0 disables the cache")
+	scanCacheTTL := flag.Duration("scan-cache-ttl", api.DefaultScanCacheTTL, "longest time a -scan-cache-bytes result is served, even if the store doesn't change")
+	v1Compat := choiceFlag("v1-compat", api.V1CompatStrict, "how /v1 answers while clients move to /v2: strict keeps its plain text errors and 201 for every put, modern answers as /v2 does", api.V1CompatStrict, api.V1CompatModern)
+	maxValueSize := flag.Int64("max-value-size", api.DefaultMaxValueSize, "largest body, in bytes, a PUT or PATCH of a key may carry; larger ones are answered 413")
+	changesInlineMax := flag.Int("changes-inline-max", api.DefaultChangesInlineMax, "largest value, in bytes, a page of "+api.ChangesPath+" holds; larger ones are referred to by the path to read them from")
+	scalingRPS := flag.Float64("scaling-target-rps", 0, "key API requests per second one instance is meant to serve, for the replicas "+api.ScalingSignalsPath+" suggests; 0 ignores the request rate")
+	scalingP99 := flag.Duration("scaling-target-p99", 0, "99th percentile latency of the key API one instance is meant to stay under, for the replicas "+api.ScalingSignalsPath+" suggests; 0 ignores latency")
+	scalingLogQueue := flag.Int64("scaling-target-log-queue", 0, "transaction log queue depth one instance is meant to stay under, for the replicas "+api.ScalingSignalsPath+" suggests; 0 ignores the queue")
+	scalingMemory := flag.Uint64("scaling-target-memory", 0, "memory in bytes one instance is meant to stay under, for the replicas "+api.ScalingSignalsPath+" suggests; 0 ignores memory")
+	compressCodec := flag.String("compress", "none", "compression for large values: none, gzip or zlib")
+	compressThreshold := flag.Int("compress-threshold", 4096, "minimum value size in bytes to compress")
+	blobThreshold := flag.Int("blob-threshold", 0, "size in bytes, once compressed and encrypted, from which values are kept as files in -blob-dir and only referred to in the transaction log; 0 keeps every value in the log")
+	blobDir := flag.String("blob-dir", "", "directory of the values kept as files under -blob-threshold; defaults to "+blob.DirName+" in -data-dir")
+	initialKeys := flag.Int("initial-keys", 0, "number of keys to preallocate room for, to avoid rehashing while the store grows")
+	pageValues := flag.Bool("page-values", false, "index the values of the snapshot at startup rather than read them into memory, and read them from the snapshot as they are needed; values written since are kept in memory")
+	pageCacheBytes := flag.Int64("page-cache-bytes", store.DefaultPageCacheBytes, "most bytes of values read under -page-values kept in memory")
+	ipRulesPath := flag.String("ip-rules", "", "file of allow/deny/trust CIDR rules for client IPs, reloaded on SIGHUP")
+	adminKey := flag.String("admin-key", "", "API key required by admin endpoints; admin endpoints are disabled if empty, unless -auth=mtls grants admin")
+	authMode := choiceFlag("auth", "api-key", "how requests are authenticated: api-key, by the -admin-key and the keys in -api-keys, or mtls, by client certificates issued by -tls-client-ca, with the -admin-key granting admin all the same", "api-key", "mtls")
+	apiKeysPath := flag.String("api-keys", "", "file of API keys under -auth=api-key, one per line as the key and the id of whoever presents it in X-API-Key, optionally with scopes as -mtls-scopes gives them, such as \"s3cret ops=admin+unlimited\"; other keys are rejected, save the -admin-key")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM bundle of the CAs that issue client certificates, required by -auth=mtls; clients without a certificate are anonymous")
+	mtlsScopes := flag.String("mtls-scopes", "", "comma-separated scopes of client certificate identities under -auth=mtls, joined by +, such as spiffe://example.org/ops=admin+unlimited; an identity is the certificate's first URI, DNS or email SAN, else its common name")
+	dataDir := flag.String("data-dir", ".", "directory of the transaction log and of any snapshot restored from a backup")
+	bootMode := choiceFlag("boot-mode", "strict", "what to do with damaged transaction log records at startup: strict refuses to start, permissive skips them and starts degraded", "strict", "permissive")
+	logBackend := choiceFlag("log-backend", "file", "transaction log backend: file, postgres, postgres-state or none", "file", "postgres", "postgres-state", "none")
+	logFailureThreshold := flag.Int("log-failure-threshold", 3, "consecutive transaction log write failures before the log is reported unhealthy")
+	logRoutesPath := flag.String("log-routes", "", "JSON file of key prefixes whose events go to file logs of their own in -data-dir/"+translog.RoutedLogDir+", each with its own sync, rotation and retention; requires -log-backend=file")
+	keyFoldingName := choiceFlag("key-folding", "none", "normalize keys so that keys differing only in case are one key: none, ascii (lower-case A to Z) or unicode (full case folding); startup fails if stored keys collide", "none", "ascii", "unicode")
+	strictWrites := flag.Bool("strict-writes", false, "wait for each write to be durable in the transaction log before applying and acknowledging it")
+	skipNoopWrites := flag.Bool("skip-noop-writes", false, "answer puts of the value a key already has without logging them, with 200 and "+api.NoopHeader+": true")
+	durabilityDefault := choiceFlag("durability-default", "enqueue", "durability of the puts and deletes of keys without an "+api.DurabilityHeader+" header: none (memory only, lost on restart), enqueue (logged, durable at the next flush) or flush (acknowledged once durable); lowered to -durability-max", "none", "enqueue", "flush")
+	durabilityMax := choiceFlag("durability-max", "flush", "highest durability an "+api.DurabilityHeader+" header may ask for: none, enqueue or flush", "none", "enqueue", "flush")
+	durabilityKeys := flag.String("durability-keys", "", "JSON file of the highest durability each API key may ask for, such as {\"telemetry-key\": \"enqueue\"}, overriding -durability-max for requests with that X-API-Key")
+	flushTimeout := flag.Duration("durability-flush-timeout", api.DefaultFlushTimeout, "how long a write with durability flush waits for the log to be durable before answering 504, the write staying applied")
+	conflictResolution := choiceFlag("conflict-resolution", "overwrite", "what to do with an event replayed or replicated for a key modified after the event was logged, as when instances with skewed clocks share a log: overwrite, applying every event, or last-writer-wins", "overwrite", "last-writer-wins")
+	logFailurePolicy := choiceFlag("log-failure-policy", "reject", "what to do with writes while the transaction log is unhealthy: reject or warn", "reject", "warn")
+	auditPath := flag.String("audit-log", "", "file to append an audit record of every mutating request to; empty disables auditing")
+	auditMaxSize := flag.Int64("audit-max-size", 100<<20, "size in bytes at which the audit log is rotated; 0 disables rotation")
+	auditBackups := flag.Int("audit-max-backups", 5, "number of rotated audit log files to keep")
+	auditBuffer := flag.Int("audit-buffer", 1024, "audit records buffered before new ones are dropped")
+	auditReads := flag.Bool("audit-reads", false, "audit GET and HEAD requests too")
+	followURL := flag.String("follow", "", "base URL of a leader to replicate from; the instance is read-only while following")
+	followKey := flag.String("follow-api-key", "", "admin API key of the leader given by -follow")
+	standby := flag.Bool("standby", false, "run read-only as a warm standby, serving the snapshots a primary pushes to "+replication.RestoreSnapshotPath+"; requires -admin-key")
+	shipTo := flag.String("ship-to", "", "base URL of a warm standby to push this instance's snapshot to every -ship-interval")
+	shipKey := flag.String("ship-api-key", "", "admin API key of the standby given by -ship-to")
+	shipInterval := flag.Duration("ship-interval", time.Minute, "time between snapshot pushes to the -ship-to standby")
+	peers := flag.String("peers", "", "comma-separated members of a Raft cluster this instance is one of, each as id=raft-address=http-url, such as a=10.0.0.1:7000=http://10.0.0.1:8080; writes go through the Raft log in -data-dir/"+cluster.DirName+" instead of the transaction log, and only the leader takes them; empty runs a single instance")
+	clusterID := flag.String("cluster-id", "", "ID of this instance among the -peers")
+	clusterWrites := choiceFlag("cluster-writes", api.ClusterRedirect, "how a member of the -peers cluster that isn't the leader answers writes, and reads with ?"+api.ConsistencyParam+"="+api.ConsistencyLeader+": redirect answers 307 with the leader's URL, proxy passes the request on to the leader", api.ClusterRedirect, api.ClusterProxy)
+	mirrorOf := flag.String("mirror-of", "", "transaction log file of a primary in another process to serve read-only, replaying it and then applying what the primary appends; -data-dir is taken to be the log's directory, whose snapshot and blobs are read too")
+	seed := flag.String("seed", "", "file or http(s) URL of a plain export, such as another instance's /v1/export, to load and log at startup; keys already stored with the same value are skipped, so it may stay set across restarts")
+	seedFormat := choiceFlag("seed-format", "jsonl", "format of -seed: jsonl, a plain export, or resp, a stream of Redis commands such as a redis-cli --pipe mass-insert file, whose string keys are loaded into the default bucket", "jsonl", "resp")
+	seedKey := flag.String("seed-api-key", "", "admin API key of the instance given by a -seed URL")
+	seedMerge := flag.Bool("seed-merge", false, "keep the stored value of keys -seed has another value for, instead of refusing to start")
+	var pgParams translog.PostgresdDBParams
+	flag.StringVar(&pgParams.Host, "pg-host", "localhost", "Postgres host for the postgres backends")
+	flag.StringVar(&pgParams.DBName, "pg-db", "kvs", "Postgres database for the postgres backends")
+	flag.StringVar(&pgParams.User, "pg-user", "kvs", "Postgres user for the postgres backends")
+	flag.StringVar(&pgParams.Password, "pg-password", "", "Postgres password for the postgres backends")
+	flag.StringVar(&pgParams.Table, "pg-table", translog.DefaultPostgresTable, "table of the postgres log backend")
+	relayWebhook := flag.String("relay-webhook", "", "URL to POST every logged event to as JSON; empty disables the relay")
+	relayCursor := flag.String("relay-cursor", "", "file recording the last event relayed; defaults to "+relay.CursorFileName+" in -data-dir")
+	notifyRate := flag.Int("notify-rate", store.DefaultNotifyRate, "most keys a second whose watchers a bulk operation, such as -seed or a deletion by prefix, wakes; its changes are summed up for "+api.BatchesPath+" instead")
+	notifyWindow := flag.Duration("notify-window", store.DefaultNotifyWindow, "longest time the summary of a bulk operation's changes covers")
+	notifyWebhook := flag.String("notify-webhook", "", "URL to POST the summary of every bulk operation to as JSON; empty disables it")
+	retentionAge := flag.Duration("retention-max-age", 0, "delete keys not written for this long, such as 720h; 0 keeps keys forever")
+	retentionPrefixes := flag.String("retention-prefixes", "", "comma-separated prefix=age overrides of -retention-max-age for keys with a prefix, such as sessions/=24h,audit/=0")
+	retentionInterval := flag.Duration("retention-interval", time.Hour, "time between scans for keys past their retention age")
+	retentionRate := flag.Int("retention-rate", 100, "maximum keys deleted per second by a retention scan; 0 is unlimited")
+	retentionDryRun := flag.Bool("retention-dry-run", false, "log the keys past their retention age instead of deleting them")
+	expiryInterval := flag.Duration("expiry-interval", 10*time.Second, "time between the sweeps deleting the keys whose "+api.TTLHeader+" ran out, which reads hide meanwhile; 0 disables them")
+	bucketQuotas := flag.String("bucket-quotas", "", "comma-separated bucket=keys/bytes quotas, where 0 is no limit and the bucket * stands for the others, such as sessions=10000/0,*=1000/1048576; puts past a quota are rejected")
+	quotaWarnRatio := flag.Float64("quota-warn-ratio", store.DefaultQuotaWarnRatio, "share of a bucket's quota from which puts carry an "+api.QuotaWarningHeader+" header and a warning is logged")
+	quotaWarnInterval := flag.Duration("quota-warn-interval", store.DefaultQuotaWarnInterval, "minimum time between the quota warnings logged for a bucket")
+	evictMaxKeys := flag.Int("evict-max-keys", 0, "most keys the store holds: writes past it evict the keys read or written longest ago, logging their eviction; 0 is no limit")
+	evictMaxBytes := flag.Int64("evict-max-bytes", 0, "most bytes of keys and values, as stored, the store holds: writes past it evict the keys read or written longest ago, logging their eviction; 0 is no limit")
+	usageBackend := choiceFlag("usage", "off", "account for the requests, bytes written and read, and storage of each principal of the key API, hourly, for "+api.UsagePath+", saving the counters every -usage-interval: off, file, in -usage-file, or postgres, in the kv_usage table of the -pg-db", "off", "file", "postgres")
+	usageFile := flag.String("usage-file", "", "file the -usage=file counters are saved to; defaults to "+usage.FileName+" in -data-dir")
+	usageRetention := flag.Duration("usage-retention", usage.DefaultRetention, "how long the hourly -usage counters are kept")
+	usageInterval := flag.Duration("usage-interval", time.Minute, "time between the saves of the -usage counters, and the samples of what each principal stores; at most this much usage is lost on a crash")
+	usageOwners := flag.String("usage-owners", "", "comma-separated bucket=principal pairs, such as sessions=web,metrics=ops, naming whose -usage storage the bytes of each bucket are; buckets without an owner aren't accounted for")
+	masterKey := flag.String("master-key", "", "base64 or hex 256-bit key wrapping the data keys values are encrypted with; empty disables encryption unless -master-key-file is set")
+	masterKeyFile := flag.String("master-key-file", "", "file holding the -master-key")
+	keyringPath := flag.String("keyring", "", "file of the wrapped data keys, shared by the followers of an encrypted leader; defaults to "+crypt.KeyringFileName+" in -data-dir")
+	shadowBackend := choiceFlag("shadow-backend", "off", "backend of a shadow store to verify before migrating to it: every write is passed on to it, and a share of the reads compared with it in the background; off, file, postgres or postgres-state", "off", "file", "postgres", "postgres-state")
+	shadowDataDir := flag.String("shadow-data-dir", "", "data directory of the -shadow-backend store, which must differ from -data-dir")
+	shadowPercent := flag.Float64("shadow-sample-percent", 1, "percent of reads compared with the shadow store, adjusted through the "+api.ShadowPath+" admin endpoint")
+	shadowBudget := flag.Duration("shadow-budget", api.DefaultShadowBudget, "how long a comparison waits for the shadow store to catch up with a read before giving up on it")
+	driftKeys := flag.Int("drift-sample-keys", 0, "number of keys of the store, and of recent transaction log records, spot-checked against each other on each drift sample; 0 disables the sampler")
+	driftInterval := flag.Duration("drift-sample-interval", time.Minute, "time between drift samples")
+	driftWindow := flag.Int64("drift-window", store.DefaultDriftWindow, "bytes at the end of the transaction log the drift sampler reads its records from")
+	driftThreshold := flag.Int("drift-threshold", 3, "mismatches found by the drift sampler from which /readyz reports drift_suspected, until a clean /v1/admin/fsck")
+	chaos := flag.Bool("chaos", false, "enable fault injection for testing clients, adjusted through the "+api.ChaosPath+" admin endpoint; never use in production")
+	chaosRules := flag.String("chaos-rules", "", "JSON file of the fault injection rules to start with under -chaos")
+	replayUntilSeq := flag.Uint64("replay-until-seq", 0, "recover the state as of this event sequence, starting read-only; 0 replays the whole log")
+	replayUntilTime := flag.String("replay-until-time", "", "recover the state as of this RFC 3339 time, such as 2024-05-01T14:05:00Z, starting read-only")
+	replayCompact := flag.Bool("replay-compact", false, "make the state recovered by -replay-until-seq or -replay-until-time the data directory's, moving the log aside, so writes can be re-enabled")
+	latencyHistograms := flag.Bool("latency-histograms", false, "record the time spent in each phase of writes and transaction log writes in the kv_operation_phase_seconds histogram on /metrics")
+	slowOpThreshold := flag.Duration("slow-op-threshold", 0, "log writes and transaction log writes with a phase at least this long, such as 50ms; 0 disables the log")
+	slowOpHashKeys := flag.Bool("slow-op-hash-keys", false, "log a hash of the key of slow operations instead of the key, for privacy")
+	hotKeys := flag.Bool("hot-keys", false, "count the reads and writes of each key, to report the hot ones on "+api.HotKeysPath+" and the share of the hottest in kv_hot_key_share on /metrics")
+	hotKeysCapacity := flag.Int("hot-keys-capacity", hotkeys.DefaultCapacity, "keys -hot-keys counts every 10 seconds, for reads and for writes; its memory is bounded by it, whatever the number of keys")
+	hotKeysSample := flag.Float64("hot-keys-sample", 1, "share of the reads and writes -hot-keys counts, from 0 to 1, to lower its overhead; the counts are scaled up to match")
+	hotKeysHashKeys := flag.Bool("hot-keys-hash-keys", false, "report a hash of the hot keys and of their buckets but the default instead of them, for privacy")
+	configPath := flag.String("config", "", "YAML or JSON file of settings, or other file of name=value flag settings; SIGHUP re-reads the reloadable ones")
+	printConf := flag.Bool("print-config", false, "print the settings in effect as a YAML -config file, with secrets redacted, and exit")
+	printVersion := flag.Bool("version", false, "print the version, commit and build date of the binary, and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nEvery flag can also be set by an environment variable named %s and the flag's name\n"+
+			"in upper case with dashes as underscores, such as %sADMIN_KEY, which overrides the command line.\n"+
+			"The command line overrides the -config file.\n", envPrefix, envPrefix)
+	}
+	flag.Parse()
+
+	fixed := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { fixed[f.Name] = true })
+
+	if err := applyEnv(fixed); err != nil {
+		log.Fatal(err)
+	}
+
+	var conf *configFile
+	if *configPath != "" {
+		conf = newConfigFile(*configPath, fixed)
+		if err := conf.load(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *printConf {
+		if err := printConfig(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *printVersion {
+		v := version.Get()
+		fmt.Printf("kvstore %s commit %s built %s with %s\n", v.Version, v.Commit, v.Date, v.GoVersion)
+		return
+	}
+
+	// The flags are read before defaults derived from others fill them in
+	features := changedFlags()
+
+	if *listenAddr == "" && *unixPath == "" {
+		log.Fatal("at least one of -listen or -listen-unix is required")
+	}
+
+	certs, err := loadCertFlags(*tlsCert, *tlsKey, "-tls-cert", "-tls-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *adminListenAddr == "" && (*adminTLSCert != "" || *adminTLSKey != "") {
+		log.Fatal("-admin-tls-cert and -admin-tls-key require -admin-listen")
+	}
+
+	adminCerts, err := loadCertFlags(*adminTLSCert, *adminTLSKey, "-admin-tls-cert", "-admin-tls-key")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if (certs != nil || adminCerts != nil) && *tlsReloadInterval <= 0 {
+		log.Fatal("-tls-reload-interval must be positive")
+	}
+
+	var clientCAs *x509.CertPool
+	var authenticator api.Authenticator
+
+	if *authMode == "mtls" {
+		if certs == nil && adminCerts == nil {
+			log.Fatal("-auth=mtls requires -tls-cert or -admin-tls-cert")
+		}
+		if *tlsClientCA == "" {
+			log.Fatal("-auth=mtls requires -tls-client-ca")
+		}
+
+		if clientCAs, err = loadClientCAs(*tlsClientCA); err != nil {
+			log.Fatal(err)
+		}
+
+		scopes, err := parseScopes(*mtlsScopes)
+		if err != nil {
+			log.Fatalf("-mtls-scopes: %v", err)
+		}
+		authenticator = &api.MTLSAuthenticator{Scopes: scopes}
+	} else if *tlsClientCA != "" || *mtlsScopes != "" {
+		log.Fatal("-tls-client-ca and -mtls-scopes require -auth=mtls")
+	}
+
+	if *apiKeysPath != "" {
+		if *authMode != "api-key" {
+			log.Fatal("-api-keys requires -auth=api-key")
+		}
+
+		keys, err := loadAPIKeys(*apiKeysPath)
+		if err != nil {
+			log.Fatalf("-api-keys: %v", err)
+		}
+		authenticator = &api.APIKeyAuthenticator{Keys: keys}
+	}
+
+	failClosed := *logFailurePolicy == "reject"
+
+	// Followers keep the leader's sequence numbers in their log to know
+	// where to resume, which Postgres's generated sequences can't do
+	if *followURL != "" && (*logBackend == "postgres" || *logBackend == "postgres-state") {
+		log.Fatal("-follow requires -log-backend=file or none")
+	}
+
+	// A standby's state is replaced wholesale by each push, which a store
+	// backed by Postgres can't do, and its sequence numbers are the
+	// primary's, which Postgres can't log
+	if *standby && (*logBackend == "postgres" || *logBackend == "postgres-state") {
+		log.Fatal("-standby requires -log-backend=file or none")
+	}
+
+	if *standby && (*followURL != "" || *adminKey == "") {
+		log.Fatal("-standby requires -admin-key and can't be used with -follow")
+	}
+
+	// A mirror only reads the primary's files, and everything it holds
+	// comes from them
+	if *mirrorOf != "" {
+		if *followURL != "" || *standby || *seed != "" || *shipTo != "" || *relayWebhook != "" || *replayUntilSeq != 0 || *replayUntilTime != "" {
+			log.Fatal("-mirror-of can't be used with -follow, -standby, -seed, -ship-to, -relay-webhook, -replay-until-seq or -replay-until-time")
+		}
+		if *logBackend != "file" {
+			log.Fatal("-mirror-of requires -log-backend=file")
+		}
+
+		*dataDir = filepath.Dir(*mirrorOf)
+	}
+
+	// A cluster's state all comes from its Raft log, which stands for the
+	// transaction log, and its members must apply the same events
+	if *peers != "" {
+		if *logBackend != "file" || *followURL != "" || *standby || *mirrorOf != "" || *seed != "" || *relayWebhook != "" || *logRoutesPath != "" || *shadowBackend != "off" || *driftKeys > 0 || *blobThreshold > 0 || *pageValues || *replayUntilSeq != 0 || *replayUntilTime != "" {
+			log.Fatal("-peers can't be used with a -log-backend other than file, -follow, -standby, -mirror-of, -seed, -relay-webhook, -log-routes, -shadow-backend, -drift-sample-keys, -blob-threshold, -page-values, -replay-until-seq or -replay-until-time")
+		}
+	}
+
+	// A seed is written like any client's puts, which a read-only
+	// instance refuses
+	if *seed != "" && (*followURL != "" || *standby) {
+		log.Fatal("-seed can't be used with -follow or -standby")
+	}
+
+	if *shipTo != "" && *shipInterval <= 0 {
+		log.Fatal("-ship-interval must be positive")
+	}
+
+	if *relayWebhook != "" && (*logBackend == "postgres-state" || *logBackend == "none") {
+		log.Fatal("-relay-webhook requires -log-backend=file or postgres")
+	}
+
+	// The Postgres flags can only set one of the two stores' databases
+	if *shadowBackend != "off" {
+		if *shadowDataDir == "" || filepath.Clean(*shadowDataDir) == filepath.Clean(*dataDir) {
+			log.Fatal("-shadow-backend requires a -shadow-data-dir other than -data-dir")
+		}
+		if strings.HasPrefix(*shadowBackend, "postgres") && strings.HasPrefix(*logBackend, "postgres") {
+			log.Fatal("-shadow-backend and -log-backend can't both be postgres backends")
+		}
+		if *mirrorOf != "" || *logBackend == "none" || *replayUntilSeq != 0 || *replayUntilTime != "" {
+			log.Fatal("-shadow-backend can't be used with -mirror-of, -log-backend=none, -replay-until-seq or -replay-until-time")
+		}
+	}
+
+	var logRoutes []translog.LogRoute
+	if *logRoutesPath != "" {
+		if *logBackend != "file" || *mirrorOf != "" || *standby || *relayWebhook != "" || *driftKeys > 0 || *replayUntilSeq != 0 || *replayUntilTime != "" {
+			log.Fatal("-log-routes requires -log-backend=file, and can't be used with -mirror-of, -standby, -relay-webhook, -drift-sample-keys, -replay-until-seq or -replay-until-time")
+		}
+
+		if logRoutes, err = translog.LoadLogRoutes(*logRoutesPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *driftKeys > 0 {
+		if *logBackend != "file" || *mirrorOf != "" || *replayUntilSeq != 0 || *replayUntilTime != "" {
+			log.Fatal("-drift-sample-keys requires -log-backend=file, and can't be used with -mirror-of, -replay-until-seq or -replay-until-time")
+		}
+		if *driftInterval <= 0 || *driftWindow <= 0 || *driftThreshold <= 0 {
+			log.Fatal("-drift-sample-interval, -drift-window and -drift-threshold must be positive")
+		}
+	}
+
+	limit, err := parseReplayLimit(*replayUntilSeq, *replayUntilTime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !limit.IsZero() {
+		if *followURL != "" || *relayWebhook != "" || *seed != "" {
+			log.Fatal("-replay-until-seq and -replay-until-time can't be used with -follow, -relay-webhook or -seed")
+		}
+		if *logBackend != "file" && (*logBackend != "postgres" || *replayCompact) {
+			log.Fatal("-replay-until-seq and -replay-until-time require -log-backend=file, or postgres without -replay-compact")
+		}
+	}
+
+	timing.Setup(timing.Options{
+		Histograms:    *latencyHistograms,
+		SlowThreshold: *slowOpThreshold,
+		HashKeys:      *slowOpHashKeys,
+	})
+
+	// The seed is read before the log is opened, so that an unreachable one
+	// fails startup before anything is changed
+	var seedRecords []store.Record
+	if *seed != "" {
+		if seedRecords, err = readSeed(*seed, *seedFormat, *seedKey); err != nil {
+			log.Fatalf("failed to read -seed %s: %v", *seed, err)
+		}
+	}
+
+	resolveConflict, err := store.ParseConflictResolver(*conflictResolution)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keyFolding, err := store.ParseKeyFolding(*keyFoldingName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	codec, err := compress.Parse(*compressCodec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *pageValues {
+		if *logBackend == "postgres-state" {
+			log.Fatal("-page-values can't be used with -log-backend=postgres-state")
+		}
+		if *pageCacheBytes <= 0 {
+			log.Fatal("-page-cache-bytes must be positive")
+		}
+	}
+
+	var blobs *blob.Dir
+
+	switch {
+	case *blobThreshold < 0:
+		log.Fatal("-blob-threshold must not be negative")
+	case *blobThreshold > 0:
+		if *blobDir == "" {
+			*blobDir = filepath.Join(*dataDir, blob.DirName)
+		}
+
+		if blobs, err = blob.Open(*blobDir, *blobThreshold); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	retention := store.RetentionPolicy{
+		MaxAge:   *retentionAge,
+		Interval: *retentionInterval,
+		Rate:     *retentionRate,
+		DryRun:   *retentionDryRun,
+	}
+
+	if retention.Prefixes, err = store.ParseRetentionRules(*retentionPrefixes); err != nil {
+		log.Fatal(err)
+	}
+
+	if retention.Enabled() && retention.Interval <= 0 {
+		log.Fatal("-retention-interval must be positive")
+	}
+
+	if retention.Enabled() && *mirrorOf != "" {
+		log.Fatal("-retention-max-age and -retention-prefixes can't be used with -mirror-of")
+	}
+
+	if *expiryInterval < 0 {
+		log.Fatal("-expiry-interval must not be negative")
+	}
+
+	quotas, err := store.ParseQuotas(*bucketQuotas)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *quotaWarnRatio <= 0 || *quotaWarnRatio > 1 {
+		log.Fatal("-quota-warn-ratio must be more than 0 and at most 1")
+	}
+	quotas.WarnRatio, quotas.WarnInterval = *quotaWarnRatio, *quotaWarnInterval
+
+	if *evictMaxKeys < 0 || *evictMaxBytes < 0 {
+		log.Fatal("-evict-max-keys and -evict-max-bytes must not be negative")
+	}
+
+	eviction := store.Quota{MaxKeys: *evictMaxKeys, MaxBytes: *evictMaxBytes}
+	if !eviction.IsZero() && *logBackend == "postgres-state" {
+		log.Fatal("-evict-max-keys and -evict-max-bytes can't be used with -log-backend=postgres-state")
+	}
+
+	var usageStore usage.Store
+	var usageOwnership usage.Owners
+
+	if *usageBackend != "off" {
+		if *usageInterval <= 0 {
+			log.Fatal("-usage-interval must be positive")
+		}
+		if *usageRetention <= 0 {
+			log.Fatal("-usage-retention must be positive")
+		}
+
+		if usageOwnership, err = usage.ParseOwners(*usageOwners); err != nil {
+			log.Fatal(err)
+		}
+
+		switch *usageBackend {
+		case "file":
+			if *usageFile == "" {
+				*usageFile = filepath.Join(*dataDir, usage.FileName)
+			}
+			usageStore = usage.FileStore{Path: *usageFile}
+		case "postgres":
+			pg, err := usage.NewPostgresStore(pgParams)
+			if err != nil {
+				log.Fatalf("failed to open the usage table: %v", err)
+			}
+			defer pg.Close()
+
+			usageStore = pg
+		}
+	}
+
+	// reloadable returns the API settings that can change while the server
+	// runs, as the flags currently set them
+	reloadable := func() (api.Config, error) {
+		cfg := api.Config{
+			AdminKey:          *adminKey,
+			MaxInflightReads:  *maxReads,
+			MaxInflightWrites: *maxWrites,
+			LimitWait:         *limitWait,
+		}
+
+		if *limitPolicy == "reject" {
+			cfg.LimitWait = 0
+		}
+
+		if *ipRulesPath != "" {
+			var err error
+			if cfg.IPRules, err = api.LoadIPRules(*ipRulesPath); err != nil {
+				return cfg, err
+			}
+		}
+
+		return cfg, nil
+	}
+
+	cfg, err := reloadable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg.Authenticator = authenticator
+	cfg.MinSequenceWait = *minSequenceWait
+	cfg.MaxDeadline = *maxDeadline
+	cfg.V1Compat = *v1Compat
+	if *changesInlineMax < 0 {
+		log.Fatal("-changes-inline-max must not be negative")
+	}
+	cfg.ChangesInlineMax = *changesInlineMax
+	if *maxValueSize <= 0 {
+		log.Fatal("-max-value-size must be positive")
+	}
+	cfg.MaxValueSize = *maxValueSize
+
+	cfg.Durability.Default, _ = store.ParseDurability(*durabilityDefault)
+	cfg.Durability.Max, _ = store.ParseDurability(*durabilityMax)
+	cfg.Durability.FlushTimeout = *flushTimeout
+	if *durabilityKeys != "" {
+		if cfg.Durability.Keys, err = api.LoadDurabilityKeys(*durabilityKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg.ScalingTargets = api.ScalingTargets{
+		RequestsPerSecond: *scalingRPS,
+		P99:               *scalingP99,
+		LogQueueDepth:     *scalingLogQueue,
+		MemoryBytes:       *scalingMemory,
+	}
+
+	if *scanCacheBytes < 0 {
+		log.Fatal("-scan-cache-bytes can't be negative")
+	}
+	if *scanCacheBytes > 0 {
+		cfg.ScanCache = api.NewScanCache(*scanCacheBytes, *scanCacheTTL)
+	}
+
+	if *chaos {
+		var rules []api.FaultRule
+		if *chaosRules != "" {
+			if rules, err = api.LoadFaultRules(*chaosRules); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if cfg.Faults, err = api.NewFaultInjector(rules); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("WARNING: -chaos is set, %d fault injection rules are active\n", len(rules))
+	}
+
+	var cipher crypt.Cipher
+
+	if *masterKey != "" || *masterKeyFile != "" {
+		var master *crypt.MasterKey
+		if *masterKey != "" {
+			master, err = crypt.ParseMasterKey(*masterKey)
+		} else {
+			master, err = crypt.LoadMasterKey(*masterKeyFile)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *keyringPath == "" {
+			*keyringPath = filepath.Join(*dataDir, crypt.KeyringFileName)
+		}
+
+		if cfg.Keyring, err = crypt.OpenKeyring(*keyringPath, master); err != nil {
+			log.Fatalf("failed to open the keyring: %v", err)
+		}
+
+		cipher = cfg.Keyring
+	}
+
+	// The recovered state is inspected read-only before writes resume
+	recovering := !limit.IsZero()
+
+	if recovering && *replayCompact {
+		rec, err := recoverDataDir(*dataDir, limit, false)
+		if err != nil {
+			log.Fatalf("point-in-time recovery: %v", err)
+		}
+
+		log.Printf("rewound %s to sequence %d; the replaced log, holding %d later events, is in %s\n",
+			*dataDir, rec.Sequence, rec.Skipped, rec.Archive)
+
+		// The data directory now ends at the limit
+		limit = store.ReplayLimit{}
+	}
+
+	boot := &api.BootReport{Mode: *bootMode, Backend: *logBackend}
+	openStart := time.Now()
+
+	var logger translog.TransactionLogger
+	var backing store.Backing
+
+	switch {
+	case *mirrorOf != "":
+		// The log is the primary's, which only it writes
+		logger = translog.NewNopTransactionLogger()
+	case *peers != "":
+		// The Raft log stands for the transaction log
+		logger = translog.NewNopTransactionLogger()
+	case *logBackend == "none":
+		logger = translog.NewNopTransactionLogger()
+
+		log.Println("WARNING: -log-backend=none, nothing is persisted and all data will be lost on restart")
+	case *logBackend == "postgres-state":
+		// Postgres holds the current state and memory is a cache of it
+		b, err := pgstate.New(pgParams)
+		if err != nil {
+			panic(fmt.Errorf("failed to create state backend: %w", err))
+		}
+
+		logger, backing = b, b
+	default:
+		cfg.LogHealth = translog.NewHealth(*logFailureThreshold, failClosed)
+
+		logger, err = newTransactionLogger(*logBackend, *dataDir, pgParams, cfg.LogHealth)
+		if err != nil {
+			panic(fmt.Errorf("failed to create event logger: %w", err))
+		}
+
+		switch {
+		case len(logRoutes) > 0:
+			// fsck, log stats and pushed snapshots only know of the
+			// default log, so are disabled
+			if logger, err = translog.NewRoutedLogger(*dataDir, logger, logRoutes, cfg.LogHealth); err != nil {
+				log.Fatalf("failed to open the routed logs: %v", err)
+			}
+
+			log.Printf("routing events by key prefix to %d logs besides the default one\n", len(logRoutes))
+		case *logBackend == "file":
+			cfg.DataDir = *dataDir
+		}
+
+		if len(logRoutes) == 0 {
+			cfg.LogScan = logScanner(*logBackend, *dataDir, pgParams)
+		}
+	}
+
+	// Without -replay-compact the log still holds the events past the
+	// limit, so writes must not be appended to it; the recovered state is
+	// only served from memory
+	replayLogger := logger
+
+	if !limit.IsZero() {
+		logger = translog.NewNopTransactionLogger()
+		cfg.LogHealth, cfg.DataDir, cfg.LogScan = nil, "", nil
+
+		log.Println("WARNING: recovering without -replay-compact, writes re-enabled through maintenance mode will not be persisted")
+	}
+
+	if *hotKeys && (*hotKeysSample <= 0 || *hotKeysSample > 1) {
+		log.Fatal("-hot-keys-sample must be greater than 0 and at most 1")
+	}
+
+	var hotKeyTracker *hotkeys.Tracker
+	if *hotKeys {
+		hotKeyTracker = hotkeys.New(hotkeys.Options{Capacity: *hotKeysCapacity, SampleRate: *hotKeysSample, HashKeys: *hotKeysHashKeys}, nil)
+	}
+
+	opts := store.Options{
+		Codec:             codec,
+		CompressThreshold: *compressThreshold,
+		InitialCapacity:   *initialKeys,
+		PageValues:        *pageValues,
+		PageCacheBytes:    *pageCacheBytes,
+		Backing:           backing,
+		CoalesceReads:     backing != nil,
+		StrictWrites:      *strictWrites,
+		SkipNoopWrites:    *skipNoopWrites,
+		KeyFolding:        keyFolding,
+		Cipher:            cipher,
+		Blobs:             blobs,
+		Quotas:            quotas,
+		Eviction:          eviction,
+		ResolveConflict:   resolveConflict,
+		NotifyRate:        *notifyRate,
+		NotifyWindow:      *notifyWindow,
+		HotKeys:           hotKeyTracker,
+	}
+
+	// The shadow is loaded before the primary, whose writes it then takes
+	// from the start
+	var shadowLogger translog.TransactionLogger
+	storeLogger := store.Logger(logger)
+
+	var node *cluster.Node
+
+	if *peers != "" {
+		members, err := cluster.ParsePeers(*peers)
+		if err != nil {
+			log.Fatalf("-peers: %v", err)
+		}
+
+		if node, err = cluster.New(cluster.Config{ID: *clusterID, Dir: filepath.Join(*dataDir, cluster.DirName), Peers: members}); err != nil {
+			log.Fatalf("-cluster-id: %v", err)
+		}
+
+		storeLogger = node
+		cfg.Cluster, cfg.ClusterWrites = node, *clusterWrites
+	}
+
+	if *shadowBackend != "off" {
+		var shadowStore *store.Store
+
+		if shadowStore, shadowLogger, err = openShadow(*shadowBackend, *shadowDataDir, pgParams, opts); err != nil {
+			log.Fatal(err)
+		}
+
+		if cfg.Shadow, err = api.NewShadow(shadowStore, *shadowPercent, *shadowBudget); err != nil {
+			log.Fatal(err)
+		}
+
+		storeLogger = cfg.Shadow.Logger(logger)
+	}
+
+	st := store.New(storeLogger, opts)
+
+	if reporter, ok := replayLogger.(translog.DamageReporter); ok {
+		reporter.ReportDamage(recordDamage(boot), *bootMode == "permissive")
+	}
+
+	boot.Phase(api.BootPhaseOpenLog, time.Since(openStart))
+
+	// Loads existing data, if any, before the logger starts accepting events
+	start := time.Now()
+
+	var stats store.ReplayStats
+
+	switch {
+	case *mirrorOf != "":
+		cfg.Mirror = replication.NewMirror(*mirrorOf, st)
+		err = cfg.Mirror.Load(context.Background())
+	case node != nil:
+		// Raft restores its snapshot, and applies the entries after it as
+		// it learns they are committed
+		err = node.Start(st)
+	default:
+		stats, err = st.LoadUntil(*dataDir, replayLogger, limit)
+	}
+	if err != nil {
+		log.Fatalf("startup replay failed in %s boot mode: %v\n%s", *bootMode, err, replayAdvice(*bootMode, boot))
+	}
+
+	boot.Duration = time.Since(start)
+	boot.Events, boot.Gaps, boot.LastSequence = stats.Events, stats.Gaps, st.Sequence()
+	if *logBackend == "file" && *mirrorOf == "" {
+		boot.LogBytes = logSize(*dataDir)
+	}
+	boot.Degraded = boot.Skipped > 0
+	boot.Phase(api.BootPhaseReplay, boot.Duration)
+
+	logBootReport(boot)
+	cfg.Boot = boot
+
+	warmStart := time.Now()
+
+	if replayLogger != logger {
+		if err := replayLogger.Close(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("left %d events past the replay limit unapplied\n", stats.PastLimit)
+	}
+
+	if recovering {
+		st.SetReadOnly(true, "point-in-time recovery")
+	}
+
+	if err := st.VerifyEncryption(); err != nil {
+		log.Fatalf("stored values can't be decrypted: %v", err)
+	}
+
+	// A recovery only replayed part of the log, so it doesn't know every
+	// blob the log refers to, and a mirror's blobs are the primary's
+	if !recovering && *mirrorOf == "" {
+		if n, size, err := st.CollectBlobs(context.Background()); err != nil {
+			log.Fatalf("failed to collect unreferenced blobs: %v", err)
+		} else if n > 0 {
+			log.Printf("removed %d unreferenced blobs (%d bytes) from %s\n", n, size, *blobDir)
+		}
+	}
+
+	if err := logger.Run(); err != nil {
+		log.Fatalf("failed to start the transaction log: %v", err)
+	}
+
+	if *followURL != "" {
+		st.SetReadOnly(true, "following "+*followURL)
+		cfg.Follower = replication.NewFollower(strings.TrimSuffix(*followURL, "/"), *followKey, st, st.Sequence())
+	}
+
+	if *standby {
+		st.SetReadOnly(true, "warm standby")
+	}
+
+	if *mirrorOf != "" {
+		st.SetReadOnly(true, "mirror of "+*mirrorOf)
+	}
+
+	// Keys stored before the folding was turned on are folded before
+	// anything looks them up by their folded form
+	if folded, collisions, err := st.FoldKeys(context.Background()); errors.Is(err, store.ErrorKeyCollision) {
+		log.Fatalf("-key-folding=%s refused: %v\n%s\nNothing was changed. Delete or rename all but one key of each set with the folding off, then restart with it.",
+			keyFolding, err, listCollisions(collisions))
+	} else if errors.Is(err, store.ErrorReadOnly) {
+		log.Fatalf("-key-folding=%s refused: keys that aren't folded can't be renamed while the store is read-only; fold them where they are written first", keyFolding)
+	} else if err != nil {
+		log.Fatalf("failed to fold keys: %v", err)
+	} else if folded > 0 {
+		log.Printf("renamed %d keys to their %s folded form\n", folded, keyFolding)
+	}
+
+	if *seed != "" {
+		report, err := st.Seed(context.Background(), seedRecords, *seedMerge)
+		if errors.Is(err, store.ErrorSeedConflict) {
+			log.Fatalf("failed to load -seed %s: %v\nNothing was written. Start with -seed-merge to keep the stored values of these keys and load the rest.", *seed, err)
+		} else if err != nil {
+			log.Fatalf("failed to load -seed %s: %v", *seed, err)
+		}
+
+		log.Printf("seed: source=%s loaded=%d unchanged=%d kept_local=%d\n", *seed, report.Loaded, report.Unchanged, len(report.Conflicts))
+	}
+
+	if src, ok := logger.(translog.Source); ok {
+		if blobs != nil {
+			src = blob.Inline(src, blobs)
+		}
+		cfg.EventSource = src
+	}
+	if cr, ok := logger.(translog.ChangeReader); ok {
+		cfg.Changes = cr
+	}
+
+	if *shipTo != "" {
+		cfg.Shipper = replication.NewShipper(strings.TrimSuffix(*shipTo, "/"), *shipKey, st, *shipInterval)
+	}
+
+	if *driftKeys > 0 {
+		cfg.Drift = store.NewDriftSampler(st, filepath.Join(*dataDir, translog.LogFileName), *driftKeys, *driftWindow, *driftThreshold)
+	}
+
+	cfg.LogErrors = translog.NewErrorHistory(maxLogErrors)
+	go cfg.LogErrors.Drain(logger.Err())
+
+	cfg.PrintConfig = printConfig
+
+	var blobPath string
+	if blobs != nil {
+		blobPath = *blobDir
+	}
+	var keyring string
+	if cfg.Keyring != nil {
+		keyring = *keyringPath
+	}
+
+	cfg.Info = api.InstanceInfo{
+		Build:    version.Get(),
+		Started:  processStart.UTC(),
+		Backend:  *logBackend,
+		Paths:    dataPaths(*logBackend, *dataDir, blobPath, keyring),
+		Features: features,
+	}
+	if meta, ok := replayLogger.(translog.MetaReader); ok {
+		cfg.LogMeta = meta
+	}
+
+	cfg.HotKeys = hotKeyTracker
+
+	if usageStore != nil {
+		cfg.Usage = usage.NewMeter(*usageRetention, nil)
+		if err := cfg.Usage.Load(context.Background(), usageStore); err != nil {
+			log.Fatalf("failed to load the usage counters: %v", err)
+		}
+	}
+
+	if *auditPath != "" {
+		f, err := api.OpenRotatingFile(*auditPath, *auditMaxSize, *auditBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		cfg.Audit = api.NewAuditLogger(f, *auditBuffer, *auditReads)
+	}
+
+	boot.Phase(api.BootPhaseWarm, time.Since(warmStart))
+	listenStart := time.Now()
+
+	var listeners []net.Listener
+
+	if *listenAddr != "" {
+		l, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if *unixPath != "" {
+		mode, err := parseFileMode(*unixMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		l, err := listenUnix(*unixPath, mode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	var adminListener net.Listener
+
+	if *adminListenAddr != "" {
+		if adminListener, err = net.Listen("tcp", *adminListenAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	boot.Phase(api.BootPhaseListen, time.Since(listenStart))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := api.NewServer(st, cfg)
+	logInstanceInfo(server)
+
+	go api.ToggleMaintenanceOnSignal(ctx, st)
+
+	if cfg.Follower != nil {
+		go cfg.Follower.Run(ctx)
+	}
+
+	if cfg.Shipper != nil {
+		go cfg.Shipper.Run(ctx)
+	}
+
+	if cfg.Mirror != nil {
+		go cfg.Mirror.Run(ctx)
+	}
+
+	if cfg.Shadow != nil {
+		go cfg.Shadow.Run(ctx)
+	}
+
+	if cfg.Drift != nil {
+		go cfg.Drift.Run(ctx, *driftInterval)
+	}
+
+	// The counters are saved a last time once the server has stopped
+	// taking requests
+	usageCtx, stopUsage := context.WithCancel(context.Background())
+	usageDone := make(chan struct{})
+
+	if cfg.Usage != nil {
+		go func() {
+			defer close(usageDone)
+			cfg.Usage.Run(usageCtx, usageStore, *usageInterval, func() map[string]int64 {
+				return usageOwnership.Storage(st.BucketBytes())
+			})
+		}()
+	} else {
+		close(usageDone)
+	}
+
+	if *relayWebhook != "" {
+		if *relayCursor == "" {
+			*relayCursor = filepath.Join(*dataDir, relay.CursorFileName)
+		}
+
+		r := relay.New(cfg.EventSource, &relay.WebhookSink{URL: *relayWebhook}, *relayCursor, cipher)
+		go r.Run(ctx)
+	}
+
+	if *notifyWebhook != "" {
+		go postBatches(ctx, st, &relay.WebhookSink{URL: *notifyWebhook})
+	}
+
+	if retention.Enabled() {
+		go store.RunRetention(ctx, st, retention)
+	}
+
+	if *expiryInterval > 0 {
+		go store.RunExpiry(ctx, st, *expiryInterval)
+	}
+
+	for _, c := range []*certReloader{certs, adminCerts} {
+		if c != nil {
+			go c.watch(ctx, *tlsReloadInterval)
+		}
+	}
+
+	go reloadOnSignal(ctx, logger, func() error {
+		for _, c := range []*certReloader{certs, adminCerts} {
+			if c == nil {
+				continue
+			}
+			if err := c.reload(); err != nil {
+				log.Printf("TLS certificate reload failed, keeping the previous one: %v\n", err)
+			}
+		}
+
+		apply := func() error {
+			next, err := reloadable()
+			if err == nil {
+				server.Reload(next)
+			}
+			return err
+		}
+
+		if conf == nil {
+			return apply()
+		}
+		return conf.reload(apply)
+	})
+
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: api.NewRouter(server)}
+	srv.RegisterOnShutdown(server.CloseStreams)
+	serveErrors := make(chan error, len(listeners)+1)
+
+	if certs != nil {
+		srv.TLSConfig = certs.tlsConfig()
+		verifyClients(srv.TLSConfig, clientCAs)
+	}
+
+	boot.MarkReady(processStart)
+	logStartupPhases(boot)
+
+	// With an admin listener, the operational endpoints move there, and the
+	// other listeners answer 404 for them
+	var adminSrv *http.Server
+
+	if adminListener != nil {
+		srv.Handler = api.NewRouterFor(server, api.DataRoutes)
+
+		adminSrv = &http.Server{Handler: api.NewRouterFor(server, api.AdminRoutes)}
+		adminSrv.RegisterOnShutdown(server.CloseStreams)
+
+		if adminCerts != nil {
+			adminSrv.TLSConfig = adminCerts.tlsConfig()
+			verifyClients(adminSrv.TLSConfig, clientCAs)
+		}
+
+		go serve(adminSrv, adminListener, adminCerts != nil, serveErrors)
+	}
+
+	for _, l := range listeners {
+		// Unix sockets are local, so only TCP is served over TLS
+		go serve(srv, l, certs != nil && l.Addr().Network() == "tcp", serveErrors)
+	}
+
+	select {
+	case err := <-serveErrors:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	// Shutting down closes every listener, which also removes the socket file
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, s := range []*http.Server{srv, adminSrv} {
+		if s == nil {
+			continue
+		}
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v\n", err)
+		}
+	}
+
+	stopUsage()
+	<-usageDone
+
+	// A leader leaving makes way for the next one
+	if node != nil {
+		if err := node.Shutdown(); err != nil {
+			log.Printf("cluster shutdown: %v\n", err)
+		}
+	}
+
+	// Writes have stopped with the server, so whatever the logger still
+	// holds is all there is left to persist
+	if err := logger.Close(shutdownCtx); err != nil {
+		log.Printf("transaction log close: %v\n", err)
+	}
+
+	if shadowLogger != nil {
+		if err := shadowLogger.Close(shutdownCtx); err != nil {
+			log.Printf("shadow transaction log close: %v\n", err)
+		}
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("tracing shutdown: %v\n", err)
+	}
+
+	if cfg.Audit != nil {
+		cfg.Audit.Close()
+	}
+}
+
+// postBatches POSTs the summary of every bulk operation to sink until ctx
+// is done. A summary the sink refuses is logged and dropped.
+func postBatches(ctx context.Context, st *store.Store, sink *relay.WebhookSink) {
+	summaries, cancel := st.WatchBatches("", "")
+	defer cancel()
+
+	for {
+		select {
+		case sum := <-summaries:
+			if err := sink.Post(ctx, sum); err != nil {
+				log.Printf("posting the summary of %s prefix=%q: %v\n", sum.Op, sum.Prefix, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serve serves srv on l, over TLS with srv.TLSConfig if withTLS, and sends
+// the error it stops with to errs.
+func serve(srv *http.Server, l net.Listener, withTLS bool, errs chan<- error) {
+	if withTLS {
+		log.Printf("listening on %s %s with TLS\n", l.Addr().Network(), l.Addr())
+		errs <- srv.ServeTLS(l, "", "")
+		return
+	}
+
+	log.Printf("listening on %s %s\n", l.Addr().Network(), l.Addr())
+	errs <- srv.Serve(l)
+}
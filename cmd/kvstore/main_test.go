@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/sheritzs/key-value-store/internal/testharness"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// buildBinary builds kvstore into a temporary directory, with any further
+// flags to go build, skipping the test in short mode.
+func buildBinary(t *testing.T, flags ...string) string {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("builds the binary")
+	}
+
+	binary := filepath.Join(t.TempDir(), "kvstore")
+	if out, err := exec.Command("go", append(append([]string{"build", "-o", binary}, flags...), ".")...).CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+
+	return binary
+}
+
+// syncBuffer is a bytes.Buffer that the output of a process can be written
+// to from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestRunWithoutPersistence(t *testing.T) {
+	binary := buildBinary(t)
+	dataDir := t.TempDir()
+
+	var output syncBuffer
+	p, err := testharness.StartProcess(context.Background(), testharness.ProcessConfig{
+		Binary:   binary,
+		DataDir:  dataDir,
+		AdminKey: "none",
+		Args:     []string{"-log-backend", "none"},
+		Output:   &output,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Every operation of the harness works, its restart losing the data
+	if err := testharness.Run(context.Background(), "none", p).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(output.String(), "WARNING: -log-backend=none") {
+		t.Errorf("no warning that nothing is persisted in:\n%s", output.String())
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("-log-backend=none created %s in the data directory", e.Name())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recoveryDirPrefix starts the name of the directory in a data directory
+// that a point-in-time recovery moves the replaced log files to, which
+// continues with the time of the recovery.
+const recoveryDirPrefix = "pitr-"
+
+// parseReplayLimit returns the replay limit set by the -replay-until-seq and
+// -replay-until-time flags.
+func parseReplayLimit(seq uint64, until string) (store.ReplayLimit, error) {
+	limit := store.ReplayLimit{Sequence: seq}
+
+	if until != "" {
+		t, err := time.Parse(time.RFC3339Nano, until)
+		if err != nil {
+			return limit, fmt.Errorf("invalid -replay-until-time: %w", err)
+		}
+		limit.Time = t.UTC()
+	}
+
+	return limit, nil
+}
+
+// recovery describes the state a data directory's log was replayed to.
+type recovery struct {
+	Sequence uint64 // Last event applied
+	Keys     int    // Keys in the recovered store
+	Skipped  int    // Events past the limit
+	Archive  string // Directory the replaced files were moved to; empty if nothing was written
+}
+
+// recoverDataDir replays the file log in dataDir up to limit. Unless dryRun
+// is set, it then makes the recovered state the directory's: the log files
+// and any snapshot are moved to a new recovery directory, and a snapshot of
+// the recovered state takes their place, with the log starting empty after
+// it, as the new MetaFileName records. The snapshot is written before anything is moved, and only renamed
+// into place after, so a crash in between leaves every event in either the
+// data directory or the recovery directory.
+func recoverDataDir(dataDir string, limit store.ReplayLimit, dryRun bool) (recovery, error) {
+	var rec recovery
+
+	logPath := filepath.Join(dataDir, translog.LogFileName)
+
+	logger, err := translog.NewFileTransactionLogger(logPath, nil)
+	if err != nil {
+		return rec, err
+	}
+
+	st := store.New(translog.NewNopTransactionLogger(), store.Options{})
+
+	stats, err := st.LoadUntil(dataDir, logger, limit)
+	if cerr := logger.Close(context.Background()); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return rec, err
+	}
+
+	rec.Sequence = st.Sequence()
+	rec.Skipped = stats.PastLimit
+	rec.Keys = st.Stats().Keys
+
+	if dryRun {
+		return rec, nil
+	}
+
+	var buf bytes.Buffer
+	if err := st.Snapshot(&buf); err != nil {
+		return rec, err
+	}
+
+	snapshotPath := filepath.Join(dataDir, snapshotFileName)
+	if err := os.WriteFile(snapshotPath+".tmp", buf.Bytes(), 0644); err != nil {
+		return rec, err
+	}
+
+	archive := filepath.Join(dataDir, recoveryDirPrefix+time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Mkdir(archive, 0755); err != nil {
+		return rec, err
+	}
+
+	files, err := translog.SegmentFiles(logPath)
+	if err != nil {
+		return rec, err
+	}
+	files = append(files, filepath.Join(dataDir, translog.PendingFileName), filepath.Join(dataDir, translog.MetaFileName), snapshotPath)
+
+	for _, name := range files {
+		err := os.Rename(name, filepath.Join(archive, filepath.Base(name)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return rec, err
+		}
+	}
+
+	// Numbering resumes after the events moved aside, which followers may
+	// have seen, rather than reusing their numbers
+	meta := translog.LogMeta{After: rec.Sequence, Compacted: time.Now().UTC()}
+	if seq, ok := logger.(translog.Sequencer); ok {
+		meta.HighWater = seq.LastSequence()
+	}
+	if err := translog.WriteLogMeta(logPath, meta); err != nil {
+		return rec, err
+	}
+
+	if err := os.Rename(snapshotPath+".tmp", snapshotPath); err != nil {
+		return rec, err
+	}
+
+	rec.Archive = archive
+
+	return rec, nil
+}
+
+// restoreTo implements "kvstore restore-to", which rewinds the data
+// directory of a stopped instance to a point in its transaction log.
+func restoreTo(args []string) error {
+	flags := flag.NewFlagSet("restore-to", flag.ExitOnError)
+	dataDir := flags.String("data-dir", ".", "data directory of the stopped instance to rewind")
+	untilSeq := flags.Uint64("replay-until-seq", 0, "last event sequence to keep")
+	untilTime := flags.String("replay-until-time", "", "RFC 3339 time of the last events to keep, such as 2024-05-01T14:05:00Z")
+	dryRun := flags.Bool("dry-run", false, "report the state the log would be rewound to without changing anything")
+	flags.Parse(args)
+
+	limit, err := parseReplayLimit(*untilSeq, *untilTime)
+	if err != nil {
+		return err
+	}
+
+	if limit.IsZero() || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore restore-to (-replay-until-seq N | -replay-until-time TIME) [-data-dir DIR] [-dry-run]")
+	}
+
+	rec, err := recoverDataDir(*dataDir, limit, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Printf("%s would be rewound to sequence %d with %d keys, dropping %d later events\n",
+			*dataDir, rec.Sequence, rec.Keys, rec.Skipped)
+		return nil
+	}
+
+	log.Printf("rewound %s to sequence %d with %d keys; the replaced log, holding %d later events, is in %s\n",
+		*dataDir, rec.Sequence, rec.Keys, rec.Skipped, rec.Archive)
+
+	return nil
+}
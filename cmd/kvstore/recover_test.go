@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/testharness"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copyDir copies the files of the directory dir to a new one.
+func copyDir(t *testing.T, dir string) string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := t.TempDir()
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(copied, e.Name()), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return copied
+}
+
+// writeHistory logs n events to a file log in dir, the ith made i minutes
+// after start, putting keys k0 to k9 over and over and deleting one now and
+// then. It returns the contents after each prefix of the history.
+func writeHistory(t *testing.T, dir string, start time.Time, n int) []map[string]string {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, errs := l.ReadEvents()
+	for range events {
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	states := []map[string]string{{}}
+
+	for i := 1; i <= n; i++ {
+		e := translog.Event{Sequence: uint64(i), Bucket: translog.DefaultBucket, Key: fmt.Sprintf("k%d", i%10), Time: start.Add(time.Duration(i) * time.Minute)}
+
+		state := make(map[string]string)
+		for k, v := range states[i-1] {
+			state[k] = v
+		}
+		if i%7 == 6 {
+			e.EventType = translog.EventDelete
+			delete(state, e.Key)
+		} else {
+			e.EventType, e.Value = translog.EventPut, fmt.Sprintf("v%d", i)
+			state[e.Key] = e.Value
+		}
+		states = append(states, state)
+
+		if err := l.WriteEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return states
+}
+
+func TestRecoverToCutPoints(t *testing.T) {
+	const n = 60
+	start := time.Date(2026, 5, 1, 14, 0, 0, 0, time.UTC)
+	minute := func(i int) time.Time { return start.Add(time.Duration(i) * time.Minute) }
+
+	dir := t.TempDir()
+	states := writeHistory(t, dir, start, n)
+
+	tests := []struct {
+		limit store.ReplayLimit
+		want  int // Events kept
+	}{
+		{store.ReplayLimit{Sequence: 1}, 1},
+		{store.ReplayLimit{Sequence: 25}, 25},
+		{store.ReplayLimit{Sequence: n}, n},
+		{store.ReplayLimit{Sequence: n + 10}, n},
+		{store.ReplayLimit{Time: minute(25)}, 25},
+		{store.ReplayLimit{Time: minute(25).Add(30 * time.Second)}, 25},
+		{store.ReplayLimit{Time: start}, 0},
+		{store.ReplayLimit{Sequence: 40, Time: minute(30)}, 30},
+		{store.ReplayLimit{Sequence: 30, Time: minute(40)}, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("seq=%d,time=%s", tt.limit.Sequence, tt.limit.Time.Format("15:04:05")), func(t *testing.T) {
+			dir := copyDir(t, dir)
+
+			// A dry run reports the cut, and changes nothing
+			rec, err := recoverDataDir(dir, tt.limit, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Sequence != uint64(tt.want) || rec.Skipped != n-tt.want || rec.Keys != len(states[tt.want]) || rec.Archive != "" {
+				t.Errorf("dry run: %+v; want sequence %d, %d skipped and %d keys", rec, tt.want, n-tt.want, len(states[tt.want]))
+			}
+			st, closeLog := openLogged(t, dir)
+			if got := contents(t, st); st.Sequence() != n || fmt.Sprint(got) != fmt.Sprint(states[n]) {
+				t.Errorf("after a dry run the directory holds %v at %d", got, st.Sequence())
+			}
+			closeLog()
+
+			// The recovery leaves the directory holding the state after the
+			// cut, numbering new writes after every event moved aside
+			rec, err = recoverDataDir(dir, tt.limit, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			st, closeLog = openLogged(t, dir)
+			if got := contents(t, st); fmt.Sprint(got) != fmt.Sprint(states[tt.want]) {
+				t.Errorf("recovered %v,\nwant %v", got, states[tt.want])
+			}
+			if err := st.PutCtx(context.Background(), "new", "x"); err != nil {
+				t.Fatal(err)
+			}
+			if st.Sequence() <= n {
+				t.Errorf("a write after the recovery got sequence %d, reusing one moved aside", st.Sequence())
+			}
+			closeLog()
+
+			// The recovered state survives a restart, and the whole history
+			// is kept aside
+			st, closeLog = openLogged(t, dir)
+			want := map[string]string{"new": "x"}
+			for k, v := range states[tt.want] {
+				want[k] = v
+			}
+			if got := contents(t, st); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("after a restart %v,\nwant %v", got, want)
+			}
+			closeLog()
+
+			archived, closeLog := openLogged(t, rec.Archive)
+			if got := contents(t, archived); archived.Sequence() != n || fmt.Sprint(got) != fmt.Sprint(states[n]) {
+				t.Errorf("%s holds %v at %d, not the whole history", rec.Archive, got, archived.Sequence())
+			}
+			closeLog()
+		})
+	}
+}
+
+func TestRecoverRefusesASnapshotPastTheCut(t *testing.T) {
+	dir := t.TempDir()
+	writeHistory(t, dir, time.Now().Add(-time.Hour), 30)
+
+	st, closeLog := openLogged(t, dir)
+	f, err := os.Create(filepath.Join(dir, store.SnapshotFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Snapshot(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	closeLog()
+
+	if _, err := recoverDataDir(dir, store.ReplayLimit{Sequence: 10}, false); err == nil {
+		t.Fatal("rewound to before the snapshot")
+	}
+
+	// Nothing was moved
+	st, closeLog = openLogged(t, dir)
+	defer closeLog()
+	if st.Sequence() != 30 {
+		t.Errorf("after a refused recovery the directory is at %d, want 30", st.Sequence())
+	}
+}
+
+func TestReplayUntilStartsReadOnly(t *testing.T) {
+	binary := buildBinary(t)
+
+	dataDir := t.TempDir()
+	states := writeHistory(t, dataDir, time.Now().Add(-time.Hour), 60)
+
+	p, err := testharness.StartProcess(context.Background(), testharness.ProcessConfig{
+		Binary:   binary,
+		DataDir:  dataDir,
+		AdminKey: "admin",
+		Args:     []string{"-replay-until-seq", "25"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The server serves the state after the cut, to inspect, and refuses
+	// writes
+	for i := range 10 {
+		key := fmt.Sprintf("k%d", i)
+		want, ok := states[25][key]
+
+		code := status(t, "GET", p.URL()+"/v1/key/"+key, "")
+		if ok && code != http.StatusOK || !ok && code != http.StatusNotFound {
+			t.Errorf("GET %s: %d; want it %q", key, code, want)
+		}
+	}
+
+	if code := status(t, "PUT", p.URL()+"/v1/key/k1", "x"); code < 400 {
+		t.Errorf("PUT during a point-in-time recovery: %d, want it refused", code)
+	}
+}
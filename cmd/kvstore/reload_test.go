@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/testharness"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitForOutput waits for the server's output to contain s n times.
+func waitForOutput(t *testing.T, output *syncBuffer, s string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for strings.Count(output.String(), s) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q not %d times in the output:\n%s", s, n, output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// status returns the status of a request to the server.
+func status(t *testing.T, method, url, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestSIGHUPRotatesAndReloads(t *testing.T) {
+	binary := buildBinary(t)
+	dataDir := t.TempDir()
+
+	configPath := filepath.Join(t.TempDir(), "kvstore.conf")
+	rulesPath := filepath.Join(t.TempDir(), "ip-rules")
+
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(configPath, "max-value-size=1048576\n")
+	writeFile(rulesPath, "deny 127.0.0.0/8\n")
+
+	var output syncBuffer
+	p, err := testharness.StartProcess(context.Background(), testharness.ProcessConfig{
+		Binary:   binary,
+		DataDir:  dataDir,
+		AdminKey: "admin",
+		Args:     []string{"-config", configPath},
+		Output:   &output,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Writes keep succeeding while the server rotates its log, over and
+	// over
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failures []string
+	written := 0
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/v1/key/k%d", p.URL(), i), strings.NewReader("v"))
+			resp, err := http.DefaultClient.Do(req)
+
+			mu.Lock()
+			if err != nil {
+				failures = append(failures, err.Error())
+			} else {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusCreated {
+					failures = append(failures, resp.Status)
+				}
+			}
+			written = i + 1
+			mu.Unlock()
+		}
+	}()
+
+	rotatedAt := 0
+	for i := 1; i <= 3; i++ {
+		// An empty log isn't rotated, so each rotation waits for a write
+		// made after the last; the one in flight then may have been made
+		// before it
+		for n := rotatedAt; n <= rotatedAt+1; {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			n = written
+			mu.Unlock()
+		}
+
+		if err := p.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		waitForOutput(t, &output, "transaction log rotated", i)
+		waitForOutput(t, &output, "config reloaded", i)
+
+		mu.Lock()
+		rotatedAt = written
+		mu.Unlock()
+	}
+	close(stop)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		t.Fatalf("%d of %d writes failed across SIGHUPs: %v", len(failures), written, failures)
+	}
+
+	segments, err := translog.SegmentFiles(filepath.Join(dataDir, translog.LogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 4 {
+		t.Errorf("%d log files after 3 rotations, want 4: %v", len(segments), segments)
+	}
+
+	// Every write is replayed from the rotated segments
+	if err := p.Restart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := range written {
+		if code := status(t, "GET", fmt.Sprintf("%s/v1/key/k%d", p.URL(), i), ""); code != http.StatusOK {
+			t.Fatalf("k%d after the restart: %d", i, code)
+		}
+	}
+
+	// Reloadable settings added to the file take effect, and changes to the
+	// others are reported as ignored
+	writeFile(configPath, "max-value-size=2048\nip-rules="+rulesPath+"\n")
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitForOutput(t, &output, "ignoring the change to -max-value-size", 1)
+	if code := status(t, "GET", p.URL()+"/v1/key/k0", ""); code != http.StatusForbidden {
+		t.Errorf("GET after reloading IP rules denying it: %d, want 403", code)
+	}
+
+	// A file that doesn't load keeps the previous settings
+	writeFile(configPath, "no-such-flag=1\n")
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitForOutput(t, &output, "config reload failed, keeping previous settings", 1)
+	if code := status(t, "GET", p.URL()+"/v1/key/k0", ""); code != http.StatusForbidden {
+		t.Errorf("GET after a failed reload: %d, want the IP rules kept", code)
+	}
+}
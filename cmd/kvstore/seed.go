@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/resp"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// readSeed reads the records of a seed, in a file or at an http(s) URL. In
+// the jsonl format, the seed is a plain export, as written by GET /v1/export
+// or "kvctl export"; in the resp format, it's a stream of Redis commands,
+// as readRESPSeed reads it. apiKey is sent to a URL, whose export endpoint
+// may be an admin endpoint.
+func readSeed(source, format, apiKey string) ([]store.Record, error) {
+	var body io.ReadCloser
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequest(http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s responded %s: %s", source, resp.Status, msg)
+		}
+
+		body = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+
+		body = f
+	}
+	defer body.Close()
+
+	if format == "resp" {
+		return readRESPSeed(body)
+	}
+
+	var records []store.Record
+
+	dec := json.NewDecoder(body)
+	for {
+		var rec store.Record
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid seed record %d: %w", len(records)+1, err)
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// readRESPSeed reads a seed from a stream of Redis commands in RESP, such as
+// a mass-insert file or the export of GET /v1/export?format=resp, into
+// records of the default bucket. String keys, set by SET, SETNX and MSET,
+// are loaded with the last value the stream leaves them with, DEL
+// included; their expiries are dropped, since keys don't expire here. Keys
+// the store can't hold, the other types of Redis, such as hashes and
+// lists, and the keys of databases other than 0 are skipped, and counted
+// in the log.
+func readRESPSeed(r io.Reader) ([]store.Record, error) {
+	values := make(map[string]string)
+	var order []string // Keys in the order they were first set
+
+	set := func(key, value string) {
+		if _, ok := values[key]; !ok {
+			order = append(order, key)
+		}
+		values[key] = value
+	}
+
+	skipped := make(map[string]int)
+	commands, expiries := 0, 0
+	db := "0"
+
+	rd := resp.NewReader(r)
+	for {
+		args, err := rd.ReadCommand()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		commands++
+
+		name := strings.ToUpper(args[0])
+
+		if name == "SELECT" && len(args) == 2 {
+			db = args[1]
+			continue
+		}
+		if db != "0" {
+			skipped["db "+db]++
+			continue
+		}
+
+		switch name {
+		case "SET", "SETNX":
+			if len(args) < 3 || name == "SETNX" && len(args) != 3 {
+				skipped["malformed "+name]++
+				continue
+			}
+
+			nx, xx, expiry, ok := setOptions(args[3:])
+			if !ok {
+				skipped["malformed "+name]++
+				continue
+			}
+			if err := store.ValidateKey(args[1]); err != nil {
+				skipped["invalid key"]++
+				continue
+			}
+
+			_, exists := values[args[1]]
+			if name == "SETNX" || nx {
+				if exists {
+					continue
+				}
+			} else if xx && !exists {
+				continue
+			}
+
+			set(args[1], args[2])
+			if expiry {
+				expiries++
+			}
+		case "MSET":
+			if len(args) < 3 || len(args)%2 == 0 {
+				skipped["malformed MSET"]++
+				continue
+			}
+
+			for i := 1; i < len(args); i += 2 {
+				if err := store.ValidateKey(args[i]); err != nil {
+					skipped["invalid key"]++
+					continue
+				}
+				set(args[i], args[i+1])
+			}
+		case "DEL", "UNLINK":
+			for _, key := range args[1:] {
+				delete(values, key)
+			}
+		default:
+			skipped[name]++ // HSET, RPUSH, SADD, ZADD, RESTORE...
+		}
+	}
+
+	records := make([]store.Record, 0, len(values))
+	for _, key := range order {
+		if value, ok := values[key]; ok {
+			records = append(records, store.Record{Key: key, Value: value})
+			delete(values, key) // A key set again after a DEL is listed once
+		}
+	}
+
+	var summary []string
+	for _, reason := range slices.Sorted(maps.Keys(skipped)) {
+		summary = append(summary, fmt.Sprintf("%s=%d", reason, skipped[reason]))
+	}
+
+	log.Printf("seed: format=resp commands=%d keys=%d expiries_dropped=%d skipped=%s\n",
+		commands, len(records), expiries, cmp.Or(strings.Join(summary, ","), "none"))
+
+	return records, nil
+}
+
+// setOptions parses the options of a SET command, and reports whether it
+// has NX or XX, and an expiry. ok is false if the options are invalid.
+func setOptions(opts []string) (nx, xx, expiry, ok bool) {
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToUpper(opts[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+		case "KEEPTTL":
+			expiry = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i++; i == len(opts) {
+				return false, false, false, false
+			}
+			expiry = true
+		default:
+			return false, false, false, false
+		}
+	}
+
+	return nx, xx, expiry, !(nx && xx)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/testharness"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSeed(t *testing.T) {
+	const export = `{"bucket":"default","key":"a","value":"1"}
+{"bucket":"b","key":"a","value":"2"}
+`
+	path := filepath.Join(t.TempDir(), "seed.jsonl")
+	if err := os.WriteFile(path, []byte(export), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "source" {
+			http.Error(w, "admin key required", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(export))
+	}))
+	defer srv.Close()
+
+	for _, source := range []string{path, srv.URL} {
+		records, err := readSeed(source, "jsonl", "source")
+		if err != nil || len(records) != 2 || records[1].Bucket != "b" || records[1].Value != "2" {
+			t.Errorf("reading the seed %s: %+v, %v", source, records, err)
+		}
+	}
+
+	if _, err := readSeed(srv.URL, "jsonl", ""); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("reading a seed URL refusing the request: %v", err)
+	}
+	if _, err := readSeed(filepath.Join(t.TempDir(), "missing"), "jsonl", ""); err == nil {
+		t.Error("read a seed file that doesn't exist")
+	}
+
+	if err := os.WriteFile(path, []byte(export+"not a record\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSeed(path, "jsonl", ""); err == nil || !strings.Contains(err.Error(), "invalid seed record 3") {
+		t.Errorf("reading a seed with an invalid record: %v", err)
+	}
+}
+
+func TestSeedAtStartup(t *testing.T) {
+	binary := buildBinary(t)
+	ctx := context.Background()
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "source" {
+			http.Error(w, "admin key required", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"bucket":"default","key":"a","value":"from the source"}` + "\n"))
+	}))
+	defer source.Close()
+
+	// start starts an instance on dataDir with args, failing the test if it
+	// can't
+	dataDir := t.TempDir()
+	start := func(args ...string) *testharness.Process {
+		t.Helper()
+
+		var output syncBuffer
+		p, err := testharness.StartProcess(ctx, testharness.ProcessConfig{Binary: binary, DataDir: dataDir, Args: args, Output: &output})
+		if err != nil {
+			t.Fatalf("starting with %v: %v\n%s", args, err, output.String())
+		}
+
+		return p
+	}
+
+	// An HTTP seed is loaded into the new instance, and logged, so it's
+	// still there after a restart without it
+	p := start("-seed", source.URL, "-seed-api-key", "source")
+	if code := status(t, "GET", p.URL()+"/v1/key/a", ""); code != http.StatusOK {
+		t.Errorf("GET a after seeding: %d", code)
+	}
+	if code := status(t, "PUT", p.URL()+"/v1/key/local", "mine"); code != http.StatusCreated {
+		t.Fatalf("PUT local: %d", code)
+	}
+	p.Close()
+
+	p = start()
+	if code := status(t, "GET", p.URL()+"/v1/key/a", ""); code != http.StatusOK {
+		t.Errorf("GET a after a restart without the seed: %d", code)
+	}
+	p.Close()
+
+	// A file seed with another value for a stored key stops the start,
+	// saying how to go on, unless the stored values are to be kept
+	seed := filepath.Join(t.TempDir(), "seed.jsonl")
+	records := `{"bucket":"default","key":"local","value":"seeded"}
+{"bucket":"default","key":"new","value":"seeded"}
+`
+	if err := os.WriteFile(seed, []byte(records), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, ok := runBinary(t, binary, nil, "-data-dir", dataDir, "-listen", "127.0.0.1:0", "-seed", seed)
+	if ok || !strings.Contains(stderr, "default/local") || !strings.Contains(stderr, "-seed-merge") {
+		t.Fatalf("starting with a conflicting seed: ok=%v\n%s", ok, stderr)
+	}
+
+	p = start("-seed", seed, "-seed-merge")
+	defer p.Close()
+
+	for key, want := range map[string]string{"local": "mine", "new": "seeded", "a": "from the source"} {
+		resp, err := http.Get(p.URL() + "/v1/key/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(b) != want {
+			t.Errorf("GET %s after a merged seed: %q, want %q", key, b, want)
+		}
+	}
+}
+
+func TestReadRESPSeed(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// The fixture's string keys, in the order they were first set, with the
+	// values the stream leaves them with
+	big := make([]byte, 1<<20)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	want := []store.Record{
+		{Key: "plain", Value: "v"},
+		{Key: "crlf", Value: "line1\r\nline2\r\n"},
+		{Key: "ключ/日本", Value: "значение ✓ 🚀"},
+		{Key: "nul", Value: "a\x00b\r\n\x00"},
+		{Key: "big", Value: string(big)},
+		{Key: "ttl", Value: "v"},
+		{Key: "m1", Value: "a"},
+		{Key: "m2", Value: "again"},
+	}
+
+	records, err := readSeed(filepath.Join("testdata", "redis.resp"), "resp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(want) {
+		t.Fatalf("%d records, want %d", len(records), len(want))
+	}
+	for i, r := range records {
+		if r != want[i] {
+			t.Errorf("record %d: %.60q, want %.60q", i, r, want[i])
+		}
+	}
+
+	// Hashes, lists, sets, invalid keys and other databases are counted as
+	// skipped, and expiries as dropped
+	for _, part := range []string{"commands=19", "keys=8", "expiries_dropped=1", "skipped=HSET=1,RPUSH=1,SADD=1,db 1=1,invalid key=1"} {
+		if !strings.Contains(logged.String(), part) {
+			t.Errorf("the seed's log line lacks %q: %s", part, logged.String())
+		}
+	}
+
+	// A stream cut short fails the seed, saying where
+	b, err := os.ReadFile(filepath.Join("testdata", "redis.resp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "truncated.resp")
+	if err := os.WriteFile(path, b[:len(b)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSeed(path, "resp", ""); err == nil || !strings.Contains(err.Error(), "command 5") {
+		t.Errorf("reading a truncated stream: %v", err)
+	}
+}
+
+func TestRESPExportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	records, err := readSeed(filepath.Join("testdata", "redis.resp"), "resp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// export seeds a store with records, and exports its default bucket
+	export := func(records []store.Record) []byte {
+		t.Helper()
+
+		st := store.New(translog.NewNopTransactionLogger(), store.Options{})
+		if _, err := st.Seed(ctx, records, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.BucketPut(ctx, "other", "plain", "not exported"); err != nil {
+			t.Fatal(err)
+		}
+
+		srv := httptest.NewServer(api.NewRouter(api.NewServer(st, api.Config{AdminKey: "secret"})))
+		defer srv.Close()
+
+		req, err := http.NewRequest("GET", srv.URL+"/v1/export?format=resp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /v1/export?format=resp: %d %.100s, %v", resp.StatusCode, b, err)
+		}
+		return b
+	}
+
+	// The export, seeded into another instance and exported again, comes
+	// back byte for byte
+	first := export(records)
+
+	path := filepath.Join(t.TempDir(), "export.resp")
+	if err := os.WriteFile(path, first, 0644); err != nil {
+		t.Fatal(err)
+	}
+	again, err := readSeed(path, "resp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(records) {
+		t.Fatalf("%d records read back of %d", len(again), len(records))
+	}
+
+	byKey := make(map[string]string, len(again))
+	for _, r := range again {
+		byKey[r.Key] = r.Value
+	}
+	for _, r := range records {
+		if byKey[r.Key] != r.Value {
+			t.Errorf("%s read back as %.60q, want %.60q", r.Key, byKey[r.Key], r.Value)
+		}
+	}
+
+	if second := export(again); !bytes.Equal(first, second) {
+		t.Error("the export of the re-seeded records differs from the first")
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// selftestBuckets are the buckets the self-test writes to. Bucket names
+// are limited to what store.ValidateBucket accepts; the fixed keys of
+// selftestRecords cover unicode.
+var selftestBuckets = []string{translog.DefaultBucket, "selftest", "self-test_2.v1"}
+
+// selftestPayloadSize is the size of the largest values the self-test
+// writes.
+const selftestPayloadSize = 1 << 20
+
+// selftestReport is the outcome of "kvstore selftest".
+type selftestReport struct {
+	Backend  string `json:"backend"`
+	Location string `json:"location"` // Directory or table written, and removed once done
+	Seed     uint64 `json:"seed"`     // Seed of the generated keys, to repeat a run
+
+	Keys    int   `json:"keys"`    // Keys expected after the reopen
+	Deleted int   `json:"deleted"` // Keys written, then deleted
+	Bytes   int64 `json:"bytes"`   // Bytes of the values expected after the reopen
+	Events  int   `json:"events"`  // Events replayed on reopening
+
+	Write  time.Duration `json:"write_ns"`  // Writing and flushing every event
+	Replay time.Duration `json:"replay_ns"` // Reopening and replaying the log
+
+	Mismatches []string `json:"mismatches"` // What was recovered differently, by bucket and key
+	Error      string   `json:"error,omitempty"`
+}
+
+// selftest implements "kvstore selftest", which checks that a backend
+// gives back exactly what was written to it: it writes a few hundred keys
+// to a throwaway log through the same loggers the server uses, closes it,
+// replays it into a new store and compares every key. The JSON report goes
+// to stdout and a summary to stderr; any difference is an error, so the
+// exit code is non-zero. Whatever was written is removed afterwards.
+func selftest(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	backend := &choiceValue{value: "file", choices: []string{"file", "postgres"}}
+	flags.Var(backend, "log-backend", "transaction log backend to test: file or postgres")
+	dataDir := flags.String("data-dir", ".", "directory to create the throwaway data directory in")
+	compressCodec := flags.String("compress", "none", "compression for large values: none, gzip or zlib")
+	compressThreshold := flags.Int("compress-threshold", 4096, "minimum value size in bytes to compress")
+	keys := flags.Int("keys", 300, "number of keys to write")
+	seed := flags.Uint64("seed", 0, "seed of the generated keys; random if 0")
+
+	var pgParams translog.PostgresdDBParams
+	flags.StringVar(&pgParams.Host, "pg-host", "localhost", "Postgres host for the postgres backend")
+	flags.StringVar(&pgParams.DBName, "pg-db", "kvs", "Postgres database for the postgres backend")
+	flags.StringVar(&pgParams.User, "pg-user", "kvs", "Postgres user for the postgres backend")
+	flags.StringVar(&pgParams.Password, "pg-password", "", "Postgres password for the postgres backend")
+	flags.Parse(args)
+
+	if *keys < 1 || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore selftest [-log-backend file|postgres] [-data-dir DIR] [-keys N]")
+	}
+
+	codec, err := compress.Parse(*compressCodec)
+	if err != nil {
+		return err
+	}
+
+	if *seed == 0 {
+		*seed = rand.Uint64()
+	}
+
+	report := selftestReport{Backend: backend.value, Seed: *seed, Mismatches: []string{}}
+
+	// The snapshot and, for the file backend, the log go in a directory of
+	// their own, and a Postgres log in a table of its own
+	dir, err := os.MkdirTemp(*dataDir, "kvstore-selftest-")
+	if err != nil {
+		return reportSelftest(report, fmt.Errorf("failed to create the data directory: %w", err))
+	}
+	report.Location = dir
+
+	if backend.value == "postgres" {
+		pgParams.Table = fmt.Sprintf("kvs_selftest_%016x", rand.Uint64())
+		report.Location = pgParams.Table
+	}
+
+	opts := store.Options{Codec: codec, CompressThreshold: *compressThreshold}
+	err = runSelftest(&report, backend.value, dir, pgParams, opts, *keys)
+
+	if cleanupErr := cleanupSelftest(backend.value, dir, pgParams); cleanupErr != nil {
+		log.Printf("failed to remove %s: %v\n", report.Location, cleanupErr)
+		err = cmp.Or(err, cleanupErr)
+	}
+
+	return reportSelftest(report, err)
+}
+
+// reportSelftest prints report, with the error the self-test failed with,
+// if any, and returns the error the self-test exits with.
+func reportSelftest(report selftestReport, err error) error {
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	out, jsonErr := json.MarshalIndent(report, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	fmt.Println(string(out))
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("wrote %d keys (%d bytes, %d deleted) to %s in %s, replayed %d events in %s: %d mismatches\n",
+		report.Keys, report.Bytes, report.Deleted, report.Location, report.Write, report.Events, report.Replay,
+		len(report.Mismatches))
+
+	if len(report.Mismatches) > 0 {
+		return fmt.Errorf("%d keys weren't recovered as written", len(report.Mismatches))
+	}
+
+	return nil
+}
+
+// runSelftest writes the keys, reopens the log and compares what it
+// replays, filling in report.
+func runSelftest(report *selftestReport, backend, dir string, pgParams translog.PostgresdDBParams, opts store.Options, keys int) error {
+	ctx := context.Background()
+
+	// Postgres keeps values as text, which can't hold every byte
+	binary := backend == "file"
+	expected, deleted := selftestRecords(rand.New(rand.NewPCG(report.Seed, 0)), keys, binary)
+
+	start := time.Now()
+
+	logger, err := newTransactionLogger(backend, dir, pgParams, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create event logger: %w", err)
+	}
+
+	st := store.New(logger, opts)
+
+	if err := st.Load(dir, logger); err != nil {
+		logger.Close(ctx)
+		return fmt.Errorf("failed to read the new log: %w", err)
+	}
+
+	if err := logger.Run(); err != nil {
+		logger.Close(ctx)
+		return fmt.Errorf("failed to start the transaction log: %w", err)
+	}
+
+	err = writeSelftest(ctx, st, expected, deleted)
+	if err == nil {
+		err = logger.Flush(ctx)
+	}
+	err = cmp.Or(err, logger.Close(ctx))
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	report.Write = time.Since(start)
+	start = time.Now()
+
+	logger, err = newTransactionLogger(backend, dir, pgParams, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reopen event logger: %w", err)
+	}
+	defer logger.Close(ctx)
+
+	st = store.New(logger, opts)
+
+	stats, err := st.LoadUntil(dir, logger, store.ReplayLimit{})
+	if err != nil {
+		return fmt.Errorf("replay failed: %w", err)
+	}
+
+	report.Replay = time.Since(start)
+	report.Events = stats.Events
+	report.Deleted = len(deleted)
+
+	for k, value := range expected {
+		report.Keys++
+		report.Bytes += int64(len(value))
+
+		got, _, err := st.BucketGetWithMeta(ctx, k.bucket, k.key)
+		switch {
+		case errors.Is(err, store.ErrorNoSuchKey):
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s/%q: missing", k.bucket, k.key))
+		case err != nil:
+			return err
+		case got != value:
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s/%q: recovered %d bytes that differ from the %d written", k.bucket, k.key, len(got), len(value)))
+		}
+	}
+
+	buckets, err := st.Buckets()
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range buckets {
+		names, err := st.BucketKeys(ctx, bucket, "")
+		if err != nil {
+			return err
+		}
+
+		for _, key := range names {
+			if _, ok := expected[selftestKey{bucket, key}]; ok {
+				continue
+			}
+
+			what := "extra"
+			if deleted[selftestKey{bucket, key}] {
+				what = "deleted, but recovered"
+			}
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s/%q: %s", bucket, key, what))
+		}
+	}
+
+	slices.Sort(report.Mismatches)
+
+	return nil
+}
+
+// writeSelftest writes every key of expected and deleted, overwriting some
+// along the way, then deletes those of deleted.
+func writeSelftest(ctx context.Context, st *store.Store, expected map[selftestKey]string, deleted map[selftestKey]bool) error {
+	for k := range deleted {
+		if err := st.BucketPut(ctx, k.bucket, k.key, "to be deleted"); err != nil {
+			return err
+		}
+	}
+
+	i := 0
+	for k, value := range expected {
+		// Every third key is first written with another value, so that
+		// replay must apply puts in order
+		if i++; i%3 == 0 {
+			if err := st.BucketPut(ctx, k.bucket, k.key, value+" (overwritten)"); err != nil {
+				return err
+			}
+		}
+
+		if err := st.BucketPut(ctx, k.bucket, k.key, value); err != nil {
+			return err
+		}
+	}
+
+	for k := range deleted {
+		if err := st.BucketDelete(ctx, k.bucket, k.key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type selftestKey struct {
+	bucket, key string
+}
+
+// selftestRecords generates n keys, with the values they should be
+// recovered with, and a tenth as many keys that are deleted once written.
+// A few of each are pathological: unusual keys, and empty, multi-line,
+// tab-separated, unicode and megabyte values. Values with NUL bytes or
+// invalid UTF-8 are only generated if binary is true.
+func selftestRecords(r *rand.Rand, n int, binary bool) (map[selftestKey]string, map[selftestKey]bool) {
+	fixedKeys := []string{
+		"a",
+		" leading and trailing spaces ",
+		"slashes/in/the/key",
+		"ключ-日本語-🔑",
+		"combining é and ZWJ 👩‍💻",
+		"quotes \"'` and escapes \\t\\n",
+		"equals=and&ampersands?#",
+		strings.Repeat("long key ", 100),
+	}
+
+	fixedValues := []string{
+		"",
+		" ",
+		"tab\tseparated\tvalue\t",
+		"\t\t\t",
+		"multi\nline\r\nvalue\n",
+		"\n",
+		"unicode ☃ ключ 日本語 🔑",
+		"{\"json\": [1, 2.5, null, \"x\"]}",
+		strings.Repeat("compressible ", selftestPayloadSize/13),
+		randomText(r, selftestPayloadSize),
+	}
+
+	if binary {
+		fixedValues = append(fixedValues, "nul\x00byte", "\xff\xfe invalid utf-8 \xc3")
+	}
+
+	expected := make(map[selftestKey]string, n)
+	deleted := make(map[selftestKey]bool)
+
+	bucket := func() string { return selftestBuckets[r.IntN(len(selftestBuckets))] }
+
+	for i := 0; len(expected) < n; i++ {
+		k := selftestKey{bucket: bucket()}
+		if i < len(fixedKeys) {
+			k.key = fixedKeys[i]
+		} else {
+			k.key = fmt.Sprintf("key-%d-%s", i, randomText(r, 1+r.IntN(32)))
+		}
+
+		var value string
+		if i < len(fixedValues) {
+			value = fixedValues[i]
+		} else {
+			value = randomText(r, r.IntN(256))
+		}
+
+		// Every key is distinct, so a deleted key is never also expected
+		if i >= len(fixedValues) && i%10 == 0 {
+			deleted[k] = true
+		} else {
+			expected[k] = value
+		}
+	}
+
+	return expected, deleted
+}
+
+// selftestRunes are the characters of random text: ASCII, and some that
+// take two, three and four bytes in UTF-8.
+var selftestRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 -_.:/éßøЖλ日本語☃€🔑😀")
+
+// randomText returns n random characters.
+func randomText(r *rand.Rand, n int) string {
+	var b strings.Builder
+	b.Grow(n)
+
+	for range n {
+		b.WriteRune(selftestRunes[r.IntN(len(selftestRunes))])
+	}
+
+	return b.String()
+}
+
+// cleanupSelftest removes the data directory and Postgres table of a
+// self-test.
+func cleanupSelftest(backend, dir string, pgParams translog.PostgresdDBParams) error {
+	var err error
+
+	if backend == "postgres" {
+		err = translog.DropPostgresTable(pgParams)
+	}
+
+	return cmp.Or(err, os.RemoveAll(dir))
+}
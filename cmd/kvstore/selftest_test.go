@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	binary := buildBinary(t)
+
+	for _, test := range []struct {
+		seed uint64
+		args []string
+	}{
+		{1, nil},
+		{2, []string{"-compress", "gzip", "-compress-threshold", "64"}},
+	} {
+		t.Run(fmt.Sprint(test.seed), func(t *testing.T) {
+			dir := t.TempDir()
+
+			args := append([]string{"selftest", "-data-dir", dir, "-keys", "200", "-seed", fmt.Sprint(test.seed)}, test.args...)
+			stdout, stderr, ok := runBinary(t, binary, nil, args...)
+			if !ok {
+				t.Fatalf("selftest failed:\n%s\n%s", stdout, stderr)
+			}
+
+			var report selftestReport
+			if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+				t.Fatalf("report: %v\n%s", err, stdout)
+			}
+			if report.Backend != "file" || report.Seed != test.seed || report.Error != "" {
+				t.Errorf("report of backend %q, seed %d and error %q", report.Backend, report.Seed, report.Error)
+			}
+			if report.Keys != 200 || report.Deleted == 0 || report.Bytes == 0 || report.Events < report.Keys+2*report.Deleted || len(report.Mismatches) != 0 {
+				t.Errorf("report of %d keys, %d deleted, %d bytes, %d events and mismatches %q", report.Keys, report.Deleted, report.Bytes, report.Events, report.Mismatches)
+			}
+
+			// The throwaway directory was made in dir, and removed
+			if filepath.Dir(report.Location) != dir {
+				t.Errorf("wrote to %s, want a directory in %s", report.Location, dir)
+			}
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+				t.Errorf("%s left with %v (%v)", dir, entries, err)
+			}
+		})
+	}
+}
+
+// TestSelftestRecords checks that everything the self-test writes is
+// accepted by the store, which it otherwise fails writing.
+func TestSelftestRecords(t *testing.T) {
+	for _, bucket := range selftestBuckets {
+		if err := store.ValidateBucket(bucket); err != nil {
+			t.Error(err)
+		}
+	}
+
+	expected, deleted := selftestRecords(rand.New(rand.NewPCG(1, 0)), 300, true)
+	for k := range expected {
+		if err := store.ValidateKey(k.key); err != nil {
+			t.Error(err)
+		}
+	}
+	for k := range deleted {
+		if err := store.ValidateKey(k.key); err != nil {
+			t.Error(err)
+		}
+	}
+}
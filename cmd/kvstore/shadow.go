@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/pgstate"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+)
+
+// openShadow opens the shadow store of -shadow-backend, with the options of
+// the primary but its own backend, and loads it. Its logger is running when
+// it returns, and must be closed on shutdown.
+func openShadow(backend, dataDir string, pgParams translog.PostgresdDBParams, opts store.Options) (*store.Store, translog.TransactionLogger, error) {
+	var logger translog.TransactionLogger
+	var err error
+
+	opts.Backing, opts.CoalesceReads = nil, false
+
+	if backend == "postgres-state" {
+		b, err := pgstate.New(pgParams)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create shadow state backend: %w", err)
+		}
+
+		logger, opts.Backing, opts.CoalesceReads = b, b, true
+	} else if logger, err = newTransactionLogger(backend, dataDir, pgParams, nil); err != nil {
+		return nil, nil, fmt.Errorf("failed to create shadow event logger: %w", err)
+	}
+
+	st := store.New(logger, opts)
+
+	if err := st.Load(dataDir, logger); err != nil {
+		return nil, nil, fmt.Errorf("shadow replay failed: %w", err)
+	}
+
+	if err := logger.Run(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start the shadow transaction log: %w", err)
+	}
+
+	return st, logger, nil
+}
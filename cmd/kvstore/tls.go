@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certReloader serves the certificate in a pair of PEM files and picks up
+// a new one whenever the files change, so certificates can be rotated
+// without a restart. Handshakes after a reload get the new certificate;
+// connections already established keep their session.
+type certReloader struct {
+	certFile, keyFile string
+
+	cert atomic.Pointer[tls.Certificate]
+
+	mu    sync.Mutex // Serializes reloads
+	stamp string     // Sizes and modification times of the files last loaded
+}
+
+// newCertReloader loads the certificate in certFile and its key in keyFile.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// loadCertFlags returns the reloader of the pair in certFile and keyFile,
+// set by the flags certFlag and keyFlag, or nil if neither is set.
+func loadCertFlags(certFile, keyFile, certFlag, keyFlag string) (*certReloader, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("%s and %s must be set together", certFlag, keyFlag)
+	}
+
+	return newCertReloader(certFile, keyFile)
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// reload loads the pair from the files and swaps it in if it is valid: the
+// key must match the certificate, which must be current. A pair that fails
+// leaves the previous one in use.
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return err
+	}
+	r.stamp = stamp
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate: %w", err)
+	}
+
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("TLS certificate is only valid from %s to %s",
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	cert.Leaf = leaf
+	r.cert.Store(&cert)
+
+	return nil
+}
+
+// fileStamp describes the current state of the files, to tell when either
+// has been rewritten.
+func (r *certReloader) fileStamp() (string, error) {
+	var stamp string
+
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+
+		stamp += fmt.Sprintf("%d@%d;", fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return stamp, nil
+}
+
+// changed reports whether the files differ from those last loaded. A file
+// that can't be read, such as one being replaced, counts as unchanged until
+// it is back.
+func (r *certReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamp, err := r.fileStamp()
+
+	return err == nil && stamp != r.stamp
+}
+
+// watch polls the files every interval, until ctx is done, and reloads the
+// pair when they change. Issuers often write the certificate and the key
+// one after the other; a reload between the two fails, and the next change
+// is retried.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+
+			if err := r.reload(); err != nil {
+				log.Printf("TLS certificate reload failed, keeping the previous one: %v\n", err)
+				continue
+			}
+
+			log.Printf("TLS certificate reloaded, valid until %s\n", r.cert.Load().Leaf.NotAfter.Format(time.RFC3339))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tlsConfig returns the server TLS configuration serving r's certificate.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// loadClientCAs returns the pool of the CA certificates in the PEM file at
+// path.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+
+	return pool, nil
+}
+
+// verifyClients has cfg verify the certificates clients present against
+// clientCAs, if it isn't nil. Clients may still connect without one.
+func verifyClients(cfg *tls.Config, clientCAs *x509.CertPool) {
+	if clientCAs == nil {
+		return
+	}
+
+	cfg.ClientCAs = clientCAs
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+}
+
+// parseScopes parses comma-separated id=scope+scope pairs into the scopes
+// of each id. An id may itself hold "=", so the last one separates it.
+func parseScopes(s string) (map[string][]string, error) {
+	scopes := make(map[string][]string)
+	if s == "" {
+		return scopes, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("%q: expected id=scope+scope", pair)
+		}
+
+		for _, scope := range strings.Split(pair[i+1:], "+") {
+			if scope != api.ScopeAdmin && scope != api.ScopeUnlimited {
+				return nil, fmt.Errorf("%q: unknown scope %q, expected %s or %s", pair, scope, api.ScopeAdmin, api.ScopeUnlimited)
+			}
+			scopes[pair[:i]] = append(scopes[pair[:i]], scope)
+		}
+	}
+
+	return scopes, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for name, valid from
+// notBefore to notAfter, and its key, to the PEM files certFile and
+// keyFile. The key goes first, as an issuer rotating the pair might.
+func writeCert(t *testing.T, certFile, keyFile, name string, notBefore, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keyFile != "" {
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName connects to addr and returns the name in the certificate the
+// server presents, and the connection.
+func servedName(t *testing.T, addr string) (string, *tls.Conn) {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, conn
+}
+
+// echo answers each byte sent on conn with the same byte.
+func echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func TestCertificateRotation(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	now := time.Now()
+	writeCert(t, certFile, keyFile, "first.example", now.Add(-time.Hour), now.Add(24*time.Hour))
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.watch(ctx, 5*time.Millisecond)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.tlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn)
+		}
+	}()
+
+	addr := ln.Addr().String()
+
+	name, before := servedName(t, addr)
+	if name != "first.example" {
+		t.Fatalf("served %s before the rotation, want first.example", name)
+	}
+
+	// waitForName waits for new connections to be served the certificate
+	// for want
+	waitForName := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			name, conn := servedName(t, addr)
+			conn.Close()
+			if name == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("new connections still get %s, want %s", name, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// New handshakes get the rotated certificate, and the connection made
+	// before keeps working on its session
+	writeCert(t, certFile, keyFile, "second.example", now.Add(-time.Hour), now.Add(24*time.Hour))
+	waitForName("second.example")
+
+	if _, err := before.Write([]byte("ping")); err != nil {
+		t.Fatalf("the connection made before the rotation: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(before, b); err != nil || string(b) != "ping" {
+		t.Fatalf("the connection made before the rotation read %q, %v", b, err)
+	}
+	if name := before.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "first.example" {
+		t.Errorf("the connection made before the rotation has %s", name)
+	}
+
+	// A certificate not matching its key, or expired, is refused, keeping
+	// the one in use
+	writeCert(t, certFile, "", "mismatched.example", now.Add(-time.Hour), now.Add(24*time.Hour))
+	time.Sleep(50 * time.Millisecond)
+	if name, _ := servedName(t, addr); name != "second.example" {
+		t.Errorf("served %s after a certificate not matching its key was written", name)
+	}
+
+	writeCert(t, certFile, keyFile, "expired.example", now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+	time.Sleep(50 * time.Millisecond)
+	if name, _ := servedName(t, addr); name != "second.example" {
+		t.Errorf("served %s after an expired certificate was written", name)
+	}
+
+	// And a valid pair is picked up once it's written
+	writeCert(t, certFile, keyFile, "third.example", now.Add(-time.Hour), now.Add(24*time.Hour))
+	waitForName("third.example")
+}
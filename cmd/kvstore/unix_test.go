@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeOverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.sock")
+
+	unixListener, err := listenUnix(path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode %v, want 0660", fi.Mode().Perm())
+	}
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := translog.NewNopTransactionLogger()
+	st := store.New(l, store.Options{})
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// One server on both listeners, as main serves them
+	srv := &http.Server{Handler: api.NewRouter(api.NewServer(st, api.Config{}))}
+	go srv.Serve(unixListener)
+	go srv.Serve(tcpListener)
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+
+	req, _ := http.NewRequest("PUT", "http://kv/v1/key/greeting", strings.NewReader("hello"))
+	resp, err := unixClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT over the socket: %d", resp.StatusCode)
+	}
+
+	// The value written over the socket is read over TCP
+	resp, err = http.Get("http://" + tcpListener.Addr().String() + "/v1/key/greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello" {
+		t.Errorf("GET over TCP returned %d %q", resp.StatusCode, b)
+	}
+
+	// A socket in use isn't taken over
+	if _, err := listenUnix(path, 0660); err == nil {
+		t.Error("listened on a socket in use by another server")
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind on shutdown: %v", err)
+	}
+}
+
+func TestListenUnixRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.sock")
+
+	// A process that died leaves its socket file behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	l.Close()
+
+	// A file that isn't a socket is never removed
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path, 0600); err == nil {
+		t.Error("listened over a regular file")
+	}
+}
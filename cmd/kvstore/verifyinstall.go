@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/testharness"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+// verifyInstallLogName is the file in the throwaway data directory that
+// the server's output goes to.
+const verifyInstallLogName = "server.log"
+
+// verifyInstall implements "kvstore verify-install", which checks a built
+// binary end to end: it starts the binary as a server on a random loopback
+// port with a throwaway data directory, or Postgres table, runs the
+// testharness scenario against it over HTTP, restarting it along the way,
+// and stops it. The JSON report goes to stdout; a failed step is an error,
+// so the exit code is non-zero. The data directory, with the server's
+// output, is kept if a step fails, and removed otherwise unless -keep is
+// given.
+func verifyInstall(args []string) error {
+	flags := flag.NewFlagSet("verify-install", flag.ExitOnError)
+	binary := flags.String("binary", "", "kvstore binary to check; this one if empty")
+	backend := &choiceValue{value: "file", choices: []string{"file", "postgres", "none"}}
+	flags.Var(backend, "log-backend", "transaction log backend to run the server with: file, postgres or none")
+	dataDir := flags.String("data-dir", os.TempDir(), "directory to create the throwaway data directory in")
+	keep := flags.Bool("keep", false, "keep the data directory, and Postgres table, even if every step passes")
+
+	var pgParams translog.PostgresdDBParams
+	flags.StringVar(&pgParams.Host, "pg-host", "localhost", "Postgres host for the postgres backend")
+	flags.StringVar(&pgParams.DBName, "pg-db", "kvs", "Postgres database for the postgres backend")
+	flags.StringVar(&pgParams.User, "pg-user", "kvs", "Postgres user for the postgres backend")
+	flags.StringVar(&pgParams.Password, "pg-password", "", "Postgres password for the postgres backend")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("usage: kvstore verify-install [-binary PATH] [-log-backend file|postgres|none] [-data-dir DIR]")
+	}
+
+	if *binary == "" {
+		self, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find this binary: %w", err)
+		}
+		*binary = self
+	}
+
+	dir, err := os.MkdirTemp(*dataDir, "kvstore-verify-")
+	if err != nil {
+		return fmt.Errorf("failed to create the data directory: %w", err)
+	}
+
+	output, err := os.Create(filepath.Join(dir, verifyInstallLogName))
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	cfg := testharness.ProcessConfig{
+		Binary:   *binary,
+		DataDir:  dir,
+		AdminKey: fmt.Sprintf("verify-%016x", rand.Uint64()),
+		Args:     []string{"-log-backend", backend.value},
+		Durable:  backend.value != "none",
+		Output:   output,
+	}
+
+	if backend.value == "postgres" {
+		// The server's log goes in a table of its own
+		pgParams.Table = fmt.Sprintf("kvs_verify_%016x", rand.Uint64())
+		cfg.Args = append(cfg.Args, "-pg-host", pgParams.Host, "-pg-db", pgParams.DBName, "-pg-user", pgParams.User, "-pg-table", pgParams.Table)
+
+		// Kept off the command line, which other users can read
+		cfg.Env = []string{envPrefix + "PG_PASSWORD=" + pgParams.Password}
+	}
+
+	report, err := runVerifyInstall(cfg, backend.value)
+	if err == nil {
+		err = report.Err()
+	}
+
+	out, jsonErr := json.MarshalIndent(report, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	fmt.Println(string(out))
+
+	if err != nil {
+		log.Printf("kept %s, with the server's output in %s\n", dir, verifyInstallLogName)
+		return err
+	}
+
+	if *keep {
+		log.Printf("passed %d steps in %s; kept %s\n", len(report.Steps), report.Duration, dir)
+		return nil
+	}
+
+	var cleanupErr error
+	if backend.value == "postgres" {
+		cleanupErr = translog.DropPostgresTable(pgParams)
+	}
+	cleanupErr = cmp.Or(cleanupErr, os.RemoveAll(dir))
+	if cleanupErr != nil {
+		return fmt.Errorf("failed to remove %s: %w", dir, cleanupErr)
+	}
+
+	log.Printf("passed %d steps in %s\n", len(report.Steps), report.Duration)
+
+	return nil
+}
+
+// runVerifyInstall starts the server, runs the scenario against it and
+// stops it.
+func runVerifyInstall(cfg testharness.ProcessConfig, backend string) (testharness.Report, error) {
+	ctx := context.Background()
+
+	p, err := testharness.StartProcess(ctx, cfg)
+	if err != nil {
+		return testharness.Report{Target: backend}, err
+	}
+
+	report := testharness.Run(ctx, backend, p)
+
+	return report, p.Close()
+}
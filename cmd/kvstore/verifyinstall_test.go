@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/sheritzs/key-value-store/internal/testharness"
+	"testing"
+)
+
+func TestVerifyInstall(t *testing.T) {
+	binary := buildBinary(t)
+
+	for _, backend := range []string{"file", "none"} {
+		t.Run(backend, func(t *testing.T) {
+			report, err := runVerifyInstall(testharness.ProcessConfig{
+				Binary:   binary,
+				DataDir:  t.TempDir(),
+				AdminKey: "verify",
+				Args:     []string{"-log-backend", backend},
+				Durable:  backend != "none",
+			}, backend)
+			if err == nil {
+				err = report.Err()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+)
+
+// maxJSONBody bounds the size of the JSON request bodies accepted by the
+// atomic operation endpoints.
+const maxJSONBody = 1 << 20
+
+// decodeJSONBody decodes the request body into v, rejecting unknown fields.
+// Bodies over maxJSONBody are reported as ErrorValueTooLarge, and those that
+// don't decode as ErrorInvalidRequest.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) error {
+	return decodeJSONBodyUpTo(w, r, v, maxJSONBody)
+}
+
+// decodeJSONBodyUpTo is decodeJSONBody for bodies of up to limit bytes.
+func decodeJSONBodyUpTo(w http.ResponseWriter, r *http.Request, v any, limit int64) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("%w: over %d bytes", ErrorValueTooLarge, tooLarge.Limit)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorInvalidRequest, err)
+	}
+
+	return nil
+}
+
+// casHandler expects a POST request for the "v1/key/{key}/cas" resource with
+// a body like {"expected": "old", "value": "new"}, with "encoding": "base64"
+// if both are base64-encoded, as valueEncodingBase64 describes. It answers
+// 200 if the value was swapped and 409 if the current value didn't match.
+func (s *Server) casHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var req struct {
+		Expected *string `json:"expected"`
+		Value    *string `json:"value"`
+		Encoding string  `json:"encoding"` // Of Expected and Value
+	}
+
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if req.Expected == nil || req.Value == nil {
+		s.writeError(w, fmt.Errorf(`%w: expected a body like {"expected":"old","value":"new"}`, ErrorInvalidRequest))
+		return
+	}
+	for _, value := range []*string{req.Expected, req.Value} {
+		if err := decodeJSONValue(value, req.Encoding); err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+
+	var seq uint64
+	var usage store.QuotaUsage
+
+	ctx := store.WithQuotaWarning(store.WithSequence(r.Context(), &seq), &usage)
+
+	swapped, err := s.store.BucketCompareAndSwap(ctx, bucket, key, *req.Expected, *req.Value)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if !swapped {
+		s.writeError(w, store.ErrorCASMismatch)
+		return
+	}
+
+	writeSequence(w, seq)
+	writeQuotaWarning(w, usage)
+
+	log.Printf("CAS bucket=%s key=%s\n", bucket, key)
+}
+
+// incrHandler expects a POST request for the "v1/key/{key}/incr" resource
+// with a body like {"delta": 5}, and responds with the new value.
+func (s *Server) incrHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var req struct {
+		Delta *int64 `json:"delta"`
+	}
+
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if req.Delta == nil {
+		s.writeError(w, fmt.Errorf(`%w: expected a body like {"delta":1}`, ErrorInvalidRequest))
+		return
+	}
+
+	var seq uint64
+	var usage store.QuotaUsage
+
+	ctx := store.WithQuotaWarning(store.WithSequence(r.Context(), &seq), &usage)
+
+	n, err := s.store.BucketIncrement(ctx, bucket, key, *req.Delta)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+	writeQuotaWarning(w, usage)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Value int64 `json:"value"`
+	}{n})
+
+	log.Printf("INCR bucket=%s key=%s delta=%d\n", bucket, key, *req.Delta)
+}
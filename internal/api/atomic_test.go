@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCASRace(t *testing.T) {
+	dir := t.TempDir()
+
+	st, h, closeLog := openRouter(t, dir, Config{})
+
+	const rounds = 50
+
+	if w := serve(h, "PUT", "/v1/key/k", "0", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	for round := range rounds {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		results := make([]*httptest.ResponseRecorder, 2)
+
+		// Both clients read the same value and try to replace it
+		for client := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				body := fmt.Sprintf(`{"expected":"%d","value":"%d"}`, round, round+1)
+				results[client] = serve(h, "POST", "/v1/key/k/cas", body, nil)
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+
+		wins := 0
+		for _, w := range results {
+			switch w.Code {
+			case http.StatusOK:
+				wins++
+			case http.StatusConflict:
+			default:
+				t.Fatalf("round %d: CAS returned %d %s", round, w.Code, w.Body)
+			}
+		}
+		if wins != 1 {
+			t.Fatalf("round %d: %d clients won the CAS, want 1", round, wins)
+		}
+	}
+
+	_, meta, err := st.GetWithMeta("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	// Each win was logged once: the put, then one version per round
+	replayed, h, closeLog := openRouter(t, dir, Config{})
+	defer closeLog()
+
+	v, replayedMeta, err := replayed.GetWithMeta("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != fmt.Sprint(rounds) || replayedMeta.Version != rounds+1 || replayedMeta.Version != meta.Version {
+		t.Errorf("replayed %q at version %d, want %d at version %d", v, replayedMeta.Version, rounds, rounds+1)
+	}
+
+	// A mismatch leaves the value alone
+	if w := serve(h, "POST", "/v1/key/k/cas", `{"expected":"0","value":"x"}`, nil); w.Code != http.StatusConflict {
+		t.Errorf("CAS of a stale value: %d, want 409", w.Code)
+	}
+	if w := serve(h, "POST", "/v1/key/k/cas", `{"value":"x"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("CAS without expected: %d, want 400", w.Code)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	dir := t.TempDir()
+
+	_, h, closeLog := openRouter(t, dir, Config{})
+
+	for _, want := range []int64{5, 10} {
+		w := serve(h, "POST", "/v1/key/counter/incr", `{"delta":5}`, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("incr: %d %s", w.Code, w.Body)
+		}
+
+		var body struct {
+			Value int64 `json:"value"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Value != want {
+			t.Errorf("incr returned %d, %v; want %d", body.Value, err, want)
+		}
+	}
+
+	if w := serve(h, "PUT", "/v1/key/name", "alice", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "POST", "/v1/key/name/incr", `{"delta":1}`, nil); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("incr of a non-numeric value: %d %s, want 422", w.Code, w.Body)
+	}
+	if w := serve(h, "POST", "/v1/key/counter/incr", `{}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("incr without delta: %d, want 400", w.Code)
+	}
+	closeLog()
+
+	_, h, closeLog = openRouter(t, dir, Config{})
+	defer closeLog()
+
+	if w := serve(h, "GET", "/v1/key/counter", "", nil); w.Body.String() != "10" || w.Header().Get("X-KV-Version") != "2" {
+		t.Errorf("counter after replay is %q at version %s, want 10 at version 2", w.Body, w.Header().Get("X-KV-Version"))
+	}
+	if w := serve(h, "GET", "/v1/key/name", "", nil); w.Body.String() != "alice" {
+		t.Errorf("name after a failed incr is %q", w.Body)
+	}
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord describes one audited request. Records are written to the
+// audit log as one JSON object per line.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Principal string    `json:"principal"`
+	RemoteIP  string    `json:"remote_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Bucket    string    `json:"bucket,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	ValueLen  int64     `json:"value_len"`
+	Status    int       `json:"status"`
+	Forced    bool      `json:"forced,omitempty"` // Whether the request carried ForceHeader, to change write-once keys
+}
+
+// AuditLogger writes audit records from a bounded buffer on its own
+// goroutine, so a slow audit destination never holds up a request. Records
+// that don't fit in the buffer are dropped and counted.
+type AuditLogger struct {
+	records chan auditRecord
+	done    chan struct{}
+	reads   bool // Whether GET and HEAD requests are audited too
+}
+
+func NewAuditLogger(w io.Writer, buffer int, reads bool) *AuditLogger {
+	a := &AuditLogger{
+		records: make(chan auditRecord, buffer),
+		done:    make(chan struct{}),
+		reads:   reads,
+	}
+
+	go func() {
+		defer close(a.done)
+
+		enc := json.NewEncoder(w)
+		for rec := range a.records {
+			if err := enc.Encode(rec); err != nil {
+				log.Printf("audit log write failed: %v\n", err)
+			}
+		}
+	}()
+
+	return a
+}
+
+// record enqueues rec without blocking.
+func (a *AuditLogger) record(rec auditRecord) {
+	select {
+	case a.records <- rec:
+	default:
+		auditDroppedTotal.Inc()
+	}
+}
+
+// Close writes the records still buffered and stops the writer goroutine.
+func (a *AuditLogger) Close() {
+	close(a.records)
+	<-a.done
+}
+
+// clientIP returns the client address of r as determined by the IP rules,
+// or "unix" for a request over the Unix socket.
+func (s *Server) clientIP(r *http.Request) string {
+	peer, ok := peerAddr(r)
+	if !ok {
+		return "unix"
+	}
+
+	if rules := s.settings.Load().ipRules; rules != nil {
+		if client, ok := rules.clientAddr(peer, r); ok {
+			return client.String()
+		}
+	}
+
+	return peer.String()
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, for
+// handlers that stream and need to flush.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader counts the bytes of a request body read by the handler.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// auditRequests records every mutating request, and reads if configured, in
+// the audit log once the handler has finished.
+func (s *Server) auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if s.audit == nil || (read && !s.audit.reads) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+
+		// Authentication comes later, so that failures are audited too
+		r = r.WithContext(withPrincipalSlot(r.Context()))
+
+		next.ServeHTTP(rec, r)
+
+		vars := mux.Vars(r)
+		key, err := url.PathUnescape(vars["key"])
+		if err != nil {
+			key = vars["key"]
+		}
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		s.audit.record(auditRecord{
+			Time:      time.Now().UTC(),
+			RequestID: requestID(r.Context()),
+			Principal: PrincipalFrom(r.Context()).ID,
+			RemoteIP:  s.clientIP(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Bucket:    vars["bucket"],
+			Key:       key,
+			ValueLen:  body.n,
+			Status:    status,
+			Forced:    forced(r),
+		})
+	})
+}
+
+// RotatingFile is an append-only file that is rotated once it would grow
+// past maxSize bytes: path is renamed to path.1, path.1 to path.2 and so on,
+// keeping at most backups old files.
+type RotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot stat audit log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.backups < 1 {
+		os.Remove(f.path)
+	} else {
+		for i := f.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return fmt.Errorf("cannot rotate audit log file: %w", err)
+		}
+	}
+
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
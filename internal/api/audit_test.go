@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blockingWriter holds every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+// auditRecords decodes the records written to buf.
+func auditRecords(t *testing.T, buf *bytes.Buffer) []auditRecord {
+	t.Helper()
+
+	var records []auditRecord
+
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+
+	return records
+}
+
+func TestAuditRecords(t *testing.T) {
+	var buf bytes.Buffer
+	audit := NewAuditLogger(&buf, 16, false)
+
+	keys := &APIKeyAuthenticator{Keys: map[string]Principal{"user-key": {ID: "user"}}}
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{Audit: audit, Authenticator: keys})
+	defer closeLog()
+
+	before := time.Now().UTC()
+
+	if w := serve(h, "PUT", "/v2/buckets/b/key/a%2Fb", "hello", http.Header{"X-Api-Key": {"user-key"}}); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "GET", "/v2/buckets/b/key/a%2Fb", "", http.Header{"X-Api-Key": {"user-key"}}); w.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "DELETE", "/v2/key/k", "", http.Header{"X-Api-Key": {"guess"}}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("DELETE with an unknown key: %d %s", w.Code, w.Body)
+	}
+
+	audit.Close()
+
+	records := auditRecords(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("%d records, want the PUT and the DELETE but not the GET: %+v", len(records), records)
+	}
+
+	put := records[0]
+	if put.Time.Before(before) || put.RequestID == "" {
+		t.Errorf("PUT record time %v, request ID %q: want a time since the test started and an ID", put.Time, put.RequestID)
+	}
+	put.Time, put.RequestID = time.Time{}, ""
+
+	want := auditRecord{Principal: "user", RemoteIP: "192.0.2.1", Method: "PUT", Path: "/v2/buckets/b/key/a/b", Bucket: "b", Key: "a/b", ValueLen: 5, Status: http.StatusCreated}
+	if put != want {
+		t.Errorf("PUT record %+v, want %+v", put, want)
+	}
+
+	// Requests that fail authentication are audited too, as anonymous
+	del := records[1]
+	del.Time, del.RequestID = time.Time{}, ""
+
+	want = auditRecord{Principal: Anonymous.ID, RemoteIP: "192.0.2.1", Method: "DELETE", Path: "/v2/key/k", Key: "k", Status: http.StatusUnauthorized}
+	if del != want {
+		t.Errorf("DELETE record %+v, want %+v", del, want)
+	}
+}
+
+func TestAuditReads(t *testing.T) {
+	var buf bytes.Buffer
+	audit := NewAuditLogger(&buf, 16, true)
+
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{Audit: audit})
+	defer closeLog()
+
+	serve(h, "GET", "/v2/key/k", "", nil)
+	serve(h, "HEAD", "/v2/key/k", "", nil)
+
+	audit.Close()
+
+	records := auditRecords(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2: %+v", len(records), records)
+	}
+	for i, method := range []string{"GET", "HEAD"} {
+		if rec := records[i]; rec.Method != method || rec.Key != "k" || rec.Status != http.StatusNotFound {
+			t.Errorf("record %d: %+v, want a %s of k answered with 404", i, rec, method)
+		}
+	}
+}
+
+func TestAuditDoesNotBlockRequests(t *testing.T) {
+	out := blockingWriter{release: make(chan struct{})}
+	audit := NewAuditLogger(out, 2, false)
+
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{Audit: audit})
+	defer closeLog()
+
+	before := testutil.ToFloat64(auditDroppedTotal)
+
+	// The writer holds the first record, two more fill the buffer, and the
+	// rest are dropped, while every request is answered straight away
+	const requests = 10
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := range requests {
+			if w := serve(h, "PUT", fmt.Sprintf("/v2/key/k%d", i), "v", nil); w.Code != http.StatusCreated {
+				t.Errorf("PUT k%d: %d %s", i, w.Code, w.Body)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests held up by a stuck audit log")
+	}
+
+	// The writer takes the first record off the buffer concurrently, so it
+	// may or may not have made room for one more
+	dropped := testutil.ToFloat64(auditDroppedTotal) - before
+	if dropped != requests-3 && dropped != requests-2 {
+		t.Errorf("%v records dropped, want %d or %d", dropped, requests-3, requests-2)
+	}
+
+	close(out.release)
+	audit.Close()
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each line would take the file past 10 bytes, so each rotates; the
+	// oldest falls off the end
+	want := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for name, content := range want {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("%s: %q, want %q", filepath.Base(name), b, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 kept past the 2 backups: %v", filepath.Base(path), err)
+	}
+
+	// Reopening appends to the current file
+	f, err = OpenRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fifth\n"))
+	f.Close()
+
+	if b, _ := os.ReadFile(path); string(b) != "fourth\nfifth\n" {
+		t.Errorf("after reopening: %q, want the line appended", b)
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// Scopes a Principal may hold.
+const (
+	ScopeAdmin     = "admin"     // May use the admin endpoints
+	ScopeUnlimited = "unlimited" // Isn't held to the concurrency limits
+)
+
+// Principal is who made a request, as an Authenticator established it.
+type Principal struct {
+	ID     string   // Names the principal in audit records and as the owner of leases
+	Scopes []string // What the principal may do beyond the key API, such as ScopeAdmin
+}
+
+// Anonymous is the principal of the requests no one is known to have made.
+var Anonymous = Principal{ID: "anonymous"}
+
+// adminPrincipal is the principal of a request presenting the admin API
+// key, unless its Authenticator knows better.
+var adminPrincipal = Principal{ID: "admin", Scopes: []string{ScopeAdmin}}
+
+// IsAnonymous reports whether p is no one in particular.
+func (p Principal) IsAnonymous() bool {
+	return p.ID == "" || p.ID == Anonymous.ID
+}
+
+// Has reports whether p holds scope.
+func (p Principal) Has(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// Authenticator establishes who made requests. The server authenticates
+// every request once, before authorizing and serving it.
+type Authenticator interface {
+	// Authenticate returns the principal of r: Anonymous if r carries no
+	// credentials the Authenticator knows, or an error, which rejects r
+	// with 401 Unauthorized, if it carries credentials that are invalid.
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// AnonymousAuthenticator takes every request to be anonymous. It's the
+// default, under which only the admin API key identifies anyone.
+type AnonymousAuthenticator struct{}
+
+func (AnonymousAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	return Anonymous, nil
+}
+
+// APIKeyAuthenticator authenticates requests by the API key in their
+// X-API-Key header. A request without one is anonymous; one with a key
+// not in Keys is rejected.
+type APIKeyAuthenticator struct {
+	Keys map[string]Principal // Principals by API key
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	presented := r.Header.Get("X-API-Key")
+	if presented == "" {
+		return Anonymous, nil
+	}
+
+	// Every key is compared in constant time, so that timing reveals none
+	found := Anonymous
+	ok := false
+	for key, p := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+			found, ok = p, true
+		}
+	}
+
+	if !ok {
+		return Anonymous, errors.New("unknown API key")
+	}
+
+	return found, nil
+}
+
+// MTLSAuthenticator authenticates requests by the client certificate of
+// their TLS connection, which the server must have verified: its
+// tls.Config needs ClientCAs and a ClientAuth of
+// tls.VerifyClientCertIfGiven or stricter. The principal is named by the
+// certificate's first URI SAN, such as a SPIFFE ID, else its first DNS or
+// email SAN, else its subject's common name. Requests without a
+// certificate are anonymous.
+type MTLSAuthenticator struct {
+	Scopes map[string][]string // Scopes of the principals, by ID
+}
+
+func (a *MTLSAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return Anonymous, nil
+	}
+
+	if len(r.TLS.VerifiedChains) == 0 {
+		return Anonymous, errors.New("client certificate not verified")
+	}
+
+	id := certIdentity(r.TLS.VerifiedChains[0][0])
+	if id == "" {
+		return Anonymous, errors.New("client certificate names no one")
+	}
+
+	return Principal{ID: id, Scopes: a.Scopes[id]}, nil
+}
+
+// certIdentity returns the name of the holder of cert, as
+// MTLSAuthenticator takes it, or "" if it has none.
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	default:
+		return cert.Subject.CommonName
+	}
+}
+
+// principalFunc adapts a Config.Principal hook into an Authenticator.
+type principalFunc func(r *http.Request) string
+
+func (f principalFunc) Authenticate(r *http.Request) (Principal, error) {
+	if name := f(r); name != "" {
+		return Principal{ID: name}, nil
+	}
+
+	return Anonymous, nil
+}
+
+// principalKey is the context key of the principal of a request.
+type principalKey struct{}
+
+// PrincipalFrom returns the principal of the request whose context is ctx,
+// for Config.Authorize hooks and handlers, or Anonymous before the request
+// is authenticated.
+func PrincipalFrom(ctx context.Context) Principal {
+	if p, ok := ctx.Value(principalKey{}).(*Principal); ok && p.ID != "" {
+		return *p
+	}
+
+	return Anonymous
+}
+
+// withPrincipalSlot returns ctx with room for the principal of its request,
+// so that middleware running before the request is authenticated, such as
+// the audit log, can read the principal once it is.
+func withPrincipalSlot(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(principalKey{}).(*Principal); ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, principalKey{}, new(Principal))
+}
+
+// authenticate returns the principal of r, as the configured Authenticator
+// establishes it. The admin API key adds ScopeAdmin to whoever presents
+// it, and names them "admin" if no one else. It is checked first, since an
+// Authenticator that doesn't know it, such as an APIKeyAuthenticator
+// without it, would reject it.
+func (s *Server) authenticate(r *http.Request) (Principal, error) {
+	admin := s.validAdminKey(r.Header.Get("X-API-Key"))
+
+	p, err := s.authenticator.Authenticate(r)
+	if err != nil && !admin {
+		return Anonymous, err
+	}
+
+	if admin {
+		if err != nil || p.IsAnonymous() {
+			return adminPrincipal, nil
+		}
+		if !p.Has(ScopeAdmin) {
+			p.Scopes = append(slices.Clip(p.Scopes), ScopeAdmin)
+		}
+	}
+
+	return p, nil
+}
+
+// authenticateRequests establishes the principal of every request, for the
+// middleware and handlers after it and for the audit log, and rejects
+// those with invalid credentials.
+func (s *Server) authenticateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticate(r)
+		if err != nil {
+			log.Printf("%s %s %s unauthenticated: %v\n", requestID(r.Context()), r.Method, r.URL.Path, err)
+			s.writeError(w, fmt.Errorf("%w: %v", ErrorUnauthenticated, err))
+			return
+		}
+
+		r = r.WithContext(withPrincipalSlot(r.Context()))
+		*r.Context().Value(principalKey{}).(*Principal) = p
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeRequests rejects the requests refused by the configured
+// Authorize hook.
+func (s *Server) authorizeRequests(next http.Handler) http.Handler {
+	if s.authorize == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.authorize(r); err != nil {
+			log.Printf("%s %s %s rejected: %v\n", requestID(r.Context()), r.Method, r.URL.Path, err)
+			s.writeError(w, fmt.Errorf("%w: %v", ErrorForbidden, err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
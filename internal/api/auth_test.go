@@ -0,0 +1,162 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeAuthenticator takes the X-User header to name the principal, and
+// rejects requests whose X-User is "mallory".
+type fakeAuthenticator struct{}
+
+func (fakeAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	switch user := r.Header.Get("X-User"); user {
+	case "":
+		return Anonymous, nil
+	case "mallory":
+		return Anonymous, errors.New("mallory is banned")
+	default:
+		return Principal{ID: user}, nil
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	keys := &APIKeyAuthenticator{Keys: map[string]Principal{
+		"ops-key":  {ID: "ops", Scopes: []string{ScopeAdmin}},
+		"user-key": {ID: "user"},
+	}}
+
+	tests := []struct {
+		name   string
+		auth   Authenticator
+		header http.Header
+		status int // Of GET /v1/export, an admin endpoint
+	}{
+		{"admin key without an authenticator", nil, http.Header{"X-Api-Key": {"sekret"}}, http.StatusOK},
+		{"admin key past an API key authenticator", keys, http.Header{"X-Api-Key": {"sekret"}}, http.StatusOK},
+		{"admin API key", keys, http.Header{"X-Api-Key": {"ops-key"}}, http.StatusOK},
+		{"API key without admin", keys, http.Header{"X-Api-Key": {"user-key"}}, http.StatusForbidden},
+		{"unknown API key", keys, http.Header{"X-Api-Key": {"guess"}}, http.StatusUnauthorized},
+		{"anonymous", keys, nil, http.StatusForbidden},
+		{"admin key past a custom authenticator", fakeAuthenticator{}, http.Header{"X-User": {"bob"}, "X-Api-Key": {"sekret"}}, http.StatusOK},
+		{"rejected by a custom authenticator", fakeAuthenticator{}, http.Header{"X-User": {"mallory"}}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h, closeLog := openRouter(t, t.TempDir(), Config{AdminKey: "sekret", Authenticator: tt.auth})
+			defer closeLog()
+
+			if w := serve(h, "GET", "/v1/export", "", tt.header); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthenticatePrincipal(t *testing.T) {
+	s := NewServer(nil, Config{AdminKey: "sekret", Authenticator: fakeAuthenticator{}})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "bob")
+	r.Header.Set("X-API-Key", "sekret")
+
+	p, err := s.authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != "bob" || !p.Has(ScopeAdmin) {
+		t.Errorf("principal %+v, want bob with the admin scope", p)
+	}
+}
+
+func TestMTLSAuthenticator(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := url.Parse("spiffe://example.org/ops")
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ops"},
+		URIs:         []*url.URL{id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, ca, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := x509.ParseCertificate(clientDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	chains, err := client.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &MTLSAuthenticator{Scopes: map[string][]string{id.String(): {ScopeAdmin}}}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}, VerifiedChains: chains}
+
+	p, err := a.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != id.String() || !p.Has(ScopeAdmin) {
+		t.Errorf("principal %+v, want %s with the admin scope", p, id)
+	}
+
+	// A certificate the server didn't verify names no one
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}
+	if _, err := a.Authenticate(r); err == nil {
+		t.Error("an unverified certificate was accepted")
+	}
+
+	r.TLS = nil
+	if p, err := a.Authenticate(r); err != nil || !p.IsAnonymous() {
+		t.Errorf("a request without a certificate is %+v, %v; want anonymous", p, err)
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// BatchesPath streams the summaries of bulk operations, as
+// store.WatchBatches gives them.
+const BatchesPath = "/v1/admin/batches"
+
+// batchesHandler streams, as JSON lines, the summaries of the bulk
+// operations changing keys in the bucket and with the prefix of the query,
+// such as a seed or a deletion by prefix, until the client goes away. Without
+// a bucket, every bucket is covered. A client that reads too slowly misses
+// summaries, counted in the missed field of the next one.
+func (s *Server) batchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stop := context.AfterFunc(s.streams, cancel)
+	defer stop()
+
+	q := r.URL.Query()
+	summaries, unsubscribe := s.store.WatchBatches(q.Get("bucket"), q.Get("prefix"))
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	for {
+		select {
+		case sum := <-summaries:
+			if err := enc.Encode(sum); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// requireAdmin rejects requests whose principal doesn't hold ScopeAdmin,
+// as those presenting the admin API key in the X-API-Key header do. Admin
+// endpoints are disabled entirely when no admin key is configured, unless
+// Config.Authenticator may grant the scope.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.keyOnlyAdmin && s.settings.Load().adminKey == "" {
+			s.writeError(w, ErrorAdminDisabled)
+			return
+		}
+
+		if !PrincipalFrom(r.Context()).Has(ScopeAdmin) {
+			s.writeError(w, ErrorForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validAdminKey reports whether key is the admin API key. No key is valid
+// while the admin endpoints are disabled.
+func (s *Server) validAdminKey(key string) bool {
+	adminKey := s.settings.Load().adminKey
+
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1
+}
+
+// RenameBucketPath renames the bucket in its path.
+const RenameBucketPath = "/v1/admin/buckets/{bucket}/rename"
+
+// requestBucket returns the validated bucket named in the request path, or
+// store.DefaultBucket for the unscoped "/v1/key/{key}" routes.
+func requestBucket(r *http.Request) (string, error) {
+	raw, ok := mux.Vars(r)["bucket"]
+	if !ok {
+		return store.DefaultBucket, nil
+	}
+
+	bucket, err := url.PathUnescape(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", store.ErrorInvalidBucket, err)
+	}
+
+	if err := store.ValidateBucket(bucket); err != nil {
+		return "", err
+	}
+
+	return bucket, nil
+}
+
+func (s *Server) listBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	buckets, err := s.store.Buckets()
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
+
+func (s *Server) dropBucketHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var seq uint64
+
+	n, err := s.store.DropBucket(store.WithSequence(r.Context(), &seq), bucket)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Bucket  string `json:"bucket"`
+		Deleted int    `json:"deleted"`
+	}{bucket, n})
+
+	log.Printf("DROP bucket=%s keys=%d\n", bucket, n)
+}
+
+// renameBucketHandler expects a POST request for RenameBucketPath with a
+// body like {"name": "new", "merge": false}, and renames the bucket in the
+// path to name, as store.RenameBucket does. Without merge, a bucket that
+// already has keys can't be renamed to. It responds with the number of keys
+// moved.
+func (s *Server) renameBucketHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var req struct {
+		Name  string `json:"name"`
+		Merge bool   `json:"merge"`
+	}
+
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var seq uint64
+
+	n, err := s.store.RenameBucket(store.WithSequence(r.Context(), &seq), bucket, req.Name, req.Merge)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Bucket string `json:"bucket"`
+		Name   string `json:"name"`
+		Merge  bool   `json:"merge"`
+		Moved  int    `json:"moved"`
+	}{bucket, req.Name, req.Merge, n})
+
+	log.Printf("RENAME bucket=%s name=%s merge=%t keys=%d\n", bucket, req.Name, req.Merge, n)
+}
+
+// deleteKeysHandler deletes the keys starting with the prefix query
+// parameter, in the default bucket or the one in the bucket parameter. The
+// prefix must not be empty, and confirm=true must be given, so that a
+// mistyped request can't empty a bucket; dry_run=true instead reports how
+// many keys would be deleted. With urgent=true the deletes are durable once
+// the request returns.
+func (s *Server) deleteKeysHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	bucket := store.DefaultBucket
+	if b := query.Get("bucket"); b != "" {
+		if err := store.ValidateBucket(b); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		bucket = b
+	}
+
+	prefix := query.Get("prefix")
+	if prefix == "" {
+		s.writeError(w, fmt.Errorf("%w: a non-empty prefix is required; use DELETE /v1/buckets/{bucket} to delete a whole bucket", ErrorInvalidRequest))
+		return
+	}
+
+	if query.Get("dry_run") == "true" {
+		keys, err := s.store.BucketKeys(r.Context(), bucket, prefix)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Bucket  string `json:"bucket"`
+			Prefix  string `json:"prefix"`
+			DryRun  bool   `json:"dry_run"`
+			Matched int    `json:"matched"`
+		}{bucket, prefix, true, len(keys)})
+
+		return
+	}
+
+	if query.Get("confirm") != "true" {
+		s.writeError(w, fmt.Errorf("%w: deleting by prefix requires confirm=true, or dry_run=true to count the keys first", ErrorInvalidRequest))
+		return
+	}
+
+	var seq uint64
+
+	n, err := s.store.BucketDeleteByPrefix(store.WithSequence(urgentContext(r), &seq), bucket, prefix)
+	writeSequence(w, seq) // Batches already deleted stay deleted on failure
+	if err != nil {
+		log.Printf("DELETE-PREFIX bucket=%s prefix=%s failed after %d keys: %v\n", bucket, prefix, n, err)
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Bucket  string `json:"bucket"`
+		Prefix  string `json:"prefix"`
+		Deleted int    `json:"deleted"`
+	}{bucket, prefix, n})
+
+	log.Printf("DELETE-PREFIX bucket=%s prefix=%s keys=%d\n", bucket, prefix, n)
+}
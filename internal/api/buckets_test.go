@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBucketsAreIsolated(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{AdminKey: "secret"}
+
+	_, h, closeLog := openRouter(t, dir, cfg)
+
+	writes := map[string]string{
+		"/v1/key/k":               "default",
+		"/v1/buckets/a/key/k":     "a",
+		"/v1/buckets/b/key/k":     "b",
+		"/v1/buckets/b/key/other": "b only",
+	}
+	for path, value := range writes {
+		if w := serve(h, "PUT", path, value, nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	if w := serve(h, "DELETE", "/v1/buckets/a/key/k", "", nil); w.Code >= 300 {
+		t.Fatalf("DELETE a/k: %d %s", w.Code, w.Body)
+	}
+	delete(writes, "/v1/buckets/a/key/k")
+
+	check := func(when string) {
+		t.Helper()
+
+		for path, value := range writes {
+			if w := serve(h, "GET", path, "", nil); w.Code != http.StatusOK || w.Body.String() != value {
+				t.Errorf("GET %s %s: %d %q, want %q", path, when, w.Code, w.Body, value)
+			}
+		}
+		for _, path := range []string{"/v1/buckets/a/key/k", "/v1/buckets/a/key/other", "/v1/key/other"} {
+			if w := serve(h, "GET", path, "", nil); w.Code != http.StatusNotFound {
+				t.Errorf("GET %s %s: %d, want 404", path, when, w.Code)
+			}
+		}
+
+		w := serve(h, "GET", "/v1/buckets", "", nil)
+
+		var buckets []string
+		if err := json.Unmarshal(w.Body.Bytes(), &buckets); err != nil {
+			t.Fatalf("GET /v1/buckets %s: %v in %s", when, err, w.Body)
+		}
+		if !slices.Contains(buckets, "b") {
+			t.Errorf("GET /v1/buckets %s = %q, want b among them", when, buckets)
+		}
+	}
+
+	check("before replay")
+	closeLog()
+
+	_, h, closeLog = openRouter(t, dir, cfg)
+	defer closeLog()
+
+	check("after replay")
+
+	// Dropping a bucket takes the admin key, and leaves the others be
+	if w := serve(h, "DELETE", "/v1/buckets/b", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE /v1/buckets/b without the admin key: %d, want 403", w.Code)
+	}
+	if w := serve(h, "DELETE", "/v1/buckets/b", "", http.Header{"X-Api-Key": {"secret"}}); w.Code != http.StatusOK {
+		t.Fatalf("DELETE /v1/buckets/b: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "GET", "/v1/buckets/b/key/k", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET b/k after the drop: %d, want 404", w.Code)
+	}
+	if w := serve(h, "GET", "/v1/key/k", "", nil); w.Code != http.StatusOK || w.Body.String() != "default" {
+		t.Errorf("GET /v1/key/k after the drop: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestInvalidBucketNames(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	for _, bucket := range []string{"a/b", "a%2Fb", strings.Repeat("x", 300), "sp ace"} {
+		path := "/v1/buckets/" + url.PathEscape(bucket) + "/key/k"
+
+		if w := serve(h, "PUT", path, "v", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: %d, want 400", path, w.Code)
+		}
+	}
+}
+
+func TestDeleteKeysByPrefix(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{AdminKey: "secret"}
+	admin := http.Header{"X-Api-Key": {"secret"}}
+
+	_, h, closeLog := openRouter(t, dir, cfg)
+
+	for _, path := range []string{"/v1/key/tenant.a", "/v1/key/tenant.b", "/v1/key/other", "/v1/buckets/b/key/tenant.a"} {
+		if w := serve(h, "PUT", path, "v", nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	// Without the admin key, a prefix and a confirmation, nothing goes
+	refused := map[string]int{
+		"/v1/keys?prefix=tenant.&confirm=true&bucket=a%2Fb": http.StatusBadRequest,
+		"/v1/keys?prefix=&confirm=true":                     http.StatusBadRequest,
+		"/v1/keys?confirm=true":                             http.StatusBadRequest,
+		"/v1/keys?prefix=tenant.":                           http.StatusBadRequest,
+		"/v1/keys?prefix=tenant.&confirm=yes":               http.StatusBadRequest,
+	}
+	for path, want := range refused {
+		if w := serve(h, "DELETE", path, "", admin); w.Code != want {
+			t.Errorf("DELETE %s: %d, want %d", path, w.Code, want)
+		}
+	}
+	if w := serve(h, "DELETE", "/v1/keys?prefix=tenant.&confirm=true", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE by prefix without the admin key: %d, want 403", w.Code)
+	}
+
+	// A dry run counts the keys and deletes none
+	var result struct {
+		DryRun  bool `json:"dry_run"`
+		Matched int  `json:"matched"`
+		Deleted int  `json:"deleted"`
+	}
+
+	w := serve(h, "DELETE", "/v1/keys?prefix=tenant.&dry_run=true", "", admin)
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || !result.DryRun || result.Matched != 2 {
+		t.Errorf("a dry run: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "GET", "/v1/key/tenant.a", "", nil); w.Code != http.StatusOK {
+		t.Errorf("GET tenant.a after a dry run: %d", w.Code)
+	}
+
+	// Confirmed, the keys of the one bucket go
+	w = serve(h, "DELETE", "/v1/keys?prefix=tenant.&confirm=true", "", admin)
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Deleted != 2 {
+		t.Fatalf("DELETE by prefix: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "DELETE", "/v1/keys?prefix=nothing.&confirm=true", "", admin); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"deleted":0`) {
+		t.Errorf("DELETE by a prefix matching nothing: %d %s", w.Code, w.Body)
+	}
+
+	check := func(when string) {
+		t.Helper()
+
+		for path, want := range map[string]int{
+			"/v1/key/tenant.a":           http.StatusNotFound,
+			"/v1/key/tenant.b":           http.StatusNotFound,
+			"/v1/key/other":              http.StatusOK,
+			"/v1/buckets/b/key/tenant.a": http.StatusOK,
+		} {
+			if w := serve(h, "GET", path, "", nil); w.Code != want {
+				t.Errorf("GET %s %s: %d, want %d", path, when, w.Code, want)
+			}
+		}
+	}
+
+	check("after the delete")
+	closeLog()
+
+	_, h, closeLog = openRouter(t, dir, cfg)
+	defer closeLog()
+
+	check("after replay")
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// MaxBulkOps is the most keys a bulk request to "/v1/keys" may get, put and
+// delete, all together.
+const MaxBulkOps = 1000
+
+// maxBulkBody bounds the size of the body of a bulk request, which holds
+// the values of up to MaxBulkOps puts.
+const maxBulkBody = 16 << 20
+
+// bulkHandler expects a POST request for the "v1/keys" resource with a body
+// like
+//
+//	{"bucket": "b",
+//	 "get": ["a"],
+//	 "put": {"c": "v1", "d": "v2"},
+//	 "delete": ["e"]}
+//
+// and runs it as one transaction without conditions, as store.Txn does:
+// the keys are got, put and deleted under one hold of the write lock, the
+// writes logged together, and all or none of them applied. Gets read the
+// keys as they were before the writes. Puts are made in the order of their
+// keys, and a key may be written only once. The bucket is optional. It
+// responds with the sequence of the last write and the result of each
+// operation, gets first, then puts and deletes, as a transaction's. At
+// most MaxBulkOps keys may be given, in a body of up to 16 MiB. The
+// values put may be base64-encoded, with "encoding": "base64" in the body,
+// as valueEncodingBase64 describes, and the values got that aren't text are
+// returned so.
+func (s *Server) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Bucket   string            `json:"bucket"`
+		Get      []string          `json:"get"`
+		Put      map[string]string `json:"put"`
+		Encoding string            `json:"encoding"` // Of the values of Put
+		Delete   []string          `json:"delete"`
+	}
+
+	if err := decodeJSONBodyUpTo(w, r, &req, maxBulkBody); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n := len(req.Get) + len(req.Put) + len(req.Delete); n > MaxBulkOps {
+		s.writeError(w, fmt.Errorf("%w: %d keys given, at most %d may be", store.ErrorTooManyKeys, n, MaxBulkOps))
+		return
+	}
+
+	bucket := store.DefaultBucket
+	if req.Bucket != "" {
+		if err := store.ValidateBucket(req.Bucket); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		bucket = req.Bucket
+	}
+
+	var ops []store.TxnOp
+
+	for _, key := range req.Get {
+		ops = append(ops, store.TxnOp{Type: store.TxnGet, Bucket: bucket, Key: key})
+	}
+	for _, key := range slices.Sorted(maps.Keys(req.Put)) {
+		value := req.Put[key]
+		if err := decodeJSONValue(&value, req.Encoding); err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		ops = append(ops, store.TxnOp{Type: store.TxnPut, Bucket: bucket, Key: key, Value: value})
+	}
+	for _, key := range slices.Compact(slices.Sorted(slices.Values(req.Delete))) {
+		ops = append(ops, store.TxnOp{Type: store.TxnDelete, Bucket: bucket, Key: key})
+	}
+
+	for _, op := range ops {
+		if err := store.ValidateKey(op.Key); err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+
+	durability, err := s.requestDurability(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var seq uint64
+	var usage store.QuotaUsage
+
+	ctx := store.WithQuotaWarning(store.WithSequence(r.Context(), &seq), &usage)
+	ctx = store.WithDurability(ctx, durability)
+
+	outcome, err := s.store.Txn(ctx, store.Txn{Then: ops})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+	writeQuotaWarning(w, usage)
+
+	if err := s.awaitDurability(r.Context(), durability); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sequence uint64      `json:"sequence"`
+		Results  []txnResult `json:"results"`
+	}{seq, txnResults(ops, outcome.Results)})
+
+	log.Printf("BULK bucket=%s gets=%d puts=%d deletes=%d\n", bucket, len(req.Get), len(req.Put), len(ops)-len(req.Get)-len(req.Put))
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBulk(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	// bulk sends body, checking it's answered with want, and returns the
+	// results, or the error code
+	bulk := func(t *testing.T, body string, want int) ([]txnResult, string) {
+		t.Helper()
+
+		w := serve(h, "POST", "/v2/keys", body, nil)
+		if w.Code != want {
+			t.Fatalf("%.80s: %d %s, want %d", body, w.Code, w.Body, want)
+		}
+
+		var resp struct {
+			Results []txnResult `json:"results"`
+			Code    string      `json:"code"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Results, resp.Code
+	}
+
+	// keys checks that the default bucket holds want
+	keys := func(t *testing.T, want string) {
+		t.Helper()
+
+		w := serve(h, "GET", "/v2/keys", "", nil)
+		if got := strings.TrimSpace(w.Body.String()); got != want {
+			t.Errorf("keys %s, want %s", got, want)
+		}
+	}
+
+	results, _ := bulk(t, `{"put": {"b": "2", "a": "1", "c": "3"}}`, http.StatusOK)
+	if len(results) != 3 || results[0].Key != "a" || results[2].Key != "c" {
+		t.Errorf("results of three puts %+v, want them in the order of their keys", results)
+	}
+
+	// Gets read the keys as they were before the writes
+	results, _ = bulk(t, `{"get": ["a", "d"], "put": {"a": "changed", "d": "new"}, "delete": ["c"]}`, http.StatusOK)
+	if len(results) != 5 || !results[0].Found || *results[0].Value != "1" || results[1].Found {
+		t.Errorf("results %+v, want a read as 1 and d not found", results)
+	}
+	keys(t, `["a","b","d"]`)
+
+	// A key written twice is refused, as is a whole bulk one of whose
+	// writes is
+	for _, body := range []string{
+		`{"put": {"a": "x"}, "delete": ["a"]}`,
+		`{"put": {"e": "x", "a": "x"}, "delete": ["a", "b"]}`,
+	} {
+		if _, code := bulk(t, body, http.StatusBadRequest); code != "invalid_txn" {
+			t.Errorf("%s: code %q, want invalid_txn", body, code)
+		}
+	}
+
+	immutable := make(http.Header)
+	immutable.Set(ImmutableHeader, "true")
+	if w := serve(h, "PUT", "/v2/key/once", "v", immutable); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if _, code := bulk(t, `{"put": {"e": "new", "once": "changed"}, "delete": ["b"]}`, http.StatusConflict); code != "immutable" {
+		t.Errorf("a bulk write of a write-once key: code %q, want immutable", code)
+	}
+	keys(t, `["a","b","d","once"]`)
+
+	// A key deleted twice is deleted once
+	results, _ = bulk(t, `{"delete": ["b", "d", "b", "missing"]}`, http.StatusOK)
+	if len(results) != 3 {
+		t.Errorf("results of deleting b twice, d and a missing key: %+v, want three", results)
+	}
+	keys(t, `["a","once"]`)
+
+	// At most MaxBulkOps keys may be given
+	body := func(n int) string {
+		gets := make([]string, n-1)
+		for i := range gets {
+			gets[i] = fmt.Sprintf("%q", fmt.Sprint("k", i))
+		}
+		return fmt.Sprintf(`{"get": [%s], "put": {"last": "v"}}`, strings.Join(gets, ","))
+	}
+
+	if results, _ := bulk(t, body(MaxBulkOps), http.StatusOK); len(results) != MaxBulkOps {
+		t.Errorf("%d results of %d keys", len(results), MaxBulkOps)
+	}
+	if _, code := bulk(t, body(MaxBulkOps+1), http.StatusBadRequest); code != "too_many_keys" {
+		t.Errorf("%d keys: code %q, want too_many_keys", MaxBulkOps+1, code)
+	}
+	keys(t, `["a","last","once"]`)
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ChangesPath serves the events logged after a sequence, a page at a time,
+// for clients that catch up now and then rather than follow the log.
+const ChangesPath = "/v1/changes"
+
+// DefaultChangesInlineMax is the largest value a page of ChangesPath holds
+// when Config.ChangesInlineMax is zero.
+const DefaultChangesInlineMax = 64 << 10
+
+// ErrorNoSuchEvent is reported for a sequence the transaction log holds no
+// event of.
+var ErrorNoSuchEvent = errors.New("no such event in the transaction log")
+
+// Defaults and limits of the limit parameter of ChangesPath.
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// change is an event as ChangesPath reports it.
+type change struct {
+	Sequence  uint64    `json:"sequence"`
+	Type      string    `json:"type"` // As in diagnostics bundles
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key,omitempty"`
+	Value     *string   `json:"value,omitempty"`        // Of the event, unless it's larger than the inline maximum
+	Encoding  string    `json:"encoding,omitempty"`     // Of Value, as valueEncodingBase64 describes
+	ValueSize int       `json:"value_size,omitempty"`   // In bytes, of the values of puts
+	ValueRef  string    `json:"value_ref,omitempty"`    // Path to read a value too large to inline from
+	MediaType string    `json:"content_type,omitempty"` // Of the value of a put, if it was put with one
+	Time      time.Time `json:"time,omitzero"`
+}
+
+// changesPage is the body of ChangesPath.
+type changesPage struct {
+	Changes []change `json:"changes"`
+	Next    uint64   `json:"next"` // Sequence to ask for the changes since next
+	More    bool     `json:"more"` // Whether the log holds more changes already
+}
+
+// changesHandler reports the events logged after the sequence of the since
+// query parameter, 0 by default, up to limit of them, 100 by default.
+// Values are decoded as a GET would return them, those that aren't text
+// base64-encoded, as valueEncodingBase64 describes, and those larger than
+// the inline maximum left out, with the path to read them from instead.
+// The next page starts after next, and more says whether it is already
+// there. If the events asked for were compacted away, it answers 410 with
+// the code compacted and the earliest sequence the log holds: the client
+// must resync with an export, then ask for the changes since a sequence
+// seen before the export started; changes it replays again carry whole
+// values, so they do no harm.
+func (s *Server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		s.writeError(w, fmt.Errorf("%w: this instance's transaction log can't be read by sequence", ErrorNotSupported))
+		return
+	}
+
+	q := r.URL.Query()
+
+	var since uint64
+	if v := q.Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			s.writeError(w, fmt.Errorf("%w: since must be a sequence: %q", ErrorInvalidRequest, v))
+			return
+		}
+		since = n
+	}
+
+	limit := defaultChangesLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxChangesLimit {
+			s.writeError(w, fmt.Errorf("%w: limit must be an integer from 1 to %d: %q", ErrorInvalidRequest, maxChangesLimit, v))
+			return
+		}
+		limit = n
+	}
+
+	// One more than asked tells whether there are more
+	events, err := s.changes.ReadChanges(r.Context(), since, limit+1)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	page := changesPage{Changes: make([]change, 0, min(len(events), limit)), Next: since}
+	if len(events) > limit {
+		events, page.More = events[:limit], true
+	}
+
+	for _, e := range events {
+		c, err := s.change(e)
+		if err != nil {
+			s.writeError(w, fmt.Errorf("event %d: %w", e.Sequence, err))
+			return
+		}
+
+		page.Changes = append(page.Changes, c)
+		page.Next = e.Sequence
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// change converts e for ChangesPath, leaving out its value if it's larger
+// than the inline maximum.
+func (s *Server) change(e translog.Event) (change, error) {
+	c := change{Sequence: e.Sequence, Type: eventTypeName(e.EventType), Bucket: e.Bucket, Key: e.Key, Time: e.Time, MediaType: e.ContentType}
+
+	value, err := s.eventValue(e)
+	if err != nil {
+		return c, err
+	}
+	if e.EventType == translog.EventPut {
+		c.ValueSize = len(value)
+	}
+
+	switch {
+	case len(value) > s.changesInlineMax:
+		c.ValueRef = fmt.Sprintf("%s/%d/value", ChangesPath, e.Sequence)
+	case value != "" || e.EventType == translog.EventPut:
+		value, encoding := jsonValue(value)
+		c.Value, c.Encoding = &value, encoding
+	}
+
+	return c, nil
+}
+
+// changeValueHandler writes the value of the event of the sequence in the
+// path, as the value_ref of a change refers to it.
+func (s *Server) changeValueHandler(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		s.writeError(w, fmt.Errorf("%w: this instance's transaction log can't be read by sequence", ErrorNotSupported))
+		return
+	}
+
+	seq, err := strconv.ParseUint(mux.Vars(r)["sequence"], 10, 64)
+	if err != nil || seq == 0 {
+		s.writeError(w, fmt.Errorf("%w: invalid sequence %q", ErrorInvalidRequest, mux.Vars(r)["sequence"]))
+		return
+	}
+
+	events, err := s.changes.ReadChanges(r.Context(), seq-1, 1)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if len(events) == 0 || events[0].Sequence != seq {
+		s.writeError(w, fmt.Errorf("%w: %d", ErrorNoSuchEvent, seq))
+		return
+	}
+
+	value, err := s.eventValue(events[0])
+	if err != nil {
+		s.writeError(w, fmt.Errorf("event %d: %w", seq, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write([]byte(value))
+}
+
+// eventValue returns the value of e: that of a put decoded as a GET returns
+// it, and that of any other event as it is logged.
+func (s *Server) eventValue(e translog.Event) (string, error) {
+	if e.EventType != translog.EventPut {
+		return e.Value, nil
+	}
+
+	return s.store.EventValue(e)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChangesPages(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	admin := http.Header{"X-Api-Key": {"secret"}}
+	large := strings.Repeat("L", 100)
+
+	_, l, h, closeLog := openLogRouter(t, dir, Config{AdminKey: "secret", ChangesInlineMax: 64})
+	defer closeLog()
+
+	// Seven events over two rotated segments and the log
+	writes := []struct{ method, key, value string }{
+		{"PUT", "a", "1"},
+		{"PUT", "b", large},
+		{"PUT", "c", ""},
+		{"DELETE", "a", ""},
+		{"PUT", "d", strings.Repeat("i", 64)},
+		{"PUT", "b", "2"},
+		{"DELETE", "c", ""},
+	}
+	for i, wr := range writes {
+		if w := serve(h, wr.method, "/v1/key/"+wr.key, wr.value, nil); w.Code >= 300 {
+			t.Fatalf("%s %s: %d %s", wr.method, wr.key, w.Code, w.Body)
+		}
+		if i == 2 || i == 4 {
+			if err := l.Rotate(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := l.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading two at a time follows next until there are no more
+	var changes []change
+	var since uint64
+	for page := 0; ; page++ {
+		w := serve(h, "GET", fmt.Sprintf("%s?since=%d&limit=2", ChangesPath, since), "", admin)
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d: %d %s", page, w.Code, w.Body)
+		}
+
+		var p changesPage
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, p.Changes...)
+
+		if want := page < 3; p.More != want || len(p.Changes) != 2 && want {
+			t.Fatalf("page %d: %d changes with more %t", page, len(p.Changes), p.More)
+		}
+		if !p.More {
+			break
+		}
+		since = p.Next
+	}
+
+	if len(changes) != len(writes) {
+		t.Fatalf("%d changes, want %d: %+v", len(changes), len(writes), changes)
+	}
+	for i, c := range changes {
+		wr := writes[i]
+		if c.Sequence != uint64(i+1) || c.Key != wr.key || c.Type != map[string]string{"PUT": "put", "DELETE": "delete"}[wr.method] {
+			t.Errorf("change %d is %+v, want %s %s", i, c, wr.method, wr.key)
+		}
+	}
+
+	// A value larger than the inline maximum is referred to, not given
+	b := changes[1]
+	if b.Value != nil || b.ValueSize != len(large) || b.ValueRef != ChangesPath+"/2/value" {
+		t.Errorf("the large value is given as %+v, want a reference to it", b)
+	}
+	if w := serve(h, "GET", b.ValueRef, "", admin); w.Code != http.StatusOK || w.Body.String() != large {
+		t.Errorf("GET %s: %d %q", b.ValueRef, w.Code, w.Body)
+	}
+
+	// One the size of the maximum is inline, and so is an empty one
+	if d := changes[4]; d.Value == nil || len(*d.Value) != 64 || d.ValueRef != "" {
+		t.Errorf("a value of the inline maximum is given as %+v, want it inline", d)
+	}
+	if c := changes[2]; c.Value == nil || *c.Value != "" || c.ValueRef != "" {
+		t.Errorf("an empty value is given as %+v, want it inline", c)
+	}
+
+	if w := serve(h, "GET", ChangesPath+"/99/value", "", admin); w.Code != http.StatusNotFound {
+		t.Errorf("the value of an event not logged yet: %d %s, want 404", w.Code, w.Body)
+	}
+}
+
+func TestChangesCompacted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, translog.LogFileName)
+	admin := http.Header{"X-Api-Key": {"secret"}}
+
+	_, l, h, closeLog := openLogRouter(t, dir, Config{AdminKey: "secret"})
+	defer closeLog()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if w := serve(h, "PUT", "/v1/key/"+key, "v", nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d %s", key, w.Code, w.Body)
+		}
+	}
+	if err := l.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A compaction into a snapshot of sequence 2 leaves the log starting
+	// after it
+	meta, err := translog.ReadLogMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.After = 2
+	if err := translog.WriteLogMeta(path, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, since := range []uint64{0, 1} {
+		w := serve(h, "GET", fmt.Sprintf("%s?since=%d", ChangesPath, since), "", admin)
+
+		var body errorBody
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusGone || body.Code != "compacted" || body.EarliestSequence != 3 {
+			t.Errorf("since %d: %d %s, want 410 compacted from 3", since, w.Code, w.Body)
+		}
+	}
+
+	w := serve(h, "GET", ChangesPath+"?since=2", "", admin)
+
+	var p changesPage
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if w.Code != http.StatusOK || len(p.Changes) != 1 || p.Changes[0].Key != "c" || p.Next != 3 || p.More {
+		t.Errorf("since the snapshot: %d %s, want the put of c", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChaosPath is the admin endpoint reporting and replacing the fault
+// injection rules. It is exempt from the rules, so they can always be
+// turned off.
+const ChaosPath = "/v1/admin/chaos"
+
+// chaosTagHeader carries the tag of the requests a tagged FaultRule
+// applies to.
+const chaosTagHeader = "X-Chaos"
+
+// Kinds of fault a FaultRule injects.
+const (
+	FaultLatency = "latency" // Delay the request by DelayMS
+	FaultError   = "error"   // Respond with Status instead of serving the request
+	FaultDrop    = "drop"    // Close the connection without responding
+	FaultTrickle = "trickle" // Serve the request, but send the response ChunkBytes at a time every DelayMS
+)
+
+// FaultRule injects a fault into a share of the requests it matches.
+type FaultRule struct {
+	Fault       string   `json:"fault"`
+	Probability float64  `json:"probability"`           // Share of the matching requests affected, from 0 to 1
+	Methods     []string `json:"methods,omitempty"`     // Methods matched; empty matches all
+	PathPrefix  string   `json:"path_prefix,omitempty"` // Prefix of the paths matched
+	Tag         string   `json:"tag,omitempty"`         // If set, only requests with this X-Chaos header match
+
+	Status     int `json:"status,omitempty"`      // Status of an error fault, 500 or 503; 500 if 0
+	DelayMS    int `json:"delay_ms,omitempty"`    // Delay of a latency fault, or between the chunks of a trickle fault
+	ChunkBytes int `json:"chunk_bytes,omitempty"` // Chunk size of a trickle fault; 16 if 0
+}
+
+// validate checks that r describes a fault that can be injected.
+func (r FaultRule) validate() error {
+	switch r.Fault {
+	case FaultLatency, FaultDrop, FaultTrickle:
+	case FaultError:
+		if r.Status != 0 && r.Status != http.StatusInternalServerError && r.Status != http.StatusServiceUnavailable {
+			return fmt.Errorf("error fault status must be 500 or 503, not %d", r.Status)
+		}
+	default:
+		return fmt.Errorf("unknown fault %q", r.Fault)
+	}
+
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("probability %v is not between 0 and 1", r.Probability)
+	}
+
+	if r.DelayMS < 0 || r.ChunkBytes < 0 {
+		return fmt.Errorf("delay_ms and chunk_bytes can't be negative")
+	}
+
+	return nil
+}
+
+// matches reports whether r applies to req.
+func (r FaultRule) matches(req *http.Request) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method) {
+		return false
+	}
+
+	if r.Tag != "" && req.Header.Get(chaosTagHeader) != r.Tag {
+		return false
+	}
+
+	return strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// FaultInjector misbehaves on purpose, to test how clients cope. A Server
+// only injects faults if it's configured with one, and an injector without
+// rules changes nothing. It is safe for concurrent use.
+type FaultInjector struct {
+	mu    sync.RWMutex
+	rules []FaultRule
+}
+
+// NewFaultInjector returns an injector applying rules.
+func NewFaultInjector(rules []FaultRule) (*FaultInjector, error) {
+	f := &FaultInjector{}
+
+	if err := f.SetRules(rules); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// LoadFaultRules reads a JSON array of FaultRule from the file at path.
+func LoadFaultRules(path string) ([]FaultRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []FaultRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+// SetRules replaces the rules, which are tried in order. The first matching
+// rule whose probability comes up is the one applied.
+func (f *FaultInjector) SetRules(rules []FaultRule) error {
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("fault rule %d: %w", i, err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = slices.Clone(rules)
+
+	return nil
+}
+
+// Rules returns the rules in effect.
+func (f *FaultInjector) Rules() []FaultRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return slices.Clone(f.rules)
+}
+
+// pick returns the rule to apply to r, if any.
+func (f *FaultInjector) pick(r *http.Request) (FaultRule, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, rule := range f.rules {
+		if rule.matches(r) && rand.Float64() < rule.Probability {
+			return rule, true
+		}
+	}
+
+	return FaultRule{}, false
+}
+
+// injectFaults applies the fault injector's rules to every request but those
+// to ChaosPath.
+func (s *Server) injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == ChaosPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule, ok := s.faults.pick(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		faultsInjectedTotal.WithLabelValues(rule.Fault).Inc()
+
+		delay := time.Duration(rule.DelayMS) * time.Millisecond
+
+		switch rule.Fault {
+		case FaultLatency:
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		case FaultError:
+			status := rule.Status
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+
+			http.Error(w, "injected fault", status)
+		case FaultDrop:
+			// The server closes the connection without writing a response
+			panic(http.ErrAbortHandler)
+		case FaultTrickle:
+			chunk := rule.ChunkBytes
+			if chunk == 0 {
+				chunk = 16
+			}
+
+			next.ServeHTTP(&trickleWriter{ResponseWriter: w, chunk: chunk, delay: delay, ctx: r.Context()}, r)
+		}
+	})
+}
+
+// trickleWriter sends a response a chunk at a time, flushing each one and
+// pausing in between.
+type trickleWriter struct {
+	http.ResponseWriter
+	chunk int
+	delay time.Duration
+	ctx   context.Context // Done when the client goes away
+}
+
+func (t *trickleWriter) Write(b []byte) (int, error) {
+	n := 0
+
+	for len(b) > 0 {
+		size := min(t.chunk, len(b))
+
+		written, err := t.ResponseWriter.Write(b[:size])
+		n += written
+		if err != nil {
+			return n, err
+		}
+
+		http.NewResponseController(t.ResponseWriter).Flush()
+		b = b[size:]
+
+		if len(b) > 0 {
+			select {
+			case <-time.After(t.delay):
+			case <-t.ctx.Done():
+				return n, t.ctx.Err()
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (t *trickleWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// chaosHandler reports the fault injection rules on GET and replaces them
+// with the JSON array of FaultRule in the body of a PUT. An empty array
+// turns fault injection off.
+func (s *Server) chaosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var rules []FaultRule
+
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			s.writeError(w, fmt.Errorf("%w: invalid fault rules: %v", ErrorInvalidRequest, err))
+			return
+		}
+
+		if err := s.faults.SetRules(rules); err != nil {
+			s.writeError(w, fmt.Errorf("%w: %v", ErrorInvalidRequest, err))
+			return
+		}
+
+		log.Printf("CHAOS rules=%d\n", len(rules))
+	}
+
+	rules := s.faults.Rules()
+	if rules == nil {
+		rules = []FaultRule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chaosRequest sends a request to srv, tagged for fault rules if tag isn't
+// empty, and returns its status and body, or the error of a request that
+// got no response.
+func chaosRequest(srv *httptest.Server, method, path, body, tag string) (int, string, error) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("X-API-Key", "secret")
+	if tag != "" {
+		req.Header.Set(chaosTagHeader, tag)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(b), err
+}
+
+func TestChaosIsInertWithoutAnInjector(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{AdminKey: "secret"})
+	defer closeLog()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	before := testutil.ToFloat64(faultsInjectedTotal.WithLabelValues(FaultError))
+
+	// Without -chaos there's no endpoint to add rules, and tagged requests
+	// are served as any other
+	code, _, err := chaosRequest(srv, "PUT", ChaosPath, `[{"fault": "error", "probability": 1}]`, "")
+	if err != nil || code != http.StatusNotFound && code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT %s without an injector: %d, %v", ChaosPath, code, err)
+	}
+
+	for _, tag := range []string{"", "fail"} {
+		if code, _, err := chaosRequest(srv, "PUT", "/v1/key/k", "v", tag); err != nil || code != http.StatusCreated {
+			t.Errorf("PUT tagged %q: %d, %v", tag, code, err)
+		}
+		if code, body, err := chaosRequest(srv, "GET", "/v1/key/k", "", tag); err != nil || code != http.StatusOK || body != "v" {
+			t.Errorf("GET tagged %q: %d %q, %v", tag, code, body, err)
+		}
+	}
+
+	if got := testutil.ToFloat64(faultsInjectedTotal.WithLabelValues(FaultError)); got != before {
+		t.Errorf("%v faults injected without an injector", got-before)
+	}
+}
+
+func TestChaosFaults(t *testing.T) {
+	faults, err := NewFaultInjector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{AdminKey: "secret", Faults: faults})
+	defer closeLog()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	if code, _, err := chaosRequest(srv, "PUT", "/v1/key/k", "0123456789", ""); err != nil || code != http.StatusCreated {
+		t.Fatalf("PUT without rules: %d, %v", code, err)
+	}
+
+	setRules := func(rules string) {
+		t.Helper()
+		if code, body, err := chaosRequest(srv, "PUT", ChaosPath, rules, ""); err != nil || code != http.StatusOK {
+			t.Fatalf("setting rules %s: %d %s, %v", rules, code, body, err)
+		}
+	}
+
+	t.Run("error", func(t *testing.T) {
+		setRules(`[{"fault": "error", "probability": 1, "status": 503, "tag": "fail"}]`)
+
+		// Only the requests opted in are affected
+		if code, body, err := chaosRequest(srv, "GET", "/v1/key/k", "", "fail"); err != nil || code != http.StatusServiceUnavailable || strings.Contains(body, "0123456789") {
+			t.Errorf("tagged GET: %d %q, %v; want an injected 503", code, body, err)
+		}
+		for _, tag := range []string{"", "other"} {
+			if code, body, err := chaosRequest(srv, "GET", "/v1/key/k", "", tag); err != nil || code != http.StatusOK || body != "0123456789" {
+				t.Errorf("GET tagged %q: %d %q, %v; want it served", tag, code, body, err)
+			}
+		}
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		setRules(`[{"fault": "latency", "probability": 1, "delay_ms": 100, "methods": ["GET"], "path_prefix": "/v1/key/"}]`)
+
+		start := time.Now()
+		code, body, err := chaosRequest(srv, "GET", "/v1/key/k", "", "")
+		if err != nil || code != http.StatusOK || body != "0123456789" {
+			t.Errorf("delayed GET: %d %q, %v; want it served", code, body, err)
+		}
+		if took := time.Since(start); took < 100*time.Millisecond {
+			t.Errorf("delayed GET took %v, want at least 100ms", took)
+		}
+
+		// Other methods aren't delayed
+		start = time.Now()
+		if code, _, err := chaosRequest(srv, "HEAD", "/v1/key/k", "", ""); err != nil || code != http.StatusOK {
+			t.Errorf("HEAD: %d, %v", code, err)
+		}
+		if took := time.Since(start); took >= 100*time.Millisecond {
+			t.Errorf("HEAD took %v, though only GETs are delayed", took)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		setRules(`[{"fault": "drop", "probability": 1, "path_prefix": "/v1/key/"}]`)
+
+		if code, _, err := chaosRequest(srv, "GET", "/v1/key/k", "", ""); err == nil {
+			t.Errorf("dropped GET answered %d", code)
+		}
+	})
+
+	t.Run("trickle", func(t *testing.T) {
+		setRules(`[{"fault": "trickle", "probability": 1, "chunk_bytes": 2, "delay_ms": 20}]`)
+
+		// The whole response arrives, a chunk at a time
+		start := time.Now()
+		code, body, err := chaosRequest(srv, "GET", "/v1/key/k", "", "")
+		if err != nil || code != http.StatusOK || body != "0123456789" {
+			t.Errorf("trickled GET: %d %q, %v; want all of it", code, body, err)
+		}
+		if took := time.Since(start); took < 4*20*time.Millisecond {
+			t.Errorf("5 chunks 20ms apart arrived in %v", took)
+		}
+	})
+
+	t.Run("probability", func(t *testing.T) {
+		setRules(`[{"fault": "error", "probability": 0.5}, {"fault": "error", "probability": 0, "status": 503}]`)
+
+		const n = 400
+		failed := 0
+		for range n {
+			code, _, err := chaosRequest(srv, "GET", "/v1/key/k", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch code {
+			case http.StatusInternalServerError:
+				failed++
+			case http.StatusOK:
+			default:
+				t.Fatalf("GET answered %d, from a rule with probability 0", code)
+			}
+		}
+		if failed < n/4 || failed > n*3/4 {
+			t.Errorf("%d of %d requests failed, with a probability of 0.5", failed, n)
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		setRules(`[{"fault": "error", "probability": 1}]`)
+
+		// The endpoint is exempt from the rules, and needs the admin key
+		code, body, err := chaosRequest(srv, "GET", ChaosPath, "", "")
+		if err != nil || code != http.StatusOK || !strings.Contains(body, `"fault":"error"`) {
+			t.Errorf("GET %s under a rule failing everything: %d %q, %v", ChaosPath, code, body, err)
+		}
+		resp, err := srv.Client().Get(srv.URL + ChaosPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s without the admin key: %d", ChaosPath, resp.StatusCode)
+		}
+
+		// Invalid rules are refused, keeping the ones in effect
+		for _, rules := range []string{
+			`[{"fault": "explode", "probability": 1}]`,
+			`[{"fault": "error", "probability": 2}]`,
+			`[{"fault": "error", "probability": 1, "status": 404}]`,
+			`[{"fault": "latency", "probability": 1, "delay_ms": -1}]`,
+			`{"fault": "error"}`,
+		} {
+			if code, _, err := chaosRequest(srv, "PUT", ChaosPath, rules, ""); err != nil || code != http.StatusBadRequest {
+				t.Errorf("PUT %s: %d, %v; want 400", rules, code, err)
+			}
+		}
+		if rules := faults.Rules(); len(rules) != 1 || rules[0].Fault != FaultError {
+			t.Errorf("rules after invalid ones were refused: %+v", rules)
+		}
+
+		// No rules turns injection off
+		setRules(`[]`)
+		if code, body, err := chaosRequest(srv, "GET", "/v1/key/k", "", ""); err != nil || code != http.StatusOK || body != "0123456789" {
+			t.Errorf("GET without rules: %d %q, %v", code, body, err)
+		}
+	})
+}
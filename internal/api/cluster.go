@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/cluster"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// Modes of Config.ClusterWrites.
+const (
+	ClusterRedirect = "redirect" // Answer with a redirect to the leader
+	ClusterProxy    = "proxy"    // Pass the request on to the leader, and its answer back
+)
+
+// ConsistencyParam selects where a read of the key API is served from in a
+// cluster: ConsistencyLeader reads from the leader, which reflects every
+// write acknowledged before the read; anything else, ConsistencyStale
+// included, reads from the node asked, which may lag behind it.
+const (
+	ConsistencyParam  = "consistency"
+	ConsistencyStale  = "stale"
+	ConsistencyLeader = "leader"
+)
+
+// ForwardedHeader is set, to the ID of the node, on the requests a node
+// passes on to the leader. A node that isn't the leader answers those with
+// not_leader rather than pass them on again.
+const ForwardedHeader = "X-KV-Forwarded-By"
+
+// routeToLeader sends the writes of the key API, and its reads asking for
+// ConsistencyLeader, to the leader of the cluster, as Config.ClusterWrites
+// says, unless this node leads it. The leader checks it still does before
+// serving such a read.
+func (s *Server) routeToLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read := isReadRequest(r)
+		if !isKeyRequest(r) || read && r.URL.Query().Get(ConsistencyParam) != ConsistencyLeader {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.cluster.IsLeader() {
+			if read {
+				if err := s.cluster.VerifyLeader(); err != nil {
+					s.writeError(w, err)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		leader, ok := s.cluster.Leader()
+		switch {
+		case r.Header.Get(ForwardedHeader) != "":
+			s.writeError(w, fmt.Errorf("%w: forwarded by %s", cluster.ErrorNotLeader, r.Header.Get(ForwardedHeader)))
+		case !ok:
+			s.writeError(w, cluster.ErrorNoLeader)
+		case s.clusterWrites == ClusterProxy:
+			s.proxyToLeader(w, r, leader)
+		default:
+			http.Redirect(w, r, leader.HTTPURL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		}
+	})
+}
+
+// proxyToLeader passes r on to leader, and its answer back.
+func (s *Server) proxyToLeader(w http.ResponseWriter, r *http.Request, leader cluster.Peer) {
+	target, err := url.Parse(leader.HTTPURL)
+	if err != nil {
+		s.writeError(w, fmt.Errorf("%w: %v", cluster.ErrorNoLeader, err))
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(ForwardedHeader, s.cluster.ID())
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.writeError(w, fmt.Errorf("%w: leader %s unreachable: %v", cluster.ErrorNoLeader, leader.ID, err))
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+}
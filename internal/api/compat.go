@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"strings"
+)
+
+// Modes of Config.V1Compat.
+const (
+	V1CompatStrict = "strict" // /v1 answers in the shapes it had before /v2
+	V1CompatModern = "modern" // /v1 answers as /v2 does
+)
+
+// apiVersions are the path prefixes the key API is served under. /v2 always
+// answers in the current shapes, and /v1 as Config.V1Compat says.
+var apiVersions = []string{"/v1", "/v2"}
+
+// unversioned returns path without the API version it starts with, if any.
+func unversioned(path string) string {
+	for _, v := range apiVersions {
+		if rest, ok := strings.CutPrefix(path, v); ok && (rest == "" || rest[0] == '/') {
+			return rest
+		}
+	}
+
+	return path
+}
+
+// v1Compat has /v1 requests answered in the shapes clients written before
+// /v2 depend on, unless Config.V1Compat is modern. The handlers are the
+// same; their responses are translated back:
+//
+//   - Errors are plain text holding the message of the JSON body /v2
+//     sends, with the same status. Writes refused by maintenance mode keep
+//     the JSON body they always had, with the reason but no code. Reads of
+//     compacted changes keep theirs, as clients need the earliest
+//     sequence to resync from.
+//   - A put skipped by store.Options.SkipNoopWrites answers 201, like any
+//     other put, without NoopHeader.
+//
+// A delete of a missing key answers 200 under both versions.
+func (s *Server) v1Compat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.legacyV1 || !strings.HasPrefix(r.URL.Path, "/v1/") && r.URL.Path != "/v1" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		lw := &legacyWriter{ResponseWriter: w, put: r.Method == http.MethodPut}
+		defer lw.finish()
+
+		next.ServeHTTP(lw, r)
+	})
+}
+
+// legacyWriter translates a response to its legacy /v1 shape, for
+// v1Compat. JSON error bodies are held back until the handler is done, and
+// then rewritten.
+type legacyWriter struct {
+	http.ResponseWriter
+	put bool // Whether the request is a PUT
+
+	wroteHeader bool
+	status      int           // Status of the error being held back
+	body        *bytes.Buffer // The error body held back; nil unless there is one
+}
+
+func (w *legacyWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	switch {
+	case code >= 400 && h.Get("Content-Type") == "application/json":
+		w.status, w.body = code, new(bytes.Buffer)
+		return
+	case w.put && code == http.StatusOK && h.Get(NoopHeader) != "":
+		h.Del(NoopHeader)
+		code = http.StatusCreated
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *legacyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.body != nil {
+		return w.body.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *legacyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes the error held back, if any, in its legacy shape. A body
+// that isn't one writeError wrote is passed on as it is.
+func (w *legacyWriter) finish() {
+	if w.body == nil {
+		return
+	}
+
+	var body errorBody
+
+	dec := json.NewDecoder(bytes.NewReader(w.body.Bytes()))
+	dec.DisallowUnknownFields()
+
+	if dec.Decode(&body) != nil || body.Code == "" {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+
+	if c, _ := lookupError(translog.ErrorCompacted); body.Code == c.code {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+
+	if c, _ := lookupError(store.ErrorReadOnly); body.Code == c.code {
+		w.ResponseWriter.WriteHeader(w.status)
+		json.NewEncoder(w.ResponseWriter).Encode(struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason,omitempty"`
+		}{body.Error, body.Reason})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.ResponseWriter.WriteHeader(w.status)
+	fmt.Fprintln(w.ResponseWriter, body.Error)
+}
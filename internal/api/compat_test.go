@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with the responses given")
+
+// volatileHeaders change from one run to the next. Their presence is
+// pinned, but not their values.
+var volatileHeaders = []string{
+	"Date",
+	"Etag",
+	"Last-Modified",
+	"X-Kv-Created",
+	"X-Kv-Expires",
+	"X-Request-Id",
+}
+
+// timestamps matches the times in response bodies, which are volatile too.
+var timestamps = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+
+// dumpResponse renders the status, headers and body of w for a golden
+// file, with volatile values masked.
+func dumpResponse(method, path string, w *httptest.ResponseRecorder) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%s %s\n%d %s\n", method, path, w.Code, http.StatusText(w.Code))
+
+	names := make([]string, 0, len(w.Header()))
+	for name := range w.Header() {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		for _, v := range w.Header()[name] {
+			if slices.Contains(volatileHeaders, http.CanonicalHeaderKey(name)) {
+				v = "<volatile>"
+			}
+			fmt.Fprintf(&b, "%s: %s\n", name, v)
+		}
+	}
+
+	b.WriteString("\n")
+	b.Write(timestamps.ReplaceAll(w.Body.Bytes(), []byte("<time>")))
+
+	return b.Bytes()
+}
+
+// TestV1Golden pins the responses of every /v1 operation in the legacy
+// shapes clients depend on, and in the modern ones they can opt into. The
+// operations run in order against one store, so each sees what those before
+// it did. Run with -update to rewrite testdata/v1 after a deliberate change.
+func TestV1Golden(t *testing.T) {
+	user := http.Header{"X-Api-Key": {"user-key"}}
+	other := http.Header{"X-Api-Key": {"other-key"}}
+
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header http.Header
+	}{
+		{"put-create", "PUT", "/v1/key/k", "hello", nil},
+		{"put-update", "PUT", "/v1/key/k", "world", http.Header{"Content-Type": {"text/plain"}}},
+		{"put-precondition-failed", "PUT", "/v1/key/k", "v", http.Header{"If-Match": {`"stale"`}}},
+		{"put-invalid-key", "PUT", "/v1/key/line%0Abreak", "v", nil},
+		{"put-empty-key", "PUT", "/v1/key/", "v", nil},
+		{"get", "GET", "/v1/key/k", "", nil},
+		{"head", "HEAD", "/v1/key/k", "", nil},
+		{"get-missing", "GET", "/v1/key/missing", "", nil},
+		{"get-long-poll-timeout", "GET", "/v1/key/k?wait=1ms&version=2", "", nil},
+		{"get-long-poll-invalid", "GET", "/v1/key/k?wait=soon&version=2", "", nil},
+		{"put-json", "PUT", "/v1/key/doc", `{"a":1,"b":2}`, http.Header{"Content-Type": {"application/json"}}},
+		{"patch", "PATCH", "/v1/key/doc", `{"b":null,"c":3}`, http.Header{"Content-Type": {"application/merge-patch+json"}}},
+		{"patch-missing", "PATCH", "/v1/key/missing", `{"a":1}`, http.Header{"Content-Type": {"application/merge-patch+json"}}},
+		{"put-counter", "PUT", "/v1/key/counter", "1", nil},
+		{"incr", "POST", "/v1/key/counter/incr", `{"delta":5}`, nil},
+		{"incr-not-numeric", "POST", "/v1/key/k/incr", `{"delta":1}`, nil},
+		{"incr-invalid", "POST", "/v1/key/counter/incr", `{"by":1}`, nil},
+		{"cas", "POST", "/v1/key/k/cas", `{"expected":"world","value":"swapped"}`, nil},
+		{"cas-mismatch", "POST", "/v1/key/k/cas", `{"expected":"world","value":"again"}`, nil},
+		{"lease-acquire", "POST", "/v1/key/k/lease", `{"ttl":"30s"}`, user},
+		{"lease-held", "POST", "/v1/key/k/lease", `{"ttl":"30s"}`, other},
+		{"lease-anonymous", "POST", "/v1/key/k/lease", `{"ttl":"30s"}`, nil},
+		{"lease-release", "DELETE", "/v1/key/k/lease", "", user},
+		{"bucket-put", "PUT", "/v1/buckets/b/key/k", "in b", nil},
+		{"bucket-get", "GET", "/v1/buckets/b/key/k", "", nil},
+		{"bucket-patch", "PATCH", "/v1/buckets/b/key/k", `{"a":1}`, http.Header{"Content-Type": {"application/merge-patch+json"}}},
+		{"bucket-incr", "POST", "/v1/buckets/b/key/n/incr", `{"delta":2}`, nil},
+		{"bucket-cas", "POST", "/v1/buckets/b/key/k/cas", `{"expected":"in b","value":"swapped"}`, nil},
+		{"bucket-lease-acquire", "POST", "/v1/buckets/b/key/k/lease", `{"ttl":"30s"}`, user},
+		{"bucket-lease-release", "DELETE", "/v1/buckets/b/key/k/lease", "", user},
+		{"bucket-invalid", "PUT", "/v1/buckets/no%20spaces/key/k", "v", nil},
+		{"buckets", "GET", "/v1/buckets", "", nil},
+		{"keys", "GET", "/v1/keys", "", nil},
+		{"keys-prefix", "GET", "/v1/keys?prefix=co&bucket=default", "", nil},
+		{"bulk", "POST", "/v1/keys", `{"get":["k"],"put":{"x":"1","y":"2"},"delete":["counter"]}`, nil},
+		{"bulk-invalid", "POST", "/v1/keys", `{"put":`, nil},
+		{"snapshot-read", "POST", "/v1/snapshot-read", `{"keys":["x","y","missing"]}`, nil},
+		{"txn-then", "POST", "/v1/txn", `{"if":[{"key":"x","target":"value","value":"1"}],"then":[{"op":"put","key":"z","value":"v"},{"op":"delete","key":"y"}]}`, nil},
+		{"txn-else", "POST", "/v1/txn", `{"if":[{"key":"x","target":"absent"}],"then":[{"op":"delete","key":"x"}],"else":[{"op":"get","key":"x"}]}`, nil},
+		{"txn-invalid", "POST", "/v1/txn", `{"then":[{"op":"put","key":"z","value":"1"},{"op":"put","key":"z","value":"2"}]}`, nil},
+		{"delete", "DELETE", "/v1/key/z", "", nil},
+		{"delete-missing", "DELETE", "/v1/key/z", "", nil},
+		{"bucket-delete", "DELETE", "/v1/buckets/b/key/k", "", nil},
+		{"delete-keys-unauthorized", "DELETE", "/v1/keys?prefix=x&confirm=true", "", nil},
+		{"delete-keys", "DELETE", "/v1/keys?prefix=x&confirm=true", "", http.Header{"X-Api-Key": {"sekret"}}},
+		{"drop-bucket", "DELETE", "/v1/buckets/b", "", http.Header{"X-Api-Key": {"sekret"}}},
+		{"method-not-allowed", "POST", "/v1/key/k", "v", nil},
+	}
+
+	for _, mode := range []string{V1CompatStrict, V1CompatModern} {
+		t.Run(mode, func(t *testing.T) {
+			_, h, closeLog := openRouter(t, t.TempDir(), Config{
+				AdminKey: "sekret",
+				Authenticator: &APIKeyAuthenticator{Keys: map[string]Principal{
+					"user-key":  {ID: "user"},
+					"other-key": {ID: "other"},
+				}},
+				V1Compat: mode,
+			})
+			defer closeLog()
+
+			for i, step := range steps {
+				w := serve(h, step.method, step.path, step.body, step.header)
+				got := dumpResponse(step.method, step.path, w)
+
+				path := filepath.Join("testdata", "v1", mode, fmt.Sprintf("%02d-%s.golden", i, step.name))
+
+				if *update {
+					if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%v; run the tests with -update to create it", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s: the response changed\n--- got\n%s\n--- want\n%s", path, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+)
+
+// writePrecondition returns the precondition the If-Match and
+// If-None-Match headers of r set on its write, or nil if it carries
+// neither. If-Match, with ETags as a GET reports them or "*", requires the
+// key to exist with one of them; If-None-Match requires it not to, "*"
+// meaning it must not exist at all, so a PUT only creates it. A write whose
+// precondition fails is answered with 412 and the code
+// precondition_failed, and changes nothing: the check is made under the
+// lock of the store's write of the key, so this is a compare-and-swap on
+// the key's version.
+func writePrecondition(r *http.Request) store.Precondition {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+
+	return func(meta store.ValueMeta, exists bool) error {
+		if ifMatch != "" && !(exists && etagMatches(ifMatch, etag(meta))) {
+			return fmt.Errorf("%w: If-Match %s", ErrorPreconditionFailed, ifMatch)
+		}
+		if ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, etag(meta)) {
+			return fmt.Errorf("%w: If-None-Match %s", ErrorPreconditionFailed, ifNoneMatch)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	// tag returns the ETag a GET of k reports
+	tag := func(t *testing.T) string {
+		t.Helper()
+
+		w := serve(h, "HEAD", "/v2/key/k", "", nil)
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+			t.Fatalf("HEAD: %d with ETag %q", w.Code, w.Header().Get("ETag"))
+		}
+		return w.Header().Get("ETag")
+	}
+
+	// write sends a write with the header set to value, checking it's
+	// answered with want, and 412 precondition_failed in particular
+	write := func(t *testing.T, method, value, header, cond string, want int) {
+		t.Helper()
+
+		w := serve(h, method, "/v2/key/k", value, http.Header{header: {cond}})
+		if w.Code != want {
+			t.Fatalf("%s with %s %s: %d %s, want %d", method, header, cond, w.Code, w.Body, want)
+		}
+
+		var body errorBody
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if want == http.StatusPreconditionFailed && body.Code != "precondition_failed" {
+			t.Errorf("%s with %s %s answered with code %q", method, header, cond, body.Code)
+		}
+	}
+
+	// value checks that k holds want, or is missing if want is empty
+	value := func(t *testing.T, want string) {
+		t.Helper()
+
+		w := serve(h, "GET", "/v2/key/k", "", nil)
+		if want == "" && w.Code != http.StatusNotFound || want != "" && (w.Code != http.StatusOK || w.Body.String() != want) {
+			t.Errorf("GET: %d %q, want %q", w.Code, w.Body, want)
+		}
+	}
+
+	// While the key is missing, only If-None-Match lets writes through
+	write(t, "PUT", "v", "If-Match", "*", http.StatusPreconditionFailed)
+	write(t, "PUT", "v", "If-Match", `"1-0"`, http.StatusPreconditionFailed)
+	write(t, "DELETE", "", "If-Match", "*", http.StatusPreconditionFailed)
+	value(t, "")
+	write(t, "PUT", "v1", "If-None-Match", "*", http.StatusCreated)
+	value(t, "v1")
+
+	// Once it exists, If-None-Match: * refuses to create it again, and
+	// If-Match takes its current ETag or *
+	write(t, "PUT", "again", "If-None-Match", "*", http.StatusPreconditionFailed)
+	write(t, "DELETE", "", "If-None-Match", "*", http.StatusPreconditionFailed)
+
+	v1 := tag(t)
+	write(t, "PUT", "v2", "If-None-Match", v1, http.StatusPreconditionFailed)
+	write(t, "PUT", "v2", "If-Match", `"99-0", `+v1, http.StatusCreated)
+	write(t, "PUT", "v3", "If-Match", v1, http.StatusPreconditionFailed) // Stale now
+	write(t, "DELETE", "", "If-Match", v1, http.StatusPreconditionFailed)
+	value(t, "v2")
+
+	write(t, "PUT", "v3", "If-None-Match", v1, http.StatusCreated) // Not the current version
+	write(t, "PUT", "v4", "If-Match", "*", http.StatusCreated)
+	value(t, "v4")
+
+	v4 := tag(t)
+	write(t, "DELETE", "", "If-None-Match", v4, http.StatusPreconditionFailed)
+	write(t, "DELETE", "", "If-Match", v4, http.StatusOK)
+	value(t, "")
+
+	// A key put again after a delete has another ETag, though its version
+	// starts over
+	write(t, "PUT", "v1", "If-None-Match", "*", http.StatusCreated)
+	if again := tag(t); again == v1 || again == v4 {
+		t.Errorf("a key put again has an ETag it had before, %s", again)
+	}
+}
+
+func TestConditionalWritesRace(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	const writers = 20
+
+	// race has each writer send its write at once, with the header set to
+	// cond, and returns the status each was answered with
+	race := func(method, header, cond string) map[int]int {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		statuses := make(map[int]int)
+		start := make(chan struct{})
+
+		for i := range writers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				w := serve(h, method, "/v2/key/k", fmt.Sprint("writer ", i), http.Header{header: {cond}})
+
+				mu.Lock()
+				statuses[w.Code]++
+				mu.Unlock()
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+
+		return statuses
+	}
+
+	// Of those creating the key, one wins
+	if got := race("PUT", "If-None-Match", "*"); got[http.StatusCreated] != 1 || got[http.StatusPreconditionFailed] != writers-1 {
+		t.Errorf("racing creations answered %v, want one 201 and the rest 412", got)
+	}
+
+	// Of those updating the version they read, one wins
+	etag := serve(h, "HEAD", "/v2/key/k", "", nil).Header().Get("ETag")
+	if got := race("PUT", "If-Match", etag); got[http.StatusCreated] != 1 || got[http.StatusPreconditionFailed] != writers-1 {
+		t.Errorf("racing updates answered %v, want one 201 and the rest 412", got)
+	}
+
+	// As do those deleting it
+	etag = serve(h, "HEAD", "/v2/key/k", "", nil).Header().Get("ETag")
+	if got := race("DELETE", "If-Match", etag); got[http.StatusOK] != 1 || got[http.StatusPreconditionFailed] != writers-1 {
+		t.Errorf("racing deletes answered %v, want one 200 and the rest 412", got)
+	}
+}
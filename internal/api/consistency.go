@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+	"strconv"
+)
+
+// SequenceHeader carries the sequence number assigned to a successful
+// write, which a later GET can pass back in MinSequenceHeader to read its
+// own write from any instance.
+const (
+	SequenceHeader    = "X-KV-Sequence"
+	MinSequenceHeader = "X-KV-Min-Sequence"
+)
+
+// ErrorBehind is reported for reads whose X-KV-Min-Sequence the store
+// didn't reach in time, with the sequence it did reach.
+var ErrorBehind = errors.New("store is behind the requested sequence")
+
+// NoopHeader is set to true on the answer to a put that was skipped because
+// the key already had the value, under store.Options.SkipNoopWrites.
+const NoopHeader = "X-KV-Noop"
+
+// minSequenceRetryAfter is the Retry-After hint, in seconds, sent with reads
+// rejected for being behind the requested sequence.
+const minSequenceRetryAfter = 1
+
+// QuotaWarningHeader is set on the responses to writes that leave their
+// bucket near its quota or past it, to its usage, as in
+// "keys=850/1000 bytes=52000/1048576".
+const QuotaWarningHeader = "X-KV-Quota-Warning"
+
+// writeQuotaWarning reports the usage a write recorded for
+// store.WithQuotaWarning in QuotaWarningHeader, if it recorded any.
+func writeQuotaWarning(w http.ResponseWriter, u store.QuotaUsage) {
+	if u.Bucket != "" {
+		w.Header().Set(QuotaWarningHeader, u.String())
+	}
+}
+
+// writeSequence reports the sequence of a write in SequenceHeader. Writes
+// that logged nothing have none.
+func writeSequence(w http.ResponseWriter, seq uint64) {
+	if seq != 0 {
+		w.Header().Set(SequenceHeader, strconv.FormatUint(seq, 10))
+	}
+}
+
+// awaitSequence holds a read carrying MinSequenceHeader until the store has
+// applied that sequence, for at most the configured wait, and reports
+// whether the read may go ahead. Otherwise it has answered the request with
+// 503 and the sequence reached so far, so the client can retry, possibly on
+// another instance, or with 504 if the request's own deadline passed first.
+func (s *Server) awaitSequence(w http.ResponseWriter, r *http.Request) bool {
+	v := r.Header.Get(MinSequenceHeader)
+	if v == "" {
+		return true
+	}
+
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		s.writeError(w, fmt.Errorf("%w: invalid %s %q", ErrorInvalidRequest, MinSequenceHeader, v))
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.minSequenceWait)
+	defer cancel()
+
+	err = s.store.WaitSequence(ctx, seq)
+	if err == nil {
+		return true
+	}
+
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		s.writeError(w, phaseError(store.PhaseMinSequence, r.Context().Err()))
+		return false
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) || r.Context().Err() != nil {
+		return false // The client has gone away
+	}
+
+	applied := s.store.Sequence()
+
+	w.Header().Set(SequenceHeader, strconv.FormatUint(applied, 10))
+	w.Header().Set("Retry-After", strconv.Itoa(minSequenceRetryAfter))
+	s.writeError(w, fmt.Errorf("%w: applied sequence %d is behind %d", ErrorBehind, applied, seq))
+
+	return false
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFollowerReadsWaitForMinSequence(t *testing.T) {
+	_, leaderLog, leader, closeLeader := openLogRouter(t, t.TempDir(), Config{})
+	defer closeLeader()
+
+	leaderSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replication.ServeEvents(w, r, leaderLog)
+	}))
+	defer leaderSrv.Close()
+
+	st, _, _, closeFollower := openLogRouter(t, t.TempDir(), Config{})
+	defer closeFollower()
+	st.SetReadOnly(true, "following")
+
+	follower := NewRouter(NewServer(st, Config{MinSequenceWait: 10 * time.Second}))
+	impatient := NewRouter(NewServer(st, Config{MinSequenceWait: 10 * time.Millisecond}))
+
+	w := serve(leader, "PUT", "/v1/key/k", "written", nil)
+	if w.Code != http.StatusCreated || w.Header().Get(SequenceHeader) == "" {
+		t.Fatalf("PUT on the leader: %d %s with sequence %q", w.Code, w.Body, w.Header().Get(SequenceHeader))
+	}
+	seq := w.Header().Get(SequenceHeader)
+	readOwnWrite := make(http.Header)
+	readOwnWrite.Set(MinSequenceHeader, seq)
+
+	// Before the follower runs, a read that can't wait long is told it's
+	// behind
+	w = serve(impatient, "GET", "/v1/key/k", "", readOwnWrite)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(SequenceHeader) != "0" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("a GET of sequence %s not replicated yet: %d %s with sequence %q", seq, w.Code, w.Body, w.Header().Get(SequenceHeader))
+	}
+
+	// One that can is held until the write is replicated
+	read := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		read <- serve(follower, "GET", "/v1/key/k", "", readOwnWrite)
+	}()
+
+	select {
+	case w := <-read:
+		t.Fatalf("a GET of sequence %s answered %d %s before the follower ran", seq, w.Code, w.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		replication.NewFollower(leaderSrv.URL, "", st, st.Sequence()).Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	select {
+	case w := <-read:
+		if w.Code != http.StatusOK || w.Body.String() != "written" {
+			t.Errorf("a GET of sequence %s once replicated: %d %q, want the write", seq, w.Code, w.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a GET of a replicated sequence is still waiting")
+	}
+
+	// A read of a sequence already applied doesn't wait
+	if w := serve(impatient, "GET", "/v1/key/k", "", readOwnWrite); w.Code != http.StatusOK {
+		t.Errorf("a GET of sequence %s already applied: %d %s", seq, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// requestContentType returns the media type of the value r puts, from its
+// Content-Type header, normalized, or "" if it has none. Reads of the key
+// are served with it, as store.WithContentType describes; values put
+// without one are served with the type sniffed from them.
+func requestContentType(r *http.Request) (string, error) {
+	v := r.Header.Get("Content-Type")
+	if v == "" {
+		return "", nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid Content-Type %q", ErrorInvalidRequest, v)
+	}
+
+	return mime.FormatMediaType(mediaType, params), nil
+}
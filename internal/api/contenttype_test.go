@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentTypeSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	binary := make([]byte, 4096)
+	for i := range binary {
+		binary[i] = byte(rand.N(256))
+	}
+
+	puts := []struct {
+		key, value, contentType string
+	}{
+		{"png", string(binary), "image/png"},
+		{"text", "plain ☃", "text/plain; charset=utf-8"},
+		{"sniffed", "<html><body>hi</body></html>", ""},
+		{"cleared", "was json", "application/json"},
+		{"cleared", "{\"now\": \"untyped\"}", ""},
+	}
+
+	// want is the value and Content-Type each key must be served with
+	want := map[string][2]string{
+		"png":     {string(binary), "image/png"},
+		"text":    {"plain ☃", "text/plain; charset=utf-8"},
+		"sniffed": {"<html><body>hi</body></html>", "text/html; charset=utf-8"},
+		"cleared": {"{\"now\": \"untyped\"}", "text/plain; charset=utf-8"},
+	}
+
+	check := func(t *testing.T, h http.Handler, when string) {
+		t.Helper()
+
+		for key, w := range want {
+			for _, method := range []string{"GET", "HEAD"} {
+				resp := serve(h, method, "/v1/key/"+key, "", nil)
+				if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != w[1] {
+					t.Errorf("%s %s %s: %d with Content-Type %q, want %q", method, key, when, resp.Code, resp.Header().Get("Content-Type"), w[1])
+				}
+				if method == "GET" && resp.Body.String() != w[0] {
+					t.Errorf("GET %s %s: %d bytes that differ from the %d put", key, when, resp.Body.Len(), len(w[0]))
+				}
+			}
+		}
+	}
+
+	_, h, closeLog := openRouter(t, dir, Config{})
+
+	for _, p := range puts {
+		var header http.Header
+		if p.contentType != "" {
+			header = http.Header{"Content-Type": {p.contentType}}
+		}
+
+		if w := serve(h, "PUT", "/v1/key/"+p.key, p.value, header); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d %s", p.key, w.Code, w.Body)
+		}
+	}
+
+	if w := serve(h, "PUT", "/v1/key/bad", "v", http.Header{"Content-Type": {"not a media type"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with an invalid Content-Type: %d, want 400", w.Code)
+	}
+
+	check(t, h, "before the restart")
+	closeLog()
+
+	// The media type is a field of the put, so every put is a single line
+	logged, err := os.ReadFile(filepath.Join(dir, translog.LogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(logged, []byte("\n")); n != len(puts) {
+		t.Errorf("%d puts logged as %d lines:\n%q", len(puts), n, logged)
+	}
+
+	_, h, closeLog = openRouter(t, dir, Config{})
+	defer closeLog()
+
+	check(t, h, "after the restart")
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadlineHeader carries how long, in milliseconds, the client gives the
+// server to answer a request, such as "250". The server gives up once it
+// passes, answering 504 with the code deadline_exceeded and the phase the
+// request was in; see store.DeadlineError for what each phase changed.
+const DeadlineHeader = "X-KV-Deadline-Ms"
+
+// DefaultMaxDeadline is the longest deadline DeadlineHeader may ask for
+// when Config.MaxDeadline is zero.
+const DefaultMaxDeadline = time.Minute
+
+// applyDeadline gives the requests carrying DeadlineHeader a context that
+// ends once their deadline passes, capped at the server's maximum. The
+// time spent waiting for a slot under the concurrency limits counts.
+func (s *Server) applyDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(DeadlineHeader)
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms <= 0 {
+			s.writeError(w, fmt.Errorf("%w: %s must be a positive number of milliseconds: %q", ErrorInvalidRequest, DeadlineHeader, v))
+			return
+		}
+
+		timeout := s.maxDeadline
+		if ms < timeout.Milliseconds() {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// phaseError returns err as a store.DeadlineError for phase if it is the
+// error of a context whose deadline passed, and as is otherwise, for the
+// phases the server waits in itself.
+func phaseError(phase string, err error) error {
+	var de *store.DeadlineError
+	if !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &de) {
+		return err
+	}
+
+	return &store.DeadlineError{Phase: phase, Err: err}
+}
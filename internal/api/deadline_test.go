@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeadlineHeader(t *testing.T) {
+	const (
+		deadline  = 30 * time.Millisecond
+		tolerance = 300 * time.Millisecond
+	)
+
+	// expire makes a request with a deadline of ms, checking that it is
+	// answered 504 with code and phase within tolerance of deadline. It goes
+	// through /v2, whose errors carry their code
+	expire := func(t *testing.T, h http.Handler, method, path string, header http.Header, ms int, code, phase string) {
+		t.Helper()
+
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set(DeadlineHeader, strconv.Itoa(ms))
+
+		start := time.Now()
+		w := serve(h, method, path, "v", header)
+		took := time.Since(start)
+
+		var body errorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusGatewayTimeout || body.Code != code || body.Phase != phase {
+			t.Errorf("%s %s: %d %s, want 504 %s in phase %s", method, path, w.Code, w.Body, code, phase)
+		}
+		if took > deadline+tolerance {
+			t.Errorf("%s %s answered after %s, for a deadline of %s", method, path, took, deadline)
+		}
+	}
+
+	ms := int(deadline.Milliseconds())
+
+	// with returns a header setting name to value
+	with := func(name, value string) http.Header {
+		header := make(http.Header)
+		header.Set(name, value)
+		return header
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+		defer closeLog()
+
+		for _, v := range []string{"soon", "0", "-5", "1.5"} {
+			if w := serve(h, "GET", "/v2/key/k", "", with(DeadlineHeader, v)); w.Code != http.StatusBadRequest {
+				t.Errorf("GET with %s %q: %d, want 400", DeadlineHeader, v, w.Code)
+			}
+		}
+
+		// A deadline long enough changes nothing
+		if w := serve(h, "PUT", "/v2/key/k", "v", with(DeadlineHeader, "10000")); w.Code != http.StatusCreated {
+			t.Errorf("PUT with a deadline of 10s: %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run(store.PhaseQueue, func(t *testing.T) {
+		st, h, closeLog := openRouter(t, t.TempDir(), Config{MaxInflightWrites: 1, LimitWait: time.Minute})
+		defer closeLog()
+
+		// A write held in its hook keeps the only slot
+		entered, release := make(chan struct{}), make(chan struct{})
+		st.RegisterPutHook("held", func(key, value string) error {
+			close(entered)
+			<-release
+			return nil
+		})
+		held := make(chan int)
+		go func() { held <- serve(h, "PUT", "/v2/key/held", "v", nil).Code }()
+		<-entered
+
+		expire(t, h, "PUT", "/v2/key/k", nil, ms, "deadline_exceeded", store.PhaseQueue)
+		if _, err := st.Get("k"); err == nil {
+			t.Error("a write given up in the queue was applied")
+		}
+
+		close(release)
+		if code := <-held; code != http.StatusCreated {
+			t.Errorf("the held write: %d", code)
+		}
+	})
+
+	t.Run(store.PhaseFlush, func(t *testing.T) {
+		dir := t.TempDir()
+		file, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &slowSyncLogger{TransactionLogger: file}
+
+		st := store.New(l, store.Options{})
+		if err := st.Load(dir, l); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Run(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			l.delay.Store(0)
+			if err := l.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		h := NewRouter(NewServer(st, Config{Durability: DurabilityPolicy{FlushTimeout: time.Minute}}))
+
+		// The write is applied all the same
+		l.delay.Store(int64(time.Second))
+		expire(t, h, "PUT", "/v2/key/k", with(DurabilityHeader, "flush"), ms, "not_durable", store.PhaseFlush)
+		if v, err := st.Get("k"); err != nil || v != "v" {
+			t.Errorf("GET k after its flush was given up: %q, %v", v, err)
+		}
+	})
+
+	t.Run(store.PhaseMinSequence, func(t *testing.T) {
+		st, h, closeLog := openRouter(t, t.TempDir(), Config{MinSequenceWait: time.Minute})
+		defer closeLog()
+
+		ahead := fmt.Sprint(st.Sequence() + 10)
+		expire(t, h, "GET", "/v2/key/k", with(MinSequenceHeader, ahead), ms, "deadline_exceeded", store.PhaseMinSequence)
+	})
+
+	t.Run(store.PhaseWatch, func(t *testing.T) {
+		_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+		defer closeLog()
+
+		if w := serve(h, "PUT", "/v2/key/k", "v", nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT: %d", w.Code)
+		}
+		expire(t, h, "GET", "/v2/key/k?wait=1m&version=1", nil, ms, "deadline_exceeded", store.PhaseWatch)
+	})
+
+	// A deadline asked for past the server's maximum is cut to it
+	t.Run("maximum", func(t *testing.T) {
+		_, h, closeLog := openRouter(t, t.TempDir(), Config{MaxDeadline: deadline})
+		defer closeLog()
+
+		if w := serve(h, "PUT", "/v2/key/k", "v", nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT: %d", w.Code)
+		}
+		expire(t, h, "GET", "/v2/key/k?wait=1m&version=1", nil, 60000, "deadline_exceeded", store.PhaseWatch)
+	})
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"log"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// Diagnostics bundles hold the last defaultDiagEvents log events, or as many
+// as the events query parameter asks for up to maxDiagEvents.
+const (
+	defaultDiagEvents = 100
+	maxDiagEvents     = 10000
+)
+
+// diagTailWait bounds how long a bundle waits for the log tail to be
+// written, so that a stuck logger doesn't hold up the diagnostics of it.
+const diagTailWait = 5 * time.Second
+
+// diagEvent is a log event in a diagnostics bundle, with its bucket and key
+// replaced by hashes and its value by its length as logged, compressed or
+// encrypted. The default bucket is left out.
+type diagEvent struct {
+	Sequence   uint64    `json:"sequence"`
+	Time       time.Time `json:"time,omitzero"`
+	Type       string    `json:"type"`
+	Bucket     string    `json:"bucket,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	ValueBytes int       `json:"value_bytes"`
+}
+
+// diagManifest describes a diagnostics bundle.
+type diagManifest struct {
+	Created  time.Time `json:"created"`
+	Sequence uint64    `json:"sequence"`
+	Events   int       `json:"events"`
+	Hashing  string    `json:"hashing"`
+	Files    []string  `json:"files"`
+	Notes    []string  `json:"notes,omitempty"`
+}
+
+// diagHandler streams a diagnostics bundle for support: a tar.gz of the
+// settings with secrets redacted, the description of the instance, the
+// stats, the metrics, the tail of the transaction log, the logger's recent
+// errors and goroutine and heap profiles. No key or value goes in it: the
+// log tail holds keys and bucket names as HMACs under a key made for the
+// bundle and thrown away, so hashes can be compared within a bundle but not
+// across bundles, and values as their lengths.
+func (s *Server) diagHandler(w http.ResponseWriter, r *http.Request) {
+	events := defaultDiagEvents
+	if v := r.URL.Query().Get("events"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxDiagEvents {
+			s.writeError(w, fmt.Errorf("%w: events must be an integer from 0 to %d", ErrorInvalidRequest, maxDiagEvents))
+			return
+		}
+		events = n
+	}
+
+	hashKey := make([]byte, 32)
+	if _, err := rand.Read(hashKey); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	created := time.Now().UTC()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="kvstore-diag-%s.tar.gz"`, created.Format("20060102T150405Z")))
+
+	if err := s.writeDiag(r.Context(), w, created, events, hashKey); err != nil {
+		// The headers are gone, so the truncated archive is all the
+		// client gets
+		log.Printf("DIAG failed: %v\n", err)
+		return
+	}
+
+	log.Printf("DIAG events=%d\n", events)
+}
+
+// writeDiag writes the bundle to w.
+func (s *Server) writeDiag(ctx context.Context, w io.Writer, created time.Time, events int, hashKey []byte) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := diagManifest{
+		Created:  created,
+		Sequence: s.store.Sequence(),
+		Hashing:  "buckets other than default and keys are HMAC-SHA256, truncated to 16 bytes, under a key made for this bundle only",
+	}
+
+	add := func(name string, data []byte) error {
+		manifest.Files = append(manifest.Files, name)
+
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: created}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		_, err := tw.Write(data)
+		return err
+	}
+
+	addJSON := func(name string, v any) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		return add(name, append(data, '\n'))
+	}
+
+	if s.printConfig != nil {
+		var buf bytes.Buffer
+		if err := s.printConfig(&buf); err != nil {
+			return err
+		}
+
+		if err := add("config.yaml", buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if info, err := s.Info(); err != nil {
+		manifest.Notes = append(manifest.Notes, "info.json left out: "+err.Error())
+	} else if err := addJSON("info.json", info); err != nil {
+		return err
+	}
+
+	if err := addJSON("stats.json", s.diagStats()); err != nil {
+		return err
+	}
+
+	metrics, err := gatherMetrics()
+	if err != nil {
+		return err
+	}
+	if err := add("metrics.txt", metrics); err != nil {
+		return err
+	}
+
+	tail, note := s.logTail(ctx, manifest.Sequence, events, hashKey)
+	if note != "" {
+		manifest.Notes = append(manifest.Notes, note)
+	}
+	manifest.Events = len(tail)
+
+	var lines bytes.Buffer
+	enc := json.NewEncoder(&lines)
+	for _, e := range tail {
+		enc.Encode(e)
+	}
+	if err := add("log_tail.jsonl", lines.Bytes()); err != nil {
+		return err
+	}
+
+	recent := s.logErrors.Recent()
+	if recent == nil {
+		recent = []translog.RecordedError{}
+	}
+	if err := addJSON("log_errors.json", recent); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"goroutine", "heap"} {
+		var buf bytes.Buffer
+		if err := pprof.Lookup(name).WriteTo(&buf, 0); err != nil {
+			return err
+		}
+
+		if err := add(name+".pb.gz", buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	// The manifest lists the files before it, so it goes last
+	if err := addJSON("manifest.json", manifest); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// diagStats returns the stats, without the text of damaged log records the
+// boot report quotes, which may hold parts of keys or values.
+func (s *Server) diagStats() serverStats {
+	stats := s.stats()
+
+	if stats.Boot != nil && len(stats.Boot.Damage) > 0 {
+		boot := *stats.Boot
+		boot.Damage = make([]translog.Damage, len(stats.Boot.Damage))
+
+		for i, d := range stats.Boot.Damage {
+			d.Problem = "(redacted)"
+			boot.Damage[i] = d
+		}
+
+		stats.Boot = &boot
+	}
+
+	return stats
+}
+
+// gatherMetrics returns the metrics served on /metrics, in the text format.
+func gatherMetrics() ([]byte, error) {
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// logTail returns the last n events logged up to sequence last, obfuscated,
+// and a note if they couldn't all be read.
+func (s *Server) logTail(ctx context.Context, last uint64, n int, hashKey []byte) ([]diagEvent, string) {
+	if n == 0 || last == 0 {
+		return nil, ""
+	}
+
+	if s.source == nil {
+		return nil, "log_tail.jsonl is empty: this transaction log backend can't be read back"
+	}
+
+	var after uint64
+	if last > uint64(n) {
+		after = last - uint64(n)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, diagTailWait)
+	defer cancel()
+
+	hash := func(s string) string {
+		mac := hmac.New(sha256.New, hashKey)
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+
+	var tail []diagEvent
+
+	events, errs := s.source.Follow(ctx, after)
+	for e := range events {
+		de := diagEvent{
+			Sequence:   e.Sequence,
+			Time:       e.Time,
+			Type:       eventTypeName(e.EventType),
+			ValueBytes: len(e.Value),
+		}
+
+		if e.Bucket != store.DefaultBucket {
+			de.Bucket = hash(e.Bucket)
+		}
+		if e.Key != "" {
+			de.Key = hash(e.Key)
+		}
+
+		tail = append(tail, de)
+
+		if e.Sequence >= last {
+			cancel()
+			break
+		}
+	}
+
+	for range events {
+		// Drained so that Follow can exit
+	}
+
+	if len(tail) > 0 && tail[len(tail)-1].Sequence >= last {
+		return tail, ""
+	}
+
+	if err := <-errs; err != nil && ctx.Err() == nil {
+		return tail, fmt.Sprintf("log_tail.jsonl is incomplete: %v", err)
+	}
+
+	return tail, "log_tail.jsonl is incomplete: the log wasn't read up to the store's sequence in time"
+}
+
+// eventTypeName names t for diagnostics.
+func eventTypeName(t translog.EventType) string {
+	switch t {
+	case translog.EventPut:
+		return "put"
+	case translog.EventDelete:
+		return "delete"
+	case translog.EventDropBucket:
+		return "drop_bucket"
+	case translog.EventRenameBucket:
+		return "rename_bucket"
+	case translog.EventLease:
+		return "lease"
+	case translog.EventImmutable:
+		return "immutable"
+	case translog.EventExpire:
+		return "expire"
+	case translog.EventEvict:
+		return "evict"
+	case translog.EventOriginalKey:
+		return "original_key"
+	default:
+		return strconv.Itoa(int(t))
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readBundle returns the files of the diagnostics bundle b, with the
+// profiles in it decompressed.
+func readBundle(t *testing.T, b []byte) map[string][]byte {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][]byte)
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.HasSuffix(hdr.Name, ".gz") {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: %v", hdr.Name, err)
+			}
+			if data, err = io.ReadAll(zr); err != nil {
+				t.Fatalf("%s: %v", hdr.Name, err)
+			}
+		}
+
+		files[hdr.Name] = data
+	}
+
+	return files
+}
+
+// tailKeys returns the hashed keys of the events in the log tail of a
+// bundle, by sequence, and checks the lengths of their values.
+func tailKeys(t *testing.T, files map[string][]byte, valueBytes int) map[uint64]string {
+	t.Helper()
+
+	keys := make(map[uint64]string)
+
+	dec := json.NewDecoder(bytes.NewReader(files["log_tail.jsonl"]))
+	for dec.More() {
+		var e diagEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type == "put" && e.ValueBytes != valueBytes {
+			t.Errorf("event %d has value_bytes %d, want %d", e.Sequence, e.ValueBytes, valueBytes)
+		}
+
+		keys[e.Sequence] = e.Key
+	}
+
+	return keys
+}
+
+func TestDiagBundleHoldsNoData(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(ctx)
+
+	h := NewRouter(NewServer(st, Config{
+		AdminKey:    "secret",
+		EventSource: l.(translog.Source),
+		LogErrors:   translog.NewErrorHistory(10),
+		PrintConfig: func(w io.Writer) error {
+			_, err := io.WriteString(w, "admin_key: REDACTED\n")
+			return err
+		},
+	}))
+	admin := http.Header{"X-Api-Key": {"secret"}}
+
+	// Keys, values and a bucket a customer wouldn't want shared, the keys
+	// written twice
+	var secrets []string
+	for i := range 20 {
+		key, value := fmt.Sprintf("customer-key-%d", i%10), fmt.Sprintf("customer-value-%02d", i)
+		secrets = append(secrets, key, value)
+
+		if err := st.BucketPut(ctx, "customer-bucket", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secrets = append(secrets, "customer-bucket")
+	if err := st.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve(h, "GET", "/v1/admin/diag", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("a bundle without the admin key: %d, want 403", w.Code)
+	}
+	if w := serve(h, "GET", "/v1/admin/diag?events=-1", "", admin); w.Code != http.StatusBadRequest {
+		t.Errorf("a bundle of -1 events: %d, want 400", w.Code)
+	}
+
+	bundle := func(events int) map[string][]byte {
+		t.Helper()
+
+		w := serve(h, "GET", fmt.Sprintf("/v1/admin/diag?events=%d", events), "", admin)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/gzip" {
+			t.Fatalf("GET /v1/admin/diag: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+
+		return readBundle(t, w.Body.Bytes())
+	}
+
+	files := bundle(15)
+
+	for _, name := range []string{"config.yaml", "info.json", "stats.json", "metrics.txt", "log_tail.jsonl", "log_errors.json", "goroutine.pb.gz", "heap.pb.gz", "manifest.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("the bundle has no %s", name)
+		}
+	}
+
+	for name, data := range files {
+		for _, secret := range secrets {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("%s in the bundle holds %q", name, secret)
+			}
+		}
+	}
+
+	// The tail holds the last events, values as their lengths, and a key
+	// written twice the same hash both times
+	keys := tailKeys(t, files, len("customer-value-00"))
+	if _, ok := keys[6]; len(keys) != 15 || !ok || keys[20] == "" {
+		t.Fatalf("the tail holds %d events: %v", len(keys), keys)
+	}
+	if keys[10] != keys[20] || keys[10] == keys[19] {
+		t.Errorf("the same key hashed %s and %s, another %s", keys[10], keys[20], keys[19])
+	}
+
+	var manifest diagManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil || manifest.Events != 15 || manifest.Sequence != 20 {
+		t.Errorf("manifest %+v, %v", manifest, err)
+	}
+
+	// Another bundle hashes under another key
+	if again := tailKeys(t, bundle(15), len("customer-value-00")); again[20] == keys[20] {
+		t.Error("two bundles hashed a key the same")
+	}
+}
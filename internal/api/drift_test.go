@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestDriftSamplerDetectsInjectedDivergence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	st, _, closeLog := openRouter(t, dir, Config{})
+	defer closeLog()
+
+	// Every key and record is sampled, so each divergence is found
+	const keys = 10
+	drift := store.NewDriftSampler(st, filepath.Join(dir, translog.LogFileName), 4*keys, 0, 2)
+	h := NewRouter(NewServer(st, Config{AdminKey: "secret", DataDir: dir, Drift: drift}))
+	admin := make(http.Header)
+	admin.Set("X-API-Key", "secret")
+
+	for i := range keys {
+		if err := st.PutCtx(ctx, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.DeleteCtx(ctx, "k3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// readyz returns whether /readyz reports drift, checking the server
+	// stays ready either way
+	readyz := func() bool {
+		t.Helper()
+
+		w := serve(h, "GET", "/readyz", "", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET /readyz: %d %s", w.Code, w.Body.String())
+		}
+
+		var body struct {
+			Drifted bool `json:"drift_suspected"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		return body.Drifted
+	}
+
+	// mismatches returns kv_drift_mismatches_total for kind, as /metrics
+	// exports it
+	mismatches := func(kind string) float64 {
+		t.Helper()
+
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range families {
+			if f.GetName() != "kv_drift_mismatches_total" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				if m.GetLabel()[0].GetValue() == kind {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+
+		return 0
+	}
+	differs, missing, extra := mismatches(store.DivergenceDiffers), mismatches(store.DivergenceMissing), mismatches(store.DivergenceExtra)
+
+	// A store matching its log samples clean
+	drift.Sample(ctx)
+
+	status := drift.Status()
+	if status.Suspected || status.Mismatches != 0 || status.LastClean.IsZero() || status.LastError != "" {
+		t.Errorf("the status after a clean sample: %+v", status)
+	}
+	if readyz() {
+		t.Error("/readyz reports drift after a clean sample")
+	}
+
+	// Writes applied without being logged leave the store differing from
+	// its log: a value changed, a key missing, and one deleted in the log
+	// but present in the store
+	unlogged := store.WithDurability(ctx, store.DurabilityNone)
+	if err := st.PutCtx(unlogged, "k1", "diverged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteCtx(unlogged, "k2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.PutCtx(unlogged, "k3", "resurrected"); err != nil {
+		t.Fatal(err)
+	}
+
+	drift.Sample(ctx)
+
+	status = drift.Status()
+	if !status.Suspected || status.Mismatches != 3 || status.LastError != "" {
+		t.Errorf("the status after sampling injected divergence: %+v", status)
+	}
+	for _, c := range []struct {
+		kind   string
+		before float64
+	}{{store.DivergenceDiffers, differs}, {store.DivergenceMissing, missing}, {store.DivergenceExtra, extra}} {
+		if n := mismatches(c.kind) - c.before; n != 1 {
+			t.Errorf("kv_drift_mismatches_total{kind=%s} rose by %v, want 1", c.kind, n)
+		}
+	}
+	if !readyz() {
+		t.Error("/readyz doesn't report the suspected drift")
+	}
+
+	w := serve(h, "GET", "/v1/stats", "", nil)
+	var stats struct {
+		Drift *store.DriftStatus `json:"drift"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Drift == nil || !stats.Drift.Suspected {
+		t.Errorf("/v1/stats with drift suspected: %s", w.Body.String())
+	}
+
+	// A check that only reports divergences leaves the suspicion; a repair
+	// clears it, and the store samples clean again
+	if w := serve(h, "GET", "/v1/admin/fsck", "", admin); w.Code != http.StatusOK || !drift.Status().Suspected {
+		t.Errorf("GET fsck: %d, suspected %v", w.Code, drift.Status().Suspected)
+	}
+	if w := serve(h, "POST", "/v1/admin/fsck", "", admin); w.Code != http.StatusOK || drift.Status().Suspected {
+		t.Errorf("POST fsck: %d, suspected %v", w.Code, drift.Status().Suspected)
+	}
+
+	drift.Sample(ctx)
+
+	if status := drift.Status(); status.Suspected || status.Mismatches != 0 {
+		t.Errorf("the status after a repair: %+v", status)
+	}
+	if readyz() {
+		t.Error("/readyz reports drift after a repair")
+	}
+}
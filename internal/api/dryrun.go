@@ -0,0 +1,62 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+)
+
+// DryRunHeader is set to true on the answer to a request made with the
+// dry-run=true query parameter, which changed nothing.
+const DryRunHeader = "X-KV-Dry-Run"
+
+// dryRunRoutes are the routes that take dry-run=true, by method and path
+// template, without the API version.
+var dryRunRoutes = map[string]bool{
+	"PUT /key/{key}":                        true,
+	"PATCH /key/{key}":                      true,
+	"DELETE /key/{key}":                     true,
+	"POST /key/{key}/cas":                   true,
+	"POST /key/{key}/incr":                  true,
+	"PUT /buckets/{bucket}/key/{key}":       true,
+	"PATCH /buckets/{bucket}/key/{key}":     true,
+	"DELETE /buckets/{bucket}/key/{key}":    true,
+	"POST /buckets/{bucket}/key/{key}/cas":  true,
+	"POST /buckets/{bucket}/key/{key}/incr": true,
+	"DELETE /keys":                          true,
+	"DELETE /buckets/{bucket}":              true,
+	"POST /admin/buckets/{bucket}/rename":   true,
+}
+
+// dryRun serves the requests made with the dry-run=true query parameter as
+// dry runs of their writes, as store.WithDryRun describes: they are
+// authenticated, validated and checked, and answered with the status and
+// body the request would get, but change nothing, which DryRunHeader
+// says. Routes that can't make a dry run refuse the parameter rather than
+// ignore it.
+//
+// The dry_run parameter of a delete by prefix is another thing: it reports
+// how many keys match, instead of the delete's answer.
+func (s *Server) dryRun(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("dry-run") != "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(DryRunHeader, "true")
+
+		tmpl := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ = route.GetPathTemplate()
+		}
+
+		if !dryRunRoutes[r.Method+" "+unversioned(tmpl)] {
+			s.writeError(w, fmt.Errorf("%w: dry-run isn't supported by %s %s", ErrorInvalidRequest, r.Method, r.URL.Path))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(store.WithDryRun(r.Context())))
+	})
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDryRunAnswersAsTheWriteWouldWithoutWriting(t *testing.T) {
+	cfg := Config{AdminKey: "secret", MaxValueSize: 64}
+
+	// Two servers are kept in the same state: each request is made as a
+	// dry run of the first, then for real on both
+	dryDir, realDir := t.TempDir(), t.TempDir()
+	dryStore, dry, closeDry := openRouter(t, dryDir, cfg)
+	defer closeDry()
+	_, real, closeReal := openRouter(t, realDir, cfg)
+	defer closeReal()
+
+	admin := make(http.Header)
+	admin.Set("X-API-Key", "secret")
+	mergePatch := make(http.Header)
+	mergePatch.Set("Content-Type", MergePatchType)
+	staleMatch := make(http.Header)
+	staleMatch.Set("If-Match", `"1-0"`)
+
+	for _, h := range []http.Handler{dry, real} {
+		for _, kv := range [][2]string{{"k", "v"}, {"doc", `{"a":1}`}, {"n", "41"}, {"p1", "x"}, {"p2", "y"}, {"text", "plain"}} {
+			if w := serve(h, "PUT", "/v1/key/"+kv[0], kv[1], nil); w.Code != http.StatusCreated {
+				t.Fatalf("PUT %s: %d", kv[0], w.Code)
+			}
+		}
+		if w := serve(h, "PUT", "/v1/buckets/b/key/k", "v", nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT b/k: %d", w.Code)
+		}
+	}
+
+	// state returns what the dry run's server holds, and the size of its
+	// log
+	logPath := filepath.Join(dryDir, translog.LogFileName)
+	state := func() string {
+		t.Helper()
+
+		if err := dryStore.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := dryStore.Dump()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fmt.Sprintf("%v at %d, %d bytes", records, dryStore.Sequence(), info.Size())
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		header             http.Header
+	}{
+		{"PUT", "/v1/key/k", "w", nil},
+		{"PUT", "/v1/key/new", "v", nil},
+		{"PUT", "/v1/key/k", strings.Repeat("x", 65), nil},
+		{"PUT", "/v1/key/k", "w", staleMatch},
+		{"PUT", "/v1/buckets/b/key/k", "w", nil},
+		{"PATCH", "/v1/key/doc", `{"b":2}`, mergePatch},
+		{"PATCH", "/v1/key/text", `{"b":2}`, mergePatch},
+		{"PATCH", "/v1/key/missing?create=true", `{"b":2}`, mergePatch},
+		{"DELETE", "/v1/key/k", "", nil},
+		{"DELETE", "/v1/key/missing", "", nil},
+		{"DELETE", "/v1/buckets/b/key/k", "", nil},
+		{"POST", "/v1/key/k/cas", `{"expected":"v","value":"w"}`, nil},
+		{"POST", "/v1/key/k/cas", `{"expected":"other","value":"w"}`, nil},
+		{"POST", "/v1/key/n/incr", `{"delta":1}`, nil},
+		{"POST", "/v1/key/text/incr", `{"delta":1}`, nil},
+		{"DELETE", "/v1/keys?prefix=p&confirm=true", "", nil},
+		{"DELETE", "/v1/keys?prefix=p", "", nil},
+		{"DELETE", "/v1/buckets/b", "", admin},
+		{"DELETE", "/v1/buckets/b", "", nil},
+		{"POST", "/v1/admin/buckets/b/rename", `{"name":"c"}`, admin},
+	} {
+		name := tt.method + " " + tt.path
+
+		before := state()
+
+		sep := "?"
+		if strings.Contains(tt.path, "?") {
+			sep = "&"
+		}
+		dw := serve(dry, tt.method, tt.path+sep+"dry-run=true", tt.body, tt.header)
+
+		if after := state(); after != before {
+			t.Errorf("%s: the dry run changed the store or its log:\n%s\nto\n%s", name, before, after)
+		}
+		if dw.Header().Get(DryRunHeader) != "true" {
+			t.Errorf("%s: the dry run's answer doesn't carry %s", name, DryRunHeader)
+		}
+		if dw.Header().Get(SequenceHeader) != "" {
+			t.Errorf("%s: the dry run reports sequence %s", name, dw.Header().Get(SequenceHeader))
+		}
+
+		rw := serve(real, tt.method, tt.path, tt.body, tt.header)
+		if rw.Header().Get(DryRunHeader) != "" {
+			t.Errorf("%s: a real write's answer carries %s", name, DryRunHeader)
+		}
+
+		// The same status and body, and headers, save for what says it was
+		// a dry run, and what was logged
+		if dw.Code != rw.Code || dw.Body.String() != rw.Body.String() {
+			t.Errorf("%s: the dry run got %d %q, the write %d %q", name, dw.Code, dw.Body.String(), rw.Code, rw.Body.String())
+		}
+
+		headers := func(h http.Header) []string {
+			var names []string
+			for name := range h {
+				if name != http.CanonicalHeaderKey(DryRunHeader) && name != http.CanonicalHeaderKey(SequenceHeader) {
+					names = append(names, name)
+				}
+			}
+			slices.Sort(names)
+
+			return names
+		}
+		if d, r := headers(dw.Header()), headers(rw.Header()); !slices.Equal(d, r) {
+			t.Errorf("%s: the dry run's answer has the headers %v, the write's %v", name, d, r)
+		}
+
+		// The dry run's server catches up
+		if w := serve(dry, tt.method, tt.path, tt.body, tt.header); w.Code != rw.Code {
+			t.Fatalf("%s: %d on the dry run's server, %d on the other", name, w.Code, rw.Code)
+		}
+	}
+
+	// Routes that can't make a dry run refuse it rather than write
+	before := state()
+	body := `{"then":[{"type":"put","key":"k","value":"txn"}]}`
+	if w := serve(dry, "POST", TxnPath+"?dry-run=true", body, nil); w.Code != http.StatusBadRequest || w.Header().Get(DryRunHeader) != "true" {
+		t.Errorf("POST %s?dry-run=true: %d %s", TxnPath, w.Code, w.Body.String())
+	}
+	if after := state(); after != before {
+		t.Errorf("a refused dry run changed the store or its log:\n%s\nto\n%s", before, after)
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DurabilityHeader lets a PUT or DELETE of a key choose how durable it is
+// once acknowledged: none, enqueue or flush, as store.Durability describes.
+// A flush is waited for once the write is applied, for at most the
+// policy's FlushTimeout; if it doesn't complete in time, the response is
+// 504 with the code not_durable: the write stays applied, is visible to
+// readers, and becomes durable once the logger gets to it, unless the
+// process crashes first, as any write not yet flushed would be lost. A
+// client that must know can repeat the write, which for a put of the same
+// value or a delete changes nothing but its durability.
+const DurabilityHeader = "X-KV-Durability"
+
+// DefaultFlushTimeout is how long a write under the flush durability waits
+// for it by default.
+const DefaultFlushTimeout = 5 * time.Second
+
+// ErrorDurabilityNotAllowed is reported for writes asking for a higher
+// durability than their API key may.
+var ErrorDurabilityNotAllowed = errors.New("durability not allowed")
+
+// DurabilityPolicy sets the durability of the writes that don't ask for
+// one, and the highest one writes may ask for.
+type DurabilityPolicy struct {
+	Default      store.Durability            // Of writes without DurabilityHeader, if Max allows it; zero is enqueue
+	Max          store.Durability            // Highest a write may ask for; zero allows flush
+	Keys         map[string]store.Durability // Highest by API key, in X-API-Key, overriding Max
+	FlushTimeout time.Duration               // Longest wait for a flush; DefaultFlushTimeout if 0
+}
+
+// LoadDurabilityKeys reads the highest durability of each API key from the
+// JSON object at path, such as {"telemetry-key": "enqueue"}.
+func LoadDurabilityKeys(path string) (map[string]store.Durability, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]store.Durability
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return keys, nil
+}
+
+// requestDurability returns the durability r asks for, or the default,
+// lowered to the highest its API key allows. A level above that is refused
+// with ErrorDurabilityNotAllowed. In a cluster, none is taken as enqueue:
+// every write goes through the Raft log, or the nodes would diverge.
+func (s *Server) requestDurability(r *http.Request) (store.Durability, error) {
+	d, err := s.askedDurability(r)
+	if s.cluster != nil && err == nil {
+		d = max(d, store.DurabilityEnqueue)
+	}
+
+	return d, err
+}
+
+// askedDurability is requestDurability, outside a cluster.
+func (s *Server) askedDurability(r *http.Request) (store.Durability, error) {
+	p := s.durability
+
+	highest := cmp.Or(p.Max, store.DurabilityFlush)
+	if d, ok := p.Keys[r.Header.Get("X-API-Key")]; ok {
+		highest = d
+	}
+
+	v := r.Header.Get(DurabilityHeader)
+	if v == "" {
+		return min(cmp.Or(p.Default, store.DurabilityEnqueue), highest), nil
+	}
+
+	d, err := store.ParseDurability(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrorInvalidRequest, err)
+	}
+
+	if d > highest {
+		return 0, fmt.Errorf("%w: %s is above %s", ErrorDurabilityNotAllowed, d, highest)
+	}
+
+	return d, nil
+}
+
+// awaitDurability waits for the write just applied under d to be durable,
+// if d is flush, for at most the policy's FlushTimeout.
+func (s *Server) awaitDurability(ctx context.Context, d store.Durability) error {
+	if d != store.DurabilityFlush {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(s.durability.FlushTimeout, DefaultFlushTimeout))
+	defer cancel()
+
+	return s.store.Flush(ctx)
+}
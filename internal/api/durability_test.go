@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowSyncLogger is a transaction logger whose flushes take at least delay,
+// as they would on a disk slow to fsync.
+type slowSyncLogger struct {
+	translog.TransactionLogger
+	delay atomic.Int64 // Nanoseconds
+}
+
+func (l *slowSyncLogger) Flush(ctx context.Context) error {
+	time.Sleep(time.Duration(l.delay.Load()))
+	return l.TransactionLogger.Flush(ctx)
+}
+
+func TestDurabilityLevels(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, translog.LogFileName)
+
+	file, err := translog.NewFileTransactionLogger(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &slowSyncLogger{TransactionLogger: file}
+
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		l.delay.Store(0)
+		if err := l.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	h := NewRouter(NewServer(st, Config{Durability: DurabilityPolicy{FlushTimeout: 300 * time.Millisecond}}))
+
+	// logged returns the keys of the events in the log file, as written so
+	// far, without waiting for the logger
+	logged := func() []string {
+		t.Helper()
+
+		var keys []string
+		if err := translog.ScanLog(path, func(e translog.Event) error {
+			keys = append(keys, e.Key)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	// write makes a write with the given durability, returning how long it
+	// took. It goes through /v2, whose errors carry their code
+	write := func(method, key, durability string) (*http.Response, time.Duration) {
+		t.Helper()
+
+		header := make(http.Header)
+		header.Set(DurabilityHeader, durability)
+
+		start := time.Now()
+		w := serve(h, method, "/v2/key/"+key, "v", header)
+		return w.Result(), time.Since(start)
+	}
+
+	l.delay.Store(int64(100 * time.Millisecond))
+
+	// none applies the write to memory only, and logs nothing, ever
+	if resp, _ := write("PUT", "none", "none"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("PUT none: %d", resp.StatusCode)
+	}
+	if v, err := st.Get("none"); err != nil || v != "v" {
+		t.Errorf("GET none: %q, %v", v, err)
+	}
+
+	// enqueue answers without waiting for the flush
+	if resp, took := write("PUT", "enqueue", "enqueue"); resp.StatusCode != http.StatusCreated || took >= 100*time.Millisecond {
+		t.Errorf("PUT enqueue: %d after %s", resp.StatusCode, took)
+	}
+
+	// flush answers once the write, and every one before it, is in the log
+	resp, took := write("PUT", "flush", "flush")
+	if resp.StatusCode != http.StatusCreated || took < 100*time.Millisecond {
+		t.Errorf("PUT flush: %d after %s", resp.StatusCode, took)
+	}
+	if keys := logged(); len(keys) != 2 || keys[0] != "enqueue" || keys[1] != "flush" {
+		t.Errorf("the keys logged once the flush answered: %q", keys)
+	}
+
+	// A delete too
+	if resp, _ := write("DELETE", "enqueue", "flush"); resp.StatusCode != http.StatusOK {
+		t.Errorf("DELETE enqueue: %d", resp.StatusCode)
+	}
+	if keys := logged(); len(keys) != 3 || keys[2] != "enqueue" {
+		t.Errorf("the keys logged once the delete answered: %q", keys)
+	}
+
+	// A flush slower than the timeout is 504, with the write applied, and
+	// durable once the logger gets to it
+	l.delay.Store(int64(time.Second))
+
+	resp, took = write("PUT", "slow", "flush")
+	if resp.StatusCode != http.StatusGatewayTimeout || took >= time.Second {
+		t.Errorf("PUT slow, timing out: %d after %s", resp.StatusCode, took)
+	}
+
+	var body errorBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code != "not_durable" {
+		t.Errorf("PUT slow, timing out: %+v, %v", body, err)
+	}
+	if v, err := st.Get("slow"); err != nil || v != "v" {
+		t.Errorf("GET slow after its flush timed out: %q, %v", v, err)
+	}
+
+	if err := st.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := logged(); len(keys) != 4 || keys[3] != "slow" {
+		t.Errorf("the keys logged after the timed out flush: %q", keys)
+	}
+}
+
+func TestDurabilityPolicy(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{Durability: DurabilityPolicy{
+		Default: store.DurabilityFlush,
+		Max:     store.DurabilityEnqueue,
+		Keys:    map[string]store.Durability{"payments": store.DurabilityFlush, "telemetry": store.DurabilityNone},
+	}})
+	defer closeLog()
+
+	for _, tt := range []struct {
+		apiKey, durability string
+		code               int
+	}{
+		// The default is lowered to the highest allowed
+		{"", "", http.StatusCreated},
+		{"", "none", http.StatusCreated},
+		{"", "enqueue", http.StatusCreated},
+		{"", "flush", http.StatusForbidden},
+		{"payments", "flush", http.StatusCreated},
+		{"telemetry", "", http.StatusCreated},
+		{"telemetry", "enqueue", http.StatusForbidden},
+		{"", "fsync", http.StatusBadRequest},
+	} {
+		header := make(http.Header)
+		if tt.apiKey != "" {
+			header.Set("X-API-Key", tt.apiKey)
+		}
+		if tt.durability != "" {
+			header.Set(DurabilityHeader, tt.durability)
+		}
+
+		if w := serve(h, "PUT", "/v1/key/k", "v", header); w.Code != tt.code && !(tt.code == http.StatusCreated && w.Code == http.StatusNoContent) {
+			t.Errorf("PUT with key %q and durability %q: %d %s, want %d", tt.apiKey, tt.durability, w.Code, w.Body.String(), tt.code)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+)
+
+// valueEncodingBase64 is the encoding of a value in a JSON body that is
+// base64-encoded. JSON strings can only hold text, so a value that isn't,
+// as translog.IsText decides, is sent and received that way: a response
+// gives it with "encoding": "base64" next to it, and a request may do the
+// same for the values it writes. Values without an encoding are text.
+const valueEncodingBase64 = "base64"
+
+// jsonValue returns value as a JSON body holds it, with its encoding: as
+// it is if it's text, and base64-encoded otherwise.
+func jsonValue(value string) (string, string) {
+	if translog.IsText(value) {
+		return value, ""
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(value)), valueEncodingBase64
+}
+
+// decodeJSONValue decodes a value of a request body in place, given its
+// encoding, empty for text. A nil value is left as it is.
+func decodeJSONValue(value *string, encoding string) error {
+	switch {
+	case encoding == "" || value == nil:
+		return nil
+	case encoding != valueEncodingBase64:
+		return fmt.Errorf("%w: unknown value encoding %q", ErrorInvalidRequest, encoding)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(*value)
+	if err != nil {
+		return fmt.Errorf("%w: value is not valid base64", ErrorInvalidRequest)
+	}
+	*value = string(b)
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestBinaryValuesInJSONBodies(t *testing.T) {
+	const (
+		binary  = "\x00\xff\xfe"
+		encoded = "AP/+"
+	)
+
+	_, l, h, closeLog := openLogRouter(t, t.TempDir(), Config{AdminKey: "secret"})
+	defer closeLog()
+
+	admin := http.Header{"X-Api-Key": {"secret"}}
+
+	for key, value := range map[string]string{"bin": binary, "text": "plain ☃"} {
+		if w := serve(h, "PUT", "/v1/key/"+key, value, http.Header{"Content-Type": {"application/octet-stream"}}); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d %s", key, w.Code, w.Body)
+		}
+	}
+
+	if err := l.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// value is a value of a response body, with its encoding
+	type value struct {
+		Type     string  `json:"type"` // Of changes
+		Key      string  `json:"key"`
+		Value    *string `json:"value"`
+		Encoding string  `json:"encoding"`
+	}
+
+	// check checks that the values of a response hold the binary value
+	// base64-encoded, and the text one as it is
+	check := func(t *testing.T, what string, values []value) {
+		t.Helper()
+
+		got := make(map[string]value)
+		for _, v := range values {
+			if v.Value != nil && (v.Type == "" || v.Type == "put") {
+				got[v.Key] = v
+			}
+		}
+
+		if v := got["bin"]; v.Value == nil || *v.Value != encoded || v.Encoding != "base64" {
+			t.Errorf("%s: bin given as %+v, want %q base64-encoded", what, v, encoded)
+		}
+		if v := got["text"]; v.Value == nil || *v.Value != "plain ☃" || v.Encoding != "" {
+			t.Errorf("%s: text given as %+v, want it as it is", what, v)
+		}
+	}
+
+	responses := []struct {
+		name, method, path, body string
+		header                   http.Header
+		field                    string
+	}{
+		{"bulk", "POST", "/v1/keys", `{"get": ["bin", "text"]}`, nil, "results"},
+		{"txn", "POST", TxnPath, `{"then": [{"op": "get", "key": "bin"}, {"op": "get", "key": "text"}]}`, nil, "results"},
+		{"snapshot read", "POST", SnapshotReadPath, `{"keys": ["bin", "text"]}`, nil, "values"},
+		{"changes", "GET", ChangesPath, "", admin, "changes"},
+	}
+
+	for _, r := range responses {
+		t.Run(r.name, func(t *testing.T) {
+			w := serve(h, r.method, r.path, r.body, r.header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%d %s", w.Code, w.Body)
+			}
+
+			var body map[string]json.RawMessage
+			var values []value
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(body[r.field], &values); err != nil {
+				t.Fatal(err)
+			}
+			check(t, r.name, values)
+		})
+	}
+
+	// Values written base64-encoded are stored decoded
+	writes := []struct {
+		name, path, body, key string
+	}{
+		{"bulk", "/v1/keys", `{"put": {"bulk": "AP/+"}, "encoding": "base64"}`, "bulk"},
+		{"txn", TxnPath, `{"if": [{"key": "bin", "target": "value", "value": "AP/+", "encoding": "base64"}],
+			"then": [{"op": "put", "key": "txn", "value": "AP/+", "encoding": "base64"}]}`, "txn"},
+		{"cas", "/v1/key/bin/cas", `{"expected": "AP/+", "value": "AP/+AA==", "encoding": "base64"}`, "bin"},
+	}
+
+	want := map[string]string{"bulk": binary, "txn": binary, "bin": binary + "\x00"}
+
+	for _, wr := range writes {
+		t.Run(wr.name+" write", func(t *testing.T) {
+			w := serve(h, "POST", wr.path, wr.body, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%d %s", w.Code, w.Body)
+			}
+
+			var resp struct {
+				Succeeded *bool `json:"succeeded"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Succeeded != nil && !*resp.Succeeded {
+				t.Fatalf("condition on the decoded value failed: %s", w.Body)
+			}
+
+			if w := serve(h, "GET", "/v1/key/"+wr.key, "", nil); w.Code != http.StatusOK || w.Body.String() != want[wr.key] {
+				t.Errorf("GET %s: %d %q, want %q", wr.key, w.Code, w.Body, want[wr.key])
+			}
+		})
+	}
+
+	for _, body := range []string{
+		`{"put": {"k": "not base64!"}, "encoding": "base64"}`,
+		`{"put": {"k": "AP/+"}, "encoding": "hex"}`,
+	} {
+		if w := serve(h, "POST", "/v1/keys", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s, want 400", body, w.Code, w.Body)
+		}
+	}
+}
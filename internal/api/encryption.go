@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// reencryptHandler re-encrypts every value not encrypted with the current
+// data key, after rotating to a new data key if the rotate query parameter
+// is true, and responds with the current key and the number of values
+// rewritten.
+func (s *Server) reencryptHandler(w http.ResponseWriter, r *http.Request) {
+	if s.keyring == nil {
+		s.writeError(w, fmt.Errorf("%w: encryption is not configured", ErrorNotSupported))
+		return
+	}
+
+	var report struct {
+		Rotated     string `json:"rotated,omitempty"` // ID of the new data key
+		Reencrypted int    `json:"reencrypted"`
+	}
+
+	if r.URL.Query().Get("rotate") == "true" {
+		id, err := s.keyring.Rotate()
+		if err != nil {
+			s.writeError(w, fmt.Errorf("failed to rotate the data key: %w", err))
+			return
+		}
+
+		report.Rotated = id
+
+		log.Printf("REENCRYPT rotated to data key %s\n", id)
+	}
+
+	n, err := s.store.Reencrypt(r.Context())
+	report.Reencrypted = n
+	if err != nil {
+		log.Printf("REENCRYPT stopped after %d values: %v\n", n, err)
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+
+	log.Printf("REENCRYPT values=%d\n", n)
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/sheritzs/key-value-store/internal/crypt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openCipherRouter is like openRouter, but the store encrypts values with
+// kr, unless it's nil.
+func openCipherRouter(t *testing.T, dir string, kr *crypt.Keyring) (*store.Store, http.Handler, func()) {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := store.Options{}
+	if kr != nil {
+		opts.Cipher = kr
+	}
+
+	st := store.New(l, opts)
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return st, NewRouter(NewServer(st, Config{AdminKey: "secret", Keyring: kr})), func() {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	dir := t.TempDir()
+	admin := http.Header{"X-Api-Key": {"secret"}}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	mk, err := crypt.ParseMasterKey(base64.StdEncoding.EncodeToString(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{"clear": "stored before encryption", "first": "under the first key", "second": "under the second key"}
+
+	// reencrypt runs the job, returning what it reports
+	reencrypt := func(t *testing.T, h http.Handler, query string) (report struct {
+		Rotated     string `json:"rotated"`
+		Reencrypted int    `json:"reencrypted"`
+	}) {
+		t.Helper()
+
+		w := serve(h, "POST", "/v1/admin/reencrypt"+query, "", admin)
+		if w.Code != http.StatusOK {
+			t.Fatalf("reencrypt%s: %d %s", query, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	// A store without encryption can't run the job
+	_, h, closeLog := openCipherRouter(t, dir, nil)
+	if w := serve(h, "PUT", "/v1/key/clear", values["clear"], nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "POST", "/v1/admin/reencrypt", "", admin); w.Code != http.StatusNotImplemented {
+		t.Errorf("reencrypt without encryption: %d %s, want 501", w.Code, w.Body)
+	}
+	closeLog()
+
+	kr, err := crypt.OpenKeyring(filepath.Join(dir, crypt.KeyringFileName), mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, h, closeLog := openCipherRouter(t, dir, kr)
+
+	if w := serve(h, "PUT", "/v1/key/first", values["first"], nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if _, err := kr.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(h, "PUT", "/v1/key/second", values["second"], nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	// The job rewrites the value in the clear and that of the old key
+	if r := reencrypt(t, h, ""); r.Rotated != "" || r.Reencrypted != 2 {
+		t.Errorf("reencrypt: %+v, want 2 values rewritten", r)
+	}
+	if r := reencrypt(t, h, ""); r.Reencrypted != 0 {
+		t.Errorf("reencrypt again: %+v, want nothing rewritten", r)
+	}
+
+	// Rotating first rewrites them all
+	r := reencrypt(t, h, "?rotate=true")
+	if r.Rotated == "" || r.Reencrypted != len(values) {
+		t.Errorf("reencrypt after a rotation: %+v, want all %d values rewritten", r, len(values))
+	}
+
+	// check checks that st holds values, each stored encrypted with the
+	// current key
+	check := func(t *testing.T, st *store.Store, h http.Handler, when string) {
+		t.Helper()
+
+		for key, value := range values {
+			if w := serve(h, "GET", "/v1/key/"+key, "", nil); w.Code != http.StatusOK || w.Body.String() != value {
+				t.Errorf("%s: GET %s: %d %q, want %q", when, key, w.Code, w.Body, value)
+			}
+		}
+
+		records, err := st.DumpStored()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range records {
+			if !rec.Codec.IsEncrypted() || !kr.Current(string(rec.Value)) {
+				t.Errorf("%s: %s stored with codec %s, not under the current key", when, rec.Key, rec.Codec)
+			}
+		}
+	}
+
+	check(t, st, h, "after the job")
+	closeLog()
+
+	// The rewrites are logged, so they are replayed
+	kr, err = crypt.OpenKeyring(filepath.Join(dir, crypt.KeyringFileName), mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, h, closeLog = openCipherRouter(t, dir, kr)
+	defer closeLog()
+
+	check(t, st, h, "after a restart")
+}
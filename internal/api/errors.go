@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sheritzs/key-value-store/internal/cluster"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ErrorRateLimited is reported for requests over the limits on concurrent
+// requests, with a Retry-After hint.
+var ErrorRateLimited = errors.New("too many concurrent requests")
+
+// ErrorValueTooLarge is reported for request bodies over their size limit.
+var ErrorValueTooLarge = errors.New("request body too large")
+
+// ErrorInvalidRequest is reported for query parameters and request bodies
+// that can't be parsed.
+var ErrorInvalidRequest = errors.New("invalid request")
+
+// ErrorUnauthenticated is reported for leases requested anonymously, which
+// no owner could be told apart from.
+var ErrorUnauthenticated = errors.New("request has no authenticated principal")
+
+// ErrorForbidden is reported for requests refused by the IP filter, the
+// Authorize hook or the admin scope check. Its message is the body /v1
+// always answered them with.
+var ErrorForbidden = errors.New("Forbidden")
+
+// ErrorAdminDisabled is reported for admin requests while no admin key is
+// configured.
+var ErrorAdminDisabled = errors.New("admin API disabled")
+
+// ErrorMethodNotAllowed is reported for methods a resource doesn't take.
+// Its message is the body /v1 always answered them with.
+var ErrorMethodNotAllowed = errors.New("Not Allowed")
+
+// ErrorNotSupported is reported for endpoints the instance isn't configured
+// to serve, such as those needing a transaction log it doesn't have.
+var ErrorNotSupported = errors.New("not supported")
+
+// errorCode is how an error is reported to clients: the status of the
+// response, and the code in its body, which is stable across releases so
+// clients can tell errors apart without matching messages.
+type errorCode struct {
+	err    error
+	status int
+	code   string
+}
+
+// errorCodes lists every error clients can tell apart. Each must be listed
+// once, with its own code; the first one an error wraps is reported. Any
+// other error is internal, and answered with 500 and internalErrorCode
+// only, its details going to the log.
+var errorCodes = []errorCode{
+	{store.ErrorNoSuchKey, http.StatusNotFound, "no_such_key"},
+	{store.ErrorInvalidKey, http.StatusBadRequest, "invalid_key"},
+	{store.ErrorInvalidBucket, http.StatusBadRequest, "invalid_bucket"},
+	{store.ErrorNoSuchBucket, http.StatusNotFound, "no_such_bucket"},
+	{store.ErrorBucketExists, http.StatusConflict, "bucket_exists"},
+	{store.ErrorNotNumeric, http.StatusUnprocessableEntity, "not_numeric"},
+	{store.ErrorCASMismatch, http.StatusConflict, "cas_mismatch"},
+	{ErrorNotJSON, http.StatusConflict, "not_json"},
+	{ErrorPreconditionFailed, http.StatusPreconditionFailed, "precondition_failed"},
+	{ErrorUnsupportedMediaType, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+	{store.ErrorRejected, http.StatusUnprocessableEntity, "write_rejected"},
+	{store.ErrorHookTimeout, http.StatusServiceUnavailable, "hook_timeout"},
+	{cluster.ErrorNotLeader, http.StatusServiceUnavailable, "not_leader"},
+	{cluster.ErrorNoLeader, http.StatusServiceUnavailable, "no_leader"},
+	{store.ErrorReadOnly, http.StatusServiceUnavailable, "read_only"},
+	{store.ErrorOverQuota, http.StatusInsufficientStorage, "over_quota"},
+	{store.ErrorLeased, http.StatusConflict, "leased"},
+	{store.ErrorImmutable, http.StatusConflict, "immutable"},
+	{store.ErrorInvalidLease, http.StatusBadRequest, "invalid_lease"},
+	{store.ErrorTooManyKeys, http.StatusBadRequest, "too_many_keys"},
+	{store.ErrorInvalidTxn, http.StatusBadRequest, "invalid_txn"},
+	{store.ErrorInvalidContentType, http.StatusBadRequest, "invalid_content_type"},
+	{translog.ErrorCompacted, http.StatusGone, "compacted"},
+	{ErrorUnauthenticated, http.StatusUnauthorized, "unauthenticated"},
+	{ErrorForbidden, http.StatusForbidden, "forbidden"},
+	{ErrorAdminDisabled, http.StatusForbidden, "admin_disabled"},
+	{ErrorMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed"},
+	{ErrorNotSupported, http.StatusNotImplemented, "not_supported"},
+	{ErrorNoSuchEvent, http.StatusNotFound, "no_such_event"},
+	{ErrorNotStandby, http.StatusConflict, "not_standby"},
+	{ErrorBehind, http.StatusServiceUnavailable, "behind"},
+	{ErrorInvalidRequest, http.StatusBadRequest, "invalid_request"},
+	{ErrorValueTooLarge, http.StatusRequestEntityTooLarge, "value_too_large"},
+	{ErrorRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{translog.ErrorUnhealthy, http.StatusServiceUnavailable, "logger_unavailable"},
+	{translog.ErrorClosed, http.StatusServiceUnavailable, "logger_closed"},
+	{ErrorDurabilityNotAllowed, http.StatusForbidden, "durability_not_allowed"},
+	{ErrorForceNotAllowed, http.StatusForbidden, "force_not_allowed"},
+	// Listed before the context errors it wraps: the write was applied
+	{store.ErrorNotDurable, http.StatusGatewayTimeout, "not_durable"},
+	// The request's own deadline passed, before any change was made
+	{store.ErrorDeadline, http.StatusGatewayTimeout, "deadline_exceeded"},
+	// A request whose context ended before the write could be logged
+	// made no changes, so the client is told to retry
+	{context.DeadlineExceeded, http.StatusServiceUnavailable, "timeout"},
+	{context.Canceled, http.StatusServiceUnavailable, "canceled"},
+}
+
+// internalErrorCode is the code of the errors errorCodes doesn't list.
+const internalErrorCode = "internal"
+
+// errorBody is the JSON body of an error response.
+type errorBody struct {
+	Error  string `json:"error"`
+	Code   string `json:"code"`
+	Reason string `json:"reason,omitempty"` // Why writes are disabled, for read_only
+	Phase  string `json:"phase,omitempty"`  // Where the request's deadline passed, for deadline_exceeded and not_durable
+
+	EarliestSequence uint64 `json:"earliest_sequence,omitempty"` // First sequence the log holds, for compacted
+}
+
+// lookupError returns how err is reported, and false if it is internal.
+func lookupError(err error) (errorCode, bool) {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c, true
+		}
+	}
+
+	return errorCode{status: http.StatusInternalServerError, code: internalErrorCode}, false
+}
+
+// writeError reports err to the client, as a JSON body with its message and
+// code, the phase a deadline passed in, and the earliest sequence of a
+// compacted log. Writes rejected by maintenance mode get the reason and a
+// Retry-After hint too, as do rate limited requests.
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	c, known := lookupError(err)
+
+	body := errorBody{Error: err.Error(), Code: c.code}
+
+	var de *store.DeadlineError
+	if errors.As(err, &de) {
+		body.Phase = de.Phase
+	}
+
+	var ce *translog.CompactedError
+	if errors.As(err, &ce) {
+		body.EarliestSequence = ce.Earliest
+	}
+
+	switch {
+	case !known:
+		log.Printf("ERROR %v\n", err)
+		body.Error = "internal error"
+	case c.err == store.ErrorReadOnly:
+		body.Error = "maintenance mode: writes are disabled"
+		body.Reason = s.currentMaintenance().Reason
+		w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	case c.err == ErrorRateLimited:
+		w.Header().Set("Retry-After", strconv.Itoa(1))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(c.status)
+
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorCodesAreUnique(t *testing.T) {
+	codes := make(map[string]bool)
+
+	for _, c := range errorCodes {
+		if codes[c.code] {
+			t.Errorf("code %q is listed twice", c.code)
+		}
+		codes[c.code] = true
+
+		if got, _ := lookupError(fmt.Errorf("wrapped: %w", c.err)); got.err != c.err {
+			t.Errorf("%v is reported as %q, want %q", c.err, got.code, c.code)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err        error
+		status     int
+		code       string
+		retryAfter bool
+	}{
+		{ErrorRateLimited, http.StatusTooManyRequests, "rate_limited", true},
+		{fmt.Errorf("bad: %w", ErrorInvalidRequest), http.StatusBadRequest, "invalid_request", false},
+		{errors.New("disk on fire at /var/lib/kv"), http.StatusInternalServerError, internalErrorCode, false},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		(&Server{}).writeError(w, tt.err)
+
+		if w.Code != tt.status {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.status)
+		}
+
+		if got := w.Header().Get("Retry-After") != ""; got != tt.retryAfter {
+			t.Errorf("%v: Retry-After set %t, want %t", tt.err, got, tt.retryAfter)
+		}
+
+		var body errorBody
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%v: decoding body: %v", tt.err, err)
+		}
+
+		if body.Code != tt.code {
+			t.Errorf("%v: code %q, want %q", tt.err, body.Code, tt.code)
+		}
+
+		if tt.code == internalErrorCode && body.Error != "internal error" {
+			t.Errorf("internal error leaked as %q", body.Error)
+		}
+	}
+}
+
+func TestHandlersAnswerWithCodes(t *testing.T) {
+	st := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	h := NewRouter(NewServer(st, Config{
+		AdminKey: "secret",
+		V1Compat: V1CompatModern,
+		Authorize: func(r *http.Request) error {
+			if r.URL.Query().Get("deny") != "" {
+				return errors.New("denied by policy")
+			}
+			return nil
+		},
+	}))
+	disabled := NewRouter(NewServer(st, Config{V1Compat: V1CompatModern}))
+	admin := http.Header{"X-Api-Key": {"secret"}}
+
+	minSequence := func(v string) http.Header {
+		h := make(http.Header)
+		h.Set(MinSequenceHeader, v)
+		return h
+	}
+
+	tests := []struct {
+		h       http.Handler
+		method  string
+		path    string
+		body    string
+		header  http.Header
+		status  int
+		code    string
+		message string
+	}{
+		{h, "POST", "/v2/key/k", "v", nil, http.StatusMethodNotAllowed, "method_not_allowed", "Not Allowed"},
+		{h, "GET", "/v2/key/k", "", minSequence("x"), http.StatusBadRequest, "invalid_request", "X-KV-Min-Sequence"},
+		{h, "GET", "/v2/key/k", "", minSequence("5"), http.StatusServiceUnavailable, "behind", "applied sequence 0 is behind 5"},
+		{h, "GET", "/v2/key/k?deny=1", "", nil, http.StatusForbidden, "forbidden", "denied by policy"},
+		{h, "GET", "/v1/export", "", nil, http.StatusForbidden, "forbidden", "Forbidden"},
+		{disabled, "GET", "/v1/export", "", admin, http.StatusForbidden, "admin_disabled", "admin API disabled"},
+		{h, "GET", "/v1/admin/diag?events=x", "", admin, http.StatusBadRequest, "invalid_request", "events must be"},
+		{h, "POST", "/v1/admin/maintenance", "{", admin, http.StatusBadRequest, "invalid_request", "invalid maintenance request"},
+		{h, "POST", "/v1/admin/reencrypt", "", admin, http.StatusNotImplemented, "not_supported", "encryption is not configured"},
+		{h, "GET", "/v1/admin/fsck", "", admin, http.StatusNotImplemented, "not_supported", "file transaction log"},
+		{h, "GET", replication.EventsPath, "", admin, http.StatusNotImplemented, "not_supported", "can't be replicated"},
+		{h, "POST", replication.RestoreSnapshotPath, "", admin, http.StatusConflict, "not_standby", "read-only standby"},
+	}
+
+	for _, tt := range tests {
+		w := serve(tt.h, tt.method, tt.path, tt.body, tt.header)
+
+		var body errorBody
+		err := json.NewDecoder(w.Body).Decode(&body)
+		if w.Code != tt.status || w.Header().Get("Content-Type") != "application/json" || err != nil {
+			t.Errorf("%s %s: %d %s, %v; want %d and a JSON body", tt.method, tt.path, w.Code, w.Header().Get("Content-Type"), err, tt.status)
+			continue
+		}
+		if body.Code != tt.code || !strings.Contains(body.Error, tt.message) {
+			t.Errorf("%s %s: %+v, want code %s and an error with %q", tt.method, tt.path, body, tt.code, tt.message)
+		}
+	}
+
+	// Strict /v1 clients still get the plain text they always did
+	strict := NewRouter(NewServer(st, Config{AdminKey: "secret"}))
+	if w := serve(strict, "POST", "/v1/key/k", "v", nil); w.Code != http.StatusMethodNotAllowed || w.Body.String() != "Not Allowed\n" {
+		t.Errorf("POST /v1/key/k in strict mode: %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/resp"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+)
+
+// keysHandler lists the keys of the bucket named by the bucket query
+// parameter, or the default bucket, that start with the prefix query
+// parameter, as an array in lexical order. With any of the sort, order,
+// limit, cursor or meta parameters, they're listed by listKeysHandler
+// instead. Listings are answered from the scan cache, if the server has
+// one, until the store changes.
+func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := store.DefaultBucket
+	if b := r.URL.Query().Get("bucket"); b != "" {
+		if err := store.ValidateBucket(b); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		bucket = b
+	}
+
+	if pagedListing(r.URL.Query()) {
+		s.listKeysHandler(w, r, bucket, r.URL.Query().Get("prefix"))
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+
+	s.serveScan(w, scanKey("keys", bucket, prefix), "application/json", func() ([]byte, error) {
+		keys, err := s.store.BucketKeys(r.Context(), bucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+
+		return encodeJSONLine(keys)
+	})
+}
+
+// encodeJSONLine returns v encoded as JSON and followed by a newline, as a
+// json.Encoder writes it.
+func encodeJSONLine(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
+
+// exportHandler writes every key in the store as JSON lines of the form
+// {"bucket":"default","key":"k","value":"v"}. If the raw query parameter is
+// true, values are exported as stored instead, base64-encoded with their
+// codec, so that encrypted values stay encrypted. If the format query
+// parameter is resp, it writes a Redis mass-insert file instead, as
+// writeRESP does.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	var n int
+	var err error
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "jsonl":
+	case "resp":
+		s.exportRESP(w, r)
+		return
+	default:
+		s.writeError(w, fmt.Errorf("%w: unknown export format %q", ErrorInvalidRequest, format))
+		return
+	}
+
+	if r.URL.Query().Get("raw") == "true" {
+		n, err = writeRecords(w, s.store.DumpStored)
+	} else {
+		n, err = writeRecords(w, s.store.Dump)
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	log.Printf("EXPORT keys=%d\n", n)
+}
+
+// writeRecords writes the records returned by dump as JSON lines, and
+// returns how many there were. An error from dump is returned before
+// anything is written.
+func writeRecords[T any](w http.ResponseWriter, dump func() ([]T, error)) (int, error) {
+	records, err := dump()
+	if err != nil {
+		return 0, err
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			break // The client has gone away
+		}
+	}
+
+	return len(records), nil
+}
+
+// exportRESP writes the keys of the bucket named by the bucket query
+// parameter, or the default bucket, as a stream of Redis SET commands in
+// RESP, which "redis-cli --pipe" loads into Redis, and "kvstore -seed
+// -seed-format=resp" into another instance. Redis has no buckets, so only
+// one is exported at a time.
+func (s *Server) exportRESP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("raw") == "true" {
+		s.writeError(w, fmt.Errorf("%w: raw exports are JSON lines only", ErrorInvalidRequest))
+		return
+	}
+
+	bucket := store.DefaultBucket
+	if b := r.URL.Query().Get("bucket"); b != "" {
+		if err := store.ValidateBucket(b); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		bucket = b
+	}
+
+	records, err := s.store.Dump()
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	bw := bufio.NewWriter(w)
+	n := 0
+
+	for _, rec := range records {
+		if rec.Bucket != bucket {
+			continue
+		}
+		if err := resp.WriteCommand(bw, "SET", rec.Key, rec.Value); err != nil {
+			break // The client has gone away
+		}
+		n++
+	}
+	bw.Flush()
+
+	log.Printf("EXPORT format=resp bucket=%s keys=%d\n", bucket, n)
+}
+
+// snapshotHandler writes a consistent snapshot of the store, in the format
+// read by store.Restore, for online backups.
+func (s *Server) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	if err := s.store.Snapshot(w); err != nil {
+		log.Printf("SNAPSHOT failed: %v\n", err)
+		return
+	}
+
+	log.Println("SNAPSHOT")
+}
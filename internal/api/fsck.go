@@ -0,0 +1,36 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// fsckHandler compares the store to its transaction log and responds with
+// the store.CheckReport. A POST also repairs the divergent keys from the
+// log. Either way, once the store is known to match its log, the drift
+// sampler's suspicion is cleared.
+func (s *Server) fsckHandler(w http.ResponseWriter, r *http.Request) {
+	if s.dataDir == "" {
+		s.writeError(w, fmt.Errorf("%w: consistency checks need the file transaction log", ErrorNotSupported))
+		return
+	}
+
+	repair := r.Method == http.MethodPost
+
+	report, err := s.store.Check(r.Context(), s.dataDir, repair)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if s.drift != nil && (repair || len(report.Divergences) == 0) {
+		s.drift.ClearSuspicion()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+
+	log.Printf("FSCK sequence=%d divergences=%d repaired=%d\n", report.Sequence, len(report.Divergences), report.Repaired)
+}
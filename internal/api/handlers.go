@@ -0,0 +1,397 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Println(requestID(r.Context()), r.Method, r.RequestURI)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) notAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, ErrorMethodNotAllowed)
+}
+
+// refuseWrites answers every request but GET, HEAD and the POST of a
+// snapshot read as notAllowedHandler does, for mirrors, whose stores only
+// change as the log they mirror does.
+func (s *Server) refuseWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReadRequest(r) {
+			w.Header().Set("Allow", "GET, HEAD")
+			s.notAllowedHandler(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestKey returns the key named in the request path. The router matches
+// on the encoded path so that an escaped slash ("a%2Fb") stays within the key
+// segment; the key is percent-decoded exactly once here.
+func requestKey(r *http.Request) (string, error) {
+	key, err := url.PathUnescape(mux.Vars(r)["key"])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", store.ErrorInvalidKey, err)
+	}
+
+	if err := store.ValidateKey(key); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// emptyKeyHandler rejects requests for "v1/key/" that name no key.
+func (s *Server) emptyKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, fmt.Errorf("%w: key is empty", store.ErrorInvalidKey))
+}
+
+// putHandler expects to be called with a PUT request for the
+// "v1/key/{key}" or "v1/buckets/{bucket}/key/{key}" resource. The body is
+// stored byte for byte, with the media type of its Content-Type, if it has
+// one. If-Match and If-None-Match make the put conditional, as
+// writePrecondition describes.
+func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	value, err := readBody(w, r, s.maxValueSize)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	durability, err := s.requestDurability(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	immutable, err := requestImmutable(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	ttl, err := requestTTL(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	contentType, err := requestContentType(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var seq uint64
+	var usage store.QuotaUsage
+
+	ctx := store.WithQuotaWarning(store.WithSequence(r.Context(), &seq), &usage)
+	ctx = store.WithDurability(ctx, durability)
+	if immutable {
+		ctx = store.WithImmutable(ctx)
+	}
+	if ttl > 0 {
+		ctx = store.WithTTL(ctx, ttl)
+	}
+	if contentType != "" {
+		ctx = store.WithContentType(ctx, contentType)
+	}
+	if p := writePrecondition(r); p != nil {
+		ctx = store.WithPrecondition(ctx, p)
+	}
+
+	changed, err := s.store.BucketPutChanged(ctx, bucket, key, value)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+	writeQuotaWarning(w, usage)
+
+	if err := s.awaitDurability(r.Context(), durability); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	// A put skipped for not changing the value created nothing
+	if !changed {
+		w.Header().Set(NoopHeader, "true")
+		w.WriteHeader(http.StatusOK)
+
+		log.Printf("PUT bucket=%s key=%s noop=true\n", bucket, key)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	log.Printf("PUT bucket=%s key=%s bytes=%d\n", bucket, key, len(value))
+}
+
+// bodyBuffers holds the buffers request bodies are read into, so a steady
+// stream of writes doesn't allocate and grow a new one each time.
+var bodyBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// maxPooledBuffer is the largest buffer returned to bodyBuffers; holding on
+// to the odd huge one would pin its memory indefinitely. It also bounds how
+// much is set aside up front for a body, whatever its Content-Length claims.
+const maxPooledBuffer = 1 << 20
+
+// DefaultMaxValueSize is the largest request body a PUT or PATCH of a key
+// accepts when Config.MaxValueSize is zero.
+const DefaultMaxValueSize = 64 << 20
+
+// readBody reads the request body into a pooled buffer. The returned string
+// is the only copy made of it. Bodies over limit are reported as
+// ErrorValueTooLarge, and those that can't be read as ErrorInvalidRequest.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) (string, error) {
+	if r.ContentLength > limit {
+		return "", fmt.Errorf("%w: over %d bytes", ErrorValueTooLarge, limit)
+	}
+
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			buf.Reset()
+			bodyBuffers.Put(buf)
+		}
+	}()
+
+	if r.ContentLength > 0 {
+		buf.Grow(int(min(r.ContentLength, maxPooledBuffer)))
+	}
+
+	_, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, limit))
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", fmt.Errorf("%w: over %d bytes", ErrorValueTooLarge, tooLarge.Limit)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrorInvalidRequest, err)
+	}
+
+	return buf.String(), nil
+}
+
+// getHandler serves GET and HEAD requests for the "v1/key/{key}" resource.
+// The value's metadata is reported in the ETag, Last-Modified, X-KV-Version
+// and X-KV-Created headers, in OriginalKeyHeader for a key folded when it
+// was created, in ImmutableHeader for a write-once key, and in
+// ExpiresHeader for a key put with a TTL. The value is served with the
+// Content-Type it was put with, if any, and If-Modified-Since is
+// honored. Byte ranges of the value can be requested with Range,
+// conditionally on the ETag or the modification time with If-Range; ranges
+// past the value are answered with 416. With the wait and version query
+// parameters the request long-polls: it is held until the
+// key's version moves past version, or answered with 304 after wait. A read
+// with X-KV-Min-Sequence is first held until the store has caught up with
+// that sequence.
+func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	wait, version, longPoll, err := parseLongPoll(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	filter, err := parseWatchFilter(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if !s.awaitSequence(w, r) {
+		return
+	}
+
+	if longPoll {
+		changed, err := s.waitForChange(r.Context(), bucket, key, version, filter, wait)
+		if errors.Is(err, store.ErrorDeadline) {
+			s.writeError(w, err)
+			return
+		}
+		if err != nil {
+			return // The client has gone away
+		}
+
+		if !changed {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	seq := s.store.Sequence()
+
+	value, meta, err := s.store.BucketGetWithMeta(r.Context(), bucket, key)
+	if s.shadow != nil && (err == nil || errors.Is(err, store.ErrorNoSuchKey)) {
+		s.shadow.sample(s.store, seq, bucket, key, value, err == nil)
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeMetaHeaders(w, meta)
+
+	if notModified(r, meta) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Values put with a media type are served as such; ServeContent sniffs
+	// that of the others
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+
+	// Ranges are served from the value in memory, which a blob was read
+	// back into and checked against its hash
+	http.ServeContent(w, r, "", meta.Modified, strings.NewReader(value))
+
+	log.Printf("GET bucket=%s key=%s\n", bucket, key)
+}
+
+// OriginalKeyHeader carries, percent-encoded, the key as it was given when
+// the key was created, for keys folded by store.Options.KeyFolding.
+const OriginalKeyHeader = "X-KV-Original-Key"
+
+func writeMetaHeaders(w http.ResponseWriter, meta store.ValueMeta) {
+	h := w.Header()
+	h.Set("ETag", etag(meta))
+	h.Set("Last-Modified", meta.Modified.UTC().Format(http.TimeFormat))
+	h.Set("X-KV-Version", strconv.FormatUint(meta.Version, 10))
+	h.Set("X-KV-Created", meta.Created.UTC().Format(http.TimeFormat))
+
+	if meta.OriginalKey != "" {
+		h.Set(OriginalKeyHeader, url.PathEscape(meta.OriginalKey))
+	}
+	if meta.Immutable {
+		h.Set(ImmutableHeader, "true")
+	}
+	if !meta.Expires.IsZero() {
+		h.Set(ExpiresHeader, meta.Expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether r carries an If-Modified-Since header that is
+// not older than the value's last modification. HTTP dates have a
+// resolution of one second, so the comparison is done at that precision.
+func notModified(r *http.Request, meta store.ValueMeta) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !meta.Modified.Truncate(time.Second).After(since)
+}
+
+// etag returns the entity tag of a value: its version, and its creation
+// time, which tells apart the values of a key deleted and created again.
+func etag(meta store.ValueMeta) string {
+	return fmt.Sprintf(`"%d-%x"`, meta.Version, meta.Created.UnixNano())
+}
+
+// urgentContext returns the context of r, made urgent by urgent=true: the
+// write goes ahead of those waiting for the store's locks, and is durable
+// once it returns.
+func urgentContext(r *http.Request) context.Context {
+	if r.URL.Query().Get("urgent") == "true" {
+		return store.WithUrgency(r.Context())
+	}
+
+	return r.Context()
+}
+
+// deleteHandler deletes the key of a DELETE request, conditionally on
+// If-Match and If-None-Match, as writePrecondition describes, ahead of
+// other writes if urgent=true is given.
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	durability, err := s.requestDurability(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var seq uint64
+
+	ctx := store.WithDurability(store.WithSequence(urgentContext(r), &seq), durability)
+	if p := writePrecondition(r); p != nil {
+		ctx = store.WithPrecondition(ctx, p)
+	}
+
+	err = s.store.BucketDelete(ctx, bucket, key)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+
+	if err := s.awaitDurability(r.Context(), durability); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	log.Printf("DELETE bucket=%s key=%s\n", bucket, key)
+}
@@ -0,0 +1,350 @@
+package api
+
+import (
+	"context"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openRouter returns a store loaded from the file log in dir, the router of
+// a server configured by cfg for it, and a function closing the log, after
+// which dir can be opened again to replay it.
+func openRouter(t testing.TB, dir string, cfg Config) (*store.Store, http.Handler, func()) {
+	t.Helper()
+
+	st, _, h, closeLog := openLogRouter(t, dir, cfg)
+	return st, h, closeLog
+}
+
+// openLogRouter is like openRouter, also returning the log, which serves
+// ChangesPath unless cfg has another ChangeReader.
+func openLogRouter(t testing.TB, dir string, cfg Config) (*store.Store, *translog.FileTransactionLogger, http.Handler, func()) {
+	t.Helper()
+
+	logger, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := logger.(*translog.FileTransactionLogger)
+	if cfg.Changes == nil {
+		cfg.Changes = l
+	}
+
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return st, l, NewRouter(NewServer(st, cfg)), func() {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := l.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serve sends a request for method and path, with body if it isn't empty,
+// through h.
+func serve(h http.Handler, method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+// checkMetaHeaders reports the metadata headers of w that don't match the
+// metadata of key in st.
+func checkMetaHeaders(t *testing.T, st *store.Store, key string, w *httptest.ResponseRecorder) {
+	t.Helper()
+
+	_, meta, err := st.GetWithMeta(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"ETag":          etag(meta),
+		"Last-Modified": meta.Modified.UTC().Format(http.TimeFormat),
+		"X-KV-Version":  strconv.FormatUint(meta.Version, 10),
+		"X-KV-Created":  meta.Created.UTC().Format(http.TimeFormat),
+	}
+
+	for name, v := range want {
+		if got := w.Header().Get(name); got != v {
+			t.Errorf("%s: %s is %q, want %q", key, name, got, v)
+		}
+	}
+
+	if lm := w.Header().Get("Last-Modified"); !strings.HasSuffix(lm, " GMT") {
+		t.Errorf("Last-Modified %q isn't in GMT", lm)
+	}
+}
+
+func TestMetadataHeaders(t *testing.T) {
+	dir := t.TempDir()
+
+	st, h, closeLog := openRouter(t, dir, Config{})
+
+	for _, value := range []string{"created", "updated"} {
+		if w := serve(h, "PUT", "/v1/key/k", value, nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT: %d %s", w.Code, w.Body)
+		}
+
+		for _, method := range []string{"GET", "HEAD"} {
+			w := serve(h, method, "/v1/key/k", "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: %d %s", method, w.Code, w.Body)
+			}
+			checkMetaHeaders(t, st, "k", w)
+		}
+	}
+
+	if v := serve(h, "GET", "/v1/key/k", "", nil).Header().Get("X-KV-Version"); v != "2" {
+		t.Errorf("X-KV-Version after an update is %q, want 2", v)
+	}
+
+	since := http.Header{"If-Modified-Since": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}
+	if w := serve(h, "GET", "/v1/key/k", "", since); w.Code != http.StatusNotModified {
+		t.Errorf("GET modified before If-Modified-Since: %d, want 304", w.Code)
+	}
+
+	since = http.Header{"If-Modified-Since": {time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}}
+	if w := serve(h, "GET", "/v1/key/k", "", since); w.Code != http.StatusOK {
+		t.Errorf("GET modified after If-Modified-Since: %d, want 200", w.Code)
+	}
+	closeLog()
+
+	st, h, closeLog = openRouter(t, dir, Config{})
+	defer closeLog()
+
+	w := serve(h, "GET", "/v1/key/k", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET after replay: %d %s", w.Code, w.Body)
+	}
+	checkMetaHeaders(t, st, "k", w)
+}
+
+func TestMetadataHeadersSurviveReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	_, h, closeLog := openRouter(t, dir, Config{})
+	if w := serve(h, "PUT", "/v1/key/k", "first", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "PUT", "/v1/key/k", "second", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	before := serve(h, "GET", "/v1/key/k", "", nil)
+	if before.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", before.Code, before.Body)
+	}
+	closeLog()
+
+	_, h, closeLog = openRouter(t, dir, Config{})
+	defer closeLog()
+
+	after := serve(h, "GET", "/v1/key/k", "", nil)
+	if after.Code != http.StatusOK {
+		t.Fatalf("GET after replay: %d %s", after.Code, after.Body)
+	}
+
+	for _, name := range []string{"ETag", "Last-Modified", "X-KV-Version", "X-KV-Created"} {
+		if b, a := before.Header().Get(name), after.Header().Get(name); b != a || b == "" {
+			t.Errorf("%s is %q before replay and %q after", name, b, a)
+		}
+	}
+
+	// A client revalidating with the ETag it was given is still current
+	header := http.Header{"If-None-Match": {before.Header().Get("ETag")}}
+	if w := serve(h, "GET", "/v1/key/k", "", header); w.Code != http.StatusNotModified {
+		t.Errorf("GET with the ETag from before replay: %d, want 304", w.Code)
+	}
+}
+
+func TestAwkwardKeys(t *testing.T) {
+	keys := []string{"a/b", "a b", "ключ", "100%", "?q=1#frag", "a%2Fb"}
+	dir := t.TempDir()
+
+	st, h, closeLog := openRouter(t, dir, Config{})
+
+	for _, key := range keys {
+		path := "/v1/key/" + url.PathEscape(key)
+
+		if w := serve(h, "PUT", path, "value of "+key, nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %q: %d %s", key, w.Code, w.Body)
+		}
+		if w := serve(h, "GET", path, "", nil); w.Code != http.StatusOK || w.Body.String() != "value of "+key {
+			t.Errorf("GET %q: %d %q", key, w.Code, w.Body)
+		}
+
+		// The store holds the key decoded exactly once
+		if v, err := st.Get(key); err != nil || v != "value of "+key {
+			t.Errorf("store has %q as %q, %v", key, v, err)
+		}
+	}
+
+	// The first key is deleted, and stays deleted through replay
+	if w := serve(h, "DELETE", "/v1/key/"+url.PathEscape(keys[0]), "", nil); w.Code >= 300 {
+		t.Fatalf("DELETE %q: %d %s", keys[0], w.Code, w.Body)
+	}
+	if w := serve(h, "GET", "/v1/key/"+url.PathEscape(keys[0]), "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET %q after its delete: %d", keys[0], w.Code)
+	}
+	closeLog()
+
+	_, h, closeLog = openRouter(t, dir, Config{})
+	defer closeLog()
+
+	for i, key := range keys {
+		w := serve(h, "GET", "/v1/key/"+url.PathEscape(key), "", nil)
+
+		switch {
+		case i == 0 && w.Code != http.StatusNotFound:
+			t.Errorf("GET %q after replay: %d, want 404", key, w.Code)
+		case i > 0 && (w.Code != http.StatusOK || w.Body.String() != "value of "+key):
+			t.Errorf("GET %q after replay: %d %q", key, w.Code, w.Body)
+		}
+	}
+
+	for _, path := range []string{"/v1/key/", "/v1/buckets/default/key/"} {
+		if w := serve(h, "PUT", path, "v", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: %d, want 400", path, w.Code)
+		}
+	}
+}
+
+func TestOversizedBodies(t *testing.T) {
+	st, h, closeLog := openRouter(t, t.TempDir(), Config{MaxValueSize: 16})
+	defer closeLog()
+
+	// A Content-Length far past the limit is refused before anything is
+	// read or set aside for it, whatever the body really holds
+	r := httptest.NewRequest("PUT", "/v1/key/b", strings.NewReader("abc"))
+	r.ContentLength = 200000000000
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT claiming 200GB: %d %s, want 413", w.Code, w.Body)
+	}
+
+	// A body of unknown length is cut off at the limit
+	r = httptest.NewRequest("PUT", "/v1/key/b", strings.NewReader(strings.Repeat("x", 17)))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT of 17 bytes of unknown length: %d %s, want 413", w.Code, w.Body)
+	}
+
+	header := http.Header{"Content-Type": {MergePatchType}}
+	if w := serve(h, "PATCH", "/v1/key/b?create=true", `{"a":"0123456789"}`, header); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH of 18 bytes: %d %s, want 413", w.Code, w.Body)
+	}
+
+	if _, err := st.Get("b"); err != store.ErrorNoSuchKey {
+		t.Errorf("oversized writes left %q behind: %v", "b", err)
+	}
+
+	if w := serve(h, "PUT", "/v1/key/b", strings.Repeat("x", 16), nil); w.Code != http.StatusCreated {
+		t.Errorf("PUT of 16 bytes: %d %s, want 201", w.Code, w.Body)
+	}
+}
+
+func BenchmarkHTTPPut(b *testing.B) {
+	value := strings.Repeat("v", 256)
+
+	_, h, closeLog := openRouter(b, b.TempDir(), Config{})
+	defer closeLog()
+
+	// Each put is logged, which would otherwise be most of what's measured
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	paths := make([]string, 1000)
+	for i := range paths {
+		paths[i] = "/v1/key/key-" + strconv.Itoa(i)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if w := serve(h, "PUT", paths[i%len(paths)], value, nil); w.Code != http.StatusCreated {
+			b.Fatalf("PUT: %d %s", w.Code, w.Body)
+		}
+	}
+}
+
+func TestCanceledRequestsChangeNothing(t *testing.T) {
+	st, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	// The client is gone by the time the write is made
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequestWithContext(ctx, "PUT", "/v2/key/k", strings.NewReader("v"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"code":"canceled"`) {
+		t.Errorf("PUT with a canceled context: %d %s, want 503 canceled", w.Code, w.Body)
+	}
+	if _, err := st.Get("k"); err != store.ErrorNoSuchKey {
+		t.Errorf("Get after a canceled PUT = %v, want ErrorNoSuchKey", err)
+	}
+}
+
+func TestNoopPuts(t *testing.T) {
+	st := store.New(translog.NewNopTransactionLogger(), store.Options{SkipNoopWrites: true})
+	h := NewRouter(NewServer(st, Config{}))
+
+	// A put changing the value is created; one of the same value is
+	// answered 200, flagged, at the sequence the value was already there
+	for i, want := range []int{http.StatusCreated, http.StatusOK, http.StatusOK} {
+		w := serve(h, "PUT", "/v2/key/k", "v", nil)
+		if w.Code != want || (w.Header().Get(NoopHeader) == "true") != (want == http.StatusOK) {
+			t.Errorf("put %d of the same value: %d, %s %q", i+1, w.Code, NoopHeader, w.Header().Get(NoopHeader))
+		}
+		if seq := w.Header().Get(SequenceHeader); seq != "1" {
+			t.Errorf("put %d of the same value at sequence %s, want 1", i+1, seq)
+		}
+	}
+
+	if w := serve(h, "PUT", "/v2/key/k", "w", nil); w.Code != http.StatusCreated || w.Header().Get(NoopHeader) != "" {
+		t.Errorf("a put of another value: %d, %s %q", w.Code, NoopHeader, w.Header().Get(NoopHeader))
+	}
+
+	// Legacy /v1 clients get 201 for every put
+	if w := serve(h, "PUT", "/v1/key/k", "w", nil); w.Code != http.StatusCreated || w.Header().Get(NoopHeader) != "" {
+		t.Errorf("a put of the same value under /v1: %d, %s %q", w.Code, NoopHeader, w.Header().Get(NoopHeader))
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/sheritzs/key-value-store/internal/cluster"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+)
+
+// readyzHandler reports whether the instance can serve traffic. Replay
+// completes before the listeners open, so a reachable instance is ready
+// unless its transaction log has stopped persisting writes; maintenance mode
+// is reported but doesn't make the instance unready since reads keep working.
+// Neither does suspected drift, which only an fsck can confirm.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := "ready", http.StatusOK
+
+	logOK, logErr := s.logHealth.Healthy()
+	if !logOK {
+		status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+
+	var logError string
+	if logErr != nil {
+		logError = logErr.Error()
+	}
+
+	degraded := s.boot != nil && s.boot.Degraded
+	drifted := s.drift != nil && s.drift.Status().Suspected
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status      string           `json:"status"`
+		LogError    string           `json:"log_error,omitempty"`
+		Degraded    bool             `json:"degraded,omitempty"`
+		Drifted     bool             `json:"drift_suspected,omitempty"`
+		Maintenance maintenanceState `json:"maintenance"`
+	}{status, logError, degraded, drifted, s.currentMaintenance()})
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stats())
+}
+
+// serverStats is the body of /v1/stats.
+type serverStats struct {
+	Store       store.Stats                `json:"store"`
+	Maintenance maintenanceState           `json:"maintenance"`
+	Requests    requestStats               `json:"requests"`
+	Replication *replication.Status        `json:"replication,omitempty"`
+	Standby     *replication.ShipperStatus `json:"standby,omitempty"`
+	Mirror      *replication.MirrorStatus  `json:"mirror,omitempty"`
+	Cluster     *cluster.Status            `json:"cluster,omitempty"`
+	Boot        *BootReport                `json:"boot,omitempty"`
+	Drift       *store.DriftStatus         `json:"drift,omitempty"`
+	ScanCache   *ScanCacheStatus           `json:"scan_cache,omitempty"`
+}
+
+func (s *Server) stats() serverStats {
+	var repl *replication.Status
+	if s.follower != nil {
+		status := s.follower.Status()
+		repl = &status
+	}
+
+	var standby *replication.ShipperStatus
+	if s.shipper != nil {
+		status := s.shipper.Status()
+		standby = &status
+	}
+
+	var mirror *replication.MirrorStatus
+	if s.mirror != nil {
+		status := s.mirror.Status()
+		mirror = &status
+	}
+
+	var clusterStatus *cluster.Status
+	if s.cluster != nil {
+		status := s.cluster.Status()
+		clusterStatus = &status
+	}
+
+	var drift *store.DriftStatus
+	if s.drift != nil {
+		status := s.drift.Status()
+		drift = &status
+	}
+
+	var scans *ScanCacheStatus
+	if s.scans != nil {
+		status := s.scans.Status()
+		scans = &status
+	}
+
+	return serverStats{s.store.Stats(), s.currentMaintenance(), s.currentRequests(), repl, standby, mirror, clusterStatus, s.boot, drift, scans}
+}
+
+type requestStats struct {
+	ReadsInFlight  int64 `json:"reads_in_flight"`
+	WritesInFlight int64 `json:"writes_in_flight"`
+}
+
+func (s *Server) currentRequests() requestStats {
+	settings := s.settings.Load()
+
+	return requestStats{
+		ReadsInFlight:  settings.readLimiter.InFlight(),
+		WritesInFlight: settings.writeLimiter.InFlight(),
+	}
+}
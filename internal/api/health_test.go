@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLogFailuresStopWritesUntilTheLogRecovers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, translog.LogFileName)
+	health := translog.NewHealth(2, true)
+
+	l, err := translog.NewFileTransactionLogger(path, health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(context.Background())
+
+	// As main does; the writer blocks on its second unread error otherwise
+	go func() {
+		for range l.Err() {
+		}
+	}()
+
+	h := NewRouter(NewServer(st, Config{LogHealth: health}))
+
+	if w := serve(h, "PUT", "/v2/key/a", "v", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT a: %d %s", w.Code, w.Body)
+	}
+	if err := l.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log can't grow past its current size, as if its disk were full.
+	// The limit is process-wide, so the probe file is refused too; test
+	// output only goes to a pipe, which it doesn't apply to
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	full := limit
+	full.Cur = uint64(info.Size())
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &full); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+
+	// Writes are acknowledged until enough of them have failed
+	refused := false
+	for i := 0; i < 10 && !refused; i++ {
+		w := serve(h, "PUT", fmt.Sprintf("/v2/key/k%d", i), "v", nil)
+
+		switch {
+		case w.Code == http.StatusServiceUnavailable && strings.Contains(w.Body.String(), "logger_unavailable"):
+			refused = true
+		case w.Code != http.StatusCreated:
+			t.Fatalf("PUT while the log fails: %d %s", w.Code, w.Body)
+		}
+
+		l.Flush(context.Background())
+	}
+	if !refused {
+		t.Fatal("writes still acknowledged after 10 failed to be logged")
+	}
+
+	if w := serve(h, "GET", "/readyz", "", nil); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "log_error") {
+		t.Errorf("GET /readyz while the log fails: %d %s, want 503 with the error", w.Code, w.Body)
+	}
+	if w := serve(h, "DELETE", "/v2/key/a", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("DELETE while the log fails: %d, want 503", w.Code)
+	}
+	if w := serve(h, "GET", "/v2/key/a", "", nil); w.Code != http.StatusOK {
+		t.Errorf("GET while the log fails: %d, want 200", w.Code)
+	}
+
+	// Once the disk has room again, the probe finds it, and everything
+	// flips back without a write being let through first
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for serve(h, "GET", "/readyz", "", nil).Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("/readyz still failing once the log could be written again")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if w := serve(h, "PUT", "/v2/key/b", "v", nil); w.Code != http.StatusCreated {
+		t.Errorf("PUT once the log recovered: %d %s", w.Code, w.Body)
+	}
+	if err := l.Flush(context.Background()); err != nil {
+		t.Errorf("Flush once the log recovered: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/hotkeys"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HotKeysPath reports the keys read and written the most lately.
+const HotKeysPath = "/v1/admin/hot-keys"
+
+// Defaults and limits of the parameters of HotKeysPath.
+const (
+	defaultHotKeysWindow = time.Minute
+	defaultHotKeys       = 20
+	maxHotKeys           = 1000
+)
+
+// hotKeysHandler reports the n keys read the most and the n written the
+// most, 20 by default, over the window given as a duration, such as 5m, by
+// default a minute and at most hotkeys.MaxWindow. The counts are
+// approximate. A DELETE forgets every operation counted so far, to start
+// afresh.
+func (s *Server) hotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		s.hotKeys.Reset()
+		log.Printf("HOTKEYS reset principal=%s\n", PrincipalFrom(r.Context()).ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	q := r.URL.Query()
+
+	window := defaultHotKeysWindow
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > hotkeys.MaxWindow {
+			s.writeError(w, fmt.Errorf("%w: window must be a duration up to %s: %q", ErrorInvalidRequest, hotkeys.MaxWindow, v))
+			return
+		}
+		window = d
+	}
+
+	n := defaultHotKeys
+	if v := q.Get("n"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i <= 0 || i > maxHotKeys {
+			s.writeError(w, fmt.Errorf("%w: n must be an integer from 1 to %d: %q", ErrorInvalidRequest, maxHotKeys, v))
+			return
+		}
+		n = i
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.hotKeys.Top(window, n))
+}
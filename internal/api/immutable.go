@@ -0,0 +1,79 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ImmutableHeader set to true on a PUT makes the key write-once, as
+// store.WithImmutable describes: later puts, changes and deletes of it are
+// answered with 409 and the code immutable. Reads of a write-once key
+// report it in the same header.
+const ImmutableHeader = "X-KV-Immutable"
+
+// ForceHeader set to true on a write lets it change or delete write-once
+// keys. Only principals holding ScopeAdmin may send it, and the audit log
+// records every request that does.
+const ForceHeader = "X-KV-Force"
+
+// ErrorForceNotAllowed is reported for writes forced by principals that
+// aren't admins.
+var ErrorForceNotAllowed = errors.New("force not allowed")
+
+// requestImmutable reports whether r asks for its key to be made
+// write-once.
+func requestImmutable(r *http.Request) (bool, error) {
+	v := r.Header.Get(ImmutableHeader)
+	if v == "" {
+		return false, nil
+	}
+
+	immutable, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid %s %q", ErrorInvalidRequest, ImmutableHeader, v)
+	}
+
+	return immutable, nil
+}
+
+// forced reports whether r carries ForceHeader set to true.
+func forced(r *http.Request) bool {
+	force, _ := strconv.ParseBool(r.Header.Get(ForceHeader))
+	return force
+}
+
+// forceWrites makes the writes of the requests carrying ForceHeader forced,
+// as store.WithForce describes, once it has checked that their principal
+// is an admin. Each one is logged, besides being audited.
+func (s *Server) forceWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(ForceHeader)
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, err := strconv.ParseBool(v); err != nil {
+			s.writeError(w, fmt.Errorf("%w: invalid %s %q", ErrorInvalidRequest, ForceHeader, v))
+			return
+		}
+		if !forced(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p := PrincipalFrom(r.Context())
+		if !p.Has(ScopeAdmin) {
+			s.writeError(w, fmt.Errorf("%w: %s requires the admin scope", ErrorForceNotAllowed, ForceHeader))
+			return
+		}
+
+		log.Printf("FORCE principal=%s method=%s path=%s\n", p.ID, r.Method, r.URL.Path)
+
+		next.ServeHTTP(w, r.WithContext(store.WithForce(r.Context())))
+	})
+}
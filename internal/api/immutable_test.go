@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestImmutableKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	audit := NewAuditLogger(&buf, 64, false)
+
+	keys := &APIKeyAuthenticator{Keys: map[string]Principal{
+		"user-key": {ID: "user"},
+		"ops-key":  {ID: "ops", Scopes: []string{ScopeAdmin}},
+	}}
+	cfg := Config{Audit: audit, Authenticator: keys}
+
+	user := http.Header{"X-Api-Key": {"user-key"}}
+	ops := http.Header{"X-Api-Key": {"ops-key"}}
+	with := func(h http.Header, k, v string) http.Header {
+		h = h.Clone()
+		h.Set(k, v)
+		return h
+	}
+
+	// code returns the code of the error body b
+	code := func(b *bytes.Buffer) string {
+		var body errorBody
+		json.Unmarshal(b.Bytes(), &body)
+		return body.Code
+	}
+
+	_, h, closeLog := openRouter(t, dir, cfg)
+
+	if w := serve(h, "PUT", "/v2/key/k", "v1", with(user, ImmutableHeader, "true")); w.Code != http.StatusCreated {
+		t.Fatalf("an immutable PUT: %d %s", w.Code, w.Body)
+	}
+
+	// check checks that k holds want, is write-once, and refuses writes
+	// that aren't forced, whoever makes them
+	check := func(t *testing.T, h http.Handler, want, when string) {
+		t.Helper()
+
+		w := serve(h, "GET", "/v2/key/k", "", user)
+		if w.Code != http.StatusOK || w.Body.String() != want || w.Header().Get(ImmutableHeader) != "true" {
+			t.Errorf("%s: GET %d %q with %s %q, want %q write-once", when, w.Code, w.Body, ImmutableHeader, w.Header().Get(ImmutableHeader), want)
+		}
+
+		for _, header := range []http.Header{user, ops, with(ops, ForceHeader, "false")} {
+			if w := serve(h, "PUT", "/v2/key/k", "v2", header); w.Code != http.StatusConflict || code(w.Body) != "immutable" {
+				t.Errorf("%s: PUT by %s: %d %s, want 409 immutable", when, header.Get("X-Api-Key"), w.Code, w.Body)
+			}
+			if w := serve(h, "DELETE", "/v2/key/k", "", header); w.Code != http.StatusConflict || code(w.Body) != "immutable" {
+				t.Errorf("%s: DELETE by %s: %d %s, want 409 immutable", when, header.Get("X-Api-Key"), w.Code, w.Body)
+			}
+		}
+
+		// Only admins may force writes
+		for _, method := range []string{"PUT", "DELETE"} {
+			if w := serve(h, method, "/v2/key/k", "v2", with(user, ForceHeader, "true")); w.Code != http.StatusForbidden || code(w.Body) != "force_not_allowed" {
+				t.Errorf("%s: a forced %s by a user: %d %s, want 403 force_not_allowed", when, method, w.Code, w.Body)
+			}
+		}
+		if w := serve(h, "PUT", "/v2/key/k", "v2", with(ops, ForceHeader, "yes")); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: an invalid %s: %d %s, want 400", when, ForceHeader, w.Code, w.Body)
+		}
+	}
+
+	check(t, h, "v1", "as put")
+
+	// A forced put changes the value and leaves the key write-once, across
+	// a restart
+	if w := serve(h, "PUT", "/v2/key/k", "forced", with(ops, ForceHeader, "true")); w.Code != http.StatusCreated {
+		t.Fatalf("a forced PUT: %d %s", w.Code, w.Body)
+	}
+	check(t, h, "forced", "after a forced put")
+	closeLog()
+
+	_, h, closeLog = openRouter(t, dir, cfg)
+	defer closeLog()
+
+	check(t, h, "forced", "after a restart")
+
+	// A forced delete removes the key, mark and all
+	if w := serve(h, "DELETE", "/v2/key/k", "", with(ops, ForceHeader, "true")); w.Code != http.StatusOK {
+		t.Fatalf("a forced DELETE: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "GET", "/v2/key/k", "", user); w.Code != http.StatusNotFound {
+		t.Errorf("GET after a forced DELETE: %d %s, want 404", w.Code, w.Body)
+	}
+	if w := serve(h, "PUT", "/v2/key/k", "free", user); w.Code != http.StatusCreated {
+		t.Errorf("PUT after a forced DELETE: %d %s", w.Code, w.Body)
+	}
+
+	audit.Close()
+
+	// Every forced write is audited as such, and no other is
+	var forcedDeletes int
+	for _, rec := range auditRecords(t, &buf) {
+		wantForced := rec.Status == http.StatusForbidden || rec.Principal == "ops" && (rec.Status == http.StatusCreated || rec.Status == http.StatusOK)
+		if rec.Forced != wantForced {
+			t.Errorf("%s %s by %s answered %d audited with forced %t", rec.Method, rec.Path, rec.Principal, rec.Status, rec.Forced)
+		}
+		if rec.Forced && rec.Method == "DELETE" && rec.Status == http.StatusOK {
+			forcedDeletes++
+		}
+	}
+	if forcedDeletes != 1 {
+		t.Errorf("%d forced deletes audited, want 1", forcedDeletes)
+	}
+}
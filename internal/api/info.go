@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"github.com/sheritzs/key-value-store/internal/version"
+	"net/http"
+	"time"
+)
+
+// InfoPath describes the instance, as InstanceInfo.
+const InfoPath = "/v1/admin/info"
+
+// InstanceInfo describes what an instance is: the build it runs, where its
+// data comes from and the settings it runs with. Config.Info gives the parts
+// known at startup, and Server.Info fills in the rest as they are now.
+type InstanceInfo struct {
+	Build   version.Info `json:"build"`
+	Started time.Time    `json:"started"`
+
+	Backend string            `json:"backend"` // Transaction log or state backend
+	Paths   map[string]string `json:"paths"`   // Where the data is kept: data_dir, log, snapshot, blob_dir, keyring, as configured
+
+	RecordVersion  int                `json:"record_version"`           // Of the events this binary logs
+	Sequence       uint64             `json:"sequence"`                 // Of the last event applied
+	LogStartsAfter uint64             `json:"log_starts_after"`         // Sequence of the last event compacted out of the log into the snapshot; 0 if none was
+	LastCompaction time.Time          `json:"last_compaction,omitzero"` // When the log was last compacted; zero if it never was, or the logger doesn't say
+	Checkpoints    []store.Checkpoint `json:"checkpoints"`              // Snapshots restored from, the first being the one loaded at startup, if any
+	Features       map[string]string  `json:"features"`                 // Flags set to other than their default, with secrets redacted
+}
+
+// Info returns the description of the instance as it is now. The log's
+// metadata is read again, as a compaction or a restored snapshot may have
+// changed it.
+func (s *Server) Info() (InstanceInfo, error) {
+	info := s.info
+	info.RecordVersion = translog.RecordVersion
+	info.Sequence = s.store.Sequence()
+
+	info.Checkpoints = s.store.Checkpoints()
+
+	// The fields are always there, for whatever reads them across a fleet
+	if info.Checkpoints == nil {
+		info.Checkpoints = []store.Checkpoint{}
+	}
+	if info.Paths == nil {
+		info.Paths = map[string]string{}
+	}
+	if info.Features == nil {
+		info.Features = map[string]string{}
+	}
+
+	if s.logMeta != nil {
+		meta, err := s.logMeta.LogMeta()
+		if err != nil {
+			return info, fmt.Errorf("failed to read the log's metadata: %w", err)
+		}
+
+		info.LogStartsAfter, info.LastCompaction = meta.After, meta.Compacted
+	}
+
+	return info, nil
+}
+
+// infoHandler responds with the description of the instance.
+func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := s.Info()
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
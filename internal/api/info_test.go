@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"github.com/sheritzs/key-value-store/internal/version"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInstanceInfo(t *testing.T) {
+	ctx := context.Background()
+
+	// A data directory compacted up to sequence 5: a snapshot holding the
+	// events, and an empty log starting after them
+	dir := t.TempDir()
+	src, _, closeSrc := openRouter(t, t.TempDir(), Config{})
+	for i := range 5 {
+		if err := src.PutCtx(ctx, fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, store.SnapshotFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Snapshot(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	closeSrc()
+
+	compacted := time.Date(2026, 4, 1, 12, 0, 0, 0, time.UTC)
+	logPath := filepath.Join(dir, translog.LogFileName)
+	if err := translog.WriteLogMeta(logPath, translog.LogMeta{After: 5, Compacted: compacted}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := translog.NewFileTransactionLogger(logPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(ctx)
+	st.SetReadOnly(true, "warm standby")
+
+	started := time.Now().UTC().Truncate(time.Second)
+	h := NewRouter(NewServer(st, Config{
+		AdminKey: "admin",
+		DataDir:  dir,
+		Info: InstanceInfo{
+			Build:    version.Get(),
+			Started:  started,
+			Backend:  "file",
+			Paths:    map[string]string{"data_dir": dir, "log": logPath},
+			Features: map[string]string{"admin-key": "REDACTED"},
+		},
+		LogMeta: l.(translog.MetaReader),
+	}))
+	admin := http.Header{"X-Api-Key": {"admin"}}
+
+	if w := serve(h, "GET", InfoPath, "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("GET %s without the admin key: %d", InfoPath, w.Code)
+	}
+
+	// get returns the description, checking it has every field and no other
+	get := func() InstanceInfo {
+		t.Helper()
+
+		w := serve(h, "GET", InfoPath, "", admin)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("GET %s: %d %s", InfoPath, w.Code, w.Header().Get("Content-Type"))
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"backend", "build", "checkpoints", "features", "log_starts_after", "paths", "record_version", "sequence", "started"}
+		if _, ok := fields["last_compaction"]; ok {
+			want = append(want, "last_compaction")
+		}
+		if got := slices.Sorted(maps.Keys(fields)); fmt.Sprint(got) != fmt.Sprint(slices.Sorted(slices.Values(want))) {
+			t.Errorf("fields %v, want %v", got, want)
+		}
+
+		var build map[string]json.RawMessage
+		if err := json.Unmarshal(fields["build"], &build); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"version", "commit", "date", "go_version"} {
+			var s string
+			if err := json.Unmarshal(build[name], &s); err != nil || s == "" {
+				t.Errorf("build.%s: %s", name, build[name])
+			}
+		}
+
+		var info InstanceInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	info := get()
+	if info.Build != version.Get() || !info.Started.Equal(started) || info.Backend != "file" || info.Paths["log"] != logPath || info.Features["admin-key"] != "REDACTED" {
+		t.Errorf("the parts known at startup: %+v", info)
+	}
+	if info.RecordVersion != translog.RecordVersion || info.Sequence != 5 {
+		t.Errorf("record version %d at sequence %d", info.RecordVersion, info.Sequence)
+	}
+	if info.LogStartsAfter != 5 || !info.LastCompaction.Equal(compacted) || len(info.Checkpoints) != 1 || info.Checkpoints[0].Sequence != 5 {
+		t.Errorf("booted from the compaction: log starts after %d, compacted at %s, checkpoints %+v", info.LogStartsAfter, info.LastCompaction, info.Checkpoints)
+	}
+
+	// Diagnostics bundles hold the same description
+	w := serve(h, "GET", "/v1/admin/diag", "", admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /v1/admin/diag: %d", w.Code)
+	}
+	var bundled InstanceInfo
+	if err := json.Unmarshal(readBundle(t, w.Body.Bytes())["info.json"], &bundled); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(bundled) != fmt.Sprint(info) {
+		t.Errorf("info.json %+v, want %+v", bundled, info)
+	}
+
+	// A snapshot pushed by a primary replaces the one compacted into, and
+	// the log starts from it
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	primary, _, closePrimary := openRouter(t, t.TempDir(), Config{})
+	defer closePrimary()
+	for i := range 20 {
+		if err := primary.PutCtx(ctx, fmt.Sprintf("p%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := replication.NewShipper(srv.URL, "admin", primary, time.Hour).Push(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	info = get()
+	if info.Sequence != 20 || info.LogStartsAfter != 0 || !info.LastCompaction.IsZero() {
+		t.Errorf("after a pushed snapshot: at %d, log starts after %d, compacted at %s", info.Sequence, info.LogStartsAfter, info.LastCompaction)
+	}
+	if len(info.Checkpoints) != 2 || info.Checkpoints[0].Sequence != 5 || info.Checkpoints[1].Sequence != 20 || info.Checkpoints[1].Restored.Before(info.Checkpoints[0].Restored) {
+		t.Errorf("checkpoints after a pushed snapshot: %+v, want the boot one then the pushed one", info.Checkpoints)
+	}
+
+	// Without anything configured the fields are there, empty
+	_, h, closeOther := openRouter(t, t.TempDir(), Config{AdminKey: "admin"})
+	defer closeOther()
+	w = serve(h, "GET", InfoPath, "", admin)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("GET %s without a configuration: %d, %v", InfoPath, w.Code, err)
+	}
+	for name, want := range map[string]string{"checkpoints": "[]", "paths": "{}", "features": "{}", "log_starts_after": "0"} {
+		if got := string(fields[name]); got != want {
+			t.Errorf("%s without a configuration: %s, want %s", name, got, want)
+		}
+	}
+	if _, ok := fields["last_compaction"]; ok {
+		t.Error("last_compaction given for a log never compacted")
+	}
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// IPRules is a set of CIDR lists loaded from an IP rules file. Each line of
+// the file holds a directive and a CIDR or bare address:
+//
+//	allow 10.0.0.0/8
+//	deny  10.0.13.0/24
+//	trust 192.168.1.10
+//
+// Blank lines and lines starting with # are ignored.
+type IPRules struct {
+	allow   []netip.Prefix // If non-empty, only these clients are admitted
+	deny    []netip.Prefix // Clients that are always rejected
+	trusted []netip.Prefix // Proxies whose X-Forwarded-For is believed
+}
+
+func LoadIPRules(path string) (*IPRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open ip rules file: %w", err)
+	}
+	defer file.Close()
+
+	rules := &IPRules{}
+	scanner := bufio.NewScanner(file)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a directive and a CIDR", path, n)
+		}
+
+		prefix, err := parsePrefix(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+
+		switch fields[0] {
+		case "allow":
+			rules.allow = append(rules.allow, prefix)
+		case "deny":
+			rules.deny = append(rules.deny, prefix)
+		case "trust":
+			rules.trusted = append(rules.trusted, prefix)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown directive %q", path, n, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ip rules file: %w", err)
+	}
+
+	return rules, nil
+}
+
+// parsePrefix parses a CIDR, treating a bare address as a single-host prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return p.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// admits reports whether a client at addr may use the service.
+func (rules *IPRules) admits(addr netip.Addr) bool {
+	if containsAddr(rules.deny, addr) {
+		return false
+	}
+
+	return len(rules.allow) == 0 || containsAddr(rules.allow, addr)
+}
+
+// clientAddr determines the client address of a request whose direct peer is
+// peer. X-Forwarded-For is only consulted when the peer is a trusted proxy;
+// it is then walked from the nearest hop outwards, skipping further trusted
+// proxies, and the first untrusted hop is the client. A malformed hop makes
+// the address undeterminable.
+func (rules *IPRules) clientAddr(peer netip.Addr, r *http.Request) (netip.Addr, bool) {
+	if !containsAddr(rules.trusted, peer) {
+		return peer, true
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+
+		client = addr.Unmap()
+		if !containsAddr(rules.trusted, client) {
+			break
+		}
+	}
+
+	return client, true
+}
+
+// peerAddr returns the address of the request's direct peer. Requests
+// arriving over a Unix domain socket have none.
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// filterIPs rejects requests from clients not admitted by the current IP
+// rules with 403. Requests over the Unix socket, whose access is governed by
+// the socket file's permissions, are not filtered.
+func (s *Server) filterIPs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := s.settings.Load().ipRules
+		if rules == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		peer, ok := peerAddr(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client, ok := rules.clientAddr(peer, r)
+		if !ok || !rules.admits(client) {
+			s.writeError(w, ErrorForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadRules returns the IP rules of a file holding text.
+func loadRules(t *testing.T, text string) *IPRules {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ip-rules")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := LoadIPRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rules
+}
+
+func TestIPFilter(t *testing.T) {
+	rules := loadRules(t, `
+# Clients
+allow 10.0.0.0/8
+allow 2001:db8::/32
+deny  10.0.13.0/24
+
+# Proxies
+trust 192.168.1.10
+trust 192.168.1.11
+trust fd00::1
+`)
+
+	st, _, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	s := NewServer(st, Config{IPRules: rules})
+	h := s.filterIPs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name string
+		peer string
+		xff  []string
+		want int
+	}{
+		{"allowed peer", "10.1.2.3:4000", nil, http.StatusOK},
+		{"denied peer", "10.0.13.7:4000", nil, http.StatusForbidden},
+		{"peer outside allow", "172.16.0.1:4000", nil, http.StatusForbidden},
+		{"allowed IPv6 peer", "[2001:db8::5]:4000", nil, http.StatusOK},
+		{"IPv6 peer outside allow", "[2001:db9::5]:4000", nil, http.StatusForbidden},
+		{"IPv4-mapped peer", "[::ffff:10.1.2.3]:4000", nil, http.StatusOK},
+
+		// An untrusted peer's X-Forwarded-For is ignored, whichever way it
+		// tries to spoof its address
+		{"spoofed allowed XFF", "172.16.0.1:4000", []string{"10.1.2.3"}, http.StatusForbidden},
+		{"spoofed denied XFF", "10.1.2.3:4000", []string{"10.0.13.7"}, http.StatusOK},
+		{"spoofed malformed XFF", "10.1.2.3:4000", []string{"not an address"}, http.StatusOK},
+
+		{"trusted proxy", "192.168.1.10:4000", []string{"10.1.2.3"}, http.StatusOK},
+		{"trusted proxy, denied client", "192.168.1.10:4000", []string{"10.0.13.7"}, http.StatusForbidden},
+		{"trusted IPv6 proxy", "[fd00::1]:4000", []string{"2001:db8::9"}, http.StatusOK},
+		{"trusted proxy without XFF", "192.168.1.10:4000", nil, http.StatusForbidden},
+		{"malformed XFF", "192.168.1.10:4000", []string{"10.1.2.3, bogus"}, http.StatusForbidden},
+
+		// The nearest untrusted hop is the client; what it claims in turn
+		// is ignored
+		{"hops", "192.168.1.10:4000", []string{"172.16.0.1, 10.1.2.3, 192.168.1.11"}, http.StatusOK},
+		{"hops in several headers", "192.168.1.10:4000", []string{"10.1.2.3", "192.168.1.11"}, http.StatusOK},
+		{"spoofed earlier hop", "192.168.1.10:4000", []string{"10.1.2.3, 172.16.0.1"}, http.StatusForbidden},
+		{"denied nearest hop", "192.168.1.10:4000", []string{"10.1.2.3, 10.0.13.7"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/key/k", nil)
+			r.RemoteAddr = tt.peer
+			r.Header["X-Forwarded-For"] = tt.xff
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("%d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPRulesReload(t *testing.T) {
+	st, _, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	s := NewServer(st, Config{IPRules: loadRules(t, "deny 10.0.0.0/8\n")})
+	h := s.filterIPs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func() int {
+		r := httptest.NewRequest("GET", "/v1/key/k", nil)
+		r.RemoteAddr = "10.1.2.3:4000"
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	if code := request(); code != http.StatusForbidden {
+		t.Errorf("denied client: %d, want 403", code)
+	}
+
+	s.Reload(Config{IPRules: loadRules(t, "allow 10.0.0.0/8\n")})
+	if code := request(); code != http.StatusOK {
+		t.Errorf("client allowed by the reloaded rules: %d, want 200", code)
+	}
+
+	s.SetIPRules(nil)
+	if code := request(); code != http.StatusOK {
+		t.Errorf("client with IP filtering off: %d, want 200", code)
+	}
+}
+
+func TestLoadIPRulesRejectsBadLines(t *testing.T) {
+	for _, text := range []string{"allow\n", "allow 10.0.0.0/33\n", "permit 10.0.0.1\n", "deny 10.0.0.1 extra\n"} {
+		path := filepath.Join(t.TempDir(), "ip-rules")
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadIPRules(path); err == nil {
+			t.Errorf("LoadIPRules accepted %q", text)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+// writeAsPrincipal makes the writes of every request on behalf of its
+// principal, so that the owner of a lease can write the key. Anonymous
+// writes are refused for every leased key.
+func (s *Server) writeAsPrincipal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := PrincipalFrom(r.Context()); !p.IsAnonymous() {
+			r = r.WithContext(store.WithLeaseOwner(r.Context(), p.ID))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// leaseResponse is the body of a granted lease, with the value of the key
+// it was granted on.
+type leaseResponse struct {
+	store.Lease
+	Value string `json:"value"`
+}
+
+// acquireLeaseHandler expects a POST request for the "v1/key/{key}/lease"
+// resource with a body like {"ttl": "30s"}, and leases the key to the
+// request's principal, which may renew a lease it holds. It responds with
+// the lease and the key's value, or 409 with the code "leased" if another
+// principal holds it.
+func (s *Server) acquireLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	p := PrincipalFrom(r.Context())
+	if p.IsAnonymous() {
+		s.writeError(w, ErrorUnauthenticated)
+		return
+	}
+	owner := p.ID
+
+	var req struct {
+		TTL *string `json:"ttl"`
+	}
+
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if req.TTL == nil {
+		s.writeError(w, fmt.Errorf(`%w: expected a body like {"ttl":"30s"}`, ErrorInvalidRequest))
+		return
+	}
+
+	ttl, err := time.ParseDuration(*req.TTL)
+	if err != nil {
+		s.writeError(w, fmt.Errorf("%w: invalid ttl: %v", ErrorInvalidRequest, err))
+		return
+	}
+
+	var seq uint64
+
+	ctx := store.WithSequence(r.Context(), &seq)
+
+	lease, acquired, err := s.store.BucketAcquireLease(ctx, bucket, key, owner, ttl)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if !acquired {
+		s.writeError(w, fmt.Errorf("%w until %s", store.ErrorLeased, lease.Expires.Format(time.RFC3339)))
+		return
+	}
+
+	// No one else can write the key while the lease lasts, so this is the
+	// value it was granted on
+	value, _, err := s.store.BucketGetWithMeta(r.Context(), bucket, key)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leaseResponse{Lease: lease, Value: value})
+
+	log.Printf("LEASE bucket=%s key=%s owner=%s ttl=%s\n", bucket, key, owner, ttl)
+}
+
+// releaseLeaseHandler expects a DELETE request for the "v1/key/{key}/lease"
+// resource, and ends the lease the request's principal holds on the key.
+// It answers 204 if the key isn't leased too, and 409 if another principal
+// holds it.
+func (s *Server) releaseLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	p := PrincipalFrom(r.Context())
+	if p.IsAnonymous() {
+		s.writeError(w, ErrorUnauthenticated)
+		return
+	}
+	owner := p.ID
+
+	var seq uint64
+
+	if err := s.store.BucketReleaseLease(store.WithSequence(r.Context(), &seq), bucket, key, owner); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+	w.WriteHeader(http.StatusNoContent)
+
+	log.Printf("RELEASE bucket=%s key=%s owner=%s\n", bucket, key, owner)
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"golang.org/x/sync/semaphore"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of requests of one class that are
+// handled at the same time. Requests over the limit wait up to wait for a
+// slot, or are rejected immediately when wait is zero.
+type concurrencyLimiter struct {
+	sem      *semaphore.Weighted // Nil when the class is unlimited
+	limit    int                 // Size of sem
+	wait     time.Duration       // How long to wait for a free slot
+	inFlight atomic.Int64        // Requests currently being handled
+}
+
+func newConcurrencyLimiter(limit int, wait time.Duration) *concurrencyLimiter {
+	l := &concurrencyLimiter{limit: max(limit, 0), wait: wait}
+	if limit > 0 {
+		l.sem = semaphore.NewWeighted(int64(limit))
+	}
+
+	return l
+}
+
+// resize returns l if it already has the given limit and wait, and a new
+// limiter otherwise. Requests holding a slot of l release it to l, so they
+// don't count against the new limit.
+func (l *concurrencyLimiter) resize(limit int, wait time.Duration) *concurrencyLimiter {
+	if max(limit, 0) == l.limit && wait == l.wait {
+		return l
+	}
+
+	return newConcurrencyLimiter(limit, wait)
+}
+
+// acquire reserves a slot, reporting false if none became free in time.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	if l.sem == nil {
+		return true
+	}
+
+	if l.wait <= 0 {
+		return l.sem.TryAcquire(1)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+
+	return l.sem.Acquire(ctx, 1) == nil
+}
+
+func (l *concurrencyLimiter) release() {
+	if l.sem != nil {
+		l.sem.Release(1)
+	}
+}
+
+// InFlight returns the number of requests currently being handled.
+func (l *concurrencyLimiter) InFlight() int64 {
+	return l.inFlight.Load()
+}
+
+// limitConcurrency applies readLimiter to GET and HEAD requests and
+// writeLimiter to everything else, answering 429 when no slot is free, or
+// 504 if the request's deadline passed while it waited for one.
+// Principals holding ScopeUnlimited aren't limited.
+func (s *Server) limitConcurrency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A replication stream lasts as long as its follower is connected,
+		// so it would hold a read slot indefinitely
+		if r.URL.Path == replication.EventsPath || PrincipalFrom(r.Context()).Has(ScopeUnlimited) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		settings := s.settings.Load()
+
+		l := settings.writeLimiter
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			l = settings.readLimiter
+		}
+
+		if !l.acquire(r.Context()) {
+			// A request whose own deadline ran out while it waited
+			// is told so, rather than to retry
+			if err := phaseError(store.PhaseQueue, r.Context().Err()); errors.Is(err, store.ErrorDeadline) {
+				s.writeError(w, err)
+				return
+			}
+
+			s.writeError(w, ErrorRateLimited)
+			return
+		}
+		defer l.release()
+
+		l.inFlight.Add(1)
+		defer l.inFlight.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
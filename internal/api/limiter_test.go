@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingHandler counts the requests it is handling, and holds each one
+// until release is closed.
+type blockingHandler struct {
+	running, peak atomic.Int64
+	entered       chan struct{}
+	release       chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{entered: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := h.running.Add(1)
+	defer h.running.Add(-1)
+
+	for {
+		peak := h.peak.Load()
+		if n <= peak || h.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+
+	h.entered <- struct{}{}
+	<-h.release
+}
+
+func TestLimiterBoundsConcurrentRequests(t *testing.T) {
+	st, _, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	s := NewServer(st, Config{MaxInflightWrites: 2, LimitWait: 5 * time.Second})
+	inner := newBlockingHandler()
+	h := s.limitConcurrency(inner)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(h, "PUT", "/v1/key/k", "v", nil).Code
+		}()
+	}
+
+	// Two are let in, and the rest wait for them
+	<-inner.entered
+	<-inner.entered
+	time.Sleep(20 * time.Millisecond)
+
+	if got := s.currentRequests().WritesInFlight; got != 2 {
+		t.Errorf("%d writes in flight, want 2", got)
+	}
+
+	// Reads are limited apart from writes
+	if w := serve(s.limitConcurrency(http.NotFoundHandler()), "GET", "/v1/key/k", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET while writes are at their limit: %d, want to be let through", w.Code)
+	}
+
+	close(inner.release)
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("waiting write answered %d, want 200", code)
+		}
+	}
+	if got := inner.peak.Load(); got != 2 {
+		t.Errorf("%d writes handled at once, want 2", got)
+	}
+}
+
+func TestLimiterRejectsWithoutWait(t *testing.T) {
+	st, _, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	s := NewServer(st, Config{MaxInflightReads: 1})
+	inner := newBlockingHandler()
+	h := s.limitConcurrency(inner)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(h, "GET", "/v1/key/k", "", nil)
+	}()
+	<-inner.entered
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/key/k", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("GET over the limit: %d %v, want 429 with Retry-After", w.Code, w.Header())
+	}
+
+	close(inner.release)
+	<-done
+
+	if got := s.currentRequests().ReadsInFlight; got != 0 {
+		t.Errorf("%d reads in flight once all are done, want 0", got)
+	}
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Page sizes of key listings.
+const (
+	DefaultListLimit = 1000
+	MaxListLimit     = 10000
+)
+
+// Bounds of the listing snapshots kept for paging: how long one is kept
+// after its last page was read, how many are kept, and the most keys one
+// may hold. A listing over maxListingKeys is listed afresh for each page.
+const (
+	listingTTL     = 5 * time.Minute
+	maxListings    = 16
+	maxListingKeys = 1 << 20
+)
+
+// listingIDLength is the number of random bytes identifying a snapshot.
+const listingIDLength = 8
+
+// listing is a snapshot of a key listing, kept while it is paged through.
+type listing struct {
+	infos    []store.KeyInfo
+	sequence uint64
+	expires  time.Time
+}
+
+// listingCache keeps the snapshots of the listings being paged through, so
+// that every page comes from the same one.
+type listingCache struct {
+	mu        sync.Mutex
+	snapshots map[string]*listing
+}
+
+// put keeps infos, listed at sequence, and returns the ID of the snapshot,
+// evicting expired snapshots and, if there are still too many, the one
+// closest to expiring.
+func (c *listingCache) put(infos []store.KeyInfo, sequence uint64) string {
+	b := make([]byte, listingIDLength)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.snapshots == nil {
+		c.snapshots = make(map[string]*listing)
+	}
+
+	now := time.Now()
+	for other, l := range c.snapshots {
+		if now.After(l.expires) {
+			delete(c.snapshots, other)
+		}
+	}
+
+	if len(c.snapshots) >= maxListings {
+		var oldest string
+		for other, l := range c.snapshots {
+			if oldest == "" || l.expires.Before(c.snapshots[oldest].expires) {
+				oldest = other
+			}
+		}
+		delete(c.snapshots, oldest)
+	}
+
+	c.snapshots[id] = &listing{infos, sequence, now.Add(listingTTL)}
+
+	return id
+}
+
+// get returns the snapshot with the given ID, keeping it for another
+// listingTTL, and false if it has expired or been evicted.
+func (c *listingCache) get(id string) (*listing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.snapshots[id]
+	if !ok || time.Now().After(l.expires) {
+		return nil, false
+	}
+
+	l.expires = time.Now().Add(listingTTL)
+
+	return l, true
+}
+
+// listCursor is the position of a page of a key listing: the listing it
+// pages through, the snapshot it was taken from, and the last key of the
+// previous page with what it was sorted by, from which the page goes on
+// if the snapshot is gone.
+type listCursor struct {
+	Snapshot   string    `json:"s,omitempty"`
+	Bucket     string    `json:"b"`
+	Prefix     string    `json:"p"`
+	Order      string    `json:"o"`
+	Descending bool      `json:"d,omitempty"`
+	Key        string    `json:"k"`
+	Size       int64     `json:"z,omitempty"`
+	Modified   time.Time `json:"m,omitzero"`
+}
+
+func (c listCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var c listCursor
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("%w: invalid cursor", ErrorInvalidRequest)
+	}
+
+	return c, nil
+}
+
+// pagedListing reports whether a key listing request asks for one of the
+// paged, sorted or projected forms, rather than every key as a plain array.
+func pagedListing(query url.Values) bool {
+	for _, name := range []string{"sort", "order", "limit", "cursor", "meta"} {
+		if query.Has(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listKeysHandler serves a page of the keys of bucket that start with
+// prefix, sorted by the sort query parameter, one of store.ListOrders, in
+// the order given by the order parameter, asc or desc. A page holds up to
+// limit keys, or DefaultListLimit; with meta=true each key comes with the
+// size of its value as stored, its version and modification time instead of
+// alone. The response carries a next_cursor while keys remain, which is
+// passed as the cursor parameter of the same request for the next page.
+//
+// Every page of a listing comes from the snapshot taken for its first page,
+// so none is skipped or seen twice however the keys change meanwhile. The
+// snapshot is dropped listingTTL after the last page read, or sooner under
+// many concurrent listings; the listing then goes on from where its cursor
+// says the last page ended, in the current keys, so a key whose size or
+// modification time changed meanwhile may be skipped or seen again.
+//
+// First pages are answered from the scan cache, if the server has one,
+// until the store changes; the pages after them come from their snapshot.
+func (s *Server) listKeysHandler(w http.ResponseWriter, r *http.Request, bucket, prefix string) {
+	query := r.URL.Query()
+
+	order := store.ListOrder{By: store.OrderKey}
+	if by := query.Get("sort"); by != "" {
+		if !slices.Contains(store.ListOrders, by) {
+			s.writeError(w, fmt.Errorf("%w: sort must be one of %v", ErrorInvalidRequest, store.ListOrders))
+			return
+		}
+		order.By = by
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		order.Descending = true
+	default:
+		s.writeError(w, fmt.Errorf("%w: order must be asc or desc", ErrorInvalidRequest))
+		return
+	}
+
+	limit := DefaultListLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > MaxListLimit {
+			s.writeError(w, fmt.Errorf("%w: limit must be between 1 and %d", ErrorInvalidRequest, MaxListLimit))
+			return
+		}
+		limit = n
+	}
+
+	meta := query.Get("meta") == "true"
+
+	c := query.Get("cursor")
+	if c == "" {
+		key := scanKey("list", bucket, prefix, order.By, strconv.FormatBool(order.Descending), strconv.Itoa(limit), strconv.FormatBool(meta))
+		s.serveScan(w, key, "application/json", func() ([]byte, error) {
+			infos, seq, err := s.store.BucketList(r.Context(), bucket, prefix, order)
+			if err != nil {
+				return nil, err
+			}
+
+			return s.listPage(bucket, prefix, order, limit, meta, infos, seq, "")
+		})
+		return
+	}
+
+	cursor, err := decodeListCursor(c)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if cursor.Bucket != bucket || cursor.Prefix != prefix || cursor.Order != order.By || cursor.Descending != order.Descending {
+		s.writeError(w, fmt.Errorf("%w: the cursor is for another listing", ErrorInvalidRequest))
+		return
+	}
+
+	var infos []store.KeyInfo
+	var seq uint64
+	var id string
+
+	if snapshot, ok := s.listings.get(cursor.Snapshot); ok {
+		infos, seq, id = snapshot.infos, snapshot.sequence, cursor.Snapshot
+	} else if infos, seq, err = s.store.BucketList(r.Context(), bucket, prefix, order); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	infos = store.ListAfter(infos, order, store.KeyInfo{Key: cursor.Key, Size: cursor.Size, Modified: cursor.Modified})
+
+	body, err := s.listPage(bucket, prefix, order, limit, meta, infos, seq, id)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// listPage returns the body of the page of a listing holding the first
+// limit keys of infos, listed at seq, from the snapshot named id. Unless
+// it's the last page, the rest of the listing is kept as a snapshot for the
+// next ones, if it isn't one already.
+func (s *Server) listPage(bucket, prefix string, order store.ListOrder, limit int, meta bool, infos []store.KeyInfo, seq uint64, id string) ([]byte, error) {
+	page := append([]store.KeyInfo{}, infos[:min(limit, len(infos))]...)
+
+	var next string
+	if len(page) < len(infos) {
+		// A listing read in one page needn't be kept
+		if id == "" && len(infos) <= maxListingKeys {
+			id = s.listings.put(infos, seq)
+		}
+
+		last := page[len(page)-1]
+		next = listCursor{id, bucket, prefix, order.By, order.Descending, last.Key, last.Size, last.Modified}.encode()
+	}
+
+	var keys any = page
+	if !meta {
+		names := make([]string, len(page))
+		for i, info := range page {
+			names[i] = info.Key
+		}
+		keys = names
+	}
+
+	log.Printf("LIST bucket=%s prefix=%s sort=%s desc=%t keys=%d\n", bucket, prefix, order.By, order.Descending, len(page))
+
+	return encodeJSONLine(struct {
+		Bucket     string `json:"bucket"`
+		Sequence   uint64 `json:"sequence"`
+		Keys       any    `json:"keys"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}{bucket, seq, keys, next})
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// listPageBody is the body of a page of a paged key listing with meta=true.
+type listPageBody struct {
+	Sequence   uint64          `json:"sequence"`
+	Keys       []store.KeyInfo `json:"keys"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+// listWrite is a write made while keys were listed: a put, creating the
+// key or not, or a delete, with its sequence.
+type listWrite struct {
+	seq     uint64
+	key     string
+	deleted bool
+}
+
+func TestPagedListingsFollowTheirSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	st, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	const keys = 3000
+
+	live := make([]string, 0, keys)
+	created := 0
+	for i := range keys {
+		key := fmt.Sprintf("k%04d", i)
+		if err := st.PutCtx(ctx, key, strings.Repeat("v", i%97)); err != nil {
+			t.Fatal(err)
+		}
+		live = append(live, key)
+	}
+
+	for _, by := range store.ListOrders {
+		for _, desc := range []bool{false, true} {
+			order := store.ListOrder{By: by, Descending: desc}
+
+			t.Run(fmt.Sprintf("%s desc=%t", by, desc), func(t *testing.T) {
+				// The keys before the walk
+				existing := make(map[string]bool, len(live))
+				for _, key := range live {
+					existing[key] = true
+				}
+
+				// A writer resizes, creates and deletes keys while the
+				// listing is paged through, noting what it did
+				var mu sync.Mutex
+				var writes []listWrite
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					for n := 0; ; n++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+
+						var seq uint64
+						wctx := store.WithSequence(ctx, &seq)
+						i := rand.IntN(len(live))
+
+						var err error
+						var w listWrite
+						switch n % 3 {
+						case 0:
+							w.key = live[i]
+							err = st.PutCtx(wctx, w.key, strings.Repeat("w", rand.IntN(200)))
+						case 1:
+							created++
+							w.key = fmt.Sprintf("knew%d", created)
+							err = st.PutCtx(wctx, w.key, "new")
+							live = append(live, w.key)
+						case 2:
+							w.key, w.deleted = live[i], true
+							err = st.DeleteCtx(wctx, w.key)
+							live = append(live[:i], live[i+1:]...)
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+
+						w.seq = seq
+						mu.Lock()
+						writes = append(writes, w)
+						mu.Unlock()
+					}
+				}()
+
+				query := url.Values{"sort": {by}, "limit": {"100"}, "meta": {"true"}}
+				if desc {
+					query.Set("order", "desc")
+				}
+
+				var listed []store.KeyInfo
+				var sequence uint64
+				for pages := 0; ; pages++ {
+					w := serve(h, "GET", "/v1/keys?"+query.Encode(), "", nil)
+					if w.Code != http.StatusOK {
+						t.Fatalf("page %d: %d %s", pages, w.Code, w.Body.String())
+					}
+
+					var page listPageBody
+					if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+						t.Fatal(err)
+					}
+					if pages == 0 {
+						sequence = page.Sequence
+					} else if page.Sequence != sequence {
+						t.Errorf("page %d is of sequence %d, the first of %d", pages, page.Sequence, sequence)
+					}
+
+					listed = append(listed, page.Keys...)
+					if page.NextCursor == "" {
+						break
+					}
+					query.Set("cursor", page.NextCursor)
+				}
+
+				close(stop)
+				wg.Wait()
+
+				// The keys as of the snapshot are those before the walk with
+				// the writes up to its sequence applied
+				mu.Lock()
+				want := existing
+				for _, w := range writes {
+					if w.seq > sequence {
+						break
+					}
+					if w.deleted {
+						delete(want, w.key)
+					} else {
+						want[w.key] = true
+					}
+				}
+				mu.Unlock()
+
+				seen := make(map[string]bool, len(listed))
+				for i, info := range listed {
+					if seen[info.Key] {
+						t.Errorf("%s listed twice", info.Key)
+					}
+					seen[info.Key] = true
+
+					if i > 0 && !order.Less(listed[i-1], info) {
+						t.Errorf("%+v listed after %+v", info, listed[i-1])
+					}
+				}
+				for key := range want {
+					if !seen[key] {
+						t.Errorf("%s skipped", key)
+					}
+				}
+				if len(listed) != len(want) {
+					t.Errorf("%d keys listed of the %d as of sequence %d", len(listed), len(want), sequence)
+				}
+			})
+		}
+	}
+}
+
+func TestPagedListingRejectsBadParameters(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	for i := range 3 {
+		if w := serve(h, "PUT", fmt.Sprintf("/v1/key/k%d", i), "v", nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT k%d: %d", i, w.Code)
+		}
+	}
+
+	w := serve(h, "GET", "/v1/keys?sort=size&limit=1", "", nil)
+	var page struct {
+		Keys       []string `json:"keys"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Keys) != 1 || page.NextCursor == "" {
+		t.Fatalf("the first page of one key: %s", w.Body.String())
+	}
+
+	for _, query := range []string{
+		"sort=name",
+		"order=up",
+		"limit=0",
+		fmt.Sprintf("limit=%d", MaxListLimit+1),
+		"cursor=nonsense",
+		"sort=key&limit=1&cursor=" + page.NextCursor,
+		"sort=size&order=desc&limit=1&cursor=" + page.NextCursor,
+	} {
+		if w := serve(h, "GET", "/v1/keys?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /v1/keys?%s: %d %s", query, w.Code, w.Body.String())
+		}
+	}
+}
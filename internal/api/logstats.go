@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// MaxTopChurners is the most keys a log stats report may list as churners.
+const MaxTopChurners = 1000
+
+// logStatsHandler analyzes the transaction log, as translog.LogStats
+// describes, and responds with the stats, listing as many churners as the
+// top query parameter asks for, or translog.DefaultTopChurners. The log is
+// read without disturbing its writer, and only up to the sequence the store
+// is at when the request comes in, so writes made meanwhile neither wait
+// for the analysis nor skew it.
+func (s *Server) logStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.logScan == nil {
+		s.writeError(w, fmt.Errorf("%w: log stats need the file or postgres transaction log", ErrorNotSupported))
+		return
+	}
+
+	top := translog.DefaultTopChurners
+	if t := r.URL.Query().Get("top"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 || n > MaxTopChurners {
+			s.writeError(w, fmt.Errorf("%w: top must be between 0 and %d", ErrorInvalidRequest, MaxTopChurners))
+			return
+		}
+		top = n
+	}
+
+	a := translog.NewLogAnalyzer(s.store.Sequence())
+
+	err := s.logScan(func(e translog.Event) error {
+		if err := r.Context().Err(); err != nil {
+			return err // The client has gone away
+		}
+		return a.Add(e)
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	stats := a.Stats(top)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+
+	log.Printf("LOG-STATS sequence=%d records=%d live_keys=%d amplification=%.2f\n", stats.Sequence, stats.Records, stats.LiveKeys, stats.Amplification)
+}
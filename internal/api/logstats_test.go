@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// recordSize is the size of e as the file log writes it, newline included.
+func recordSize(e translog.Event) int64 {
+	return int64(len(translog.EncodeEvent(e)) + 1)
+}
+
+func TestLogStatsOfConstructedHistories(t *testing.T) {
+	put := func(seq uint64, bucket, key, value string) translog.Event {
+		return translog.Event{Sequence: seq, EventType: translog.EventPut, Bucket: bucket, Key: key, Value: value}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		history []translog.Event
+
+		// want returns the stats expected of the history, given the sizes
+		// of its records
+		want func(size []int64) translog.LogStats
+	}{
+		{
+			name: "overwrites and deletes",
+			history: []translog.Event{
+				put(1, "default", "a", "1"),
+				put(2, "default", "a", "22"),
+				put(3, "default", "a", "333"),
+				put(4, "default", "b", "x"),
+				{Sequence: 5, EventType: translog.EventDelete, Bucket: "default", Key: "b"},
+				put(6, "default", "c", "y"),
+			},
+			want: func(size []int64) translog.LogStats {
+				return translog.LogStats{
+					Sequence:                6,
+					Records:                 6,
+					RecordsByType:           map[string]int64{"put": 5, "delete": 1},
+					Bytes:                   size[0] + size[1] + size[2] + size[3] + size[4] + size[5],
+					DistinctKeys:            3,
+					LiveKeys:                2,
+					Overwrites:              2,
+					OverwriteRatio:          2.0 / 5,
+					DeletedKeyBytes:         size[3] + size[4],
+					EstimatedCompactedBytes: size[2] + size[5],
+					TopChurners: []translog.KeyChurn{
+						{Bucket: "default", Key: "a", Records: 3, Puts: 3, Overwrites: 2, OverwriteRatio: 2.0 / 3, Bytes: size[0] + size[1] + size[2], Live: true},
+						{Bucket: "default", Key: "b", Records: 2, Puts: 1, Bytes: size[3] + size[4]},
+					},
+				}
+			},
+		},
+		{
+			// The drop deletes every key of its bucket, and the rename moves
+			// the keys of its own, so the put after it overwrites k
+			name: "bucket drops and renames",
+			history: []translog.Event{
+				put(1, "b1", "a", "v"),
+				put(2, "b1", "c", "v"),
+				{Sequence: 3, EventType: translog.EventDropBucket, Bucket: "b1"},
+				put(4, "b2", "k", "v"),
+				{Sequence: 5, EventType: translog.EventRenameBucket, Bucket: "b2", Value: "b3"},
+				put(6, "b3", "k", "w"),
+			},
+			want: func(size []int64) translog.LogStats {
+				return translog.LogStats{
+					Sequence:                6,
+					Records:                 6,
+					RecordsByType:           map[string]int64{"put": 4, "drop_bucket": 1, "rename_bucket": 1},
+					Bytes:                   size[0] + size[1] + size[2] + size[3] + size[4] + size[5],
+					DistinctKeys:            4,
+					LiveKeys:                1,
+					Overwrites:              1,
+					OverwriteRatio:          1.0 / 4,
+					DeletedKeyBytes:         size[0] + size[1] + size[2] + size[3],
+					EstimatedCompactedBytes: size[5],
+					TopChurners: []translog.KeyChurn{
+						{Bucket: "b1", Key: "a", Records: 1, Puts: 1, Bytes: size[0]},
+						{Bucket: "b1", Key: "c", Records: 1, Puts: 1, Bytes: size[1]},
+					},
+				}
+			},
+		},
+		{
+			// Only a lease still held on a live key is kept by compaction
+			name: "leases",
+			history: []translog.Event{
+				put(1, "default", "k", "v"),
+				{Sequence: 2, EventType: translog.EventLease, Bucket: "default", Key: "k", Value: "owner"},
+				{Sequence: 3, EventType: translog.EventLease, Bucket: "default", Key: "k"},
+				put(4, "default", "l", "v"),
+				{Sequence: 5, EventType: translog.EventLease, Bucket: "default", Key: "l", Value: "owner"},
+			},
+			want: func(size []int64) translog.LogStats {
+				return translog.LogStats{
+					Sequence:                5,
+					Records:                 5,
+					RecordsByType:           map[string]int64{"put": 2, "lease": 3},
+					Bytes:                   size[0] + size[1] + size[2] + size[3] + size[4],
+					DistinctKeys:            2,
+					LiveKeys:                2,
+					EstimatedCompactedBytes: size[0] + size[3] + size[4],
+					TopChurners: []translog.KeyChurn{
+						{Bucket: "default", Key: "k", Records: 3, Puts: 1, Bytes: size[0] + size[1] + size[2], Live: true},
+						{Bucket: "default", Key: "l", Records: 2, Puts: 1, Bytes: size[3] + size[4], Live: true},
+					},
+				}
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.New(translog.NewNopTransactionLogger(), store.Options{})
+			h := NewRouter(NewServer(st, Config{
+				AdminKey: "secret",
+				LogScan: func(fn func(translog.Event) error) error {
+					for _, e := range tt.history {
+						if err := fn(e); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			}))
+
+			admin := make(http.Header)
+			admin.Set("X-API-Key", "secret")
+
+			w := serve(h, "GET", "/v1/admin/log-stats?top=2", "", admin)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET log-stats: %d %s", w.Code, w.Body.String())
+			}
+
+			var got translog.LogStats
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			size := make([]int64, len(tt.history))
+			for i, e := range tt.history {
+				size[i] = recordSize(e)
+			}
+			want := tt.want(size)
+			want.Amplification = float64(want.Bytes) / float64(want.EstimatedCompactedBytes)
+			if want.TopChurners == nil {
+				want.TopChurners = []translog.KeyChurn{}
+			}
+
+			if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+				t.Errorf("stats:\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLogStatsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, translog.LogFileName)
+
+	st, h, closeLog := openRouter(t, dir, Config{
+		AdminKey: "secret",
+		LogScan: func(fn func(translog.Event) error) error {
+			return translog.ScanLog(path, fn)
+		},
+	})
+	defer closeLog()
+
+	admin := make(http.Header)
+	admin.Set("X-API-Key", "secret")
+
+	// stats asks for the log stats, once the log holds every write so far
+	stats := func(query string) (int, translog.LogStats) {
+		t.Helper()
+
+		if err := st.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		var stats translog.LogStats
+		w := serve(h, "GET", "/v1/admin/log-stats"+query, "", admin)
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, stats
+	}
+
+	for i := range 10 {
+		if err := st.PutCtx(ctx, "hot", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := st.PutCtx(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.DeleteCtx(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log as written by the store, read from its file
+	code, got := stats("?top=1")
+	if code != http.StatusOK {
+		t.Fatalf("GET log-stats: %d", code)
+	}
+	if got.Sequence != 14 || got.Records != 14 || got.LiveKeys != 3 || got.DistinctKeys != 4 || got.Overwrites != 9 {
+		t.Errorf("stats: %+v", got)
+	}
+	if len(got.TopChurners) != 1 || got.TopChurners[0].Key != "hot" || got.TopChurners[0].Records != 10 {
+		t.Errorf("top churners: %+v", got.TopChurners)
+	}
+
+	// Writes made during an analysis don't skew it: it counts only up to
+	// the sequence it started at
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; !stop.Load(); i++ {
+			if err := st.PutCtx(ctx, fmt.Sprintf("new%d", i), "v"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for range 20 {
+		w := serve(h, "GET", "/v1/admin/log-stats?top=0", "", admin)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET log-stats while writing: %d %s", w.Code, w.Body.String())
+			break
+		}
+
+		var during translog.LogStats
+		if err := json.Unmarshal(w.Body.Bytes(), &during); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(during.Records) != during.Sequence || during.Records < got.Records {
+			t.Errorf("stats while writing: %d records up to sequence %d", during.Records, during.Sequence)
+		}
+	}
+
+	stop.Store(true)
+	wg.Wait()
+
+	for _, query := range []string{"?top=-1", "?top=x", fmt.Sprintf("?top=%d", MaxTopChurners+1)} {
+		if code, _ := stats(query); code != http.StatusBadRequest {
+			t.Errorf("GET log-stats%s: %d", query, code)
+		}
+	}
+
+	// Without a log to read, the stats aren't available
+	h = NewRouter(NewServer(st, Config{AdminKey: "secret"}))
+	if w := serve(h, "GET", "/v1/admin/log-stats", "", admin); w.Code != http.StatusNotImplemented {
+		t.Errorf("GET log-stats without a log to scan: %d", w.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxLongPollWait caps how long a long-polling GET may be parked.
+const maxLongPollWait = 60 * time.Second
+
+// parseLongPoll extracts the wait and version query parameters of a
+// long-polling GET such as "v1/key/{key}?wait=30s&version=3". ok is false
+// for an ordinary GET without a wait parameter.
+func parseLongPoll(r *http.Request) (wait time.Duration, version uint64, ok bool, err error) {
+	q := r.URL.Query()
+	if !q.Has("wait") {
+		return 0, 0, false, nil
+	}
+
+	wait, err = time.ParseDuration(q.Get("wait"))
+	if err != nil || wait < 0 {
+		return 0, 0, false, fmt.Errorf("%w: invalid wait %q", ErrorInvalidRequest, q.Get("wait"))
+	}
+
+	version, err = strconv.ParseUint(q.Get("version"), 10, 64)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("%w: long polling requires a numeric version: %q", ErrorInvalidRequest, q.Get("version"))
+	}
+
+	return min(wait, maxLongPollWait), version, true, nil
+}
+
+// parseWatchFilter extracts the filter of a long-polling GET from its
+// query: changes=puts or changes=deletes, equals=VALUE, and
+// field=NAME==JSON, such as field=status=="failed". A GET without them
+// waits for any change.
+func parseWatchFilter(r *http.Request) (store.WatchFilter, error) {
+	var f store.WatchFilter
+
+	q := r.URL.Query()
+
+	if q.Has("changes") {
+		var err error
+		if f.Changes, err = store.ParseWatchChanges(q.Get("changes")); err != nil {
+			return f, fmt.Errorf("%w: %v", ErrorInvalidRequest, err)
+		}
+	}
+
+	if q.Has("equals") {
+		equals := q.Get("equals")
+		f.Equals = &equals
+	}
+
+	if q.Has("field") {
+		m, err := store.ParseFieldMatch(q.Get("field"))
+		if err != nil {
+			return f, fmt.Errorf("%w: %v", ErrorInvalidRequest, err)
+		}
+		f.Field = &m
+	}
+
+	if err := f.Validate(); err != nil {
+		return f, fmt.Errorf("%w: %v", ErrorInvalidRequest, err)
+	}
+
+	if !f.IsZero() && !q.Has("wait") {
+		return f, fmt.Errorf("%w: watch filters require wait", ErrorInvalidRequest)
+	}
+
+	return f, nil
+}
+
+// waitForChange blocks until the version of key differs from version in a
+// way f matches, wait elapses, or ctx is done, and reports whether the key
+// changed. The watcher is released on every path.
+func (s *Server) waitForChange(ctx context.Context, bucket, key string, version uint64, f store.WatchFilter, wait time.Duration) (bool, error) {
+	changed, cancel := s.store.WatchMatching(bucket, key, version, f)
+	defer cancel()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	case <-ctx.Done():
+		return false, phaseError(store.PhaseWatch, ctx.Err())
+	}
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLongPollReleasedByPut(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	if w := serve(h, "PUT", "/v1/key/k", "first", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	parked := make(chan *httptest.ResponseRecorder)
+	go func() {
+		parked <- serve(h, "GET", "/v1/key/k?wait=10s&version=1", "", nil)
+	}()
+
+	// The GET has nothing to return until the key changes
+	select {
+	case w := <-parked:
+		t.Fatalf("GET returned %d %q before the key changed", w.Code, w.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if w := serve(h, "PUT", "/v1/key/k", "second", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	select {
+	case w := <-parked:
+		if w.Code != http.StatusOK || w.Body.String() != "second" {
+			t.Errorf("parked GET returned %d %q, want 200 second", w.Code, w.Body)
+		}
+		if v := w.Header().Get("X-KV-Version"); v != "2" {
+			t.Errorf("parked GET returned version %q, want 2", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the PUT didn't release the parked GET")
+	}
+
+	// A GET for a version already superseded returns at once
+	if w := serve(h, "GET", "/v1/key/k?wait=10s&version=1", "", nil); w.Code != http.StatusOK || w.Body.String() != "second" {
+		t.Errorf("GET of a stale version: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestLongPollTimeout(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	if w := serve(h, "PUT", "/v1/key/k", "v", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	start := time.Now()
+	w := serve(h, "GET", "/v1/key/k?wait=50ms&version=1", "", nil)
+
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("GET of an unchanged key: %d %q, want 304", w.Code, w.Body)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("GET returned after %v, before its wait elapsed", d)
+	}
+
+	for _, query := range []string{"wait=soon&version=1", "wait=1s", "wait=-1s&version=1", "changes=puts"} {
+		if w := serve(h, "GET", "/v1/key/k?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET ?%s: %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestLongPollClientGone(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequestWithContext(ctx, "GET", "/v1/key/missing?wait=30s&version=0", nil)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, r)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the GET stayed parked after its client went away")
+	}
+}
+
+func TestLongPollFilters(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	if w := serve(h, "PUT", "/v1/key/job", `{"status":"queued"}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	parked := make(chan *httptest.ResponseRecorder)
+	go func() {
+		parked <- serve(h, "GET", `/v1/key/job?wait=10s&version=1&changes=puts&field=status=="failed"`, "", nil)
+	}()
+
+	// Puts the filter doesn't match, JSON or not, leave the GET parked
+	for _, value := range []string{`{"status":"running"}`, "failed", `{"status":"done"}`} {
+		if w := serve(h, "PUT", "/v1/key/job", value, nil); w.Code >= 300 {
+			t.Fatalf("PUT %s: %d %s", value, w.Code, w.Body)
+		}
+	}
+
+	select {
+	case w := <-parked:
+		t.Fatalf("GET returned %d %q for puts its filter doesn't match", w.Code, w.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if w := serve(h, "PUT", "/v1/key/job", `{"status":"failed"}`, nil); w.Code >= 300 {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	select {
+	case w := <-parked:
+		if w.Code != http.StatusOK || w.Body.String() != `{"status":"failed"}` {
+			t.Errorf("parked GET returned %d %q", w.Code, w.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a put the filter matches didn't release the parked GET")
+	}
+
+	for _, query := range []string{"changes=updates", "field=status", `field=status==failed`, "changes=deletes&equals=x"} {
+		if w := serve(h, "GET", "/v1/key/job?wait=1s&version=1&"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET ?%s: %d, want 400", query, w.Code)
+		}
+	}
+}
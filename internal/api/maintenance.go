@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// maintenanceRetryAfter is the Retry-After hint, in seconds, sent with
+// writes rejected by maintenance mode.
+const maintenanceRetryAfter = 30
+
+type maintenanceState struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func (s *Server) currentMaintenance() maintenanceState {
+	on, reason := s.store.ReadOnly()
+
+	return maintenanceState{Enabled: on, Reason: reason}
+}
+
+// maintenanceHandler reports the maintenance mode on GET and changes it on
+// POST, which expects a body like {"enabled": true, "reason": "upgrade"}.
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var state maintenanceState
+
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			s.writeError(w, fmt.Errorf("%w: invalid maintenance request: %v", ErrorInvalidRequest, err))
+			return
+		}
+
+		s.store.SetReadOnly(state.Enabled, state.Reason)
+
+		log.Printf("MAINTENANCE enabled=%t reason=%q\n", state.Enabled, state.Reason)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.currentMaintenance())
+}
+
+// ToggleMaintenanceOnSignal flips the maintenance mode of st each time the
+// process receives SIGUSR2, until ctx is done.
+func ToggleMaintenanceOnSignal(ctx context.Context, st *store.Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			on, _ := st.ReadOnly()
+
+			reason := ""
+			if !on {
+				reason = "enabled by SIGUSR2"
+			}
+			st.SetReadOnly(!on, reason)
+
+			log.Printf("MAINTENANCE enabled=%t (SIGUSR2)\n", !on)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMaintenanceUnderLoad(t *testing.T) {
+	dir := t.TempDir()
+	admin := http.Header{"X-Api-Key": {"secret"}}
+
+	_, h, closeLog := openRouter(t, dir, Config{AdminKey: "secret"})
+
+	if w := serve(h, "PUT", "/v1/key/read", "v", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT read: %d %s", w.Code, w.Body)
+	}
+
+	const writers = 8
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		acked    []string
+		enabled  = make(chan struct{})
+		finished = make(chan struct{}, writers)
+	)
+
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; ; i++ {
+				// Writes started once maintenance mode is on must all be refused
+				after := false
+				select {
+				case <-enabled:
+					after = true
+				default:
+				}
+
+				key := fmt.Sprintf("w%d-%d", g, i)
+				w := serve(h, "PUT", "/v1/key/"+key, "v", nil)
+
+				switch {
+				case w.Code == http.StatusCreated && !after:
+					mu.Lock()
+					acked = append(acked, key)
+					mu.Unlock()
+				case w.Code == http.StatusServiceUnavailable:
+					if w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), `"reason":"upgrade"`) {
+						t.Errorf("refused PUT %s: %v %s, want Retry-After and the reason", key, w.Header(), w.Body)
+					}
+					if after {
+						return
+					}
+				default:
+					t.Errorf("PUT %s, after=%t: %d %s", key, after, w.Code, w.Body)
+					return
+				}
+
+				if i == 20 {
+					finished <- struct{}{}
+				}
+			}
+		}()
+	}
+
+	// Maintenance mode is turned on while every writer is busy
+	for g := 0; g < writers; g++ {
+		<-finished
+	}
+	if w := serve(h, "POST", "/v1/admin/maintenance", `{"enabled": true, "reason": "upgrade"}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("POST /v1/admin/maintenance: %d %s", w.Code, w.Body)
+	}
+	close(enabled)
+	wg.Wait()
+
+	if w := serve(h, "GET", "/v1/key/read", "", nil); w.Code != http.StatusOK {
+		t.Errorf("GET in maintenance mode: %d, want 200", w.Code)
+	}
+	if w := serve(h, "GET", "/v1/keys", "", nil); w.Code != http.StatusOK {
+		t.Errorf("listing keys in maintenance mode: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "DELETE", "/v1/key/read", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("DELETE in maintenance mode: %d, want 503", w.Code)
+	}
+	if w := serve(h, "POST", "/v1/keys", `{"put": {"a": "v"}}`, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("bulk put in maintenance mode: %d %s, want 503", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/readyz", "/v1/stats"} {
+		w := serve(h, "GET", path, "", nil)
+
+		var body struct {
+			Maintenance maintenanceState `json:"maintenance"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("GET %s: %v in %s", path, err, w.Body)
+		}
+		if !body.Maintenance.Enabled || body.Maintenance.Reason != "upgrade" {
+			t.Errorf("GET %s reports maintenance %+v", path, body.Maintenance)
+		}
+		if path == "/readyz" && w.Code != http.StatusOK {
+			t.Errorf("GET /readyz in maintenance mode: %d, want 200", w.Code)
+		}
+	}
+
+	if w := serve(h, "POST", "/v1/admin/maintenance", `{"enabled": false}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("POST /v1/admin/maintenance: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, "PUT", "/v1/key/after", "v", nil); w.Code != http.StatusCreated {
+		t.Errorf("PUT once maintenance mode is off: %d %s", w.Code, w.Body)
+	}
+	closeLog()
+
+	// Every write acknowledged before the toggle was logged
+	st, _, closeLog := openRouter(t, dir, Config{})
+	defer closeLog()
+
+	for _, key := range acked {
+		if _, err := st.Get(key); err != nil {
+			t.Errorf("acknowledged %s is gone after replay: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sheritzs/key-value-store/internal/hotkeys"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+)
+
+// registry holds every metric the service exports on /metrics.
+var registry = prometheus.NewRegistry()
+
+var panicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kv_http_panics_total",
+	Help: "Number of panics recovered while handling requests.",
+})
+
+var auditDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kv_audit_dropped_total",
+	Help: "Number of audit records dropped because the audit buffer was full.",
+})
+
+var faultsInjectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kv_faults_injected_total",
+	Help: "Number of faults injected into requests, by kind of fault.",
+}, []string{"fault"})
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		panicsTotal,
+		auditDroppedTotal,
+		faultsInjectedTotal,
+		shadowWritesTotal,
+		shadowReadsTotal,
+		bootPhaseSeconds,
+		bootReplayRate,
+		bootReadySeconds,
+		scanCacheRequestsTotal,
+		scanCacheEvictionsTotal,
+		scanCacheBytes,
+	)
+	registry.MustRegister(timing.Collectors()...)
+	registry.MustRegister(store.QuotaCollectors()...)
+	registry.MustRegister(store.EvictionCollectors()...)
+	registry.MustRegister(translog.QueueCollectors()...)
+	registry.MustRegister(store.DriftCollectors()...)
+	registry.MustRegister(store.LaneCollectors()...)
+	registry.MustRegister(hotkeys.Collectors()...)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+type requestIDKey struct{}
+
+// requestID returns the ID assigned to the request by withRequestID.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+// withRequestID tags each request with the ID from its X-Request-ID header,
+// generating one if the client didn't send it, and echoes it back in the
+// response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// recoverPanics turns a panic in a handler into a 500 response, logging the
+// stack with the request ID so the failure can be correlated, and keeps the
+// server running. http.ErrAbortHandler is re-raised since it is the
+// sanctioned way to abort a response.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			panicsTotal.Inc()
+
+			id := requestID(r.Context())
+			log.Printf("panic request_id=%s %s %s: %v\n%s", id, r.Method, r.RequestURI, p, debug.Stack())
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(struct {
+				Error     string `json:"error"`
+				RequestID string `json:"request_id"`
+			}{"internal server error", id})
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nameSpanAfterRoute renames the request span started by otelhttp after the
+// matched route template, so spans for different keys group together.
+func nameSpanAfterRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				trace.SpanFromContext(r.Context()).SetName(r.Method + " " + tmpl)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPanicsAreAnswered500(t *testing.T) {
+	// The Authorize hook runs inside the router's middleware, so a panic
+	// there is recovered as one in a handler would be
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{
+		Authorize: func(r *http.Request) error {
+			if strings.HasSuffix(r.URL.Path, "/panic") {
+				panic("test panic")
+			}
+			return nil
+		},
+	})
+	defer closeLog()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	before := testutil.ToFloat64(panicsTotal)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/key/panic", nil)
+	req.Header.Set("X-Request-ID", "panic-request")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError || err != nil {
+		t.Fatalf("panicking request: %d, %v; want 500 with a JSON body", resp.StatusCode, err)
+	}
+	if body.RequestID != "panic-request" || body.Error != "internal server error" {
+		t.Errorf("body %+v", body)
+	}
+	if got := testutil.ToFloat64(panicsTotal); got != before+1 {
+		t.Errorf("kv_http_panics_total went from %v to %v, want one more", before, got)
+	}
+
+	// The server keeps serving
+	for _, method := range []string{"PUT", "GET"} {
+		req, _ := http.NewRequest(method, srv.URL+"/v1/key/fine", strings.NewReader("value"))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s after the panic: %v", method, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			t.Errorf("%s after the panic: %d %s", method, resp.StatusCode, b)
+		}
+		if method == "GET" && string(b) != "value" {
+			t.Errorf("GET after the panic returned %q", b)
+		}
+	}
+}
+
+func TestPutSpanHierarchy(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.Install(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer tracing.Install(nil)
+
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	header := http.Header{"Traceparent": {"00-" + traceID + "-" + parentID + "-01"}}
+	if w := serve(h, "PUT", "/v1/key/k", "v", header); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	// The write span ends once the logger has written the event
+	closeLog()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	parents := []struct{ span, parent string }{
+		{"PUT /v1/key/{key}", ""},
+		{"store.Put", "PUT /v1/key/{key}"},
+		{"translog.Enqueue", "store.Put"},
+		{"translog.FileWrite", "translog.Enqueue"},
+	}
+	for _, p := range parents {
+		span, ok := spans[p.span]
+		if !ok {
+			t.Errorf("no %s span among %d", p.span, len(spans))
+			continue
+		}
+
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("%s in trace %s, want the traceparent's %s", p.span, got, traceID)
+		}
+
+		want := parentID
+		if p.parent != "" {
+			want = spans[p.parent].SpanContext().SpanID().String()
+		}
+		if got := span.Parent().SpanID().String(); got != want {
+			t.Errorf("%s is a child of %s, want %s (%s)", p.span, got, want, cmp.Or(p.parent, "traceparent"))
+		}
+	}
+
+	if attrs := spans["store.Put"].Attributes(); !slices.Contains(attrs, attribute.String("kv.key", "k")) {
+		t.Errorf("store.Put attributes %v, want kv.key=k", attrs)
+	}
+}
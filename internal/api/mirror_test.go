@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorRefusesWrites(t *testing.T) {
+	dir := t.TempDir()
+
+	st, _, closeLog := openRouter(t, dir, Config{})
+	if err := st.PutCtx(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	mirrored := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	m := replication.NewMirror(filepath.Join(dir, translog.LogFileName), mirrored)
+	if err := m.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h := NewRouter(NewServer(mirrored, Config{Mirror: m}))
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE", "POST"} {
+		w := serve(h, method, "/v1/key/k", "w", nil)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s k on a mirror: %d, Allow %q", method, w.Code, w.Header().Get("Allow"))
+		}
+	}
+
+	if w := serve(h, "GET", "/v1/key/k", "", nil); w.Code != http.StatusOK || w.Body.String() != "v" {
+		t.Errorf("GET k on a mirror: %d %q", w.Code, w.Body.String())
+	}
+
+	w := serve(h, "GET", "/v1/stats", "", nil)
+	var stats struct {
+		Mirror *replication.MirrorStatus `json:"mirror"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Mirror == nil || stats.Mirror.AppliedSequence != 1 {
+		t.Errorf("the mirror's stats: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// MergePatchType is the content type of the JSON merge patches of RFC 7386
+// that a PATCH request applies.
+const MergePatchType = "application/merge-patch+json"
+
+// ErrorNotJSON is reported for patches of values that aren't JSON.
+var ErrorNotJSON = errors.New("stored value is not JSON")
+
+// ErrorPreconditionFailed is reported for writes whose If-Match header
+// doesn't match the key's ETag.
+var ErrorPreconditionFailed = errors.New("precondition failed")
+
+// ErrorUnsupportedMediaType is reported for request bodies of a content type
+// the endpoint doesn't take.
+var ErrorUnsupportedMediaType = errors.New("unsupported media type")
+
+// patchHandler expects a PATCH request for the "v1/key/{key}" or
+// "v1/buckets/{bucket}/key/{key}" resource, with a JSON merge patch body of
+// type MergePatchType. The patch is applied to the stored JSON document
+// under the lock of the store's write of the key, so concurrent patches of
+// different fields all survive, and the whole result is stored and logged;
+// it's returned with its metadata headers, as by a GET, and stored as
+// application/json, which GETs then serve it as. A stored value that
+// isn't JSON is answered with 409. A missing key is answered with 404,
+// unless the query parameter create=true is given, in which case the patch
+// is applied to an empty document and the key created, answered with 201.
+// If-Match, with an ETag or "*", is checked against the key's ETag under the
+// lock, and answered with 412 if it doesn't match.
+func (s *Server) patchHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bucket, err := requestBucket(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != MergePatchType {
+		s.writeError(w, fmt.Errorf("%w: expected %s", ErrorUnsupportedMediaType, MergePatchType))
+		return
+	}
+
+	body, err := readBody(w, r, s.maxValueSize)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	patch, err := parseJSON(body)
+	if err != nil {
+		s.writeError(w, fmt.Errorf("%w: the patch is not JSON: %v", ErrorInvalidRequest, err))
+		return
+	}
+
+	create := r.URL.Query().Get("create") == "true"
+	ifMatch := r.Header.Get("If-Match")
+
+	var seq uint64
+	var usage store.QuotaUsage
+	var created bool
+
+	// The result is JSON whatever the key was put as
+	ctx := store.WithQuotaWarning(store.WithSequence(r.Context(), &seq), &usage)
+	ctx = store.WithContentType(ctx, "application/json")
+
+	value, meta, err := s.store.BucketUpdate(ctx, bucket, key, func(old string, meta store.ValueMeta, exists bool) (string, bool, error) {
+		if ifMatch != "" && !(exists && etagMatches(ifMatch, etag(meta))) {
+			return "", false, fmt.Errorf("%w: If-Match %s", ErrorPreconditionFailed, ifMatch)
+		}
+
+		var doc any
+		switch {
+		case exists:
+			var err error
+			if doc, err = parseJSON(old); err != nil {
+				return "", false, fmt.Errorf("%w: %v", ErrorNotJSON, err)
+			}
+		case !create:
+			return "", false, store.ErrorNoSuchKey
+		}
+
+		created = !exists
+
+		value, err := encodeJSON(mergePatch(doc, patch))
+		return value, false, err
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+	writeQuotaWarning(w, usage)
+	writeMetaHeaders(w, meta)
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(value))
+
+	log.Printf("PATCH bucket=%s key=%s version=%d\n", bucket, key, meta.Version)
+}
+
+// etagMatches reports whether the If-Match header ifMatch, a list of ETags
+// or "*", matches tag. Weak ETags never match, as If-Match compares
+// strongly.
+func etagMatches(ifMatch, tag string) bool {
+	for candidate := range strings.SplitSeq(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseJSON parses a single JSON value, keeping numbers as they were
+// written rather than rounding them to float64.
+func parseJSON(s string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after the JSON value")
+	}
+
+	return v, nil
+}
+
+// encodeJSON encodes v compactly, without escaping HTML characters, which
+// would change strings the patch didn't touch. Object fields come out in
+// lexical order.
+func encodeJSON(v any) (string, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// mergePatch applies the JSON merge patch patch to target, as RFC 7386
+// defines: an object patch sets each of its fields in target, recursively,
+// removing those it sets to null, and any other patch replaces target.
+// target may be modified.
+func mergePatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	doc, ok := target.(map[string]any)
+	if !ok {
+		doc = make(map[string]any, len(fields))
+	}
+
+	for name, value := range fields {
+		if value == nil {
+			delete(doc, name)
+			continue
+		}
+
+		doc[name] = mergePatch(doc[name], value)
+	}
+
+	return doc
+}
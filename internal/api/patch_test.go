@@ -0,0 +1,178 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7386, appendix A, and nested objects
+	for _, tt := range []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`{"user":{"name":"a","address":{"city":"x","zip":"1"}}}`, `{"user":{"address":{"zip":null,"street":"y"}}}`, `{"user":{"address":{"city":"x","street":"y"},"name":"a"}}`},
+		{`{"n":12345678901234567890}`, `{"m":1.50}`, `{"m":1.50,"n":12345678901234567890}`},
+	} {
+		target, err := parseJSON(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, err := parseJSON(tt.patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := encodeJSON(mergePatch(target, patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("merging %s into %s: %s, want %s", tt.patch, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	mergePatch := make(http.Header)
+	mergePatch.Set("Content-Type", MergePatchType)
+
+	// patch sends a merge patch of key, with the extra header if given
+	patch := func(path, body string, extra ...string) (int, string, http.Header) {
+		t.Helper()
+
+		header := mergePatch.Clone()
+		if len(extra) == 2 {
+			header.Set(extra[0], extra[1])
+		}
+
+		w := serve(h, "PATCH", path, body, header)
+		return w.Code, w.Body.String(), w.Header()
+	}
+
+	if w := serve(h, "PUT", "/v1/key/doc", `{"name":"a","tags":["x"],"address":{"city":"x","zip":"1"}}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT doc: %d", w.Code)
+	}
+
+	// Nested fields are merged, and those set to null removed; the whole
+	// result is stored
+	code, body, header := patch("/v1/key/doc", `{"address":{"zip":null,"street":"y"},"tags":null}`)
+	want := `{"address":{"city":"x","street":"y"},"name":"a"}`
+	if code != http.StatusOK || body != want || header.Get("ETag") == "" {
+		t.Errorf("PATCH doc: %d %s, ETag %q", code, body, header.Get("ETag"))
+	}
+	if w := serve(h, "GET", "/v1/key/doc", "", nil); w.Body.String() != want || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("GET doc after the patch: %s as %q, want it as application/json", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+
+	// If-Match is checked against the key's current ETag
+	tag := header.Get("ETag")
+	if code, body, _ := patch("/v1/key/doc", `{"name":"b"}`, "If-Match", `"1-0"`); code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH doc with a stale If-Match: %d %s", code, body)
+	}
+	if code, body, _ := patch("/v1/key/doc", `{"name":"b"}`, "If-Match", tag); code != http.StatusOK {
+		t.Errorf("PATCH doc with its ETag: %d %s", code, body)
+	}
+	if code, body, _ := patch("/v1/key/doc", `{"name":"c"}`, "If-Match", tag); code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH doc with the ETag it had before: %d %s", code, body)
+	}
+
+	// A missing key is 404, or created from an empty document on request
+	if code, body, _ := patch("/v1/key/missing", `{"a":1}`); code != http.StatusNotFound {
+		t.Errorf("PATCH a missing key: %d %s", code, body)
+	}
+	if code, body, _ := patch("/v1/key/missing?create=true", `{"a":1,"b":null}`); code != http.StatusCreated || body != `{"a":1}` {
+		t.Errorf("PATCH a missing key with create=true: %d %s", code, body)
+	}
+	if w := serve(h, "GET", "/v1/key/missing", "", nil); w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("GET of the key a patch created served as %q", w.Header().Get("Content-Type"))
+	}
+	if code, body, _ := patch("/v1/key/other", `{"a":1}`, "If-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH a missing key with If-Match *: %d %s", code, body)
+	}
+
+	// A stored value that isn't JSON can't be patched, nor can a patch that
+	// isn't JSON, nor one of another type, be applied
+	if w := serve(h, "PUT", "/v1/key/text", "plain", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT text: %d", w.Code)
+	}
+	if code, body, _ := patch("/v1/key/text", `{"a":1}`); code != http.StatusConflict {
+		t.Errorf("PATCH a value that isn't JSON: %d %s", code, body)
+	}
+	if w := serve(h, "GET", "/v1/key/text", "", nil); w.Body.String() != "plain" {
+		t.Errorf("GET text after a failed patch: %s", w.Body.String())
+	}
+	if code, body, _ := patch("/v1/key/doc", `{"a":`); code != http.StatusBadRequest {
+		t.Errorf("PATCH with a patch that isn't JSON: %d %s", code, body)
+	}
+	if code, body, _ := patch("/v1/key/doc", `{"a":1}`, "Content-Type", "application/json"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH with a JSON body: %d %s", code, body)
+	}
+}
+
+func TestConcurrentPatchesOfDifferentFieldsAllSurvive(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	header := make(http.Header)
+	header.Set("Content-Type", MergePatchType)
+
+	if w := serve(h, "PUT", "/v1/key/doc", `{}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT doc: %d", w.Code)
+	}
+
+	const fields = 100
+
+	var wg sync.WaitGroup
+	for i := range fields {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			body := fmt.Sprintf(`{"f%d":{"n":%d}}`, i, i)
+			if w := serve(h, "PATCH", "/v1/key/doc", body, header); w.Code != http.StatusOK {
+				t.Errorf("PATCH f%d: %d %s", i, w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	w := serve(h, "GET", "/v1/key/doc", "", nil)
+	doc, err := parseJSON(w.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := doc.(map[string]any)
+	if len(got) != fields {
+		t.Errorf("%d of %d fields survived: %s", len(got), fields, w.Body.String())
+	}
+	for i := range fields {
+		if f, ok := got[fmt.Sprintf("f%d", i)].(map[string]any); !ok || fmt.Sprint(f["n"]) != fmt.Sprint(i) {
+			t.Errorf("field f%d: %v", i, got[fmt.Sprintf("f%d", i)])
+		}
+	}
+
+	if v := w.Header().Get("X-KV-Version"); v != fmt.Sprint(fields+1) {
+		t.Errorf("the version after %d patches: %s", fields, v)
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQuotaWarningHeader(t *testing.T) {
+	st := store.New(translog.NewNopTransactionLogger(), store.Options{
+		Quotas: store.QuotaPolicy{Buckets: map[string]store.Quota{"b": {MaxKeys: 5}}},
+	})
+	h := NewRouter(NewServer(st, Config{}))
+
+	// The puts in the warning band say how close the bucket is, then the
+	// one past the quota is rejected
+	for i, want := range []string{"", "", "", "keys=4/5", "keys=5/5"} {
+		w := serve(h, "PUT", fmt.Sprintf("/v2/buckets/b/key/k%d", i), "v", nil)
+		if w.Code != http.StatusCreated || w.Header().Get(QuotaWarningHeader) != want {
+			t.Errorf("put %d: %d, %s %q, want %q", i, w.Code, QuotaWarningHeader, w.Header().Get(QuotaWarningHeader), want)
+		}
+	}
+
+	w := serve(h, "PUT", "/v2/buckets/b/key/k5", "v", nil)
+	if w.Code != http.StatusInsufficientStorage || !strings.Contains(w.Body.String(), `"code":"over_quota"`) || w.Header().Get(QuotaWarningHeader) != "" {
+		t.Errorf("a put past the quota: %d %s, %s %q", w.Code, w.Body, QuotaWarningHeader, w.Header().Get(QuotaWarningHeader))
+	}
+
+	// Deleting keys back under the band stops the warnings
+	for _, key := range []string{"k0", "k1"} {
+		if w := serve(h, "DELETE", "/v2/buckets/b/key/"+key, "", nil); w.Code != http.StatusOK {
+			t.Fatalf("DELETE %s: %d", key, w.Code)
+		}
+	}
+	if w := serve(h, "PUT", "/v2/buckets/b/key/k2", "w", nil); w.Code != http.StatusCreated || w.Header().Get(QuotaWarningHeader) != "" {
+		t.Errorf("a put back under the band: %d, %s %q", w.Code, QuotaWarningHeader, w.Header().Get(QuotaWarningHeader))
+	}
+}
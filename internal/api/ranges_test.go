@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestRangesReassembleTheValue(t *testing.T) {
+	blobs, err := blob.Open(filepath.Join(t.TempDir(), blob.DirName), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A large value of every byte, kept in memory and in a blob
+	value := make([]byte, 3<<20+17)
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := range value {
+		value[i] = byte(r.Uint32())
+	}
+
+	for name, opts := range map[string]store.Options{"in memory": {}, "in a blob": {Blobs: blobs}} {
+		t.Run(name, func(t *testing.T) {
+			st := store.New(translog.NewNopTransactionLogger(), opts)
+			h := NewRouter(NewServer(st, Config{}))
+
+			if w := serve(h, "PUT", "/v2/key/large", string(value), nil); w.Code != http.StatusCreated {
+				t.Fatalf("PUT large: %d %s", w.Code, w.Body)
+			}
+
+			full := serve(h, "GET", "/v2/key/large", "", nil)
+			if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" || !bytes.Equal(full.Body.Bytes(), value) {
+				t.Fatalf("GET large: %d, Accept-Ranges %q, %d bytes", full.Code, full.Header().Get("Accept-Ranges"), full.Body.Len())
+			}
+			tag := full.Header().Get("ETag")
+
+			// Fetched a chunk at a time, conditionally on the ETag, the
+			// value comes back byte for byte
+			const chunk = 256 << 10
+
+			var got bytes.Buffer
+			for start := 0; start < len(value); start += chunk {
+				end := min(start+chunk, len(value)) - 1
+
+				w := serve(h, "GET", "/v2/key/large", "", http.Header{
+					"Range":    {fmt.Sprintf("bytes=%d-%d", start, end)},
+					"If-Range": {tag},
+				})
+				if want := fmt.Sprintf("bytes %d-%d/%d", start, end, len(value)); w.Code != http.StatusPartialContent || w.Header().Get("Content-Range") != want {
+					t.Fatalf("GET bytes %d-%d: %d, Content-Range %q, want 206 %q", start, end, w.Code, w.Header().Get("Content-Range"), want)
+				}
+
+				got.Write(w.Body.Bytes())
+			}
+			if !bytes.Equal(got.Bytes(), value) {
+				t.Errorf("the chunks reassemble to %d bytes unlike the %d of the value", got.Len(), len(value))
+			}
+
+			// A suffix range is the end of the value
+			if w := serve(h, "GET", "/v2/key/large", "", http.Header{"Range": {"bytes=-100"}}); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), value[len(value)-100:]) {
+				t.Errorf("GET the last 100 bytes: %d, %d bytes", w.Code, w.Body.Len())
+			}
+
+			// A range past the value is refused, saying how long it is
+			w := serve(h, "GET", "/v2/key/large", "", http.Header{"Range": {fmt.Sprintf("bytes=%d-", len(value))}})
+			if want := fmt.Sprintf("bytes */%d", len(value)); w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != want {
+				t.Errorf("GET a range past the value: %d, Content-Range %q, want 416 %q", w.Code, w.Header().Get("Content-Range"), want)
+			}
+
+			// Once the value changes, a range of the old one gets the whole
+			// new value
+			if err := st.PutCtx(context.Background(), "large", "changed"); err != nil {
+				t.Fatal(err)
+			}
+			w = serve(h, "GET", "/v2/key/large", "", http.Header{"Range": {"bytes=0-1023"}, "If-Range": {tag}})
+			if w.Code != http.StatusOK || w.Body.String() != "changed" || w.Header().Get("ETag") == tag {
+				t.Errorf("GET a range of a changed value: %d, %q, ETag %s", w.Code, w.Body, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
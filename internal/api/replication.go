@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ErrorNotStandby is reported for snapshots pushed to an instance that isn't
+// a standby they could be restored to.
+var ErrorNotStandby = errors.New("only a read-only standby that isn't following a leader accepts snapshots")
+
+// replicationEventsHandler streams the transaction log to a follower.
+func (s *Server) replicationEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.source == nil {
+		s.writeError(w, fmt.Errorf("%w: this instance's transaction log can't be replicated", ErrorNotSupported))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stop := context.AfterFunc(s.streams, cancel)
+	defer stop()
+
+	replication.ServeEvents(w, r.WithContext(ctx), s.source)
+}
+
+// restoreSnapshotHandler replaces the state of a read-only standby with a
+// snapshot pushed by its primary. The snapshot is loaded into fresh maps
+// that are swapped in under the store's lock, so readers see the old state
+// until the new one is whole. With the file backend it is also saved as the
+// data directory's snapshot, so a restarted standby starts from it, and
+// restored from that file, which a store paging its values in keeps reading
+// them from.
+func (s *Server) restoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if on, _ := s.store.ReadOnly(); !on || s.follower != nil || s.cluster != nil {
+		s.writeError(w, ErrorNotStandby)
+		return
+	}
+
+	s.restoreMu.Lock()
+	defer s.restoreMu.Unlock()
+
+	var tmp *os.File
+
+	if s.dataDir != "" {
+		var err error
+		if tmp, err = os.CreateTemp(s.dataDir, store.SnapshotFileName+".*.tmp"); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		defer os.Remove(tmp.Name()) // Once renamed into place, there's nothing left to remove
+		defer tmp.Close()
+
+		if _, err := io.Copy(tmp, r.Body); err != nil {
+			s.writeError(w, fmt.Errorf("%w: reading the snapshot: %v", ErrorInvalidRequest, err))
+			return
+		}
+	}
+
+	var err error
+	if tmp != nil {
+		err = s.store.RestoreFile(tmp.Name())
+	} else {
+		err = s.store.Restore(r.Body)
+	}
+	if err != nil {
+		s.writeError(w, fmt.Errorf("%w: %v", ErrorInvalidRequest, err))
+		return
+	}
+
+	result := replication.RestoreResult{Sequence: s.store.Sequence(), Keys: s.store.Stats().Keys}
+
+	if tmp != nil {
+		if err := s.saveSnapshot(tmp); err != nil {
+			log.Printf("RESTORE-SNAPSHOT serving sequence %d, but saving it failed: %v\n", result.Sequence, err)
+			s.writeError(w, fmt.Errorf("snapshot restored but not saved: %w", err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+
+	log.Printf("RESTORE-SNAPSHOT sequence=%d keys=%d\n", result.Sequence, result.Keys)
+}
+
+// saveSnapshot makes the snapshot written to tmp the data directory's. The
+// log's metadata, if any, describes where the log starts relative to the
+// snapshot being replaced, so that is reset first, keeping only the
+// high-water sequence; replay then skips the events in the log that the new
+// snapshot already holds.
+func (s *Server) saveSnapshot(tmp *os.File) error {
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	logPath := filepath.Join(s.dataDir, translog.LogFileName)
+
+	meta, err := translog.ReadLogMeta(logPath)
+	if err != nil {
+		return err
+	}
+
+	if meta.HighWater != 0 {
+		err = translog.WriteLogMeta(logPath, translog.LogMeta{HighWater: meta.HighWater})
+	} else {
+		err = os.Remove(filepath.Join(s.dataDir, translog.MetaFileName))
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.dataDir, store.SnapshotFileName))
+}
@@ -0,0 +1,418 @@
+// Package api implements the key-value store's HTTP API.
+package api
+
+import (
+	"cmp"
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/sheritzs/key-value-store/internal/cluster"
+	"github.com/sheritzs/key-value-store/internal/crypt"
+	"github.com/sheritzs/key-value-store/internal/hotkeys"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"github.com/sheritzs/key-value-store/internal/usage"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings of the HTTP API.
+type Config struct {
+	AdminKey string // API key required by admin endpoints; empty disables them
+
+	// Authenticator establishes who made each request, for the admin
+	// endpoints, audit records, concurrency limits and the owners of
+	// leases. The admin key grants ScopeAdmin whatever it is. Nil takes
+	// requests to be anonymous unless they present the admin key. With an
+	// Authenticator, the admin endpoints are enabled even without an admin
+	// key, for the principals it grants ScopeAdmin
+	Authenticator Authenticator
+
+	// Authorize, if set, is called for every request once it is
+	// authenticated, before it is served; PrincipalFrom gives its
+	// principal. A non-nil error rejects the request with 403 Forbidden
+	// and the error's message
+	Authorize func(r *http.Request) error
+
+	// Principal, if set and Authenticator isn't, names who made a request;
+	// an empty name falls back to "admin" for the admin key and
+	// "anonymous" otherwise.
+	//
+	// Deprecated: Use Authenticator.
+	Principal func(r *http.Request) string
+
+	MaxInflightReads  int           // Concurrent GET/HEAD requests; 0 is unlimited
+	MaxInflightWrites int           // Concurrent write requests; 0 is unlimited
+	LimitWait         time.Duration // How long a request over the limit waits; 0 rejects it
+
+	IPRules   *IPRules         // Client IP rules; nil admits everyone
+	Audit     *AuditLogger     // Audit log; nil disables auditing
+	LogHealth *translog.Health // Reported by /readyz; nil is always healthy
+	DataDir   string           // Data directory of the file transaction log; empty disables /v1/admin/fsck
+
+	MinSequenceWait time.Duration // How long a GET waits for the sequence in X-KV-Min-Sequence; 0 rejects it at once
+	MaxDeadline     time.Duration // Longest deadline X-KV-Deadline-Ms may ask for; 0 is DefaultMaxDeadline
+
+	Faults      *FaultInjector        // Injects faults into requests, and is adjusted by /v1/admin/chaos; nil never injects any
+	Keyring     *crypt.Keyring        // Data keys the store encrypts values with; nil disables /v1/admin/reencrypt
+	EventSource translog.Source       // Served to replication followers; nil disables the event stream
+	Follower    *replication.Follower // Reported by /v1/stats when this instance follows a leader
+	Shipper     *replication.Shipper  // Reported by /v1/stats when this instance pushes snapshots to a standby
+	Mirror      *replication.Mirror   // Reported by /v1/stats when this instance mirrors another's log; its writes are all refused
+	Cluster     *cluster.Node         // Reported by /v1/stats, and the writes sent to its leader, when this instance is a member of a cluster
+	Shadow      *Shadow               // Compared with the store on reads, and reported by ShadowPath; nil compares nothing
+	Boot        *BootReport           // Reported by /v1/stats, and by /readyz if degraded; may be nil
+	Drift       *store.DriftSampler   // Reported by /v1/stats, and by /readyz once it suspects drift; cleared by a clean fsck; may be nil
+	ScanCache   *ScanCache            // Serves repeated key listings and snapshot reads while the store doesn't change; nil caches nothing
+	Usage       *usage.Meter          // Accounts for the key API requests of each principal, reported by UsagePath; nil accounts for nothing
+	HotKeys     *hotkeys.Tracker      // Counts the operations on each key, reported by HotKeysPath; nil disables it
+	Changes     translog.ChangeReader // Serves ChangesPath; nil disables it
+	V1Compat    string                // V1CompatStrict or V1CompatModern; empty is strict
+
+	ClusterWrites string // How writes reach the leader of a Cluster: ClusterRedirect or ClusterProxy; empty redirects
+
+	ChangesInlineMax int   // Largest value a page of ChangesPath holds; DefaultChangesInlineMax if 0
+	MaxValueSize     int64 // Largest body a PUT or PATCH of a key may carry; DefaultMaxValueSize if 0
+
+	ScalingTargets ScalingTargets   // What one instance is meant to handle, for the replicas ScalingSignalsPath suggests
+	Durability     DurabilityPolicy // Of the puts and deletes of keys, as DurabilityHeader asks
+
+	// LogScan reads the transaction log for /v1/admin/log-stats, as
+	// translog.ScanLog does; nil disables the endpoint
+	LogScan func(fn func(translog.Event) error) error
+
+	// Diagnostics bundles served by /v1/admin/diag include the logger's
+	// recent errors kept by LogErrors, and the settings PrintConfig writes,
+	// which must redact secrets; either may be nil
+	LogErrors   *translog.ErrorHistory
+	PrintConfig func(w io.Writer) error
+
+	// Info describes the instance as it started, for InfoPath and
+	// diagnostics bundles, which add what changes as it runs; LogMeta
+	// tells where the log starts, and may be nil if the logger can't
+	Info    InstanceInfo
+	LogMeta translog.MetaReader
+}
+
+// Server serves the HTTP API for a store. Each Server is independent, so
+// several can run in one process.
+type Server struct {
+	store     *store.Store
+	logHealth *translog.Health
+	adminKey  string
+	authorize func(r *http.Request) error
+	audit     *AuditLogger
+	source    translog.Source
+	follower  *replication.Follower
+	shipper   *replication.Shipper
+	mirror    *replication.Mirror
+	cluster   *cluster.Node
+	shadow    *Shadow
+	dataDir   string
+	keyring   *crypt.Keyring
+	faults    *FaultInjector
+	boot      *BootReport
+	drift     *store.DriftSampler
+	scans     *ScanCache
+	usage     *usage.Meter
+	hotKeys   *hotkeys.Tracker
+	changes   translog.ChangeReader
+	logScan   func(fn func(translog.Event) error) error
+	legacyV1  bool // Whether /v1 answers in its legacy shapes
+
+	clusterWrites string
+	logErrors     *translog.ErrorHistory
+	info          InstanceInfo
+	logMeta       translog.MetaReader
+
+	authenticator Authenticator
+	keyOnlyAdmin  bool // Whether only the admin key grants ScopeAdmin
+
+	load           *loadWindow // Requests of the key API served lately
+	scalingTargets ScalingTargets
+	durability     DurabilityPolicy
+
+	printConfig func(w io.Writer) error
+
+	minSequenceWait  time.Duration
+	maxDeadline      time.Duration
+	changesInlineMax int
+	maxValueSize     int64
+
+	streams      context.Context // Done once long-lived streams should end
+	closeStreams context.CancelFunc
+
+	restoreMu sync.Mutex // Serializes snapshots pushed to a standby
+
+	listings listingCache // Snapshots of the key listings being paged through
+
+	reloadMu sync.Mutex // Serializes changes to settings
+	settings atomic.Pointer[settings]
+}
+
+// settings are the parts of the configuration that can change while the
+// server runs. They are replaced as a whole, so a request sees either the
+// old settings or the new ones, never a mix.
+type settings struct {
+	adminKey     string
+	ipRules      *IPRules // Nil when IP filtering is off
+	readLimiter  *concurrencyLimiter
+	writeLimiter *concurrencyLimiter
+}
+
+// NewServer returns a Server for st configured by cfg.
+func NewServer(st *store.Store, cfg Config) *Server {
+	s := &Server{
+		store:         st,
+		logHealth:     cfg.LogHealth,
+		authorize:     cfg.Authorize,
+		audit:         cfg.Audit,
+		source:        cfg.EventSource,
+		follower:      cfg.Follower,
+		shipper:       cfg.Shipper,
+		mirror:        cfg.Mirror,
+		cluster:       cfg.Cluster,
+		shadow:        cfg.Shadow,
+		dataDir:       cfg.DataDir,
+		keyring:       cfg.Keyring,
+		faults:        cfg.Faults,
+		boot:          cfg.Boot,
+		drift:         cfg.Drift,
+		scans:         cfg.ScanCache,
+		usage:         cfg.Usage,
+		hotKeys:       cfg.HotKeys,
+		changes:       cfg.Changes,
+		logScan:       cfg.LogScan,
+		legacyV1:      cfg.V1Compat != V1CompatModern,
+		clusterWrites: cfg.ClusterWrites,
+		logErrors:     cfg.LogErrors,
+		info:          cfg.Info,
+		logMeta:       cfg.LogMeta,
+
+		authenticator: cfg.Authenticator,
+		keyOnlyAdmin:  cfg.Authenticator == nil,
+
+		printConfig: cfg.PrintConfig,
+
+		minSequenceWait:  cfg.MinSequenceWait,
+		maxDeadline:      cmp.Or(cfg.MaxDeadline, DefaultMaxDeadline),
+		changesInlineMax: cmp.Or(cfg.ChangesInlineMax, DefaultChangesInlineMax),
+		maxValueSize:     cmp.Or(cfg.MaxValueSize, DefaultMaxValueSize),
+
+		load:           newLoadWindow(time.Now()),
+		scalingTargets: cfg.ScalingTargets,
+		durability:     cfg.Durability,
+	}
+
+	if s.authenticator == nil {
+		s.authenticator = AnonymousAuthenticator{}
+		if cfg.Principal != nil {
+			s.authenticator = principalFunc(cfg.Principal)
+		}
+	}
+
+	s.settings.Store(&settings{
+		adminKey:     cfg.AdminKey,
+		ipRules:      cfg.IPRules,
+		readLimiter:  newConcurrencyLimiter(cfg.MaxInflightReads, cfg.LimitWait),
+		writeLimiter: newConcurrencyLimiter(cfg.MaxInflightWrites, cfg.LimitWait),
+	})
+
+	s.streams, s.closeStreams = context.WithCancel(context.Background())
+
+	return s
+}
+
+// CloseStreams ends the replication streams being served. It's meant to be
+// registered with http.Server.RegisterOnShutdown, since Shutdown would
+// otherwise wait for streams that never finish on their own.
+func (s *Server) CloseStreams() {
+	s.closeStreams()
+}
+
+// SetIPRules replaces the client IP rules; nil turns IP filtering off.
+func (s *Server) SetIPRules(rules *IPRules) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	next := *s.settings.Load()
+	next.ipRules = rules
+	s.settings.Store(&next)
+}
+
+// Reload applies the settings of cfg that can change while the server runs:
+// the admin key, the IP rules and the concurrency limits. The other fields
+// are ignored. Requests already admitted finish under the old settings.
+func (s *Server) Reload(cfg Config) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.settings.Load()
+
+	s.settings.Store(&settings{
+		adminKey:     cfg.AdminKey,
+		ipRules:      cfg.IPRules,
+		readLimiter:  old.readLimiter.resize(cfg.MaxInflightReads, cfg.LimitWait),
+		writeLimiter: old.writeLimiter.resize(cfg.MaxInflightWrites, cfg.LimitWait),
+	})
+}
+
+// Routes selects the routes a router serves.
+type Routes int
+
+const (
+	AllRoutes   Routes = iota // The whole API, on one listener
+	DataRoutes                // The key API, for a listener beside an admin one
+	AdminRoutes               // Readiness, metrics, profiles, stats and the admin, export and replication endpoints
+)
+
+// NewRouter returns the handler serving the whole API of s.
+func NewRouter(s *Server) http.Handler {
+	return NewRouterFor(s, AllRoutes)
+}
+
+// NewRouterFor returns the handler serving the routes of s that routes
+// selects; the others answer 404. Profiles are only served with
+// AdminRoutes, so that they are never on a public port by default.
+func NewRouterFor(s *Server, routes Routes) http.Handler {
+	r := mux.NewRouter().UseEncodedPath()
+
+	r.Use(nameSpanAfterRoute)
+	r.Use(s.meterUsage)
+	r.Use(s.v1Compat)
+	r.Use(loggingMiddleware)
+	r.Use(s.measureLoad)
+	r.Use(s.auditRequests)
+	r.Use(s.filterIPs)
+	r.Use(s.authenticateRequests)
+	r.Use(s.authorizeRequests)
+
+	// Without a cluster, requests don't even pass through the middleware
+	if s.cluster != nil {
+		r.Use(s.routeToLeader)
+	}
+
+	r.Use(s.writeAsPrincipal)
+	r.Use(s.applyDeadline)
+	r.Use(s.limitConcurrency)
+	r.Use(s.dryRun)
+	r.Use(s.forceWrites)
+
+	// Without an injector, requests don't even pass through the middleware
+	if s.faults != nil {
+		r.Use(s.injectFaults)
+	}
+
+	if s.mirror != nil {
+		r.Use(s.refuseWrites)
+	}
+
+	if routes != DataRoutes {
+		s.adminRoutes(r)
+	}
+	if routes == AdminRoutes {
+		s.profileRoutes(r)
+	}
+	if routes != AdminRoutes {
+		s.dataRoutes(r)
+	}
+
+	// otelhttp picks up incoming traceparent headers, so request spans join
+	// the caller's trace
+	return otelhttp.NewHandler(withRequestID(recoverPanics(r)), "kvstore")
+}
+
+// dataRoutes adds the key API to r, under each of apiVersions.
+func (s *Server) dataRoutes(r *mux.Router) {
+	for _, v := range apiVersions {
+		r.HandleFunc(v+"/key/{key}", s.putHandler).Methods("PUT")
+		r.HandleFunc(v+"/key/{key}", s.patchHandler).Methods("PATCH")
+		r.HandleFunc(v+"/key/{key}", s.getHandler).Methods("GET", "HEAD")
+		r.HandleFunc(v+"/key/{key}", s.deleteHandler).Methods("DELETE")
+
+		r.HandleFunc(v+"/buckets", s.listBucketsHandler).Methods("GET")
+		r.HandleFunc(v+"/keys", s.keysHandler).Methods("GET")
+		r.HandleFunc(v+"/keys", s.bulkHandler).Methods("POST")
+		r.HandleFunc(v+unversioned(SnapshotReadPath), s.snapshotReadHandler).Methods("POST")
+		r.HandleFunc(v+unversioned(TxnPath), s.txnHandler).Methods("POST")
+		r.Handle(v+"/keys", s.requireAdmin(http.HandlerFunc(s.deleteKeysHandler))).Methods("DELETE")
+		r.Handle(v+"/buckets/{bucket}", s.requireAdmin(http.HandlerFunc(s.dropBucketHandler))).Methods("DELETE")
+
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}", s.putHandler).Methods("PUT")
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}", s.patchHandler).Methods("PATCH")
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}", s.getHandler).Methods("GET", "HEAD")
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}", s.deleteHandler).Methods("DELETE")
+
+		r.HandleFunc(v+"/key/{key}/cas", s.casHandler).Methods("POST")
+		r.HandleFunc(v+"/key/{key}/incr", s.incrHandler).Methods("POST")
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}/cas", s.casHandler).Methods("POST")
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}/incr", s.incrHandler).Methods("POST")
+
+		r.HandleFunc(v+"/key/{key}/lease", s.acquireLeaseHandler).Methods("POST")
+		r.HandleFunc(v+"/key/{key}/lease", s.releaseLeaseHandler).Methods("DELETE")
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}/lease", s.acquireLeaseHandler).Methods("POST")
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}/lease", s.releaseLeaseHandler).Methods("DELETE")
+
+		r.HandleFunc(v+"/key/", s.emptyKeyHandler)
+		r.HandleFunc(v+"/buckets/{bucket}/key/", s.emptyKeyHandler)
+
+		r.HandleFunc(v, s.notAllowedHandler)
+		r.HandleFunc(v+"/key/{key}", s.notAllowedHandler)
+		r.HandleFunc(v+"/buckets", s.notAllowedHandler)
+		r.HandleFunc(v+"/buckets/{bucket}", s.notAllowedHandler)
+		r.HandleFunc(v+"/buckets/{bucket}/key/{key}", s.notAllowedHandler)
+	}
+}
+
+// adminRoutes adds the operational endpoints to r.
+func (s *Server) adminRoutes(r *mux.Router) {
+	if s.faults != nil {
+		r.Handle(ChaosPath, s.requireAdmin(http.HandlerFunc(s.chaosHandler))).Methods("GET", "PUT")
+	}
+	if s.shadow != nil {
+		r.Handle(ShadowPath, s.requireAdmin(http.HandlerFunc(s.shadowHandler))).Methods("GET", "PUT")
+	}
+
+	r.Handle("/v1/export", s.requireAdmin(http.HandlerFunc(s.exportHandler))).Methods("GET")
+	r.Handle("/v1/snapshot", s.requireAdmin(http.HandlerFunc(s.snapshotHandler))).Methods("GET")
+	r.Handle(ChangesPath, s.requireAdmin(http.HandlerFunc(s.changesHandler))).Methods("GET")
+	r.Handle(ChangesPath+"/{sequence}/value", s.requireAdmin(http.HandlerFunc(s.changeValueHandler))).Methods("GET")
+
+	r.HandleFunc("/readyz", s.readyzHandler).Methods("GET", "HEAD")
+	r.Handle("/metrics", metricsHandler()).Methods("GET")
+	r.HandleFunc("/v1/stats", s.statsHandler).Methods("GET")
+	r.Handle("/v1/admin/maintenance", s.requireAdmin(http.HandlerFunc(s.maintenanceHandler))).Methods("GET", "POST")
+	r.Handle("/v1/admin/fsck", s.requireAdmin(http.HandlerFunc(s.fsckHandler))).Methods("GET", "POST")
+	r.Handle("/v1/admin/log-stats", s.requireAdmin(http.HandlerFunc(s.logStatsHandler))).Methods("GET")
+	r.Handle("/v1/admin/reencrypt", s.requireAdmin(http.HandlerFunc(s.reencryptHandler))).Methods("POST")
+	r.Handle("/v1/admin/diag", s.requireAdmin(http.HandlerFunc(s.diagHandler))).Methods("GET")
+	r.Handle(InfoPath, s.requireAdmin(http.HandlerFunc(s.infoHandler))).Methods("GET")
+	r.Handle(RenameBucketPath, s.requireAdmin(http.HandlerFunc(s.renameBucketHandler))).Methods("POST")
+	r.Handle(ScalingSignalsPath, s.requireAdmin(http.HandlerFunc(s.scalingSignalsHandler))).Methods("GET")
+	r.Handle(BatchesPath, s.requireAdmin(http.HandlerFunc(s.batchesHandler))).Methods("GET")
+	if s.usage != nil {
+		r.Handle(UsagePath, s.requireAdmin(http.HandlerFunc(s.usageHandler))).Methods("GET")
+	}
+	if s.hotKeys != nil {
+		r.Handle(HotKeysPath, s.requireAdmin(http.HandlerFunc(s.hotKeysHandler))).Methods("GET", "DELETE")
+	}
+
+	r.Handle(replication.EventsPath, s.requireAdmin(http.HandlerFunc(s.replicationEventsHandler))).Methods("GET")
+	r.Handle(replication.RestoreSnapshotPath, s.requireAdmin(http.HandlerFunc(s.restoreSnapshotHandler))).Methods("POST")
+}
+
+// profileRoutes adds the runtime profiles of net/http/pprof to r, under
+// /debug/pprof/. They reveal the process's internals, and a CPU profile
+// runs for as long as the client asks, so they require the admin key.
+func (s *Server) profileRoutes(r *mux.Router) {
+	r.Handle("/debug/pprof/cmdline", s.requireAdmin(http.HandlerFunc(pprof.Cmdline))).Methods("GET")
+	r.Handle("/debug/pprof/profile", s.requireAdmin(http.HandlerFunc(pprof.Profile))).Methods("GET")
+	r.Handle("/debug/pprof/symbol", s.requireAdmin(http.HandlerFunc(pprof.Symbol))).Methods("GET", "POST")
+	r.Handle("/debug/pprof/trace", s.requireAdmin(http.HandlerFunc(pprof.Trace))).Methods("GET")
+	r.PathPrefix("/debug/pprof/").Handler(s.requireAdmin(http.HandlerFunc(pprof.Index))).Methods("GET")
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"context"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"testing"
+)
+
+func TestRoutesPartition(t *testing.T) {
+	st := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	if err := st.PutCtx(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(st, Config{AdminKey: "secret"})
+	admin := make(http.Header)
+	admin.Set("X-API-Key", "secret")
+
+	data := []string{"/v1/key/k", "/v2/key/k", "/v2/buckets", "/v2/keys"}
+	operational := []string{"/readyz", "/metrics", "/v1/stats", "/v1/export", "/v1/snapshot", "/v1/admin/maintenance", "/v1/admin/log-stats"}
+	profiles := []string{"/debug/pprof/", "/debug/pprof/cmdline"}
+
+	for _, c := range []struct {
+		name                      string
+		routes                    Routes
+		data, operational, pprofs bool
+	}{
+		{"all", AllRoutes, true, true, false},
+		{"data", DataRoutes, true, false, false},
+		{"admin", AdminRoutes, false, true, true},
+	} {
+		h := NewRouterFor(s, c.routes)
+
+		// check checks that each of paths is served if want, and answers 404
+		// otherwise
+		check := func(paths []string, want bool) {
+			t.Helper()
+
+			for _, path := range paths {
+				w := serve(h, "GET", path, "", admin)
+				if served := w.Code != http.StatusNotFound; served != want {
+					t.Errorf("GET %s on the %s routes: %d", path, c.name, w.Code)
+				}
+			}
+		}
+
+		check(data, c.data)
+		check(operational, c.operational)
+		check(profiles, c.pprofs)
+	}
+}
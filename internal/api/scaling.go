@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"math"
+	"net/http"
+	"runtime/metrics"
+	"strings"
+	"time"
+)
+
+// ScalingSignalsPath is the endpoint of the signals autoscalers poll.
+const ScalingSignalsPath = "/v1/admin/scaling-signals"
+
+// ScalingTargets are what one instance is meant to handle, for the
+// suggested replicas of ScalingSignalsPath. A zero target is ignored.
+type ScalingTargets struct {
+	RequestsPerSecond float64       // Reads and writes per second over the last minute
+	P99               time.Duration // 99th percentile latency over the last minute
+	LogQueueDepth     int64         // Events waiting for the transaction log
+	MemoryBytes       uint64        // Memory taken from the OS and still held
+}
+
+// scalingSignals is the body of ScalingSignalsPath.
+type scalingSignals struct {
+	Time          time.Time   `json:"time"`
+	Requests1m    loadSummary `json:"requests_1m"`
+	Requests5m    loadSummary `json:"requests_5m"`
+	LogQueueDepth int64       `json:"log_queue_depth"`
+	LogLagSeconds float64     `json:"log_lag_seconds"` // How long the log writers have gone without taking a queued event
+	Keys          int64       `json:"keys"`
+	MemoryBytes   uint64      `json:"memory_bytes"`
+
+	// LoadFactor is the load this instance sees over what it's meant to
+	// handle, by its most loaded signal; SuggestedReplicas rounds it up. To
+	// size a fleet, sum the load factors of its instances
+	LoadFactor        float64 `json:"load_factor"`
+	SuggestedReplicas int     `json:"suggested_replicas"`
+}
+
+// isKeyRequest reports whether r is a request of the key API, which the
+// load window counts, rather than an admin or monitoring one.
+func isKeyRequest(r *http.Request) bool {
+	path := unversioned(r.URL.Path)
+	if path == r.URL.Path {
+		return false // Not under an API version
+	}
+
+	for _, prefix := range []string{"/key/", "/keys", "/buckets", unversioned(SnapshotReadPath), unversioned(TxnPath)} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isReadRequest reports whether r only reads: a GET, a HEAD or a snapshot
+// read.
+func isReadRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead ||
+		r.Method == http.MethodPost && unversioned(r.URL.Path) == unversioned(SnapshotReadPath)
+}
+
+// measureLoad counts the requests of the key API in s.load, with the time
+// they took, waits for a concurrency slot included.
+func (s *Server) measureLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isKeyRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		next.ServeHTTP(w, r)
+
+		now := time.Now()
+		s.load.observe(now, !isReadRequest(r), now.Sub(start))
+	})
+}
+
+// memorySamples name the memory the Go runtime holds from the OS, less what
+// it returned.
+var memorySamples = []string{"/memory/classes/total:bytes", "/memory/classes/heap/released:bytes"}
+
+// memoryInUse returns the memory the process holds, as the Go runtime
+// accounts it. Unlike runtime.ReadMemStats, it doesn't stop the world.
+func memoryInUse() uint64 {
+	samples := make([]metrics.Sample, len(memorySamples))
+	for i, name := range memorySamples {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+
+	var held [2]uint64
+	for i, sample := range samples {
+		if sample.Value.Kind() == metrics.KindUint64 {
+			held[i] = sample.Value.Uint64()
+		}
+	}
+
+	return held[0] - min(held[0], held[1])
+}
+
+// scalingSignals returns the signals as of now, reading counters only, so
+// that neither the store nor the logger is held up.
+func (s *Server) scalingSignals(now time.Time) scalingSignals {
+	depth, lag := translog.QueueState()
+
+	signals := scalingSignals{
+		Time:          now.UTC(),
+		Requests1m:    s.load.summary(now, time.Minute),
+		Requests5m:    s.load.summary(now, 5*time.Minute),
+		LogQueueDepth: depth,
+		LogLagSeconds: lag.Seconds(),
+		Keys:          s.store.KeyCount(),
+		MemoryBytes:   memoryInUse(),
+	}
+
+	over := func(v, target float64) float64 {
+		if target <= 0 {
+			return 0
+		}
+		return v / target
+	}
+
+	t := s.scalingTargets
+	signals.LoadFactor = max(
+		over(signals.Requests1m.ReadsPerSecond+signals.Requests1m.WritesPerSecond, t.RequestsPerSecond),
+		over(signals.Requests1m.P99Seconds, t.P99.Seconds()),
+		over(float64(depth), float64(t.LogQueueDepth)),
+		over(float64(signals.MemoryBytes), float64(t.MemoryBytes)),
+	)
+	signals.SuggestedReplicas = max(1, int(math.Ceil(signals.LoadFactor)))
+
+	return signals
+}
+
+// scalingSignalsHandler responds with a compact snapshot of the load on this
+// instance, for autoscalers that can only read a simple JSON document:
+// request rates and latency over the last 1 and 5 minutes, the transaction
+// log queue, the keys and memory held, and the replicas the load suggests
+// under Config.ScalingTargets.
+func (s *Server) scalingSignalsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(s.scalingSignals(time.Now()))
+}
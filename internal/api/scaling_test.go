@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoadWindowRolls(t *testing.T) {
+	start := time.Unix(1_000_000, 0)
+	w := newLoadWindow(start)
+
+	// at returns the time sec seconds after start, half way through it
+	at := func(sec int) time.Time {
+		return start.Add(time.Duration(sec)*time.Second + 500*time.Millisecond)
+	}
+
+	// For the first minute, 10 fast reads a second; for the next, 5 slow
+	// writes a second
+	for sec := range 60 {
+		for range 10 {
+			w.observe(at(sec), false, 50*time.Microsecond)
+		}
+	}
+	for sec := 60; sec < 120; sec++ {
+		for range 5 {
+			w.observe(at(sec), true, 30*time.Millisecond)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		now    time.Time
+		span   time.Duration
+		reads  float64
+		writes float64
+		p99    time.Duration
+	}{
+		// The second under way isn't counted
+		{"the first second", at(0), time.Minute, 0, 0, 0},
+		// Before a minute has passed, the rates are over the seconds since
+		// the start
+		{"10s in", at(10), time.Minute, 10, 0, 100 * time.Microsecond},
+		{"10s in, over 5m", at(10), 5 * time.Minute, 10, 0, 100 * time.Microsecond},
+		{"the first minute", at(60), time.Minute, 10, 0, 100 * time.Microsecond},
+		// Half the last minute's requests were fast reads, half slow writes
+		{"a minute and a half in", at(90), time.Minute, 5, 2.5, 51200 * time.Microsecond},
+		{"the second minute", at(120), time.Minute, 0, 5, 51200 * time.Microsecond},
+		{"both minutes over 5m", at(120), 5 * time.Minute, 5, 2.5, 51200 * time.Microsecond},
+		// Once the requests are out of the window, nothing is left of them
+		{"idle for a minute", at(180), time.Minute, 0, 0, 0},
+		{"both minutes, 5m after the first", at(300), 5 * time.Minute, 600.0 / 300, 300.0 / 300, 51200 * time.Microsecond},
+		{"5m after the last", at(420), 5 * time.Minute, 0, 0, 0},
+	} {
+		got := w.summary(tt.now, tt.span)
+		want := loadSummary{ReadsPerSecond: tt.reads, WritesPerSecond: tt.writes, P99Seconds: tt.p99.Seconds()}
+		if got != want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, want)
+		}
+	}
+
+	// A second's slot is reused once it's out of every window, with none of
+	// the requests counted in it before
+	w.observe(at(300), true, time.Millisecond)
+	if got := w.summary(at(301), time.Second); got.ReadsPerSecond != 0 || got.WritesPerSecond != 1 {
+		t.Errorf("the second reusing the first's slot: %+v", got)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latency := make([]uint64, latencyBuckets+1)
+
+	// 99 fast requests and a slow one: the slow one is past the 99th
+	// percentile, until there's another
+	latency[latencyBucket(100*time.Microsecond)] = 99
+	latency[latencyBucket(time.Second)] = 1
+	if p := percentile(latency, 100, 0.99); p != 100*time.Microsecond {
+		t.Errorf("p99 with 1%% slow: %s", p)
+	}
+
+	latency[latencyBucket(time.Second)] = 2
+	if p := percentile(latency, 101, 0.99); p != latencyBounds[latencyBucket(time.Second)] {
+		t.Errorf("p99 with 2%% slow: %s", p)
+	}
+
+	// Requests slower than the last bound are reported as twice it
+	latency = make([]uint64, latencyBuckets+1)
+	latency[latencyBuckets] = 1
+	if p := percentile(latency, 1, 0.99); p != 2*latencyBounds[latencyBuckets-1] {
+		t.Errorf("p99 of a request past the last bound: %s", p)
+	}
+}
+
+func TestScalingSignals(t *testing.T) {
+	cfg := Config{AdminKey: "secret", ScalingTargets: ScalingTargets{RequestsPerSecond: 2}}
+	st, _, closeLog := openRouter(t, t.TempDir(), cfg)
+	defer closeLog()
+
+	s := NewServer(st, cfg)
+	h := NewRouter(s)
+
+	admin := make(http.Header)
+	admin.Set("X-API-Key", "secret")
+
+	// Synthetic load: puts, gets and snapshot reads, which count, and admin
+	// requests, which don't
+	for i := range 30 {
+		key := fmt.Sprintf("/v1/key/k%d", i%5)
+		serve(h, "PUT", key, "v", nil)
+		serve(h, "GET", key, "", nil)
+		serve(h, "POST", SnapshotReadPath, `{"keys":["k0"]}`, nil)
+		serve(h, "GET", ScalingSignalsPath, "", admin)
+	}
+
+	// A second on, the requests made so far are all in complete seconds
+	now := time.Now().Add(time.Second)
+	signals := s.scalingSignals(now)
+
+	secs := float64(now.Unix() - 1 - s.load.start.Unix() + 1)
+	if signals.Requests1m.ReadsPerSecond != 60/secs || signals.Requests1m.WritesPerSecond != 30/secs {
+		t.Errorf("requests over %.0fs: %+v", secs, signals.Requests1m)
+	}
+	if signals.Requests5m != signals.Requests1m {
+		t.Errorf("requests over 5m %+v, over 1m %+v, of the same requests", signals.Requests5m, signals.Requests1m)
+	}
+	if signals.Keys != 5 || signals.MemoryBytes == 0 {
+		t.Errorf("keys %d, memory %d", signals.Keys, signals.MemoryBytes)
+	}
+
+	// 90 requests a second or so, against a target of 2 an instance
+	load := 90 / secs / 2
+	if signals.LoadFactor < load || signals.SuggestedReplicas < int(load) {
+		t.Errorf("load factor %.2f, %d replicas suggested, for a load of %.2f", signals.LoadFactor, signals.SuggestedReplicas, load)
+	}
+
+	// The endpoint serves the same document, cheaply
+	fastest := time.Hour
+	for range 100 {
+		start := time.Now()
+		w := serve(h, "GET", ScalingSignalsPath, "", admin)
+		fastest = min(fastest, time.Since(start))
+
+		var got scalingSignals
+		if err := json.Unmarshal(w.Body.Bytes(), &got); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET %s: %d %s", ScalingSignalsPath, w.Code, w.Body.String())
+		}
+	}
+	if fastest > time.Millisecond {
+		t.Errorf("GET %s took at least %s", ScalingSignalsPath, fastest)
+	}
+
+	if w := serve(h, "GET", ScalingSignalsPath, "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("GET %s without the admin key: %d", ScalingSignalsPath, w.Code)
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultScanCacheTTL is how long a scan result is kept by default, even
+// if the store doesn't change.
+const DefaultScanCacheTTL = 5 * time.Second
+
+// scanEntryOverhead approximates the memory a cached result takes besides
+// its key and body, for the cache's budget.
+const scanEntryOverhead = 128
+
+var scanCacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kv_scan_cache_requests_total",
+	Help: "Number of scan requests looked up in the scan cache, by result: hit or miss.",
+}, []string{"result"})
+
+var scanCacheEvictionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kv_scan_cache_evictions_total",
+	Help: "Number of results evicted from the scan cache to stay within its budget.",
+})
+
+var scanCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "kv_scan_cache_bytes",
+	Help: "Approximate memory taken by the results in the scan cache, in bytes.",
+})
+
+// ScanCacheStatus counts what a ScanCache did since it was created.
+type ScanCacheStatus struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Budget    int64  `json:"budget"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// ScanCache keeps the responses of the expensive reads ranging over many
+// keys, key listings and snapshot reads, so that the same request repeated
+// by a dashboard is answered without scanning the store again. A result is
+// kept with the store's generation it was computed at, as
+// store.Store.Generation reports it, and only served while the store is
+// still at that generation: any write, to any key, invalidates every
+// result. Results are also dropped after their TTL, and the least recently
+// used ones once the cache takes more memory than its budget.
+type ScanCache struct {
+	budget int64
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // Elements of lru, by request
+	lru     *list.List               // Of *scanResult, the most recently used first
+	bytes   int64
+
+	hits, misses, evictions uint64
+}
+
+// scanResult is a response kept by a ScanCache.
+type scanResult struct {
+	key         string
+	expires     time.Time
+	contentType string
+	body        []byte
+
+	seq, changes uint64 // Generation of the store the response was computed at
+}
+
+func (e *scanResult) size() int64 {
+	return int64(len(e.key)+len(e.body)) + scanEntryOverhead
+}
+
+// NewScanCache returns a cache keeping results in at most budget bytes, for
+// at most ttl, or DefaultScanCacheTTL if 0.
+func NewScanCache(budget int64, ttl time.Duration) *ScanCache {
+	if ttl <= 0 {
+		ttl = DefaultScanCacheTTL
+	}
+
+	return &ScanCache{
+		budget:  budget,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// scanKey returns the cache key of the operation op with the given
+// parameters, which are told apart however they are written.
+func scanKey(op string, params ...string) string {
+	var b strings.Builder
+	b.WriteString(op)
+	for _, p := range params {
+		// Prefixed with its length, so no parameter runs into the next
+		fmt.Fprintf(&b, " %d:%s", len(p), p)
+	}
+
+	return b.String()
+}
+
+// get returns the result kept under key if the store is still at the
+// generation seq and changes, and it hasn't expired.
+func (c *ScanCache) get(key string, seq, changes uint64) (*scanResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		e := elem.Value.(*scanResult)
+		if e.seq == seq && e.changes == changes && time.Now().Before(e.expires) {
+			c.lru.MoveToFront(elem)
+			c.hits++
+			scanCacheRequestsTotal.WithLabelValues("hit").Inc()
+			return e, true
+		}
+
+		c.remove(elem)
+	}
+
+	c.misses++
+	scanCacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	return nil, false
+}
+
+// put keeps e, evicting the least recently used results until it fits. A
+// result larger than the whole budget isn't kept.
+func (c *ScanCache) put(e *scanResult) {
+	if e.size() > c.budget {
+		return
+	}
+
+	e.expires = time.Now().Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[e.key]; ok {
+		c.remove(elem)
+	}
+
+	for c.bytes+e.size() > c.budget {
+		c.remove(c.lru.Back())
+		c.evictions++
+		scanCacheEvictionsTotal.Inc()
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size()
+	scanCacheBytes.Set(float64(c.bytes))
+}
+
+// remove drops the result of elem. The caller must hold c.mu.
+func (c *ScanCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*scanResult)
+	delete(c.entries, e.key)
+	c.bytes -= e.size()
+	scanCacheBytes.Set(float64(c.bytes))
+}
+
+// Status returns the cache's counts.
+func (c *ScanCache) Status() ScanCacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ScanCacheStatus{
+		Entries:   len(c.entries),
+		Bytes:     c.bytes,
+		Budget:    c.budget,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// ScanCacheHeader is set to hit on a response served from the scan cache,
+// and to miss on one that could have been but was computed afresh.
+const ScanCacheHeader = "X-KV-Scan-Cache"
+
+// serveScan answers a scan request, identified by key, from the scan cache
+// if it holds a current result, and with compute otherwise, keeping the
+// result if compute succeeds. compute returns the response body, or an
+// error written as usual; contentType is that of the body. Without a scan
+// cache every request is computed.
+func (s *Server) serveScan(w http.ResponseWriter, key, contentType string, compute func() ([]byte, error)) {
+	if s.scans == nil {
+		body, err := compute()
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+		return
+	}
+
+	// Read before computing, so that a write made meanwhile leaves a result
+	// that will never be served, rather than one served stale
+	seq, changes := s.store.Generation()
+
+	if e, ok := s.scans.get(key, seq, changes); ok {
+		w.Header().Set("Content-Type", e.contentType)
+		w.Header().Set(ScanCacheHeader, "hit")
+		w.Write(e.body)
+		return
+	}
+
+	body, err := compute()
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.scans.put(&scanResult{key: key, seq: seq, changes: changes, contentType: contentType, body: body})
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set(ScanCacheHeader, "miss")
+	w.Write(body)
+}
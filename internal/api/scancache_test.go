@@ -0,0 +1,278 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScanCacheNeverServesAResultAfterAWrite(t *testing.T) {
+	ctx := context.Background()
+
+	// Unlogged, as on a replica, so that a snapshot can be restored
+	st := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	h := NewRouter(NewServer(st, Config{ScanCache: NewScanCache(1<<20, time.Hour)}))
+
+	// plain answers every request afresh, from the same store
+	plain := NewRouter(NewServer(st, Config{}))
+
+	for i := range 5 {
+		if err := st.PutCtx(ctx, fmt.Sprintf("s/%d", i), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := st.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	scans := []struct {
+		method, path, body string
+	}{
+		{"GET", "/v1/keys", ""},
+		{"GET", "/v1/keys?prefix=s/", ""},
+		{"GET", "/v1/keys?sort=size&order=desc&limit=3&meta=true", ""},
+		{"GET", "/v1/keys?sort=modified&meta=true", ""},
+		{"POST", SnapshotReadPath, `{"keys":["s/0","s/1","s/9"]}`},
+		{"POST", SnapshotReadPath, `{"prefix":"s/"}`},
+	}
+
+	// body returns the body of w, but for the cursor, which each server
+	// signs with its own secret
+	body := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+
+		var v any
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatalf("%s: %v", w.Body.String(), err)
+		}
+		if fields, ok := v.(map[string]any); ok {
+			delete(fields, "next_cursor")
+		}
+
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// check makes every scan twice, expecting the first to be computed and
+	// to match a fresh answer, and the second to be served from the cache
+	check := func(after string) {
+		t.Helper()
+
+		for _, scan := range scans {
+			want := body(serve(plain, scan.method, scan.path, scan.body, nil))
+
+			for i, result := range []string{"miss", "hit"} {
+				w := serve(h, scan.method, scan.path, scan.body, nil)
+				if got := body(w); w.Code != http.StatusOK || got != want {
+					t.Errorf("%s %s %s after %s: %d %s, want %s", scan.method, scan.path, scan.body, after, w.Code, got, want)
+				}
+				if got := w.Header().Get(ScanCacheHeader); got != result {
+					t.Errorf("%s %s %s #%d after %s: a cache %s, want a %s", scan.method, scan.path, scan.body, i, after, got, result)
+				}
+			}
+		}
+	}
+
+	check("the first writes")
+
+	for _, tt := range []struct {
+		name  string
+		write func() error
+	}{
+		{"a put of a value of the same size", func() error {
+			return st.PutCtx(ctx, "s/1", "x")
+		}},
+		{"a put of a new key", func() error {
+			return st.PutCtx(ctx, "s/9", "new")
+		}},
+		{"a delete", func() error {
+			return st.DeleteCtx(ctx, "s/0")
+		}},
+		{"a write to another bucket", func() error {
+			return st.BucketPut(ctx, "other", "s/1", "v")
+		}},
+		{"an unlogged put", func() error {
+			return st.PutCtx(store.WithDurability(ctx, store.DurabilityNone), "s/2", "unlogged")
+		}},
+		{"a transaction", func() error {
+			_, err := st.Txn(ctx, store.Txn{Then: []store.TxnOp{
+				{Type: store.TxnPut, Key: "s/3", Value: "txn"},
+				{Type: store.TxnDelete, Key: "s/4"},
+			}})
+			return err
+		}},
+		{"a put over HTTP", func() error {
+			if w := serve(h, "PUT", "/v1/key/t", "http", nil); w.Code != http.StatusCreated {
+				return fmt.Errorf("PUT t: %d %s", w.Code, w.Body.String())
+			}
+			return nil
+		}},
+		// Restoring the snapshot takes the sequence back, so the put after
+		// it brings the sequence to one a cached result was computed at
+		{"a restore of an older snapshot", func() error {
+			return st.Restore(bytes.NewReader(snapshot.Bytes()))
+		}},
+		{"a put taking the sequence where it was before the restore", func() error {
+			for range 7 {
+				if err := st.PutCtx(ctx, "s/1", "again"); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	} {
+		if err := tt.write(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		check(tt.name)
+	}
+}
+
+func TestScanCacheUnderConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+
+	st, h, closeLog := openRouter(t, t.TempDir(), Config{ScanCache: NewScanCache(1<<20, time.Hour)})
+	defer closeLog()
+
+	if err := st.PutCtx(ctx, "n", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer counts n up, noting each value once its write returns
+	var written atomic.Int64
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := int64(1); !stop.Load(); i++ {
+			if err := st.PutCtx(ctx, "n", strconv.FormatInt(i, 10)); err != nil {
+				t.Error(err)
+				return
+			}
+			written.Store(i)
+
+			// Pauses let readers hit the cache between writes
+			if i%10 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	// No read returns a value older than one written before it was made
+	var hits atomic.Int64
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			for range 1000 {
+				floor := written.Load()
+
+				w := serve(h, "POST", SnapshotReadPath, `{"keys":["n"]}`, nil)
+				var resp struct {
+					Values []struct {
+						Value *string
+					}
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Values) != 1 || resp.Values[0].Value == nil {
+					t.Errorf("POST %s: %d %s", SnapshotReadPath, w.Code, w.Body.String())
+					return
+				}
+
+				n, err := strconv.ParseInt(*resp.Values[0].Value, 10, 64)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n < floor {
+					t.Errorf("read n = %d, a %s, after %d was written", n, w.Header().Get(ScanCacheHeader), floor)
+					return
+				}
+				if w.Header().Get(ScanCacheHeader) == "hit" {
+					hits.Add(1)
+				}
+			}
+		}()
+	}
+	readers.Wait()
+
+	stop.Store(true)
+	wg.Wait()
+
+	if hits.Load() == 0 {
+		t.Error("no read was served from the cache")
+	}
+}
+
+func TestScanCacheBudgetAndTTL(t *testing.T) {
+	// result returns a result of key with a body of n bytes, at generation 1
+	result := func(key string, n int) *scanResult {
+		return &scanResult{key: key, seq: 1, body: bytes.Repeat([]byte("x"), n)}
+	}
+
+	// Room for two results of 100 bytes, not three
+	size := result("a", 100).size()
+	c := NewScanCache(2*size+size/2, time.Hour)
+
+	c.put(result("a", 100))
+	c.put(result("b", 100))
+	if _, ok := c.get("a", 1, 0); !ok {
+		t.Fatal("a isn't cached")
+	}
+
+	// The least recently used result goes first
+	c.put(result("c", 100))
+	if _, ok := c.get("b", 1, 0); ok {
+		t.Error("b, the least recently used, wasn't evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key, 1, 0); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	// Nor is a result served at another generation, nor kept if larger
+	// than the whole budget
+	if _, ok := c.get("a", 2, 0); ok {
+		t.Error("a served at a later sequence")
+	}
+	if _, ok := c.get("c", 1, 1); ok {
+		t.Error("c served after a change")
+	}
+	c.put(result("huge", 1000))
+	if _, ok := c.get("huge", 1, 0); ok {
+		t.Error("a result larger than the budget was kept")
+	}
+
+	status := c.Status()
+	if status.Entries != 0 || status.Bytes != 0 || status.Evictions != 1 || status.Hits != 3 {
+		t.Errorf("status: %+v", status)
+	}
+
+	// Results expire after the TTL, whatever the store does
+	c = NewScanCache(1<<20, 10*time.Millisecond)
+	c.put(result("a", 1))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get("a", 1, 0); ok {
+		t.Error("a served past its TTL")
+	}
+}
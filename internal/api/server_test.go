@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServersAreIsolated(t *testing.T) {
+	ctx := context.Background()
+
+	// Two servers in one process, each over a store of its own that logs
+	// nowhere, with another admin key
+	stores := [2]*store.Store{}
+	servers := [2]*Server{}
+	routers := [2]http.Handler{}
+	for i, key := range []string{"a", "b"} {
+		stores[i] = store.New(translog.NewNopTransactionLogger(), store.Options{})
+		servers[i] = NewServer(stores[i], Config{AdminKey: key})
+		routers[i] = NewRouter(servers[i])
+	}
+	a, b := routers[0], routers[1]
+
+	// The key routes reach the store of the server they were built for
+	for _, req := range []struct {
+		method, path, body string
+		want               int
+		wantBody           string
+	}{
+		{"PUT", "/v1/key/k", "1", http.StatusCreated, ""},
+		{"PUT", "/v1/buckets/bk/key/k", "x", http.StatusCreated, ""},
+		{"POST", "/v1/key/k/incr", `{"delta": 2}`, http.StatusOK, `{"value":3}`},
+		{"POST", "/v1/key/k/cas", `{"expected": "3", "value": "4"}`, http.StatusOK, ""},
+		{"GET", "/v1/key/k", "", http.StatusOK, "4"},
+		{"GET", "/v1/buckets/bk/key/k", "", http.StatusOK, "x"},
+		{"DELETE", "/v1/buckets/bk/key/k", "", http.StatusOK, ""},
+	} {
+		w := serve(a, req.method, req.path, req.body, nil)
+		if w.Code != req.want || req.wantBody != "" && strings.TrimSpace(w.Body.String()) != req.wantBody {
+			t.Errorf("%s %s: %d %q, want %d %q", req.method, req.path, w.Code, w.Body, req.want, req.wantBody)
+		}
+	}
+
+	if v, err := stores[0].Get("k"); err != nil || v != "4" {
+		t.Errorf("k in the store of the first server: %q, %v", v, err)
+	}
+	if _, err := stores[1].Get("k"); !errors.Is(err, store.ErrorNoSuchKey) {
+		t.Errorf("k in the store of the second server: %v, want ErrorNoSuchKey", err)
+	}
+
+	// Nor does the other server see them
+	if w := serve(b, "GET", "/v1/key/k", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET k on the second server: %d %s", w.Code, w.Body)
+	}
+	if err := stores[1].PutCtx(ctx, "k", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(a, "GET", "/v1/key/k", "", nil); w.Body.String() != "4" {
+		t.Errorf("GET k on the first server once the second's store has it: %d %s", w.Code, w.Body)
+	}
+
+	// Each server takes its own admin key
+	admin := make(http.Header)
+	admin.Set("X-API-Key", "a")
+	if w := serve(a, "GET", "/v1/admin/maintenance", "", admin); w.Code != http.StatusOK {
+		t.Errorf("the first server's admin key on the first server: %d %s", w.Code, w.Body)
+	}
+	if w := serve(b, "GET", "/v1/admin/maintenance", "", admin); w.Code == http.StatusOK {
+		t.Errorf("the first server's admin key on the second server: %d", w.Code)
+	}
+
+	// And its own IP rules
+	servers[0].SetIPRules(loadRules(t, "allow 10.0.0.0/8"))
+	if w := serve(a, "GET", "/v1/key/k", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("GET from outside the first server's rules: %d", w.Code)
+	}
+	if w := serve(b, "GET", "/v1/key/k", "", nil); w.Code != http.StatusOK {
+		t.Errorf("GET on the second server, without rules: %d", w.Code)
+	}
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowPath is the admin endpoint reporting the shadow's comparisons and
+// setting the share of reads compared.
+const ShadowPath = "/v1/admin/shadow"
+
+// DefaultShadowBudget is how long a comparison waits for the shadow by
+// default.
+const DefaultShadowBudget = 50 * time.Millisecond
+
+const (
+	shadowQueueSize      = 4096 // Writes waiting for the shadow before more are dropped
+	maxShadowComparisons = 64   // Comparisons running at once before more reads are skipped
+)
+
+var shadowWritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kv_shadow_writes_total",
+	Help: "Number of writes passed on to the shadow store, by result: applied, dropped or error.",
+}, []string{"result"})
+
+var shadowReadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kv_shadow_reads_total",
+	Help: "Number of reads compared with the shadow store, by result: match, mismatch, lagging, error or skipped.",
+}, []string{"result"})
+
+// ShadowStatus counts what a Shadow did since it started.
+type ShadowStatus struct {
+	SamplePercent float64 `json:"sample_percent"`
+
+	WritesApplied uint64 `json:"writes_applied"`
+	WritesDropped uint64 `json:"writes_dropped"` // Writes the shadow fell too far behind to take
+	WriteErrors   uint64 `json:"write_errors"`
+
+	Matches    uint64 `json:"matches"`
+	Mismatches uint64 `json:"mismatches"`
+	Lagging    uint64 `json:"lagging"` // Reads the shadow didn't catch up with within the budget
+	ReadErrors uint64 `json:"read_errors"`
+	Skipped    uint64 `json:"skipped"` // Reads sampled while too many comparisons were running
+}
+
+// Shadow verifies a store about to replace another, such as one on a new
+// backend, by comparing it with the store in use. Every write made to the
+// primary is passed on to the shadow, in order, and a share of the reads
+// served from the primary is compared with the shadow, off the request
+// path: the shadow is never waited for by clients. A comparison waits for
+// the shadow to catch up with the primary for at most its budget.
+//
+// Writes reach the shadow as the primary logged them, keeping their
+// sequence numbers, so the shadow must encrypt values with the same keys
+// and find its blobs in the same directory. The shadow is expected to start
+// with the primary's contents, such as by a migration; keys that differ
+// before then are reported like any other mismatch.
+type Shadow struct {
+	store   *store.Store
+	budget  time.Duration
+	percent atomic.Uint64 // Bits of the float64 share of reads compared, in percent
+
+	events      chan translog.Event
+	comparisons chan struct{} // Semaphore of the comparisons running
+
+	writesApplied, writesDropped, writeErrors         atomic.Uint64
+	matches, mismatches, lagging, readErrors, skipped atomic.Uint64
+}
+
+// NewShadow returns a shadow comparing st with the primary store, in
+// percent of the reads, and waiting budget for it at most, or
+// DefaultShadowBudget if 0. The primary must log with Logger, and be served
+// by a Server configured with the shadow.
+func NewShadow(st *store.Store, percent float64, budget time.Duration) (*Shadow, error) {
+	if budget <= 0 {
+		budget = DefaultShadowBudget
+	}
+
+	sh := &Shadow{
+		store:       st,
+		budget:      budget,
+		events:      make(chan translog.Event, shadowQueueSize),
+		comparisons: make(chan struct{}, maxShadowComparisons),
+	}
+
+	if err := sh.SetSamplePercent(percent); err != nil {
+		return nil, err
+	}
+
+	return sh, nil
+}
+
+// SetSamplePercent sets the share of reads compared, in percent.
+func (sh *Shadow) SetSamplePercent(percent float64) error {
+	if math.IsNaN(percent) || percent < 0 || percent > 100 {
+		return fmt.Errorf("%w: sample percent %v is not between 0 and 100", ErrorInvalidRequest, percent)
+	}
+
+	sh.percent.Store(math.Float64bits(percent))
+
+	return nil
+}
+
+func (sh *Shadow) samplePercent() float64 {
+	return math.Float64frombits(sh.percent.Load())
+}
+
+// Logger returns a logger for the primary store that logs with l and
+// passes every event logged on to the shadow.
+func (sh *Shadow) Logger(l store.Logger) store.Logger {
+	return shadowLogger{l, sh}
+}
+
+// shadowLogger is the logger of a primary store with a shadow.
+type shadowLogger struct {
+	store.Logger
+	shadow *Shadow
+}
+
+// WriteEvent implements store.Logger. The primary holds its lock while it
+// logs, so events are queued in the order they are applied.
+func (l shadowLogger) WriteEvent(ctx context.Context, e translog.Event) error {
+	if err := l.Logger.WriteEvent(ctx, e); err != nil {
+		return err
+	}
+
+	select {
+	case l.shadow.events <- e:
+	default:
+		// The shadow is too far behind; it diverges rather than slowing
+		// the primary down, and the comparisons will tell
+		l.shadow.writesDropped.Add(1)
+		shadowWritesTotal.WithLabelValues("dropped").Inc()
+	}
+
+	return nil
+}
+
+// Run applies the writes passed on to the shadow until ctx is done.
+func (sh *Shadow) Run(ctx context.Context) {
+	for {
+		select {
+		case e := <-sh.events:
+			if err := sh.store.Replicate(ctx, e); err != nil {
+				sh.writeErrors.Add(1)
+				shadowWritesTotal.WithLabelValues("error").Inc()
+				log.Printf("SHADOW-WRITE-ERROR sequence=%d: %v\n", e.Sequence, err)
+				continue
+			}
+
+			sh.writesApplied.Add(1)
+			shadowWritesTotal.WithLabelValues("applied").Inc()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sample compares, for a share of the reads, the result of a read of key
+// from primary with the shadow, in the background. seq is the primary's
+// sequence before the read, which the shadow must reach first; found is
+// false if the key wasn't there.
+func (sh *Shadow) sample(primary *store.Store, seq uint64, bucket, key, value string, found bool) {
+	if rand.Float64()*100 >= sh.samplePercent() {
+		return
+	}
+
+	select {
+	case sh.comparisons <- struct{}{}:
+	default:
+		sh.count(&sh.skipped, "skipped")
+		return
+	}
+
+	go func() {
+		defer func() { <-sh.comparisons }()
+
+		sh.compare(primary, seq, bucket, key, value, found)
+	}()
+}
+
+// compare is a single comparison for sample.
+func (sh *Shadow) compare(primary *store.Store, seq uint64, bucket, key, value string, found bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), sh.budget)
+	defer cancel()
+
+	if err := sh.store.WaitSequence(ctx, seq); err != nil {
+		sh.count(&sh.lagging, "lagging")
+		return
+	}
+
+	shadowValue, shadowFound, err := lookup(ctx, sh.store, bucket, key)
+	if err != nil {
+		sh.count(&sh.readErrors, "error")
+		return
+	}
+
+	if shadowFound == found && shadowValue == value {
+		sh.count(&sh.matches, "match")
+		return
+	}
+
+	// The shadow may be ahead of the read, if the key was written since;
+	// then it has to match the primary as it is now
+	primaryValue, primaryFound, err := lookup(ctx, primary, bucket, key)
+	if err == nil && (primaryFound != found || primaryValue != value) && primaryFound == shadowFound && primaryValue == shadowValue {
+		sh.count(&sh.matches, "match")
+		return
+	}
+
+	sh.count(&sh.mismatches, "mismatch")
+
+	log.Printf("SHADOW-MISMATCH bucket=%s key=%s primary_found=%t shadow_found=%t\n", bucket, timing.HashKey(key), found, shadowFound)
+}
+
+// lookup reads key from st, reporting false if it isn't there.
+func lookup(ctx context.Context, st *store.Store, bucket, key string) (string, bool, error) {
+	value, _, err := st.BucketGetWithMeta(ctx, bucket, key)
+	if errors.Is(err, store.ErrorNoSuchKey) {
+		return "", false, nil
+	}
+
+	return value, err == nil, err
+}
+
+func (sh *Shadow) count(n *atomic.Uint64, result string) {
+	n.Add(1)
+	shadowReadsTotal.WithLabelValues(result).Inc()
+}
+
+// Status returns the counts of the shadow's writes and comparisons.
+func (sh *Shadow) Status() ShadowStatus {
+	return ShadowStatus{
+		SamplePercent: sh.samplePercent(),
+		WritesApplied: sh.writesApplied.Load(),
+		WritesDropped: sh.writesDropped.Load(),
+		WriteErrors:   sh.writeErrors.Load(),
+		Matches:       sh.matches.Load(),
+		Mismatches:    sh.mismatches.Load(),
+		Lagging:       sh.lagging.Load(),
+		ReadErrors:    sh.readErrors.Load(),
+		Skipped:       sh.skipped.Load(),
+	}
+}
+
+// shadowHandler reports the shadow's counts on GET and sets the share of
+// reads compared on PUT, which expects a body like {"sample_percent": 5}.
+func (s *Server) shadowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req struct {
+			SamplePercent *float64 `json:"sample_percent"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SamplePercent == nil {
+			s.writeError(w, fmt.Errorf("%w: expected a body like {\"sample_percent\": 5}", ErrorInvalidRequest))
+			return
+		}
+
+		if err := s.shadow.SetSamplePercent(*req.SamplePercent); err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		log.Printf("SHADOW sample_percent=%v\n", *req.SamplePercent)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.shadow.Status())
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that can be logged to and read from
+// different goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShadowDetectsDivergence(t *testing.T) {
+	ctx := context.Background()
+
+	var logged lockedBuffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	const budget = 200 * time.Millisecond
+
+	shadowStore := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	sh, err := NewShadow(shadowStore, 100, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCtx, stopShadow := context.WithCancel(ctx)
+	defer stopShadow()
+	go sh.Run(runCtx)
+
+	primary := store.New(sh.Logger(translog.NewNopTransactionLogger()), store.Options{})
+	h := NewRouter(NewServer(primary, Config{AdminKey: "secret", Shadow: sh}))
+	admin := make(http.Header)
+	admin.Set("X-API-Key", "secret")
+
+	// get reads key as a client would, checking it gets the primary's value
+	get := func(key, want string) {
+		t.Helper()
+
+		if w := serve(h, "GET", "/v1/key/"+key, "", nil); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s: %d %q, want %q", key, w.Code, w.Body.String(), want)
+		}
+	}
+
+	const keys = 20
+	for i := range keys {
+		if w := serve(h, "PUT", fmt.Sprintf("/v1/key/k%d", i), fmt.Sprintf("v%d", i), nil); w.Code != http.StatusCreated {
+			t.Fatalf("PUT k%d: %d", i, w.Code)
+		}
+	}
+	waitFor(t, "the shadow to take the writes", func() bool { return sh.Status().WritesApplied == keys })
+
+	// While the stores agree, every read sampled matches
+	for i := range keys {
+		get(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	waitFor(t, "the reads to be compared", func() bool { return sh.Status().Matches == keys })
+
+	// Values made to differ, and a key missing from the shadow, are each
+	// detected, and logged with the key hashed, while clients still get
+	// the primary's values
+	mismatches := testutil.ToFloat64(shadowReadsTotal.WithLabelValues("mismatch"))
+
+	if err := shadowStore.Replicate(ctx, translog.Event{Sequence: keys + 1, EventType: translog.EventPut, Bucket: store.DefaultBucket, Key: "k3", Value: "diverged"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shadowStore.Replicate(ctx, translog.Event{Sequence: keys + 2, EventType: translog.EventDelete, Bucket: store.DefaultBucket, Key: "k4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	get("k3", "v3")
+	get("k4", "v4")
+	get("k5", "v5")
+
+	waitFor(t, "the divergence to be detected", func() bool {
+		st := sh.Status()
+		return st.Mismatches == 2 && st.Matches == keys+1
+	})
+	if n := testutil.ToFloat64(shadowReadsTotal.WithLabelValues("mismatch")) - mismatches; n != 2 {
+		t.Errorf("kv_shadow_reads_total{result=mismatch} rose by %v, want 2", n)
+	}
+
+	out := logged.String()
+	for _, key := range []string{"k3", "k4"} {
+		if !strings.Contains(out, "SHADOW-MISMATCH bucket=default key="+timing.HashKey(key)) {
+			t.Errorf("the mismatch of %s isn't logged with its key hashed:\n%s", key, out)
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "SHADOW-MISMATCH") && (strings.Contains(line, "key=k") || strings.Contains(line, "diverged")) {
+			t.Errorf("a mismatch logged the key or value: %s", line)
+		}
+	}
+
+	// A shadow that stopped taking writes is given up on after the budget,
+	// off the request path: reads of it are as fast as ever
+	stopShadow()
+	for i := range keys {
+		if w := serve(h, "PUT", fmt.Sprintf("/v1/key/k%d", i), "later", nil); w.Code >= 300 {
+			t.Fatalf("PUT k%d with the shadow stopped: %d", i, w.Code)
+		}
+	}
+
+	start := time.Now()
+	for i := range keys {
+		get(fmt.Sprintf("k%d", i), "later")
+	}
+	if elapsed := time.Since(start); elapsed >= budget {
+		t.Errorf("%d reads took %s with the shadow stopped, at least its budget", keys, elapsed)
+	}
+	waitFor(t, "the comparisons to give up on the shadow", func() bool { return sh.Status().Lagging == keys })
+
+	// The share of reads compared is set at runtime, and none are compared
+	// at 0
+	if w := serve(h, "PUT", ShadowPath, `{"sample_percent": 101}`, admin); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT a sample percent of 101: %d", w.Code)
+	}
+	if w := serve(h, "PUT", ShadowPath, `{"sample_percent": 0}`, admin); w.Code != http.StatusOK {
+		t.Fatalf("PUT a sample percent of 0: %d %s", w.Code, w.Body.String())
+	}
+
+	before := sh.Status()
+	get("k0", "later")
+
+	w := serve(h, "GET", ShadowPath, "", admin)
+	var status ShadowStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status != before || status.SamplePercent != 0 || status.Mismatches != 2 {
+		t.Errorf("the shadow's status after a read with sampling off: %+v, before %+v", status, before)
+	}
+}
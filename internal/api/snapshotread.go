@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SnapshotReadPath is the endpoint reading several keys at once,
+// consistently.
+const SnapshotReadPath = "/v1/snapshot-read"
+
+// MaxSnapshotReadKeys is the most keys a snapshot read returns.
+const MaxSnapshotReadKeys = 1000
+
+// snapshotReadValue is a key in the response of a snapshot read.
+type snapshotReadValue struct {
+	Key      string    `json:"key"`
+	Found    bool      `json:"found"`
+	Value    *string   `json:"value,omitempty"`
+	Encoding string    `json:"encoding,omitempty"` // Of Value, as valueEncodingBase64 describes
+	Version  uint64    `json:"version,omitempty"`
+	Modified time.Time `json:"modified,omitzero"`
+}
+
+// snapshotReadHandler expects a POST request for SnapshotReadPath with a
+// body like {"bucket": "b", "keys": ["k1", "k2"]}, or {"prefix": "p"}
+// instead of keys, and responds with the values of all the keys as they
+// were at a single point, with the sequence of the last write applied then.
+// Two writes can't straddle the read, so related keys are seen consistently.
+// The bucket is optional; keys that don't exist are returned without a
+// value, and values that aren't text base64-encoded, as valueEncodingBase64
+// describes. At most MaxSnapshotReadKeys keys are read, or matched by the prefix.
+// Like a GET, the read waits for the sequence of MinSequenceHeader first.
+// The same read is answered from the scan cache, if the server has one,
+// until the store changes.
+func (s *Server) snapshotReadHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.awaitSequence(w, r) {
+		return
+	}
+
+	var req struct {
+		Bucket string    `json:"bucket"`
+		Keys   *[]string `json:"keys"`
+		Prefix *string   `json:"prefix"`
+	}
+
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if (req.Keys == nil) == (req.Prefix == nil) {
+		s.writeError(w, fmt.Errorf(`%w: expected a body like {"keys":["k1","k2"]} or {"prefix":"p"}`, ErrorInvalidRequest))
+		return
+	}
+
+	bucket := store.DefaultBucket
+	if req.Bucket != "" {
+		if err := store.ValidateBucket(req.Bucket); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		bucket = req.Bucket
+	}
+
+	var cacheKey string
+	if req.Keys != nil {
+		if len(*req.Keys) > MaxSnapshotReadKeys {
+			s.writeError(w, fmt.Errorf("%w: %d keys requested, at most %d may be", store.ErrorTooManyKeys, len(*req.Keys), MaxSnapshotReadKeys))
+			return
+		}
+
+		for _, key := range *req.Keys {
+			if err := store.ValidateKey(key); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+
+		cacheKey = scanKey("snapshot-read-keys", append([]string{bucket}, *req.Keys...)...)
+	} else {
+		cacheKey = scanKey("snapshot-read-prefix", bucket, *req.Prefix)
+	}
+
+	s.serveScan(w, cacheKey, "application/json", func() ([]byte, error) {
+		var reads []store.KeyRead
+		var seq uint64
+		var err error
+
+		if req.Keys != nil {
+			reads, seq, err = s.store.BucketGetMany(r.Context(), bucket, *req.Keys)
+		} else {
+			reads, seq, err = s.store.BucketGetPrefix(r.Context(), bucket, *req.Prefix, MaxSnapshotReadKeys)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]snapshotReadValue, len(reads))
+		for i, read := range reads {
+			values[i] = snapshotReadValue{Key: read.Key, Found: read.Found}
+
+			if read.Found {
+				value, encoding := jsonValue(read.Value)
+				values[i].Value, values[i].Encoding = &value, encoding
+				values[i].Version = read.Meta.Version
+				values[i].Modified = read.Meta.Modified.UTC()
+			}
+		}
+
+		log.Printf("SNAPSHOT-READ bucket=%s keys=%d\n", bucket, len(values))
+
+		return encodeJSONLine(struct {
+			Bucket   string              `json:"bucket"`
+			Sequence uint64              `json:"sequence"`
+			Values   []snapshotReadValue `json:"values"`
+		}{bucket, seq, values})
+	})
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSnapshotReadNeverMixesAFlip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"uncached", Config{}},
+		{"scan cache", Config{ScanCache: NewScanCache(1<<20, 0)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st, h, closeLog := openRouter(t, t.TempDir(), tt.cfg)
+			defer closeLog()
+
+			// flip writes i to both keys, in one transaction: two events,
+			// so after flip(i) the sequence is 2(i+1)
+			flip := func(i int) error {
+				v := strconv.Itoa(i)
+				_, err := st.Txn(context.Background(), store.Txn{Then: []store.TxnOp{
+					{Type: store.TxnPut, Key: "pair/a", Value: v},
+					{Type: store.TxnPut, Key: "pair/b", Value: v},
+				}})
+				return err
+			}
+			if err := flip(0); err != nil {
+				t.Fatal(err)
+			}
+
+			var stop atomic.Bool
+			var wg sync.WaitGroup
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for i := 1; !stop.Load(); i++ {
+					if err := flip(i); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			// read reads the pair by its keys or its prefix, and checks both
+			// values are those the sequence read with them implies
+			read := func(body string) {
+				w := serve(h, "POST", SnapshotReadPath, body, nil)
+				if w.Code != http.StatusOK {
+					t.Errorf("POST %s: %d %s", body, w.Code, w.Body.String())
+					return
+				}
+
+				var resp struct {
+					Sequence uint64
+					Values   []struct {
+						Key   string
+						Found bool
+						Value *string
+					}
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Error(err)
+					return
+				}
+
+				want := strconv.FormatUint(resp.Sequence/2-1, 10)
+				if len(resp.Values) != 2 || resp.Sequence%2 != 0 {
+					t.Errorf("POST %s: %s", body, w.Body.String())
+					return
+				}
+				for _, v := range resp.Values {
+					if !v.Found || *v.Value != want {
+						t.Errorf("POST %s read a mixed pair at sequence %d: %s", body, resp.Sequence, w.Body.String())
+						return
+					}
+				}
+			}
+
+			var readers sync.WaitGroup
+			for r := range 4 {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+
+					for range 500 {
+						if r%2 == 0 {
+							read(`{"keys":["pair/a","pair/b"]}`)
+						} else {
+							read(`{"prefix":"pair/"}`)
+						}
+					}
+				}()
+			}
+			readers.Wait()
+
+			stop.Store(true)
+			wg.Wait()
+		})
+	}
+}
+
+func TestSnapshotReadBoundsKeys(t *testing.T) {
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{})
+	defer closeLog()
+
+	keys := make([]string, MaxSnapshotReadKeys+1)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%q", fmt.Sprintf("k%d", i))
+	}
+
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{`{"keys":[` + strings.Join(keys[:MaxSnapshotReadKeys], ",") + `]}`, http.StatusOK},
+		{`{"keys":[` + strings.Join(keys, ",") + `]}`, http.StatusBadRequest},
+		{`{"keys":["a"],"prefix":"a"}`, http.StatusBadRequest},
+		{`{}`, http.StatusBadRequest},
+	} {
+		if w := serve(h, "POST", SnapshotReadPath, tt.body, nil); w.Code != tt.code {
+			t.Errorf("POST %.40s...: %d %s, want %d", tt.body, w.Code, w.Body.String(), tt.code)
+		}
+	}
+}
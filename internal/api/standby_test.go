@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/replication"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmStandby(t *testing.T) {
+	ctx := context.Background()
+
+	primary, _, closePrimary := openRouter(t, t.TempDir(), Config{})
+	defer closePrimary()
+
+	standbyDir := t.TempDir()
+	standby, h, closeStandby := openRouter(t, standbyDir, Config{AdminKey: "admin", DataDir: standbyDir})
+	standby.SetReadOnly(true, "warm standby")
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// writeAll sets k0 to k99 on the primary to value
+	writeAll := func(value string) {
+		for i := range 100 {
+			if err := primary.PutCtx(ctx, fmt.Sprintf("k%d", i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	writeAll("first")
+
+	// A push is only taken from the primary, with the admin key
+	if err := replication.NewShipper(srv.URL, "", primary, time.Hour).Push(ctx); err == nil {
+		t.Error("the standby accepted a push without the admin key")
+	}
+	if w := serve(h, "PUT", "/v1/key/k0", "client", nil); w.Code/100 == 2 {
+		t.Errorf("the standby accepted a client write: %d", w.Code)
+	}
+
+	const interval = 100 * time.Millisecond
+	shipper := replication.NewShipper(srv.URL, "admin", primary, interval)
+
+	if err := shipper.Push(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := standby.Get("k99"); v != "first" || standby.Sequence() != primary.Sequence() {
+		t.Fatalf("after a push the standby is at %d with k99 %q, want %d with \"first\"", standby.Sequence(), v, primary.Sequence())
+	}
+
+	// Readers of the standby see one whole state or the next, never a key
+	// missing or a state part loaded, while pushes swap them in
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	var reads, bad atomic.Int64
+
+	for r := range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := r; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				w := serve(h, "GET", fmt.Sprintf("/v1/key/k%d", i%100), "", nil)
+				keys := standby.Stats().Keys
+				if w.Code != http.StatusOK || (w.Body.String() != "first" && w.Body.String() != "second") || keys != 100 {
+					if bad.Add(1) == 1 {
+						t.Errorf("a read of the standby during a push: %d %q, with %d keys", w.Code, w.Body.String(), keys)
+					}
+				}
+				reads.Add(1)
+			}
+		}()
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		shipper.Run(runCtx)
+		close(done)
+	}()
+
+	// The standby catches up on writes by the next push after them
+	writeAll("second")
+	written := time.Now()
+	want := primary.Sequence()
+
+	for standby.Sequence() != want {
+		if time.Since(written) > interval+time.Second {
+			t.Fatalf("the standby is at sequence %d %s after the writes, want %d", standby.Sequence(), time.Since(written), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if v, _ := standby.Get("k99"); v != "second" {
+		t.Errorf("k99 is %q on the standby that caught up, want \"second\"", v)
+	}
+
+	// Let a few more pushes swap in the same state under the readers
+	time.Sleep(3 * interval)
+	cancel()
+	<-done
+	close(stop)
+	readers.Wait()
+
+	if reads.Load() == 0 {
+		t.Error("the standby wasn't read during the pushes")
+	}
+	if st := shipper.Status(); st.PushedSequence != want || st.LastError != "" {
+		t.Errorf("shipper status %+v, want pushed to %d", st, want)
+	}
+
+	// A restarted standby starts from the last snapshot pushed
+	closeStandby()
+	standby, _, closeStandby = openRouter(t, standbyDir, Config{})
+	defer closeStandby()
+
+	if v, _ := standby.Get("k0"); v != "second" || standby.Sequence() != want {
+		t.Errorf("the restarted standby is at %d with k0 %q, want %d with \"second\"", standby.Sequence(), v, want)
+	}
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TTLHeader on a PUT makes the key expire after the duration it gives, such
+// as 30s or 24h, as store.WithTTL describes. The ttl query parameter is
+// taken in its place, for clients that can't set headers. Without either,
+// the key lives until it is deleted.
+const TTLHeader = "X-KV-TTL"
+
+// ExpiresHeader reports when a key read expires, as an HTTP date, for keys
+// put with a TTL.
+const ExpiresHeader = "X-KV-Expires"
+
+// requestTTL returns the time to live r asks for its key, or 0 if it asks
+// for none.
+func requestTTL(r *http.Request) (time.Duration, error) {
+	v := r.Header.Get(TTLHeader)
+	if v == "" {
+		v = r.URL.Query().Get("ttl")
+	}
+	if v == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("%w: %s must be a positive duration: %q", ErrorInvalidRequest, TTLHeader, v)
+	}
+
+	return ttl, nil
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+// TxnPath is the endpoint of conditional transactions over several keys.
+const TxnPath = "/v1/txn"
+
+// MaxTxnOps is the most conditions and operations a transaction may have,
+// all branches together. Its body is bounded like that of the other atomic
+// operations.
+const MaxTxnOps = 128
+
+// txnCompare is a condition in the body of a transaction.
+type txnCompare struct {
+	Bucket   string              `json:"bucket"`
+	Key      string              `json:"key"`
+	Target   store.CompareTarget `json:"target"`
+	Version  uint64              `json:"version"`
+	Value    string              `json:"value"`
+	Encoding string              `json:"encoding"` // Of Value, as valueEncodingBase64 describes
+}
+
+// txnOp is an operation in the body of a transaction.
+type txnOp struct {
+	Op       store.TxnOpType `json:"op"`
+	Bucket   string          `json:"bucket"`
+	Key      string          `json:"key"`
+	Value    *string         `json:"value"`
+	Encoding string          `json:"encoding"` // Of Value, as valueEncodingBase64 describes
+}
+
+// txnResult is the result of an operation in the response of a
+// transaction.
+type txnResult struct {
+	Op       store.TxnOpType `json:"op"`
+	Bucket   string          `json:"bucket"`
+	Key      string          `json:"key"`
+	Found    bool            `json:"found"`
+	Value    *string         `json:"value,omitempty"`
+	Encoding string          `json:"encoding,omitempty"` // Of Value, as valueEncodingBase64 describes
+	Version  uint64          `json:"version,omitempty"`
+	Modified time.Time       `json:"modified,omitzero"`
+}
+
+// txnHandler expects a POST request for TxnPath with a body like
+//
+//	{"if": [{"key": "a", "target": "version", "version": 3},
+//	        {"bucket": "b", "key": "b", "target": "exists"}],
+//	 "then": [{"op": "put", "key": "c", "value": "v"}, {"op": "delete", "key": "d"}],
+//	 "else": [{"op": "get", "key": "a"}]}
+//
+// and runs it as store.Txn does: if every condition holds, with targets
+// version, value, exists or absent, the then operations run, and otherwise
+// the else operations, which may only get keys. It responds with whether
+// the conditions held, the sequence of the transaction's last write, and
+// the result of each operation run: found tells whether the key existed,
+// gets return its value, version and modification time, and puts the
+// version and time they gave it. Values that aren't text are base64-encoded
+// with an encoding field, as valueEncodingBase64 describes, in conditions
+// and puts as in results. Buckets are optional. A transaction that
+// ran either branch answers 200; one that couldn't run, such as one writing
+// a key twice or over MaxTxnOps, answers an error and changes nothing.
+func (s *Server) txnHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		If   []txnCompare `json:"if"`
+		Then []txnOp      `json:"then"`
+		Else []txnOp      `json:"else"`
+	}
+
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n := len(req.If) + len(req.Then) + len(req.Else); n > MaxTxnOps {
+		s.writeError(w, fmt.Errorf("%w: %d conditions and operations, at most %d may be", store.ErrorInvalidTxn, n, MaxTxnOps))
+		return
+	}
+
+	var t store.Txn
+	var err error
+
+	for _, c := range req.If {
+		if err := validateTxnKey(c.Bucket, c.Key); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if err := decodeJSONValue(&c.Value, c.Encoding); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if c.Target == 0 {
+			s.writeError(w, fmt.Errorf(`%w: condition on key %q has no target`, ErrorInvalidRequest, c.Key))
+			return
+		}
+
+		t.If = append(t.If, store.Compare{Bucket: c.Bucket, Key: c.Key, Target: c.Target, Version: c.Version, Value: c.Value})
+	}
+
+	if t.Then, err = txnOps(req.Then); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if t.Else, err = txnOps(req.Else); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	durability, err := s.requestDurability(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var seq uint64
+	var usage store.QuotaUsage
+
+	ctx := store.WithQuotaWarning(store.WithSequence(r.Context(), &seq), &usage)
+	ctx = store.WithDurability(ctx, durability)
+
+	outcome, err := s.store.Txn(ctx, t)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	writeSequence(w, seq)
+	writeQuotaWarning(w, usage)
+
+	if err := s.awaitDurability(r.Context(), durability); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	ops := t.Then
+	if !outcome.Succeeded {
+		ops = t.Else
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Succeeded bool        `json:"succeeded"`
+		Sequence  uint64      `json:"sequence"`
+		Results   []txnResult `json:"results"`
+	}{outcome.Succeeded, seq, txnResults(ops, outcome.Results)})
+
+	log.Printf("TXN succeeded=%t conditions=%d ops=%d\n", outcome.Succeeded, len(t.If), len(ops))
+}
+
+// txnResults converts the results of the operations ops of a branch for
+// the response: gets with their value, encoded as jsonValue does, version
+// and modification time if they found the key, and puts with the version
+// and time they gave it.
+func txnResults(ops []store.TxnOp, results []store.TxnResult) []txnResult {
+	converted := make([]txnResult, len(results))
+
+	for i, res := range results {
+		converted[i] = txnResult{Op: ops[i].Type, Bucket: res.Bucket, Key: res.Key, Found: res.Found}
+
+		switch {
+		case ops[i].Type == store.TxnGet && res.Found:
+			value, encoding := jsonValue(res.Value)
+			converted[i].Value, converted[i].Encoding = &value, encoding
+			fallthrough
+		case ops[i].Type == store.TxnPut:
+			converted[i].Version = res.Meta.Version
+			converted[i].Modified = res.Meta.Modified.UTC()
+		}
+	}
+
+	return converted
+}
+
+// txnOps converts the operations of a branch in the body of a transaction.
+func txnOps(ops []txnOp) ([]store.TxnOp, error) {
+	var converted []store.TxnOp
+
+	for _, op := range ops {
+		if err := validateTxnKey(op.Bucket, op.Key); err != nil {
+			return nil, err
+		}
+		if err := decodeJSONValue(op.Value, op.Encoding); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case op.Op == 0:
+			return nil, fmt.Errorf(`%w: operation on key %q has no op`, ErrorInvalidRequest, op.Key)
+		case op.Op == store.TxnPut && op.Value == nil:
+			return nil, fmt.Errorf(`%w: put of key %q has no value`, ErrorInvalidRequest, op.Key)
+		case op.Op != store.TxnPut && op.Value != nil:
+			return nil, fmt.Errorf(`%w: %s of key %q has a value`, ErrorInvalidRequest, op.Op, op.Key)
+		}
+
+		converted = append(converted, store.TxnOp{Type: op.Op, Bucket: op.Bucket, Key: op.Key})
+		if op.Value != nil {
+			converted[len(converted)-1].Value = *op.Value
+		}
+	}
+
+	return converted, nil
+}
+
+// validateTxnKey checks a key of a transaction, and its bucket, which may
+// be empty for the default one.
+func validateTxnKey(bucket, key string) error {
+	if bucket != "" {
+		if err := store.ValidateBucket(bucket); err != nil {
+			return err
+		}
+	}
+
+	return store.ValidateKey(key)
+}
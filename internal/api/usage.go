@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/usage"
+	"net/http"
+	"time"
+)
+
+// UsagePath reports what each principal used of the key API, hour by hour,
+// for billing.
+const UsagePath = "/v1/admin/usage"
+
+// defaultUsageWindow is how far back a usage report goes without a from
+// parameter.
+const defaultUsageWindow = 24 * time.Hour
+
+// countingWriter counts the bytes of a response body written by the
+// handler.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, for
+// handlers that stream and need to flush.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// meterUsage accounts each key API request to its principal once served,
+// with the bytes of its body the handler read and those of the response as
+// sent. It comes before v1Compat, which may rewrite the response, and reads
+// the principal once authenticateRequests has established it; requests
+// rejected before then aren't accounted.
+func (s *Server) meterUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.usage == nil || !isKeyRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &countingWriter{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		r = r.WithContext(withPrincipalSlot(r.Context()))
+
+		next.ServeHTTP(cw, r)
+
+		if p := r.Context().Value(principalKey{}).(*Principal); p.ID != "" {
+			s.usage.Record(p.ID, body.n, cw.n)
+		}
+	})
+}
+
+// usageHandler reports the hourly usage of the principal in the principal
+// query parameter, or of every principal without it, from the hour of the
+// from parameter to the to parameter, both RFC 3339 times, by default the
+// last 24 hours. Each principal's hours are totalled too.
+func (s *Server) usageHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	to := time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.writeError(w, fmt.Errorf("%w: to: %v", ErrorInvalidRequest, err))
+			return
+		}
+		to = t.UTC()
+	}
+
+	from := to.Add(-defaultUsageWindow)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.writeError(w, fmt.Errorf("%w: from: %v", ErrorInvalidRequest, err))
+			return
+		}
+		from = t.UTC()
+	}
+
+	hours := s.usage.Report(q.Get("principal"), from, to)
+	if hours == nil {
+		hours = []usage.Hour{}
+	}
+
+	totals := make(map[string]usage.Counters)
+	for _, h := range hours {
+		t := totals[h.Principal]
+		t.Add(h.Counters)
+		totals[h.Principal] = t
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		From   time.Time                 `json:"from"`
+		To     time.Time                 `json:"to"`
+		Hours  []usage.Hour              `json:"hours"`
+		Totals map[string]usage.Counters `json:"totals"`
+	}{from, to, hours, totals})
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/sheritzs/key-value-store/internal/usage"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageAccounting(t *testing.T) {
+	meter := usage.NewMeter(0, nil)
+	_, h, closeLog := openRouter(t, t.TempDir(), Config{
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]Principal{
+			"web-key":   {ID: "web"},
+			"ops-key":   {ID: "ops"},
+			"admin-key": {ID: "root", Scopes: []string{ScopeAdmin}},
+		}},
+		Usage: meter,
+	})
+	defer closeLog()
+
+	as := func(apiKey string) http.Header {
+		header := make(http.Header)
+		if apiKey != "" {
+			header.Set("X-API-Key", apiKey)
+		}
+		return header
+	}
+
+	// Traffic from two keys and from no key, whose sizes are counted as the
+	// handlers read and write them
+	want := make(map[string]usage.Counters)
+	for _, tt := range []struct {
+		apiKey, principal string
+		method, path      string
+		body              string
+	}{
+		{"web-key", "web", "PUT", "/v1/key/a", strings.Repeat("a", 100)},
+		{"web-key", "web", "GET", "/v1/key/a", ""},
+		{"web-key", "web", "GET", "/v1/key/missing", ""},
+		{"ops-key", "ops", "PUT", "/v1/key/b", "bb"},
+		{"ops-key", "ops", "GET", "/v1/keys", ""},
+		{"ops-key", "ops", "DELETE", "/v1/key/b", ""},
+		{"", "anonymous", "GET", "/v1/key/a", ""},
+	} {
+		w := serve(h, tt.method, tt.path, tt.body, as(tt.apiKey))
+
+		c := want[tt.principal]
+		c.Add(usage.Counters{Requests: 1, BytesWritten: int64(len(tt.body)), BytesRead: int64(w.Body.Len())})
+		want[tt.principal] = c
+	}
+
+	// Requests outside the key API, and those rejected before they're
+	// served, aren't
+	serve(h, "GET", "/healthz", "", as("web-key"))
+	serve(h, "GET", "/v1/stats", "", as("web-key"))
+	serve(h, "GET", "/v1/key/a", "", as("wrong-key"))
+
+	report := func(query string) (int, map[string]usage.Counters) {
+		t.Helper()
+
+		w := serve(h, "GET", UsagePath+query, "", as("admin-key"))
+
+		var body struct {
+			Hours  []usage.Hour              `json:"hours"`
+			Totals map[string]usage.Counters `json:"totals"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			for _, hr := range body.Hours {
+				if hr.Start != hr.Start.Truncate(time.Hour) {
+					t.Errorf("an hour starting at %s", hr.Start)
+				}
+			}
+		}
+		return w.Code, body.Totals
+	}
+
+	code, got := report("")
+	if code != http.StatusOK || len(got) != len(want) {
+		t.Fatalf("GET %s: %d %v, want %v", UsagePath, code, got, want)
+	}
+	for principal, c := range want {
+		if got[principal] != c {
+			t.Errorf("usage of %s: %+v, want %+v", principal, got[principal], c)
+		}
+	}
+	if want["web"].BytesRead < 100 {
+		t.Errorf("the bytes read by web: %d, fewer than the value it got", want["web"].BytesRead)
+	}
+
+	// One principal, over a window, or outside it
+	now := time.Now().UTC()
+	window := "&from=" + url.QueryEscape(now.Add(-time.Hour).Format(time.RFC3339)) + "&to=" + url.QueryEscape(now.Add(time.Hour).Format(time.RFC3339))
+	if code, got := report("?principal=ops" + window); code != http.StatusOK || len(got) != 1 || got["ops"] != want["ops"] {
+		t.Errorf("usage of ops: %d %v", code, got)
+	}
+	if code, got := report("?to=" + url.QueryEscape(now.Add(-2*time.Hour).Format(time.RFC3339))); code != http.StatusOK || len(got) != 0 {
+		t.Errorf("usage until two hours ago: %d %v", code, got)
+	}
+
+	for _, query := range []string{"?from=yesterday", "?to=1"} {
+		if code, _ := report(query); code != http.StatusBadRequest {
+			t.Errorf("GET %s%s: %d", UsagePath, query, code)
+		}
+	}
+	if w := serve(h, "GET", UsagePath, "", as("web-key")); w.Code != http.StatusForbidden {
+		t.Errorf("GET %s as web: %d", UsagePath, w.Code)
+	}
+
+	// Without a meter, nothing is accounted and there's nothing to report
+	_, h, closeOther := openRouter(t, t.TempDir(), Config{AdminKey: "secret"})
+	defer closeOther()
+	if w := serve(h, "GET", UsagePath, "", as("secret")); w.Code != http.StatusNotFound {
+		t.Errorf("GET %s without a meter: %d", UsagePath, w.Code)
+	}
+}
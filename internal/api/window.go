@@ -0,0 +1,144 @@
+package api
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// loadSlots is how many seconds a loadWindow keeps: enough for its longest
+// window.
+const loadSlots = 300
+
+// latencyBuckets is the number of latencyBounds.
+const latencyBuckets = 18
+
+// latencyBounds are the upper bounds of the latency buckets a loadWindow
+// counts requests in: 100µs, doubling up to about 13s. Slower requests are
+// counted past the last one.
+var latencyBounds = func() []time.Duration {
+	bounds := make([]time.Duration, latencyBuckets)
+	for i := range bounds {
+		bounds[i] = 100 * time.Microsecond << i
+	}
+	return bounds
+}()
+
+// loadSlot counts the requests of one second.
+type loadSlot struct {
+	sec           int64 // Unix second counted; the slot is stale if it's another
+	reads, writes uint64
+	latency       [latencyBuckets + 1]uint32 // By latencyBounds, then slower
+}
+
+// loadWindow counts the requests served, by second, over the last
+// loadSlots seconds, so that their rates and latency can be read over a
+// rolling window, which monotonic counters can't give without a scraper
+// diffing them. A second's slot is reused once it is loadSlots seconds
+// old.
+type loadWindow struct {
+	start time.Time
+
+	mu    sync.Mutex
+	slots [loadSlots]loadSlot
+}
+
+func newLoadWindow(now time.Time) *loadWindow {
+	return &loadWindow{start: now}
+}
+
+// observe counts a request that ended at now after taking d.
+func (w *loadWindow) observe(now time.Time, write bool, d time.Duration) {
+	sec := now.Unix()
+	b := latencyBucket(d)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	slot := &w.slots[sec%loadSlots]
+	if slot.sec != sec {
+		*slot = loadSlot{sec: sec}
+	}
+
+	if write {
+		slot.writes++
+	} else {
+		slot.reads++
+	}
+	slot.latency[b]++
+}
+
+// latencyBucket returns the index of the latency bucket of d.
+func latencyBucket(d time.Duration) int {
+	for i, bound := range latencyBounds {
+		if d <= bound {
+			return i
+		}
+	}
+
+	return latencyBuckets
+}
+
+// loadSummary is what a loadWindow counted over a window.
+type loadSummary struct {
+	ReadsPerSecond  float64 `json:"reads_per_second"`
+	WritesPerSecond float64 `json:"writes_per_second"`
+	P99Seconds      float64 `json:"p99_seconds"` // Upper bound of the latency bucket of the 99th percentile; 0 without requests
+}
+
+// summary returns the rates and latency of the requests of the span of
+// complete seconds before now. A window longer than the time since the
+// loadWindow was created is cut to that time, so that rates aren't diluted
+// by seconds before the first request could be made.
+func (w *loadWindow) summary(now time.Time, span time.Duration) loadSummary {
+	last := now.Unix() - 1
+	secs := min(int64(span/time.Second), loadSlots, last-w.start.Unix()+1)
+	if secs <= 0 {
+		return loadSummary{}
+	}
+
+	var reads, writes uint64
+	var latency [latencyBuckets + 1]uint64
+
+	w.mu.Lock()
+	for i := range secs {
+		slot := &w.slots[(last-i)%loadSlots]
+		if slot.sec != last-i {
+			continue
+		}
+
+		reads += slot.reads
+		writes += slot.writes
+		for b, n := range slot.latency {
+			latency[b] += uint64(n)
+		}
+	}
+	w.mu.Unlock()
+
+	return loadSummary{
+		ReadsPerSecond:  float64(reads) / float64(secs),
+		WritesPerSecond: float64(writes) / float64(secs),
+		P99Seconds:      percentile(latency[:], reads+writes, 0.99).Seconds(),
+	}
+}
+
+// percentile returns the upper bound of the latency bucket holding the
+// quantile q of the total requests counted in latency. Requests past the
+// last bound are reported as twice it.
+func percentile(latency []uint64, total uint64, q float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+
+	var seen uint64
+	for b, n := range latency {
+		seen += n
+		if seen >= rank && b < latencyBuckets {
+			return latencyBounds[b]
+		}
+	}
+
+	return 2 * latencyBounds[latencyBuckets-1]
+}
@@ -0,0 +1,301 @@
+// Package blob keeps large values out of the transaction log and the
+// store's memory. A value at least as large as a threshold is written to a
+// file named after its SHA-256 in a blob directory, and is logged and stored
+// as a Ref to it, from which it is read back and checked against its hash.
+package blob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DirName is the name of the blob directory in a data directory, unless
+// configured elsewhere.
+const DirName = "blobs"
+
+var ErrorInvalidRef = errors.New("invalid blob reference")
+
+var ErrorMissing = errors.New("blob is missing")
+
+var ErrorCorrupt = errors.New("blob doesn't match its reference")
+
+// refPrefix starts every reference, naming the hash.
+const refPrefix = "sha256:"
+
+// Ref is what is stored and logged in place of a blob: its hash and size.
+type Ref struct {
+	Hash string // SHA-256 of the blob in lower-case hex, which names its file
+	Size int64
+}
+
+// String returns r as stored: "sha256:HASH:SIZE".
+func (r Ref) String() string {
+	return refPrefix + r.Hash + ":" + strconv.FormatInt(r.Size, 10)
+}
+
+// ParseRef parses a reference written by Ref.String.
+func ParseRef(s string) (Ref, error) {
+	var r Ref
+
+	rest, ok := strings.CutPrefix(s, refPrefix)
+	if !ok {
+		return r, fmt.Errorf("%w: %q", ErrorInvalidRef, s)
+	}
+
+	hash, size, ok := strings.Cut(rest, ":")
+	if !ok || !isHash(hash) {
+		return r, fmt.Errorf("%w: %q", ErrorInvalidRef, s)
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return r, fmt.Errorf("%w: %q", ErrorInvalidRef, s)
+	}
+
+	return Ref{Hash: hash, Size: n}, nil
+}
+
+// isHash reports whether s is a SHA-256 in lower-case hex, as blob files are
+// named.
+func isHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Dir is a blob directory. Its methods are safe for concurrent use, except
+// Collect.
+type Dir struct {
+	path      string
+	threshold int
+}
+
+// Open returns the blob directory at path, creating it if needed, which
+// takes values of at least threshold bytes.
+func Open(path string, threshold int) (*Dir, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("blob threshold must be positive, got %d", threshold)
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create blob directory: %w", err)
+	}
+
+	return &Dir{path: path, threshold: threshold}, nil
+}
+
+// Path returns the directory's path.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Takes reports whether a value of n bytes belongs in the directory.
+func (d *Dir) Takes(n int) bool {
+	return n >= d.threshold
+}
+
+// Put writes data to the directory, unless a blob of the same hash and size
+// is already there, and returns its reference. The file is synced and
+// renamed into place before Put returns, so a logged reference always finds
+// its blob; a crash before the reference is logged leaves an orphan, for
+// Collect.
+func (d *Dir) Put(data string) (Ref, error) {
+	sum := sha256.Sum256([]byte(data))
+	ref := Ref{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+
+	name := filepath.Join(d.path, ref.Hash)
+	if info, err := os.Stat(name); err == nil && info.Size() == ref.Size {
+		return ref, nil
+	}
+
+	tmp, err := os.CreateTemp(d.path, ref.Hash+".*.tmp")
+	if err != nil {
+		return ref, err
+	}
+	defer os.Remove(tmp.Name()) // Once renamed into place, there's nothing left to remove
+
+	_, err = io.WriteString(tmp, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return ref, fmt.Errorf("cannot write blob: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return ref, fmt.Errorf("cannot write blob: %w", err)
+	}
+
+	return ref, syncDir(d.path)
+}
+
+// syncDir makes the entries renamed into dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// Get returns the blob ref refers to, after checking it against the
+// reference's size and hash.
+func (d *Dir) Get(ref Ref) (string, error) {
+	if !isHash(ref.Hash) {
+		return "", fmt.Errorf("%w: %q", ErrorInvalidRef, ref)
+	}
+
+	b, err := os.ReadFile(filepath.Join(d.path, ref.Hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", ErrorMissing, ref)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	if int64(len(b)) != ref.Size || hex.EncodeToString(sum[:]) != ref.Hash {
+		return "", fmt.Errorf("%w: %s has %d bytes hashing to %x", ErrorCorrupt, ref, len(b), sum)
+	}
+
+	return string(b), nil
+}
+
+// Resolve returns the blob the stored reference s refers to.
+func (d *Dir) Resolve(s string) (string, error) {
+	ref, err := ParseRef(s)
+	if err != nil {
+		return "", err
+	}
+
+	return d.Get(ref)
+}
+
+// Collect removes the blobs for which live returns false, and the temporary
+// files of writes cut short, and returns the number of blobs removed and
+// their total size. Files that aren't blobs are left alone. It must not run
+// while blobs are written, since a blob is written before the reference
+// making it live.
+func (d *Dir) Collect(live func(hash string) bool) (removed int, size int64, err error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		switch {
+		case !entry.Type().IsRegular():
+			continue
+		case strings.HasSuffix(name, ".tmp"):
+		case !isHash(name) || live(name):
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return removed, size, err
+		}
+
+		if err := os.Remove(filepath.Join(d.path, name)); err != nil {
+			return removed, size, err
+		}
+
+		if isHash(name) {
+			removed++
+			size += info.Size()
+		}
+	}
+
+	return removed, size, nil
+}
+
+// Inline returns src with the values of its events restored from the
+// blobs in d, for readers outside the store, such as replication followers,
+// that need every value in the event itself.
+func Inline(src translog.Source, d *Dir) translog.Source {
+	return inlineSource{src: src, dir: d}
+}
+
+type inlineSource struct {
+	src translog.Source
+	dir *Dir
+}
+
+// Follow implements translog.Source. Reading a blob that is missing or
+// corrupt ends the stream with the error.
+func (s inlineSource) Follow(ctx context.Context, after uint64) (<-chan translog.Event, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	events, errs := s.src.Follow(ctx, after)
+
+	outEvent := make(chan translog.Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outError)
+		defer close(outEvent)
+		defer cancel()
+
+		// stop ends the follow, reporting err if it isn't nil
+		stop := func(err error) {
+			cancel()
+			for range events {
+				// Drained so that the follow can exit
+			}
+			<-errs
+			if err != nil {
+				outError <- err
+			}
+		}
+
+		for e := range events {
+			if e.Codec.IsBlob() {
+				value, err := s.dir.Resolve(e.Value)
+				if err != nil {
+					stop(fmt.Errorf("event %d: %w", e.Sequence, err))
+					return
+				}
+
+				e.Value, e.Codec = value, e.Codec&^compress.Blob
+			}
+
+			select {
+			case outEvent <- e:
+			case <-ctx.Done():
+				stop(nil)
+				return
+			}
+		}
+
+		if err := <-errs; err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
@@ -0,0 +1,128 @@
+package blob
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPutAndGet(t *testing.T) {
+	d, err := Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Takes(1023) || !d.Takes(1024) {
+		t.Error("the directory takes values on the wrong side of its threshold")
+	}
+
+	value := strings.Repeat("large value ", 1000)
+
+	ref, err := d.Put(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := d.Put(value); err != nil || again != ref {
+		t.Errorf("putting the same value again: %s, %v; want %s", again, err, ref)
+	}
+
+	parsed, err := ParseRef(ref.String())
+	if err != nil || parsed != ref {
+		t.Errorf("ParseRef(%s) = %s, %v", ref, parsed, err)
+	}
+	if got, err := d.Resolve(ref.String()); got != value || err != nil {
+		t.Errorf("resolving %s: %d bytes, %v", ref, len(got), err)
+	}
+
+	for _, s := range []string{"", "md5:abc:1", "sha256:" + ref.Hash, "sha256:" + ref.Hash + ":-1", "sha256:ABC:1", "sha256:" + strings.ToUpper(ref.Hash) + ":1"} {
+		if _, err := ParseRef(s); !errors.Is(err, ErrorInvalidRef) {
+			t.Errorf("ParseRef(%q): %v", s, err)
+		}
+	}
+}
+
+func TestGetDetectsDamage(t *testing.T) {
+	d, err := Open(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := d.Put("the blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(d.Path(), ref.Hash)
+
+	// A blob changed on disk no longer matches its reference, even keeping
+	// its size
+	if err := os.WriteFile(name, []byte("the blub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ref); !errors.Is(err, ErrorCorrupt) {
+		t.Errorf("getting a changed blob: %v", err)
+	}
+
+	if err := os.WriteFile(name, []byte("the blob, longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ref); !errors.Is(err, ErrorCorrupt) {
+		t.Errorf("getting a blob of another size: %v", err)
+	}
+
+	// A blob of a size that's changed is written again rather than kept
+	if again, err := d.Put("the blob"); err != nil || again != ref {
+		t.Fatalf("putting the blob again: %s, %v", again, err)
+	}
+	if got, err := d.Get(ref); got != "the blob" || err != nil {
+		t.Errorf("getting the blob put again: %q, %v", got, err)
+	}
+
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ref); !errors.Is(err, ErrorMissing) {
+		t.Errorf("getting a removed blob: %v", err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	d, err := Open(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := d.Put("referred to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := d.Put("written before a crash, never referred to")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write cut short leaves its temporary file, and other files may be
+	// in the directory
+	for name, data := range map[string]string{orphan.Hash + ".123.tmp": "half", "README": "mine"} {
+		if err := os.WriteFile(filepath.Join(d.Path(), name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, size, err := d.Collect(func(hash string) bool { return hash == live.Hash })
+	if err != nil || removed != 1 || size != orphan.Size {
+		t.Errorf("collecting: %d removed, %d bytes, %v; want 1 of %d bytes", removed, size, err, orphan.Size)
+	}
+
+	entries, err := os.ReadDir(d.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := make(map[string]bool)
+	for _, entry := range entries {
+		left[entry.Name()] = true
+	}
+	if len(left) != 2 || !left[live.Hash] || !left["README"] {
+		t.Errorf("left %v after collecting", left)
+	}
+}
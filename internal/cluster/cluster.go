@@ -0,0 +1,426 @@
+// Package cluster replicates a store across a static set of nodes with
+// Raft. Every write is an entry of the Raft log, holding the event the
+// store would have logged, in the file log's encoding; the leader applies
+// its writes as the store always does once they are committed, and the
+// other nodes apply the entries as they learn of them. Raft snapshots are
+// the store's own snapshots.
+//
+// Only the leader takes writes. The others are read-only, and serve reads
+// that may lag behind it.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirName is the directory, in the data directory, of a node's Raft log
+// and snapshots.
+const DirName = "raft"
+
+// LogFileName is the name of the Raft log, and of the state Raft keeps
+// besides, in the directory of a node.
+const LogFileName = "raft.db"
+
+// retainSnapshots is how many Raft snapshots a node keeps.
+const retainSnapshots = 2
+
+// readOnlyReason is why the store of a node that isn't the leader refuses
+// writes.
+const readOnlyReason = "not the cluster leader"
+
+// ErrorNotLeader is reported for writes made on a node that isn't the
+// leader, or stopped being the leader before the write was committed. The
+// next leader may still commit such a write.
+var ErrorNotLeader = errors.New("not the cluster leader")
+
+// ErrorNoLeader is reported for requests that must go to the leader while
+// there is none, as during an election, or it can't be reached.
+var ErrorNoLeader = errors.New("no cluster leader")
+
+// Peer is a member of a cluster.
+type Peer struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"` // Host and port Raft is served on
+	HTTPURL  string `json:"http_url"`  // Base URL of the HTTP API, which writes are sent to on the leader
+}
+
+// ParsePeers parses a comma-separated list of peers, each given as its ID,
+// Raft address and HTTP URL separated by =, such as
+// "a=10.0.0.1:7000=http://10.0.0.1:8080".
+func ParsePeers(s string) ([]Peer, error) {
+	var peers []Peer
+
+	seen := make(map[string]bool)
+
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid peer %q: expected id=raft-address=http-url", field)
+		}
+
+		p := Peer{ID: parts[0], RaftAddr: parts[1], HTTPURL: strings.TrimSuffix(parts[2], "/")}
+
+		if strings.ContainsAny(p.ID, "\t ") {
+			return nil, fmt.Errorf("invalid peer ID %q", p.ID)
+		}
+		if seen[p.ID] {
+			return nil, fmt.Errorf("peer %q given twice", p.ID)
+		}
+		seen[p.ID] = true
+
+		if u, err := url.Parse(p.HTTPURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid HTTP URL %q of peer %q", parts[2], p.ID)
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
+
+// Config configures a Node.
+type Config struct {
+	ID    string // Of the node, among Peers
+	Dir   string // Directory of the Raft log and snapshots, created if need be
+	Peers []Peer // Every member of the cluster, this node included
+
+	// Timeout is how long a follower goes without hearing from the leader
+	// before it stands for election, and the leader without hearing from
+	// a quorum before it steps down; 1s if 0
+	Timeout time.Duration
+}
+
+// Node is a member of a cluster. It is the store.Logger of its store,
+// which it commits the writes of to the Raft log, refusing them unless it
+// is the leader.
+//
+// WriteEvent returns once the event is committed, or fails to be, so the
+// writes of a node are committed one at a time, and Flush has nothing
+// left to wait for.
+type Node struct {
+	cfg  Config
+	self Peer
+
+	origin string // ID and incarnation of the node, which its proposals are told apart by
+
+	raft   *raft.Raft
+	store  *store.Store
+	trans  *raft.NetworkTransport
+	logs   *raftboltdb.BoltStore
+	notify chan bool     // Leadership changes, from Raft
+	done   chan struct{} // Closed once the node is shut down
+
+	mu        sync.Mutex
+	writable  bool                 // Whether the node leads, and has applied every entry of the terms before its own
+	proposals uint64               // Proposals made so far
+	pending   map[uint64]*proposal // Proposals not yet committed or failed
+	applied   uint64               // Sequence of the last event of the entries applied, or of the snapshot restored
+}
+
+// proposal is an event proposed by the node, which its store applies
+// itself once it is committed.
+type proposal struct {
+	seen bool // Whether the entry was committed, and skipped by the FSM
+}
+
+// New returns a node of the cluster cfg describes, which Start starts.
+func New(cfg Config) (*Node, error) {
+	n := &Node{cfg: cfg, notify: make(chan bool, 16), done: make(chan struct{}), pending: make(map[uint64]*proposal)}
+
+	found := false
+	for _, p := range cfg.Peers {
+		if p.ID == cfg.ID {
+			n.self, found = p, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("node %q is not among the peers", cfg.ID)
+	}
+
+	incarnation := make([]byte, 8)
+	rand.Read(incarnation)
+	n.origin = cfg.ID + "/" + hex.EncodeToString(incarnation)
+
+	return n, nil
+}
+
+// Start joins the cluster, with st as the node's store, which must be
+// empty: its contents are restored from the Raft log. The first start of
+// each node sets the cluster up with the configured peers. The store is
+// read-only until the node is elected leader.
+func (n *Node) Start(st *store.Store) error {
+	n.store = st
+	st.SetReadOnly(true, readOnlyReason)
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.cfg.ID)
+	conf.LogOutput = log.Writer()
+	conf.LogLevel = "WARN"
+	conf.NotifyCh = n.notify
+	if t := n.cfg.Timeout; t > 0 {
+		conf.HeartbeatTimeout, conf.ElectionTimeout, conf.LeaderLeaseTimeout = t, t, t/2
+	}
+
+	if err := os.MkdirAll(n.cfg.Dir, 0755); err != nil {
+		return err
+	}
+
+	var err error
+	if n.logs, err = raftboltdb.New(raftboltdb.Options{Path: filepath.Join(n.cfg.Dir, LogFileName)}); err != nil {
+		return fmt.Errorf("failed to open the Raft log: %w", err)
+	}
+
+	snaps, err := raft.NewFileSnapshotStore(n.cfg.Dir, retainSnapshots, log.Writer())
+	if err != nil {
+		n.logs.Close()
+		return fmt.Errorf("failed to open the Raft snapshots: %w", err)
+	}
+
+	if n.trans, err = raft.NewTCPTransport(n.self.RaftAddr, nil, 3, 10*time.Second, log.Writer()); err != nil {
+		n.logs.Close()
+		return fmt.Errorf("failed to listen for Raft on %s: %w", n.self.RaftAddr, err)
+	}
+
+	existing, err := raft.HasExistingState(n.logs, n.logs, snaps)
+	if err == nil && !existing {
+		err = raft.BootstrapCluster(conf, n.logs, n.logs, snaps, n.trans, n.configuration())
+	}
+	if err == nil {
+		n.raft, err = raft.NewRaft(conf, &fsm{n}, n.logs, n.logs, snaps, n.trans)
+	}
+	if err != nil {
+		n.trans.Close()
+		n.logs.Close()
+		return err
+	}
+
+	go n.watchLeadership()
+
+	return nil
+}
+
+// configuration returns the Raft configuration of the peers, all voters.
+func (n *Node) configuration() raft.Configuration {
+	var c raft.Configuration
+
+	for _, p := range n.cfg.Peers {
+		c.Servers = append(c.Servers, raft.Server{Suffrage: raft.Voter, ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.RaftAddr)})
+	}
+
+	return c
+}
+
+// watchLeadership makes the store writable while the node leads, and
+// read-only otherwise, until the node is shut down.
+func (n *Node) watchLeadership() {
+	for {
+		select {
+		case leader := <-n.notify:
+			if leader {
+				n.lead()
+			} else {
+				n.follow()
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// lead takes writes once the entries committed before the node was
+// elected are applied, as writes made before then could be applied out of
+// order with them.
+func (n *Node) lead() {
+	if err := n.raft.Barrier(0).Error(); err != nil {
+		log.Printf("cluster: elected leader, but failed to catch up: %v\n", err)
+		return
+	}
+
+	n.mu.Lock()
+	n.writable = true
+	n.mu.Unlock()
+
+	n.store.SetReadOnly(false, "")
+
+	log.Printf("cluster: %s is the leader\n", n.cfg.ID)
+}
+
+// follow stops taking writes.
+func (n *Node) follow() {
+	n.mu.Lock()
+	n.writable = false
+	n.mu.Unlock()
+
+	n.store.SetReadOnly(true, readOnlyReason)
+
+	log.Printf("cluster: %s is no longer the leader\n", n.cfg.ID)
+}
+
+// WriteEvent commits e to the Raft log, and returns once it is committed,
+// which the store then applies it on. It fails with an error wrapping
+// ErrorNotLeader unless the node leads, or if it stops leading before e
+// is committed, in which case the next leader may still commit e, and the
+// node applies it as it does the others'. ctx is only checked before e is
+// proposed: Raft settles every proposal soon enough, by committing it or
+// by stepping down.
+func (n *Node) WriteEvent(ctx context.Context, e translog.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if !n.writable {
+		n.mu.Unlock()
+		return ErrorNotLeader
+	}
+	n.proposals++
+	id := n.proposals
+	n.pending[id] = &proposal{}
+	n.mu.Unlock()
+
+	err := n.raft.Apply(encodeCommand(n.origin, id, e), 0).Error()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	p := n.pending[id]
+	delete(n.pending, id)
+
+	// The FSM has seen the entry only once it was committed, whatever the
+	// future says
+	if err != nil && !p.seen {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+			return fmt.Errorf("%w: %v", ErrorNotLeader, err)
+		}
+		return fmt.Errorf("raft: %w", err)
+	}
+
+	return nil
+}
+
+// Flush returns at once: the events WriteEvent returned for are committed
+// to a quorum already.
+func (n *Node) Flush(ctx context.Context) error {
+	return nil
+}
+
+// ID returns the ID of the node.
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// IsLeader reports whether the node leads the cluster and takes writes.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.writable
+}
+
+// VerifyLeader checks with a quorum that the node still leads the cluster,
+// so that a read it serves next reflects every write acknowledged before
+// it. It fails with an error wrapping ErrorNotLeader otherwise.
+func (n *Node) VerifyLeader() error {
+	if !n.IsLeader() {
+		return ErrorNotLeader
+	}
+
+	if err := n.raft.VerifyLeader().Error(); err != nil {
+		return fmt.Errorf("%w: %v", ErrorNotLeader, err)
+	}
+
+	return nil
+}
+
+// Leader returns the peer the node takes to be the leader, and false if it
+// knows of none.
+func (n *Node) Leader() (Peer, bool) {
+	_, id := n.raft.LeaderWithID()
+
+	for _, p := range n.cfg.Peers {
+		if raft.ServerID(p.ID) == id {
+			return p, true
+		}
+	}
+
+	return Peer{}, false
+}
+
+// Snapshot takes a Raft snapshot of the node's store now, rather than once
+// enough entries have been committed since the last one, and drops the
+// entries it covers from the Raft log. Nothing is done if no entry was
+// applied since the last snapshot: Raft would take another of the same
+// index, and two taken within a millisecond get the same name, failing the
+// second.
+func (n *Node) Snapshot() error {
+	if last, err := strconv.ParseUint(n.raft.Stats()["last_snapshot_index"], 10, 64); err == nil && last != 0 && last == n.raft.AppliedIndex() {
+		return nil
+	}
+
+	err := n.raft.Snapshot().Error()
+	if errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return nil
+	}
+
+	return err
+}
+
+// Status is the state of a node, as it sees the cluster.
+type Status struct {
+	ID           string `json:"id"`
+	State        string `json:"state"` // Follower, Candidate, Leader or Shutdown
+	Leader       string `json:"leader,omitempty"`
+	Writable     bool   `json:"writable"`
+	Term         uint64 `json:"term"`
+	AppliedIndex uint64 `json:"applied_index"` // Of the last entry of the Raft log applied
+	Peers        []Peer `json:"peers"`
+}
+
+// Status returns the state of the node.
+func (n *Node) Status() Status {
+	st := Status{
+		ID:           n.cfg.ID,
+		State:        n.raft.State().String(),
+		Writable:     n.IsLeader(),
+		AppliedIndex: n.raft.AppliedIndex(),
+		Peers:        n.cfg.Peers,
+	}
+
+	if leader, ok := n.Leader(); ok {
+		st.Leader = leader.ID
+	}
+	st.Term, _ = strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+
+	return st
+}
+
+// Shutdown leaves the cluster, which elects another leader if the node
+// led it, and releases the Raft log. Writes fail from then on.
+func (n *Node) Shutdown() error {
+	n.mu.Lock()
+	n.writable = false
+	n.mu.Unlock()
+
+	// Raft tells of losing the leadership as it shuts down, so the watch
+	// only stops once it has
+	err := n.raft.Shutdown().Error()
+	close(n.done)
+
+	return errors.Join(err, n.trans.Close(), n.logs.Close())
+}
@@ -0,0 +1,437 @@
+package cluster_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/cluster"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// member is a node of a test cluster, with the store it replicates to and
+// the HTTP server in front of it.
+type member struct {
+	peer  cluster.Peer
+	dir   string
+	node  *cluster.Node
+	store *store.Store
+	srv   *httptest.Server
+}
+
+// testCluster is a cluster of nodes running in the test, talking Raft and
+// HTTP over loopback.
+type testCluster struct {
+	t       *testing.T
+	writes  string
+	peers   []cluster.Peer
+	members []*member
+}
+
+// listen returns a listener on a free loopback port.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+// newCluster starts a cluster of n nodes, writing as writes says, and stops
+// it when the test ends.
+func newCluster(t *testing.T, n int, writes string) *testCluster {
+	t.Helper()
+
+	c := &testCluster{t: t, writes: writes}
+	listeners := make([]net.Listener, n)
+
+	for i := range n {
+		raftListener := listen(t)
+		raftAddr := raftListener.Addr().String()
+		raftListener.Close()
+
+		listeners[i] = listen(t)
+		c.peers = append(c.peers, cluster.Peer{
+			ID:       fmt.Sprintf("n%d", i+1),
+			RaftAddr: raftAddr,
+			HTTPURL:  "http://" + listeners[i].Addr().String(),
+		})
+	}
+
+	for i, p := range c.peers {
+		m := &member{peer: p, dir: t.TempDir()}
+		c.members = append(c.members, m)
+		c.start(m, listeners[i])
+	}
+
+	t.Cleanup(func() {
+		for _, m := range c.members {
+			c.stop(m)
+		}
+	})
+
+	return c
+}
+
+// start starts the node of m from its directory, serving HTTP on l.
+func (c *testCluster) start(m *member, l net.Listener) {
+	c.t.Helper()
+
+	node, err := cluster.New(cluster.Config{ID: m.peer.ID, Dir: m.dir, Peers: c.peers, Timeout: 200 * time.Millisecond})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	st := store.New(node, store.Options{})
+	if err := node.Start(st); err != nil {
+		c.t.Fatal(err)
+	}
+
+	srv := &httptest.Server{
+		Listener: l,
+		Config:   &http.Server{Handler: api.NewRouter(api.NewServer(st, api.Config{Cluster: node, ClusterWrites: c.writes}))},
+	}
+	srv.Start()
+
+	m.node, m.store, m.srv = node, st, srv
+}
+
+// restart starts the node of m again, on the addresses it had.
+func (c *testCluster) restart(m *member) {
+	c.t.Helper()
+
+	l, err := net.Listen("tcp", strings.TrimPrefix(m.peer.HTTPURL, "http://"))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.start(m, l)
+}
+
+// stop stops the node of m, unless it's stopped already.
+func (c *testCluster) stop(m *member) {
+	if m.node == nil {
+		return
+	}
+
+	m.srv.Close()
+	if err := m.node.Shutdown(); err != nil {
+		c.t.Errorf("%s: shutdown: %v", m.peer.ID, err)
+	}
+	m.node, m.store, m.srv = nil, nil, nil
+}
+
+// leader waits for one of the running nodes to lead the cluster, and for
+// the others to know it, and returns it.
+func (c *testCluster) leader() *member {
+	c.t.Helper()
+
+	var leader *member
+	waitFor(c.t, "a leader", func() bool {
+		leader = nil
+		for _, m := range c.members {
+			if m.node != nil && m.node.IsLeader() {
+				leader = m
+			}
+		}
+		if leader == nil {
+			return false
+		}
+
+		for _, m := range c.members {
+			if m.node == nil {
+				continue
+			}
+			if p, ok := m.node.Leader(); !ok || p.ID != leader.peer.ID {
+				return false
+			}
+		}
+		return true
+	})
+
+	return leader
+}
+
+// followers returns the running nodes other than leader.
+func (c *testCluster) followers(leader *member) []*member {
+	var ms []*member
+	for _, m := range c.members {
+		if m != leader && m.node != nil {
+			ms = append(ms, m)
+		}
+	}
+
+	return ms
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForValue waits for key to hold value in the store of m.
+func waitForValue(t *testing.T, m *member, key, value string) {
+	t.Helper()
+
+	waitFor(t, fmt.Sprintf("%s to have %s=%s", m.peer.ID, key, value), func() bool {
+		v, err := m.store.Get(key)
+		return err == nil && v == value
+	})
+}
+
+// noRedirects is a client handing back redirects rather than following
+// them.
+var noRedirects = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// do sends a request for path to m with client, returning the status and
+// body of the response.
+func do(t *testing.T, client *http.Client, m *member, method, path, body string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, m.peer.HTTPURL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(b)
+}
+
+// put writes key to m, failing the test unless it's acknowledged.
+func put(t *testing.T, client *http.Client, m *member, key, value string) {
+	t.Helper()
+
+	resp, body := do(t, client, m, "PUT", "/v2/key/"+key, value)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT %s to %s: %d %s", key, m.peer.ID, resp.StatusCode, body)
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := cluster.ParsePeers("a=10.0.0.1:7000=http://10.0.0.1:8080/, b=10.0.0.2:7000=https://kv-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []cluster.Peer{
+		{ID: "a", RaftAddr: "10.0.0.1:7000", HTTPURL: "http://10.0.0.1:8080"},
+		{ID: "b", RaftAddr: "10.0.0.2:7000", HTTPURL: "https://kv-b"},
+	}
+	if fmt.Sprint(peers) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", peers, want)
+	}
+
+	for _, s := range []string{
+		"",
+		"a=10.0.0.1:7000",
+		"a=10.0.0.1:7000=ftp://x",
+		"a=10.0.0.1:7000=http://x,a=10.0.0.2:7000=http://y",
+	} {
+		if _, err := cluster.ParsePeers(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	c := newCluster(t, 3, api.ClusterRedirect)
+	leader := c.leader()
+
+	for i := range 20 {
+		put(t, http.DefaultClient, leader, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+
+	// Every follower applies the writes, and serves them as stale reads
+	followers := c.followers(leader)
+	for _, f := range followers {
+		waitForValue(t, f, "k19", "v19")
+
+		resp, body := do(t, http.DefaultClient, f, "GET", "/v2/key/k3?consistency=stale", "")
+		if resp.StatusCode != http.StatusOK || body != "v3" {
+			t.Errorf("stale read from %s: %d %q", f.peer.ID, resp.StatusCode, body)
+		}
+	}
+
+	// A follower sends writes, and reads asking for the leader, to the leader
+	f := followers[0]
+	for _, path := range []string{"/v2/key/k1", "/v2/key/k1?consistency=leader"} {
+		method := "PUT"
+		if strings.Contains(path, "consistency") {
+			method = "GET"
+		}
+
+		resp, body := do(t, noRedirects, f, method, path, "redirected")
+		if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != leader.peer.HTTPURL+path {
+			t.Errorf("%s %s on a follower: %d, Location %q: %s", method, path, resp.StatusCode, resp.Header.Get("Location"), body)
+		}
+	}
+
+	put(t, http.DefaultClient, f, "k1", "redirected")
+	resp, body := do(t, http.DefaultClient, f, "GET", "/v2/key/k1?consistency=leader", "")
+	if resp.StatusCode != http.StatusOK || body != "redirected" {
+		t.Errorf("leader read through %s: %d %q", f.peer.ID, resp.StatusCode, body)
+	}
+
+	// The store of a follower refuses writes made to it directly
+	if err := f.store.PutCtx(context.Background(), "direct", "x"); err == nil {
+		t.Error("a follower's store accepted a write")
+	}
+
+	// Stop the leader: another node takes over, with everything acknowledged
+	old := leader
+	c.stop(old)
+
+	leader = c.leader()
+	if leader == old {
+		t.Fatal("the stopped node still leads")
+	}
+	for i := range 20 {
+		want := fmt.Sprintf("v%d", i)
+		if i == 1 {
+			want = "redirected"
+		}
+
+		if v, err := leader.store.Get(fmt.Sprintf("k%d", i)); err != nil || v != want {
+			t.Errorf("k%d on the new leader: %q, %v; want %q", i, v, err, want)
+		}
+	}
+
+	for i := 20; i < 40; i++ {
+		put(t, http.DefaultClient, leader, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+
+	// The old leader comes back as a follower and catches up
+	c.restart(old)
+	if c.leader() != leader {
+		t.Error("the leader changed when the old one came back")
+	}
+	waitForValue(t, old, "k39", "v39")
+
+	for _, m := range c.members {
+		waitFor(t, m.peer.ID+" to catch up", func() bool {
+			return m.store.Sequence() == leader.store.Sequence()
+		})
+
+		for i := range 40 {
+			key := fmt.Sprintf("k%d", i)
+			lv, _ := leader.store.Get(key)
+			if v, err := m.store.Get(key); err != nil || v != lv {
+				t.Errorf("%s on %s: %q, %v; leader has %q", key, m.peer.ID, v, err, lv)
+			}
+		}
+	}
+}
+
+func TestProxyWrites(t *testing.T) {
+	c := newCluster(t, 3, api.ClusterProxy)
+	leader := c.leader()
+	f := c.followers(leader)[0]
+
+	resp, body := do(t, noRedirects, f, "PUT", "/v2/key/proxied", "yes")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT through %s: %d %s", f.peer.ID, resp.StatusCode, body)
+	}
+	if v, err := leader.store.Get("proxied"); err != nil || v != "yes" {
+		t.Errorf("leader has %q, %v", v, err)
+	}
+
+	resp, body = do(t, noRedirects, f, "GET", "/v2/key/proxied?consistency=leader", "")
+	if resp.StatusCode != http.StatusOK || body != "yes" {
+		t.Errorf("leader read through %s: %d %q", f.peer.ID, resp.StatusCode, body)
+	}
+}
+
+func TestSnapshotWhileWriting(t *testing.T) {
+	c := newCluster(t, 3, api.ClusterRedirect)
+	leader := c.leader()
+
+	// Snapshots taken while writes wait on their entries don't block them
+	const writers, writes = 4, 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				if err := leader.store.PutCtx(context.Background(), fmt.Sprintf("w%d-%d", w, i), fmt.Sprint(i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for range 3 {
+		if err := leader.node.Snapshot(); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// A follower restarted from its snapshot, and the entries after it,
+	// ends up with the leader's contents
+	f := c.followers(leader)[0]
+	waitFor(t, f.peer.ID+" to catch up", func() bool {
+		return f.store.Sequence() == leader.store.Sequence()
+	})
+	if err := f.node.Snapshot(); err != nil {
+		t.Fatalf("snapshot on %s: %v", f.peer.ID, err)
+	}
+
+	c.stop(f)
+	for i := range 10 {
+		put(t, http.DefaultClient, leader, fmt.Sprintf("after%d", i), "x")
+	}
+	c.restart(f)
+
+	waitFor(t, f.peer.ID+" to catch up", func() bool {
+		return f.store.Sequence() == leader.store.Sequence()
+	})
+	for w := range writers {
+		key := fmt.Sprintf("w%d-%d", w, writes-1)
+		if v, err := f.store.Get(key); err != nil || v != fmt.Sprint(writes-1) {
+			t.Errorf("%s on %s: %q, %v", key, f.peer.ID, v, err)
+		}
+	}
+	if _, err := f.store.Get("after9"); err != nil {
+		t.Errorf("after9 on %s: %v", f.peer.ID, err)
+	}
+}
@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// command is an entry of the Raft log: an event, with the node that
+// proposed it and the number of its proposal, which tell the proposer its
+// own entries apart.
+type command struct {
+	origin   string
+	proposal uint64
+	event    translog.Event
+}
+
+// encodeCommand returns the entry of the proposal id of origin, of e: the
+// origin, the proposal and the line the file log would hold for e,
+// separated by tabs.
+func encodeCommand(origin string, id uint64, e translog.Event) []byte {
+	b := append([]byte(origin), '\t')
+	b = strconv.AppendUint(b, id, 10)
+	b = append(b, '\t')
+
+	return append(b, translog.EncodeEvent(e)...)
+}
+
+// decodeCommand decodes an entry written by encodeCommand.
+func decodeCommand(data []byte) (command, error) {
+	var c command
+
+	origin, rest, ok := strings.Cut(string(data), "\t")
+	id, line, ok2 := strings.Cut(rest, "\t")
+	if !ok || !ok2 {
+		return c, fmt.Errorf("invalid command: expected origin, proposal and event")
+	}
+
+	var err error
+	if c.proposal, err = strconv.ParseUint(id, 10, 64); err != nil {
+		return c, fmt.Errorf("invalid proposal: %w", err)
+	}
+	if c.event, err = translog.DecodeEvent(line); err != nil {
+		return c, err
+	}
+	c.origin = origin
+
+	return c, nil
+}
+
+// fsm applies the Raft log to the store of a node.
+type fsm struct {
+	n *Node
+}
+
+// Apply applies an entry to the store, unless the node proposed it: the
+// write that did applies it once it's told the entry is committed. Entries
+// of events the store has already, from the snapshot it was restored from,
+// are skipped. An entry that can't be applied is logged and skipped, as it
+// is on every node.
+func (f *fsm) Apply(l *raft.Log) any {
+	c, err := decodeCommand(l.Data)
+	if err != nil {
+		log.Printf("cluster: skipping Raft log entry %d: %v\n", l.Index, err)
+		return err
+	}
+
+	n := f.n
+
+	n.mu.Lock()
+	p, own := n.pending[c.proposal]
+	own = own && c.origin == n.origin
+	if own {
+		p.seen = true
+	}
+	restored := c.event.Sequence <= n.applied
+	n.applied = max(n.applied, c.event.Sequence)
+	n.mu.Unlock()
+
+	if own || restored {
+		return nil
+	}
+
+	if err := n.store.ApplyEvent(c.event); err != nil {
+		log.Printf("cluster: skipping Raft log entry %d, event %d: %v\n", l.Index, c.event.Sequence, err)
+		return err
+	}
+
+	return nil
+}
+
+// Snapshot returns a snapshot of the store, taken as it's persisted rather
+// than now: the writes waiting for their entries to be applied hold the
+// store's locks, so it can't be read until Apply moves on. It may then
+// include later entries too, which Apply skips once it's restored.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return snapshot{f.n.store}, nil
+}
+
+// Restore replaces the contents of the store with a snapshot.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+
+	if err := f.n.store.Restore(r); err != nil {
+		return err
+	}
+
+	f.n.mu.Lock()
+	f.n.applied = f.n.store.Sequence()
+	f.n.mu.Unlock()
+
+	return nil
+}
+
+// snapshot persists a snapshot of a store, as store.Snapshot writes it.
+type snapshot struct {
+	store *store.Store
+}
+
+func (s snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.store.Snapshot(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s snapshot) Release() {}
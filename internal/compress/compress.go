@@ -0,0 +1,156 @@
+// Package compress implements the codecs used to compress stored values.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Codec identifies the compression applied to a stored value, and whether
+// the compressed value was then encrypted.
+type Codec byte
+
+const (
+	None Codec = iota
+	Gzip
+	Zlib
+)
+
+// Encrypted is set on the codec of a value that was encrypted after being
+// compressed with the rest of the codec.
+const Encrypted Codec = 0x80
+
+// Blob is set on the codec of a value kept in a blob directory once
+// compressed and encrypted with the rest of the codec. The value stored with
+// it is the blob's reference.
+const Blob Codec = 0x40
+
+// Suffixes of the names of encrypted codecs, such as "gzip+aes", and of
+// blob codecs, such as "gzip+aes+blob".
+const (
+	encryptedSuffix = "+aes"
+	blobSuffix      = "+blob"
+)
+
+// IsEncrypted reports whether Encrypted is set on c.
+func (c Codec) IsEncrypted() bool {
+	return c&Encrypted != 0
+}
+
+// IsBlob reports whether Blob is set on c.
+func (c Codec) IsBlob() bool {
+	return c&Blob != 0
+}
+
+// Compression returns c without Encrypted.
+func (c Codec) Compression() Codec {
+	return c &^ Encrypted
+}
+
+var codecNames = map[Codec]string{
+	None: "none",
+	Gzip: "gzip",
+	Zlib: "zlib",
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c.Compression()&^Blob]; ok {
+		if c.IsEncrypted() {
+			name += encryptedSuffix
+		}
+		if c.IsBlob() {
+			name += blobSuffix
+		}
+		return name
+	}
+
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// Parse returns the codec with the given name.
+func Parse(name string) (Codec, error) {
+	base, blob := strings.CutSuffix(name, blobSuffix)
+	base, encrypted := strings.CutSuffix(base, encryptedSuffix)
+
+	for c, n := range codecNames {
+		if n == base {
+			if encrypted {
+				c |= Encrypted
+			}
+			if blob {
+				c |= Blob
+			}
+			return c, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown compression codec %q", name)
+}
+
+// Compress compresses value with c if it is at least threshold bytes long
+// and compression actually makes it smaller. It returns the value to store
+// and the codec that was applied.
+func Compress(value string, c Codec, threshold int) (string, Codec) {
+	if c == None || len(value) < threshold {
+		return value, None
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch c {
+	case Gzip:
+		w = gzip.NewWriter(&buf)
+	case Zlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return value, None
+	}
+
+	io.WriteString(w, value)
+
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return value, None
+	}
+
+	return buf.String(), c
+}
+
+// Decompress reverses Compress.
+func Decompress(value string, c Codec) (string, error) {
+	var r io.ReadCloser
+	var err error
+
+	if c.IsBlob() {
+		return "", fmt.Errorf("value is a blob reference")
+	}
+
+	switch c {
+	case None:
+		return value, nil
+	case Gzip:
+		r, err = gzip.NewReader(strings.NewReader(value))
+	case Zlib:
+		r, err = zlib.NewReader(strings.NewReader(value))
+	case None | Encrypted, Gzip | Encrypted, Zlib | Encrypted:
+		return "", fmt.Errorf("value is encrypted")
+	default:
+		return "", fmt.Errorf("unknown compression codec %d", c)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress value: %w", err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress value: %w", err)
+	}
+
+	return string(b), nil
+}
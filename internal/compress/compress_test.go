@@ -0,0 +1,118 @@
+package compress
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// jsonValue returns a JSON document of about n bytes, as repetitive as the
+// records of a typical API response.
+func jsonValue(n int) string {
+	var b strings.Builder
+
+	b.WriteString(`[`)
+	for i := 0; b.Len() < n; i++ {
+		if i > 0 {
+			b.WriteString(`,`)
+		}
+		fmt.Fprintf(&b, `{"id":%d,"status":"shipped","customer":{"name":"customer %d","tier":"gold"},"total":%d.%02d}`, i, i%37, i*13%1000, i%100)
+	}
+	b.WriteString(`]`)
+
+	return b.String()
+}
+
+// randomValue returns n bytes no codec can compress.
+func randomValue(n int) string {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+
+	return string(b)
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	value := jsonValue(64 << 10)
+
+	for _, c := range []Codec{Gzip, Zlib} {
+		stored, applied := Compress(value, c, 1024)
+		if applied != c {
+			t.Errorf("%v: compressed with %v", c, applied)
+		}
+		if len(stored) >= len(value)/4 {
+			t.Errorf("%v: %d bytes compressed to %d", c, len(value), len(stored))
+		}
+
+		got, err := Decompress(stored, applied)
+		if err != nil || got != value {
+			t.Errorf("%v: decompressed to %d bytes, %v", c, len(got), err)
+		}
+	}
+}
+
+func TestCompressLeavesValuesRawUnlessItHelps(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		codec     Codec
+		threshold int
+	}{
+		{"incompressible", randomValue(8 << 10), Gzip, 1024},
+		{"below the threshold", jsonValue(4 << 10), Zlib, 64 << 10},
+		{"no codec", jsonValue(8 << 10), None, 0},
+	}
+
+	for _, tt := range tests {
+		stored, applied := Compress(tt.value, tt.codec, tt.threshold)
+		if applied != None || stored != tt.value {
+			t.Errorf("%s: stored %d of %d bytes with %v, want them raw", tt.name, len(stored), len(tt.value), applied)
+		}
+	}
+}
+
+func TestDecompressRefusesOtherCodecs(t *testing.T) {
+	for _, c := range []Codec{Gzip | Encrypted, Gzip | Blob, Codec(9)} {
+		if _, err := Decompress("x", c); err == nil {
+			t.Errorf("Decompress with %v succeeded", c)
+		}
+	}
+
+	if _, err := Decompress("not gzip", Gzip); err == nil {
+		t.Error("Decompress of a corrupt value succeeded")
+	}
+}
+
+func TestCodecNames(t *testing.T) {
+	for _, c := range []Codec{None, Gzip, Zlib, Gzip | Encrypted, None | Encrypted | Blob, Zlib | Blob} {
+		parsed, err := Parse(c.String())
+		if err != nil || parsed != c {
+			t.Errorf("Parse(%q) = %v, %v; want %v", c.String(), parsed, err, c)
+		}
+	}
+
+	if _, err := Parse("snappy"); err == nil {
+		t.Error(`Parse("snappy") succeeded`)
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	value := jsonValue(100 << 10)
+
+	for _, c := range []Codec{Gzip, Zlib} {
+		b.Run(c.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(value)))
+
+			var stored string
+			for i := 0; i < b.N; i++ {
+				stored, _ = Compress(value, c, 0)
+			}
+
+			b.ReportMetric(float64(len(stored))/float64(len(value)), "ratio")
+		})
+	}
+}
@@ -0,0 +1,401 @@
+// Package crypt encrypts stored values with envelope keys. Values are sealed
+// with AES-GCM under a data key, and the data keys are kept in a keyring file
+// wrapped by a master key, which is never written to disk. Wrapping is
+// behind the Wrapper interface, so a KMS can hold the master key instead.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyringFileName is the default name of the keyring in a data directory.
+const KeyringFileName = "keyring.json"
+
+// keySize is the size in bytes of master and data keys, for AES-256.
+const keySize = 32
+
+// formatVersion starts every ciphertext, followed by the ID of its data key
+// as 4 big-endian bytes, the nonce and the sealed value.
+const formatVersion = 1
+
+var ErrorWrongMasterKey = errors.New("wrong master key")
+
+var ErrorNoKey = errors.New("value is encrypted and no key is configured")
+
+// Cipher encrypts and decrypts stored values.
+type Cipher interface {
+	Encrypt(plaintext string) (string, error)
+	Decrypt(ciphertext string) (string, error)
+
+	// Current reports whether ciphertext is sealed under the data key that
+	// Encrypt uses now.
+	Current(ciphertext string) bool
+}
+
+// Encode compresses value with codec if it's at least threshold bytes long,
+// then encrypts it with c unless c is nil. It returns the value to store and
+// the codec that was applied, with compress.Encrypted set if c encrypted it.
+func Encode(value string, codec compress.Codec, threshold int, c Cipher) (string, compress.Codec, error) {
+	stored, codec := compress.Compress(value, codec, threshold)
+	if c == nil {
+		return stored, codec, nil
+	}
+
+	sealed, err := c.Encrypt(stored)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return sealed, codec | compress.Encrypted, nil
+}
+
+// Decode reverses Encode. Values without compress.Encrypted are only
+// decompressed, so values stored before encryption was enabled still read.
+func Decode(value string, codec compress.Codec, c Cipher) (string, error) {
+	if codec.IsEncrypted() {
+		if c == nil {
+			return "", ErrorNoKey
+		}
+
+		var err error
+		if value, err = c.Decrypt(value); err != nil {
+			return "", err
+		}
+	}
+
+	return compress.Decompress(value, codec.Compression())
+}
+
+// Wrapper encrypts data keys for storage in a keyring file.
+type Wrapper interface {
+	Wrap(dataKey []byte) ([]byte, error)
+
+	// Unwrap returns the data key in wrapped, or an error wrapping
+	// ErrorWrongMasterKey if it wasn't wrapped by this Wrapper's key.
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// MasterKey wraps data keys with AES-GCM under a key held in memory.
+type MasterKey struct {
+	aead cipher.AEAD
+}
+
+// ParseMasterKey returns the master key encoded in s as 32 bytes of base64
+// or hex.
+func ParseMasterKey(s string) (*MasterKey, error) {
+	s = strings.TrimSpace(s)
+
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != keySize {
+		if key, err = hex.DecodeString(s); err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("master key must be %d bytes of base64 or hex", keySize)
+		}
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MasterKey{aead: aead}, nil
+}
+
+// LoadMasterKey reads a master key, as parsed by ParseMasterKey, from the
+// file at path.
+func LoadMasterKey(path string) (*MasterKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := ParseMasterKey(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return k, nil
+}
+
+func (k *MasterKey) Wrap(dataKey []byte) ([]byte, error) {
+	return seal(k.aead, nil, dataKey)
+}
+
+func (k *MasterKey) Unwrap(wrapped []byte) ([]byte, error) {
+	key, err := open(k.aead, nil, wrapped)
+	if err != nil {
+		return nil, ErrorWrongMasterKey
+	}
+
+	return key, nil
+}
+
+// keyringFile is the JSON layout of a keyring file.
+type keyringFile struct {
+	Current string       `json:"current"` // ID of the key new values are encrypted with
+	Keys    []wrappedKey `json:"keys"`
+}
+
+type wrappedKey struct {
+	ID      string    `json:"id"` // 8 hex digits
+	Wrapped []byte    `json:"wrapped"`
+	Created time.Time `json:"created"`
+}
+
+// Keyring is a Cipher holding every data key values were ever encrypted
+// with, since the transaction log keeps old values for replay. New values
+// are encrypted with the current key. It is safe for concurrent use.
+type Keyring struct {
+	path    string
+	wrapper Wrapper
+
+	mu      sync.RWMutex
+	file    keyringFile
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+// OpenKeyring reads the keyring file at path and unwraps its data keys with
+// w, or creates the file with a new data key if there isn't one. A keyring
+// that w can't unwrap is an error wrapping ErrorWrongMasterKey.
+func OpenKeyring(path string, w Wrapper) (*Keyring, error) {
+	k := &Keyring{path: path, wrapper: w, keys: make(map[uint32]cipher.AEAD)}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &k.file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, wk := range k.file.Keys {
+		id, err := parseKeyID(wk.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		key, err := w.Unwrap(wk.Wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("%s: data key %s: %w", path, wk.ID, err)
+		}
+
+		if k.keys[id], err = newAEAD(key); err != nil {
+			return nil, fmt.Errorf("%s: data key %s: %w", path, wk.ID, err)
+		}
+	}
+
+	if k.current, err = parseKeyID(k.file.Current); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if k.keys[k.current] == nil {
+		return nil, fmt.Errorf("%s: current data key %s is missing", path, k.file.Current)
+	}
+
+	return k, nil
+}
+
+// Rotate adds a new data key to the keyring and makes it current, and
+// returns its ID. Values already encrypted keep their keys until they are
+// rewritten or re-encrypted.
+func (k *Keyring) Rotate() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	var id uint32
+	for id == 0 || k.keys[id] != nil {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		id = binary.BigEndian.Uint32(b[:])
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := k.wrapper.Wrap(key)
+	if err != nil {
+		return "", err
+	}
+
+	file := k.file
+	file.Current = formatKeyID(id)
+	file.Keys = append(file.Keys[:len(file.Keys):len(file.Keys)], wrappedKey{ID: file.Current, Wrapped: wrapped, Created: time.Now().UTC()})
+
+	// The key must be on disk before anything is encrypted with it
+	if err := writeKeyring(k.path, file); err != nil {
+		return "", err
+	}
+
+	k.file = file
+	k.keys[id] = aead
+	k.current = id
+
+	return file.Current, nil
+}
+
+// writeKeyring replaces the keyring file at path with file.
+func writeKeyring(path string, file keyringFile) error {
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	k.mu.RLock()
+	id, aead := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+
+	header := []byte{formatVersion, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], id)
+
+	sealed, err := seal(aead, header, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return string(sealed), nil
+}
+
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	id, err := ciphertextKeyID(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	k.mu.RLock()
+	aead := k.keys[id]
+	k.mu.RUnlock()
+
+	if aead == nil {
+		return "", fmt.Errorf("value is encrypted with unknown data key %s", formatKeyID(id))
+	}
+
+	plaintext, err := open(aead, []byte(ciphertext[:5]), []byte(ciphertext[5:]))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value with data key %s: %w", formatKeyID(id), err)
+	}
+
+	return string(plaintext), nil
+}
+
+func (k *Keyring) Current(ciphertext string) bool {
+	id, err := ciphertextKeyID(ciphertext)
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return err == nil && id == k.current
+}
+
+// ciphertextKeyID returns the ID of the data key ciphertext is sealed with.
+func ciphertextKeyID(ciphertext string) (uint32, error) {
+	if len(ciphertext) < 5 || ciphertext[0] != formatVersion {
+		return 0, errors.New("invalid encrypted value")
+	}
+
+	return binary.BigEndian.Uint32([]byte(ciphertext[1:5])), nil
+}
+
+func formatKeyID(id uint32) string {
+	return fmt.Sprintf("%08x", id)
+}
+
+func parseKeyID(s string) (uint32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, fmt.Errorf("invalid data key ID %q", s)
+	}
+
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal returns header followed by a random nonce and the sealing of
+// plaintext. The header is authenticated too, so that a ciphertext can't be
+// passed off as sealed under another key ID.
+func seal(aead cipher.AEAD, header, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+// open reverses seal, given the header and the rest of its output.
+func open(aead cipher.AEAD, header, b []byte) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, sealed := b[:aead.NonceSize()], b[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, sealed, header)
+}
@@ -0,0 +1,211 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newMasterKey returns a random master key, in base64 and parsed.
+func newMasterKey(t *testing.T) (string, *MasterKey) {
+	t.Helper()
+
+	b := make([]byte, keySize)
+	rand.Read(b)
+
+	s := base64.StdEncoding.EncodeToString(b)
+	k, err := ParseMasterKey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, k
+}
+
+func TestParseMasterKey(t *testing.T) {
+	b := make([]byte, keySize)
+	rand.Read(b)
+
+	for _, s := range []string{base64.StdEncoding.EncodeToString(b), hex.EncodeToString(b), " " + hex.EncodeToString(b) + "\n"} {
+		if _, err := ParseMasterKey(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+
+	for _, s := range []string{"", "not a key", hex.EncodeToString(b[:16]), base64.StdEncoding.EncodeToString(append(b, 0))} {
+		if _, err := ParseMasterKey(s); err == nil {
+			t.Errorf("%q parsed as a master key", s)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	_, mk := newMasterKey(t)
+	kr, err := OpenKeyring(filepath.Join(t.TempDir(), KeyringFileName), mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []string{"", "short", strings.Repeat("compressible ", 100), "\x00\xff binary"}
+
+	for _, c := range []Cipher{nil, kr} {
+		for _, codec := range []compress.Codec{compress.None, compress.Gzip, compress.Zlib} {
+			for _, v := range values {
+				stored, applied, err := Encode(v, codec, 64, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if applied.IsEncrypted() != (c != nil) {
+					t.Errorf("%s with cipher %v: codec %s", codec, c, applied)
+				}
+				if c != nil && strings.Contains(stored, "short") {
+					t.Errorf("%q stored in the clear as %q", v, stored)
+				}
+
+				got, err := Decode(stored, applied, c)
+				if err != nil || got != v {
+					t.Errorf("%s with cipher %v: %q decoded as %q, %v", codec, c, v, got, err)
+				}
+			}
+		}
+	}
+
+	// Values stored in the clear read with a cipher, but encrypted ones not
+	// without
+	stored, codec, _ := Encode("clear", compress.None, 0, nil)
+	if got, err := Decode(stored, codec, kr); err != nil || got != "clear" {
+		t.Errorf("a value stored in the clear decoded as %q, %v", got, err)
+	}
+
+	stored, codec, _ = Encode("secret", compress.None, 0, kr)
+	if _, err := Decode(stored, codec, nil); !errors.Is(err, ErrorNoKey) {
+		t.Errorf("an encrypted value decoded without a cipher: %v, want ErrorNoKey", err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), KeyringFileName)
+	encoded, mk := newMasterKey(t)
+
+	kr, err := OpenKeyring(path, mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := kr.file.Current
+
+	old, err := kr.Encrypt("old value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kr.Current(old) {
+		t.Error("a value just encrypted isn't current")
+	}
+
+	// Rotating makes a new key current and keeps the old one
+	second, err := kr.Rotate()
+	if err != nil || second == first {
+		t.Fatalf("rotated to %q, %v, from %q", second, err, first)
+	}
+	if kr.Current(old) {
+		t.Error("a value encrypted before the rotation is current")
+	}
+
+	newer, err := kr.Encrypt("new value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check checks that kr decrypts the values of both keys, and takes only
+	// the newer as current
+	check := func(t *testing.T, kr *Keyring, when string) {
+		t.Helper()
+
+		if got, err := kr.Decrypt(old); err != nil || got != "old value" {
+			t.Errorf("%s: the old value decrypted as %q, %v", when, got, err)
+		}
+		if got, err := kr.Decrypt(newer); err != nil || got != "new value" {
+			t.Errorf("%s: the new value decrypted as %q, %v", when, got, err)
+		}
+		if kr.Current(old) || !kr.Current(newer) {
+			t.Errorf("%s: the old value current %t, the new %t", when, kr.Current(old), kr.Current(newer))
+		}
+	}
+
+	check(t, kr, "after the rotation")
+
+	// The keyring reopens with the master key read back from a file
+	keyPath := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(keyPath, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mk, err = LoadMasterKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenKeyring(path, mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.file.Current != second || len(reopened.keys) != 2 {
+		t.Errorf("reopened with current key %s of %d, want %s of 2", reopened.file.Current, len(reopened.keys), second)
+	}
+	check(t, reopened, "after reopening")
+
+	// But not with another master key
+	_, wrong := newMasterKey(t)
+	if _, err := OpenKeyring(path, wrong); !errors.Is(err, ErrorWrongMasterKey) {
+		t.Errorf("opened with the wrong master key: %v, want ErrorWrongMasterKey", err)
+	}
+}
+
+func TestTamperedCiphertexts(t *testing.T) {
+	_, mk := newMasterKey(t)
+	kr, err := OpenKeyring(filepath.Join(t.TempDir(), KeyringFileName), mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := kr.Encrypt("value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := binary.BigEndian.Uint32([]byte(sealed[1:5]))
+
+	if _, err := kr.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// withKeyID returns sealed with its header naming the data key id
+	withKeyID := func(id uint32) string {
+		b := []byte(sealed)
+		binary.BigEndian.PutUint32(b[1:5], id)
+		return string(b)
+	}
+
+	tampered := map[string]string{
+		"the ID of the current key": withKeyID(kr.current),
+		"the ID of an unknown key":  withKeyID(from + 1),
+		"another version":           "\x02" + sealed[1:],
+		"a flipped bit":             sealed[:len(sealed)-1] + string(sealed[len(sealed)-1]^1),
+		"a cut":                     sealed[:len(sealed)-1],
+		"a header only":             sealed[:5],
+		"too short":                 sealed[:3],
+	}
+
+	for what, ciphertext := range tampered {
+		if got, err := kr.Decrypt(ciphertext); err == nil {
+			t.Errorf("a value with %s decrypted as %q", what, got)
+		}
+	}
+
+	if got, err := kr.Decrypt(sealed); err != nil || got != "value" {
+		t.Errorf("the value decrypted as %q, %v", got, err)
+	}
+}
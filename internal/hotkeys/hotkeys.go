@@ -0,0 +1,286 @@
+// Package hotkeys finds the keys read and written the most lately, to tell
+// which ones are hot when latency spikes. Operations are counted by
+// SlotWidth in bounded sketches, so that the memory taken doesn't depend on
+// the number of keys, and the counts it reports are approximate.
+package hotkeys
+
+import (
+	"cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultCapacity is the number of keys a Tracker counts by default in each
+// slot, for reads and for writes.
+const DefaultCapacity = 256
+
+// SlotWidth is the time each slot of a Tracker counts the operations of,
+// and the granularity of the windows it reports on.
+const SlotWidth = 10 * time.Second
+
+// slots is how many slots a Tracker keeps.
+const slots = 90
+
+// MaxWindow is the longest window a Tracker reports on.
+const MaxWindow = slots * SlotWidth
+
+var hotKeyShare = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "kv_hot_key_share",
+	Help: "Share of the reads and writes of the last complete slot of the hot-key tracker taken by its most frequent key, between 0 and 1; a share near 1 is a pathological skew.",
+})
+
+// Collectors returns the tracker's metrics, for the metrics registry.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{hotKeyShare}
+}
+
+// Options configures a Tracker.
+type Options struct {
+	Capacity   int     // Keys counted in each slot, for reads and for writes; DefaultCapacity if 0
+	SampleRate float64 // Share of the operations counted, between 0 and 1, their counts scaled up to match; every operation if 0
+	HashKeys   bool    // Report a hash of the keys and of their buckets but the default instead of them, for privacy
+}
+
+// slot counts the operations of one SlotWidth.
+type slot struct {
+	n             int64 // Number of the SlotWidth counted, since the epoch; the slot is stale if it's another
+	reads, writes *sketch
+}
+
+// Tracker counts the operations on each key, by slot, over the last
+// MaxWindow. A slot is reset once it is MaxWindow old, and each holds at
+// most Options.Capacity keys for reads and as many for writes. A nil
+// *Tracker counts nothing. It is safe for concurrent use.
+type Tracker struct {
+	opts Options
+	now  func() time.Time
+
+	mu    sync.Mutex
+	slots [slots]slot
+}
+
+// New returns a Tracker configured by opts. now tells the time, time.Now if
+// nil.
+func New(opts Options, now func() time.Time) *Tracker {
+	if opts.Capacity <= 0 {
+		opts.Capacity = DefaultCapacity
+	}
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	if now == nil {
+		now = time.Now
+	}
+
+	return &Tracker{opts: opts, now: now}
+}
+
+// slotNumber returns the number of the SlotWidth of t since the epoch.
+func slotNumber(t time.Time) int64 {
+	return t.Unix() / int64(SlotWidth/time.Second)
+}
+
+// Observe counts a read or a write of key in bucket, unless it isn't
+// sampled.
+func (t *Tracker) Observe(bucket, key string, write bool) {
+	if t == nil {
+		return
+	}
+	if t.opts.SampleRate < 1 && rand.Float64() >= t.opts.SampleRate {
+		return
+	}
+
+	n := slotNumber(t.now())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sl := &t.slots[n%slots]
+	if sl.n != n {
+		t.rotate(sl, n)
+	}
+
+	if write {
+		sl.writes.add(id{bucket, key})
+	} else {
+		sl.reads.add(id{bucket, key})
+	}
+}
+
+// rotate resets sl to count the slot n, once the share of the hottest key
+// of the slot before it is set in kv_hot_key_share. The caller must hold
+// t.mu.
+func (t *Tracker) rotate(sl *slot, n int64) {
+	if prev := &t.slots[(n-1)%slots]; prev.n == n-1 && prev.reads != nil {
+		hotKeyShare.Set(topShare(prev.reads, prev.writes))
+	} else {
+		hotKeyShare.Set(0)
+	}
+
+	sl.n = n
+	if sl.reads == nil {
+		sl.reads, sl.writes = newSketch(t.opts.Capacity), newSketch(t.opts.Capacity)
+		return
+	}
+
+	sl.reads.reset()
+	sl.writes.reset()
+}
+
+// topShare returns the share of the operations counted by reads and writes
+// taken by the key counted most by both.
+func topShare(reads, writes *sketch) float64 {
+	total := reads.total + writes.total
+	if total == 0 {
+		return 0
+	}
+
+	var top uint64
+	for k, c := range reads.counters {
+		n := c.count
+		if w, ok := writes.counters[k]; ok {
+			n += w.count
+		}
+		top = max(top, n)
+	}
+	for _, c := range writes.counters {
+		top = max(top, c.count)
+	}
+
+	return min(float64(top)/float64(total), 1)
+}
+
+// Reset forgets every operation counted so far.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.slots {
+		t.slots[i].n = 0
+	}
+	hotKeyShare.Set(0)
+}
+
+// Key is a hot key, with its approximate count of operations.
+type Key struct {
+	Bucket string `json:"bucket"` // Hashed if the Tracker hashes keys, unless it's the default
+	Key    string `json:"key"`    // Hashed if the Tracker hashes keys
+	Count  uint64 `json:"count"`  // Operations on the key, at most; scaled up for sampling
+	Error  uint64 `json:"error"`  // Most by which Count may overestimate them
+}
+
+// Report is what a Tracker counted over a window.
+type Report struct {
+	Window     string  `json:"window"`
+	SampleRate float64 `json:"sample_rate"`
+	Reads      uint64  `json:"reads"`  // Operations counted, scaled up for sampling
+	Writes     uint64  `json:"writes"` // Likewise
+	TopReads   []Key   `json:"top_reads"`
+	TopWrites  []Key   `json:"top_writes"`
+}
+
+// Top reports the n keys read the most and the n written the most over the
+// window ending now, rounded up to a multiple of SlotWidth and at most
+// MaxWindow. The window includes the slot under way, so it may cover up to
+// SlotWidth less than asked.
+func (t *Tracker) Top(window time.Duration, n int) Report {
+	k := min(int64((window+SlotWidth-1)/SlotWidth), slots)
+	last := slotNumber(t.now())
+
+	var reads, writes []*sketch
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range k {
+		sl := &t.slots[(last-i)%slots]
+		if sl.n != last-i || sl.reads == nil {
+			continue
+		}
+		reads = append(reads, sl.reads)
+		writes = append(writes, sl.writes)
+	}
+
+	r := Report{
+		Window:     (time.Duration(k) * SlotWidth).String(),
+		SampleRate: t.opts.SampleRate,
+	}
+
+	var total uint64
+	r.TopReads, total = t.top(reads, n)
+	r.Reads = t.scale(total)
+	r.TopWrites, total = t.top(writes, n)
+	r.Writes = t.scale(total)
+
+	return r
+}
+
+// top merges the counts of sketches, and returns the n keys counted most,
+// with the total of operations counted. The caller must hold t.mu.
+func (t *Tracker) top(sketches []*sketch, n int) ([]Key, uint64) {
+	type bounds struct{ upper, lower uint64 }
+
+	var total uint64
+	merged := make(map[id]*bounds)
+
+	for _, s := range sketches {
+		total += s.total
+		for k, c := range s.counters {
+			b, ok := merged[k]
+			if !ok {
+				b = &bounds{}
+				merged[k] = b
+			}
+			b.upper += c.count
+			b.lower += c.count - c.err
+		}
+	}
+
+	// A key without a counter in a full sketch may have had up to its least
+	// count there
+	for _, s := range sketches {
+		if floor := s.floor(); floor > 0 {
+			for k, b := range merged {
+				if _, ok := s.counters[k]; !ok {
+					b.upper += floor
+				}
+			}
+		}
+	}
+
+	keys := make([]Key, 0, len(merged))
+	for k, b := range merged {
+		bucket, key := k.bucket, k.key
+		if t.opts.HashKeys {
+			key = timing.HashKey(key)
+			if bucket != translog.DefaultBucket {
+				bucket = timing.HashKey(bucket)
+			}
+		}
+
+		keys = append(keys, Key{
+			Bucket: bucket,
+			Key:    key,
+			Count:  t.scale(b.upper),
+			Error:  t.scale(b.upper - b.lower),
+		})
+	}
+
+	slices.SortFunc(keys, func(a, b Key) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Error, b.Error), cmp.Compare(a.Bucket, b.Bucket), cmp.Compare(a.Key, b.Key))
+	})
+
+	return keys[:min(n, len(keys))], total
+}
+
+// scale returns n operations counted as the operations they stand for,
+// given the sample rate.
+func (t *Tracker) scale(n uint64) uint64 {
+	return uint64(math.Round(float64(n) / t.opts.SampleRate))
+}
@@ -0,0 +1,219 @@
+package hotkeys
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clock is a time a test sets, for a Tracker to tell.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+// newClock returns a clock at the start of a slot.
+func newClock() *clock {
+	return &clock{time.Unix(1_700_000_000, 0)}
+}
+
+// checkBounds checks that the count of each key of got is at least the
+// operations counted on it, by want, and overestimates them by at most its
+// error, and that no error is above maxErr.
+func checkBounds(t *testing.T, got []Key, want map[string]uint64, maxErr uint64) {
+	t.Helper()
+
+	for _, k := range got {
+		n := want[k.Key]
+		if k.Count < n || k.Count-k.Error > n || k.Error > maxErr {
+			t.Errorf("%s counted %d with error %d, but had %d operations; errors must be at most %d", k.Key, k.Count, k.Error, n, maxErr)
+		}
+	}
+}
+
+func TestZipfianTopKeys(t *testing.T) {
+	const (
+		capacity = 64
+		ops      = 100_000
+		n        = 10
+	)
+
+	c := newClock()
+	tr := New(Options{Capacity: capacity}, c.now)
+
+	r := rand.New(rand.NewPCG(1, 2))
+	zipf := rand.NewZipf(r, 1.1, 1, 9_999)
+
+	counts := make(map[string]uint64)
+	for range ops {
+		key := fmt.Sprintf("k%d", zipf.Uint64())
+		counts[key]++
+		tr.Observe("default", key, false)
+	}
+
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int { return int(counts[b]) - int(counts[a]) })
+
+	report := tr.Top(SlotWidth, n)
+	if report.Reads != ops || report.Writes != 0 || len(report.TopWrites) != 0 {
+		t.Fatalf("report of %d reads and %d writes, want %d reads", report.Reads, report.Writes, ops)
+	}
+	if len(report.TopReads) != n {
+		t.Fatalf("%d top reads, want %d", len(report.TopReads), n)
+	}
+
+	// The hottest keys are certain to be counted, in their order
+	for i, k := range report.TopReads[:5] {
+		if k.Key != keys[i] {
+			t.Errorf("top read %d is %s, want %s", i, k.Key, keys[i])
+		}
+	}
+
+	var reported []string
+	for _, k := range report.TopReads {
+		reported = append(reported, k.Key)
+	}
+	for _, k := range keys[:n] {
+		if counts[k] > ops/capacity && !slices.Contains(reported, k) {
+			t.Errorf("%s, with %d operations, isn't among the top reads %v", k, counts[k], reported)
+		}
+	}
+
+	checkBounds(t, report.TopReads, counts, ops/capacity)
+}
+
+func TestErrorBoundsAcrossSlots(t *testing.T) {
+	const capacity = 8
+
+	c := newClock()
+	tr := New(Options{Capacity: capacity}, c.now)
+	r := rand.New(rand.NewPCG(3, 4))
+
+	// Each slot has its own hot keys, and a long tail the sketches can't
+	// all keep
+	counts := make(map[string]uint64)
+	var total uint64
+	for slot := range 3 {
+		for range 2_000 {
+			var key string
+			if r.IntN(2) == 0 {
+				key = fmt.Sprintf("hot%d", r.IntN(slot+2))
+			} else {
+				key = fmt.Sprintf("cold%d", r.IntN(200))
+			}
+			counts[key]++
+			total++
+			tr.Observe("default", key, true)
+		}
+		c.t = c.t.Add(SlotWidth)
+	}
+	c.t = c.t.Add(-time.Second)
+
+	report := tr.Top(3*SlotWidth, 1_000)
+	if report.Writes != total {
+		t.Fatalf("%d writes, want %d", report.Writes, total)
+	}
+
+	// A key's error is at most the least count of each sketch, and those
+	// are each at most the sketch's total over its capacity
+	checkBounds(t, report.TopWrites, counts, total/capacity)
+
+	for i, k := range report.TopWrites[:2] {
+		if !strings.HasPrefix(k.Key, "hot") {
+			t.Errorf("top write %d is %s, want a hot key", i, k.Key)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	c := newClock()
+	tr := New(Options{}, c.now)
+
+	// counts returns the reads of each key over window
+	counts := func(window time.Duration) map[string]uint64 {
+		got := make(map[string]uint64)
+		for _, k := range tr.Top(window, 100).TopReads {
+			got[k.Key] = k.Count
+		}
+		return got
+	}
+
+	tr.Observe("default", "first", false)
+	tr.Observe("default", "first", false)
+	c.t = c.t.Add(SlotWidth)
+	tr.Observe("default", "second", false)
+	c.t = c.t.Add(SlotWidth)
+
+	if got := counts(SlotWidth); len(got) != 0 {
+		t.Errorf("the slot under way counted %v, want nothing", got)
+	}
+	if got := counts(2 * SlotWidth); fmt.Sprint(got) != "map[second:1]" {
+		t.Errorf("the last two slots counted %v, want second once", got)
+	}
+	if got := counts(3 * SlotWidth); fmt.Sprint(got) != "map[first:2 second:1]" {
+		t.Errorf("the last three slots counted %v", got)
+	}
+	if r := tr.Top(time.Hour, 1); r.Window != MaxWindow.String() || r.Reads != 3 {
+		t.Errorf("a window of an hour is %s with %d reads, want %s with 3", r.Window, r.Reads, MaxWindow)
+	}
+
+	// A slot is reused for the slot a MaxWindow later, forgetting what it
+	// counted
+	c.t = time.Unix(1_700_000_000, 0).Add(MaxWindow)
+	tr.Observe("default", "later", false)
+	if got := counts(MaxWindow); fmt.Sprint(got) != "map[later:1 second:1]" {
+		t.Errorf("a MaxWindow on, the window counted %v, want first forgotten", got)
+	}
+
+	c.t = c.t.Add(MaxWindow)
+	if got := counts(MaxWindow); len(got) != 0 {
+		t.Errorf("a MaxWindow after the last operation, the window counted %v", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	c := newClock()
+	tr := New(Options{}, c.now)
+
+	tr.Observe("default", "k", false)
+	tr.Observe("default", "k", true)
+	tr.Reset()
+
+	if r := tr.Top(MaxWindow, 10); r.Reads != 0 || r.Writes != 0 || len(r.TopReads) != 0 || len(r.TopWrites) != 0 {
+		t.Errorf("after a reset: %+v", r)
+	}
+
+	tr.Observe("default", "k", false)
+	if r := tr.Top(MaxWindow, 10); r.Reads != 1 || len(r.TopReads) != 1 || r.TopReads[0].Count != 1 {
+		t.Errorf("a read after a reset: %+v", r)
+	}
+
+	var nilTracker *Tracker
+	nilTracker.Observe("default", "k", false)
+}
+
+func TestHashKeys(t *testing.T) {
+	c := newClock()
+	tr := New(Options{HashKeys: true}, c.now)
+
+	tr.Observe("default", "secret-key", true)
+	tr.Observe("customers", "secret-key", true)
+
+	var got []string
+	for _, k := range tr.Top(SlotWidth, 10).TopWrites {
+		got = append(got, k.Bucket+"/"+k.Key)
+	}
+	slices.Sort(got)
+
+	want := []string{timing.HashKey("customers") + "/" + timing.HashKey("secret-key"), "default/" + timing.HashKey("secret-key")}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("hashed hot keys %v, want %v", got, want)
+	}
+}
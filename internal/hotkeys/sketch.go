@@ -0,0 +1,100 @@
+package hotkeys
+
+import "container/heap"
+
+// id names a key within its bucket.
+type id struct {
+	bucket, key string
+}
+
+// counter is the count of a key a sketch keeps.
+type counter struct {
+	id
+	count uint64 // Operations counted, overestimated by at most err
+	err   uint64 // Count of the key the counter was taken from, if it was
+	index int    // In the sketch's heap
+}
+
+// counterHeap orders counters by count, the smallest first.
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// sketch counts the operations on the most frequent keys with SpaceSaving:
+// it keeps at most capacity counters, and a key without one takes that of
+// the key counted least, whose count becomes its error. A key counted more
+// than total/capacity times is certain to have a counter, and no count is
+// overestimated by more than total/capacity.
+type sketch struct {
+	capacity int
+	total    uint64 // Operations counted
+	counters map[id]*counter
+	heap     counterHeap
+}
+
+func newSketch(capacity int) *sketch {
+	return &sketch{capacity: capacity, counters: make(map[id]*counter)}
+}
+
+// add counts an operation on k.
+func (s *sketch) add(k id) {
+	s.total++
+
+	if c, ok := s.counters[k]; ok {
+		c.count++
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+
+	if len(s.heap) < s.capacity {
+		c := &counter{id: k, count: 1}
+		s.counters[k] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+
+	c := s.heap[0]
+	delete(s.counters, c.id)
+
+	c.id, c.err = k, c.count
+	c.count++
+	s.counters[k] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// floor returns the most operations a key without a counter may have had:
+// the least count kept once the sketch is full, and none before.
+func (s *sketch) floor() uint64 {
+	if len(s.heap) < s.capacity {
+		return 0
+	}
+
+	return s.heap[0].count
+}
+
+// reset forgets every operation counted.
+func (s *sketch) reset() {
+	s.total = 0
+	clear(s.counters)
+	s.heap = s.heap[:0]
+}
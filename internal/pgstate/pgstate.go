@@ -0,0 +1,320 @@
+// Package pgstate keeps the store's current contents in Postgres, rather
+// than a log of every change. It serves as both the store's Logger, writing
+// each change through to the kv_current table before the store applies it,
+// and its Backing, from which keys are loaded into memory as they are first
+// needed. Startup therefore replays nothing.
+package pgstate
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorLeasesUnsupported is returned for leases, which need a log to
+// survive a restart.
+var ErrorLeasesUnsupported = errors.New("leases are not supported by the postgres-state backend")
+
+// Backend is a Postgres table of the current value of every key. It
+// implements translog.TransactionLogger and store.Backing.
+type Backend struct {
+	db     *sql.DB
+	errors chan error  // Never receives, since writes are reported to their callers
+	closed atomic.Bool // Set by Close
+}
+
+// New connects to the database and creates the kv_current table if needed.
+func New(config translog.PostgresdDBParams) (*Backend, error) {
+	connStr := fmt.Sprintf("host=%s dbname=%s user=%s password=%s",
+		config.Host, config.DBName, config.User, config.Password)
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+
+	if err := db.Ping(); err != nil { // Test the database connection
+		return nil, fmt.Errorf("failed to open db connection: %w", err)
+	}
+
+	query := `CREATE TABLE IF NOT EXISTS kv_current (
+			bucket 		TEXT NOT NULL,
+			key 		TEXT NOT NULL,
+			value 		TEXT NOT NULL,
+			codec 		SMALLINT NOT NULL DEFAULT 0,
+			version 	BIGINT NOT NULL,
+			created_at 	TIMESTAMPTZ NOT NULL,
+			updated_at 	TIMESTAMPTZ NOT NULL,
+			immutable 	BOOLEAN NOT NULL DEFAULT false,
+			expires_at 	TIMESTAMPTZ,
+			content_type 	TEXT,
+			encoded 	BOOLEAN NOT NULL DEFAULT false,
+			PRIMARY KEY (bucket, key)
+			);`
+
+	if _, err := db.Exec(query); err != nil {
+		return nil, fmt.Errorf("failed create table: %w", err)
+	}
+
+	// Tables created before write-once keys lack the column
+	if _, err := db.Exec(`ALTER TABLE kv_current ADD COLUMN IF NOT EXISTS immutable BOOLEAN NOT NULL DEFAULT false`); err != nil {
+		return nil, fmt.Errorf("failed to add the immutable column: %w", err)
+	}
+
+	// And those created before key expiry lack this one
+	if _, err := db.Exec(`ALTER TABLE kv_current ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`); err != nil {
+		return nil, fmt.Errorf("failed to add the expires_at column: %w", err)
+	}
+
+	// And those created before binary values and media types lack these
+	if _, err := db.Exec(`ALTER TABLE kv_current
+				ADD COLUMN IF NOT EXISTS content_type TEXT,
+				ADD COLUMN IF NOT EXISTS encoded BOOLEAN NOT NULL DEFAULT false`); err != nil {
+		return nil, fmt.Errorf("failed to add the content_type and encoded columns: %w", err)
+	}
+
+	return &Backend{db: db, errors: make(chan error, 1)}, nil
+}
+
+// WriteEvent applies e to the table before returning, so a write the store
+// acknowledges is already durable. Event sequence numbers aren't kept. A
+// context already done leaves e out; once started, the statement runs to
+// completion whatever ctx, since one cancelled might have committed, and
+// the store must know whether to apply e.
+func (b *Backend) WriteEvent(ctx context.Context, e translog.Event) (err error) {
+	ctx, span := tracing.Start(ctx, "pgstate.Write", e.Bucket, e.Key)
+	defer func() { tracing.End(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	switch e.EventType {
+	case translog.EventPut:
+		// Compressed values aren't valid text, so they're stored
+		// base64-encoded, as are those that aren't text to begin with
+		value, encoded := e.Value, e.Codec != compress.None || !translog.IsText(e.Value)
+		if encoded {
+			value = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+
+		// The store stamps e with the time it serves as the key's, so a
+		// key reloaded from the table keeps its metadata, and its ETag
+		stamp := e.Time
+		if stamp.IsZero() {
+			stamp = time.Now()
+		}
+
+		// A put makes the key permanent, unless an expiry follows it,
+		// and sets its media type, clearing it if the put has none; one
+		// over an expired row creates the key afresh
+		_, err = b.db.ExecContext(ctx, `INSERT INTO kv_current
+						(bucket, key, value, codec, version, created_at, updated_at, encoded, content_type)
+						VALUES ($1, $2, $3, $4, 1, $5, $5, $6, NULLIF($7, ''))
+					ON CONFLICT (bucket, key) DO UPDATE SET
+						value = EXCLUDED.value,
+						codec = EXCLUDED.codec,
+						encoded = EXCLUDED.encoded,
+						content_type = EXCLUDED.content_type,
+						version = CASE WHEN kv_current.expires_at <= EXCLUDED.updated_at THEN 1 ELSE kv_current.version + 1 END,
+						created_at = CASE WHEN kv_current.expires_at <= EXCLUDED.updated_at THEN EXCLUDED.created_at ELSE kv_current.created_at END,
+						immutable = kv_current.immutable AND (kv_current.expires_at IS NULL OR kv_current.expires_at > EXCLUDED.updated_at),
+						updated_at = EXCLUDED.updated_at,
+						expires_at = NULL`,
+			e.Bucket, e.Key, value, e.Codec, stamp, encoded, e.ContentType)
+	case translog.EventDelete, translog.EventEvict:
+		_, err = b.db.ExecContext(ctx,
+			`DELETE FROM kv_current WHERE bucket = $1 AND key = $2`, e.Bucket, e.Key)
+	case translog.EventDropBucket:
+		_, err = b.db.ExecContext(ctx,
+			`DELETE FROM kv_current WHERE bucket = $1`, e.Bucket)
+	case translog.EventRenameBucket:
+		err = b.renameBucket(ctx, e.Bucket, e.Value)
+	case translog.EventImmutable:
+		_, err = b.db.ExecContext(ctx,
+			`UPDATE kv_current SET immutable = true WHERE bucket = $1 AND key = $2`, e.Bucket, e.Key)
+	case translog.EventExpire:
+		var deadline time.Time
+		if deadline, err = translog.ParseExpiry(e.Value); err == nil {
+			_, err = b.db.ExecContext(ctx,
+				`UPDATE kv_current SET expires_at = $3 WHERE bucket = $1 AND key = $2`, e.Bucket, e.Key, deadline)
+		}
+	case translog.EventOriginalKey:
+		// The table keeps keys as they are stored, folded; the form they
+		// were given in isn't needed to serve them
+	case translog.EventLease:
+		// The table holds values only, so a restart would forget the
+		// lease and could grant it again
+		err = ErrorLeasesUnsupported
+	default:
+		err = fmt.Errorf("unknown event type %d", e.EventType)
+	}
+
+	return err
+}
+
+// renameBucket moves the rows of bucket from to the bucket to, in one
+// transaction, over the rows it already has.
+func (b *Backend) renameBucket(ctx context.Context, from, to string) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO kv_current
+					(bucket, key, value, codec, version, created_at, updated_at, immutable, expires_at, content_type, encoded)
+					SELECT $2, key, value, codec, version, created_at, updated_at, immutable, expires_at, content_type, encoded
+					FROM kv_current WHERE bucket = $1
+				ON CONFLICT (bucket, key) DO UPDATE SET
+					value = EXCLUDED.value,
+					codec = EXCLUDED.codec,
+					encoded = EXCLUDED.encoded,
+					content_type = EXCLUDED.content_type,
+					version = EXCLUDED.version,
+					created_at = EXCLUDED.created_at,
+					updated_at = EXCLUDED.updated_at,
+					immutable = EXCLUDED.immutable,
+					expires_at = EXCLUDED.expires_at`,
+		from, to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM kv_current WHERE bucket = $1`, from); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b *Backend) WritePutCtx(ctx context.Context, key, value string) error {
+	return b.WriteEvent(ctx, translog.Event{EventType: translog.EventPut, Bucket: translog.DefaultBucket, Key: key, Value: value})
+}
+
+func (b *Backend) WriteDeleteCtx(ctx context.Context, key string) error {
+	return b.WriteEvent(ctx, translog.Event{EventType: translog.EventDelete, Bucket: translog.DefaultBucket, Key: key})
+}
+
+func (b *Backend) WritePut(key, value string) {
+	if err := b.WritePutCtx(context.Background(), key, value); err != nil {
+		log.Printf("WARNING: write to kv_current dropped: %v\n", err)
+	}
+}
+
+func (b *Backend) WriteDelete(key string) {
+	if err := b.WriteDeleteCtx(context.Background(), key); err != nil {
+		log.Printf("WARNING: write to kv_current dropped: %v\n", err)
+	}
+}
+
+// Flush has nothing to wait for, since writes are made synchronously.
+func (b *Backend) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (b *Backend) Err() <-chan error {
+	return b.errors
+}
+
+// ReadEvents returns no events: there is no history to replay, the store
+// loads keys from the table as needed instead.
+func (b *Backend) ReadEvents() (<-chan translog.Event, <-chan error) {
+	outEvent := make(chan translog.Event)
+	outError := make(chan error)
+
+	close(outEvent)
+	close(outError)
+
+	return outEvent, outError
+}
+
+// Run does nothing, since writes are made synchronously.
+func (b *Backend) Run() error {
+	return nil
+}
+
+// Close closes the database.
+func (b *Backend) Close(ctx context.Context) error {
+	if b.closed.Swap(true) {
+		return fmt.Errorf("Close: %w", translog.ErrorClosed)
+	}
+
+	close(b.errors)
+	return b.db.Close()
+}
+
+// Lookup reads a single key from the table.
+func (b *Backend) Lookup(ctx context.Context, bucket, key string) (store.BackingRecord, bool, error) {
+	row := b.db.QueryRowContext(ctx, `SELECT bucket, key, value, codec, version, created_at, updated_at, immutable, expires_at, content_type, encoded
+				FROM kv_current
+				WHERE bucket = $1 AND key = $2`, bucket, key)
+
+	rec, err := scanRecord(row)
+	if err == sql.ErrNoRows {
+		return rec, false, nil
+	}
+	if err != nil {
+		return rec, false, err
+	}
+
+	return rec, true, nil
+}
+
+// LoadAll reads the whole table.
+func (b *Backend) LoadAll(ctx context.Context, fn func(store.BackingRecord)) error {
+	rows, err := b.db.QueryContext(ctx, `SELECT bucket, key, value, codec, version, created_at, updated_at, immutable, expires_at, content_type, encoded
+				FROM kv_current`)
+	if err != nil {
+		return fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return err
+		}
+
+		fn(rec)
+	}
+
+	return rows.Err()
+}
+
+// scanRecord decodes a row selected by Lookup or LoadAll.
+func scanRecord(row interface{ Scan(...any) error }) (store.BackingRecord, error) {
+	var rec store.BackingRecord
+	var expires sql.NullTime
+	var contentType sql.NullString
+	var encoded bool
+
+	err := row.Scan(&rec.Bucket, &rec.Key, &rec.Value, &rec.Codec,
+		&rec.Meta.Version, &rec.Meta.Created, &rec.Meta.Modified, &rec.Meta.Immutable, &expires, &contentType, &encoded)
+	if err != nil {
+		return rec, err
+	}
+	rec.Meta.Expires = expires.Time
+	rec.Meta.ContentType = contentType.String
+
+	if rec.Codec != compress.None || encoded {
+		value, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return rec, fmt.Errorf("invalid encoded value: %w", err)
+		}
+		rec.Value = string(value)
+	}
+
+	return rec, nil
+}
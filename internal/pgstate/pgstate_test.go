@@ -0,0 +1,98 @@
+package pgstate
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testParams returns the database named by KV_TEST_POSTGRES, given as
+// "host=... dbname=... user=... password=...", skipping the test if it
+// isn't set.
+func testParams(t *testing.T) translog.PostgresdDBParams {
+	t.Helper()
+
+	dsn := os.Getenv("KV_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("KV_TEST_POSTGRES is not set")
+	}
+
+	var p translog.PostgresdDBParams
+	for _, field := range strings.Fields(dsn) {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "host":
+			p.Host = value
+		case "dbname":
+			p.DBName = value
+		case "user":
+			p.User = value
+		case "password":
+			p.Password = value
+		}
+	}
+
+	return p
+}
+
+// open returns a store over a backend connected with params.
+func open(t *testing.T, params translog.PostgresdDBParams) (*Backend, *store.Store) {
+	t.Helper()
+
+	b, err := New(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, store.New(b, store.Options{Backing: b})
+}
+
+func TestWriteEventThenReload(t *testing.T) {
+	ctx := context.Background()
+	params := testParams(t)
+	bucket := fmt.Sprint("pgstate-test-", time.Now().UnixNano())
+
+	b, s := open(t, params)
+	defer func() {
+		b.WriteEvent(ctx, translog.Event{EventType: translog.EventDropBucket, Bucket: bucket})
+		b.Close(ctx)
+	}()
+
+	if err := s.BucketPut(store.WithContentType(ctx, "application/json"), bucket, "k", `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+	_, first, err := s.BucketGetWithMeta(ctx, bucket, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := s.BucketPut(store.WithContentType(ctx, "application/json"), bucket, "k", `{"a":2}`); err != nil {
+		t.Fatal(err)
+	}
+	_, served, err := s.BucketGetWithMeta(ctx, bucket, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !served.Created.Equal(first.Created) || !served.Modified.After(first.Modified) {
+		t.Fatalf("an overwrite: %+v after %+v, want it created as before and modified since", served, first)
+	}
+
+	// Another store loading the key from the table sees what was served
+	reloaded, r := open(t, params)
+	defer reloaded.Close(ctx)
+
+	value, meta, err := r.BucketGetWithMeta(ctx, bucket, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != `{"a":2}` || meta.Version != served.Version || !meta.Created.Equal(served.Created) ||
+		!meta.Modified.Equal(served.Modified) || meta.ContentType != served.ContentType {
+		t.Errorf("reloaded %q with %+v, want %+v as served", value, meta, served)
+	}
+}
@@ -0,0 +1,272 @@
+// Package relay publishes the transaction log to an external system. The
+// log serves as an outbox: events are read back from it rather than written
+// twice, and the sequence of the last one published is kept in a cursor
+// file so that a restarted relay resumes where it stopped. Delivery is at
+// least once; an event published just before a crash is published again.
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/crypt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CursorFileName is the default name of the cursor in a data directory.
+const CursorFileName = "relay.cursor"
+
+// Retry backoff bounds for a failing sink or log.
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Event is a logged event as published, with its value decompressed.
+type Event struct {
+	Sequence uint64 `json:"sequence"`
+
+	// Type is what the event did:
+	//   - "put", "delete" and "drop_bucket"
+	//   - "rename_bucket", whose value is the bucket the keys move to
+	//   - "immutable", which marks the key just put write-once
+	//   - "expire", whose value is the time the key just put expires, as
+	//     translog.FormatExpiry writes it
+	//   - "evict", a delete made to keep the store under its size cap
+	//   - "original_key", whose value is the form the key just created
+	//     was given in, before key folding
+	//   - "lease", whose value is translog.FormatLease's, or empty for a
+	//     release
+	Type string `json:"type"`
+
+	Bucket string `json:"bucket"`
+	Key    string `json:"key,omitempty"`
+	Value  string `json:"value,omitempty"`
+
+	ContentType string `json:"content_type,omitempty"` // Media type of the value of a put, if it was put with one
+}
+
+// MarshalJSON writes e as a WebhookSink posts it: a value that isn't text,
+// as translog.IsText decides, is base64-encoded, with "encoding": "base64"
+// next to it. Sinks in Go get the value as it is.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event Event
+
+	out := struct {
+		event
+		Encoding string `json:"encoding,omitempty"`
+	}{event: event(e)}
+
+	if !translog.IsText(e.Value) {
+		out.Value, out.Encoding = base64.StdEncoding.EncodeToString([]byte(e.Value)), "base64"
+	}
+
+	return json.Marshal(out)
+}
+
+// newEvent converts a logged event for publishing, decrypting its value with
+// c if it's encrypted.
+func newEvent(e translog.Event, c crypt.Cipher) (Event, error) {
+	out := Event{Sequence: e.Sequence, Bucket: e.Bucket, Key: e.Key, ContentType: e.ContentType}
+
+	switch e.EventType {
+	case translog.EventPut:
+		out.Type = "put"
+	case translog.EventDelete:
+		out.Type = "delete"
+	case translog.EventDropBucket:
+		out.Type = "drop_bucket"
+	case translog.EventRenameBucket:
+		out.Type = "rename_bucket"
+	case translog.EventLease:
+		out.Type = "lease"
+	case translog.EventImmutable:
+		out.Type = "immutable"
+	case translog.EventExpire:
+		out.Type = "expire"
+	case translog.EventEvict:
+		out.Type = "evict"
+	case translog.EventOriginalKey:
+		out.Type = "original_key"
+	default:
+		return out, fmt.Errorf("unknown event type %d", e.EventType)
+	}
+
+	value, err := crypt.Decode(e.Value, e.Codec, c)
+	out.Value = value
+
+	return out, err
+}
+
+// Sink receives the published events, in log order. Kafka, NATS and the
+// like are supported by implementing it.
+type Sink interface {
+	// Publish delivers e, returning only once the sink has accepted it.
+	Publish(ctx context.Context, e Event) error
+}
+
+// WebhookSink POSTs each event as JSON to a URL. Any 2xx response accepts
+// the event.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, e Event) error {
+	return s.Post(ctx, e)
+}
+
+// Post POSTs v as JSON to the webhook, for messages other than events.
+func (s *WebhookSink) Post(ctx context.Context, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Relay publishes the events of a log to a sink.
+type Relay struct {
+	src    translog.Source
+	sink   Sink
+	cursor string       // File holding the last published sequence
+	cipher crypt.Cipher // Decrypts logged values; nil if they aren't encrypted
+}
+
+// New returns a relay of the events of src to sink that keeps its cursor in
+// the file at cursorPath. Encrypted values are published decrypted with c,
+// which is nil if values aren't encrypted.
+func New(src translog.Source, sink Sink, cursorPath string, c crypt.Cipher) *Relay {
+	return &Relay{src: src, sink: sink, cursor: cursorPath, cipher: c}
+}
+
+// Run publishes events until ctx is done. When the sink or the log fails,
+// it starts again from the cursor after a backoff, so the cursor only ever
+// moves past events the sink has accepted.
+func (r *Relay) Run(ctx context.Context) {
+	backoff := minBackoff
+
+	for {
+		progressed, err := r.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if progressed {
+			backoff = minBackoff
+		}
+
+		log.Printf("relay interrupted, retrying in %s: %v\n", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// stream publishes the events after the cursor until publishing or reading
+// the log fails. It reports whether any event was published.
+func (r *Relay) stream(ctx context.Context) (bool, error) {
+	after, err := readCursor(r.cursor)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Stops the follow when publishing fails
+
+	events, errs := r.src.Follow(ctx, after)
+	progressed := false
+
+	for e := range events {
+		out, err := newEvent(e, r.cipher)
+		if err != nil {
+			return progressed, fmt.Errorf("event %d: %w", e.Sequence, err)
+		}
+
+		if err := r.sink.Publish(ctx, out); err != nil {
+			return progressed, fmt.Errorf("publishing event %d: %w", e.Sequence, err)
+		}
+
+		if err := writeCursor(r.cursor, e.Sequence); err != nil {
+			return progressed, err
+		}
+
+		progressed = true
+	}
+
+	if err := <-errs; err != nil {
+		return progressed, err
+	}
+
+	return progressed, errors.New("log stream ended")
+}
+
+// readCursor returns the sequence in the cursor file at path, or 0 if there
+// is none yet.
+func readCursor(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid cursor: %w", path, err)
+	}
+
+	return seq, nil
+}
+
+// writeCursor replaces the cursor file at path, through a rename so that a
+// crash leaves either the old cursor or the new one.
+func writeCursor(path string, seq uint64) error {
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink accepts events, recording them, until crash, if set, says
+// the process dies with the one given to it, which it accepts first.
+type recordingSink struct {
+	mu        sync.Mutex
+	published []Event
+	fail      int                // Events left to refuse before accepting again
+	crash     func(e Event) bool // Whether accepting e is the relay's last act
+	cancel    context.CancelFunc // Stops the relay on a crash
+}
+
+func (s *recordingSink) Publish(ctx context.Context, e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("broker unavailable")
+	}
+
+	s.published = append(s.published, e)
+
+	// The process dies once the sink has the event, before the cursor
+	// moves past it
+	if s.crash != nil && s.crash(e) {
+		s.cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// sequences returns the sequences of the events published so far.
+func (s *recordingSink) sequences() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seqs := make([]uint64, len(s.published))
+	for i, e := range s.published {
+		seqs[i] = e.Sequence
+	}
+
+	return seqs
+}
+
+// openLog returns a running file log in dir, closed when the test ends.
+func openLog(t *testing.T, dir string) translog.TransactionLogger {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, errs := l.ReadEvents()
+	for range events {
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close(context.Background()) })
+
+	return l
+}
+
+// write logs n puts, of the keys and sequences from first on, and waits
+// for them to be durable.
+func write(t *testing.T, l translog.TransactionLogger, first, n int) {
+	t.Helper()
+
+	ctx := context.Background()
+	for i := first; i < first+n; i++ {
+		e := translog.Event{Sequence: uint64(i + 1), EventType: translog.EventPut, Bucket: translog.DefaultBucket, Key: fmt.Sprintf("k%d", i), Value: "v"}
+		if err := l.WriteEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRelayResumesAfterCrashes(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir)
+	cursor := filepath.Join(dir, CursorFileName)
+
+	const total = 100
+	write(t, l, 0, total/2)
+
+	sink := &recordingSink{}
+	var cursors []uint64
+
+	// The relay dies right after publishing events 10, 30 and 70, the rest
+	// of the log being written while it runs
+	for _, at := range []uint64{10, 30, 70, total} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		sink.mu.Lock()
+		sink.cancel = cancel
+		sink.crash = func(e Event) bool { return e.Sequence == at && at != total }
+		sink.mu.Unlock()
+
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			New(l.(translog.Source), sink, cursor, nil).Run(ctx)
+		}()
+
+		if at == 30 {
+			write(t, l, total/2, total/2)
+		}
+		if at == total {
+			waitFor(t, "the relay to catch up", func() bool {
+				seqs := sink.sequences()
+				return len(seqs) > 0 && seqs[len(seqs)-1] == total
+			})
+			cancel()
+		}
+		<-stopped
+
+		c, err := readCursor(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursors = append(cursors, c)
+	}
+
+	// The cursor only moves forward, and never past what was published
+	for i, c := range cursors {
+		if i > 0 && c < cursors[i-1] {
+			t.Errorf("cursor went back from %d to %d", cursors[i-1], c)
+		}
+	}
+	if want := []uint64{9, 29, 69, total}; fmt.Sprint(cursors) != fmt.Sprint(want) {
+		t.Errorf("cursors after each run: %v, want %v", cursors, want)
+	}
+
+	// Every event is published in order, and only those published just
+	// before a crash are published again
+	var want []uint64
+	for seq := uint64(1); seq <= total; seq++ {
+		want = append(want, seq)
+		if seq == 10 || seq == 30 || seq == 70 {
+			want = append(want, seq)
+		}
+	}
+	if got := sink.sequences(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("published %v,\nwant %v", got, want)
+	}
+}
+
+func TestRelayRetriesAFailingSink(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir)
+	write(t, l, 0, 5)
+
+	// The sink refuses the first attempt, then accepts everything
+	sink := &recordingSink{fail: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		New(l.(translog.Source), sink, filepath.Join(dir, CursorFileName), nil).Run(ctx)
+	}()
+
+	waitFor(t, "every event to be published", func() bool {
+		return len(sink.sequences()) == 5
+	})
+	cancel()
+	<-stopped
+
+	if got := sink.sequences(); fmt.Sprint(got) != "[1 2 3 4 5]" {
+		t.Errorf("published %v, want each event once, in order", got)
+	}
+	if c, err := readCursor(filepath.Join(dir, CursorFileName)); err != nil || c != 5 {
+		t.Errorf("cursor %d, %v; want 5", c, err)
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	for _, test := range []struct {
+		value, json string
+	}{
+		{"plain ☃", `{"sequence":1,"type":"put","bucket":"default","key":"k","value":"plain ☃"}`},
+		{"\x00\xff\xfe", `{"sequence":1,"type":"put","bucket":"default","key":"k","value":"AP/+","encoding":"base64"}`},
+	} {
+		b, err := json.Marshal(Event{Sequence: 1, Type: "put", Bucket: translog.DefaultBucket, Key: "k", Value: test.value})
+		if err != nil || string(b) != test.json {
+			t.Errorf("%q: %s, %v, want %s", test.value, b, err, test.json)
+		}
+	}
+}
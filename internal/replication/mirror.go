@@ -0,0 +1,312 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorCheckInterval is how often a mirror checks whether the primary
+// compacted its log or restored its data directory.
+const mirrorCheckInterval = time.Second
+
+// MirrorStatus describes a mirror's progress through the log it mirrors.
+type MirrorStatus struct {
+	Log             string    `json:"log"`
+	AppliedSequence uint64    `json:"applied_sequence"`
+	LagBytes        int64     `json:"lag_bytes"` // Bytes of the log not yet applied, as of the last read
+	LastEvent       time.Time `json:"last_event,omitzero"`
+	Resyncs         int       `json:"resyncs"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+// Mirror keeps a store in step with the file log of a primary running in
+// another process, reading it without writing anything: the primary's
+// snapshot is restored, then its log is replayed and tailed. The primary
+// rotating its log is followed like any tail; compacting it, or having its
+// data directory restored, replaces the snapshot the log continues from,
+// and the mirror syncs again from scratch.
+type Mirror struct {
+	path  string // Log the primary writes
+	dir   string // Data directory holding the primary's snapshot
+	store *store.Store
+	tail  *translog.FileTail
+
+	mu        sync.Mutex
+	applied   uint64
+	lastEvent time.Time
+	resyncs   int
+	lastErr   error
+	origin    mirrorOrigin
+}
+
+// mirrorOrigin is what the primary's log continues from. A change to it
+// means the events already applied may no longer be those of the log.
+type mirrorOrigin struct {
+	snapshot os.FileInfo // nil if there's no snapshot
+	meta     translog.LogMeta
+}
+
+// equal reports whether o and other are the same origin. The log's high
+// water mark moves on every rotation, so it is left out.
+func (o mirrorOrigin) equal(other mirrorOrigin) bool {
+	if o.meta.After != other.meta.After || !o.meta.Compacted.Equal(other.meta.Compacted) {
+		return false
+	}
+
+	if o.snapshot == nil || other.snapshot == nil {
+		return o.snapshot == nil && other.snapshot == nil
+	}
+
+	return os.SameFile(o.snapshot, other.snapshot) &&
+		o.snapshot.Size() == other.snapshot.Size() &&
+		o.snapshot.ModTime().Equal(other.snapshot.ModTime())
+}
+
+// NewMirror returns a mirror of the file log at path into st, which should
+// be read-only, as nothing it is given is logged.
+func NewMirror(path string, st *store.Store) *Mirror {
+	return &Mirror{
+		path:  path,
+		dir:   filepath.Dir(path),
+		store: st,
+		tail:  translog.NewFileTail(path),
+	}
+}
+
+// readOrigin returns what the log currently continues from.
+func (m *Mirror) readOrigin() (mirrorOrigin, error) {
+	var o mirrorOrigin
+
+	info, err := os.Stat(filepath.Join(m.dir, store.SnapshotFileName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return o, err
+	default:
+		o.snapshot = info
+	}
+
+	o.meta, err = translog.ReadLogMeta(m.path)
+
+	return o, err
+}
+
+// Load brings the store up to the end of the log: it restores the
+// primary's snapshot, or empties the store if there's none, and applies
+// the events logged after it. A primary compacting its log meanwhile is
+// waited out and the load started over.
+func (m *Mirror) Load(ctx context.Context) error {
+	for {
+		synced, err := m.sync()
+		if synced || err != nil {
+			return err
+		}
+
+		log.Printf("log %s changed while loading it, loading again\n", m.path)
+
+		select {
+		case <-time.After(minBackoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sync is a single attempt at Load. It reports false, with the store in an
+// unknown state, if the log's origin changed while it was read.
+func (m *Mirror) sync() (bool, error) {
+	origin, err := m.readOrigin()
+	if err != nil {
+		return false, err
+	}
+
+	// A store paging its values in keeps reading them from the snapshot
+	// the primary replaces, by renaming another over it, when compacting
+	err = m.store.RestoreFile(filepath.Join(m.dir, store.SnapshotFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = m.store.Restore(strings.NewReader("{}\n"))
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", store.SnapshotFileName, err)
+	}
+
+	// Compaction writes the snapshot first and the log's metadata last, so
+	// the two may not match while it runs
+	if after := origin.meta.After; after != 0 && after != m.store.Sequence() {
+		return false, nil
+	}
+
+	err = translog.ScanLog(m.path, func(e translog.Event) error {
+		if e.Sequence <= m.store.Sequence() {
+			return nil
+		}
+
+		return m.apply(e)
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	current, err := m.readOrigin()
+	if err != nil || !current.equal(origin) {
+		return false, err
+	}
+
+	m.mu.Lock()
+	m.origin = origin
+	m.applied = m.store.Sequence()
+	m.mu.Unlock()
+
+	return true, nil
+}
+
+// apply applies an event of the log to the store.
+func (m *Mirror) apply(e translog.Event) error {
+	if err := m.store.ApplyEvent(e); err != nil {
+		return fmt.Errorf("applying event %d: %w", e.Sequence, err)
+	}
+
+	m.mu.Lock()
+	m.applied = e.Sequence
+	m.lastEvent = time.Now()
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Run tails the log until ctx is done, applying events as the primary
+// appends them, and syncs again whenever the log's origin changes. Failures
+// are retried with backoff. Load must have been called first.
+func (m *Mirror) Run(ctx context.Context) {
+	backoff := minBackoff
+
+	for {
+		resync, err := m.follow(ctx)
+
+		m.mu.Lock()
+		m.lastErr = err
+		m.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if resync {
+			log.Printf("log %s was compacted or restored, syncing again\n", m.path)
+
+			m.mu.Lock()
+			m.resyncs++
+			m.mu.Unlock()
+
+			err = m.Load(ctx)
+
+			m.mu.Lock()
+			m.lastErr = err
+			m.mu.Unlock()
+
+			if err == nil {
+				backoff = minBackoff
+				continue
+			}
+		}
+
+		log.Printf("mirroring %s interrupted, retrying in %s: %v\n", m.path, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// follow applies the events of the tail until its origin changes, when it
+// reports true, or reading or applying them fails.
+func (m *Mirror) follow(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, errs := m.tail.Follow(ctx, m.store.Sequence())
+
+	// stop ends the tail, so that a resync doesn't race it
+	stop := func() {
+		cancel()
+		for range events {
+			// Drained so that the tail can exit
+		}
+		<-errs
+	}
+
+	ticker := time.NewTicker(mirrorCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				err := <-errs
+				if err == nil {
+					err = ctx.Err()
+				}
+				return false, err
+			}
+
+			if err := m.apply(e); err != nil {
+				stop()
+				return false, err
+			}
+
+		case <-ticker.C:
+			origin, err := m.readOrigin()
+			if err != nil {
+				stop()
+				return false, err
+			}
+
+			m.mu.Lock()
+			changed := !origin.equal(m.origin)
+			m.mu.Unlock()
+
+			if changed {
+				stop()
+				return true, nil
+			}
+
+		case <-ctx.Done():
+			stop()
+			return false, ctx.Err()
+		}
+	}
+}
+
+// Status returns the mirror's current progress.
+func (m *Mirror) Status() MirrorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := MirrorStatus{
+		Log:             m.path,
+		AppliedSequence: m.applied,
+		LagBytes:        m.tail.Behind(),
+		LastEvent:       m.lastEvent,
+		Resyncs:         m.resyncs,
+	}
+
+	if m.lastErr != nil {
+		st.LastError = m.lastErr.Error()
+	}
+
+	return st
+}
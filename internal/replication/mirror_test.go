@@ -0,0 +1,107 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMirrorConvergesWithTheWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, translog.LogFileName)
+
+	writer, _, closeWriter := openLogged(t, dir)
+
+	// write makes n writes over a few keys, deleting now and then
+	write := func(n int) {
+		t.Helper()
+
+		for i := range n {
+			key := fmt.Sprintf("k%d", i%25)
+			var err error
+			if i%7 == 6 {
+				err = writer.DeleteCtx(ctx, key)
+			} else {
+				err = writer.PutCtx(ctx, key, fmt.Sprintf("v%d at %d", i, writer.Sequence()))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(100)
+
+	mirrored := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	m := NewMirror(path, mirrored)
+	if err := m.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mirrored.SetReadOnly(true, "mirror of "+path)
+
+	go m.Run(ctx)
+
+	// converged reports whether the mirror holds what the writer does
+	converged := func() bool {
+		want, _ := writer.Dump()
+		got, _ := mirrored.Dump()
+
+		return fmt.Sprint(got) == fmt.Sprint(want) && m.Status().AppliedSequence == writer.Sequence()
+	}
+
+	waitFor(t, "the mirror to load the writer's log", converged)
+
+	// What the writer appends is applied as it is written
+	write(300)
+	waitFor(t, "the mirror to apply the writer's appends", converged)
+
+	if err := mirrored.PutCtx(ctx, "k0", "from the mirror"); !errors.Is(err, store.ErrorReadOnly) {
+		t.Errorf("a write to the mirror: %v", err)
+	}
+
+	// The writer compacting its log replaces the snapshot the log goes on
+	// from, and the mirror syncs again from it
+	closeWriter()
+
+	f, err := os.Create(filepath.Join(dir, store.SnapshotFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Snapshot(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	meta := translog.LogMeta{After: writer.Sequence(), HighWater: writer.Sequence(), Compacted: time.Now().UTC()}
+	if err := translog.WriteLogMeta(path, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	writer, _, closeWriter = openLogged(t, dir)
+	defer closeWriter()
+
+	write(200)
+	waitFor(t, "the mirror to sync again after the compaction", func() bool {
+		return converged() && m.Status().Resyncs > 0
+	})
+
+	if st := m.Status(); st.LastError != "" || st.Log != path {
+		t.Errorf("the mirror's status after converging: %+v", st)
+	}
+}
@@ -0,0 +1,312 @@
+// Package replication streams a leader's transaction log to followers. The
+// leader serves its events as JSON lines; a follower applies them to its
+// store and local log in order, resuming after the last applied sequence
+// whenever the stream is interrupted.
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventsPath is the leader endpoint serving the event stream.
+const EventsPath = "/v1/replication/events"
+
+// heartbeatInterval is how often an idle stream tells the follower the last
+// sequence sent, so it can tell a quiet leader from a dead connection.
+const heartbeatInterval = 5 * time.Second
+
+// Reconnection backoff bounds for a follower.
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// message is one line of the event stream. Heartbeats carry only the
+// leader's sequence. Events carry the translog.RecordVersion of the leader,
+// none if it predates versions.
+type message struct {
+	Sequence  uint64             `json:"sequence"`
+	Heartbeat bool               `json:"heartbeat,omitempty"`
+	Version   int                `json:"version,omitempty"`
+	Type      translog.EventType `json:"type,omitempty"`
+	Bucket    string             `json:"bucket,omitempty"`
+	Key       string             `json:"key,omitempty"`
+	Value     []byte             `json:"value,omitempty"` // As logged, compressed with Codec
+	Codec     compress.Codec     `json:"codec,omitempty"`
+	Time      time.Time          `json:"time,omitzero"` // When the leader logged the event
+
+	ContentType string `json:"content_type,omitempty"` // Media type of the value of a put, if it has one
+}
+
+// ServeEvents streams the events src logged after the sequence in the
+// "after" query parameter, until the client goes away.
+func ServeEvents(w http.ResponseWriter, r *http.Request, src translog.Source) {
+	var after uint64
+
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid after sequence", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, errs := src.Follow(r.Context(), after)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	last := after
+
+	for {
+		var m message
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				if err := <-errs; err != nil {
+					log.Printf("replication stream: %v\n", err)
+				}
+				return
+			}
+
+			m = message{
+				Sequence: e.Sequence,
+				Version:  translog.RecordVersion,
+				Type:     e.EventType,
+				Bucket:   e.Bucket,
+				Key:      e.Key,
+				Value:    []byte(e.Value),
+				Codec:    e.Codec,
+				Time:     e.Time,
+
+				ContentType: e.ContentType,
+			}
+			last = e.Sequence
+		case <-ticker.C:
+			m = message{Sequence: last, Heartbeat: true}
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := enc.Encode(m); err != nil {
+			return
+		}
+		rc.Flush()
+	}
+}
+
+// Status describes a follower's progress.
+type Status struct {
+	Leader          string    `json:"leader"`
+	Connected       bool      `json:"connected"`
+	AppliedSequence uint64    `json:"applied_sequence"`
+	LeaderSequence  uint64    `json:"leader_sequence"`
+	LagEvents       uint64    `json:"lag_events"`
+	LastContact     time.Time `json:"last_contact,omitzero"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+// Follower applies a leader's event stream to a store.
+type Follower struct {
+	leader string
+	apiKey string
+	store  *store.Store
+	client *http.Client
+
+	mu          sync.Mutex
+	connected   bool
+	applied     uint64 // Last leader sequence applied
+	leaderSeq   uint64 // Highest sequence the leader has reported
+	lastContact time.Time
+	lastErr     error
+}
+
+// NewFollower returns a follower of the leader at leaderURL that resumes
+// after sequence applied. apiKey is sent to the leader, whose event stream
+// is an admin endpoint.
+func NewFollower(leaderURL, apiKey string, st *store.Store, applied uint64) *Follower {
+	return &Follower{
+		leader:    leaderURL,
+		apiKey:    apiKey,
+		store:     st,
+		client:    &http.Client{},
+		applied:   applied,
+		leaderSeq: applied,
+	}
+}
+
+// Run follows the leader until ctx is done, reconnecting with backoff
+// whenever the stream ends.
+func (f *Follower) Run(ctx context.Context) {
+	backoff := minBackoff
+
+	for {
+		progressed, err := f.stream(ctx)
+
+		f.mu.Lock()
+		f.connected = false
+		f.lastErr = err
+		f.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if progressed {
+			backoff = minBackoff
+		}
+
+		log.Printf("replication from %s interrupted, retrying in %s: %v\n", f.leader, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// stream reads the leader's events after the last applied one until the
+// connection fails. It reports whether anything was received.
+func (f *Follower) stream(ctx context.Context) (bool, error) {
+	f.mu.Lock()
+	after := f.applied
+	f.mu.Unlock()
+
+	u := f.leader + EventsPath + "?" + url.Values{"after": {strconv.FormatUint(after, 10)}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if f.apiKey != "" {
+		req.Header.Set("X-API-Key", f.apiKey)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("leader responded %s", resp.Status)
+	}
+
+	f.mu.Lock()
+	f.connected = true
+	f.lastErr = nil
+	f.mu.Unlock()
+
+	log.Printf("replicating from %s after sequence %d\n", f.leader, after)
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	progressed := false
+
+	for {
+		var m message
+
+		if err := dec.Decode(&m); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("leader closed the stream")
+			}
+			return progressed, err
+		}
+
+		progressed = true
+
+		if err := f.handle(ctx, m); err != nil {
+			return progressed, err
+		}
+	}
+}
+
+// handle applies a single stream message.
+func (f *Follower) handle(ctx context.Context, m message) error {
+	f.mu.Lock()
+	applied := f.applied
+	f.lastContact = time.Now()
+	f.leaderSeq = max(f.leaderSeq, m.Sequence)
+	f.mu.Unlock()
+
+	// Events already applied can reappear if the leader resends after a
+	// reconnect; they're skipped
+	if m.Heartbeat || m.Sequence <= applied {
+		return nil
+	}
+
+	if err := translog.CheckRecordVersion(m.Version); err != nil {
+		return fmt.Errorf("event %d from %s: %w", m.Sequence, f.leader, err)
+	}
+
+	e := translog.Event{
+		Sequence:  m.Sequence,
+		EventType: m.Type,
+		Bucket:    m.Bucket,
+		Key:       m.Key,
+		Value:     string(m.Value),
+		Codec:     m.Codec,
+		Time:      m.Time,
+
+		ContentType: m.ContentType,
+	}
+
+	if err := f.store.Replicate(ctx, e); err != nil {
+		return fmt.Errorf("applying event %d: %w", m.Sequence, err)
+	}
+
+	f.mu.Lock()
+	f.applied = m.Sequence
+	f.mu.Unlock()
+
+	return nil
+}
+
+// Status returns the follower's current progress.
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	st := Status{
+		Leader:          f.leader,
+		Connected:       f.connected,
+		AppliedSequence: f.applied,
+		LeaderSequence:  f.leaderSeq,
+		LastContact:     f.lastContact,
+	}
+
+	if f.leaderSeq > f.applied {
+		st.LagEvents = f.leaderSeq - f.applied
+	}
+
+	if f.lastErr != nil {
+		st.LastError = f.lastErr.Error()
+	}
+
+	return st
+}
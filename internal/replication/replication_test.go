@@ -0,0 +1,215 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openLogged returns a store loaded from the file log in dir, its running
+// logger, and a function closing the logger once everything written is
+// durable, after which dir can be opened again to replay it.
+func openLogged(t *testing.T, dir string) (*store.Store, translog.TransactionLogger, func()) {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return st, l, func() {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := l.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollowerConvergesAcrossRestarts(t *testing.T) {
+	leader, leaderLog, closeLeader := openLogged(t, t.TempDir())
+	defer closeLeader()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeEvents(w, r, leaderLog.(translog.Source))
+	}))
+	defer srv.Close()
+
+	const keys, writes = 20, 600
+
+	// The leader keeps writing, deleting now and then, while the follower
+	// is stopped and restarted underneath it
+	written := make(chan error, 1)
+	go func() {
+		ctx := context.Background()
+
+		for i := range writes {
+			key := fmt.Sprintf("k%d", i%keys)
+
+			var err error
+			if i%7 == 6 {
+				err = leader.DeleteCtx(ctx, key)
+			} else {
+				err = leader.PutCtx(ctx, key, fmt.Sprintf("v%d", i))
+			}
+			if err != nil {
+				written <- err
+				return
+			}
+
+			if i%10 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		written <- nil
+	}()
+
+	dir := t.TempDir()
+	done := false
+
+	for run := 0; !done; run++ {
+		st, _, closeLog := openLogged(t, dir)
+		st.SetReadOnly(true, "following")
+
+		f := NewFollower(srv.URL, "", st, st.Sequence())
+		resumed := st.Sequence()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			f.Run(ctx)
+		}()
+
+		if run < 3 {
+			// Stop it as soon as it has made some progress, likely with
+			// events in flight
+			waitFor(t, "the follower to make progress", func() bool {
+				return f.Status().AppliedSequence > resumed
+			})
+		} else {
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+
+			waitFor(t, "the follower to catch up", func() bool {
+				return f.Status().AppliedSequence == leader.Sequence()
+			})
+			done = true
+		}
+
+		cancel()
+		<-stopped
+		closeLog()
+	}
+
+	// Every event is in the follower's log once, in the leader's order
+	want := uint64(1)
+	err := translog.ScanLog(filepath.Join(dir, translog.LogFileName), func(e translog.Event) error {
+		if e.Sequence != want {
+			return fmt.Errorf("sequence %d, want %d", e.Sequence, want)
+		}
+		want++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("follower log: %v", err)
+	}
+	if want-1 != leader.Sequence() {
+		t.Errorf("follower log ends at %d, leader at %d", want-1, leader.Sequence())
+	}
+
+	// And replaying it gives the leader's contents
+	follower, _, closeLog := openLogged(t, dir)
+	defer closeLog()
+
+	for i := range keys {
+		key := fmt.Sprintf("k%d", i)
+
+		lv, lerr := leader.Get(key)
+		fv, ferr := follower.Get(key)
+		if lv != fv || lerr != ferr {
+			t.Errorf("%s: follower has %q, %v; leader %q, %v", key, fv, ferr, lv, lerr)
+		}
+	}
+}
+
+func TestFollowerDecodesEveryRecordVersion(t *testing.T) {
+	ctx := context.Background()
+	st := store.New(translog.NewNopTransactionLogger(), store.Options{})
+	f := NewFollower("http://leader", "", st, 0)
+
+	// Messages from a leader older than record versions carry none; later
+	// ones carry theirs
+	stream := fmt.Sprintf(`{"sequence":1,"type":2,"bucket":"default","key":"a","value":"MQ=="}
+{"sequence":2,"version":5,"type":2,"bucket":"b","key":"k","value":"dg==","time":"2024-01-02T03:04:05Z"}
+{"sequence":3,"version":%d,"type":2,"bucket":"b","key":"k","value":"dg==","time":"2024-01-02T03:04:06Z","content_type":"text/plain"}
+{"sequence":4,"version":%d,"type":2,"bucket":"default","key":"a","value":"Mg=="}
+`, translog.RecordVersion, translog.RecordVersion+1)
+
+	dec := json.NewDecoder(strings.NewReader(stream))
+	for i := 1; ; i++ {
+		var m message
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		err := f.handle(ctx, m)
+		if i < 4 && err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if i == 4 && !errors.Is(err, translog.ErrorNewerVersion) {
+			t.Errorf("a message of version %d: %v", translog.RecordVersion+1, err)
+		}
+	}
+
+	if v, err := st.Get("a"); err != nil || v != "1" {
+		t.Errorf("a: %q, %v", v, err)
+	}
+	if v, meta, err := st.BucketGetWithMeta(ctx, "b", "k"); err != nil || v != "v" || meta.ContentType != "text/plain" {
+		t.Errorf("b/k: %q, %+v, %v", v, meta, err)
+	}
+	if applied := f.Status().AppliedSequence; applied != 3 {
+		t.Errorf("applied up to %d", applied)
+	}
+}
@@ -0,0 +1,154 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RestoreSnapshotPath is the standby endpoint a primary pushes its
+// snapshots to.
+const RestoreSnapshotPath = "/v1/admin/restore-snapshot"
+
+// RestoreResult is the standby's answer to a pushed snapshot.
+type RestoreResult struct {
+	Sequence uint64 `json:"sequence"` // Sequence of the snapshot now served
+	Keys     int    `json:"keys"`
+}
+
+// ShipperStatus describes a primary's pushes to its standby.
+type ShipperStatus struct {
+	Standby        string    `json:"standby"`
+	PushedSequence uint64    `json:"pushed_sequence"` // Sequence of the last snapshot the standby accepted
+	LastPush       time.Time `json:"last_push,omitzero"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// Shipper keeps a warm standby close to a primary by pushing the primary's
+// snapshot to it periodically. Each snapshot holds the whole state as of the
+// push, the log tail since the previous push included, so a standby that
+// missed a push, or restarted, catches up on the next one.
+type Shipper struct {
+	standby  string
+	apiKey   string
+	store    *store.Store
+	interval time.Duration
+	client   *http.Client
+
+	mu       sync.Mutex
+	pushed   uint64
+	lastPush time.Time
+	lastErr  error
+}
+
+// NewShipper returns a shipper pushing st to the standby at standbyURL
+// every interval. apiKey is sent to the standby, whose restore endpoint is
+// an admin endpoint.
+func NewShipper(standbyURL, apiKey string, st *store.Store, interval time.Duration) *Shipper {
+	return &Shipper{
+		standby:  standbyURL,
+		apiKey:   apiKey,
+		store:    st,
+		interval: interval,
+		client:   &http.Client{},
+	}
+}
+
+// Run pushes a snapshot at once, then every interval, until ctx is done. A
+// failed push is retried at the next interval.
+func (s *Shipper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		err := s.Push(ctx)
+		if ctx.Err() != nil {
+			// A push cut short by the shutdown didn't fail
+			return
+		}
+
+		s.mu.Lock()
+		s.lastErr = err
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Printf("snapshot push to standby %s failed, retrying in %s: %v\n", s.standby, s.interval, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Push sends the store's current snapshot to the standby, streaming it as
+// it is encoded. Values go as stored, so a standby of an encrypting primary
+// needs the same master key and keyring to read them.
+func (s *Shipper) Push(ctx context.Context) error {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(s.store.Snapshot(pw))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.standby+RestoreSnapshotPath, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.apiKey != "" {
+		req.Header.Set("X-API-Key", s.apiKey)
+	}
+
+	resp, err := s.client.Do(req)
+	pr.Close() // Stops the snapshot if the request ended early
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("standby responded %s: %s", resp.Status, msg)
+	}
+
+	var restored RestoreResult
+	if err := json.NewDecoder(resp.Body).Decode(&restored); err != nil {
+		return fmt.Errorf("invalid standby response: %w", err)
+	}
+
+	s.mu.Lock()
+	s.pushed = restored.Sequence
+	s.lastPush = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Status returns the state of the pushes.
+func (s *Shipper) Status() ShipperStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := ShipperStatus{
+		Standby:        s.standby,
+		PushedSequence: s.pushed,
+		LastPush:       s.lastPush,
+	}
+
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+
+	return st
+}
@@ -0,0 +1,153 @@
+// Package resp reads and writes streams of Redis commands in RESP, the Redis
+// serialization protocol, as in the files fed to "redis-cli --pipe" for a
+// mass insert. Commands are arrays of bulk strings, which are
+// length-prefixed, so keys and values may hold any bytes, CR and LF
+// included.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits of what a Reader accepts: those of Redis itself.
+const (
+	MaxBulkLength = 512 << 20 // Longest argument, in bytes
+	MaxArgs       = 1 << 20   // Most arguments in a command
+)
+
+// ErrorProtocol is returned for a stream that isn't valid RESP.
+var ErrorProtocol = errors.New("invalid RESP")
+
+// Reader reads commands from a RESP stream.
+type Reader struct {
+	r        *bufio.Reader
+	offset   int64 // Bytes read so far, for errors
+	commands int   // Commands read so far, for errors
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// ReadCommand returns the arguments of the next command, the command name
+// first, or io.EOF once the stream ends between commands. Inline commands,
+// which aren't binary-safe, are refused.
+func (r *Reader) ReadCommand() ([]string, error) {
+	start := r.offset
+
+	n, err := r.header('*')
+	if err == io.EOF && r.offset == start {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, r.fail(err)
+	}
+	if n < 1 || n > MaxArgs {
+		return nil, r.fail(fmt.Errorf("%w: command of %d arguments", ErrorProtocol, n))
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if args[i], err = r.bulk(); err != nil {
+			return nil, r.fail(err)
+		}
+	}
+
+	r.commands++
+
+	return args, nil
+}
+
+// fail adds where reading stopped to err.
+func (r *Reader) fail(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return fmt.Errorf("command %d, at byte %d: %w", r.commands+1, r.offset, err)
+}
+
+// header reads a line of the given type, such as *3 or $5, and returns its
+// length.
+func (r *Reader) header(typ byte) (int64, error) {
+	line, err := r.r.ReadSlice('\n')
+	r.offset += int64(len(line))
+	if err == bufio.ErrBufferFull {
+		return 0, fmt.Errorf("%w: line too long", ErrorProtocol)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok || s == "" {
+		return 0, fmt.Errorf("%w: line not ending in CRLF", ErrorProtocol)
+	}
+	if s[0] != typ {
+		if typ == '*' {
+			return 0, fmt.Errorf("%w: expected a command array, got %q; inline commands aren't supported", ErrorProtocol, truncate(s))
+		}
+		return 0, fmt.Errorf("%w: expected %q, got %q", ErrorProtocol, typ, truncate(s))
+	}
+
+	n, err := strconv.ParseInt(s[1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrorProtocol, truncate(s[1:]))
+	}
+
+	return n, nil
+}
+
+// bulk reads a bulk string.
+func (r *Reader) bulk() (string, error) {
+	n, err := r.header('$')
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n > MaxBulkLength {
+		return "", fmt.Errorf("%w: bulk string of %d bytes", ErrorProtocol, n)
+	}
+
+	b := make([]byte, n+2)
+	read, err := io.ReadFull(r.r, b)
+	r.offset += int64(read)
+	if err != nil {
+		return "", err
+	}
+
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string not ending in CRLF", ErrorProtocol)
+	}
+
+	return string(b[:n]), nil
+}
+
+// truncate shortens s for an error message.
+func truncate(s string) string {
+	if len(s) > 32 {
+		return s[:32] + "..."
+	}
+
+	return s
+}
+
+// WriteCommand writes the command made of args to w, as a RESP array of
+// bulk strings.
+func WriteCommand(w *bufio.Writer, args ...string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(a))
+		w.WriteString(a)
+		w.WriteString("\r\n")
+	}
+
+	// Errors stick to w, so the last write reports any of them
+	_, err := w.WriteString("")
+	return err
+}
@@ -0,0 +1,90 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCommandsRoundTrip(t *testing.T) {
+	commands := [][]string{
+		{"SET", "k", "v"},
+		{"SET", "crlf", "line1\r\nline2\r\n"},
+		{"SET", "ключ/日本", "значение ✓ 🚀"},
+		{"SET", "nul", "a\x00b\r\n\x00"},
+		{"SET", "empty", ""},
+		{"SET", "big", strings.Repeat("0123456789\r\n", 100_000)},
+		{"MSET", "a", "1", "b", "2"},
+		{"PING"},
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, args := range commands {
+		if err := WriteCommand(w, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n*3\r\n") {
+		t.Errorf("the stream begins %q", buf.String()[:40])
+	}
+
+	r := NewReader(&buf)
+	for i, want := range commands {
+		got, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("command %d: %.60q, want %.60q", i, got, want)
+		}
+	}
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("after the last command: %v", err)
+	}
+}
+
+func TestReaderRejectsInvalidStreams(t *testing.T) {
+	for _, tt := range []struct {
+		name, stream string
+		protocol     bool // Whether the error is ErrorProtocol, rather than a truncation
+	}{
+		{"inline command", "SET k v\r\n", true},
+		{"no CRLF", "*1\n$4\r\nPING\r\n", true},
+		{"empty command", "*0\r\n", true},
+		{"negative length", "*1\r\n$-1\r\n", true},
+		{"length too large", "*1\r\n$536870913\r\n", true},
+		{"length not a number", "*1\r\n$x\r\n", true},
+		{"not a bulk string", "*1\r\n:1\r\n", true},
+		{"bulk string too long", "*1\r\n$3\r\nPING\r\n", true},
+		{"truncated header", "*2\r\n$4\r\nPING\r\n$", false},
+		{"truncated bulk string", "*1\r\n$4\r\nPI", false},
+		{"truncated after a command", "*1\r\n$4\r\nPING\r\n*1", false},
+	} {
+		r := NewReader(strings.NewReader(tt.stream))
+
+		var err error
+		for err == nil {
+			_, err = r.ReadCommand()
+		}
+
+		switch {
+		case err == io.EOF:
+			t.Errorf("%s: read to the end", tt.name)
+		case tt.protocol && !errors.Is(err, ErrorProtocol):
+			t.Errorf("%s: %v, want %v", tt.name, err, ErrorProtocol)
+		case !tt.protocol && !errors.Is(err, io.ErrUnexpectedEOF):
+			t.Errorf("%s: %v, want %v", tt.name, err, io.ErrUnexpectedEOF)
+		case !strings.Contains(err.Error(), "at byte"):
+			t.Errorf("%s: %v doesn't say where", tt.name, err)
+		}
+	}
+}
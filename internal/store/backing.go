@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"strconv"
+	"time"
+)
+
+// Backing is an authoritative copy of the store's contents, for stores
+// that aren't rebuilt by replaying a log. The in-memory map then acts as a
+// cache of it: writes reach the backing through the store's Logger before
+// the cache is updated, and keys that aren't cached are read from it.
+type Backing interface {
+	// Lookup returns the record of a key, or ok false if there is none.
+	Lookup(ctx context.Context, bucket, key string) (rec BackingRecord, ok bool, err error)
+
+	// LoadAll calls fn for every key.
+	LoadAll(ctx context.Context, fn func(BackingRecord)) error
+}
+
+// BackingRecord is a key as kept by a Backing. Value is compressed with
+// Codec, as in the log.
+type BackingRecord struct {
+	Bucket string
+	Key    string
+	Value  string
+	Codec  compress.Codec
+	Meta   ValueMeta
+}
+
+// cache stores rec in the map without touching its metadata. The caller
+// must hold the write lock.
+func (s *Store) cache(rec BackingRecord) {
+	var old *entry
+	if prev, ok := s.m.get(rec.Bucket, rec.Key); ok {
+		old = &prev
+	}
+
+	e := entry{value: rec.Value, codec: rec.Codec, meta: rec.Meta}
+	s.m.set(rec.Bucket, rec.Key, e)
+	s.accountChange(rec.Bucket, rec.Key, old, &e)
+}
+
+// fetched is the outcome of a backing lookup shared by coalesced reads.
+type fetched struct {
+	e  entry
+	ok bool
+}
+
+// fetch reads a key missing from the cache from the backing, and caches it
+// unless the store changed in the meantime, in which case the record read
+// may already be stale. The caller must not hold the lock.
+//
+// With CoalesceReads, concurrent fetches of a key share a single lookup,
+// and its result or error. Only fetches that saw the same epoch share one,
+// so a read never gets a lookup that began before a write it should see.
+// The lookup outlives the cancellation of any one reader, each of which
+// stops waiting once its own ctx is done.
+func (s *Store) fetch(ctx context.Context, bucket, key string, epoch uint64) (entry, bool, error) {
+	if !s.opts.CoalesceReads {
+		e, ok, err := s.lookupBacking(ctx, bucket, key, epoch)
+		return e, ok, phaseError(PhaseBacking, err)
+	}
+
+	flight := strconv.FormatUint(epoch, 10) + "/" + bucket + "/" + key
+
+	results := s.flights.DoChan(flight, func() (any, error) {
+		e, ok, err := s.lookupBacking(context.WithoutCancel(ctx), bucket, key, epoch)
+		return fetched{e, ok}, err
+	})
+
+	select {
+	case r := <-results:
+		f, _ := r.Val.(fetched)
+		return f.e, f.ok, phaseError(PhaseBacking, r.Err)
+	case <-ctx.Done():
+		return entry{}, false, phaseError(PhaseBacking, ctx.Err())
+	}
+}
+
+// lookupBacking performs a fetch's lookup.
+func (s *Store) lookupBacking(ctx context.Context, bucket, key string, epoch uint64) (entry, bool, error) {
+	rec, ok, err := s.opts.Backing.Lookup(ctx, bucket, key)
+	if err != nil || !ok || rec.Meta.expired(time.Now()) {
+		return entry{}, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.epoch.Load() == epoch {
+		s.cache(rec)
+	}
+
+	return entry{value: rec.Value, codec: rec.Codec, meta: rec.Meta}, true, nil
+}
+
+// lookupForWrite is lookup for a write about to change key, faulting it in
+// from the backing first so the write builds on its current value and
+// version. The caller must hold the lock of a write of key, which takes the
+// write lock when there is a backing.
+func (s *Store) lookupForWrite(ctx context.Context, bucket, key string) (entry, bool, error) {
+	if e, ok := s.lookup(bucket, key); ok || s.complete() {
+		return e, ok, nil
+	}
+
+	rec, ok, err := s.opts.Backing.Lookup(ctx, bucket, key)
+	if err != nil || !ok || rec.Meta.expired(time.Now()) {
+		return entry{}, false, phaseError(PhaseBacking, err)
+	}
+
+	s.cache(rec)
+
+	return entry{value: rec.Value, codec: rec.Codec, meta: rec.Meta}, true, nil
+}
+
+// complete reports whether every key is in the map, as it always is without
+// a backing. The caller must hold the lock.
+func (s *Store) complete() bool {
+	return s.opts.Backing == nil || s.loaded
+}
+
+// loadAll fills the cache with every key in the backing, so the operations
+// that range over the map see them all. It only reads the backing once.
+func (s *Store) loadAll(ctx context.Context) error {
+	s.mu.RLock()
+	done := s.complete()
+	s.mu.RUnlock()
+
+	if done {
+		return nil
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if s.complete() {
+		return nil
+	}
+
+	// Cached keys are at least as recent as the backing, since every write
+	// reaches the backing before the cache
+	err := s.opts.Backing.LoadAll(ctx, func(rec BackingRecord) {
+		if _, ok := s.lookup(rec.Bucket, rec.Key); !ok {
+			s.cache(rec)
+		}
+	})
+	if err != nil {
+		return phaseError(PhaseBacking, err)
+	}
+
+	s.loaded = true
+
+	return nil
+}
@@ -0,0 +1,383 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBacking is a Backing kept in memory, which is also the store's Logger,
+// writing puts and deletes through to itself as the postgres-state backend
+// does to its table.
+type memBacking struct {
+	mu      sync.Mutex
+	recs    map[[2]string]BackingRecord
+	lookups int   // Lookups made so far
+	fail    error // Returned by WriteEvent, if set
+	broken  error // Returned by Lookup, if set
+
+	// Set, the next lookup reads its record, then signals started and
+	// waits for release before returning it
+	started, release chan struct{}
+}
+
+func newMemBacking(recs ...BackingRecord) *memBacking {
+	b := &memBacking{recs: make(map[[2]string]BackingRecord)}
+	for _, rec := range recs {
+		b.recs[[2]string{rec.Bucket, rec.Key}] = rec
+	}
+
+	return b
+}
+
+func (b *memBacking) WriteEvent(ctx context.Context, e translog.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fail != nil {
+		return b.fail
+	}
+
+	switch e.EventType {
+	case translog.EventPut:
+		b.recs[[2]string{e.Bucket, e.Key}] = BackingRecord{Bucket: e.Bucket, Key: e.Key, Value: e.Value, Codec: e.Codec}
+	case translog.EventDelete:
+		delete(b.recs, [2]string{e.Bucket, e.Key})
+	}
+
+	return nil
+}
+
+func (b *memBacking) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (b *memBacking) Lookup(ctx context.Context, bucket, key string) (BackingRecord, bool, error) {
+	b.mu.Lock()
+	rec, ok := b.recs[[2]string{bucket, key}]
+	b.lookups++
+	started, release := b.started, b.release
+	b.started, b.release = nil, nil
+	err := b.broken
+	b.mu.Unlock()
+
+	if started != nil {
+		close(started)
+		<-release
+	}
+
+	return rec, ok, err
+}
+
+func (b *memBacking) LoadAll(ctx context.Context, fn func(BackingRecord)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, rec := range b.recs {
+		fn(rec)
+	}
+
+	return nil
+}
+
+// value returns the value of key in the backing, or ok false.
+func (b *memBacking) value(key string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rec, ok := b.recs[[2]string{DefaultBucket, key}]
+
+	return rec.Value, ok
+}
+
+// lookupCount returns the lookups made so far.
+func (b *memBacking) lookupCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lookups
+}
+
+func TestBackingMissThenHit(t *testing.T) {
+	b := newMemBacking(BackingRecord{Bucket: DefaultBucket, Key: "k", Value: "stored"})
+	s := New(b, Options{Backing: b})
+	ctx := context.Background()
+
+	// A miss reads the backing, and caches the key for the reads after it
+	for range 3 {
+		if v, err := s.GetCtx(ctx, "k"); err != nil || v != "stored" {
+			t.Fatalf("Get: %q, %v; want stored", v, err)
+		}
+	}
+	if n := b.lookupCount(); n != 1 {
+		t.Errorf("3 reads made %d lookups, want 1", n)
+	}
+
+	// A key in neither is missing, and looked up each time
+	for range 2 {
+		if _, err := s.GetCtx(ctx, "missing"); !errors.Is(err, ErrorNoSuchKey) {
+			t.Fatalf("Get of a missing key: %v, want ErrorNoSuchKey", err)
+		}
+	}
+	if n := b.lookupCount(); n != 3 {
+		t.Errorf("%d lookups, want 3", n)
+	}
+}
+
+func TestBackingWriteThrough(t *testing.T) {
+	b := newMemBacking(BackingRecord{Bucket: DefaultBucket, Key: "old", Value: "stored"})
+	s := New(b, Options{Backing: b})
+	ctx := context.Background()
+
+	// A put reaches the backing and the cache, which serves it from then on
+	if err := s.PutCtx(ctx, "k", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := b.value("k"); !ok || v != "v1" {
+		t.Errorf("backing has %q, %v after the put", v, ok)
+	}
+
+	lookups := b.lookupCount()
+	if v, err := s.GetCtx(ctx, "k"); err != nil || v != "v1" {
+		t.Errorf("Get after the put: %q, %v", v, err)
+	}
+	if b.lookupCount() != lookups {
+		t.Error("a read after a put went to the backing")
+	}
+
+	// A delete removes the key from both, whether it was cached or not
+	for _, key := range []string{"k", "old"} {
+		if err := s.DeleteCtx(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := b.value(key); ok {
+			t.Errorf("%s is still in the backing after its delete", key)
+		}
+		if _, err := s.GetCtx(ctx, key); !errors.Is(err, ErrorNoSuchKey) {
+			t.Errorf("Get of %s after its delete: %v, want ErrorNoSuchKey", key, err)
+		}
+	}
+
+	// A write the backing refuses leaves the cache as it was
+	if err := s.PutCtx(ctx, "k", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.fail = errors.New("connection lost")
+	b.mu.Unlock()
+
+	if err := s.PutCtx(ctx, "k", "v3"); err == nil {
+		t.Fatal("a put the backing refused succeeded")
+	}
+	if err := s.DeleteCtx(ctx, "k"); err == nil {
+		t.Fatal("a delete the backing refused succeeded")
+	}
+	if v, err := s.GetCtx(ctx, "k"); err != nil || v != "v2" {
+		t.Errorf("Get after refused writes: %q, %v; want v2", v, err)
+	}
+}
+
+func TestBackingLookupRacingAWrite(t *testing.T) {
+	b := newMemBacking(BackingRecord{Bucket: DefaultBucket, Key: "k", Value: "old"})
+	s := New(b, Options{Backing: b})
+	ctx := context.Background()
+
+	b.started, b.release = make(chan struct{}), make(chan struct{})
+	started, release := b.started, b.release
+
+	// A read misses, and reads the old value from the backing
+	read := make(chan string, 1)
+	go func() {
+		v, _ := s.GetCtx(ctx, "k")
+		read <- v
+	}()
+	<-started
+
+	// A write lands before the lookup returns
+	if err := s.PutCtx(ctx, "k", "new"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	if v := <-read; v != "old" {
+		t.Errorf("the racing read got %q, want old", v)
+	}
+
+	// The old value it read isn't cached over the write
+	if v, err := s.GetCtx(ctx, "k"); err != nil || v != "new" {
+		t.Errorf("Get after the race: %q, %v; want new", v, err)
+	}
+}
+
+func TestBackingListingsLoadEveryKey(t *testing.T) {
+	b := newMemBacking(
+		BackingRecord{Bucket: DefaultBucket, Key: "a", Value: "1"},
+		BackingRecord{Bucket: DefaultBucket, Key: "b", Value: "2"},
+	)
+	s := New(b, Options{Backing: b})
+	ctx := context.Background()
+
+	// Keys cached before the listing are as written, not as first loaded
+	if err := s.PutCtx(ctx, "b", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "c", "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _, err := s.Keys(ctx, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(keys, want) {
+		t.Errorf("Keys: %v, want %v", keys, want)
+	}
+
+	lookups := b.lookupCount()
+	for key, want := range map[string]string{"a": "1", "b": "3", "c": "4"} {
+		if v, err := s.GetCtx(ctx, key); err != nil || v != want {
+			t.Errorf("Get %s: %q, %v; want %s", key, v, err, want)
+		}
+	}
+	if b.lookupCount() != lookups {
+		t.Error("reads after a listing went to the backing")
+	}
+}
+
+// concurrentGets starts n reads of key, holding the backing's lookup until
+// all of them have had time to join it, and returns their results.
+func concurrentGets(t *testing.T, s *Store, b *memBacking, ctx context.Context, key string, n int) []string {
+	t.Helper()
+
+	b.mu.Lock()
+	b.started, b.release = make(chan struct{}), make(chan struct{})
+	started, release := b.started, b.release
+	b.mu.Unlock()
+
+	results := make([]string, n)
+
+	var ready, done sync.WaitGroup
+	for i := range n {
+		ready.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			ready.Done()
+
+			v, err := s.GetCtx(ctx, key)
+			results[i] = fmt.Sprintf("%s, %v", v, err)
+		}()
+	}
+	ready.Wait()
+	<-started
+
+	// The reads started after the lookup join it within a moment
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	return results
+}
+
+func TestCoalescedReadsShareOneLookup(t *testing.T) {
+	const readers = 1000
+
+	b := newMemBacking(BackingRecord{Bucket: DefaultBucket, Key: "hot", Value: "v"})
+	s := New(b, Options{Backing: b, CoalesceReads: true})
+	ctx := context.Background()
+
+	for i, r := range concurrentGets(t, s, b, ctx, "hot", readers) {
+		if r != "v, <nil>" {
+			t.Fatalf("read %d got %s", i, r)
+		}
+	}
+	if n := b.lookupCount(); n != 1 {
+		t.Errorf("%d concurrent reads of a key made %d lookups, want 1", readers, n)
+	}
+
+	// A failed lookup fails every read sharing it, and isn't kept: the
+	// next read looks up again
+	b.mu.Lock()
+	b.broken = errors.New("connection lost")
+	b.mu.Unlock()
+
+	for i, r := range concurrentGets(t, s, b, ctx, "cold", 100) {
+		if r != ", connection lost" {
+			t.Fatalf("read %d sharing a failed lookup got %s", i, r)
+		}
+	}
+	if n := b.lookupCount(); n != 2 {
+		t.Errorf("%d lookups after the failed one, want 2", n)
+	}
+
+	b.mu.Lock()
+	b.broken = nil
+	b.mu.Unlock()
+
+	if _, err := s.GetCtx(ctx, "cold"); !errors.Is(err, ErrorNoSuchKey) || b.lookupCount() != 3 {
+		t.Errorf("read after a failed lookup: %v, %d lookups; want a new lookup finding nothing", err, b.lookupCount())
+	}
+}
+
+func TestCoalescedReadStopsWaitingWhenCanceled(t *testing.T) {
+	b := newMemBacking(BackingRecord{Bucket: DefaultBucket, Key: "k", Value: "v"})
+	s := New(b, Options{Backing: b, CoalesceReads: true})
+
+	b.started, b.release = make(chan struct{}), make(chan struct{})
+	started, release := b.started, b.release
+
+	read := make(chan string, 1)
+	go func() {
+		v, err := s.GetCtx(context.Background(), "k")
+		read <- fmt.Sprintf("%s, %v", v, err)
+	}()
+	<-started
+
+	// A reader joining the lookup gives up when its context is done, and
+	// the lookup carries on for the one that started it
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.GetCtx(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("canceled read: %v, want its deadline", err)
+	}
+
+	close(release)
+	if r := <-read; r != "v, <nil>" {
+		t.Errorf("the read that started the lookup got %s", r)
+	}
+	if n := b.lookupCount(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
+
+func TestUncoalescedReadsLookUpEach(t *testing.T) {
+	b := newMemBacking(BackingRecord{Bucket: DefaultBucket, Key: "hot", Value: "v"})
+	s := New(b, Options{Backing: b})
+
+	b.started, b.release = make(chan struct{}), make(chan struct{})
+	started, release := b.started, b.release
+
+	// Without CoalesceReads a read doesn't wait on another's lookup
+	read := make(chan string, 1)
+	go func() {
+		v, err := s.GetCtx(context.Background(), "hot")
+		read <- fmt.Sprintf("%s, %v", v, err)
+	}()
+	<-started
+
+	if v, err := s.GetCtx(context.Background(), "hot"); err != nil || v != "v" {
+		t.Errorf("second read: %q, %v", v, err)
+	}
+	close(release)
+	<-read
+
+	if n := b.lookupCount(); n != 2 {
+		t.Errorf("2 concurrent reads made %d lookups, want 2", n)
+	}
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/compress"
+)
+
+// ErrorNoBlobs is returned when a value kept in a blob directory is read
+// from a store that has none configured.
+var ErrorNoBlobs = errors.New("value is in a blob directory, but none is configured")
+
+// offload moves a value encoded with codec to the blob directory if it is
+// large enough, and returns what to store and log in its place: the blob's
+// reference, with compress.Blob set on the codec.
+func (s *Store) offload(stored string, codec compress.Codec) (string, compress.Codec, error) {
+	if s.opts.Blobs == nil || codec.IsBlob() || !s.opts.Blobs.Takes(len(stored)) {
+		return stored, codec, nil
+	}
+
+	ref, err := s.opts.Blobs.Put(stored)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return ref.String(), codec | compress.Blob, nil
+}
+
+// inline reverses offload, reading the blob a value refers to back. Values
+// that aren't blobs are returned as they are.
+func (s *Store) inline(stored string, codec compress.Codec) (string, compress.Codec, error) {
+	if !codec.IsBlob() {
+		return stored, codec, nil
+	}
+
+	if s.opts.Blobs == nil {
+		return "", 0, ErrorNoBlobs
+	}
+
+	value, err := s.opts.Blobs.Resolve(stored)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return value, codec &^ compress.Blob, nil
+}
+
+// noteBlob records that the reference stored with codec is in use, for
+// CollectBlobs. The caller must hold the write lock, or the lock of a
+// write.
+func (s *Store) noteBlob(stored string, codec compress.Codec) {
+	if !codec.IsBlob() {
+		return
+	}
+
+	if ref, err := blob.ParseRef(stored); err == nil {
+		s.blobMu.Lock()
+		defer s.blobMu.Unlock()
+
+		if s.blobRefs == nil {
+			s.blobRefs = make(map[string]struct{})
+		}
+		s.blobRefs[ref.Hash] = struct{}{}
+	}
+}
+
+// checkBlob verifies the blob a value read from the log or a snapshot refers
+// to against its hash, unless it was already checked. Without a blob
+// directory references are kept unchecked, for tools that only move the
+// stored values around. The caller must hold the write lock.
+func (s *Store) checkBlob(stored string, codec compress.Codec) error {
+	if !codec.IsBlob() || s.opts.Blobs == nil {
+		return nil
+	}
+
+	ref, err := blob.ParseRef(stored)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.blobRefs[ref.Hash]; ok {
+		return nil
+	}
+
+	if _, err := s.opts.Blobs.Get(ref); err != nil {
+		return err
+	}
+
+	s.noteBlob(stored, codec)
+
+	return nil
+}
+
+// CollectBlobs removes the blobs that neither the snapshot and log the store
+// was loaded from nor the store's current values refer to, such as those
+// written by puts that never reached the log before a crash, or only
+// referred to by events a compaction dropped. It returns the number of blobs
+// removed and their total size. It is meant for startup, after Load and
+// before the store serves writes, since a put writes its blob before logging
+// the reference.
+func (s *Store) CollectBlobs(ctx context.Context) (int, int64, error) {
+	if s.opts.Blobs == nil {
+		return 0, 0, nil
+	}
+
+	if err := s.loadAll(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Values a backing holds were never replayed
+	for _, b := range s.m.parts() {
+		for _, e := range b {
+			s.noteBlob(e.value, e.codec)
+		}
+	}
+
+	return s.opts.Blobs.Collect(func(hash string) bool {
+		_, ok := s.blobRefs[hash]
+		return ok
+	})
+}
+
+// blobError adds the key a value belongs to to an error reading its blob.
+func blobError(bucket, key string, err error) error {
+	return fmt.Errorf("key %q in bucket %q: %w", key, bucket, err)
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openBlobs returns the blob directory of dir, taking values of 1KiB and
+// more.
+func openBlobs(t *testing.T, dir string) *blob.Dir {
+	t.Helper()
+
+	d, err := blob.Open(filepath.Join(dir, blob.DirName), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestLargeValuesInBlobs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blobs := openBlobs(t, dir)
+
+	large, small := strings.Repeat("large ", 1000), "small"
+
+	s, closeLog := openLogged(t, dir, Options{Blobs: blobs})
+	if err := s.PutCtx(ctx, "large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "small", small); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	// The log holds a reference to the large value, which a blob holds
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, errs := l.ReadEvents()
+	for e := range events {
+		_, err := blob.ParseRef(e.Value)
+		if isRef := e.Codec.IsBlob() && err == nil; isRef != (e.Key == "large") {
+			t.Errorf("the put of %s logs %d bytes, codec %s", e.Key, len(e.Value), e.Codec)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	l.Close(ctx)
+
+	if entries, _ := os.ReadDir(blobs.Path()); len(entries) != 1 {
+		t.Errorf("the blob directory holds %d files, want 1", len(entries))
+	}
+
+	// Replay checks the blob, and reads give the value back
+	s, closeLog = openLogged(t, dir, Options{Blobs: blobs})
+	if v, err := s.Get("large"); v != large || err != nil {
+		t.Errorf("GET large after replay: %d bytes, %v", len(v), err)
+	}
+	if v, err := s.Get("small"); v != small || err != nil {
+		t.Errorf("GET small after replay: %q, %v", v, err)
+	}
+	closeLog()
+
+	// A blob changed on disk fails the replay, naming the key
+	entries, err := os.ReadDir(blobs.Path())
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("the blob directory holds %v, %v", entries, err)
+	}
+	name := filepath.Join(blobs.Path(), entries[0].Name())
+	if err := os.WriteFile(name, []byte(strings.Replace(large, "l", "L", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(ctx)
+
+	err = New(l, Options{Blobs: blobs}).Load(dir, l)
+	if !errors.Is(err, blob.ErrorCorrupt) || !strings.Contains(err.Error(), `key "large"`) {
+		t.Errorf("replaying a log referring to a changed blob: %v", err)
+	}
+}
+
+func TestCollectBlobsAfterACrash(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blobs := openBlobs(t, dir)
+
+	s, closeLog := openLogged(t, dir, Options{Blobs: blobs})
+	for _, key := range []string{"kept", "replaced", "deleted"} {
+		if err := s.PutCtx(ctx, key, strings.Repeat(key+" ", 500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PutCtx(ctx, "replaced", "small now"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteCtx(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash between writing a put's blob and logging its reference leaves
+	// the blob behind
+	orphan, err := blobs.Put(strings.Repeat("never logged ", 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{Blobs: blobs})
+	defer closeLog()
+
+	// The blobs of the replaced and deleted values are still referred to by
+	// the log, so only the orphan goes
+	removed, size, err := s.CollectBlobs(ctx)
+	if err != nil || removed != 1 || size != orphan.Size {
+		t.Errorf("collecting blobs: %d removed, %d bytes, %v; want the orphan of %d bytes", removed, size, err, orphan.Size)
+	}
+	if _, err := blobs.Get(orphan); !errors.Is(err, blob.ErrorMissing) {
+		t.Errorf("the orphan after collecting: %v", err)
+	}
+	if v, err := s.Get("kept"); v != strings.Repeat("kept ", 500) || err != nil {
+		t.Errorf("GET kept after collecting: %d bytes, %v", len(v), err)
+	}
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"maps"
+	"slices"
+)
+
+// GetMany is BucketGetMany for keys in the default bucket.
+func (s *Store) GetMany(ctx context.Context, keys []string) ([]KeyRead, uint64, error) {
+	return s.BucketGetMany(ctx, DefaultBucket, keys)
+}
+
+// PutMany is BucketPutMany for keys in the default bucket.
+func (s *Store) PutMany(ctx context.Context, values map[string]string) error {
+	return s.BucketPutMany(ctx, DefaultBucket, values)
+}
+
+// DeleteMany is BucketDeleteMany for keys in the default bucket.
+func (s *Store) DeleteMany(ctx context.Context, keys []string) error {
+	return s.BucketDeleteMany(ctx, DefaultBucket, keys)
+}
+
+// BucketPutMany puts each value under its key in the named bucket, as a Txn
+// of puts without conditions: under one hold of the write lock, logged
+// together, in the order of the keys, and all or none of them applied. Two
+// keys that fold to the same key are an error wrapping ErrorInvalidTxn.
+func (s *Store) BucketPutMany(ctx context.Context, bucket string, values map[string]string) error {
+	keys := slices.Sorted(maps.Keys(values))
+
+	ops := make([]TxnOp, len(keys))
+	for i, key := range keys {
+		ops[i] = TxnOp{Type: TxnPut, Bucket: bucket, Key: key, Value: values[key]}
+	}
+
+	_, err := s.Txn(ctx, Txn{Then: ops})
+	return err
+}
+
+// BucketDeleteMany deletes keys from the named bucket as BucketPutMany puts
+// values. Missing keys are skipped, and a key given twice is deleted once.
+func (s *Store) BucketDeleteMany(ctx context.Context, bucket string, keys []string) error {
+	keys = slices.Compact(slices.Sorted(slices.Values(keys)))
+
+	ops := make([]TxnOp, len(keys))
+	for i, key := range keys {
+		ops[i] = TxnOp{Type: TxnDelete, Bucket: bucket, Key: key}
+	}
+
+	_, err := s.Txn(ctx, Txn{Then: ops})
+	return err
+}
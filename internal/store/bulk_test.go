@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBulkWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{KeyFolding: FoldASCII})
+
+	if err := s.PutMany(ctx, map[string]string{"a": "1", "b": "2", "c": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(WithImmutable(ctx), "once", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// check checks that the keys of the default bucket are want
+	check := func(t *testing.T, s *Store, want, when string) {
+		t.Helper()
+
+		var got []string
+		keys, err := s.BucketKeys(ctx, DefaultBucket, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			v, err := s.GetCtx(ctx, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, k+"="+v)
+		}
+
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: %v, want %s", when, got, want)
+		}
+	}
+
+	check(t, s, "[a=1 b=2 c=3 once=v]", "after a bulk put")
+
+	// A write the store refuses leaves the others unapplied
+	err := s.PutMany(ctx, map[string]string{"a": "changed", "d": "new", "once": "changed"})
+	if !errors.Is(err, ErrorImmutable) {
+		t.Errorf("a bulk put of a write-once key: %v, want ErrorImmutable", err)
+	}
+	if err := s.DeleteMany(ctx, []string{"a", "once"}); !errors.Is(err, ErrorImmutable) {
+		t.Errorf("a bulk delete of a write-once key: %v, want ErrorImmutable", err)
+	}
+	check(t, s, "[a=1 b=2 c=3 once=v]", "after refused bulk writes")
+
+	// Keys that fold to the same key are the same key written twice
+	if err := s.PutMany(ctx, map[string]string{"a": "x", "A": "y"}); !errors.Is(err, ErrorInvalidTxn) {
+		t.Errorf("a bulk put of a and A: %v, want ErrorInvalidTxn", err)
+	}
+
+	// A key deleted twice is deleted once, and missing keys are skipped
+	if err := s.DeleteMany(ctx, []string{"b", "c", "b", "missing"}); err != nil {
+		t.Errorf("a bulk delete of b twice: %v", err)
+	}
+	if err := s.BucketDeleteMany(ctx, "other", []string{"a"}); err != nil {
+		t.Errorf("a bulk delete in a bucket without the keys: %v", err)
+	}
+	check(t, s, "[a=1 once=v]", "after a bulk delete")
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{KeyFolding: FoldASCII})
+	defer closeLog()
+
+	check(t, s, "[a=1 once=v]", "after a restart")
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"time"
+)
+
+// ConflictAction is what a ConflictResolver decides to do with an event.
+type ConflictAction int
+
+const (
+	TakeIncoming ConflictAction = iota // Apply the event, as without a resolver
+	KeepLocal                          // Skip the event, leaving the key as it is
+	MergeValue                         // Put Resolution.Value in the key instead
+)
+
+var conflictActionNames = []string{"take-incoming", "keep-local", "merge"}
+
+func (a ConflictAction) String() string {
+	if int(a) < len(conflictActionNames) {
+		return conflictActionNames[a]
+	}
+
+	return fmt.Sprintf("ConflictAction(%d)", int(a))
+}
+
+// Resolution is the outcome of a conflict.
+type Resolution struct {
+	Action ConflictAction
+	Value  string // Value to put, as a client would write it, for MergeValue
+}
+
+// ConflictResolver decides the outcome of a conflict: a put, delete or
+// eviction, replayed from the log or replicated from a leader, of a key
+// modified after the event was logged, such as when instances whose clocks
+// differ write to one log, or a store with writes of its own starts
+// following a leader. incoming's Value is decoded, as the client wrote it.
+//
+// Resolvers are called without the store's lock, so they may read the
+// store; the decision is applied under the lock afterwards, unless the key
+// changed in the meantime, in which case it is decided again. Outcomes
+// aren't logged: every replay decides them anew, so a resolver must decide
+// the same way for the same arguments for replays to end in the same state.
+type ConflictResolver func(local ValueMeta, incoming translog.Event) Resolution
+
+// LastWriterWins is the built-in ConflictResolver: the write made last, by
+// the clocks of the instances that made them, is kept.
+func LastWriterWins(local ValueMeta, incoming translog.Event) Resolution {
+	if local.Modified.After(incoming.Time) {
+		return Resolution{Action: KeepLocal}
+	}
+
+	return Resolution{Action: TakeIncoming}
+}
+
+// conflictResolverNames are the resolvers ParseConflictResolver knows.
+var conflictResolverNames = []string{"overwrite", "last-writer-wins"}
+
+// ParseConflictResolver returns the resolver named by name: overwrite, which
+// is nil, applying every event as it comes, or last-writer-wins.
+func ParseConflictResolver(name string) (ConflictResolver, error) {
+	switch name {
+	case "overwrite":
+		return nil, nil
+	case "last-writer-wins":
+		return LastWriterWins, nil
+	default:
+		return nil, fmt.Errorf("unknown conflict resolution %q, expected one of %v", name, conflictResolverNames)
+	}
+}
+
+// decision is how an event is applied, and the state of its key it was
+// decided on, which must still hold when it is applied.
+type decision struct {
+	local    entry
+	hadLocal bool
+
+	conflict bool
+	action   ConflictAction
+	stored   string // Merged value, encoded
+	codec    compress.Codec
+}
+
+// eventTime returns the time e is applied as written at: when it was
+// logged, or now for events of logs older than timestamps.
+func eventTime(e translog.Event) time.Time {
+	if e.Time.IsZero() {
+		return time.Now()
+	}
+
+	return e.Time
+}
+
+// decide decides how e is applied, calling Options.ResolveConflict if it
+// conflicts with the key's local state. The caller must not hold the lock.
+func (s *Store) decide(e translog.Event) (decision, error) {
+	var d decision
+
+	if s.opts.ResolveConflict == nil {
+		return d, nil
+	}
+	if e.EventType != translog.EventPut && e.EventType != translog.EventDelete && e.EventType != translog.EventEvict {
+		return d, nil
+	}
+
+	s.mu.RLock()
+	d.local, d.hadLocal = s.lookup(e.Bucket, e.Key)
+	s.mu.RUnlock()
+
+	if !d.hadLocal || e.Time.IsZero() || !d.local.meta.Modified.After(e.Time) {
+		return d, nil
+	}
+
+	incoming := e
+	if e.EventType == translog.EventPut {
+		value, err := s.decode(entry{value: e.Value, codec: e.Codec})
+		if err != nil {
+			return d, fmt.Errorf("key %q in bucket %q: %w", e.Key, e.Bucket, err)
+		}
+		incoming.Value, incoming.Codec = value, compress.None
+	}
+
+	r := s.opts.ResolveConflict(d.local.meta, incoming)
+
+	d.conflict, d.action = true, r.Action
+
+	switch r.Action {
+	case TakeIncoming, KeepLocal:
+	case MergeValue:
+		var err error
+		if d.stored, d.codec, err = s.encode(r.Value); err != nil {
+			return d, err
+		}
+	default:
+		return d, fmt.Errorf("conflict resolver returned %v for key %q in bucket %q", r.Action, e.Key, e.Bucket)
+	}
+
+	log.Printf("CONFLICT bucket=%s key=%s sequence=%d resolution=%s\n", e.Bucket, e.Key, e.Sequence, r.Action)
+
+	return d, nil
+}
+
+// holds reports whether the key of e is still as d was decided on. The
+// caller must hold the lock.
+func (d decision) holds(s *Store, e translog.Event) bool {
+	if s.opts.ResolveConflict == nil {
+		return true
+	}
+
+	cur, ok := s.lookup(e.Bucket, e.Key)
+
+	return ok == d.hadLocal && cur == d.local
+}
+
+// applyEvent applies e, an event from the log or a leader, as decided by
+// decide, calling before under the write lock first; an error from before
+// leaves e unapplied.
+func (s *Store) applyEvent(e translog.Event, before func() error) error {
+	for {
+		d, err := s.decide(e)
+		if err != nil {
+			return err
+		}
+
+		if done, err := s.applyDecided(e, d, before); done {
+			return err
+		}
+	}
+}
+
+// applyDecided applies e as d decides, and reports false, with nothing done,
+// if the key changed since d was decided.
+func (s *Store) applyDecided(e translog.Event, d decision, before func() error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !d.holds(s, e) {
+		return false, nil
+	}
+
+	logErr := before()
+	if !logged(logErr) {
+		return true, logErr
+	}
+
+	if d.conflict {
+		switch d.action {
+		case KeepLocal:
+			s.seq.raise(e.Sequence)
+			return true, logErr
+		case MergeValue:
+			e.EventType, e.Value, e.Codec = translog.EventPut, d.stored, d.codec
+		}
+	}
+
+	return true, cmp.Or(s.apply(e), logErr)
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mergeValues is a ConflictResolver merging the values of conflicting puts
+// into their sorted, comma-separated union, and keeping keys deleted
+// elsewhere. It reads the local value from s, which it may, being called
+// without the store's lock.
+func mergeValues(s **Store) ConflictResolver {
+	return func(local ValueMeta, incoming translog.Event) Resolution {
+		if incoming.EventType != translog.EventPut {
+			return Resolution{Action: KeepLocal}
+		}
+
+		value, _, err := (*s).BucketGetWithMeta(context.Background(), incoming.Bucket, incoming.Key)
+		if err != nil {
+			return Resolution{Action: TakeIncoming}
+		}
+
+		values := append(strings.Split(value, ","), incoming.Value)
+		sort.Strings(values)
+
+		return Resolution{Action: MergeValue, Value: strings.Join(values, ",")}
+	}
+}
+
+func TestConflictResolutions(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	earlier, later := now.Add(-time.Hour), now.Add(time.Hour)
+
+	// incoming returns an event for k logged at, as another instance would
+	// log it
+	incoming := func(seq uint64, typ translog.EventType, value string, at time.Time) translog.Event {
+		return translog.Event{Sequence: seq, EventType: typ, Bucket: DefaultBucket, Key: "k", Value: value, Time: at}
+	}
+
+	var merging *Store
+
+	tests := []struct {
+		name     string
+		resolver ConflictResolver
+		event    translog.Event
+		want     string // Value of k after the event, or "" if deleted
+	}{
+		{"no resolver", nil, incoming(10, translog.EventPut, "theirs", earlier), "theirs"},
+		{"an older put", LastWriterWins, incoming(10, translog.EventPut, "theirs", earlier), "ours"},
+		{"a newer put", LastWriterWins, incoming(10, translog.EventPut, "theirs", later), "theirs"},
+		{"an older delete", LastWriterWins, incoming(10, translog.EventDelete, "", earlier), "ours"},
+		{"a newer delete", LastWriterWins, incoming(10, translog.EventDelete, "", later), ""},
+		{"a merged put", mergeValues(&merging), incoming(10, translog.EventPut, "theirs", earlier), "ours,theirs"},
+		{"a delete kept out", mergeValues(&merging), incoming(10, translog.EventDelete, "", earlier), "ours"},
+	}
+
+	for _, tt := range tests {
+		for _, replicated := range []bool{false, true} {
+			s := New(translog.NewNopTransactionLogger(), Options{ResolveConflict: tt.resolver})
+			merging = s
+
+			if err := s.PutCtx(ctx, "k", "ours"); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			if replicated {
+				err = s.Replicate(ctx, tt.event)
+			} else {
+				err = s.ApplyEvent(tt.event)
+			}
+			if err != nil {
+				t.Errorf("%s, replicated %v: %v", tt.name, replicated, err)
+				continue
+			}
+
+			got, _ := s.Get("k")
+			if got != tt.want {
+				t.Errorf("%s, replicated %v: k is %q, want %q", tt.name, replicated, got, tt.want)
+			}
+
+			// Kept or not, the event's sequence is past
+			if s.Sequence() != 10 {
+				t.Errorf("%s, replicated %v: at sequence %d, want 10", tt.name, replicated, s.Sequence())
+			}
+		}
+	}
+
+	// A resolver deciding nothing known fails the event
+	s := New(translog.NewNopTransactionLogger(), Options{ResolveConflict: func(ValueMeta, translog.Event) Resolution {
+		return Resolution{Action: ConflictAction(7)}
+	}})
+	if err := s.PutCtx(ctx, "k", "ours"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApplyEvent(incoming(10, translog.EventPut, "theirs", earlier)); err == nil || !strings.Contains(err.Error(), "ConflictAction(7)") {
+		t.Errorf("an unknown resolution: %v", err)
+	}
+}
+
+func TestConflictsReplayTheSame(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// A log two instances with clocks apart wrote to: the second's writes
+	// are logged after the first's, but stamped earlier
+	var b []byte
+	for i, e := range []translog.Event{
+		{EventType: translog.EventPut, Key: "a", Value: "first", Time: t0.Add(time.Minute)},
+		{EventType: translog.EventPut, Key: "a", Value: "second", Time: t0},
+		{EventType: translog.EventPut, Key: "b", Value: "first", Time: t0},
+		{EventType: translog.EventPut, Key: "b", Value: "second", Time: t0.Add(time.Minute)},
+		{EventType: translog.EventPut, Key: "c", Value: "first", Time: t0.Add(time.Minute)},
+		{EventType: translog.EventDelete, Key: "c", Time: t0},
+		{EventType: translog.EventPut, Key: "d", Value: "first", Time: t0.Add(time.Minute)},
+		{EventType: translog.EventPut, Key: "d", Value: "second", Time: t0},
+	} {
+		e.Sequence, e.Bucket = uint64(i+1), DefaultBucket
+		b = append(append(b, translog.EncodeEvent(e)...), '\n')
+	}
+	if err := os.WriteFile(filepath.Join(dir, translog.LogFileName), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every replay decides the conflicts the same way: the last writer by
+	// the clocks wins, or the values merge
+	for name, want := range map[string]string{
+		"overwrite":        "a=second b=second d=second",
+		"last-writer-wins": "a=first b=second c=first d=first",
+		"merge":            "a=first,second b=second c=first d=first,second",
+	} {
+		for replay := range 3 {
+			l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The merging resolver reads the store being loaded
+			var s *Store
+			resolvers := map[string]ConflictResolver{"overwrite": nil, "last-writer-wins": LastWriterWins, "merge": mergeValues(&s)}
+
+			s = New(l, Options{ResolveConflict: resolvers[name]})
+			if err := s.Load(dir, l); err != nil {
+				t.Fatal(err)
+			}
+			l.Close(context.Background())
+
+			var got []string
+			for _, key := range []string{"a", "b", "c", "d"} {
+				if v, err := s.Get(key); err == nil {
+					got = append(got, fmt.Sprintf("%s=%s", key, v))
+				}
+			}
+
+			if strings.Join(got, " ") != want {
+				t.Errorf("%s, replay %d: %s, want %s", name, replay+1, strings.Join(got, " "), want)
+			}
+		}
+	}
+}
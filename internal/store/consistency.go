@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"slices"
+	"sync"
+)
+
+// sequenceKey is the context key of the *uint64 a write records the
+// sequence number of its event in.
+type sequenceKey struct{}
+
+// WithSequence returns a context under which a successful write stores the
+// sequence number assigned to its event in seq, for clients that want to
+// read their own writes elsewhere. Writes that log nothing leave it as is.
+func WithSequence(ctx context.Context, seq *uint64) context.Context {
+	return context.WithValue(ctx, sequenceKey{}, seq)
+}
+
+// recordSequence stores seq where WithSequence asked for it, if it did.
+func recordSequence(ctx context.Context, seq uint64) {
+	if p, ok := ctx.Value(sequenceKey{}).(*uint64); ok {
+		*p = seq
+	}
+}
+
+// sequencer numbers the events the store logs. Writes of keys in different
+// shards log at once, so the numbers are taken under a lock of its own,
+// held while the event is enqueued, which keeps the log in the order of
+// the numbers. An event logged by the write of a single key counts as
+// applied once the write is done: until then, it holds back the sequence
+// reported as applied, so that no event is reported applied before one
+// numbered ahead of it. Events logged under the store's write lock count
+// as applied at once, as no one sees the store until the lock is released.
+type sequencer struct {
+	mu      sync.Mutex
+	last    uint64        // Sequence number of the last event logged or applied
+	open    []uint64      // Numbers of the events of the writes of single keys not yet done, in order
+	changed chan struct{} // Closed when the applied sequence next changes; nil until someone waits
+}
+
+// load returns the sequence number of the last event logged or applied.
+func (q *sequencer) load() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.last
+}
+
+// applied returns the sequence number up to which every event is applied.
+func (q *sequencer) applied() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.appliedLocked()
+}
+
+func (q *sequencer) appliedLocked() uint64 {
+	if len(q.open) > 0 {
+		return q.open[0] - 1
+	}
+
+	return q.last
+}
+
+// set makes seq the sequence of the last event applied, as a restore does,
+// and wakes the waiters of WaitSequence.
+func (q *sequencer) set(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.last = seq
+	q.wake()
+}
+
+// raise is set for seq, unless a later event was applied already.
+func (q *sequencer) raise(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if seq > q.last {
+		q.last = seq
+		q.wake()
+	}
+}
+
+// next numbers e as the event after the last, unless it has a number, and
+// enqueues it with write under the lock, then takes its number as the last
+// unless write failed to enqueue it. w is the write of a single key
+// logging e, if it is one, which releases the number once it's done.
+func (q *sequencer) next(e *translog.Event, w *keyWrite, write func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e.Sequence == 0 {
+		e.Sequence = q.last + 1
+	}
+
+	if err := write(); err != nil {
+		return err
+	}
+
+	q.last = e.Sequence
+	if w != nil {
+		q.open = append(q.open, e.Sequence)
+		w.seqs = append(w.seqs, e.Sequence)
+	} else {
+		q.wake()
+	}
+
+	return nil
+}
+
+// done releases the numbers of the events of a write of a single key,
+// once it has applied them.
+func (q *sequencer) done(seqs []uint64) {
+	if len(seqs) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.open = slices.DeleteFunc(q.open, func(seq uint64) bool {
+		return slices.Contains(seqs, seq)
+	})
+	q.wake()
+}
+
+// wait returns a channel closed when the applied sequence next changes,
+// unless it has reached seq already. The caller must not hold q.mu.
+func (q *sequencer) wait(seq uint64) (changed <-chan struct{}, reached bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.appliedLocked() >= seq {
+		return nil, true
+	}
+
+	// The channel is only created once someone waits, so writes don't pay
+	// for it otherwise
+	if q.changed == nil {
+		q.changed = make(chan struct{})
+	}
+
+	return q.changed, false
+}
+
+// wake wakes the waiters of wait. The caller must hold q.mu.
+func (q *sequencer) wake() {
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+// WaitSequence blocks until the store has applied the event numbered seq,
+// or ctx is done. A follower applies its leader's events under the leader's
+// numbers, so a sequence returned by a write on the leader can be waited
+// for on any of its followers.
+func (s *Store) WaitSequence(ctx context.Context, seq uint64) error {
+	for {
+		changed, reached := s.seq.wait(seq)
+		if reached {
+			// An event logged under the write lock counts once it's
+			// logged; the read lock waits for it to be applied
+			s.mu.RLock()
+			s.mu.RUnlock()
+
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
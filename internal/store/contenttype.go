@@ -0,0 +1,31 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrorInvalidContentType is returned for a put under WithContentType of a
+// media type the log can't hold.
+var ErrorInvalidContentType = errors.New("invalid content type")
+
+// contentTypeKey is the context key of the media type of the values put.
+type contentTypeKey struct{}
+
+// WithContentType returns a context under which puts record mediaType as
+// the media type of the value they write, for reads to serve it as. It is
+// logged as a field of the put, so it survives a restart and is replicated
+// as the put is. Any later write of the key without it, an increment or a
+// transaction included, clears it. A media type that isn't text, as
+// translog.ValidContentType decides, fails the put with
+// ErrorInvalidContentType.
+func WithContentType(ctx context.Context, mediaType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, mediaType)
+}
+
+// contentTypeOf returns the media type of the values put under ctx, or ""
+// if they have none.
+func contentTypeOf(ctx context.Context) string {
+	mediaType, _ := ctx.Value(contentTypeKey{}).(string)
+	return mediaType
+}
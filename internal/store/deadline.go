@@ -0,0 +1,214 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorDeadline is wrapped by the DeadlineError of an operation whose
+// context's deadline passed before it completed.
+var ErrorDeadline = errors.New("deadline exceeded")
+
+// Phases of an operation that its deadline may end, as DeadlineError names
+// them. What the operation changed depends on the phase: nothing in those
+// before the events are logged, and everything once they are enqueued.
+const (
+	PhaseQueue       = "queue"        // Waiting for a slot under the server's concurrency limits; nothing is changed
+	PhaseHooks       = "hooks"        // Running the put hooks; nothing is changed
+	PhaseBacking     = "backing"      // Reading keys from the backing; nothing is changed
+	PhaseLockWait    = "lock_wait"    // Waiting for the store's lock; nothing is changed
+	PhaseLogEnqueue  = "log_enqueue"  // Enqueueing the events with the logger; nothing is changed, but for the keys a bulk deletion enqueued before
+	PhaseFlush       = "flush"        // Waiting for the events to be durable; the write is applied, as for ErrorNotDurable
+	PhaseScan        = "scan"         // Listing keys; nothing is changed
+	PhaseMinSequence = "min_sequence" // Waiting for the sequence a read asked for; nothing is read
+	PhaseWatch       = "watch"        // Waiting for a change a long poll asked for; nothing is read
+)
+
+// DeadlineError is returned for an operation whose context's deadline
+// passed in Phase. It wraps ErrorDeadline and the context's error.
+type DeadlineError struct {
+	Phase string
+	Err   error // The context's error
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("%v in phase %s", e.Err, e.Phase)
+}
+
+func (e *DeadlineError) Unwrap() []error {
+	return []error{ErrorDeadline, e.Err}
+}
+
+// phaseError returns err as a DeadlineError for phase if it is the error
+// of a context whose deadline passed, unless it already names a phase, and
+// as is otherwise.
+func phaseError(phase string, err error) error {
+	var de *DeadlineError
+	if !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &de) {
+		return err
+	}
+
+	return &DeadlineError{Phase: phase, Err: err}
+}
+
+// notDurable returns the error of the events enqueued under ctx that
+// weren't flushed because ctx was done first: ErrorNotDurable, for the
+// flush phase. Those events are written all the same, so their write must
+// be applied.
+func notDurable(err error) error {
+	return fmt.Errorf("%w: %w", ErrorNotDurable, phaseError(PhaseFlush, err))
+}
+
+// logged reports whether the events whose logging returned err must be
+// applied: those logged without error, and those enqueued that ctx didn't
+// leave time to flush, for which err is ErrorNotDurable.
+func logged(err error) bool {
+	return err == nil || errors.Is(err, ErrorNotDurable)
+}
+
+// lock takes the write lock, unless the deadline of ctx passes first. It
+// then fails with a DeadlineError for PhaseLockWait, having changed
+// nothing. Locks taken for contexts without a deadline are waited for as
+// usual.
+func (s *Store) lock(ctx context.Context) error {
+	return lockBy(ctx, s.mu.TryLock, s.mu.Lock, s.mu.Unlock)
+}
+
+// rlock is lock for the read lock.
+func (s *Store) rlock(ctx context.Context) error {
+	return lockBy(ctx, s.mu.TryRLock, s.mu.RLock, s.mu.RUnlock)
+}
+
+// rlockScan is rlock for reads of more than one key, which also keep out
+// the writes of single keys, as those hold the read lock too: it takes the
+// writer lock of every shard as well, so the read sees the store as it was
+// between writes. runlockScan releases the locks.
+func (s *Store) rlockScan(ctx context.Context) error {
+	if err := s.rlock(ctx); err != nil {
+		return err
+	}
+
+	s.m.lockWriters()
+
+	return nil
+}
+
+func (s *Store) runlockScan() {
+	s.m.unlockWriters()
+	s.mu.RUnlock()
+}
+
+// keyWriteKey is the context key of the *keyWrite of the write holding
+// lockKey.
+type keyWriteKey struct{}
+
+// keyWrite is a write of a single key under lockKey, with the sequence
+// numbers of the events it logged, which count as applied once it's done.
+type keyWrite struct {
+	seqs []uint64
+}
+
+// lockKey takes the locks a write of key holds from its lookup until it's
+// applied, unless the deadline of ctx passes first, as lock does. The
+// writes of keys in different shards run at once: each holds the read
+// lock, with the writer lock of its key's shard, which orders the writes
+// of the shard's keys as the log does. A write that may change what other
+// keys share, as under quotas, eviction or a backing, or while a rename or
+// a bulk operation is under way, takes the write lock instead. Writes
+// first wait their turn in the lanes, urgent ones ahead of the rest. It
+// returns the context for the write to log its events under, and the
+// function releasing the locks.
+func (s *Store) lockKey(ctx context.Context, bucket, key string) (context.Context, func(), error) {
+	leave, err := s.lanes.enter(ctx, isUrgent(ctx), bucket, key)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		leave()
+		return ctx, nil, err
+	}
+
+	if s.usage != nil || !s.opts.Eviction.IsZero() || s.opts.Backing != nil || s.renaming != nil || len(s.batches) > 0 {
+		s.mu.RUnlock()
+
+		if err := s.lock(ctx); err != nil {
+			leave()
+			return ctx, nil, err
+		}
+
+		return ctx, func() {
+			s.mu.Unlock()
+			leave()
+		}, nil
+	}
+
+	wmu := s.m.writer(key)
+	if err := lockBy(ctx, wmu.TryLock, wmu.Lock, wmu.Unlock); err != nil {
+		s.mu.RUnlock()
+		leave()
+		return ctx, nil, err
+	}
+
+	w := &keyWrite{}
+
+	return context.WithValue(ctx, keyWriteKey{}, w), func() {
+		s.seq.done(w.seqs)
+		wmu.Unlock()
+		s.mu.RUnlock()
+		leave()
+	}, nil
+}
+
+// lockBy takes a lock with try, or failing that with lock, unless the
+// deadline of ctx passes first. A wait for a lock can't be interrupted, so
+// a wait given up goes on in the background, and unlock releases the lock
+// once it's taken. A lock taken once the deadline has passed is released,
+// so the operation gives up before it changes anything.
+func lockBy(ctx context.Context, try func() bool, lock, unlock func()) error {
+	if _, ok := ctx.Deadline(); !ok {
+		lock()
+		return nil
+	}
+
+	if !try() {
+		locked := make(chan struct{})
+		go func() {
+			lock()
+			close(locked)
+		}()
+
+		select {
+		case <-locked:
+		case <-ctx.Done():
+			go func() {
+				<-locked
+				unlock()
+			}()
+			return phaseError(PhaseLockWait, ctx.Err())
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		unlock()
+		return phaseError(PhaseLockWait, err)
+	}
+
+	return nil
+}
+
+// scanCheckInterval is how many keys a listing goes through between checks
+// of its context's deadline.
+const scanCheckInterval = 1024
+
+// scanDeadline returns a DeadlineError for PhaseScan if the deadline of ctx
+// has passed, checking it every scanCheckInterval keys, of which n have
+// been gone through.
+func scanDeadline(ctx context.Context, n int) error {
+	if n%scanCheckInterval != 0 {
+		return nil
+	}
+
+	return phaseError(PhaseScan, ctx.Err())
+}
@@ -0,0 +1,252 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The deadline given to the operations below, and how long after it they
+// may take to give up.
+const (
+	testDeadline  = 20 * time.Millisecond
+	testTolerance = 200 * time.Millisecond
+)
+
+// blockingFlushLogger is a stubLogger whose flushes wait until their
+// context is done.
+type blockingFlushLogger struct {
+	stubLogger
+}
+
+func (l *blockingFlushLogger) Flush(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// checkDeadline checks that err is a DeadlineError for phase, returned no
+// later than testTolerance after the deadline of an operation started at
+// start.
+func checkDeadline(t *testing.T, err error, phase string, start time.Time) {
+	t.Helper()
+
+	var de *DeadlineError
+	if !errors.As(err, &de) || de.Phase != phase || !errors.Is(err, ErrorDeadline) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("%v, want a deadline passing in phase %s", err, phase)
+	}
+	if d := time.Since(start); d > testDeadline+testTolerance {
+		t.Errorf("gave up after %s, for a deadline of %s", d, testDeadline)
+	}
+}
+
+// withDeadline returns a context whose deadline passes after testDeadline,
+// and the time it was made.
+func withDeadline(t *testing.T) (context.Context, time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), testDeadline)
+	t.Cleanup(cancel)
+
+	return ctx, time.Now()
+}
+
+func TestDeadlinePhases(t *testing.T) {
+	// Phases before the events are enqueued change nothing
+	t.Run(PhaseHooks, func(t *testing.T) {
+		l := &stubLogger{}
+		s := New(l, Options{HookTimeout: time.Minute})
+
+		release := make(chan struct{})
+		defer close(release)
+		s.RegisterPutHook("", func(key, value string) error {
+			<-release
+			return nil
+		})
+
+		ctx, start := withDeadline(t)
+		checkDeadline(t, s.PutCtx(ctx, "k", "v"), PhaseHooks, start)
+
+		if _, err := s.GetCtx(context.Background(), "k"); !errors.Is(err, ErrorNoSuchKey) || len(l.logged()) != 0 {
+			t.Errorf("a put given up in its hooks: %v, with %d events logged", err, len(l.logged()))
+		}
+	})
+
+	t.Run(PhaseBacking, func(t *testing.T) {
+		b := newMemBacking(BackingRecord{Bucket: DefaultBucket, Key: "k", Value: "stored"})
+		b.started, b.release = make(chan struct{}), make(chan struct{})
+		defer close(b.release)
+		s := New(b, Options{Backing: b, CoalesceReads: true})
+
+		ctx, start := withDeadline(t)
+		_, _, err := s.BucketGetWithMeta(ctx, DefaultBucket, "k")
+		checkDeadline(t, err, PhaseBacking, start)
+	})
+
+	t.Run(PhaseLockWait, func(t *testing.T) {
+		l := &stubLogger{}
+		s := New(l, Options{})
+
+		s.mu.Lock()
+		ctx, start := withDeadline(t)
+		checkDeadline(t, s.PutCtx(ctx, "k", "v"), PhaseLockWait, start)
+		s.mu.Unlock()
+
+		if len(l.logged()) != 0 {
+			t.Errorf("a put given up waiting for the lock logged %v", l.logged())
+		}
+
+		// The lock its wait took in the end is released
+		done := make(chan error)
+		go func() { done <- s.PutCtx(context.Background(), "k", "v") }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the lock taken for a put that gave up is still held")
+		}
+	})
+
+	t.Run(PhaseLogEnqueue, func(t *testing.T) {
+		// A logger whose queue is full
+		l := &stubLogger{write: func(ctx context.Context, e translog.Event) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+		s := New(l, Options{})
+
+		ctx, start := withDeadline(t)
+		checkDeadline(t, s.PutCtx(ctx, "k", "v"), PhaseLogEnqueue, start)
+
+		l.write = nil
+		if _, err := s.GetCtx(context.Background(), "k"); !errors.Is(err, ErrorNoSuchKey) || len(l.logged()) != 0 {
+			t.Errorf("a put given up enqueueing its event: %v, with %d events logged", err, len(l.logged()))
+		}
+	})
+
+	// Once the events are enqueued they are applied, and the deadline only
+	// ends the wait for them to be durable
+	t.Run(PhaseFlush, func(t *testing.T) {
+		l := &blockingFlushLogger{}
+		s := New(l, Options{StrictWrites: true})
+
+		ctx, start := withDeadline(t)
+		err := s.PutCtx(ctx, "k", "v")
+		checkDeadline(t, err, PhaseFlush, start)
+		if !errors.Is(err, ErrorNotDurable) {
+			t.Errorf("%v, want it not durable", err)
+		}
+
+		if v, err := s.GetCtx(context.Background(), "k"); err != nil || v != "v" || len(l.logged()) != 1 {
+			t.Errorf("a put given up waiting for durability: %q, %v, with %d events logged", v, err, len(l.logged()))
+		}
+	})
+
+	t.Run(PhaseScan, func(t *testing.T) {
+		s := New(&stubLogger{}, Options{})
+		for i := range 3 * scanCheckInterval {
+			if err := s.PutCtx(context.Background(), fmt.Sprintf("k%d", i), "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A write holding a shard keeps the scan from starting until past
+		// its deadline
+		wmu := s.m.writer("k0")
+		wmu.Lock()
+		time.AfterFunc(2*testDeadline, wmu.Unlock)
+
+		ctx, start := withDeadline(t)
+		keys, err := s.BucketKeys(ctx, DefaultBucket, "")
+		checkDeadline(t, err, PhaseScan, start)
+		if keys != nil {
+			t.Errorf("a scan given up returned %d keys", len(keys))
+		}
+	})
+}
+
+func TestDeadlineDoesntSplitWrites(t *testing.T) {
+	// A transaction is given up before its first event is enqueued, or not
+	// at all
+	for _, tt := range []struct {
+		name    string
+		write   func(ctx context.Context, e translog.Event) error
+		applied bool
+	}{
+		{"passing before the first event", func(ctx context.Context, e translog.Event) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, false},
+		{"passing while the events are enqueued", func(ctx context.Context, e translog.Event) error {
+			time.Sleep(testDeadline)
+			return nil
+		}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &stubLogger{write: tt.write}
+			s := New(l, Options{})
+
+			ctx, start := withDeadline(t)
+			_, err := s.Txn(ctx, Txn{Then: []TxnOp{
+				{Type: TxnPut, Key: "a", Value: "1"},
+				{Type: TxnPut, Key: "b", Value: "2"},
+				{Type: TxnPut, Key: "c", Value: "3"},
+			}})
+
+			if !tt.applied {
+				checkDeadline(t, err, PhaseLogEnqueue, start)
+			} else if err != nil {
+				t.Errorf("a transaction whose events were all enqueued: %v", err)
+			}
+
+			var applied int
+			for _, key := range []string{"a", "b", "c"} {
+				if _, err := s.GetCtx(context.Background(), key); err == nil {
+					applied++
+				}
+			}
+			want := map[bool]int{true: 3, false: 0}[tt.applied]
+			if applied != want || len(l.logged()) != want {
+				t.Errorf("%d puts applied and %d logged, want %d", applied, len(l.logged()), want)
+			}
+		})
+	}
+
+	// A deletion by prefix stops at the event it couldn't enqueue, with
+	// those before it applied
+	t.Run("deletion by prefix", func(t *testing.T) {
+		l := &stubLogger{}
+		s := New(l, Options{})
+		for i := range 10 {
+			if err := s.PutCtx(context.Background(), fmt.Sprintf("k%d", i), "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		puts := len(l.logged())
+
+		var deletes atomic.Int64
+		l.write = func(ctx context.Context, e translog.Event) error {
+			if deletes.Add(1) > 4 {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		ctx, start := withDeadline(t)
+		n, err := s.DeleteByPrefix(ctx, "k")
+		checkDeadline(t, err, PhaseLogEnqueue, start)
+
+		l.write = nil
+		keys, _, err := s.Keys(context.Background(), "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if logged := len(l.logged()) - puts; n != 4 || logged != 4 || len(keys) != 6 {
+			t.Errorf("%d deleted, %d deletes logged and %d keys left, want 4, 4 and 6", n, logged, len(keys))
+		}
+	})
+}
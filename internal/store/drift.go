@@ -0,0 +1,315 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// DefaultDriftWindow is how much of the end of the log a drift sample
+// reads by default.
+const DefaultDriftWindow = 4 << 20
+
+var driftSampledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kv_drift_sampled_total",
+	Help: "Number of keys compared by the drift sampler, by where they were picked: store or log.",
+}, []string{"side"})
+
+var driftUnverifiedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kv_drift_unverified_total",
+	Help: "Number of keys picked from the store by the drift sampler that weren't written within the end of the log it read, so couldn't be compared.",
+})
+
+var driftMismatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kv_drift_mismatches_total",
+	Help: "Number of sampled keys on which the store and its log disagree, by kind: differs, missing or extra.",
+}, []string{"kind"})
+
+var driftLastCleanPass = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "kv_drift_last_clean_pass_timestamp_seconds",
+	Help: "Time of the last drift sample that found no mismatch, in seconds since the epoch; 0 if none has.",
+})
+
+var driftSuspected = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "kv_drift_suspected",
+	Help: "1 if the drift sampler found enough mismatches since the last clean fsck to suspect the store has drifted from its log, 0 otherwise.",
+})
+
+// DriftCollectors returns the drift sampler's metrics, for the metrics
+// registry.
+func DriftCollectors() []prometheus.Collector {
+	return []prometheus.Collector{driftSampledTotal, driftUnverifiedTotal, driftMismatchesTotal, driftLastCleanPass, driftSuspected}
+}
+
+// DriftSample is the outcome of SampleDrift.
+type DriftSample struct {
+	Sequence    uint64       // Last event the sample covers
+	StoreKeys   int          // Keys picked from the store
+	LogRecords  int          // Records picked from the log
+	Unverified  int          // Keys picked from the store without a record in the window
+	Divergences []Divergence // Sampled keys on which the store and the log disagree
+}
+
+// SampleDrift spot-checks the store against the end of its file log at
+// path, as a cheap, partial fsck: it picks n keys of the store, at random,
+// and n of the records in the last window bytes of the log, or
+// DefaultDriftWindow if window isn't positive, and compares
+// each key's value with the last record the window holds for it. Keys of the
+// store the window has no record for are older than it, and left
+// unverified. Only values are compared, as by Check.
+//
+// Writes are held off while the log is flushed and its window read, so that
+// the two sides are compared at the same sequence; reads go on.
+func (s *Store) SampleDrift(ctx context.Context, path string, n int, window int64) (DriftSample, error) {
+	var sample DriftSample
+
+	if s.opts.Backing != nil {
+		return sample, errors.New("the store has no transaction log to check")
+	}
+
+	if window <= 0 {
+		window = DefaultDriftWindow
+	}
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	defer s.runlockScan()
+
+	sample.Sequence = s.seq.load()
+
+	// Every event up to the sequence must be in the file to be compared
+	if err := s.logger.Flush(ctx); err != nil {
+		return sample, err
+	}
+
+	events, err := translog.ReadLogTail(path, window)
+	if err != nil {
+		return sample, err
+	}
+
+	last := make(map[watchKey]translog.Event)
+	dropped := make(map[string]uint64) // Sequence of the last drop or rename away of each bucket
+	renamed := make(map[string]uint64) // Sequence of the last rename into each bucket
+	var records []translog.Event
+
+	for _, e := range events {
+		if e.Sequence > sample.Sequence {
+			break // Logged since, by a write that was under way
+		}
+
+		switch e.EventType {
+		case translog.EventPut, translog.EventDelete, translog.EventEvict:
+			last[watchKey{e.Bucket, e.Key}] = e
+			records = append(records, e)
+		case translog.EventDropBucket:
+			dropped[e.Bucket] = e.Sequence
+		case translog.EventRenameBucket:
+			// The keys the bucket held then move, as if put anew in
+			// the other bucket
+			var moved []translog.Event
+			for k, put := range last {
+				if k.bucket == e.Bucket && put.EventType == translog.EventPut && put.Sequence > dropped[e.Bucket] {
+					put.Bucket, put.Sequence = e.Value, e.Sequence
+					moved = append(moved, put)
+				}
+			}
+			for _, put := range moved {
+				last[watchKey{put.Bucket, put.Key}] = put
+			}
+
+			dropped[e.Bucket] = e.Sequence
+			renamed[e.Value] = e.Sequence
+		}
+	}
+
+	// want returns what the window says k holds, and false if it doesn't
+	// say
+	want := func(k watchKey) (e translog.Event, deleted, ok bool) {
+		e, ok = last[k]
+		drop, rename := dropped[k.bucket], renamed[k.bucket]
+
+		switch {
+		case ok && e.Sequence >= max(drop, rename):
+		case drop > rename:
+			return e, true, true
+		case rename != 0:
+			// The bucket renamed into it may have held the key since
+			// before the window
+			return e, false, false
+		}
+
+		return e, e.EventType == translog.EventDelete || e.EventType == translog.EventEvict, ok
+	}
+
+	// A key picked from both sides is compared once
+	checked := make(map[watchKey]bool)
+
+	check := func(k watchKey) {
+		if checked[k] {
+			return
+		}
+		checked[k] = true
+
+		e, deleted, ok := want(k)
+		if !ok {
+			sample.Unverified++
+			return
+		}
+
+		got, exists := s.lookup(k.bucket, k.key)
+
+		var kind string
+		switch {
+		case deleted && exists:
+			kind = DivergenceExtra
+		case !deleted && !exists:
+			kind = DivergenceMissing
+		case !deleted && !sameStored(got, entry{value: e.Value, codec: e.Codec}):
+			kind = DivergenceDiffers
+		default:
+			return
+		}
+
+		sample.Divergences = append(sample.Divergences, Divergence{k.bucket, k.key, kind})
+	}
+
+	// Map iteration starts at random, so the first keys met are a random
+	// pick, if not a uniform one; each bucket gets its share
+	buckets := s.m.buckets()
+	perBucket := max(n/max(len(buckets), 1), 1)
+
+	for _, bucket := range buckets {
+		taken := 0
+
+		for key := range s.m.bucket(bucket) {
+			if taken == perBucket || sample.StoreKeys == n {
+				break
+			}
+
+			taken++
+			sample.StoreKeys++
+			check(watchKey{bucket, key})
+		}
+	}
+
+	for _, i := range rand.Perm(len(records))[:min(n, len(records))] {
+		sample.LogRecords++
+		check(watchKey{records[i].Bucket, records[i].Key})
+	}
+
+	return sample, nil
+}
+
+// DriftSampler runs SampleDrift periodically, and suspects the store has
+// drifted from its log once enough mismatches are found, until a check of
+// the whole store, such as fsck, clears it with ClearSuspicion.
+type DriftSampler struct {
+	store     *Store
+	path      string
+	n         int
+	window    int64
+	threshold int
+
+	mu         sync.Mutex
+	mismatches int // Since the suspicion was last cleared
+	lastClean  time.Time
+	lastErr    error
+}
+
+// DriftStatus describes what a DriftSampler found.
+type DriftStatus struct {
+	Suspected  bool      `json:"suspected"`
+	Mismatches int       `json:"mismatches"` // Since the suspicion was last cleared
+	LastClean  time.Time `json:"last_clean,omitzero"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// NewDriftSampler returns a sampler of n keys each of the store and of the
+// last window bytes of its file log at path, as by SampleDrift, which
+// suspects drift once threshold mismatches are found.
+func NewDriftSampler(st *Store, path string, n int, window int64, threshold int) *DriftSampler {
+	return &DriftSampler{store: st, path: path, n: n, window: window, threshold: max(threshold, 1)}
+}
+
+// Run samples every interval until ctx is done.
+func (d *DriftSampler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Sample(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sample takes a single sample, and records what it found.
+func (d *DriftSampler) Sample(ctx context.Context) {
+	sample, err := d.store.SampleDrift(ctx, d.path, d.n, d.window)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastErr = err
+	if err != nil {
+		log.Printf("drift sample failed: %v\n", err)
+		return
+	}
+
+	driftSampledTotal.WithLabelValues("store").Add(float64(sample.StoreKeys))
+	driftSampledTotal.WithLabelValues("log").Add(float64(sample.LogRecords))
+	driftUnverifiedTotal.Add(float64(sample.Unverified))
+
+	if len(sample.Divergences) == 0 {
+		d.lastClean = time.Now()
+		driftLastCleanPass.Set(float64(d.lastClean.Unix()))
+		return
+	}
+
+	for _, div := range sample.Divergences {
+		driftMismatchesTotal.WithLabelValues(div.Kind).Inc()
+		log.Printf("DRIFT sequence=%d bucket=%s key=%q kind=%s\n", sample.Sequence, div.Bucket, div.Key, div.Kind)
+	}
+
+	d.mismatches += len(sample.Divergences)
+	if d.suspected() {
+		driftSuspected.Set(1)
+	}
+}
+
+// suspected reports whether enough mismatches were found to suspect drift.
+// The caller must hold mu.
+func (d *DriftSampler) suspected() bool {
+	return d.mismatches >= d.threshold
+}
+
+// ClearSuspicion forgets the mismatches found so far, once a check of the
+// whole store found it matches its log, or repaired it.
+func (d *DriftSampler) ClearSuspicion() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.mismatches = 0
+	driftSuspected.Set(0)
+}
+
+// Status returns what the sampler found.
+func (d *DriftSampler) Status() DriftStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := DriftStatus{Suspected: d.suspected(), Mismatches: d.mismatches, LastClean: d.lastClean}
+	if d.lastErr != nil {
+		st.LastError = d.lastErr.Error()
+	}
+
+	return st
+}
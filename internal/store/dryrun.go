@@ -0,0 +1,48 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// dryRunKey is the context key marking the writes made under a context as
+// dry runs.
+type dryRunKey struct{}
+
+// WithDryRun returns a context under which writes are dry runs: they go
+// through every check a write does, in the same order, and fail as the
+// write would, on read-only mode, leases, quotas, put hooks and the
+// conditions of compare-and-swap and updates, but once every check has
+// passed they neither log an event nor change the store. A dry run reports
+// what the write would have: the keys it would delete, the value an
+// increment or update would store, and the metadata it would be stored
+// with. It records no sequence, for WithSequence, as nothing was logged.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun reports whether writes made under ctx are dry runs.
+func IsDryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunKey{}).(bool)
+	return dry
+}
+
+// dryRunMeta returns the metadata key would have once a put of it were
+// applied, as set and noteOriginal would give it, from old, its entry if it
+// exists. The caller must hold the write lock.
+func dryRunMeta(old entry, exists bool, key, original string) ValueMeta {
+	meta := old.meta
+	now := time.Now()
+
+	if !exists {
+		meta = ValueMeta{Created: now}
+		if original != key {
+			meta.OriginalKey = original
+		}
+	}
+
+	meta.Version++
+	meta.Modified = now
+
+	return meta
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorNotDurable is returned by Flush when it gives up waiting. The writes
+// it waited for are applied, and become durable all the same once the
+// logger gets to them.
+var ErrorNotDurable = errors.New("write applied but not yet durable")
+
+// Durability is how durable a write is once acknowledged. The zero
+// Durability is unset, and stands for DurabilityEnqueue.
+type Durability int
+
+const (
+	DurabilityNone    Durability = iota + 1 // Applied to memory only, never logged
+	DurabilityEnqueue                       // Logged, and durable at the logger's next flush
+	DurabilityFlush                         // Logged, and durable, as Flush waits for it
+)
+
+// ParseDurability returns the Durability named none, enqueue or flush.
+func ParseDurability(name string) (Durability, error) {
+	switch name {
+	case "none":
+		return DurabilityNone, nil
+	case "enqueue":
+		return DurabilityEnqueue, nil
+	case "flush":
+		return DurabilityFlush, nil
+	default:
+		return 0, fmt.Errorf("unknown durability %q: must be none, enqueue or flush", name)
+	}
+}
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case 0, DurabilityEnqueue:
+		return "enqueue"
+	case DurabilityFlush:
+		return "flush"
+	default:
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+}
+
+// MarshalText names d as ParseDurability reads it.
+func (d Durability) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText sets d to the Durability named by text.
+func (d *Durability) UnmarshalText(text []byte) error {
+	parsed, err := ParseDurability(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = parsed
+	return nil
+}
+
+// durabilityKey is the context key of the durability of writes.
+type durabilityKey struct{}
+
+// WithDurability returns a context under which writes are made with
+// durability d. Under DurabilityNone, puts and deletes skip the log: they
+// are lost on restart, never replicated, and with a backing, only kept
+// until the cache is reloaded. The store doesn't wait under
+// DurabilityFlush; the caller does, with Flush, once the write is applied.
+func WithDurability(ctx context.Context, d Durability) context.Context {
+	return context.WithValue(ctx, durabilityKey{}, d)
+}
+
+// unlogged reports whether the writes made under ctx skip the log.
+func unlogged(ctx context.Context) bool {
+	d, _ := ctx.Value(durabilityKey{}).(Durability)
+	return d == DurabilityNone
+}
+
+// Flush waits for the writes applied so far to be durable, and returns the
+// first failure to persist one of them. If ctx is done first, it gives up
+// with ErrorNotDurable, wrapping the context's error, as a DeadlineError for
+// PhaseFlush if its deadline passed; the logger goes on flushing all the
+// same.
+func (s *Store) Flush(ctx context.Context) error {
+	flushed := make(chan error, 1)
+	go func() { flushed <- s.logger.Flush(context.WithoutCancel(ctx)) }()
+
+	select {
+	case err := <-flushed:
+		return err
+	case <-ctx.Done():
+		return notDurable(ctx.Err())
+	}
+}
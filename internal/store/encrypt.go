@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"sort"
+)
+
+// VerifyEncryption decrypts every encrypted value loaded, so that a store
+// opened with the wrong keys, or with none, fails at startup rather than on
+// reads. Keys a backing holds but hasn't yet cached aren't checked.
+func (s *Store) VerifyEncryption() error {
+	s.mu.RLock()
+	s.m.lockWriters()
+	defer s.runlockScan()
+
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			if !e.codec.IsEncrypted() {
+				continue
+			}
+
+			if _, err := s.decode(e); err != nil {
+				return fmt.Errorf("key %q in bucket %q: %w", key, bucket, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reencrypt rewrites every value that isn't encrypted with the cipher's
+// current key, including values stored before encryption was enabled, and
+// returns the number rewritten. Each rewrite is logged as a put of the same
+// value, but keeps the key's metadata, since the client's value is
+// unchanged. Keys are rewritten one at a time, so other requests proceed
+// meanwhile.
+func (s *Store) Reencrypt(ctx context.Context) (n int, err error) {
+	if s.opts.Cipher == nil {
+		return 0, fmt.Errorf("encryption is not configured")
+	}
+
+	if err := s.loadAll(ctx); err != nil {
+		return 0, err
+	}
+
+	type stale struct{ bucket, key string }
+	var keys []stale
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			if !s.sealedCurrent(e) {
+				keys = append(keys, stale{bucket, key})
+			}
+		}
+	}
+	s.runlockScan()
+
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		rewritten, err := s.reencryptKey(ctx, k.bucket, k.key)
+		if err != nil {
+			return n, err
+		}
+		if rewritten {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// reencryptKey rewrites the value of key with the cipher's current key if it
+// isn't encrypted with it already, and reports whether it did.
+func (s *Store) reencryptKey(ctx context.Context, bucket, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return false, ErrorReadOnly
+	}
+
+	// The key may have been deleted or rewritten since the scan
+	e, ok := s.lookup(bucket, key)
+	if !ok || s.sealedCurrent(e) {
+		return false, nil
+	}
+
+	value, err := s.decode(e)
+	if err != nil {
+		return false, fmt.Errorf("key %q in bucket %q: %w", key, bucket, err)
+	}
+
+	stored, codec, err := s.encode(value)
+	if err != nil {
+		return false, err
+	}
+
+	ev := translog.Event{EventType: translog.EventPut, Bucket: bucket, Key: key, Value: stored, Codec: codec}
+	err = s.log(ctx, ev)
+	if !logged(err) {
+		return false, err
+	}
+
+	old := e
+	e.value, e.page, e.codec = stored, nil, codec
+	s.m.set(bucket, key, e)
+	s.epoch.Add(1)
+	s.accountChange(bucket, key, &old, &e)
+
+	return true, err
+}
+
+// sealedCurrent reports whether the value of e is encrypted with the
+// cipher's current key. A value in the blob directory is read back to tell.
+func (s *Store) sealedCurrent(e entry) bool {
+	if !e.codec.IsEncrypted() {
+		return false
+	}
+
+	value, err := e.stored()
+	if err != nil {
+		return false
+	}
+
+	stored, _, err := s.inline(value, e.codec)
+
+	return err == nil && s.opts.Cipher.Current(stored)
+}
+
+// StoredRecord is a key and its value as stored, which is encrypted if
+// encryption is configured, as exported by DumpStored.
+type StoredRecord struct {
+	Bucket string         `json:"bucket"`
+	Key    string         `json:"key"`
+	Value  []byte         `json:"value"`
+	Codec  compress.Codec `json:"codec,omitempty"`
+}
+
+// DumpStored is like Dump, but returns the values as stored rather than as
+// written by clients, though read back from the blob directory.
+func (s *Store) DumpStored() ([]StoredRecord, error) {
+	if err := s.loadAll(context.Background()); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	var records []StoredRecord
+	var pages []*pageRef // Of the records, which are paged in once the lock is released
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			records = append(records, StoredRecord{Bucket: bucket, Key: key, Value: []byte(e.value), Codec: e.codec})
+			pages = append(pages, e.page)
+		}
+	}
+	s.runlockScan()
+
+	for i, page := range pages {
+		if page == nil {
+			continue
+		}
+
+		value, err := page.read()
+		if err != nil {
+			return nil, err
+		}
+		records[i].Value = []byte(value)
+	}
+
+	// Values in the blob directory are read back, so the dump stands alone
+	for i, r := range records {
+		value, codec, err := s.inline(string(r.Value), r.Codec)
+		if err != nil {
+			return nil, blobError(r.Bucket, r.Key, err)
+		}
+		records[i].Value, records[i].Codec = []byte(value), codec
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Bucket != records[j].Bucket {
+			return records[i].Bucket < records[j].Bucket
+		}
+		return records[i].Key < records[j].Key
+	})
+
+	return records, nil
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"time"
+)
+
+var evictionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kv_evictions_total",
+	Help: "Number of keys evicted to keep the store within its eviction limits.",
+})
+
+// EvictionCollectors returns the eviction counter, for the metrics registry.
+func EvictionCollectors() []prometheus.Collector {
+	return []prometheus.Collector{evictionsTotal}
+}
+
+// overEviction reports whether the store holds more keys or bytes than
+// Options.Eviction allows. The caller must hold the lock.
+func (s *Store) overEviction() bool {
+	limit := s.opts.Eviction
+
+	if limit.MaxKeys > 0 && s.keys.Load() > int64(limit.MaxKeys) {
+		return true
+	}
+
+	return limit.MaxBytes > 0 && s.m.bytes() > limit.MaxBytes
+}
+
+// evict deletes the keys used longest ago while the store is past
+// Options.Eviction, logging an eviction for each, so that replay and
+// replicas delete them too. Keys used after the time since, as
+// shardedMap.now counts it, such as those of the write that called it,
+// are kept, as are write-once keys and keys leased to anyone:
+// the store may then stay past its limits. A failure to log an eviction
+// stops them, and is only logged, since the write that called it already
+// stands. The caller must hold the write lock.
+func (s *Store) evict(ctx context.Context, since int64) {
+	if s.opts.Eviction.IsZero() {
+		return
+	}
+
+	// The write is applied, so its evictions are made even if it's canceled
+	ctx = context.WithoutCancel(ctx)
+	now := time.Now()
+
+	for s.overEviction() {
+		k, ok := s.m.leastRecent(since)
+		if !ok {
+			return
+		}
+
+		if e, _ := s.m.get(k.bucket, k.key); e.meta.Immutable || e.lease.live(now) {
+			s.m.touch(k.bucket, k.key) // Passed over until a later eviction
+			continue
+		}
+
+		err := s.enqueue(ctx, translog.Event{EventType: translog.EventEvict, Bucket: k.bucket, Key: k.key})
+		if !logged(err) {
+			log.Printf("eviction failed: %v\n", err)
+			return
+		}
+
+		s.remove(k.bucket, k.key)
+		evictionsTotal.Inc()
+	}
+}
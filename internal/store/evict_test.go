@@ -0,0 +1,233 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// size returns the keys and bytes the store counts against
+// Options.Eviction.
+func size(s *Store) (keys, bytes int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.keys.Load(), s.m.bytes()
+}
+
+// checkKeys checks that the keys of bucket are want.
+func checkKeys(t *testing.T, s *Store, bucket, want, when string) {
+	t.Helper()
+
+	keys, err := s.BucketKeys(context.Background(), bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != want {
+		t.Errorf("%s: keys %v, want %s", when, keys, want)
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{Eviction: Quota{MaxKeys: 3}})
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.PutCtx(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkKeys(t, s, DefaultBucket, "[a b c]", "at the limit")
+
+	// A read marks a key used, as does a write
+	if _, err := s.GetCtx(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "d", "v"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, s, DefaultBucket, "[a c d]", "after a was read and d put")
+
+	if err := s.PutCtx(ctx, "c", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "e", "v"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, s, DefaultBucket, "[c d e]", "after c was written and e put")
+
+	// Each write evicts as many keys as it takes
+	if err := s.PutMany(ctx, map[string]string{"f": "v", "g": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, s, DefaultBucket, "[e f g]", "after f and g were put at once")
+	closeLog()
+
+	// Evictions are logged, so that replay deletes the keys without the cap
+	var evicted []string
+	for _, e := range loggedEvents(t, dir) {
+		if strings.HasPrefix(e, fmt.Sprint(translog.EventEvict, " ")) {
+			evicted = append(evicted, e)
+		}
+	}
+	want := []string{"b", "a", "d", "c"}
+	for i, key := range want {
+		want[i] = fmt.Sprintf("%d %s/%s", translog.EventEvict, DefaultBucket, key)
+	}
+	if !slices.Equal(evicted, want) {
+		t.Errorf("logged evictions %v, want %v", evicted, want)
+	}
+
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	checkKeys(t, s, DefaultBucket, "[e f g]", "replayed without the cap")
+	if v, err := s.GetCtx(ctx, "e"); err != nil || v != "v" {
+		t.Errorf("e replayed: %q, %v", v, err)
+	}
+}
+
+func TestEvictionToOneKey(t *testing.T) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(t, t.TempDir(), Options{Eviction: Quota{MaxKeys: 1}})
+	defer closeLog()
+
+	// The key used last before a write is evicted by it too
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.PutCtx(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+		checkKeys(t, s, DefaultBucket, fmt.Sprintf("[%s]", key), "after "+key+" was put")
+	}
+}
+
+func TestEvictionSkipsWriteOnceAndLeasedKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{Eviction: Quota{MaxKeys: 2}})
+
+	if err := s.PutCtx(WithImmutable(ctx), "once", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "leased", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.AcquireLease(ctx, "leased", "owner", 200*time.Millisecond); err != nil || !ok {
+		t.Fatalf("lease: %t, %v", ok, err)
+	}
+
+	// With nothing else to evict, the store stays past its limit
+	if err := s.PutCtx(ctx, "a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, s, DefaultBucket, "[a leased once]", "after a was put")
+
+	// The keys passed over count as used, so a is evicted before them
+	if err := s.PutCtx(ctx, "b", "v"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, s, DefaultBucket, "[b leased once]", "after b was put")
+
+	// Once its lease expires, a key is evicted like any other
+	time.Sleep(250 * time.Millisecond)
+	if err := s.PutCtx(ctx, "c", "v"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, s, DefaultBucket, "[c once]", "after the lease expired and c was put")
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	checkKeys(t, s, DefaultBucket, "[c once]", "replayed without the cap")
+	if _, meta, err := s.GetWithMetaCtx(ctx, "once"); err != nil || !meta.Immutable {
+		t.Errorf("once replayed: %+v, %v, want it write-once", meta, err)
+	}
+}
+
+func TestEvictionBytes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{Eviction: Quota{MaxBytes: 30}}
+
+	s, closeLog := openLogged(t, dir, opts)
+
+	// check checks the keys and bytes of the store, a key and its value
+	// counting for their lengths
+	check := func(t *testing.T, s *Store, keys, bytes int64, when string) {
+		t.Helper()
+
+		if k, b := size(s); k != keys || b != bytes {
+			t.Errorf("%s: %d keys of %d bytes, want %d of %d", when, k, b, keys, bytes)
+		}
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := s.BucketPut(ctx, "src", key, "12345"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BucketPut(ctx, "dst", "b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, s, 3, 14, "after the puts")
+
+	// A merge counts the keys it replaces no longer, a rename those it
+	// moves once
+	if _, err := s.RenameBucket(ctx, "src", "dst", true); err != nil {
+		t.Fatal(err)
+	}
+	check(t, s, 2, 12, "after src was merged into dst")
+
+	if _, err := s.RenameBucket(ctx, "dst", "moved", false); err != nil {
+		t.Fatal(err)
+	}
+	check(t, s, 2, 12, "after dst was renamed")
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, opts)
+	defer closeLog()
+
+	check(t, s, 2, 12, "after a restart")
+	checkKeys(t, s, "moved", "[a b]", "after a restart")
+
+	// A restore counts the keys of the snapshot alone
+	var snap bytes.Buffer
+	if err := s.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(&stubLogger{}, opts)
+	if err := r.BucketPut(ctx, "moved", "c", "12345"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, 1, 6, "before the restore")
+
+	if err := r.Restore(&snap); err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, 2, 12, "after the restore")
+
+	// So the cap is reached when the restored keys and new ones reach it
+	if err := r.BucketPut(ctx, "moved", "x", strings.Repeat("v", 18)); err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, 2, 25, "after x was put")
+
+	if err := r.BucketPut(ctx, "moved", "y", "1"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, 3, 27, "after y was put")
+	if _, _, err := r.BucketGetWithMeta(ctx, "moved", "x"); err != nil {
+		t.Errorf("the key written since the restore: %v", err)
+	}
+}
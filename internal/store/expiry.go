@@ -0,0 +1,171 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"sort"
+	"time"
+)
+
+// ttlKey is the context key of the time to live of the keys put.
+type ttlKey struct{}
+
+// WithTTL returns a context under which puts make the key they write expire
+// ttl after the put; a ttl of 0 or less sets none. The deadline is logged
+// as an event right after the put, and flushed with it, so it survives a
+// restart and is replicated as the put is.
+//
+// A key is gone for reads and writes as soon as it expires, though it may
+// still be counted by quotas and statistics until RunExpiry deletes it,
+// with an ordinary delete event. Any later write of the key without a TTL,
+// an increment or a transaction included, makes it permanent again, and a
+// put under WithTTL sets it a new deadline. An expired key is deleted even
+// if it's write-once or leased: it's gone already.
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey{}, ttl)
+}
+
+// ttlOf returns the time to live of the keys put under ctx, or 0 if they
+// live forever.
+func ttlOf(ctx context.Context) time.Duration {
+	ttl, _ := ctx.Value(ttlKey{}).(time.Duration)
+	return max(ttl, 0)
+}
+
+// expired reports whether the key of m has expired at now.
+func (m ValueMeta) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// applyExpire sets the deadline of an expiry event on its key, if it has an
+// entry, leaving its value and the rest of its metadata as they are. A
+// deadline passed since is set all the same, so that replay hides the key.
+// The caller must hold the write lock, or the lock of a write of its key.
+func (s *Store) applyExpire(e translog.Event) error {
+	deadline, err := translog.ParseExpiry(e.Value)
+	if err != nil {
+		return fmt.Errorf("key %q in bucket %q: %w", e.Key, e.Bucket, err)
+	}
+
+	x, ok := s.m.get(e.Bucket, e.Key)
+	if !ok {
+		return nil
+	}
+
+	x.meta.Expires = deadline
+	s.m.set(e.Bucket, e.Key, x)
+	s.epoch.Add(1)
+	s.renaming.touch(e.Bucket, e.Key)
+
+	return nil
+}
+
+// expiring is a key found expired by a sweep, with its deadline.
+type expiring struct {
+	bucket, key string
+	deadline    time.Time
+}
+
+// Expire deletes the keys expired at now, and returns how many it deleted.
+// Each deletion is logged as an ordinary delete event, so replicas and
+// replay see it, and takes the write lock on its own, so that a large
+// sweep doesn't hold up other requests. A key written again since the scan
+// is kept.
+func (s *Store) Expire(ctx context.Context, now time.Time) (int, error) {
+	// Deadlines of keys held only by the backing are known once they're
+	// cached
+	if err := s.loadAll(ctx); err != nil {
+		return 0, err
+	}
+
+	var expired []expiring
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			if e.meta.expired(now) {
+				expired = append(expired, expiring{bucket, key, e.meta.Expires})
+			}
+		}
+	}
+	s.runlockScan()
+
+	// Oldest first, so that a sweep cut short frees the longest expired
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].deadline.Before(expired[j].deadline)
+	})
+
+	n := 0
+
+	for _, x := range expired {
+		deleted, err := s.deleteExpired(ctx, x.bucket, x.key, x.deadline)
+		if deleted {
+			n++
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// deleteExpired logs and applies the deletion of key if it still expires
+// at deadline, and reports whether it did.
+func (s *Store) deleteExpired(ctx context.Context, bucket, key string, deadline time.Time) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return false, ErrorReadOnly
+	}
+
+	// Looked up directly, as lookup hides the key now that it's expired
+	if e, ok := s.m.get(bucket, key); !ok || !e.meta.Expires.Equal(deadline) {
+		return false, nil
+	}
+
+	e := translog.Event{EventType: translog.EventDelete, Bucket: bucket, Key: key}
+	err := s.log(ctx, e)
+	if !logged(err) {
+		return false, err
+	}
+
+	s.remove(bucket, key)
+
+	return true, err
+}
+
+// RunExpiry deletes the keys of st that expired, every interval until ctx
+// is done. Sweeps are skipped while the store is read-only, as when
+// following a leader, whose own deletions are replicated instead; the
+// expired keys are hidden in the meantime.
+func RunExpiry(ctx context.Context, st *Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if on, _ := st.ReadOnly(); on {
+			continue
+		}
+
+		n, err := st.Expire(ctx, time.Now())
+		if n > 0 {
+			log.Printf("expiry: deleted %d expired keys\n", n)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("expiry sweep stopped: %v\n", err)
+		}
+	}
+}
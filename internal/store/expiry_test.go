@@ -0,0 +1,201 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// loggedEvents returns the type, bucket and key of each event logged in
+// dir, once its logger is closed.
+func loggedEvents(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var events []string
+	err := translog.ScanLog(filepath.Join(dir, translog.LogFileName), func(e translog.Event) error {
+		events = append(events, fmt.Sprintf("%d %s/%s", e.EventType, e.Bucket, e.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+func TestExpiredKeysAreHiddenThenDeleted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+
+	if err := s.PutCtx(WithTTL(ctx, time.Millisecond), "short", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(WithTTL(ctx, time.Hour), "long", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "forever", "v"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Before any sweep, the expired key is gone for reads
+	if _, err := s.GetCtx(ctx, "short"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("GET of an expired key: %v, want ErrorNoSuchKey", err)
+	}
+	if keys, err := s.BucketKeys(ctx, DefaultBucket, ""); err != nil || fmt.Sprint(keys) != "[forever long]" {
+		t.Errorf("keys before the sweep: %v, %v", keys, err)
+	}
+	if _, meta, err := s.GetWithMetaCtx(ctx, "long"); err != nil || meta.Expires.IsZero() {
+		t.Errorf("the key expiring in an hour: %+v, %v", meta, err)
+	}
+
+	// A sweep deletes it with a delete event
+	if n, err := s.Expire(ctx, time.Now()); err != nil || n != 1 {
+		t.Errorf("the sweep deleted %d keys, %v, want 1", n, err)
+	}
+	if n, err := s.Expire(ctx, time.Now()); err != nil || n != 0 {
+		t.Errorf("a second sweep deleted %d keys, %v, want none", n, err)
+	}
+	closeLog()
+
+	events := loggedEvents(t, dir)
+	deleted := fmt.Sprintf("%d %s/short", translog.EventDelete, DefaultBucket)
+	if events[len(events)-1] != deleted {
+		t.Errorf("logged %v, want the sweep's delete of short last", events)
+	}
+
+	// The deadline of the other survives replay, and a sweep once it's
+	// passed deletes it
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	_, meta, err := s.GetWithMetaCtx(ctx, "long")
+	if err != nil || meta.Expires.Before(time.Now().Add(59*time.Minute)) || meta.Expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("after a restart, the key expiring in an hour: %+v, %v", meta, err)
+	}
+	if n, err := s.Expire(ctx, time.Now().Add(2*time.Hour)); err != nil || n != 1 {
+		t.Errorf("a sweep two hours on deleted %d keys, %v, want 1", n, err)
+	}
+	if keys, err := s.BucketKeys(ctx, DefaultBucket, ""); err != nil || fmt.Sprint(keys) != "[forever]" {
+		t.Errorf("keys after the sweep: %v, %v", keys, err)
+	}
+}
+
+func TestExpiryReplaysAPassedDeadline(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+	if err := s.PutCtx(WithTTL(ctx, 5*time.Millisecond), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+	time.Sleep(10 * time.Millisecond)
+
+	// Replay sets the deadline though it has passed, which hides the key
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if _, err := s.GetCtx(ctx, "k"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("GET of a key that expired while the store was down: %v, want ErrorNoSuchKey", err)
+	}
+	if n, err := s.Expire(ctx, time.Now()); err != nil || n != 1 {
+		t.Errorf("the sweep deleted %d keys, %v, want 1", n, err)
+	}
+}
+
+func TestExpiryKeepsKeysWrittenSinceTheScan(t *testing.T) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(t, t.TempDir(), Options{})
+	defer closeLog()
+
+	for _, key := range []string{"rewritten", "renewed", "deleted"} {
+		if err := s.PutCtx(WithTTL(ctx, time.Hour), key, "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadlines := make(map[string]time.Time)
+	for _, key := range []string{"rewritten", "renewed", "deleted"} {
+		_, meta, err := s.GetWithMetaCtx(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadlines[key] = meta.Expires
+	}
+
+	// The keys change between a sweep's scan and its deletions
+	if err := s.PutCtx(ctx, "rewritten", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(WithTTL(ctx, 2*time.Hour), "renewed", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteCtx(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, deadline := range deadlines {
+		if deleted, err := s.deleteExpired(ctx, DefaultBucket, key, deadline); err != nil || deleted {
+			t.Errorf("%s deleted by a sweep that scanned it before it changed: %t, %v", key, deleted, err)
+		}
+	}
+
+	for _, key := range []string{"rewritten", "renewed"} {
+		if v, err := s.GetCtx(ctx, key); err != nil || v != "v2" {
+			t.Errorf("%s after the sweep: %q, %v, want v2", key, v, err)
+		}
+	}
+
+	// Rewritten without a TTL, the key is permanent
+	if n, err := s.Expire(ctx, time.Now().Add(90*time.Minute)); err != nil || n != 0 {
+		t.Errorf("a sweep before the renewed deadline deleted %d keys, %v", n, err)
+	}
+	if n, err := s.Expire(ctx, time.Now().Add(3*time.Hour)); err != nil || n != 1 {
+		t.Errorf("a sweep after the renewed deadline deleted %d keys, %v, want 1", n, err)
+	}
+	if keys, err := s.BucketKeys(ctx, DefaultBucket, ""); err != nil || !slices.Equal(keys, []string{"rewritten"}) {
+		t.Errorf("keys after the sweeps: %v, %v", keys, err)
+	}
+}
+
+func TestImmutableKeysExpire(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+
+	if err := s.PutCtx(WithTTL(WithImmutable(ctx), time.Hour), "k", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "k", "v2"); !errors.Is(err, ErrorImmutable) {
+		t.Errorf("a put of a write-once key with a TTL: %v, want ErrorImmutable", err)
+	}
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if _, meta, err := s.GetWithMetaCtx(ctx, "k"); err != nil || !meta.Immutable || meta.Expires.IsZero() {
+		t.Fatalf("after a restart: %+v, %v, want the key write-once with a deadline", meta, err)
+	}
+
+	// Expiry deletes it all the same, and it can be put again
+	if n, err := s.Expire(ctx, time.Now().Add(2*time.Hour)); err != nil || n != 1 {
+		t.Errorf("the sweep deleted %d keys, %v, want the write-once key", n, err)
+	}
+	if _, err := s.GetCtx(ctx, "k"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("GET of the expired write-once key: %v, want ErrorNoSuchKey", err)
+	}
+	if err := s.PutCtx(ctx, "k", "v2"); err != nil {
+		t.Errorf("a put of the expired write-once key: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"golang.org/x/text/cases"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrorKeyCollision is returned by FoldKeys when keys already stored differ
+// only in case, so they can't be folded into one without losing values.
+var ErrorKeyCollision = errors.New("stored keys differ only in case")
+
+// KeyFolding is how keys are normalized, so that keys differing only in case
+// are the same key.
+type KeyFolding int
+
+const (
+	FoldNone    KeyFolding = iota // Keys are kept as given
+	FoldASCII                     // A to Z are lower-cased
+	FoldUnicode                   // Full Unicode case folding, under which "Straße" is "strasse"
+)
+
+var foldingNames = []string{"none", "ascii", "unicode"}
+
+// ParseKeyFolding returns the folding named by name: none, ascii or unicode.
+func ParseKeyFolding(name string) (KeyFolding, error) {
+	if i := slices.Index(foldingNames, name); i >= 0 {
+		return KeyFolding(i), nil
+	}
+
+	return FoldNone, fmt.Errorf("unknown key folding %q", name)
+}
+
+func (f KeyFolding) String() string {
+	if int(f) < len(foldingNames) {
+		return foldingNames[f]
+	}
+
+	return fmt.Sprintf("KeyFolding(%d)", int(f))
+}
+
+// Fold returns key normalized by f. Folding a folded key changes nothing.
+func (f KeyFolding) Fold(key string) string {
+	switch f {
+	case FoldASCII:
+		return foldASCII(key)
+	case FoldUnicode:
+		if isASCII(key) {
+			return foldASCII(key) // Same result, without allocating a Caser
+		}
+		return cases.Fold().String(key)
+	default:
+		return key
+	}
+}
+
+// foldASCII lower-cases A to Z, and returns key itself if it has none.
+func foldASCII(key string) string {
+	for i := 0; i < len(key); i++ {
+		if 'A' <= key[i] && key[i] <= 'Z' {
+			return strings.Map(func(r rune) rune {
+				if 'A' <= r && r <= 'Z' {
+					return r + 'a' - 'A'
+				}
+				return r
+			}, key)
+		}
+	}
+
+	return key
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// foldKey returns key as the store keeps it.
+func (s *Store) foldKey(key string) string {
+	return s.opts.KeyFolding.Fold(key)
+}
+
+// noteOriginal records original as the form key was written in, if the put
+// that just stored key created it. The caller must hold the write lock, or
+// the lock of a write of key.
+func (s *Store) noteOriginal(bucket, key, original string) {
+	if original == key {
+		return
+	}
+
+	if e, ok := s.m.get(bucket, key); ok && e.meta.Version == 1 {
+		e.meta.OriginalKey = original
+		s.m.set(bucket, key, e)
+	}
+}
+
+// KeyCollision is a set of stored keys that fold to the same key.
+type KeyCollision struct {
+	Bucket string   `json:"bucket"`
+	Key    string   `json:"key"`  // The folded key
+	Keys   []string `json:"keys"` // The stored keys folding to it, in lexical order
+}
+
+func (c KeyCollision) String() string {
+	return fmt.Sprintf("%s: %s", c.Bucket, strings.Join(c.Keys, ", "))
+}
+
+// FoldKeys brings the keys already stored under Options.KeyFolding, for a
+// store that is switched to it with existing data: each key that isn't
+// folded is renamed to its folded form, by logging a put of its value
+// under the new key and its deletion, and keeps its metadata, with the old
+// key as OriginalKey. Renaming through the log means that later replays find
+// only folded keys past that point, as written under the folding.
+//
+// If some keys fold to the same key, nothing is renamed: FoldKeys returns
+// the collisions, ordered by bucket and key, and ErrorKeyCollision. They
+// must be resolved with the folding off before it can be turned on. It
+// returns the number of keys renamed otherwise. It is meant for startup,
+// before the store serves requests: a failure part way leaves the keys
+// renamed so far, and the store should not be used.
+func (s *Store) FoldKeys(ctx context.Context) (int, []KeyCollision, error) {
+	if s.opts.KeyFolding == FoldNone {
+		return 0, nil, nil
+	}
+
+	if err := s.loadAll(ctx); err != nil {
+		return 0, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type rename struct{ bucket, from, to string }
+
+	var renames []rename
+	var collisions []KeyCollision
+
+	// Keys folding to the same key may be in different shards, so each
+	// bucket is gone through whole
+	for _, bucket := range s.m.buckets() {
+		folded := make(map[string][]string)
+		for key := range s.m.bucket(bucket) {
+			f := s.foldKey(key)
+			folded[f] = append(folded[f], key)
+		}
+
+		for f, keys := range folded {
+			switch {
+			case len(keys) > 1:
+				slices.Sort(keys)
+				collisions = append(collisions, KeyCollision{Bucket: bucket, Key: f, Keys: keys})
+			case keys[0] != f:
+				renames = append(renames, rename{bucket, keys[0], f})
+			}
+		}
+	}
+
+	if len(collisions) > 0 {
+		slices.SortFunc(collisions, func(a, b KeyCollision) int {
+			return cmp.Or(strings.Compare(a.Bucket, b.Bucket), strings.Compare(a.Key, b.Key))
+		})
+
+		return 0, collisions, fmt.Errorf("%w: %d sets of keys under %s folding", ErrorKeyCollision, len(collisions), s.opts.KeyFolding)
+	}
+
+	if len(renames) == 0 {
+		return 0, nil, nil
+	}
+
+	if s.readOnly {
+		return 0, nil, ErrorReadOnly
+	}
+
+	for _, r := range renames {
+		e, _ := s.m.get(r.bucket, r.from)
+
+		// The put goes first, so that a log cut short between the two
+		// still has the value
+		value, err := e.stored()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		put := translog.Event{EventType: translog.EventPut, Bucket: r.bucket, Key: r.to, Value: value, Codec: e.codec, ContentType: e.meta.ContentType}
+		del := translog.Event{EventType: translog.EventDelete, Bucket: r.bucket, Key: r.from}
+
+		if err := s.enqueue(ctx, put); err != nil {
+			return 0, nil, err
+		}
+
+		if e.meta.OriginalKey == "" {
+			e.meta.OriginalKey = r.from
+		}
+		mark := translog.Event{EventType: translog.EventOriginalKey, Bucket: r.bucket, Key: r.to, Value: e.meta.OriginalKey}
+		if err := s.enqueue(ctx, mark); err != nil {
+			return 0, nil, err
+		}
+
+		if e.meta.Immutable {
+			mark := translog.Event{EventType: translog.EventImmutable, Bucket: r.bucket, Key: r.to}
+			if err := s.enqueue(ctx, mark); err != nil {
+				return 0, nil, err
+			}
+		}
+		if !e.meta.Expires.IsZero() {
+			mark := translog.Event{EventType: translog.EventExpire, Bucket: r.bucket, Key: r.to, Value: translog.FormatExpiry(e.meta.Expires)}
+			if err := s.enqueue(ctx, mark); err != nil {
+				return 0, nil, err
+			}
+		}
+		if err := s.enqueue(ctx, del); err != nil {
+			return 0, nil, err
+		}
+
+		s.m.delete(r.bucket, r.from)
+		s.m.set(r.bucket, r.to, e)
+		s.epoch.Add(1)
+		s.accountChange(r.bucket, r.from, &e, nil)
+		s.accountChange(r.bucket, r.to, nil, &e)
+
+		s.notify(r.bucket, r.from, nil)
+	}
+
+	return len(renames), nil, s.logger.Flush(ctx)
+}
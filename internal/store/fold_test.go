@@ -0,0 +1,194 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFolding(t *testing.T) {
+	tests := []struct {
+		key, ascii, unicode string
+	}{
+		{"alice@example.com", "alice@example.com", "alice@example.com"},
+		{"Alice@Example.COM", "alice@example.com", "alice@example.com"},
+		{"Straße", "straße", "strasse"},
+		{"ÉCOLE", "École", "école"},
+		{"ΣΊΣΥΦΟΣ", "ΣΊΣΥΦΟΣ", "σίσυφοσ"},
+	}
+
+	for _, tt := range tests {
+		for _, c := range []struct {
+			f    KeyFolding
+			want string
+		}{{FoldNone, tt.key}, {FoldASCII, tt.ascii}, {FoldUnicode, tt.unicode}} {
+			got := c.f.Fold(tt.key)
+			if got != c.want {
+				t.Errorf("%s folding of %q = %q, want %q", c.f, tt.key, got, c.want)
+			}
+			if again := c.f.Fold(got); again != got {
+				t.Errorf("%s folding of the folded %q = %q", c.f, got, again)
+			}
+		}
+	}
+
+	for _, name := range []string{"none", "ascii", "unicode"} {
+		if f, err := ParseKeyFolding(name); err != nil || f.String() != name {
+			t.Errorf("ParseKeyFolding(%q) = %s, %v", name, f, err)
+		}
+	}
+	if _, err := ParseKeyFolding("lower"); err == nil {
+		t.Error("ParseKeyFolding accepted an unknown folding")
+	}
+}
+
+func TestFoldedKeysRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{KeyFolding: FoldUnicode})
+
+	if err := s.PutCtx(ctx, "Alice@Example.com", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "ALICE@EXAMPLE.COM", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BucketPut(ctx, "b", "Straße", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "Bob", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteCtx(ctx, "BOB"); err != nil {
+		t.Fatal(err)
+	}
+
+	// check reads every key in any case, and finds the case it was first
+	// written in
+	check := func(when string) {
+		t.Helper()
+
+		for _, key := range []string{"alice@example.com", "Alice@example.com", "ALICE@EXAMPLE.COM"} {
+			v, meta, err := s.GetWithMeta(key)
+			if v != "second" || err != nil || meta.OriginalKey != "Alice@Example.com" || meta.Version != 2 {
+				t.Errorf("GET %s %s: %q, %+v, %v", key, when, v, meta, err)
+			}
+		}
+		if v, meta, err := s.BucketGetWithMeta(ctx, "b", "STRASSE"); v != "v" || err != nil || meta.OriginalKey != "Straße" {
+			t.Errorf("GET b/STRASSE %s: %q, %+v, %v", when, v, meta, err)
+		}
+		if _, err := s.Get("bob"); err != ErrorNoSuchKey {
+			t.Errorf("GET bob %s, deleted as BOB: %v", when, err)
+		}
+		if keys, _ := s.BucketKeys(ctx, DefaultBucket, "ALICE"); fmt.Sprint(keys) != "[alice@example.com]" {
+			t.Errorf("keys starting with ALICE %s: %v", when, keys)
+		}
+	}
+
+	check("as written")
+	closeLog()
+
+	// The log holds the keys folded, so replaying it gives the same keys,
+	// and the form each was created in
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var originals []string
+	events, errs := l.ReadEvents()
+	for e := range events {
+		if e.Key != FoldUnicode.Fold(e.Key) {
+			t.Errorf("event %d holds the key %s unfolded", e.Sequence, e.Key)
+		}
+		if e.EventType == translog.EventOriginalKey {
+			originals = append(originals, e.Value)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	l.Close(ctx)
+
+	if fmt.Sprint(originals) != "[Alice@Example.com Straße Bob]" {
+		t.Errorf("the log records the keys were created as %v", originals)
+	}
+
+	s, closeLog = openLogged(t, dir, Options{KeyFolding: FoldUnicode})
+	defer closeLog()
+
+	check("after replay")
+}
+
+func TestFoldKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Keys written before the folding is turned on
+	s, closeLog := openLogged(t, dir, Options{})
+	for _, key := range []string{"Bob", "bob", "BOB", "Carol", "dave"} {
+		if err := s.PutCtx(ctx, key, "v "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BucketPut(ctx, "b", "Erin", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BucketPut(ctx, "b", "ERIN", "v"); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	// Turning it on is refused, listing the keys that collide, and changes
+	// nothing
+	s, closeLog = openLogged(t, dir, Options{KeyFolding: FoldASCII})
+	seq := s.Sequence()
+
+	n, collisions, err := s.FoldKeys(ctx)
+	if !errors.Is(err, ErrorKeyCollision) || n != 0 {
+		t.Fatalf("folding colliding keys: %d, %v", n, err)
+	}
+	if got := fmt.Sprint(collisions); got != "[b: ERIN, Erin default: BOB, Bob, bob]" {
+		t.Errorf("collisions %s", got)
+	}
+	if s.Sequence() != seq {
+		t.Errorf("a refused folding logged events, from sequence %d to %d", seq, s.Sequence())
+	}
+	closeLog()
+
+	// With the collisions resolved, the keys are renamed, keeping the case
+	// they were written in, and stay renamed after a restart
+	s, closeLog = openLogged(t, dir, Options{})
+	for _, key := range []string{"Bob", "BOB"} {
+		if err := s.DeleteCtx(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.DropBucket(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{KeyFolding: FoldASCII})
+	if n, _, err := s.FoldKeys(ctx); n != 1 || err != nil {
+		t.Fatalf("folding the keys: %d renamed, %v", n, err)
+	}
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{KeyFolding: FoldASCII})
+	defer closeLog()
+
+	if keys, _ := s.BucketKeys(ctx, DefaultBucket, ""); fmt.Sprint(keys) != "[bob carol dave]" {
+		t.Errorf("keys after folding: %v", keys)
+	}
+	if v, meta, err := s.GetWithMeta("CAROL"); v != "v Carol" || err != nil || meta.OriginalKey != "Carol" {
+		t.Errorf("GET CAROL after folding: %q, %+v, %v", v, meta, err)
+	}
+	if n, _, err := s.FoldKeys(ctx); n != 0 || err != nil {
+		t.Errorf("folding folded keys: %d renamed, %v", n, err)
+	}
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Kinds of Divergence.
+const (
+	DivergenceDiffers = "differs" // The key has another value than the log gives it
+	DivergenceMissing = "missing" // The log has the key but the store doesn't
+	DivergenceExtra   = "extra"   // The store has the key but the log doesn't
+)
+
+// Divergence is a key on which a store disagrees with its transaction log.
+type Divergence struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Kind   string `json:"kind"`
+}
+
+// CheckReport is the outcome of a consistency check.
+type CheckReport struct {
+	Sequence    uint64       `json:"sequence"`    // Last event the comparison covers
+	Keys        int          `json:"keys"`        // Keys the log gives the store
+	Divergences []Divergence `json:"divergences"` // Ordered by bucket and then key
+	Repaired    int          `json:"repaired"`    // Divergent keys reset to the log's value
+}
+
+// Replay builds a store from the snapshot and transaction log in dataDir, as
+// Load would, but leaves out the events after sequence upTo. Neither file is
+// modified, so it's safe to use on the data directory of a running instance.
+func Replay(dataDir string, upTo uint64) (*Store, error) {
+	s := New(translog.NewNopTransactionLogger(), Options{})
+
+	f, err := os.Open(filepath.Join(dataDir, SnapshotFileName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		err := s.Restore(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+	}
+
+	if s.seq.load() > upTo {
+		return nil, fmt.Errorf("snapshot is at sequence %d, past %d", s.seq.load(), upTo)
+	}
+
+	after := s.seq.load()
+
+	err = translog.ScanLog(filepath.Join(dataDir, translog.LogFileName), func(e translog.Event) error {
+		if e.Sequence > after && e.Sequence <= upTo {
+			return s.apply(e)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Check compares the store to the replay of the snapshot and transaction
+// log in dataDir, which must be those it was loaded from and is logging to.
+// The store is copied under the read lock and compared afterwards, so writes
+// are only held up for the copy. With repair set, divergent keys are reset
+// to the log's value, unless they were written since the copy was made.
+func (s *Store) Check(ctx context.Context, dataDir string, repair bool) (CheckReport, error) {
+	if s.opts.Backing != nil {
+		return CheckReport{}, errors.New("the store has no transaction log to check")
+	}
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	seq := s.seq.load()
+	seen := s.m.copy()
+	s.runlockScan()
+
+	// Events up to seq may still be waiting to be written
+	if err := s.logger.Flush(ctx); err != nil {
+		return CheckReport{}, err
+	}
+
+	ref, err := Replay(dataDir, seq)
+	if err != nil {
+		return CheckReport{}, err
+	}
+
+	want := ref.m.copy()
+
+	report := compare(want, seen)
+	report.Sequence = seq
+
+	if repair {
+		report.Repaired = s.repair(want, seen, report.Divergences)
+	}
+
+	return report, nil
+}
+
+// Compare checks s, a store restored from a snapshot, against ref, the
+// replay of the log up to the snapshot's sequence.
+func (s *Store) Compare(ref *Store) CheckReport {
+	s.mu.RLock()
+	s.m.lockWriters()
+	defer s.runlockScan()
+
+	ref.mu.RLock()
+	defer ref.mu.RUnlock()
+
+	report := compare(ref.m.copy(), s.m.copy())
+	report.Sequence = s.seq.load()
+
+	return report
+}
+
+// compare lists the keys of got that differ from want. Only values are
+// compared, since metadata isn't logged and differs between replays.
+func compare(want, got map[string]map[string]entry) CheckReport {
+	var report CheckReport
+
+	for bucket, b := range want {
+		report.Keys += len(b)
+
+		for key, w := range b {
+			g, ok := got[bucket][key]
+			switch {
+			case !ok:
+				report.Divergences = append(report.Divergences, Divergence{bucket, key, DivergenceMissing})
+			case !sameStored(g, w):
+				report.Divergences = append(report.Divergences, Divergence{bucket, key, DivergenceDiffers})
+			}
+		}
+	}
+
+	for bucket, b := range got {
+		for key := range b {
+			if _, ok := want[bucket][key]; !ok {
+				report.Divergences = append(report.Divergences, Divergence{bucket, key, DivergenceExtra})
+			}
+		}
+	}
+
+	sort.Slice(report.Divergences, func(i, j int) bool {
+		a, b := report.Divergences[i], report.Divergences[j]
+		if a.Bucket != b.Bucket {
+			return a.Bucket < b.Bucket
+		}
+		return a.Key < b.Key
+	})
+
+	return report
+}
+
+// repair resets each divergent key to its entry in want, skipping keys whose
+// entry is no longer the one in seen, the copy they were compared as. It
+// returns the number of keys reset.
+func (s *Store) repair(want, seen map[string]map[string]entry, divs []Divergence) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+
+	for _, d := range divs {
+		cur, exists := s.lookup(d.Bucket, d.Key)
+		old, had := seen[d.Bucket][d.Key]
+		if exists != had || cur != old {
+			continue
+		}
+
+		if w, ok := want[d.Bucket][d.Key]; ok {
+			var prev *entry
+			if exists {
+				prev = &cur
+			}
+
+			s.m.set(d.Bucket, d.Key, w)
+			s.epoch.Add(1)
+			s.accountChange(d.Bucket, d.Key, prev, &w)
+			s.notify(d.Bucket, d.Key, &w)
+		} else {
+			s.remove(d.Bucket, d.Key)
+		}
+
+		n++
+	}
+
+	return n
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"testing"
+)
+
+func TestCheckAndRepair(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	opts := Options{Quotas: QuotaPolicy{Default: Quota{MaxKeys: 100}}}
+	s, closeLog := openLogged(t, dir, opts)
+	defer closeLog()
+
+	for _, key := range []string{"differs", "missing", "same"} {
+		if err := s.BucketPut(ctx, "b", key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Events applied without being logged make the store diverge from its log
+	for _, e := range []translog.Event{
+		{EventType: translog.EventPut, Bucket: "b", Key: "differs", Value: "changed"},
+		{EventType: translog.EventDelete, Bucket: "b", Key: "missing"},
+		{EventType: translog.EventPut, Bucket: "b", Key: "extra", Value: "v"},
+	} {
+		if err := s.ApplyEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := s.Check(ctx, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{b differs differs} {b extra extra} {b missing missing}]"
+	if fmt.Sprint(report.Divergences) != want || report.Keys != 3 || report.Repaired != 0 {
+		t.Errorf("check: %+v, want the divergences %s of 3 keys", report, want)
+	}
+
+	// A check without repair leaves the store as it was
+	if v, _, err := s.BucketGetWithMeta(ctx, "b", "differs"); err != nil || v != "changed" {
+		t.Errorf("differs after a check: %q, %v", v, err)
+	}
+
+	report, err = s.Check(ctx, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Divergences) != want || report.Repaired != 3 {
+		t.Errorf("repair: %+v, want the divergences %s repaired", report, want)
+	}
+	checkKeys(t, s, "b", "[differs missing same]", "after the repair")
+	if v, _, err := s.BucketGetWithMeta(ctx, "b", "differs"); err != nil || v != "v" {
+		t.Errorf("differs after the repair: %q, %v, want v", v, err)
+	}
+
+	// The counts kept as keys change agree with the keys after the repair
+	if n, stats := s.KeyCount(), s.Stats(); n != int64(stats.Keys) || n != 3 {
+		t.Errorf("KeyCount %d and Stats %d keys after the repair, want 3", n, stats.Keys)
+	}
+	s.mu.RLock()
+	u := *s.usage["b"]
+	s.mu.RUnlock()
+	if bytes := s.BucketBytes()["b"]; u.keys != 3 || u.bytes != bytes {
+		t.Errorf("usage of b after the repair: %d keys of %d bytes, want 3 of %d", u.keys, u.bytes, bytes)
+	}
+
+	if report, err := s.Check(ctx, dir, false); err != nil || len(report.Divergences) != 0 {
+		t.Errorf("a check after the repair: %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorRejected wraps the error of a put hook that refused a write.
+var ErrorRejected = errors.New("write rejected")
+
+// ErrorHookTimeout is returned for a write whose put hooks didn't finish in
+// time. The write is not made.
+var ErrorHookTimeout = errors.New("put hook timed out")
+
+// DefaultHookTimeout bounds the put hooks of a write when Options doesn't.
+const DefaultHookTimeout = time.Second
+
+// PutHook checks a value about to be written under key, which is given
+// without its bucket, and returns an error to refuse the write.
+type PutHook func(key, value string) error
+
+type putHook struct {
+	bucket string // Bucket the hook applies to; empty for every bucket
+	prefix string // Prefix of the keys the hook applies to
+	fn     PutHook
+}
+
+// hookRegistry holds the put hooks in the order they were registered.
+type hookRegistry struct {
+	mu    sync.RWMutex
+	hooks []putHook
+}
+
+func (h *hookRegistry) add(hook putHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.hooks = append(h.hooks, hook)
+}
+
+// matching returns the hooks that apply to key in bucket, in registration
+// order.
+func (h *hookRegistry) matching(bucket, key string) []PutHook {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var fns []PutHook
+	for _, hook := range h.hooks {
+		if (hook.bucket == "" || hook.bucket == bucket) && strings.HasPrefix(key, hook.prefix) {
+			fns = append(fns, hook.fn)
+		}
+	}
+
+	return fns
+}
+
+// RegisterPutHook has fn check every value written under a key starting
+// with prefix, in any bucket, by a put, a compare-and-swap, an update such
+// as a PATCH, a transaction or an increment. If fn
+// returns an error the write is refused with it, wrapped in ErrorRejected;
+// the API answers 422 Unprocessable Entity with its message. For instance,
+// to only accept YAML under config/:
+//
+//	st.RegisterPutHook("config/", func(key, value string) error {
+//		return yaml.Unmarshal([]byte(value), new(any))
+//	})
+//
+// Hooks of puts and compare-and-swaps run before the store is locked, but
+// those of updates, transactions and increments, whose values are only
+// known under the lock, hold up the writes waiting for it, so hooks should
+// be fast, and can't take longer than Options.HookTimeout: a write whose
+// hooks take longer fails with ErrorHookTimeout. Hooks matching the same
+// key run in the order they were registered, and stop at the first error.
+// They are not run for events replayed or replicated, which were checked
+// when first written.
+func (s *Store) RegisterPutHook(prefix string, fn func(key, value string) error) {
+	s.hooks.add(putHook{prefix: prefix, fn: fn})
+}
+
+// RegisterBucketPutHook is like RegisterPutHook for the keys of bucket only.
+func (s *Store) RegisterBucketPutHook(bucket, prefix string, fn func(key, value string) error) {
+	s.hooks.add(putHook{bucket: bucket, prefix: prefix, fn: fn})
+}
+
+// runPutHooks runs the hooks matching key in bucket on value. A hook still
+// running at the timeout is left to finish on its own, since it can't be
+// stopped, but its result is ignored.
+func (s *Store) runPutHooks(ctx context.Context, bucket, key, value string) error {
+	fns := s.hooks.matching(bucket, key)
+	if len(fns) == 0 {
+		return nil
+	}
+
+	timeout := s.opts.HookTimeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	done := make(chan error, 1)
+
+	go func() {
+		for _, fn := range fns {
+			if err := fn(key, value); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrorRejected, err)
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w after %s", ErrorHookTimeout, timeout)
+	case <-ctx.Done():
+		return phaseError(PhaseHooks, ctx.Err())
+	}
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPutHookRejection(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	errNotJSON := errors.New("not JSON")
+
+	s, closeLog := openLogged(t, dir, Options{})
+	s.RegisterPutHook("config/", func(key, value string) error {
+		if !strings.HasPrefix(value, "{") {
+			return errNotJSON
+		}
+		return nil
+	})
+
+	if err := s.PutCtx(ctx, "config/app", `{"replicas": 3}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refused write carries the hook's error and leaves the key as it was
+	err := s.PutCtx(ctx, "config/app", "replicas: 3")
+	if !errors.Is(err, ErrorRejected) || !errors.Is(err, errNotJSON) {
+		t.Fatalf("a put refused by its hook: %v", err)
+	}
+	if _, err := s.CompareAndSwap(ctx, "config/app", `{"replicas": 3}`, "replicas: 3"); !errors.Is(err, ErrorRejected) {
+		t.Errorf("a compare-and-swap refused by its hook: %v", err)
+	}
+	if v, _ := s.Get("config/app"); v != `{"replicas": 3}` {
+		t.Errorf("config/app is %q after refused writes", v)
+	}
+
+	// Keys outside the prefix aren't checked
+	if err := s.PutCtx(ctx, "other", "replicas: 3"); err != nil {
+		t.Errorf("a put outside the hook's prefix: %v", err)
+	}
+	seq := s.Sequence()
+	closeLog()
+
+	// Nor was the refused write logged, so a restart doesn't bring it back
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if v, _ := s.Get("config/app"); v != `{"replicas": 3}` || s.Sequence() != seq {
+		t.Errorf("restarted at %d with config/app %q, want %d with the accepted value", s.Sequence(), v, seq)
+	}
+}
+
+func TestPutHookIncrement(t *testing.T) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(t, t.TempDir(), Options{})
+	defer closeLog()
+
+	// The hook sees the value the increment computes
+	var seen []string
+	s.RegisterPutHook("counters/", func(key, value string) error {
+		seen = append(seen, value)
+		if len(value) > 1 {
+			return errors.New("at most 9")
+		}
+		return nil
+	})
+
+	if n, err := s.Increment(ctx, "counters/n", 5); err != nil || n != 5 {
+		t.Fatalf("an increment the hook accepts: %d, %v", n, err)
+	}
+	if _, err := s.Increment(ctx, "counters/n", 5); !errors.Is(err, ErrorRejected) {
+		t.Errorf("an increment refused by its hook: %v", err)
+	}
+	if v, _ := s.Get("counters/n"); v != "5" || fmt.Sprint(seen) != "[5 10]" {
+		t.Errorf("counters/n is %q after the hook saw %v, want 5 after [5 10]", v, seen)
+	}
+}
+
+func TestPutHookTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(t, t.TempDir(), Options{HookTimeout: 20 * time.Millisecond})
+	defer closeLog()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	s.RegisterPutHook("slow/", func(key, value string) error {
+		<-release
+		return nil
+	})
+
+	// A write whose hook runs past the timeout isn't made, and doesn't hold
+	// up writes to other keys meanwhile
+	done := make(chan error)
+	go func() { done <- s.PutCtx(ctx, "slow/k", "v") }()
+
+	if err := s.PutCtx(ctx, "fast", "v"); err != nil {
+		t.Errorf("a put while another's hook is running: %v", err)
+	}
+
+	if err := <-done; !errors.Is(err, ErrorHookTimeout) {
+		t.Errorf("a put whose hook outran the timeout: %v, want ErrorHookTimeout", err)
+	}
+	if _, err := s.Get("slow/k"); err != ErrorNoSuchKey {
+		t.Errorf("a put whose hook timed out was made: %v", err)
+	}
+
+	// Nor does a canceled write wait for the hook
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := s.PutCtx(ctx, "slow/k", "v"); !errors.Is(err, context.Canceled) {
+		t.Errorf("a canceled put with a slow hook: %v", err)
+	}
+}
+
+func TestPutHookOrder(t *testing.T) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(t, t.TempDir(), Options{})
+	defer closeLog()
+
+	var mu sync.Mutex
+	var ran []string
+
+	hook := func(name string, err error) func(key, value string) error {
+		return func(key, value string) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			ran = append(ran, fmt.Sprintf("%s(%s)", name, key))
+			return err
+		}
+	}
+
+	s.RegisterPutHook("", hook("all", nil))
+	s.RegisterPutHook("a/", hook("a", nil))
+	s.RegisterPutHook("b/", hook("b", nil))
+	s.RegisterPutHook("a/b/", hook("ab", errors.New("no")))
+	s.RegisterPutHook("a/", hook("a-again", nil))
+	s.RegisterBucketPutHook("users", "a/", hook("users-a", nil))
+
+	check := func(bucket, key, want string) {
+		t.Helper()
+
+		ran = nil
+		s.BucketPut(ctx, bucket, key, "v")
+		if got := strings.Join(ran, " "); got != want {
+			t.Errorf("a put of %s in %s ran %s, want %s", key, bucket, got, want)
+		}
+	}
+
+	// Matching hooks run in the order they were registered, a bucket's
+	// hooks only for its keys, which they're given without the bucket
+	check(DefaultBucket, "a/k", "all(a/k) a(a/k) a-again(a/k)")
+	check("users", "a/k", "all(a/k) a(a/k) a-again(a/k) users-a(a/k)")
+	check(DefaultBucket, "c", "all(c)")
+
+	// The first to refuse stops the rest
+	check(DefaultBucket, "a/b/k", "all(a/b/k) a(a/b/k) ab(a/b/k)")
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorImmutable is returned for writes to a write-once key, unless they
+// are forced.
+var ErrorImmutable = errors.New("key is immutable")
+
+// immutableKey is the context key of the puts that make their key
+// write-once.
+type immutableKey struct{}
+
+// WithImmutable returns a context under which puts make the key they write
+// write-once: once applied, the key can't be put, changed or deleted again
+// but by a write made under WithForce. The mark is logged as an event
+// right after the put, and flushed with it, so it survives a restart and
+// is replicated as the put is. A key already write-once refuses the put
+// like any other.
+//
+// Expiry isn't a change: a write-once key is deleted by a retention policy
+// once it's old enough, as any key is. Nor are the bulk deletions, which
+// are for admins, and drop, rename or delete write-once keys along with
+// the others, as they do leased ones. Compaction keeps the mark in the
+// snapshot the log is compacted into.
+func WithImmutable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, immutableKey{}, true)
+}
+
+// makesImmutable reports whether the puts made under ctx make their key
+// write-once.
+func makesImmutable(ctx context.Context) bool {
+	immutable, _ := ctx.Value(immutableKey{}).(bool)
+	return immutable
+}
+
+// forceKey is the context key of the writes allowed to change write-once
+// keys.
+type forceKey struct{}
+
+// WithForce returns a context under which writes may put, change and
+// delete write-once keys. A forced put leaves the key write-once; a forced
+// delete removes it, mark and all. It's meant for admins, and callers
+// should record its use.
+func WithForce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceKey{}, true)
+}
+
+// IsForced reports whether the writes made under ctx may change write-once
+// keys.
+func IsForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(forceKey{}).(bool)
+	return forced
+}
+
+// checkImmutable returns ErrorImmutable if e, the entry of key, is
+// write-once, unless the writes of ctx are forced.
+func checkImmutable(ctx context.Context, bucket, key string, e entry) error {
+	if !e.meta.Immutable || IsForced(ctx) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: key %q in bucket %q", ErrorImmutable, key, bucket)
+}
+
+// setImmutable makes key write-once, if it exists, leaving its value and
+// the rest of its metadata as they are. The caller must hold the write
+// lock, or the lock of a write of key.
+func (s *Store) setImmutable(bucket, key string) {
+	e, ok := s.lookup(bucket, key)
+	if !ok {
+		return
+	}
+
+	e.meta.Immutable = true
+	s.m.set(bucket, key, e)
+	s.epoch.Add(1)
+	s.renaming.touch(bucket, key)
+}
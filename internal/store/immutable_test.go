@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestImmutableKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+
+	if err := s.PutCtx(WithImmutable(ctx), "once", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "other", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// check checks that once is write-once and holds want, and that other
+	// can still be written
+	check := func(t *testing.T, s *Store, want, when string) {
+		t.Helper()
+
+		if v, meta, err := s.GetWithMetaCtx(ctx, "once"); err != nil || v != want || !meta.Immutable {
+			t.Errorf("%s: once is %q, %+v, %v, want %q write-once", when, v, meta, err, want)
+		}
+		if err := s.PutCtx(ctx, "once", "v2"); !errors.Is(err, ErrorImmutable) {
+			t.Errorf("%s: a put of once: %v, want ErrorImmutable", when, err)
+		}
+		if err := s.DeleteCtx(ctx, "once"); !errors.Is(err, ErrorImmutable) {
+			t.Errorf("%s: a delete of once: %v, want ErrorImmutable", when, err)
+		}
+		if err := s.PutCtx(WithImmutable(ctx), "once", "v2"); !errors.Is(err, ErrorImmutable) {
+			t.Errorf("%s: an immutable put of once: %v, want ErrorImmutable", when, err)
+		}
+
+		if _, meta, err := s.GetWithMetaCtx(ctx, "other"); err != nil || meta.Immutable {
+			t.Errorf("%s: other is %+v, %v, want it writable", when, meta, err)
+		}
+	}
+
+	check(t, s, "v1", "as put")
+
+	// A forced put changes the value, and leaves the key write-once
+	if err := s.PutCtx(WithForce(ctx), "once", "forced"); err != nil {
+		t.Fatalf("a forced put: %v", err)
+	}
+	check(t, s, "forced", "after a forced put")
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{})
+	check(t, s, "forced", "after a restart")
+
+	// A forced delete removes the mark along with the key, for good
+	if err := s.DeleteCtx(WithForce(ctx), "once"); err != nil {
+		t.Fatalf("a forced delete: %v", err)
+	}
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if _, err := s.GetCtx(ctx, "once"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("once after a forced delete and a restart: %v, want ErrorNoSuchKey", err)
+	}
+	if err := s.PutCtx(ctx, "once", "again"); err != nil {
+		t.Errorf("a put of a key forcibly deleted: %v", err)
+	}
+	if err := s.PutCtx(ctx, "once", "and again"); err != nil {
+		t.Errorf("a put of a key put again after a forced delete: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Lanes of the queue writes wait in for the store's locks, as labelled on
+// kv_write_lane_depth.
+const (
+	laneNormal = iota
+	laneUrgent
+)
+
+var laneNames = [...]string{laneNormal: "normal", laneUrgent: "urgent"}
+
+// maxLaneWriters is how many writes the lanes let through to the store's
+// locks at once: one per shard, so that every shard's writes can go on.
+const maxLaneWriters = shardCount
+
+var laneDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "kv_write_lane_depth",
+	Help: "Number of writes waiting for their turn at the store's locks, by lane: urgent or normal.",
+}, []string{"lane"})
+
+// LaneCollectors returns the lane depth gauges, for the metrics registry.
+func LaneCollectors() []prometheus.Collector {
+	return []prometheus.Collector{laneDepth}
+}
+
+// urgentKey is the context key marking the writes made under a context as
+// urgent.
+type urgentKey struct{}
+
+// WithUrgency returns a context under which writes are urgent, such as the
+// delete of a key that must be erased now rather than soon: they go ahead of
+// the writes waiting for the store's locks, save those of the same key, and
+// are durable once they return, as under StrictWrites. Lease releases and
+// bucket drops are always urgent.
+func WithUrgency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, urgentKey{}, true)
+}
+
+// isUrgent reports whether the writes made under ctx are urgent.
+func isUrgent(ctx context.Context) bool {
+	urgent, _ := ctx.Value(urgentKey{}).(bool)
+
+	return urgent
+}
+
+// laneWaiter is a write waiting in a lane.
+type laneWaiter struct {
+	ticket   uint64 // Order of arrival, across both lanes
+	bucket   string
+	key      string        // Empty for a write of the whole bucket
+	prefix   bool          // Whether the write is of the keys starting with key
+	admitted chan struct{} // Closed once the write may take the locks
+}
+
+// follows reports whether w must keep to its place after earlier, which
+// arrived before it: they write the same key, or one of them writes the
+// whole bucket of the other, or the keys starting with a prefix that the
+// other's key or prefix starts with.
+func (w *laneWaiter) follows(earlier *laneWaiter) bool {
+	return w.bucket == earlier.bucket && (w.covers(earlier.key) || earlier.covers(w.key))
+}
+
+// covers reports whether w writes key, or the keys starting with it.
+func (w *laneWaiter) covers(key string) bool {
+	if w.prefix || w.key == "" {
+		return strings.HasPrefix(key, w.key)
+	}
+
+	return w.key == key
+}
+
+// lanes admits the writes of single keys, and those of the keys starting
+// with a prefix or of whole buckets, to the store's locks, maxLaneWriters
+// at a time. Writes that find them all taken wait in one of two lanes,
+// each in order of arrival. Urgent writes are let through ahead of the
+// normal ones, save that an urgent write is held back while a normal write
+// of the same key that arrived before it is still waiting: the writes of
+// each key keep their order, and so do their events in the log, which is
+// numbered once a write has its locks.
+type lanes struct {
+	mu      sync.Mutex
+	running int // Writes let through and not yet done
+	arrived uint64
+	waiting [2][]*laneWaiter // By lane, in order of arrival
+}
+
+// enter waits for the turn of a write of key in bucket, or of the whole
+// bucket if key is empty, in the urgent lane if urgent is set, unless the
+// deadline of ctx passes first, as for lock. It returns the function
+// ending the turn, to be called once the write is done.
+func (l *lanes) enter(ctx context.Context, urgent bool, bucket, key string) (leave func(), err error) {
+	return l.wait(ctx, urgent, &laneWaiter{bucket: bucket, key: key})
+}
+
+// enterPrefix is enter for a write of the keys in bucket starting with
+// prefix, such as a batch of a deletion by prefix.
+func (l *lanes) enterPrefix(ctx context.Context, urgent bool, bucket, prefix string) (leave func(), err error) {
+	return l.wait(ctx, urgent, &laneWaiter{bucket: bucket, key: prefix, prefix: true})
+}
+
+// wait waits for the turn of the write w, for enter.
+func (l *lanes) wait(ctx context.Context, urgent bool, w *laneWaiter) (leave func(), err error) {
+	l.mu.Lock()
+
+	if l.running < maxLaneWriters {
+		l.running++
+		l.mu.Unlock()
+
+		return l.leave, nil
+	}
+
+	lane := laneNormal
+	if urgent {
+		lane = laneUrgent
+	}
+
+	w.ticket, w.admitted = l.arrived, make(chan struct{})
+	l.arrived++
+	l.waiting[lane] = append(l.waiting[lane], w)
+	laneDepth.WithLabelValues(laneNames[lane]).Inc()
+
+	l.mu.Unlock()
+
+	// As for the locks, only a deadline gives up the wait
+	var done <-chan struct{}
+	if _, ok := ctx.Deadline(); ok {
+		done = ctx.Done()
+	}
+
+	select {
+	case <-w.admitted:
+		return l.leave, nil
+	case <-done:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if i := slices.Index(l.waiting[lane], w); i >= 0 {
+		l.waiting[lane] = slices.Delete(l.waiting[lane], i, i+1)
+		laneDepth.WithLabelValues(laneNames[lane]).Dec()
+	} else {
+		// Let through meanwhile, so the turn goes to the next write
+		l.running--
+		l.admit()
+	}
+
+	return nil, phaseError(PhaseLockWait, ctx.Err())
+}
+
+// leave ends the turn of a write, letting the next one through.
+func (l *lanes) leave() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.running--
+	l.admit()
+}
+
+// admit lets waiting writes through while there's room. The caller must
+// hold l.mu.
+func (l *lanes) admit() {
+	for l.running < maxLaneWriters {
+		lane, i := l.next()
+		if i < 0 {
+			return
+		}
+
+		w := l.waiting[lane][i]
+		if i == 0 {
+			l.waiting[lane] = l.waiting[lane][1:]
+		} else {
+			l.waiting[lane] = slices.Delete(l.waiting[lane], i, i+1)
+		}
+		laneDepth.WithLabelValues(laneNames[lane]).Dec()
+
+		l.running++
+		close(w.admitted)
+	}
+}
+
+// next returns the lane and index of the write to let through next, with
+// an index of -1 if none is waiting: the first urgent write not held back
+// by an earlier normal write of its key, else the first normal write.
+func (l *lanes) next() (lane, i int) {
+	for i, u := range l.waiting[laneUrgent] {
+		if !l.heldBack(u) {
+			return laneUrgent, i
+		}
+	}
+
+	if len(l.waiting[laneNormal]) > 0 {
+		return laneNormal, 0
+	}
+
+	return laneNormal, -1
+}
+
+// heldBack reports whether a normal write that arrived before the urgent
+// write u, and that u must follow, is still waiting.
+func (l *lanes) heldBack(u *laneWaiter) bool {
+	for _, w := range l.waiting[laneNormal] {
+		if w.ticket > u.ticket {
+			return false
+		}
+		if u.follows(w) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,309 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// depth returns the number of writes waiting in lane, as the gauge has it.
+func depth(lane int) float64 {
+	return testutil.ToFloat64(laneDepth.WithLabelValues(laneNames[lane]))
+}
+
+// waitUntil polls cond until it holds, failing the test after a while.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLanesLetUrgentWritesAheadSaveOfTheirKey(t *testing.T) {
+	ctx := context.Background()
+
+	var l lanes
+
+	// Every turn is taken, so the writes below wait
+	leaves := make([]func(), maxLaneWriters)
+	for i := range leaves {
+		leave, err := l.enter(ctx, false, DefaultBucket, fmt.Sprintf("running%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves[i] = leave
+	}
+
+	normal, urgent := depth(laneNormal), depth(laneUrgent)
+
+	// queue has a write wait in its lane, sending its name once let through,
+	// and returns once it's waiting
+	admitted := make(chan string, 8)
+	queued := 0
+	queue := func(name string, urgent bool, bucket, key string) {
+		go func() {
+			if _, err := l.enter(ctx, urgent, bucket, key); err != nil {
+				t.Error(err)
+			}
+			admitted <- name
+		}()
+
+		queued++
+		waitUntil(t, name+" to wait", func() bool {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			return len(l.waiting[laneNormal])+len(l.waiting[laneUrgent]) == queued
+		})
+	}
+
+	queue("normal a", false, DefaultBucket, "a")
+	queue("normal b", false, DefaultBucket, "b")
+	queue("urgent c", true, DefaultBucket, "c")
+	queue("urgent a", true, DefaultBucket, "a")
+
+	if n := depth(laneNormal) - normal; n != 2 {
+		t.Errorf("the normal lane's depth rose by %v, want 2", n)
+	}
+	if n := depth(laneUrgent) - urgent; n != 2 {
+		t.Errorf("the urgent lane's depth rose by %v, want 2", n)
+	}
+
+	// The urgent write of c goes first; that of a waits for the normal write
+	// of a that arrived before it, and goes before the normal write of b
+	for i, want := range []string{"urgent c", "normal a", "urgent a", "normal b"} {
+		leaves[i]()
+
+		select {
+		case got := <-admitted:
+			if got != want {
+				t.Errorf("let through #%d: %s, want %s", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nothing let through for %s", want)
+		}
+	}
+
+	if normal, urgent := depth(laneNormal)-normal, depth(laneUrgent)-urgent; normal != 0 || urgent != 0 {
+		t.Errorf("the lanes' depths rose by %v normal and %v urgent once empty", normal, urgent)
+	}
+
+	// A write of the whole bucket keeps its place after those of its keys,
+	// but not after those of other buckets
+	queued = 0
+	queue("normal d", false, DefaultBucket, "d")
+	queue("urgent drop", true, DefaultBucket, "")
+	queue("urgent other", true, "other", "d")
+
+	for i, want := range []string{"urgent other", "normal d", "urgent drop"} {
+		leaves[4+i]()
+
+		if got := <-admitted; got != want {
+			t.Errorf("let through after the drop was queued #%d: %s, want %s", i, got, want)
+		}
+	}
+
+	// A write whose deadline passes while it waits gives up its place
+	dctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+
+	_, err := l.enter(dctx, false, DefaultBucket, "late")
+	var de *DeadlineError
+	if !errors.As(err, &de) || de.Phase != PhaseLockWait {
+		t.Errorf("a wait past its deadline: %v", err)
+	}
+	if len(l.waiting[laneNormal]) != 0 || depth(laneNormal) != normal {
+		t.Errorf("a write that gave up is still waiting: %d", len(l.waiting[laneNormal]))
+	}
+}
+
+func TestLaneWaiterFollows(t *testing.T) {
+	for _, test := range []struct {
+		w, earlier laneWaiter
+		follows    bool
+	}{
+		{laneWaiter{bucket: "b", key: "a"}, laneWaiter{bucket: "b", key: "a"}, true},
+		{laneWaiter{bucket: "b", key: "a"}, laneWaiter{bucket: "b", key: "ab"}, false},
+		{laneWaiter{bucket: "b", key: "a"}, laneWaiter{bucket: "other", key: "a"}, false},
+		{laneWaiter{bucket: "b", key: ""}, laneWaiter{bucket: "b", key: "a"}, true},
+		{laneWaiter{bucket: "b", key: "a"}, laneWaiter{bucket: "b", key: ""}, true},
+		{laneWaiter{bucket: "b", key: "a/", prefix: true}, laneWaiter{bucket: "b", key: "a/x"}, true},
+		{laneWaiter{bucket: "b", key: "a/x"}, laneWaiter{bucket: "b", key: "a/", prefix: true}, true},
+		{laneWaiter{bucket: "b", key: "a/", prefix: true}, laneWaiter{bucket: "b", key: "a"}, false},
+		{laneWaiter{bucket: "b", key: "a/", prefix: true}, laneWaiter{bucket: "b", key: "a/x/", prefix: true}, true},
+		{laneWaiter{bucket: "b", key: "a/", prefix: true}, laneWaiter{bucket: "b", key: "b/", prefix: true}, false},
+		{laneWaiter{bucket: "b", key: "", prefix: true}, laneWaiter{bucket: "b", key: "a"}, true},
+	} {
+		if got := test.w.follows(&test.earlier); got != test.follows {
+			t.Errorf("%+v follows %+v: %t, want %t", test.w, test.earlier, got, test.follows)
+		}
+	}
+}
+
+func TestUrgentPrefixDeleteOvertakesQueuedPuts(t *testing.T) {
+	ctx := context.Background()
+
+	s := New(&stubLogger{}, Options{})
+	for _, key := range []string{"secret/1", "secret/2", "k"} {
+		if err := s.PutCtx(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every turn is taken, so the writes below wait
+	leaves := make([]func(), maxLaneWriters)
+	for i := range leaves {
+		leave, err := s.lanes.enter(ctx, false, DefaultBucket, fmt.Sprintf("running%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves[i] = leave
+	}
+	defer func() {
+		for _, leave := range leaves[1:] {
+			leave()
+		}
+	}()
+
+	// queue has write wait in its lane, sending name once it's done, and
+	// returns once it's waiting
+	done := make(chan string, 3)
+	queued := 0
+	queue := func(name string, write func() error) {
+		go func() {
+			if err := write(); err != nil {
+				t.Error(err)
+			}
+			done <- name
+		}()
+
+		queued++
+		waitUntil(t, name+" to wait", func() bool {
+			s.lanes.mu.Lock()
+			defer s.lanes.mu.Unlock()
+
+			return len(s.lanes.waiting[laneNormal])+len(s.lanes.waiting[laneUrgent]) == queued
+		})
+	}
+
+	queue("put of secret/3", func() error { return s.PutCtx(ctx, "secret/3", "v") })
+	queue("put of k", func() error { return s.PutCtx(ctx, "k", "changed") })
+	queue("prefix delete", func() error {
+		n, err := s.DeleteByPrefix(WithUrgency(ctx), "secret/")
+		if n != 2 {
+			t.Errorf("the prefix delete removed %d keys, want the 2 there when it was made", n)
+		}
+		return err
+	})
+
+	// The delete waits for the put of one of its keys that arrived before
+	// it, but goes ahead of that of another key
+	leaves[0]()
+	for i, want := range []string{"put of secret/3", "prefix delete", "put of k"} {
+		select {
+		case got := <-done:
+			if got != want {
+				t.Errorf("done #%d: %s, want %s", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nothing done for %s", want)
+		}
+	}
+}
+
+// flushLogger is a stubLogger noting how many events were logged as of its
+// last flush.
+type flushLogger struct {
+	stubLogger
+
+	flushed atomic.Int64
+}
+
+func (l *flushLogger) Flush(ctx context.Context) error {
+	l.flushed.Store(int64(len(l.logged())))
+	return nil
+}
+
+func TestUrgentDeleteOvertakesQueuedPuts(t *testing.T) {
+	ctx := context.Background()
+
+	// Each event takes a while to log, so the puts queue up for their turns,
+	// until the urgent delete is done
+	var slow atomic.Bool
+	slow.Store(true)
+
+	l := &flushLogger{}
+	l.write = func(context.Context, translog.Event) error {
+		if slow.Load() {
+			time.Sleep(50 * time.Microsecond)
+		}
+		return nil
+	}
+	s := New(l, Options{})
+
+	if err := s.PutCtx(ctx, "secret", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	const puts = 10000
+	normal := depth(laneNormal)
+
+	var done atomic.Int64
+	var wg sync.WaitGroup
+	for i := range puts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := s.PutCtx(ctx, fmt.Sprintf("k%d", i), "v"); err != nil {
+				t.Error(err)
+			}
+			done.Add(1)
+		}()
+	}
+	defer wg.Wait()
+
+	waitUntil(t, "the puts to queue", func() bool { return depth(laneNormal)-normal >= puts/2 })
+
+	start := time.Now()
+	if err := s.DeleteCtx(WithUrgency(ctx), "secret"); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	slow.Store(false)
+	t.Logf("the urgent delete was durable after %s, with %d of %d puts done", elapsed, done.Load(), puts)
+
+	if n := done.Load(); n >= puts/2 {
+		t.Errorf("the urgent delete returned after %d of %d puts queued before it", n, puts)
+	}
+	if elapsed >= time.Second {
+		t.Errorf("the urgent delete took %s", elapsed)
+	}
+
+	// It was flushed before it returned
+	events := l.logged()
+	at := -1
+	for i, e := range events {
+		if e.EventType == translog.EventDelete && e.Key == "secret" {
+			at = i
+		}
+	}
+	if at < 0 || l.flushed.Load() <= int64(at) {
+		t.Errorf("the urgent delete, event #%d, wasn't flushed: flushed through %d", at, l.flushed.Load())
+	}
+
+	if _, err := s.Get("secret"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Get of the deleted key: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"time"
+)
+
+// ErrorLeased is returned for writes to a key leased to another owner, and
+// for releases of its lease.
+var ErrorLeased = errors.New("key is leased to another owner")
+
+// ErrorInvalidLease is returned for leases without an owner or a positive
+// duration.
+var ErrorInvalidLease = errors.New("invalid lease")
+
+// Lease is a time-boxed claim on a key. While it lasts, only its owner may
+// write the key; the store's bulk deletions, which are for admins, ignore
+// it.
+type Lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// live reports whether l still holds at now.
+func (l Lease) live(now time.Time) bool {
+	return l.Owner != "" && now.Before(l.Expires)
+}
+
+// leaseOwnerKey is the context key of the owner writes are made by.
+type leaseOwnerKey struct{}
+
+// WithLeaseOwner returns a context under which writes are made by owner, and
+// so are allowed to the keys it leases. Writes made under no owner are
+// refused for every leased key.
+func WithLeaseOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, leaseOwnerKey{}, owner)
+}
+
+func leaseOwner(ctx context.Context) string {
+	owner, _ := ctx.Value(leaseOwnerKey{}).(string)
+
+	return owner
+}
+
+// checkLease returns ErrorLeased if e, the entry of key, is leased to
+// someone other than the owner of ctx.
+func checkLease(ctx context.Context, bucket, key string, e entry) error {
+	if !e.lease.live(time.Now()) || e.lease.Owner == leaseOwner(ctx) {
+		return nil
+	}
+
+	return fmt.Errorf("%w until %s: key %q in bucket %q", ErrorLeased, e.lease.Expires.Format(time.RFC3339), key, bucket)
+}
+
+// AcquireLease is BucketAcquireLease for a key in the default bucket.
+func (s *Store) AcquireLease(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	_, ok, err := s.BucketAcquireLease(ctx, DefaultBucket, key, owner, ttl)
+
+	return ok, err
+}
+
+// BucketAcquireLease leases key to owner for ttl, and reports whether it
+// did, with the key's lease afterwards: owner's, or that of the owner
+// holding it. A key can be leased if it isn't, if its lease expired, or if
+// owner holds it already, which renews the lease. The key must exist.
+//
+// The lease is logged with its deadline, so a restart or a follower doesn't
+// grant it to anyone else before it expires.
+func (s *Store) BucketAcquireLease(ctx context.Context, bucket, key, owner string, ttl time.Duration) (l Lease, acquired bool, err error) {
+	if err := validate(bucket, key); err != nil {
+		return l, false, err
+	}
+
+	key = s.foldKey(key)
+
+	ctx, span := tracing.Start(ctx, "store.AcquireLease", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	if owner == "" || ttl <= 0 {
+		return l, false, fmt.Errorf("%w: a lease needs an owner and a positive duration", ErrorInvalidLease)
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return l, false, err
+	}
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return l, false, ErrorReadOnly
+	}
+
+	e, ok, err := s.lookupForWrite(ctx, bucket, key)
+	if err != nil {
+		return l, false, err
+	}
+	if !ok {
+		return l, false, ErrorNoSuchKey
+	}
+
+	now := time.Now()
+	if e.lease.live(now) && e.lease.Owner != owner {
+		return e.lease, false, nil
+	}
+
+	l = Lease{Owner: owner, Expires: now.Add(ttl)}
+
+	ev := translog.Event{EventType: translog.EventLease, Bucket: bucket, Key: key, Value: translog.FormatLease(l.Owner, l.Expires)}
+	err = s.log(ctx, ev)
+	if !logged(err) {
+		return Lease{}, false, err
+	}
+
+	s.setLease(bucket, key, l)
+
+	return l, true, err
+}
+
+// ReleaseLease is BucketReleaseLease for a key in the default bucket.
+func (s *Store) ReleaseLease(ctx context.Context, key, owner string) error {
+	return s.BucketReleaseLease(ctx, DefaultBucket, key, owner)
+}
+
+// BucketReleaseLease ends the lease owner holds on key. A key that isn't
+// leased, or whose lease expired, is left as it is; one leased to another
+// owner fails with ErrorLeased.
+func (s *Store) BucketReleaseLease(ctx context.Context, bucket, key, owner string) (err error) {
+	if err := validate(bucket, key); err != nil {
+		return err
+	}
+
+	key = s.foldKey(key)
+
+	ctx, span := tracing.Start(ctx, "store.ReleaseLease", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	ctx = WithUrgency(ctx)
+
+	leave, err := s.lanes.enter(ctx, true, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrorReadOnly
+	}
+
+	// Leases are only ever on cached keys
+	e, ok := s.lookup(bucket, key)
+	if !ok || !e.lease.live(time.Now()) {
+		return nil
+	}
+
+	if err := checkLease(WithLeaseOwner(ctx, owner), bucket, key, e); err != nil {
+		return err
+	}
+
+	ev := translog.Event{EventType: translog.EventLease, Bucket: bucket, Key: key}
+	err = s.log(ctx, ev)
+	if !logged(err) {
+		return err
+	}
+
+	s.setLease(bucket, key, Lease{})
+
+	return err
+}
+
+// setLease puts l on the entry of key, if it has one, leaving its value and
+// metadata as they are. The caller must hold the write lock.
+func (s *Store) setLease(bucket, key string, l Lease) {
+	e, ok := s.lookup(bucket, key)
+	if !ok {
+		return
+	}
+
+	e.lease = l
+	s.m.set(bucket, key, e)
+	s.epoch.Add(1)
+	s.renaming.touch(bucket, key)
+}
+
+// applyLease applies a lease event read from the log or a leader. A lease
+// that expired since is applied all the same, and then ignored. The caller
+// must hold the write lock.
+func (s *Store) applyLease(e translog.Event) error {
+	var l Lease
+
+	if e.Value != "" {
+		var err error
+		if l.Owner, l.Expires, err = translog.ParseLease(e.Value); err != nil {
+			return fmt.Errorf("key %q in bucket %q: %w", e.Key, e.Bucket, err)
+		}
+	}
+
+	s.setLease(e.Bucket, e.Key, l)
+
+	return nil
+}
+
+// ReapLeases clears the leases expired at now, and returns how many it
+// cleared. Expired leases are already ignored, so this only frees them, and
+// isn't logged.
+func (s *Store) ReapLeases(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			if e.lease.Owner != "" && !e.lease.live(now) {
+				e.lease = Lease{}
+				s.m.set(bucket, key, e)
+				n++
+			}
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOneLeaseWinnerPerTerm(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+	if err := s.PutCtx(ctx, "job", "pending"); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		claimants = 50
+		terms     = 5
+		ttl       = 100 * time.Millisecond
+	)
+
+	// Each term, every claimant tries at once, once the last term's lease
+	// expired, and exactly one gets it
+	for term := range terms {
+		var (
+			wg      sync.WaitGroup
+			start   = make(chan struct{})
+			mu      sync.Mutex
+			winners []string
+		)
+
+		for i := range claimants {
+			owner := fmt.Sprintf("worker-%d-%d", term, i)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				ok, err := s.AcquireLease(ctx, "job", owner, ttl)
+				if err != nil {
+					t.Errorf("%s claiming job: %v", owner, err)
+				}
+				if ok {
+					mu.Lock()
+					winners = append(winners, owner)
+					mu.Unlock()
+				}
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+
+		if len(winners) != 1 {
+			t.Fatalf("term %d had winners %v", term, winners)
+		}
+
+		// Only the winner may write the key, or release it
+		if err := s.PutCtx(ctx, "job", "stolen"); !errors.Is(err, ErrorLeased) {
+			t.Errorf("term %d: a write by no owner: %v", term, err)
+		}
+		if err := s.PutCtx(WithLeaseOwner(ctx, winners[0]), "job", fmt.Sprintf("done by %s", winners[0])); err != nil {
+			t.Errorf("term %d: a write by the winner: %v", term, err)
+		}
+		if err := s.ReleaseLease(ctx, "job", "someone else"); !errors.Is(err, ErrorLeased) {
+			t.Errorf("term %d: a release by another owner: %v", term, err)
+		}
+
+		time.Sleep(ttl)
+	}
+
+	// A lease taken before a restart still holds after it, and expires when
+	// it would have
+	if ok, err := s.AcquireLease(ctx, "job", "before", time.Second); !ok || err != nil {
+		t.Fatalf("claiming job before the restart: %v, %v", ok, err)
+	}
+	closeLog()
+
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if ok, err := s.AcquireLease(ctx, "job", "after", time.Second); ok || err != nil {
+		t.Errorf("claiming job leased before the restart: %v, %v", ok, err)
+	}
+	if n := s.ReapLeases(time.Now()); n != 0 {
+		t.Errorf("reaped %d leases still held", n)
+	}
+	if n := s.ReapLeases(time.Now().Add(2 * time.Second)); n != 1 {
+		t.Errorf("reaped %d expired leases, want 1", n)
+	}
+	if err := s.PutCtx(ctx, "job", "free"); err != nil {
+		t.Errorf("a write once the lease was reaped: %v", err)
+	}
+
+	// A released lease can be taken at once
+	if ok, err := s.AcquireLease(ctx, "job", "next", time.Minute); !ok || err != nil {
+		t.Fatalf("claiming job: %v, %v", ok, err)
+	}
+	if err := s.ReleaseLease(ctx, "job", "next"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.AcquireLease(ctx, "job", "after", time.Minute); !ok || err != nil {
+		t.Errorf("claiming job after its release: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Orders BucketList sorts keys by.
+const (
+	OrderKey      = "key"      // Lexical order of the keys
+	OrderSize     = "size"     // Size of the values as stored
+	OrderModified = "modified" // Time of the last write
+)
+
+// ListOrders are the orders BucketList sorts keys by.
+var ListOrders = []string{OrderKey, OrderSize, OrderModified}
+
+// ListOrder is how BucketList sorts keys: by one of ListOrders, ties being
+// broken by key so that the order is total, ascending unless Descending.
+type ListOrder struct {
+	By         string
+	Descending bool
+}
+
+// Less reports whether a comes before b in the order.
+func (o ListOrder) Less(a, b KeyInfo) bool {
+	if o.Descending {
+		a, b = b, a
+	}
+
+	switch o.By {
+	case OrderSize:
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case OrderModified:
+		if !a.Modified.Equal(b.Modified) {
+			return a.Modified.Before(b.Modified)
+		}
+	}
+
+	return a.Key < b.Key
+}
+
+// KeyInfo describes a key listed by BucketList, without its value.
+type KeyInfo struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"` // Bytes of the value as stored, compressed or encrypted
+	Version  uint64    `json:"version"`
+	Modified time.Time `json:"modified"`
+}
+
+// BucketList returns the keys in the named bucket that start with prefix,
+// with their size and metadata, sorted in order, and the sequence of the
+// last event applied when they were listed. The keys are copied under the
+// read lock, so the listing is a snapshot of the bucket, and sorted once
+// the lock is released. Under Options.KeyFolding, the prefix is folded and
+// the keys are returned folded, as by BucketKeys.
+func (s *Store) BucketList(ctx context.Context, bucket, prefix string, order ListOrder) ([]KeyInfo, uint64, error) {
+	if err := s.loadForRead(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	prefix = s.foldKey(prefix)
+
+	if err := s.rlockScan(ctx); err != nil {
+		return nil, 0, err
+	}
+	var infos []KeyInfo
+	n, now := 0, time.Now()
+	for key, e := range s.m.bucket(bucket) {
+		if err := scanDeadline(ctx, n); err != nil {
+			s.runlockScan()
+			return nil, 0, err
+		}
+		n++
+
+		if strings.HasPrefix(key, prefix) && !e.meta.expired(now) {
+			infos = append(infos, KeyInfo{key, storedSize(e), e.meta.Version, e.meta.Modified})
+		}
+	}
+	seq := s.seq.load()
+	s.runlockScan()
+
+	slices.SortFunc(infos, func(a, b KeyInfo) int {
+		switch {
+		case order.Less(a, b):
+			return -1
+		case order.Less(b, a):
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return infos, seq, nil
+}
+
+// ListAfter returns the keys of infos, sorted in order, that come after
+// after in it. after needn't be one of infos: keys are paged through by
+// the position of the last one seen in the order, which holds even once
+// that key has changed or gone.
+func ListAfter(infos []KeyInfo, order ListOrder, after KeyInfo) []KeyInfo {
+	i := sort.Search(len(infos), func(i int) bool { return order.Less(after, infos[i]) })
+
+	return infos[i:]
+}
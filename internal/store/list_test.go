@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestKeysPages(t *testing.T) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(t, t.TempDir(), Options{})
+	defer closeLog()
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "other"} {
+		if err := s.PutCtx(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BucketPut(ctx, "b2", "a2", "v"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "b", "c", "d", "e", "f"}
+
+	// all pages through the keys of the default bucket, limit at a time,
+	// returning those but other and the number of pages
+	all := func(limit int) ([]string, int) {
+		t.Helper()
+
+		var keys []string
+		var cursor string
+		pages := 0
+		for {
+			page, next, err := s.Keys(ctx, "", cursor, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages++
+
+			for _, k := range page {
+				if k != "other" {
+					keys = append(keys, k)
+				}
+			}
+			if next == "" {
+				return keys, pages
+			}
+			if next != page[len(page)-1] {
+				t.Fatalf("next cursor %q, want the last key of %v", next, page)
+			}
+			cursor = next
+		}
+	}
+
+	for _, test := range []struct {
+		limit, pages int
+	}{
+		{0, 1},  // Every key
+		{-1, 1}, // Likewise
+		{3, 3},  // The last page holds other alone
+		{7, 1},  // An exact fit has no next page
+		{6, 2},
+		{8, 1},
+	} {
+		if keys, pages := all(test.limit); !slices.Equal(keys, want) || pages != test.pages {
+			t.Errorf("by %d: %v in %d pages, want %v in %d", test.limit, keys, pages, want, test.pages)
+		}
+	}
+
+	// An exact fit is the last page
+	if keys, next, err := s.Keys(ctx, "", "d", 3); err != nil || fmt.Sprint(keys) != "[e f other]" || next != "" {
+		t.Errorf("the three keys after d by 3: %v, next %q, %v", keys, next, err)
+	}
+
+	if keys, next, err := s.BucketKeysPage(ctx, "b2", "", "", 10); err != nil || fmt.Sprint(keys) != "[a2]" || next != "" {
+		t.Errorf("bucket b2: %v, next %q, %v", keys, next, err)
+	}
+	if keys, _, err := s.Keys(ctx, "o", "", 0); err != nil || fmt.Sprint(keys) != "[other]" {
+		t.Errorf("prefix o: %v, %v", keys, err)
+	}
+
+	// Keys deleted and put between pages leave the others listed once
+	page, next, err := s.Keys(ctx, "", "", 2)
+	if err != nil || fmt.Sprint(page) != "[a b]" || next != "b" {
+		t.Fatalf("first page %v, next %q, %v", page, next, err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if err := s.DeleteCtx(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"aa", "ca"} {
+		if err := s.PutCtx(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, next, err = s.Keys(ctx, "", next, 2)
+	if err != nil || fmt.Sprint(page) != "[ca d]" || next != "d" {
+		t.Errorf("the page after the cursor's key was deleted: %v, next %q, %v; want [ca d]", page, next, err)
+	}
+	page, next, err = s.Keys(ctx, "", next, 0)
+	if err != nil || fmt.Sprint(page) != "[e f other]" || next != "" {
+		t.Errorf("the rest: %v, next %q, %v", page, next, err)
+	}
+}
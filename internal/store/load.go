@@ -0,0 +1,164 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotFileName is the name of the snapshot in a data directory, which
+// is where a backup restores it.
+const SnapshotFileName = "snapshot.jsonl"
+
+// ReplayLimit bounds the events LoadUntil applies, for point-in-time
+// recovery. Replay stops at the first event past either bound, so the store
+// always ends up with a prefix of the log.
+type ReplayLimit struct {
+	Sequence uint64    // Last event to apply; 0 is unbounded
+	Time     time.Time // Latest time of an event to apply; zero is unbounded
+}
+
+// IsZero reports whether l leaves replay unbounded.
+func (l ReplayLimit) IsZero() bool {
+	return l.Sequence == 0 && l.Time.IsZero()
+}
+
+// includes reports whether e is within l. Events logged before timestamps
+// existed have none; they precede every timestamped event, so they are
+// within any time bound.
+func (l ReplayLimit) includes(e translog.Event) bool {
+	if l.Sequence != 0 && e.Sequence > l.Sequence {
+		return false
+	}
+
+	return l.Time.IsZero() || e.Time.IsZero() || !e.Time.After(l.Time)
+}
+
+// ReplayStats describes what LoadUntil read.
+type ReplayStats struct {
+	Events    int    // Events applied from the log
+	PastLimit int    // Events past the replay limit, left unapplied
+	Gaps      int    // Places where the log skips sequence numbers
+	First     uint64 // Sequence of the first event applied; 0 if none was
+}
+
+// Load restores the snapshot in dataDir, if there is one, then applies
+// every event read from logger that came after it. It must be called before
+// the logger is started, and blocks until all data is read.
+func (s *Store) Load(dataDir string, logger translog.TransactionLogger) error {
+	_, err := s.LoadUntil(dataDir, logger, ReplayLimit{})
+
+	return err
+}
+
+// LoadUntil is like Load, but stops applying events at the first one past
+// limit. It returns what was read, including the number of events left
+// unapplied. A snapshot taken after the limit can't be rewound, so it is an
+// error.
+func (s *Store) LoadUntil(dataDir string, logger translog.TransactionLogger, limit ReplayLimit) (ReplayStats, error) {
+	var stats ReplayStats
+
+	f, err := os.Open(filepath.Join(dataDir, SnapshotFileName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return stats, err
+	default:
+		var header SnapshotHeader
+		if s.opts.PageValues {
+			// The values are paged in from f for as long as it's indexed
+			header, err = s.index(f)
+			if err != nil {
+				f.Close()
+			}
+		} else {
+			header, err = s.restore(f)
+			f.Close()
+		}
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+
+		if limit.Sequence != 0 && header.Sequence > limit.Sequence ||
+			!limit.Time.IsZero() && header.Time.After(limit.Time) {
+			return stats, fmt.Errorf("%s: snapshot at sequence %d taken %s is past the replay limit",
+				f.Name(), header.Sequence, header.Time.Format(time.RFC3339))
+		}
+	}
+
+	// A compacted log continues from its snapshot, so the two must have
+	// been written together
+	meta, err := translog.ReadLogMeta(filepath.Join(dataDir, translog.LogFileName))
+	if err != nil {
+		return stats, err
+	}
+	if meta.After != 0 && meta.After != s.Sequence() {
+		return stats, fmt.Errorf("%s: the log continues from sequence %d, but the snapshot is at %d",
+			translog.MetaFileName, meta.After, s.Sequence())
+	}
+
+	stats, err = s.replay(logger, limit)
+	if err != nil {
+		return stats, err
+	}
+
+	// Writes are numbered by the store, so it must resume after any
+	// sequence the logger already numbered, including those of events no
+	// longer in the log, or the numbers seen by followers and resuming
+	// watchers would be reused. A store rewound to a limit doesn't write.
+	if seq, ok := logger.(translog.Sequencer); ok && limit.IsZero() {
+		s.mu.Lock()
+		s.seq.raise(seq.LastSequence())
+		s.mu.Unlock()
+	}
+
+	return stats, nil
+}
+
+// replay applies the events read from logger within limit, skipping those
+// already included in a snapshot the store was restored from.
+func (s *Store) replay(logger translog.TransactionLogger, limit ReplayLimit) (ReplayStats, error) {
+	events, errors := logger.ReadEvents()
+
+	var err error
+	var stats ReplayStats
+	e := translog.Event{}
+	ok := true
+	after := s.Sequence()
+
+	// Events past the limit are still read, so the reader runs to the end
+	for ok && err == nil {
+		select {
+		case err, ok = <-errors: // Retrieve any errors; ok = false if channel has
+		case e, ok = <-events: // been closed
+			switch {
+			case !ok || e.Sequence <= after:
+			case stats.PastLimit > 0 || !limit.includes(e):
+				stats.PastLimit++
+			default:
+				if after != 0 && e.Sequence > after+1 {
+					stats.Gaps++
+				}
+				if stats.First == 0 {
+					stats.First = e.Sequence
+				}
+
+				err = s.ApplyEvent(e)
+				stats.Events++
+				after = e.Sequence
+			}
+		}
+	}
+
+	// The reader closes both channels after reporting a failure, so the
+	// loop can see the events channel close before the error arrives
+	if err == nil {
+		err = <-errors
+	}
+
+	return stats, err
+}
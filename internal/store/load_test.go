@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compact replaces the log in dir with a snapshot of s, as a compaction
+// does: the snapshot holds every event so far, and the log starts empty
+// after it.
+func compact(t *testing.T, dir string, s *Store) {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(dir, SnapshotFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, translog.LogFileName)
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := translog.WriteLogMeta(path, translog.LogMeta{After: s.Sequence(), HighWater: s.Sequence()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keyValues returns the keys k0 to k9 of s that are set, with their values.
+func keyValues(s *Store) string {
+	var b strings.Builder
+	for i := range 10 {
+		if v, err := s.Get(fmt.Sprintf("k%d", i)); err == nil {
+			fmt.Fprintf(&b, "k%d=%s ", i, v)
+		}
+	}
+
+	return b.String()
+}
+
+func TestRestartFromSnapshotAndTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+	for i := range 30 {
+		if err := s.PutCtx(ctx, fmt.Sprintf("k%d", i%10), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeLog()
+
+	compact(t, dir, s)
+
+	// The tail is written after the snapshot, numbered on from it
+	s, closeLog = openLogged(t, dir, Options{})
+	if s.Sequence() != 30 {
+		t.Fatalf("restored from the snapshot at sequence %d, want 30", s.Sequence())
+	}
+	for i := 30; i < 45; i++ {
+		if err := s.PutCtx(ctx, fmt.Sprintf("k%d", i%10), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteCtx(ctx, "k0"); err != nil {
+		t.Fatal(err)
+	}
+	want := keyValues(s)
+	closeLog()
+
+	// A restart restores the snapshot, then replays the tail after it
+	s, closeLog = openLogged(t, dir, Options{})
+	if got := keyValues(s); got != want || s.Sequence() != 46 {
+		t.Errorf("restarted at %d with %s, want 46 with %s", s.Sequence(), got, want)
+	}
+	if err := s.PutCtx(ctx, "k0", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Sequence() != 47 {
+		t.Errorf("the write after the restart got sequence %d, want 47", s.Sequence())
+	}
+	closeLog()
+
+	// A log continuing from somewhere else than the snapshot is refused
+	// rather than replayed on top of it
+	if err := translog.WriteLogMeta(filepath.Join(dir, translog.LogFileName), translog.LogMeta{After: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(ctx)
+
+	if err := New(l, Options{}).Load(dir, l); err == nil || !strings.Contains(err.Error(), "continues from sequence 20, but the snapshot is at 30") {
+		t.Errorf("loading a snapshot with a log continuing from elsewhere: %v", err)
+	}
+}
+
+func TestWritesNumberedAfterLostEvents(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, translog.LogFileName)
+
+	s, closeLog := openLogged(t, dir, Options{})
+	for i := range 3 {
+		if err := s.PutCtx(ctx, fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeLog()
+
+	// A crash tears the last event, which followers may already have seen
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	s, closeLog = openLogged(t, dir, Options{})
+	if _, err := s.Get("k2"); err != ErrorNoSuchKey {
+		t.Errorf("GET k2, torn from the log: %v", err)
+	}
+	if err := s.PutCtx(ctx, "k3", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Sequence() != 4 {
+		t.Errorf("the write after the torn event got sequence %d, want 4", s.Sequence())
+	}
+	closeLog()
+
+	// Compacted, then restarted, the store numbers on from there
+	compact(t, dir, s)
+
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if err := s.PutCtx(ctx, "k4", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keyValues(s); got != "k0=v k1=v k3=v k4=v " || s.Sequence() != 5 {
+		t.Errorf("after compaction and a restart: %s at sequence %d, want 5", got, s.Sequence())
+	}
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// duplicateWrites returns n puts over keys keys, of which about nine in ten
+// set a key to the value it already has.
+func duplicateWrites(n, keys int) []Record {
+	r := rand.New(rand.NewPCG(1, 2))
+	current := make(map[string]string)
+
+	writes := make([]Record, n)
+	for i := range writes {
+		key := fmt.Sprintf("k%d", r.IntN(keys))
+
+		value, ok := current[key]
+		if !ok || r.IntN(10) == 0 {
+			value = fmt.Sprintf("value %d", i)
+			current[key] = value
+		}
+
+		writes[i] = Record{Key: key, Value: value}
+	}
+
+	return writes
+}
+
+func TestSkipNoopWrites(t *testing.T) {
+	ctx := context.Background()
+	skipDir, allDir := t.TempDir(), t.TempDir()
+
+	skip, closeSkip := openLogged(t, skipDir, Options{SkipNoopWrites: true})
+	all, closeAll := openLogged(t, allDir, Options{})
+
+	if err := skip.PutCtx(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	_, before, _ := skip.GetWithMeta("k")
+	seq := skip.Sequence()
+
+	// A put of the value the key has changes nothing, and says so
+	changed, err := skip.BucketPutChanged(ctx, DefaultBucket, "k", "v")
+	if err != nil || changed {
+		t.Errorf("a put of the same value: changed %v, %v", changed, err)
+	}
+	if _, after, _ := skip.GetWithMeta("k"); after != before || skip.Sequence() != seq {
+		t.Errorf("a skipped put took k from %+v at %d to %+v at %d", before, seq, after, skip.Sequence())
+	}
+
+	if changed, err := skip.BucketPutChanged(ctx, DefaultBucket, "k", "w"); err != nil || !changed {
+		t.Errorf("a put of another value: changed %v, %v", changed, err)
+	}
+
+	// Compare-and-swap is unaffected: a swap to the same value is made
+	if swapped, err := skip.CompareAndSwap(ctx, "k", "w", "w"); err != nil || !swapped || skip.Sequence() != seq+2 {
+		t.Errorf("a swap to the same value: %v, %v, at sequence %d", swapped, err, skip.Sequence())
+	}
+
+	// Replaying a log of the writes made leaves the same values as one of
+	// every write
+	for _, w := range duplicateWrites(5000, 50) {
+		for _, s := range []*Store{skip, all} {
+			if err := s.PutCtx(ctx, w.Key, w.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := all.PutCtx(ctx, "k", "w"); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := skip.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := all.Dump(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal("the stores differ before replay")
+	}
+	skipped := skip.Sequence()
+	closeSkip()
+	closeAll()
+
+	skip, closeSkip = openLogged(t, skipDir, Options{SkipNoopWrites: true})
+	defer closeSkip()
+	all, closeAll = openLogged(t, allDir, Options{})
+	defer closeAll()
+
+	for name, s := range map[string]*Store{"skipping": skip, "logging every write": all} {
+		if got, _ := s.Dump(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("the store %s replayed different values", name)
+		}
+	}
+	if skip.Sequence() != skipped || skipped >= all.Sequence() {
+		t.Errorf("replayed to sequence %d skipping, %d logging every write; want %d and more", skip.Sequence(), all.Sequence(), skipped)
+	}
+}
+
+// BenchmarkDuplicateWrites measures the log written for a workload in which
+// nine puts in ten set a key to the value it already has, with and without
+// SkipNoopWrites.
+func BenchmarkDuplicateWrites(b *testing.B) {
+	ctx := context.Background()
+	writes := duplicateWrites(20000, 100)
+
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip=%v", skip), func(b *testing.B) {
+			dir := b.TempDir()
+			s, closeLog := openLogged(b, dir, Options{SkipNoopWrites: skip})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := writes[i%len(writes)]
+				if err := s.PutCtx(ctx, w.Key, w.Value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			closeLog()
+
+			info, err := os.Stat(filepath.Join(dir, translog.LogFileName))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportMetric(float64(info.Size())/float64(b.N), "log-B/op")
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package store
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the notification batches of bulk operations, when Options
+// doesn't set them.
+const (
+	DefaultNotifyRate   = 100              // Per-key wakes a second
+	DefaultNotifyWindow = 10 * time.Second // Longest time a summary covers
+)
+
+// maxPendingWakes bounds the watched keys a notification batch holds for
+// their per-key wake. Past it, the batch wakes every watcher of its keys at
+// once when it ends, as dropping a bucket does.
+const maxPendingWakes = 10000
+
+// summaryBuffer is how many summaries a subscriber may fall behind by
+// before it misses some.
+const summaryBuffer = 16
+
+// BatchSummary describes the changes a bulk operation made over a window,
+// in place of a notification for each key.
+type BatchSummary struct {
+	Op     string `json:"op"`               // "seed" or "delete_prefix"
+	Bucket string `json:"bucket,omitempty"` // Empty if the operation spans buckets
+	Prefix string `json:"prefix,omitempty"`
+	Count  int    `json:"count"` // Keys changed
+
+	// FirstSequence and LastSequence bound the events logged over the
+	// window, which may include others' writes. Both are 0 if none was
+	// logged
+	FirstSequence uint64 `json:"first_sequence,omitempty"`
+	LastSequence  uint64 `json:"last_sequence,omitempty"`
+
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+	Partial bool      `json:"partial,omitempty"` // The operation outlasted the window and more summaries follow
+	Missed  int       `json:"missed,omitempty"`  // Summaries the subscriber missed before this one, having fallen behind
+}
+
+// change is a change of a key waiting for its watchers to be woken.
+type change struct {
+	deleted bool
+	e       entry
+}
+
+// notifyBatch coalesces the notifications of the keys a bulk operation
+// changes. Watchers of those keys are woken at most NotifyRate times a
+// second, and the changes are summed up in a BatchSummary at most every
+// NotifyWindow and when the operation ends.
+type notifyBatch struct {
+	op, bucket, prefix string // Keys covered; an empty bucket covers all of them
+
+	mu       sync.Mutex
+	count    int
+	from     uint64 // Sequence when the window started
+	last     uint64 // Sequence at the latest change
+	started  time.Time
+	pending  map[watchKey]change // Latest change of the watched keys, until they are woken
+	order    []watchKey          // Keys of pending, in the order they changed
+	overflow bool                // Whether watched keys were left out of pending
+	closed   bool
+}
+
+// covers reports whether the batch coalesces the notifications of key.
+func (b *notifyBatch) covers(bucket, key string) bool {
+	return (b.bucket == "" || b.bucket == bucket) && strings.HasPrefix(key, b.prefix)
+}
+
+// record counts a change of k as of seq, and keeps it for the wake of
+// its watchers if it has any.
+func (b *notifyBatch) record(k watchKey, c change, seq uint64, watched bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.count++
+	b.last = seq
+
+	if !watched {
+		return
+	}
+
+	if _, ok := b.pending[k]; !ok {
+		if len(b.pending) >= maxPendingWakes {
+			b.overflow = true
+			return
+		}
+		b.order = append(b.order, k)
+	}
+	b.pending[k] = c
+}
+
+// summary returns the summary of the window ending at now, and starts the
+// next one. The caller must hold b.mu.
+func (b *notifyBatch) summary(now time.Time) BatchSummary {
+	sum := BatchSummary{
+		Op:      b.op,
+		Bucket:  b.bucket,
+		Prefix:  b.prefix,
+		Count:   b.count,
+		Started: b.started,
+		Ended:   now,
+		Partial: !b.closed,
+	}
+
+	if b.last > b.from {
+		sum.FirstSequence, sum.LastSequence = b.from+1, b.last
+		b.from = b.last
+	}
+
+	b.count = 0
+	b.started = now
+
+	return sum
+}
+
+// next returns the next watched key to wake, if any, after publishing the
+// summary of the window to subs if it is due. done is true once the batch
+// is closed and every key is woken.
+func (b *notifyBatch) next(now time.Time, window time.Duration, subs *summaryRegistry) (k watchKey, c change, ok, done bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Summaries are published under b.mu, so that they go out in order
+	if b.count > 0 && now.Sub(b.started) >= window {
+		subs.publish(b.summary(now))
+	}
+
+	if len(b.order) > 0 {
+		k, b.order = b.order[0], b.order[1:]
+		c, ok = b.pending[k]
+		delete(b.pending, k)
+	}
+
+	return k, c, ok, b.closed && len(b.order) == 0
+}
+
+// summarySub is a subscriber to the summaries of the batches covering
+// bucket and prefix.
+type summarySub struct {
+	bucket, prefix string
+	ch             chan BatchSummary
+	missed         int
+}
+
+// wants reports whether the keys sub subscribed to overlap those sum covers.
+func (sub *summarySub) wants(sum BatchSummary) bool {
+	if sub.bucket != "" && sum.Bucket != "" && sub.bucket != sum.Bucket {
+		return false
+	}
+
+	return strings.HasPrefix(sub.prefix, sum.Prefix) || strings.HasPrefix(sum.Prefix, sub.prefix)
+}
+
+// summaryRegistry holds the subscribers to batch summaries.
+type summaryRegistry struct {
+	mu   sync.Mutex
+	subs map[*summarySub]struct{}
+}
+
+func (r *summaryRegistry) add(sub *summarySub) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.subs == nil {
+		r.subs = make(map[*summarySub]struct{})
+	}
+	r.subs[sub] = struct{}{}
+}
+
+func (r *summaryRegistry) remove(sub *summarySub) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.subs, sub)
+}
+
+// publish hands sum to the subscribers that want it, without waiting: a
+// subscriber whose buffer is full misses it, and is told how many it missed
+// with the next one it gets.
+func (r *summaryRegistry) publish(sum BatchSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for sub := range r.subs {
+		if !sub.wants(sum) {
+			continue
+		}
+
+		out := sum
+		out.Missed = sub.missed
+
+		select {
+		case sub.ch <- out:
+			sub.missed = 0
+		default:
+			sub.missed++
+		}
+	}
+}
+
+// WatchBatches returns a channel receiving the summaries of the bulk
+// operations changing keys in bucket that start with prefix; an empty
+// bucket stands for every bucket. Summaries are never waited for: a
+// subscriber that falls behind misses some, and the next it gets counts
+// them in Missed. The caller must call cancel once it stops reading.
+func (s *Store) WatchBatches(bucket, prefix string) (summaries <-chan BatchSummary, cancel func()) {
+	sub := &summarySub{bucket: bucket, prefix: prefix, ch: make(chan BatchSummary, summaryBuffer)}
+	s.summaries.add(sub)
+
+	return sub.ch, func() { s.summaries.remove(sub) }
+}
+
+// openBatch starts coalescing the notifications of the keys in bucket, or
+// every bucket if it is empty, that start with prefix, for a bulk operation
+// named op. The caller must not hold the lock, and must close the batch
+// with closeBatch.
+func (s *Store) openBatch(op, bucket, prefix string) *notifyBatch {
+	b := &notifyBatch{op: op, bucket: bucket, prefix: prefix, pending: make(map[watchKey]change)}
+
+	s.mu.Lock()
+	b.from = s.seq.load()
+	b.last = s.seq.load()
+	b.started = time.Now()
+	s.batches = append(s.batches, b)
+	s.mu.Unlock()
+
+	go s.trickle(b)
+
+	return b
+}
+
+// closeBatch stops b coalescing notifications and publishes the summary of
+// its last window. Its watched keys left to wake go on being woken at the
+// rate cap. The caller must not hold the lock.
+func (s *Store) closeBatch(b *notifyBatch) {
+	s.mu.Lock()
+	for i, open := range s.batches {
+		if open == b {
+			s.batches = append(s.batches[:i], s.batches[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+
+	if b.overflow {
+		// Too many keys to track: everyone watching one is woken
+		s.watchers.notifyPrefix(b.bucket, b.prefix)
+		b.pending = nil
+		b.order = nil
+	}
+
+	if b.count > 0 {
+		s.summaries.publish(b.summary(time.Now()))
+	}
+}
+
+// batchOf returns the open batch covering key, if any. The caller must hold
+// the lock.
+func (s *Store) batchOf(bucket, key string) *notifyBatch {
+	for _, b := range s.batches {
+		if b.covers(bucket, key) {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// trickle wakes the watchers of the keys b holds, one key at a time at
+// most Options.NotifyRate times a second, and publishes the summaries of
+// its windows as they elapse, until b is closed and every key is woken.
+func (s *Store) trickle(b *notifyBatch) {
+	rate, window := s.opts.NotifyRate, s.opts.NotifyWindow
+	if rate <= 0 {
+		rate = DefaultNotifyRate
+	}
+	if window <= 0 {
+		window = DefaultNotifyWindow
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		k, c, ok, done := b.next(now, window, &s.summaries)
+
+		if ok {
+			s.wake(k, c)
+		}
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextSummary returns the next summary on sums, failing the test if none
+// comes within a second.
+func nextSummary(t *testing.T, sums <-chan BatchSummary) BatchSummary {
+	t.Helper()
+
+	select {
+	case sum := <-sums:
+		return sum
+	case <-time.After(time.Second):
+		t.Fatal("no summary")
+		return BatchSummary{}
+	}
+}
+
+func TestImportCoalescesNotifications(t *testing.T) {
+	ctx := context.Background()
+	s := New(&stubLogger{}, Options{NotifyRate: 100})
+
+	const keys, watched = 20000, 50
+
+	// Watchers of some of the keys the import creates, and of one it
+	// doesn't
+	var changed []<-chan struct{}
+	for i := range watched {
+		ch, cancel := s.Watch(DefaultBucket, fmt.Sprintf("k%05d", i*keys/watched), 0)
+		defer cancel()
+		changed = append(changed, ch)
+	}
+	untouched, cancel := s.Watch(DefaultBucket, "other", 0)
+	defer cancel()
+
+	sums, cancelSums := s.WatchBatches("", "")
+	defer cancelSums()
+
+	records := make([]Record, keys)
+	for i := range records {
+		records[i] = Record{Bucket: DefaultBucket, Key: fmt.Sprintf("k%05d", i), Value: "v"}
+	}
+
+	before := s.Sequence()
+	start := time.Now()
+	if _, err := s.Seed(ctx, records, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// One summary for the whole import
+	sum := nextSummary(t, sums)
+	want := BatchSummary{Op: "seed", Count: keys, FirstSequence: before + 1, LastSequence: before + keys}
+	if sum.Op != want.Op || sum.Bucket != "" || sum.Prefix != "" || sum.Count != want.Count || sum.FirstSequence != want.FirstSequence || sum.LastSequence != want.LastSequence || sum.Partial || sum.Missed != 0 {
+		t.Errorf("summary of the import: %+v, want %+v", sum, want)
+	}
+
+	// The watchers of the keys are woken, one key at a time at the rate
+	// cap, not all at once
+	for i, ch := range changed {
+		select {
+		case <-ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("watcher %d not woken", i)
+		}
+	}
+	if took, least := time.Since(start), (watched-1)*time.Second/100; took < least {
+		t.Errorf("%d watched keys woken in %s, faster than the rate cap allows", watched, took)
+	}
+
+	select {
+	case <-untouched:
+		t.Error("the watcher of a key the import didn't change was woken")
+	default:
+	}
+
+	// A deletion by prefix is summed up for its bucket and prefix
+	if n, err := s.DeleteByPrefix(ctx, "k1"); err != nil || n != 10000 {
+		t.Fatalf("DeleteByPrefix: %d, %v", n, err)
+	}
+	sum = nextSummary(t, sums)
+	if sum.Op != "delete_prefix" || sum.Bucket != DefaultBucket || sum.Prefix != "k1" || sum.Count != 10000 || sum.LastSequence != s.Sequence() || sum.LastSequence-sum.FirstSequence+1 != 10000 {
+		t.Errorf("summary of the deletion: %+v", sum)
+	}
+
+	// Subscribers to other keys get neither
+	other, cancelOther := s.WatchBatches("other", "")
+	defer cancelOther()
+	if _, err := s.DeleteByPrefix(ctx, "k0"); err != nil {
+		t.Fatal(err)
+	}
+	nextSummary(t, sums)
+	select {
+	case sum := <-other:
+		t.Errorf("a subscriber to another bucket got %+v", sum)
+	default:
+	}
+}
+
+func TestNotifyBatchBoundsWhatItHolds(t *testing.T) {
+	b := &notifyBatch{pending: make(map[watchKey]change)}
+
+	// Only watched keys are held, each once, up to maxPendingWakes
+	for i := range 2 * (maxPendingWakes + 100) {
+		k := watchKey{DefaultBucket, fmt.Sprintf("k%d", i)}
+		b.record(k, change{}, uint64(i+1), i%2 == 0)
+	}
+	b.record(watchKey{DefaultBucket, "k0"}, change{deleted: true}, 1, true)
+
+	if b.count != 2*(maxPendingWakes+100)+1 {
+		t.Errorf("%d changes counted", b.count)
+	}
+	if len(b.pending) != maxPendingWakes || len(b.order) != maxPendingWakes || !b.overflow {
+		t.Errorf("%d keys pending, %d in order, overflow %v", len(b.pending), len(b.order), b.overflow)
+	}
+	if c := b.pending[watchKey{DefaultBucket, "k0"}]; !c.deleted {
+		t.Error("a key changed twice isn't held with its latest change")
+	}
+
+	// Past the bound, every watcher of the batch's keys is woken when it
+	// closes, rather than one key at a time
+	s := New(&stubLogger{}, Options{NotifyRate: 1})
+
+	var changed []<-chan struct{}
+	for i := range maxPendingWakes + 1 {
+		ch, cancel := s.Watch(DefaultBucket, fmt.Sprintf("k%05d", i), 0)
+		defer cancel()
+		changed = append(changed, ch)
+	}
+
+	records := make([]Record, maxPendingWakes+1)
+	for i := range records {
+		records[i] = Record{Bucket: DefaultBucket, Key: fmt.Sprintf("k%05d", i), Value: "v"}
+	}
+	if _, err := s.Seed(context.Background(), records, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ch := range changed {
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("watcher %d not woken once the import was done", i)
+		}
+	}
+}
+
+func TestNotifyBatchWindows(t *testing.T) {
+	ctx := context.Background()
+	s := New(&stubLogger{}, Options{NotifyWindow: 50 * time.Millisecond})
+
+	sums, cancel := s.WatchBatches(DefaultBucket, "p/")
+	defer cancel()
+
+	// A batch outlasting its window is summed up as it goes, and once more
+	// when it's closed
+	b := s.openBatch("seed", DefaultBucket, "p/")
+	for i := range 3 {
+		if err := s.PutCtx(ctx, fmt.Sprintf("p/%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := nextSummary(t, sums)
+	if first.Count != 3 || !first.Partial || first.FirstSequence != 1 || first.LastSequence != 3 {
+		t.Errorf("the summary of the first window: %+v", first)
+	}
+
+	for i := range 2 {
+		if err := s.PutCtx(ctx, fmt.Sprintf("p/%d", i), "w"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.closeBatch(b)
+
+	last := nextSummary(t, sums)
+	if last.Count != 2 || last.Partial || last.FirstSequence != 4 || last.LastSequence != 5 || last.Started != first.Ended {
+		t.Errorf("the summary of the last window: %+v, after %+v", last, first)
+	}
+
+	// A subscriber that falls behind misses summaries, and is told how many
+	for i := range summaryBuffer + 3 {
+		s.summaries.publish(BatchSummary{Op: "seed", Bucket: DefaultBucket, Count: i})
+	}
+	for range summaryBuffer {
+		<-sums
+	}
+	s.summaries.publish(BatchSummary{Op: "seed", Bucket: DefaultBucket})
+	if sum := <-sums; sum.Missed != 3 {
+		t.Errorf("a summary after 3 were missed: %+v", sum)
+	}
+}
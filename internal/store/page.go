@@ -0,0 +1,295 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// DefaultPageCacheBytes bounds the values paged in from a snapshot that are
+// kept in memory, when Options.PageCacheBytes doesn't.
+const DefaultPageCacheBytes = 64 << 20
+
+// pager reads the values of a snapshot file on demand, for stores with
+// Options.PageValues, and keeps the most recently read in memory up to a
+// budget in bytes. A pager lives as long as entries refer to it: a snapshot
+// replaced by another one leaves the entries indexed from it readable until
+// they are all gone, when the file is closed as it is collected.
+type pager struct {
+	f *os.File
+
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	lru    *list.List                 // Of *cachedPage, most recently read first
+	pages  map[*pageRef]*list.Element // Cached values by page
+}
+
+// cachedPage is a value in the cache of a pager.
+type cachedPage struct {
+	ref   *pageRef
+	value string
+}
+
+// pageRef locates the value of an entry in the snapshot file of a pager. It
+// takes the place of the value in entries indexed from a snapshot, until
+// they are written.
+type pageRef struct {
+	p      *pager
+	offset int64 // Of the snapshot line holding the value
+	length int32 // Of the line
+	size   int32 // Of the value as stored
+}
+
+func newPager(f *os.File, budget int64) *pager {
+	if budget <= 0 {
+		budget = DefaultPageCacheBytes
+	}
+
+	return &pager{f: f, budget: budget, lru: list.New(), pages: make(map[*pageRef]*list.Element)}
+}
+
+// read returns the value as stored that r locates, from the cache or else
+// the snapshot file.
+func (r *pageRef) read() (string, error) {
+	if value, ok := r.p.cached(r); ok {
+		return value, nil
+	}
+
+	line := make([]byte, r.length)
+	if _, err := r.p.f.ReadAt(line, r.offset); err != nil {
+		return "", fmt.Errorf("paging in from %s at byte %d: %w", r.p.f.Name(), r.offset, err)
+	}
+
+	var rec snapshotRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return "", fmt.Errorf("paging in from %s at byte %d: %w", r.p.f.Name(), r.offset, err)
+	}
+
+	value := string(rec.Value)
+	r.p.cache(r, value)
+
+	return value, nil
+}
+
+// cached returns the value of r if it is in the cache, and marks it as the
+// most recently read.
+func (p *pager) cached(r *pageRef) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el, ok := p.pages[r]
+	if !ok {
+		return "", false
+	}
+
+	p.lru.MoveToFront(el)
+
+	return el.Value.(*cachedPage).value, true
+}
+
+// cache keeps value as the value of r, evicting the least recently read
+// values past the budget. A value larger than the budget isn't kept.
+func (p *pager) cache(r *pageRef, value string) {
+	size := int64(len(value))
+	if size > p.budget {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.pages[r]; ok {
+		return // Read meanwhile by someone else
+	}
+
+	p.pages[r] = p.lru.PushFront(&cachedPage{r, value})
+	p.used += size
+
+	for p.used > p.budget {
+		oldest := p.lru.Remove(p.lru.Back()).(*cachedPage)
+		delete(p.pages, oldest.ref)
+		p.used -= int64(len(oldest.value))
+	}
+}
+
+// stored returns the value of e as stored, paging it in if e was indexed
+// from a snapshot. It doesn't need the lock.
+func (e entry) stored() (string, error) {
+	if e.page == nil {
+		return e.value, nil
+	}
+
+	return e.page.read()
+}
+
+// sameStored reports whether a and b hold the same value as stored. A
+// value that can't be paged in differs from every other.
+func sameStored(a, b entry) bool {
+	if a.codec != b.codec {
+		return false
+	}
+	if a.page != nil && a.page == b.page {
+		return true
+	}
+
+	av, err := a.stored()
+	if err != nil {
+		return false
+	}
+	bv, err := b.stored()
+	if err != nil {
+		return false
+	}
+
+	return av == bv
+}
+
+// indexRecord is a snapshotRecord as indexed: its value is left encoded.
+type indexRecord struct {
+	snapshotRecord
+	Value json.RawMessage `json:"value"`
+}
+
+// storedSize returns the size of the value of rec once decoded, without
+// decoding it: encoding/json writes bytes in standard base64, padded.
+func (rec *indexRecord) storedSize() (int64, error) {
+	raw := rec.Value
+	if bytes.Equal(raw, []byte("null")) {
+		return 0, nil
+	}
+
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' || bytes.IndexByte(raw, '\\') >= 0 {
+		return 0, errors.New("invalid value encoding")
+	}
+
+	b64 := raw[1 : len(raw)-1]
+	if len(b64)%4 != 0 {
+		return 0, errors.New("invalid value encoding")
+	}
+
+	return int64(len(b64)/4*3 - (len(b64) - len(bytes.TrimRight(b64, "=")))), nil
+}
+
+// index reads the snapshot in f as restore does, but keeps only the
+// location of each value in f, which must stay open, with the keys and
+// their metadata. Values in the blob directory are kept as references, as
+// they always are.
+func (s *Store) index(f *os.File) (SnapshotHeader, error) {
+	m := newShardedMap(s.opts.InitialCapacity)
+	p := newPager(f, s.opts.PageCacheBytes)
+	br := bufio.NewReaderSize(f, 1<<20)
+
+	var header SnapshotHeader
+	var offset int64
+
+	for {
+		line, err := readLine(br)
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return header, err
+		}
+
+		start := offset
+		offset += int64(len(line))
+
+		if start == 0 {
+			if err := json.Unmarshal(line, &header); err != nil {
+				return header, fmt.Errorf("invalid snapshot header: %w", err)
+			}
+			continue
+		}
+
+		var rec indexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return header, fmt.Errorf("invalid snapshot at byte %d: %w", start, err)
+		}
+
+		size, err := rec.storedSize()
+		if err != nil {
+			return header, fmt.Errorf("invalid snapshot at byte %d: %w", start, err)
+		}
+		if len(line) > 1<<31-1 {
+			return header, fmt.Errorf("snapshot line at byte %d too long to page in", start)
+		}
+
+		e := entry{
+			codec: rec.Codec,
+			meta:  ValueMeta{Version: rec.Version, Created: rec.Created, Modified: rec.Modified, OriginalKey: rec.OriginalKey, Immutable: rec.Immutable, Expires: rec.Expires, ContentType: rec.ContentType},
+			lease: Lease{Owner: rec.LeaseOwner, Expires: rec.LeaseExpires},
+		}
+
+		if rec.Codec.IsBlob() {
+			var ref []byte
+			if err := json.Unmarshal(rec.Value, &ref); err != nil {
+				return header, fmt.Errorf("invalid snapshot at byte %d: %w", start, err)
+			}
+			e.value = string(ref)
+
+			if s.opts.Blobs != nil {
+				if _, err := s.opts.Blobs.Resolve(e.value); err != nil {
+					return header, blobError(rec.Bucket, rec.Key, err)
+				}
+			}
+		} else {
+			e.page = &pageRef{p: p, offset: start, length: int32(len(line)), size: int32(size)}
+		}
+
+		m.set(rec.Bucket, rec.Key, e)
+	}
+
+	if offset == 0 {
+		return header, errors.New("invalid snapshot header: empty snapshot")
+	}
+
+	s.swap(header, m)
+
+	return header, nil
+}
+
+// readLine reads a line of br, however long, with its newline.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+
+	long := append([]byte(nil), line...)
+	for err == bufio.ErrBufferFull {
+		line, err = br.ReadSlice('\n')
+		long = append(long, line...)
+	}
+
+	return long, err
+}
+
+// RestoreFile is Restore from the snapshot file at path. With
+// Options.PageValues, the values are indexed and paged in from the file
+// rather than read into memory, so it must not be written to once restored
+// from, though it may be renamed or replaced by another through a rename.
+func (s *Store) RestoreFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	if !s.opts.PageValues {
+		defer f.Close()
+		return s.Restore(f)
+	}
+
+	if _, err := s.index(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+package store
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var snapshotMB = flag.Int("snapshot-mb", 32, "size in MB of the snapshot BenchmarkLoadSnapshot loads; the paging mode is sized for 5120")
+
+// pagedValue is the value of key at generation gen, padded to size bytes.
+func pagedValue(key string, gen, size int) string {
+	v := fmt.Sprintf("%s:%d:", key, gen)
+	return v + strings.Repeat("x", max(size-len(v), 0))
+}
+
+// parsePagedValue returns the key and generation of a pagedValue.
+func parsePagedValue(v string) (string, int, bool) {
+	key, rest, ok := strings.Cut(v, ":")
+	if !ok {
+		return "", 0, false
+	}
+	n, _, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", 0, false
+	}
+	gen, err := strconv.Atoi(n)
+
+	return key, gen, err == nil
+}
+
+// writeSnapshot writes the snapshot of s to path, through a rename, as
+// compaction replaces one.
+func writeSnapshot(t testing.TB, s *Store, path string) {
+	t.Helper()
+
+	f, err := os.CreateTemp(filepath.Dir(path), "snapshot-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pagedIn returns how many entries of s are paged in, and how many bytes
+// their pagers hold in memory.
+func pagedIn(s *Store) (int, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paged := 0
+	pagers := make(map[*pager]bool)
+	for _, b := range s.m.parts() {
+		for _, e := range b {
+			if e.page != nil {
+				paged++
+				pagers[e.page.p] = true
+			}
+		}
+	}
+
+	var used int64
+	for p := range pagers {
+		p.mu.Lock()
+		used += p.used
+		p.mu.Unlock()
+	}
+
+	return paged, used
+}
+
+func TestPagedValues(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	const keys, size, budget = 500, 512, 8 * 512
+
+	// A snapshot of keys with values of every size, one of them leased
+	full, closeFull := openLogged(t, t.TempDir(), Options{})
+	for i := range keys {
+		key := fmt.Sprintf("k%03d", i)
+		if err := full.PutCtx(ctx, key, pagedValue(key, 0, i*size/keys)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := full.AcquireLease(ctx, "k000", "owner", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	writeSnapshot(t, full, filepath.Join(dir, SnapshotFileName))
+	closeFull()
+
+	want, err := full.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, closeLog := openLogged(t, dir, Options{PageValues: true, PageCacheBytes: budget})
+
+	// Only the index is loaded; values are read as they're asked for, and
+	// no more of them kept than the budget allows
+	if paged, used := pagedIn(s); paged != keys || used != 0 {
+		t.Errorf("loaded: %d entries paged in, %d bytes cached", paged, used)
+	}
+	for range 2 {
+		for i := range keys {
+			key := fmt.Sprintf("k%03d", i)
+			if v, err := s.Get(key); err != nil || v != pagedValue(key, 0, i*size/keys) {
+				t.Fatalf("GET %s: %.20q, %v", key, v, err)
+			}
+		}
+	}
+	if _, meta, err := s.GetWithMeta("k001"); err != nil || meta.Version != 1 || meta.Created.IsZero() {
+		t.Errorf("GET k001: %+v, %v", meta, err)
+	}
+	if ok, err := s.AcquireLease(ctx, "k000", "other", time.Hour); err != nil || ok {
+		t.Errorf("a lease on k000 taken from the lease held in the snapshot: %v, %v", ok, err)
+	}
+	if _, used := pagedIn(s); used <= 0 || used > budget {
+		t.Errorf("%d bytes cached after reading every key, with a budget of %d", used, budget)
+	}
+
+	got, err := s.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Error("the dump of the paged store differs from the store it was taken of")
+	}
+
+	// Writes supersede the index
+	if err := s.PutCtx(ctx, "k001", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteCtx(ctx, "k002"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("k001"); err != nil || v != "new" {
+		t.Errorf("GET k001 after a put: %q, %v", v, err)
+	}
+	if _, err := s.Get("k002"); err != ErrorNoSuchKey {
+		t.Errorf("GET k002 after a delete: %v", err)
+	}
+	if paged, _ := pagedIn(s); paged != keys-2 {
+		t.Errorf("%d entries paged in after a put and a delete", paged)
+	}
+
+	// A snapshot of the paged store reads its values from the file it was
+	// indexed from, and the log replayed over it gives the same store
+	// materialized or not
+	var snap strings.Builder
+	if err := s.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(snap.String(), `"key":"k003"`) {
+		t.Error("the snapshot of the paged store lacks a key it didn't write")
+	}
+
+	want, err = s.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	for _, opts := range []Options{{}, {PageValues: true, PageCacheBytes: budget}} {
+		s, closeLog := openLogged(t, dir, opts)
+		got, err := s.Dump()
+		closeLog()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("reloaded with paging %v: the dump differs", opts.PageValues)
+		}
+	}
+
+	// A value the file no longer holds is an error, not a wrong value
+	p := newPager(nil, budget)
+	p.f, err = os.Open(filepath.Join(dir, SnapshotFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.f.Close()
+	if _, err := (&pageRef{p: p, offset: 1 << 30, length: 10}).read(); err == nil {
+		t.Error("paging in past the end of the snapshot succeeded")
+	}
+}
+
+func TestPagedReadsRaceCompaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, SnapshotFileName)
+
+	const keys, size, rounds = 200, 256, 20
+
+	s := New(&stubLogger{}, Options{PageValues: true, PageCacheBytes: 16 * size})
+	for i := range keys {
+		key := fmt.Sprintf("k%03d", i)
+		if err := s.PutCtx(ctx, key, pagedValue(key, 0, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSnapshot(t, s, path)
+	if err := s.RestoreFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers check that each key has a value of its own, never of a
+	// generation before one they've seen, while the keys are overwritten
+	// and the snapshot they're paged in from replaced under them
+	var stop atomic.Bool
+	var reads atomic.Int64
+	var wg sync.WaitGroup
+	for r := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			seen := make([]int, keys)
+			for i := r; !stop.Load(); i++ {
+				key := fmt.Sprintf("k%03d", i%keys)
+
+				v, err := s.Get(key)
+				if err != nil {
+					t.Errorf("GET %s: %v", key, err)
+					return
+				}
+				k, gen, ok := parsePagedValue(v)
+				if !ok || k != key || len(v) != size {
+					t.Errorf("GET %s: %.40q", key, v)
+					return
+				}
+				if gen < seen[i%keys] {
+					t.Errorf("GET %s: generation %d after %d", key, gen, seen[i%keys])
+					return
+				}
+				seen[i%keys] = gen
+				reads.Add(1)
+			}
+		}()
+	}
+
+	for gen := 1; gen <= rounds; gen++ {
+		// Half the keys are overwritten each round, so some are paged in
+		// from the last snapshot and some held in memory
+		for i := gen % 2; i < keys; i += 2 {
+			key := fmt.Sprintf("k%03d", i)
+			if err := s.PutCtx(ctx, key, pagedValue(key, gen, size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		writeSnapshot(t, s, path)
+		if err := s.RestoreFile(path); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stop.Store(true)
+	wg.Wait()
+
+	if reads.Load() == 0 {
+		t.Fatal("nothing was read")
+	}
+
+	// Every key ends up with its last value, paged in from the last
+	// snapshot
+	for i := range keys {
+		key := fmt.Sprintf("k%03d", i)
+		last := rounds
+		if i%2 != rounds%2 {
+			last = rounds - 1
+		}
+		if v, err := s.Get(key); err != nil || v != pagedValue(key, last, size) {
+			t.Errorf("GET %s: %.40q, %v", key, v, err)
+		}
+	}
+	if paged, used := pagedIn(s); paged != keys || used > 16*size {
+		t.Errorf("%d entries paged in, %d bytes cached", paged, used)
+	}
+}
+
+// BenchmarkLoadSnapshot compares loading a snapshot into memory with
+// indexing it to page its values in, by the time taken and the heap held
+// once loaded. The snapshot is -snapshot-mb in size.
+func BenchmarkLoadSnapshot(b *testing.B) {
+	ctx := context.Background()
+	dir := b.TempDir()
+	path := filepath.Join(dir, SnapshotFileName)
+
+	const size = 4 << 10
+	keys := *snapshotMB << 20 / size
+
+	src := New(&stubLogger{}, Options{})
+	for i := range keys {
+		key := fmt.Sprintf("k%08d", i)
+		if err := src.PutCtx(ctx, key, pagedValue(key, 0, size)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	writeSnapshot(b, src, path)
+	src = nil
+
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"full", Options{}},
+		{"paged", Options{PageValues: true}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			var heap uint64
+			var ms runtime.MemStats
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				before := ms.HeapAlloc
+				b.StartTimer()
+
+				s := New(&stubLogger{}, tt.opts)
+				if err := s.RestoreFile(path); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				heap += ms.HeapAlloc - min(before, ms.HeapAlloc)
+				runtime.KeepAlive(s)
+				b.StartTimer()
+			}
+
+			b.ReportMetric(float64(heap)/float64(b.N)/(1<<20), "heap-MB")
+			b.ReportMetric(float64(keys), "keys")
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package store
+
+import "context"
+
+// Precondition checks the key a write is about to change, given its
+// metadata, or exists false if there is no such key, and returns an error
+// to refuse the write.
+type Precondition func(meta ValueMeta, exists bool) error
+
+// preconditionKey is the context key of the Precondition of the writes.
+type preconditionKey struct{}
+
+// WithPrecondition returns a context under which puts and deletes first
+// check their key with p. The check is made under the lock of the write,
+// against the key as the write would change it, so no other write can
+// come in between: a write based on what a client read earlier fails if
+// the key changed since. The error p returns is returned as it is, and
+// nothing is written. Under Options.SkipNoopWrites, a put under a
+// precondition is logged and applied even if it doesn't change the value.
+func WithPrecondition(ctx context.Context, p Precondition) context.Context {
+	return context.WithValue(ctx, preconditionKey{}, p)
+}
+
+// preconditionOf returns the Precondition of the writes made under ctx, or
+// nil if they have none.
+func preconditionOf(ctx context.Context) Precondition {
+	p, _ := ctx.Value(preconditionKey{}).(Precondition)
+	return p
+}
+
+// checkPrecondition checks e, the entry of a key about to be written, or
+// its absence if ok is false, with the Precondition of ctx, if it has one.
+func checkPrecondition(ctx context.Context, e entry, ok bool) error {
+	p := preconditionOf(ctx)
+	if p == nil {
+		return nil
+	}
+
+	if !ok {
+		return p(ValueMeta{}, false)
+	}
+
+	return p(e.meta, true)
+}
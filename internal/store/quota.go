@@ -0,0 +1,431 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorOverQuota is returned for writes that would take a bucket past its
+// quota.
+var ErrorOverQuota = errors.New("bucket quota exceeded")
+
+const (
+	DefaultQuotaWarnRatio    = 0.8
+	DefaultQuotaWarnInterval = time.Minute
+)
+
+// Quota bounds the size of a bucket. A zero limit is no limit.
+type Quota struct {
+	MaxKeys  int   `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"` // Keys and values as stored, compressed and encrypted, with blobs at their size
+}
+
+// IsZero reports whether q limits nothing.
+func (q Quota) IsZero() bool {
+	return q.MaxKeys <= 0 && q.MaxBytes <= 0
+}
+
+// QuotaPolicy sets the quotas of buckets. A put that would take a bucket past
+// a limit fails with ErrorOverQuota, unless it doesn't grow the bucket, so
+// that a bucket over a quota lowered since can still be brought back under
+// it. The events of replay and replication were checked where they were
+// first written, and aren't checked again.
+//
+// Puts that succeed with the bucket at WarnRatio of a limit or more carry
+// its usage, for WithQuotaWarning, and it is logged, at most once per
+// WarnInterval until the bucket is back under that ratio.
+type QuotaPolicy struct {
+	Default Quota            // Quota of the buckets not in Buckets
+	Buckets map[string]Quota // Quotas of particular buckets
+
+	WarnRatio    float64       // DefaultQuotaWarnRatio if 0
+	WarnInterval time.Duration // DefaultQuotaWarnInterval if 0
+}
+
+// ParseQuotas parses a comma-separated list of bucket=keys/bytes quotas, such
+// as "sessions=10000/0,*=1000/1048576", into a policy. A zero limit is no
+// limit, and the bucket * sets the quota of the buckets not listed.
+func ParseQuotas(s string) (QuotaPolicy, error) {
+	var p QuotaPolicy
+
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		bucket, limits, ok := strings.Cut(strings.TrimSpace(field), "=")
+		keys, bytes, ok2 := strings.Cut(limits, "/")
+		if !ok || !ok2 || bucket == "" {
+			return p, fmt.Errorf("quota %q: expected bucket=keys/bytes", field)
+		}
+
+		if bucket != "*" {
+			if err := ValidateBucket(bucket); err != nil {
+				return p, fmt.Errorf("quota %q: %w", field, err)
+			}
+		}
+
+		var q Quota
+		var err error
+
+		if q.MaxKeys, err = strconv.Atoi(keys); err != nil || q.MaxKeys < 0 {
+			return p, fmt.Errorf("quota %q: invalid key limit %q", field, keys)
+		}
+		if q.MaxBytes, err = strconv.ParseInt(bytes, 10, 64); err != nil || q.MaxBytes < 0 {
+			return p, fmt.Errorf("quota %q: invalid byte limit %q", field, bytes)
+		}
+
+		if bucket == "*" {
+			p.Default = q
+			continue
+		}
+
+		if p.Buckets == nil {
+			p.Buckets = make(map[string]Quota)
+		}
+		p.Buckets[bucket] = q
+	}
+
+	return p, nil
+}
+
+// Enabled reports whether the policy limits any bucket.
+func (p QuotaPolicy) Enabled() bool {
+	if !p.Default.IsZero() {
+		return true
+	}
+
+	for _, q := range p.Buckets {
+		if !q.IsZero() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// quota returns the quota of bucket.
+func (p QuotaPolicy) quota(bucket string) Quota {
+	if q, ok := p.Buckets[bucket]; ok {
+		return q
+	}
+
+	return p.Default
+}
+
+func (p QuotaPolicy) warnRatio() float64 {
+	if p.WarnRatio <= 0 {
+		return DefaultQuotaWarnRatio
+	}
+
+	return p.WarnRatio
+}
+
+func (p QuotaPolicy) warnInterval() time.Duration {
+	if p.WarnInterval <= 0 {
+		return DefaultQuotaWarnInterval
+	}
+
+	return p.WarnInterval
+}
+
+// QuotaUsage is the size of a bucket next to its quota.
+type QuotaUsage struct {
+	Bucket string `json:"bucket"`
+	Keys   int    `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+	Quota  Quota  `json:"quota"`
+}
+
+// String returns u as "keys=USED/LIMIT bytes=USED/LIMIT", leaving out the
+// limits the quota doesn't set.
+func (u QuotaUsage) String() string {
+	var parts []string
+
+	if u.Quota.MaxKeys > 0 {
+		parts = append(parts, fmt.Sprintf("keys=%d/%d", u.Keys, u.Quota.MaxKeys))
+	}
+	if u.Quota.MaxBytes > 0 {
+		parts = append(parts, fmt.Sprintf("bytes=%d/%d", u.Bytes, u.Quota.MaxBytes))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// ratios returns the shares of its limits of keys and bytes u uses, 0 for
+// those it has none of.
+func (u QuotaUsage) ratios() (keys, bytes float64) {
+	if u.Quota.MaxKeys > 0 {
+		keys = float64(u.Keys) / float64(u.Quota.MaxKeys)
+	}
+	if u.Quota.MaxBytes > 0 {
+		bytes = float64(u.Bytes) / float64(u.Quota.MaxBytes)
+	}
+
+	return keys, bytes
+}
+
+// bucketUsage is the size of a bucket with a quota, kept up to date under the
+// write lock by every change to the map.
+type bucketUsage struct {
+	keys   int
+	bytes  int64
+	warned time.Time // When a warning was last logged; zero while under the warning ratio
+}
+
+var quotaUsageRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "kv_bucket_quota_usage_ratio",
+	Help: "Share of its quota a bucket uses, by bucket and limit: keys or bytes.",
+}, []string{"bucket", "limit"})
+
+var quotaWarning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "kv_bucket_quota_warning",
+	Help: "Whether a bucket is at the warning ratio of its quota or past it.",
+}, []string{"bucket"})
+
+// QuotaCollectors returns the quota gauges, for the metrics registry.
+func QuotaCollectors() []prometheus.Collector {
+	return []prometheus.Collector{quotaUsageRatio, quotaWarning}
+}
+
+// quotaWarningKey is the context key of the *QuotaUsage a put records the
+// usage of its bucket in.
+type quotaWarningKey struct{}
+
+// WithQuotaWarning returns a context under which a successful put that leaves
+// its bucket at the warning ratio of its quota or past it stores the
+// bucket's usage in u. Other writes leave it as is.
+func WithQuotaWarning(ctx context.Context, u *QuotaUsage) context.Context {
+	return context.WithValue(ctx, quotaWarningKey{}, u)
+}
+
+// entrySize returns the bytes e counts for in the usage of its bucket.
+func entrySize(key string, e entry) int64 {
+	return int64(len(key)) + storedSize(e)
+}
+
+// storedSize returns the bytes the value of e takes as stored, compressed
+// or encrypted, or in its blob.
+func storedSize(e entry) int64 {
+	if e.page != nil {
+		return int64(e.page.size)
+	}
+
+	if e.codec.IsBlob() {
+		if ref, err := blob.ParseRef(e.value); err == nil {
+			return ref.Size
+		}
+	}
+
+	return int64(len(e.value))
+}
+
+// accountChange updates the key count, and the usage of bucket, for the
+// entry of key changing from old to e, where nil is no entry, and notes
+// the change for a rename under way. The caller must hold the write lock,
+// or the lock of a write of key, which takes the write lock for quotas and
+// renames.
+func (s *Store) accountChange(bucket, key string, old, e *entry) {
+	s.renaming.touch(bucket, key)
+
+	switch {
+	case old == nil && e != nil:
+		s.keys.Add(1)
+	case old != nil && e == nil:
+		s.keys.Add(-1)
+	}
+
+	if s.usage == nil {
+		return
+	}
+
+	var keys int
+	var bytes int64
+
+	if old != nil {
+		keys--
+		bytes -= entrySize(key, *old)
+	}
+	if e != nil {
+		keys++
+		bytes += entrySize(key, *e)
+	}
+
+	s.account(bucket, keys, bytes)
+}
+
+// account adds keys and bytes to the usage of bucket, if it has a quota, and
+// updates its gauges. The caller must hold the write lock.
+func (s *Store) account(bucket string, keys int, bytes int64) {
+	q := s.opts.Quotas.quota(bucket)
+	if q.IsZero() {
+		return
+	}
+
+	u, ok := s.usage[bucket]
+	if !ok {
+		u = &bucketUsage{}
+		s.usage[bucket] = u
+	}
+
+	u.keys += keys
+	u.bytes += bytes
+
+	kr, br := QuotaUsage{Keys: u.keys, Bytes: u.bytes, Quota: q}.ratios()
+	warn := max(kr, br) >= s.opts.Quotas.warnRatio()
+
+	if !warn {
+		u.warned = time.Time{}
+	}
+
+	if q.MaxKeys > 0 {
+		quotaUsageRatio.WithLabelValues(bucket, "keys").Set(kr)
+	}
+	if q.MaxBytes > 0 {
+		quotaUsageRatio.WithLabelValues(bucket, "bytes").Set(br)
+	}
+	quotaWarning.WithLabelValues(bucket).Set(boolGauge(warn))
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// dropUsage forgets the usage of a dropped bucket. The caller must hold the
+// write lock.
+func (s *Store) dropUsage(bucket string) {
+	if s.usage == nil {
+		return
+	}
+
+	delete(s.usage, bucket)
+
+	quotaUsageRatio.DeletePartialMatch(prometheus.Labels{"bucket": bucket})
+	quotaWarning.DeleteLabelValues(bucket)
+}
+
+// recount rebuilds the key count and the usage of every bucket from the
+// map, after it was replaced as a whole. The caller must hold the write
+// lock.
+func (s *Store) recount() {
+	s.keys.Store(0)
+	s.renaming.invalidate("")
+
+	for bucket := range s.usage {
+		s.dropUsage(bucket)
+	}
+
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			s.accountChange(bucket, key, nil, &e)
+		}
+	}
+}
+
+// BucketBytes returns the bytes each bucket takes, keys included, as
+// quotas count them, whether or not the bucket has a quota. With a
+// Backing, only the keys cached so far are counted. It walks every key
+// under the read lock, holding up writes, so it is meant to be called now
+// and then, such as by a periodic sampler.
+func (s *Store) BucketBytes() map[string]int64 {
+	s.mu.RLock()
+	s.m.lockWriters()
+	defer s.runlockScan()
+
+	sizes := make(map[string]int64)
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			sizes[bucket] += entrySize(key, e)
+		}
+	}
+
+	return sizes
+}
+
+// loadUsage fills the cache from the backing, once, if quotas are enabled, so
+// that the usage counts every key. The caller must not hold the lock.
+func (s *Store) loadUsage(ctx context.Context) error {
+	if s.usage == nil {
+		return nil
+	}
+
+	return s.loadAll(ctx)
+}
+
+// checkQuota returns ErrorOverQuota if putting value, encoded with codec,
+// under key, whose entry is old if it has one, would take bucket past its
+// quota. The caller must hold the write lock.
+func (s *Store) checkQuota(bucket, key string, old *entry, value string, codec compress.Codec) error {
+	if s.usage == nil {
+		return nil
+	}
+
+	q := s.opts.Quotas.quota(bucket)
+	if q.IsZero() {
+		return nil
+	}
+
+	var keys int
+	var bytes int64
+	if u, ok := s.usage[bucket]; ok {
+		keys, bytes = u.keys, u.bytes
+	}
+
+	added := entrySize(key, entry{value: value, codec: codec})
+	if old != nil {
+		added -= entrySize(key, *old)
+	} else {
+		keys++
+	}
+
+	if old == nil && q.MaxKeys > 0 && keys > q.MaxKeys {
+		return fmt.Errorf("%w: bucket %q is limited to %d keys", ErrorOverQuota, bucket, q.MaxKeys)
+	}
+
+	if added > 0 && q.MaxBytes > 0 && bytes+added > q.MaxBytes {
+		return fmt.Errorf("%w: bucket %q is limited to %d bytes, and would take %d", ErrorOverQuota, bucket, q.MaxBytes, bytes+added)
+	}
+
+	return nil
+}
+
+// warnQuota records the usage of bucket for WithQuotaWarning after a put that
+// left it at the warning ratio of its quota or past it, and logs it unless
+// it was logged less than WarnInterval ago. The caller must hold the write
+// lock.
+func (s *Store) warnQuota(ctx context.Context, bucket string) {
+	u, ok := s.usage[bucket]
+	if !ok {
+		return
+	}
+
+	usage := QuotaUsage{Bucket: bucket, Keys: u.keys, Bytes: u.bytes, Quota: s.opts.Quotas.quota(bucket)}
+
+	if kr, br := usage.ratios(); max(kr, br) < s.opts.Quotas.warnRatio() {
+		return
+	}
+
+	if p, ok := ctx.Value(quotaWarningKey{}).(*QuotaUsage); ok {
+		*p = usage
+	}
+
+	now := time.Now()
+	if !u.warned.IsZero() && now.Sub(u.warned) < s.opts.Quotas.warnInterval() {
+		return
+	}
+	u.warned = now
+
+	log.Printf("QUOTA-WARNING bucket=%s %s\n", bucket, usage)
+}
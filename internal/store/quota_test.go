@@ -0,0 +1,149 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuotas(t *testing.T) {
+	p, err := ParseQuotas("sessions=10000/0, *=1000/1048576")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Buckets["sessions"] != (Quota{MaxKeys: 10000}) || p.Default != (Quota{MaxKeys: 1000, MaxBytes: 1 << 20}) || !p.Enabled() {
+		t.Errorf("parsed %+v", p)
+	}
+	if p.quota("other") != p.Default {
+		t.Errorf("a bucket not listed has the quota %+v", p.quota("other"))
+	}
+
+	for _, s := range []string{"sessions", "sessions=10", "=1/1", "a/b=1/1", "b=-1/0", "b=1/x"} {
+		if _, err := ParseQuotas(s); err == nil {
+			t.Errorf("ParseQuotas(%q) accepted it", s)
+		}
+	}
+	if p, err := ParseQuotas("b=0/0"); err != nil || p.Enabled() {
+		t.Errorf("a quota of no limits: %+v, %v", p, err)
+	}
+}
+
+func TestQuotaWarningThenRejection(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	opts := Options{Quotas: QuotaPolicy{Buckets: map[string]Quota{"b": {MaxKeys: 10}}, WarnInterval: time.Hour}}
+	s, closeLog := openLogged(t, dir, opts)
+
+	// put puts key in b, returning the usage it was warned of
+	put := func(key string) (QuotaUsage, error) {
+		var u QuotaUsage
+		err := s.BucketPut(WithQuotaWarning(ctx, &u), "b", key, "v")
+		return u, err
+	}
+	warnings := func() int {
+		return strings.Count(logged.String(), "QUOTA-WARNING bucket=b")
+	}
+
+	// Under 80% of the quota, puts aren't warned
+	for i := range 7 {
+		if u, err := put(fmt.Sprintf("k%d", i)); err != nil || u.Bucket != "" {
+			t.Fatalf("put %d: warned of %+v, %v", i, u, err)
+		}
+	}
+	if got := testutil.ToFloat64(quotaWarning.WithLabelValues("b")); got != 0 {
+		t.Errorf("the warning gauge is %v at 7 of 10 keys", got)
+	}
+
+	// From 80%, they are, and logged once per interval
+	for i := 7; i < 10; i++ {
+		u, err := put(fmt.Sprintf("k%d", i))
+		if want := fmt.Sprintf("keys=%d/10", i+1); err != nil || u.Bucket != "b" || u.String() != want {
+			t.Errorf("put %d: warned of %q, %v; want %q", i, u, err, want)
+		}
+	}
+	if warnings() != 1 {
+		t.Errorf("logged %d warnings for 3 puts in the band, want 1:\n%s", warnings(), logged.String())
+	}
+	if got := testutil.ToFloat64(quotaWarning.WithLabelValues("b")); got != 1 {
+		t.Errorf("the warning gauge is %v in the warning band", got)
+	}
+	if got := testutil.ToFloat64(quotaUsageRatio.WithLabelValues("b", "keys")); got != 1 {
+		t.Errorf("the usage gauge is %v at 10 of 10 keys", got)
+	}
+
+	// Past the quota, a new key is rejected, but a key can still be
+	// overwritten, and other buckets are unaffected
+	if _, err := put("k10"); !errors.Is(err, ErrorOverQuota) {
+		t.Errorf("a put past the quota: %v", err)
+	}
+	if u, err := put("k0"); err != nil || u.String() != "keys=10/10" {
+		t.Errorf("overwriting a key at the quota: warned of %q, %v", u, err)
+	}
+	if err := s.BucketPut(ctx, "other", "k", "v"); err != nil {
+		t.Errorf("a put in a bucket without a quota: %v", err)
+	}
+	closeLog()
+
+	// The usage is counted again on replay, so enforcement agrees
+	s, closeLog = openLogged(t, dir, opts)
+	defer closeLog()
+
+	if _, err := put("k10"); !errors.Is(err, ErrorOverQuota) {
+		t.Errorf("a put past the quota after replay: %v", err)
+	}
+
+	// Deletes back under the warning ratio clear the warning, which is
+	// logged again when the bucket next reaches it
+	for i := range 3 {
+		if err := s.BucketDelete(ctx, "b", fmt.Sprintf("k%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(quotaWarning.WithLabelValues("b")); got != 0 {
+		t.Errorf("the warning gauge is %v back at 7 of 10 keys", got)
+	}
+
+	logged.Reset()
+	if u, err := put("k10"); err != nil || u.String() != "keys=8/10" {
+		t.Errorf("a put back into the band: warned of %q, %v", u, err)
+	}
+	if warnings() != 1 {
+		t.Errorf("logged %d warnings reaching the band again, want 1", warnings())
+	}
+}
+
+func TestByteQuota(t *testing.T) {
+	ctx := context.Background()
+	s := New(translog.NewNopTransactionLogger(), Options{Quotas: QuotaPolicy{Default: Quota{MaxBytes: 100}}})
+
+	// Keys and values count, as stored
+	if err := s.BucketPut(ctx, "b", "k1", strings.Repeat("v", 48)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BucketPut(ctx, "b", "k2", strings.Repeat("v", 49)); !errors.Is(err, ErrorOverQuota) {
+		t.Errorf("a put to 101 bytes: %v", err)
+	}
+	if err := s.BucketPut(ctx, "b", "k2", strings.Repeat("v", 48)); err != nil {
+		t.Errorf("a put to 100 bytes: %v", err)
+	}
+
+	// A value shrunk makes room for another to grow
+	if err := s.BucketPut(ctx, "b", "k1", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BucketPut(ctx, "b", "k2", strings.Repeat("v", 95)); err != nil {
+		t.Errorf("a put into room made by a smaller value: %v", err)
+	}
+}
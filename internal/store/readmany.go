@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrorTooManyKeys is returned for reads of more keys than they are allowed.
+var ErrorTooManyKeys = errors.New("too many keys")
+
+// KeyRead is a key read by BucketGetMany or BucketGetPrefix, with its value
+// and metadata if it was found.
+type KeyRead struct {
+	Key   string
+	Value string
+	Meta  ValueMeta
+	Found bool
+}
+
+// BucketGetMany reads keys from the named bucket as they all were at a
+// single point, between two writes, and returns them in the order given
+// with the sequence of the last event applied at that point. A key that
+// doesn't exist is returned with Found false.
+func (s *Store) BucketGetMany(ctx context.Context, bucket string, keys []string) ([]KeyRead, uint64, error) {
+	if err := s.loadForRead(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	reads := make([]KeyRead, len(keys))
+	entries := make([]entry, len(keys))
+	folded := make([]string, len(keys))
+
+	for i, key := range keys {
+		reads[i].Key, folded[i] = key, s.foldKey(key)
+		s.opts.HotKeys.Observe(bucket, folded[i], false)
+	}
+
+	if err := s.rlockScan(ctx); err != nil {
+		return nil, 0, err
+	}
+	for i, key := range folded {
+		entries[i], reads[i].Found = s.lookup(bucket, key)
+		s.m.touch(bucket, key)
+	}
+	seq := s.seq.load()
+	s.runlockScan()
+
+	return reads, seq, s.decodeReads(bucket, reads, entries)
+}
+
+// BucketGetPrefix is like BucketGetMany for the keys in the named bucket
+// that start with prefix, in lexical order. More than limit of them is an
+// error wrapping ErrorTooManyKeys. Under Options.KeyFolding, the prefix is
+// folded and the keys are returned folded, as by BucketKeys.
+func (s *Store) BucketGetPrefix(ctx context.Context, bucket, prefix string, limit int) ([]KeyRead, uint64, error) {
+	if err := s.loadForRead(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	prefix = s.foldKey(prefix)
+
+	var reads []KeyRead
+	var entries []entry
+
+	if err := s.rlockScan(ctx); err != nil {
+		return nil, 0, err
+	}
+	n, now := 0, time.Now()
+	for key, e := range s.m.bucket(bucket) {
+		if err := scanDeadline(ctx, n); err != nil {
+			s.runlockScan()
+			return nil, 0, err
+		}
+		n++
+
+		if !strings.HasPrefix(key, prefix) || e.meta.expired(now) {
+			continue
+		}
+
+		if len(reads) == limit {
+			s.runlockScan()
+			return nil, 0, fmt.Errorf("%w: prefix %q matches more than %d keys", ErrorTooManyKeys, prefix, limit)
+		}
+
+		reads = append(reads, KeyRead{Key: key, Found: true})
+		entries = append(entries, e)
+	}
+	seq := s.seq.load()
+	s.runlockScan()
+
+	sort.Sort(readsByKey{reads, entries})
+
+	return reads, seq, s.decodeReads(bucket, reads, entries)
+}
+
+// loadForRead checks ctx, and fills the cache from the backing, if there's
+// one, so that every key can be read under a single hold of the lock.
+func (s *Store) loadForRead(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return phaseError(PhaseLockWait, err)
+	}
+
+	return s.loadAll(ctx)
+}
+
+// decodeReads fills in the values and metadata of the reads found, from
+// their entries. Values are decoded outside the lock, which entries, as
+// copies, don't need.
+func (s *Store) decodeReads(bucket string, reads []KeyRead, entries []entry) error {
+	for i := range reads {
+		if !reads[i].Found {
+			continue
+		}
+
+		value, err := s.decode(entries[i])
+		if err != nil {
+			return fmt.Errorf("bucket %s, key %q: %w", bucket, reads[i].Key, err)
+		}
+
+		reads[i].Value, reads[i].Meta = value, entries[i].meta
+	}
+
+	return nil
+}
+
+// readsByKey sorts reads, and their entries alongside, by key.
+type readsByKey struct {
+	reads   []KeyRead
+	entries []entry
+}
+
+func (r readsByKey) Len() int           { return len(r.reads) }
+func (r readsByKey) Less(i, j int) bool { return r.reads[i].Key < r.reads[j].Key }
+
+func (r readsByKey) Swap(i, j int) {
+	r.reads[i], r.reads[j] = r.reads[j], r.reads[i]
+	r.entries[i], r.entries[j] = r.entries[j], r.entries[i]
+}
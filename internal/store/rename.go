@@ -0,0 +1,345 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"iter"
+)
+
+// ErrorNoSuchBucket is returned for operations on a bucket without keys.
+var ErrorNoSuchBucket = errors.New("no such bucket")
+
+// ErrorBucketExists is returned for a rename to a bucket that has keys,
+// unless they are to be merged.
+var ErrorBucketExists = errors.New("bucket already exists")
+
+// renameBatch is the most keys RenameBucket copies per hold of the read
+// lock, so that writers get a turn during the rename of a large bucket.
+const renameBatch = 1000
+
+// bucketRename is a rename under way: while the keys of both buckets are
+// copied, outside the write lock, every change to them is noted, so that
+// the copy can be brought up to date before it replaces them.
+type bucketRename struct {
+	from, to string
+	changed  map[string]struct{} // Keys written in either bucket since the copy started
+	stale    bool                // Whether either bucket was dropped or replaced, so the copy must start over
+}
+
+// touch notes a change to key in bucket, if it's one of those renamed. It
+// may be called on a nil rename. The caller must hold the write lock.
+func (r *bucketRename) touch(bucket, key string) {
+	if r != nil && (bucket == r.from || bucket == r.to) {
+		r.changed[key] = struct{}{}
+	}
+}
+
+// invalidate makes the copy start over if bucket is one of those renamed,
+// or whatever the bucket if it's empty. It may be called on a nil rename.
+// The caller must hold the write lock.
+func (r *bucketRename) invalidate(bucket string) {
+	if r != nil && (bucket == "" || bucket == r.from || bucket == r.to) {
+		r.stale = true
+	}
+}
+
+// RenameBucket moves every key of the bucket from to the bucket to, with
+// its value, metadata and lease, and returns the number of keys moved. It
+// fails with ErrorNoSuchBucket if from has no keys, and with
+// ErrorBucketExists if to has keys, unless merge is set, in which case the
+// keys of from replace those of to that they share. A single event is
+// logged, which replay applies the same way.
+//
+// Readers see either both buckets as they were or both renamed, never a
+// part of the keys moved. A rename to an empty bucket is made at once. A
+// merge copies the keys of both buckets into a new one in batches of
+// renameBatch under the read lock, noting the keys written meanwhile, and
+// takes the write lock only to bring those up to date, log the event and
+// put the copy in place. Quotas are checked against the destination's,
+// and a merge that would take it past them fails, unless it doesn't grow.
+func (s *Store) RenameBucket(ctx context.Context, from, to string, merge bool) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "store.RenameBucket", from, to)
+	defer func() { tracing.End(span, err) }()
+
+	if err := ValidateBucket(from); err != nil {
+		return 0, err
+	}
+	if err := ValidateBucket(to); err != nil {
+		return 0, err
+	}
+	if from == to {
+		return 0, fmt.Errorf("%w: bucket %q renamed to itself", ErrorInvalidBucket, from)
+	}
+
+	// Every key in the bucket must be cached to move with it
+	if err := s.loadAll(ctx); err != nil {
+		return 0, err
+	}
+
+	// One rename at a time, so that one tracker notes the changes
+	s.renameMu.Lock()
+	defer s.renameMu.Unlock()
+
+	for {
+		r, done, n, err := s.startRename(ctx, from, to, merge)
+		if done || err != nil {
+			return n, err
+		}
+
+		merged, bytes := s.copyRename(r)
+
+		if done, n, err := s.finishRename(ctx, r, merge, merged, bytes); done {
+			return n, err
+		}
+	}
+}
+
+// startRename checks that from can be renamed to to, and renames it at once
+// if to is empty. Otherwise it returns the tracker of a copy of both
+// buckets, which finishRename completes.
+func (s *Store) startRename(ctx context.Context, from, to string, merge bool) (r *bucketRename, done bool, n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkRename(from, to, merge); err != nil {
+		return nil, true, 0, err
+	}
+
+	src := s.m.take(from)
+
+	// The keys move with their maps, unless the destination's quota needs
+	// their size and the source has none to give
+	if s.m.len(to) == 0 && (!s.sizesBucket(to) || s.usage[from] != nil) {
+		var bytes int64
+		if u := s.usage[from]; u != nil {
+			bytes = u.bytes
+		}
+
+		if err := s.checkRenameQuota(to, src.len(), bytes); err != nil {
+			return nil, true, 0, err
+		}
+
+		n = src.len()
+		if IsDryRun(ctx) {
+			return nil, true, n, nil
+		}
+
+		e := translog.Event{EventType: translog.EventRenameBucket, Bucket: from, Value: to}
+		if err = s.log(ctx, e); !logged(err) {
+			return nil, true, 0, err
+		}
+
+		s.moveBucket(from, to, src, bytes)
+
+		return nil, true, n, err
+	}
+
+	s.renaming = &bucketRename{from: from, to: to, changed: make(map[string]struct{})}
+
+	return s.renaming, false, 0, nil
+}
+
+// checkRename returns the error a rename of from to to fails with now, if
+// any. The caller must hold the lock.
+func (s *Store) checkRename(from, to string, merge bool) error {
+	switch {
+	case s.readOnly:
+		return ErrorReadOnly
+	case s.m.len(from) == 0:
+		return fmt.Errorf("%w: %q", ErrorNoSuchBucket, from)
+	case s.m.len(to) > 0 && !merge:
+		return fmt.Errorf("%w: %q has %d keys", ErrorBucketExists, to, s.m.len(to))
+	}
+
+	return nil
+}
+
+// copyRename copies the keys of the buckets r renames into one bucket,
+// those of r.from over those of r.to, in batches of renameBatch under the
+// read lock, and returns it with the bytes it counts for in the
+// destination's usage, if its quota needs them. The copy may miss the
+// changes r notes. Writes of single keys take the write lock while r is
+// under way, so the read lock alone keeps the buckets from changing.
+func (s *Store) copyRename(r *bucketRename) (*shardedBucket, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sized := s.sizesBucket(r.to)
+	merged := &shardedBucket{}
+	var bytes int64
+	copied := 0
+
+	// A map may be ranged over while it's changed between batches: a key
+	// is then met once at most, and the keys missed were changed, so noted
+	copyBucket := func(b iter.Seq2[string, entry]) {
+		for key, e := range b {
+			if old, ok := merged.get(key); ok && sized {
+				bytes -= entrySize(key, old)
+			}
+
+			merged.set(key, e)
+			if sized {
+				bytes += entrySize(key, e)
+			}
+
+			if copied++; copied%renameBatch == 0 {
+				s.mu.RUnlock()
+				s.mu.RLock()
+
+				if r.stale {
+					return
+				}
+			}
+		}
+	}
+
+	copyBucket(s.m.bucket(r.to))
+	if !r.stale {
+		copyBucket(s.m.bucket(r.from))
+	}
+
+	return merged, bytes
+}
+
+// finishRename brings the copy of the buckets r renames up to date with the
+// changes r noted, and puts it in place of both under the write lock. It
+// reports false, with nothing done, if the copy must start over.
+func (s *Store) finishRename(ctx context.Context, r *bucketRename, merge bool, merged *shardedBucket, bytes int64) (done bool, n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer func() { s.renaming = nil }()
+
+	if r.stale {
+		return false, 0, nil
+	}
+
+	from, to := r.from, r.to
+
+	if err := s.checkRename(from, to, merge); err != nil {
+		return true, 0, err
+	}
+
+	sized := s.sizesBucket(to)
+
+	for key := range r.changed {
+		if old, ok := merged.get(key); ok && sized {
+			bytes -= entrySize(key, old)
+		}
+
+		e, ok := s.m.get(from, key)
+		if !ok {
+			e, ok = s.m.get(to, key)
+		}
+		if !ok {
+			merged.delete(key)
+			continue
+		}
+
+		merged.set(key, e)
+		if sized {
+			bytes += entrySize(key, e)
+		}
+	}
+
+	if err := s.checkRenameQuota(to, merged.len(), bytes); err != nil {
+		return true, 0, err
+	}
+
+	n = s.m.len(from)
+	if IsDryRun(ctx) {
+		return true, n, nil
+	}
+
+	e := translog.Event{EventType: translog.EventRenameBucket, Bucket: from, Value: to}
+	if err = s.log(ctx, e); !logged(err) {
+		return true, 0, err
+	}
+
+	s.moveBucket(from, to, merged, bytes)
+
+	return true, n, err
+}
+
+// sizesBucket reports whether the usage of bucket is kept, for its quota.
+func (s *Store) sizesBucket(bucket string) bool {
+	return s.usage != nil && !s.opts.Quotas.quota(bucket).IsZero()
+}
+
+// checkRenameQuota returns ErrorOverQuota if to would be past its quota
+// with keys keys of bytes bytes, and larger than it is. The caller must
+// hold the lock.
+func (s *Store) checkRenameQuota(to string, keys int, bytes int64) error {
+	if !s.sizesBucket(to) {
+		return nil
+	}
+
+	q := s.opts.Quotas.quota(to)
+
+	var cur bucketUsage
+	if u, ok := s.usage[to]; ok {
+		cur = *u
+	}
+
+	if q.MaxKeys > 0 && keys > q.MaxKeys && keys > cur.keys {
+		return fmt.Errorf("%w: bucket %q is limited to %d keys, and would have %d", ErrorOverQuota, to, q.MaxKeys, keys)
+	}
+
+	if q.MaxBytes > 0 && bytes > q.MaxBytes && bytes > cur.bytes {
+		return fmt.Errorf("%w: bucket %q is limited to %d bytes, and would take %d", ErrorOverQuota, to, q.MaxBytes, bytes)
+	}
+
+	return nil
+}
+
+// moveBucket replaces the buckets from and to with b, under the name to,
+// whose keys count bytes in its usage, if its quota needs them. The caller
+// must hold the write lock.
+func (s *Store) moveBucket(from, to string, b *shardedBucket, bytes int64) {
+	s.keys.Add(int64(b.len() - s.m.len(from) - s.m.len(to)))
+
+	s.m.move(from, to, b)
+
+	s.dropUsage(from)
+	s.dropUsage(to)
+	if s.sizesBucket(to) {
+		s.account(to, b.len(), bytes)
+	}
+
+	s.epoch.Add(1)
+	s.renaming.invalidate(from)
+	s.renaming.invalidate(to)
+
+	s.watchers.notifyBucket(from)
+	s.watchers.notifyBucket(to)
+}
+
+// rename applies a rename read from the log or a leader, as RenameBucket
+// made it: the keys of from replace those of to, and from is left empty.
+// The caller must hold the write lock.
+func (s *Store) rename(from, to string) {
+	src := s.m.take(from)
+	if src.len() == 0 {
+		return
+	}
+
+	b := src
+	if s.m.len(to) > 0 {
+		b = s.m.take(to).clone()
+		for key, e := range src.all() {
+			b.set(key, e)
+		}
+	}
+
+	var bytes int64
+	if s.sizesBucket(to) {
+		for key, e := range b.all() {
+			bytes += entrySize(key, e)
+		}
+	}
+
+	s.moveBucket(from, to, b, bytes)
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dump returns the keys of s with their values, by bucket and key, failing
+// the test if they can't be read.
+func dump(t *testing.T, s *Store) string {
+	t.Helper()
+
+	records, err := s.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(records)
+}
+
+func TestRenameBucket(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, closeLog := openLogged(t, dir, Options{})
+
+	put := func(bucket, key, value string) {
+		t.Helper()
+		if err := s.BucketPut(ctx, bucket, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("a", "k1", "a1")
+	put("a", "k2", "a2")
+	put("b", "k2", "b2")
+	put("b", "k3", "b3")
+	if _, _, err := s.BucketAcquireLease(ctx, "a", "k1", "owner", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		from, to string
+		merge    bool
+		err      error
+	}{
+		{"onto a bucket with keys", "a", "b", false, ErrorBucketExists},
+		{"from an empty bucket", "none", "c", false, ErrorNoSuchBucket},
+		{"to itself", "a", "a", true, ErrorInvalidBucket},
+		{"to an invalid name", "a", "x/y", false, ErrorInvalidBucket},
+	} {
+		if _, err := s.RenameBucket(ctx, tt.from, tt.to, tt.merge); !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// To a bucket without keys, with their metadata and leases
+	if n, err := s.RenameBucket(ctx, "a", "c", false); err != nil || n != 2 {
+		t.Fatalf("renaming a to c: %d, %v", n, err)
+	}
+	if _, _, err := s.BucketGetWithMeta(ctx, "a", "k1"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("a/k1 after the rename: %v", err)
+	}
+	if v, meta, err := s.BucketGetWithMeta(ctx, "c", "k1"); err != nil || v != "a1" || meta.Version != 1 {
+		t.Errorf("c/k1 after the rename: %q, %+v, %v", v, meta, err)
+	}
+	if _, ok, err := s.BucketAcquireLease(ctx, "c", "k1", "other", time.Hour); err != nil || ok {
+		t.Errorf("c/k1 leased by another after the rename: %v, %v", ok, err)
+	}
+
+	// A merge replaces the keys the buckets share, and keeps the others
+	if n, err := s.RenameBucket(ctx, "c", "b", true); err != nil || n != 2 {
+		t.Fatalf("merging c into b: %d, %v", n, err)
+	}
+	for key, want := range map[string]string{"k1": "a1", "k2": "a2", "k3": "b3"} {
+		if v, _, err := s.BucketGetWithMeta(ctx, "b", key); err != nil || v != want {
+			t.Errorf("b/%s after the merge: %q, %v", key, v, err)
+		}
+	}
+	if s.KeyCount() != 3 {
+		t.Errorf("%d keys after the merge", s.KeyCount())
+	}
+
+	// A dry run changes nothing
+	before := dump(t, s)
+	if n, err := s.RenameBucket(WithDryRun(ctx), "b", "d", false); err != nil || n != 3 {
+		t.Errorf("a dry run: %d, %v", n, err)
+	}
+	if after := dump(t, s); after != before {
+		t.Errorf("a dry run renamed: %s", after)
+	}
+
+	// The renames replay to the same store
+	closeLog()
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+	if got := dump(t, s); got != before {
+		t.Errorf("replayed: %s, want %s", got, before)
+	}
+}
+
+func TestReadsAndWritesRaceARename(t *testing.T) {
+	ctx := context.Background()
+	l := &stubLogger{}
+	s := New(l, Options{})
+
+	// Large enough buckets to be copied in several batches, one of them
+	// with a key marking which bucket is which
+	const keys = 4 * renameBatch
+	for i := range keys {
+		for _, bucket := range []string{"src", "dst"} {
+			if err := s.BucketPut(ctx, bucket, fmt.Sprintf("k%05d", i), bucket+"0"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.BucketPut(ctx, "src", "marker", "src"); err != nil {
+		t.Fatal(err)
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+
+	// Readers check, reading both buckets at once, that the rename is
+	// either not made or made, never half way
+	var reads atomic.Int64
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for !stop.Load() {
+				outcome, err := s.Txn(ctx, Txn{Then: []TxnOp{
+					{Type: TxnGet, Bucket: "src", Key: "marker"},
+					{Type: TxnGet, Bucket: "dst", Key: "marker"},
+				}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if outcome.Results[0].Found == outcome.Results[1].Found {
+					t.Errorf("the marker in both buckets, or in neither: %+v", outcome.Results)
+					return
+				}
+				reads.Add(1)
+			}
+		}()
+	}
+
+	// Writers keep writing to both buckets, each write acknowledged before
+	// the rename ending in dst, and every one after it where it was made
+	var writes atomic.Int64
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; !stop.Load(); i++ {
+				bucket := []string{"src", "dst"}[i%2]
+				key := fmt.Sprintf("k%05d", (i*7+w*1000)%keys)
+				if i%5 == 4 {
+					key = fmt.Sprintf("w%d-%d", w, i) // A new key
+				}
+
+				var err error
+				if i%11 == 10 {
+					err = s.BucketDelete(ctx, bucket, key)
+					if errors.Is(err, ErrorNoSuchKey) {
+						err = nil
+					}
+				} else {
+					err = s.BucketPut(ctx, bucket, key, fmt.Sprintf("%s%d-%d", bucket, w, i))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				writes.Add(1)
+			}
+		}()
+	}
+
+	// Let the writers get going, then merge src into dst, and again the
+	// other way round
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.RenameBucket(ctx, "src", "dst", true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.RenameBucket(ctx, "dst", "src", true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	stop.Store(true)
+	wg.Wait()
+
+	if reads.Load() == 0 || writes.Load() == 0 {
+		t.Fatalf("%d reads and %d writes made during the renames", reads.Load(), writes.Load())
+	}
+
+	// The store is the one its log replays to: no write made during a
+	// rename was lost or moved to the wrong bucket
+	replayed := New(&stubLogger{}, Options{})
+	for _, e := range l.logged() {
+		if err := replayed.ApplyEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := dump(t, replayed), dump(t, s); got != want {
+		t.Error("the replayed log differs from the store that wrote it")
+	}
+	if s.KeyCount() != replayed.KeyCount() {
+		t.Errorf("%d keys, %d replayed", s.KeyCount(), replayed.KeyCount())
+	}
+}
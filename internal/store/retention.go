@@ -0,0 +1,232 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy deletes keys that haven't been written for a while. A
+// key's age is taken from its Modified metadata, which replay takes from the
+// time each event was logged: keys replayed from logs older than event
+// timestamps count as written when they were loaded, so they are kept
+// longer rather than purged early.
+type RetentionPolicy struct {
+	MaxAge   time.Duration   // Age of the keys to delete; 0 keeps keys forever
+	Prefixes []RetentionRule // Overrides of MaxAge for the keys with a prefix
+
+	Interval time.Duration // Time between scans
+	Rate     int           // Maximum deletions per second; 0 is unlimited
+	DryRun   bool          // Report the keys that would be deleted without deleting them
+}
+
+// RetentionRule overrides a RetentionPolicy's MaxAge for the keys, in any
+// bucket, that start with Prefix.
+type RetentionRule struct {
+	Prefix string
+	MaxAge time.Duration // 0 keeps the keys forever
+}
+
+// ParseRetentionRules parses a comma-separated list of prefix=age rules, such
+// as "sessions/=24h,audit/=0".
+func ParseRetentionRules(s string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		prefix, age, ok := strings.Cut(field, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || prefix == "" {
+			return nil, fmt.Errorf("retention rule %q: expected prefix=age", field)
+		}
+
+		maxAge, err := time.ParseDuration(strings.TrimSpace(age))
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("retention rule %q: invalid age %q", field, age)
+		}
+
+		rules = append(rules, RetentionRule{Prefix: prefix, MaxAge: maxAge})
+	}
+
+	return rules, nil
+}
+
+// Enabled reports whether the policy can delete anything.
+func (p RetentionPolicy) Enabled() bool {
+	if p.MaxAge > 0 {
+		return true
+	}
+
+	for _, r := range p.Prefixes {
+		if r.MaxAge > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxAge returns the age at which key is deleted, set by the rule with the
+// longest matching prefix.
+func (p RetentionPolicy) maxAge(key string) time.Duration {
+	maxAge, longest := p.MaxAge, -1
+
+	for _, r := range p.Prefixes {
+		if strings.HasPrefix(key, r.Prefix) && len(r.Prefix) > longest {
+			maxAge, longest = r.MaxAge, len(r.Prefix)
+		}
+	}
+
+	return maxAge
+}
+
+// ExpiredKey is a key found past its retention age.
+type ExpiredKey struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Modified time.Time `json:"modified"`
+}
+
+// PurgeReport summarizes a retention scan.
+type PurgeReport struct {
+	Scanned int          `json:"scanned"`
+	Expired []ExpiredKey `json:"expired"`
+	Deleted int          `json:"deleted"` // Fewer than expired if keys were written during the purge, and 0 in dry runs
+	DryRun  bool         `json:"dry_run,omitempty"`
+}
+
+// Purge deletes the keys older than the policy allows at now. Each deletion
+// is logged as an ordinary delete event, so replicas and replay see it, and
+// takes the write lock on its own, paced by the policy's Rate, so that a
+// large purge doesn't hold up other requests. A key written after the scan,
+// or under a lease, is kept.
+func (s *Store) Purge(ctx context.Context, p RetentionPolicy, now time.Time) (PurgeReport, error) {
+	report := PurgeReport{DryRun: p.DryRun}
+
+	// Ages of keys held only by the backing are known once they're cached
+	if err := s.loadAll(ctx); err != nil {
+		return report, err
+	}
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			report.Scanned++
+
+			if maxAge := p.maxAge(key); maxAge > 0 && now.Sub(e.meta.Modified) > maxAge {
+				report.Expired = append(report.Expired, ExpiredKey{bucket, key, e.meta.Modified})
+			}
+		}
+	}
+	s.runlockScan()
+
+	sort.Slice(report.Expired, func(i, j int) bool {
+		if report.Expired[i].Bucket != report.Expired[j].Bucket {
+			return report.Expired[i].Bucket < report.Expired[j].Bucket
+		}
+		return report.Expired[i].Key < report.Expired[j].Key
+	})
+
+	if p.DryRun {
+		return report, nil
+	}
+
+	var pace <-chan time.Time
+	if p.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(p.Rate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	for _, x := range report.Expired {
+		if pace != nil {
+			select {
+			case <-pace:
+			case <-ctx.Done():
+				return report, ctx.Err()
+			}
+		}
+
+		deleted, err := s.deleteUnmodified(ctx, x.Bucket, x.Key, x.Modified)
+		if err != nil {
+			return report, err
+		}
+		if deleted {
+			report.Deleted++
+		}
+	}
+
+	return report, nil
+}
+
+// deleteUnmodified logs and applies the deletion of key if it was last
+// written at modified and isn't leased, and reports whether it did.
+func (s *Store) deleteUnmodified(ctx context.Context, bucket, key string, modified time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return false, ErrorReadOnly
+	}
+
+	// A key under a lease is being worked on, and is kept until it's over
+	if e, ok := s.lookup(bucket, key); !ok || !e.meta.Modified.Equal(modified) || e.lease.live(time.Now()) {
+		return false, nil
+	}
+
+	e := translog.Event{EventType: translog.EventDelete, Bucket: bucket, Key: key}
+	err := s.log(ctx, e)
+	if !logged(err) {
+		return false, err
+	}
+
+	s.remove(bucket, key)
+
+	return true, err
+}
+
+// RunRetention purges st by p, and clears its expired leases, every
+// p.Interval until ctx is done. Scans are skipped while the store is read-only, as when following a leader, whose
+// own deletions are replicated instead.
+func RunRetention(ctx context.Context, st *Store, p RetentionPolicy) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if on, _ := st.ReadOnly(); on {
+			continue
+		}
+
+		report, err := st.Purge(ctx, p, time.Now())
+
+		if p.DryRun {
+			for _, x := range report.Expired {
+				log.Printf("retention dry run: would delete %s/%s, last written %s\n", x.Bucket, x.Key, x.Modified.Format(time.RFC3339))
+			}
+		}
+
+		log.Printf("retention: scanned %d keys, %d expired, %d deleted\n", report.Scanned, len(report.Expired), report.Deleted)
+
+		if n := st.ReapLeases(time.Now()); n > 0 {
+			log.Printf("retention: cleared %d expired leases\n", n)
+		}
+
+		if err != nil && ctx.Err() == nil {
+			log.Printf("retention purge stopped: %v\n", err)
+		}
+	}
+}
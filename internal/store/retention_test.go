@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// aged is a put logged at a time before now.
+type aged struct {
+	bucket, key string
+	age         time.Duration
+}
+
+// openAged returns a store replayed from a log in dir of the puts, in order,
+// stamped as written their age before now, and a function closing its
+// logger.
+func openAged(t *testing.T, dir string, now time.Time, puts []aged) (*Store, func()) {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, errs := l.ReadEvents()
+	for range events {
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i, p := range puts {
+		e := translog.Event{Sequence: uint64(i + 1), EventType: translog.EventPut, Bucket: p.bucket, Key: p.key, Value: "v", Time: now.Add(-p.age)}
+		if err := l.WriteEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return openLogged(t, dir, Options{})
+}
+
+// present returns which of the keys of puts are in s.
+func present(t *testing.T, s *Store, puts []aged) map[string]bool {
+	t.Helper()
+
+	found := make(map[string]bool)
+	for _, p := range puts {
+		_, _, err := s.BucketGetWithMeta(context.Background(), p.bucket, p.key)
+		found[p.bucket+"/"+p.key] = err == nil
+	}
+
+	return found
+}
+
+func TestPurgeDeletesOnlyExpiredKeys(t *testing.T) {
+	const day = 24 * time.Hour
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+
+	puts := []aged{
+		{translog.DefaultBucket, "old", 40 * day},
+		{translog.DefaultBucket, "recent", day},
+		{translog.DefaultBucket, "rewritten", 40 * day},
+		{translog.DefaultBucket, "rewritten", day},
+		{translog.DefaultBucket, "sessions/a", 2 * day},
+		{translog.DefaultBucket, "sessions/b", time.Hour},
+		{translog.DefaultBucket, "audit/x", 400 * day},
+		{"other", "old", 31 * day},
+		{"other", "sessions/a", 29 * day},
+	}
+	s, closeLog := openAged(t, dir, now, puts)
+
+	policy := RetentionPolicy{
+		MaxAge:   30 * day,
+		Prefixes: []RetentionRule{{Prefix: "sessions/", MaxAge: day}, {Prefix: "audit/", MaxAge: 0}},
+		DryRun:   true,
+	}
+
+	// Keys past the age of their longest matching prefix, or the global age
+	// without one, expire; the last write, not the first, sets the age
+	want := []ExpiredKey{
+		{translog.DefaultBucket, "old", now.Add(-40 * day)},
+		{translog.DefaultBucket, "sessions/a", now.Add(-2 * day)},
+		{"other", "old", now.Add(-31 * day)},
+		{"other", "sessions/a", now.Add(-29 * day)},
+	}
+
+	// A dry run reports them and deletes nothing
+	report, err := s.Purge(context.Background(), policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Expired) != fmt.Sprint(want) || report.Deleted != 0 || report.Scanned != 8 {
+		t.Errorf("dry run: %+v; want %d scanned and %v expired, none deleted", report, 8, want)
+	}
+	for key, ok := range present(t, s, puts) {
+		if !ok {
+			t.Errorf("dry run deleted %s", key)
+		}
+	}
+
+	// The purge deletes them, and only them
+	policy.DryRun = false
+	report, err = s.Purge(context.Background(), policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Expired) != fmt.Sprint(want) || report.Deleted != len(want) {
+		t.Errorf("purge: %+v; want %v expired and deleted", report, want)
+	}
+
+	expired := make(map[string]bool)
+	for _, x := range want {
+		expired[x.Bucket+"/"+x.Key] = true
+	}
+	check := func(when string, found map[string]bool) {
+		t.Helper()
+		for key, ok := range found {
+			if ok == expired[key] {
+				t.Errorf("%s: %s present %v, expired %v", when, key, ok, expired[key])
+			}
+		}
+	}
+	check("after the purge", present(t, s, puts))
+	closeLog()
+
+	// The deletions are logged, so replay agrees
+	replayed, closeLog := openLogged(t, dir, Options{})
+	defer closeLog()
+
+	check("after replay", present(t, replayed, puts))
+}
+
+func TestPurgeIsRateLimited(t *testing.T) {
+	const n, rate = 10, 50
+	now := time.Now()
+
+	var puts []aged
+	for i := range n {
+		puts = append(puts, aged{translog.DefaultBucket, fmt.Sprintf("k%d", i), time.Hour})
+	}
+	s, closeLog := openAged(t, t.TempDir(), now, puts)
+	defer closeLog()
+
+	ctx := context.Background()
+	policy := RetentionPolicy{MaxAge: time.Minute, Rate: rate}
+
+	done := make(chan PurgeReport)
+	start := time.Now()
+	go func() {
+		report, err := s.Purge(ctx, policy, now)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- report
+	}()
+
+	// Writes aren't held up while the purge runs, and a key written after
+	// it scanned is kept
+	time.Sleep(time.Second / rate / 2)
+	written := time.Now()
+	if err := s.PutCtx(ctx, puts[n-1].key, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(written); took > 100*time.Millisecond {
+		t.Errorf("a write during the purge took %v", took)
+	}
+
+	report := <-done
+	if took, min := time.Since(start), n*time.Second/rate; took < min*9/10 {
+		t.Errorf("purged %d keys at %d a second in %v, want at least %v", n, rate, took, min)
+	}
+	if len(report.Expired) != n || report.Deleted != n-1 {
+		t.Errorf("%d expired and %d deleted, want %d and %d", len(report.Expired), report.Deleted, n, n-1)
+	}
+	if v, err := s.Get(puts[n-1].key); v != "new" {
+		t.Errorf("key written during the purge: %q, %v", v, err)
+	}
+
+	// A purge stops when its context is done
+	for i := range n {
+		if err := s.PutCtx(ctx, fmt.Sprintf("more%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	canceled, cancel := context.WithTimeout(ctx, time.Second/rate*3)
+	defer cancel()
+
+	report, err := s.Purge(canceled, policy, time.Now().Add(time.Hour))
+	if !errors.Is(err, context.DeadlineExceeded) || report.Deleted == 0 || report.Deleted >= len(report.Expired) {
+		t.Errorf("purge stopped part way: %v, %d of %d deleted", err, report.Deleted, len(report.Expired))
+	}
+}
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules("sessions/=24h, audit/=0,,tmp/=90m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[{sessions/ 24h0m0s} {audit/ 0s} {tmp/ 1h30m0s}]"; fmt.Sprint(rules) != want {
+		t.Errorf("rules %v, want %s", rules, want)
+	}
+
+	for _, s := range []string{"sessions/", "=24h", "a=soon", "a=-1h"} {
+		if _, err := ParseRetentionRules(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
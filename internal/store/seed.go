@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/translog"
+)
+
+// ErrorSeedConflict is returned by Seed when the store already holds a
+// different value for some of the seed's keys.
+var ErrorSeedConflict = errors.New("seed conflicts with the stored data")
+
+// SeedReport describes what Seed did.
+type SeedReport struct {
+	Loaded    int      // Keys written from the seed
+	Unchanged int      // Keys the store already held with the seed's value
+	Conflicts []string // Keys, as bucket/key, the store holds with another value
+}
+
+// Seed writes records, as exported by Dump, to the store and its log, so
+// that a new instance can start out with another's data. Keys the store
+// already holds with the same value are left alone, so seeding again from
+// the same records changes nothing. Keys it holds with another value are
+// conflicts: unless keepLocal is set, Seed then fails with
+// ErrorSeedConflict before writing anything; with it, the stored values are
+// kept and the rest of the seed is loaded.
+//
+// The records are written as one batch, under a single hold of the write
+// lock, and Seed waits for them to be durable before returning. Their
+// notifications are coalesced, as those of a bulk operation: see
+// WatchBatches.
+func (s *Store) Seed(ctx context.Context, records []Record, keepLocal bool) (SeedReport, error) {
+	var report SeedReport
+
+	type encoded struct {
+		Record
+		original string
+		stored   string
+		codec    compress.Codec
+	}
+
+	batch := make([]encoded, 0, len(records))
+
+	for _, rec := range records {
+		if rec.Bucket == "" {
+			rec.Bucket = DefaultBucket
+		}
+
+		if rec.Bucket != DefaultBucket {
+			if err := ValidateBucket(rec.Bucket); err != nil {
+				return report, err
+			}
+		}
+		if err := ValidateKey(rec.Key); err != nil {
+			return report, fmt.Errorf("%w: %q", err, rec.Key)
+		}
+
+		stored, codec, err := s.encode(rec.Value)
+		if err != nil {
+			return report, err
+		}
+
+		original := rec.Key
+		rec.Key = s.foldKey(rec.Key)
+
+		batch = append(batch, encoded{rec, original, stored, codec})
+	}
+
+	if err := s.loadAll(ctx); err != nil {
+		return report, err
+	}
+
+	b := s.openBatch("seed", "", "")
+	defer s.closeBatch(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return report, ErrorReadOnly
+	}
+
+	// Conflicts are all found before anything is written
+	var writes []encoded
+	seen := make(map[[2]string]string) // Values of the keys to write, which may repeat once folded
+
+	for _, rec := range batch {
+		e, ok := s.lookup(rec.Bucket, rec.Key)
+		if !ok {
+			if value, dup := seen[[2]string{rec.Bucket, rec.Key}]; dup {
+				if value == rec.Value {
+					report.Unchanged++
+				} else {
+					report.Conflicts = append(report.Conflicts, rec.Bucket+"/"+rec.original)
+				}
+				continue
+			}
+
+			seen[[2]string{rec.Bucket, rec.Key}] = rec.Value
+			writes = append(writes, rec)
+			continue
+		}
+
+		current, err := s.decode(e)
+		if err != nil {
+			return report, err
+		}
+
+		if current == rec.Value {
+			report.Unchanged++
+		} else {
+			report.Conflicts = append(report.Conflicts, rec.Bucket+"/"+rec.Key)
+		}
+	}
+
+	if len(report.Conflicts) > 0 && !keepLocal {
+		return report, fmt.Errorf("%w: %d keys differ, such as %s", ErrorSeedConflict, len(report.Conflicts), report.Conflicts[0])
+	}
+
+	since := s.m.now()
+	for _, rec := range writes {
+		e := translog.Event{EventType: translog.EventPut, Bucket: rec.Bucket, Key: rec.Key, Value: rec.stored, Codec: rec.codec, Time: stamp()}
+		if err := s.enqueue(ctx, e); err != nil {
+			return report, err
+		}
+
+		s.setAt(rec.Bucket, rec.Key, rec.stored, rec.codec, "", e.Time)
+		report.Loaded++
+
+		if rec.original != rec.Key {
+			mark := translog.Event{EventType: translog.EventOriginalKey, Bucket: rec.Bucket, Key: rec.Key, Value: rec.original}
+			if err := s.enqueue(ctx, mark); err != nil {
+				return report, err
+			}
+			s.noteOriginal(rec.Bucket, rec.Key, rec.original)
+		}
+	}
+
+	if report.Loaded == 0 {
+		return report, nil
+	}
+	s.evict(ctx, since)
+
+	return report, s.logger.Flush(ctx)
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	seed := []Record{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2"},
+		{Bucket: "other", Key: "a", Value: "3"},
+	}
+
+	s, closeLog := openLogged(t, dir, Options{})
+	report, err := s.Seed(ctx, seed, false)
+	if err != nil || report.Loaded != 3 || s.Sequence() != 3 {
+		t.Fatalf("seeding an empty store: %+v, %v, at sequence %d", report, err, s.Sequence())
+	}
+	if err := s.PutCtx(ctx, "local", "v"); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	// The seed was logged, so a restart has it without seeding, and seeding
+	// again with the same records changes nothing
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if v, _, err := s.BucketGetWithMeta(ctx, "other", "a"); v != "3" || err != nil {
+		t.Errorf("other/a after a restart: %q, %v", v, err)
+	}
+
+	report, err = s.Seed(ctx, seed, false)
+	if err != nil || report.Loaded != 0 || report.Unchanged != 3 || s.Sequence() != 4 {
+		t.Errorf("seeding again: %+v, %v, at sequence %d", report, err, s.Sequence())
+	}
+
+	// A seed differing from the store writes nothing, unless the local
+	// values are to be kept
+	conflicting := []Record{
+		{Key: "a", Value: "1"},
+		{Key: "local", Value: "seeded"},
+		{Key: "new", Value: "v"},
+	}
+
+	report, err = s.Seed(ctx, conflicting, false)
+	if !errors.Is(err, ErrorSeedConflict) || len(report.Conflicts) != 1 || report.Conflicts[0] != "default/local" {
+		t.Fatalf("a conflicting seed: %+v, %v", report, err)
+	}
+	if _, err := s.Get("new"); err != ErrorNoSuchKey || s.Sequence() != 4 {
+		t.Errorf("a refused seed was written: %v, at sequence %d", err, s.Sequence())
+	}
+
+	report, err = s.Seed(ctx, conflicting, true)
+	if err != nil || report.Loaded != 1 || report.Unchanged != 1 || len(report.Conflicts) != 1 {
+		t.Errorf("a conflicting seed merged: %+v, %v", report, err)
+	}
+	if v, _ := s.Get("local"); v != "v" {
+		t.Errorf("local is %q after a merge, want the stored v", v)
+	}
+	if v, _ := s.Get("new"); v != "v" {
+		t.Errorf("new is %q after a merge, want the seeded v", v)
+	}
+
+	if _, err := s.Seed(ctx, []Record{{Key: "", Value: "v"}}, false); err == nil {
+		t.Error("a seed with an empty key was loaded")
+	}
+}
@@ -0,0 +1,522 @@
+package store
+
+import (
+	"container/list"
+	"hash/maphash"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// shardCount is the number of shards the keys of a store are split into.
+const shardCount = 64
+
+// shardSeed hashes keys to their shard. It is shared by every map of the
+// process, so that a map built apart, as by a restore, splits keys as the
+// one it replaces does.
+var shardSeed = maphash.MakeSeed()
+
+// shardOf returns the index of the shard holding key.
+func shardOf(key string) int {
+	return int(maphash.String(shardSeed, key) % shardCount)
+}
+
+// shard is the keys of every bucket whose hash falls to one shard.
+type shard struct {
+	wmu    sync.Mutex                  // Held by the write of one of its keys, from its lookup until it's applied
+	mu     sync.RWMutex                // Held to change m, and to read a key of it without the writer lock
+	m      map[string]map[string]entry // Entries by bucket, then by key
+	recent *recency                    // Keys in the order they were used; nil unless the map tracks it
+}
+
+// shardedMap holds the entries of a store, split into shardCount shards by
+// the hash of their key, each with two locks. A shard is changed either
+// under the store's write lock, or by the write of one of its keys, which
+// holds the store's read lock and the shard's writer lock, so that the
+// writes of keys in different shards run at once, while those of a shard
+// are applied in the order they are logged. Every change also takes the
+// lock of the shard, under which a single key is read, as by get and
+// load. Reads of more than one key hold the store's read lock and the
+// writer lock of every shard, as lockWriters takes them, or its write
+// lock, so that no shard changes under them.
+//
+// A map may also track the order its keys were used in, and the bytes they
+// take, for eviction.
+type shardedMap struct {
+	shards      [shardCount]shard
+	defaultSize int // Keys the default bucket is sized for in each shard
+
+	clock atomic.Int64 // Uses of keys so far, across shards, which time them
+}
+
+// newShardedMap returns an empty map whose default bucket is made with room
+// for size keys. Most keys live in the default bucket, so it's sized up
+// front to spare it from growing through every power of two.
+func newShardedMap(size int) *shardedMap {
+	m := &shardedMap{defaultSize: size / shardCount}
+	for i := range m.shards {
+		m.shards[i].m = make(map[string]map[string]entry)
+	}
+
+	return m
+}
+
+// get returns the entry of key, under the read lock of its shard. The
+// caller must hold the store's lock.
+func (m *shardedMap) get(bucket, key string) (entry, bool) {
+	sh := &m.shards[shardOf(key)]
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, ok := sh.m[bucket][key]
+	return e, ok
+}
+
+// load is get for callers not holding the store's lock, which marks key
+// used.
+func (m *shardedMap) load(bucket, key string) (entry, bool) {
+	sh := &m.shards[shardOf(key)]
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, ok := sh.m[bucket][key]
+	if ok && sh.recent != nil {
+		sh.recent.use(watchKey{bucket, key}, &m.clock)
+	}
+
+	return e, ok
+}
+
+// set stores e under key. The caller must hold the store's write lock, or
+// the lock of a write of key, as Store.lockKey takes it.
+func (m *shardedMap) set(bucket, key string, e entry) {
+	sh := &m.shards[shardOf(key)]
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	b, ok := sh.m[bucket]
+	if !ok {
+		size := 0
+		if bucket == DefaultBucket {
+			size = m.defaultSize
+		}
+
+		b = make(map[string]entry, size)
+		sh.m[bucket] = b
+	}
+
+	if sh.recent != nil {
+		sh.recent.add(watchKey{bucket, key}, entrySize(key, e), &m.clock)
+	}
+
+	b[key] = e
+}
+
+// delete removes key, dropping its bucket from the shard once it has no
+// keys there, and returns the entry it had. The caller must hold the
+// store's write lock, or the lock of a write of key.
+func (m *shardedMap) delete(bucket, key string) (entry, bool) {
+	sh := &m.shards[shardOf(key)]
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	b := sh.m[bucket]
+	e, ok := b[key]
+	if !ok {
+		return entry{}, false
+	}
+
+	delete(b, key)
+	if len(b) == 0 {
+		delete(sh.m, bucket)
+	}
+
+	if sh.recent != nil {
+		sh.recent.forget(watchKey{bucket, key})
+	}
+
+	return e, true
+}
+
+// len returns the number of keys in bucket. The caller must hold the
+// store's write lock, or its read lock with lockWriters.
+func (m *shardedMap) len(bucket string) int {
+	n := 0
+	for i := range m.shards {
+		n += len(m.shards[i].m[bucket])
+	}
+
+	return n
+}
+
+// buckets returns the names of the buckets holding at least one key, in
+// lexical order. The caller must hold the store's write lock, or its read
+// lock with lockWriters.
+func (m *shardedMap) buckets() []string {
+	names := make(map[string]struct{})
+	for i := range m.shards {
+		for name := range m.shards[i].m {
+			names[name] = struct{}{}
+		}
+	}
+
+	return slices.Sorted(maps.Keys(names))
+}
+
+// bucket returns the keys of bucket with their entries, in no order. The
+// caller must hold the store's write lock, or its read lock with
+// lockWriters.
+func (m *shardedMap) bucket(bucket string) iter.Seq2[string, entry] {
+	return func(yield func(string, entry) bool) {
+		for i := range m.shards {
+			for key, e := range m.shards[i].m[bucket] {
+				if !yield(key, e) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// parts returns the keys of every bucket, as the name of a bucket with the
+// keys of it in one shard, so each bucket may come once per shard. The
+// caller must hold the store's write lock, or its read lock with
+// lockWriters, and not change the maps.
+func (m *shardedMap) parts() iter.Seq2[string, map[string]entry] {
+	return func(yield func(string, map[string]entry) bool) {
+		for i := range m.shards {
+			for name, b := range m.shards[i].m {
+				if !yield(name, b) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// copy returns the entries of the map in one map by bucket and then key.
+// The caller must hold the store's write lock, or its read lock with
+// lockWriters.
+func (m *shardedMap) copy() map[string]map[string]entry {
+	c := make(map[string]map[string]entry)
+	for name, b := range m.parts() {
+		if c[name] == nil {
+			c[name] = make(map[string]entry, len(b))
+		}
+		maps.Copy(c[name], b)
+	}
+
+	return c
+}
+
+// take returns the keys of bucket, as they are split into shards, without
+// copying them. The caller must hold the store's write lock, and not
+// change them while they are still in the map.
+func (m *shardedMap) take(bucket string) *shardedBucket {
+	var b shardedBucket
+	for i := range m.shards {
+		b[i] = m.shards[i].m[bucket]
+	}
+
+	return &b
+}
+
+// writer returns the writer lock of the shard of key.
+func (m *shardedMap) writer(key string) *sync.Mutex {
+	return &m.shards[shardOf(key)].wmu
+}
+
+// lockWriters takes the writer lock of every shard, in order, so that no
+// write of a single key changes the map until unlockWriters. The caller
+// must hold the store's read lock.
+func (m *shardedMap) lockWriters() {
+	for i := range m.shards {
+		m.shards[i].wmu.Lock()
+	}
+}
+
+func (m *shardedMap) unlockWriters() {
+	for i := range m.shards {
+		m.shards[i].wmu.Unlock()
+	}
+}
+
+// drop removes the keys of bucket. The caller must hold the store's write
+// lock.
+func (m *shardedMap) drop(bucket string) {
+	for i := range m.shards {
+		sh := &m.shards[i]
+
+		sh.mu.Lock()
+		m.forget(sh, bucket)
+		delete(sh.m, bucket)
+		sh.mu.Unlock()
+	}
+}
+
+// move replaces the keys of from and to with b, under the name to. Each
+// shard is changed under its lock at once, so a read of one key finds it
+// as it was in either bucket or as it is moved. The caller must hold the
+// store's write lock.
+func (m *shardedMap) move(from, to string, b *shardedBucket) {
+	for i := range m.shards {
+		sh := &m.shards[i]
+
+		sh.mu.Lock()
+		m.forget(sh, from)
+		m.forget(sh, to)
+		delete(sh.m, from)
+		if len(b[i]) == 0 {
+			delete(sh.m, to)
+		} else {
+			sh.m[to] = b[i]
+			m.remember(sh, to)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// replace replaces the entries of m with those of other, which must no
+// longer be used. The caller must hold the store's write lock.
+func (m *shardedMap) replace(other *shardedMap) {
+	for i := range m.shards {
+		sh := &m.shards[i]
+
+		sh.mu.Lock()
+		sh.m = other.shards[i].m
+		if sh.recent != nil {
+			sh.recent = newRecency()
+			for name := range sh.m {
+				m.remember(sh, name)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// track makes m track the order its keys are used in and the bytes they
+// take. It must be called while m is still empty.
+func (m *shardedMap) track() {
+	for i := range m.shards {
+		m.shards[i].recent = newRecency()
+	}
+}
+
+// remember marks the keys of bucket in sh used now, as if they were all just
+// set. The caller must hold the lock of sh.
+func (m *shardedMap) remember(sh *shard, bucket string) {
+	if sh.recent == nil {
+		return
+	}
+
+	for key, e := range sh.m[bucket] {
+		sh.recent.add(watchKey{bucket, key}, entrySize(key, e), &m.clock)
+	}
+}
+
+// forget stops tracking the keys of bucket in sh, before they are removed.
+// The caller must hold the lock of sh.
+func (m *shardedMap) forget(sh *shard, bucket string) {
+	if sh.recent == nil {
+		return
+	}
+
+	for key := range sh.m[bucket] {
+		sh.recent.forget(watchKey{bucket, key})
+	}
+}
+
+// touch marks key used now, if m tracks it and has the key. The caller must
+// hold the store's lock.
+func (m *shardedMap) touch(bucket, key string) {
+	if sh := &m.shards[shardOf(key)]; sh.recent != nil {
+		sh.recent.use(watchKey{bucket, key}, &m.clock)
+	}
+}
+
+// now returns the time of the last use of a key, as touch counts it.
+func (m *shardedMap) now() int64 {
+	return m.clock.Load()
+}
+
+// bytes returns the bytes the keys of m take, as quotas count them, if m
+// tracks them. The caller must hold the store's lock.
+func (m *shardedMap) bytes() int64 {
+	var n int64
+	for i := range m.shards {
+		if r := m.shards[i].recent; r != nil {
+			n += r.size()
+		}
+	}
+
+	return n
+}
+
+// leastRecent returns the key of m used longest ago, if it was used at the
+// time since, as now counts it, or before. The caller must hold the store's
+// write lock.
+func (m *shardedMap) leastRecent(since int64) (watchKey, bool) {
+	var oldest watchKey
+	used := since + 1
+
+	for i := range m.shards {
+		if k, at, ok := m.shards[i].recent.first(); ok && at < used {
+			oldest, used = k, at
+		}
+	}
+
+	return oldest, used <= since
+}
+
+// shardedBucket is the keys of one bucket, split into shards as a
+// shardedMap splits them, for a bucket built apart and put in a map whole.
+type shardedBucket [shardCount]map[string]entry
+
+// get returns the entry of key.
+func (b *shardedBucket) get(key string) (entry, bool) {
+	e, ok := b[shardOf(key)][key]
+	return e, ok
+}
+
+// set stores e under key.
+func (b *shardedBucket) set(key string, e entry) {
+	i := shardOf(key)
+	if b[i] == nil {
+		b[i] = make(map[string]entry)
+	}
+
+	b[i][key] = e
+}
+
+// delete removes key.
+func (b *shardedBucket) delete(key string) {
+	delete(b[shardOf(key)], key)
+}
+
+// len returns the number of keys in b.
+func (b *shardedBucket) len() int {
+	n := 0
+	for _, part := range b {
+		n += len(part)
+	}
+
+	return n
+}
+
+// all returns the keys of b with their entries, in no order.
+func (b *shardedBucket) all() iter.Seq2[string, entry] {
+	return func(yield func(string, entry) bool) {
+		for _, part := range b {
+			for key, e := range part {
+				if !yield(key, e) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// clone returns a copy of b.
+func (b *shardedBucket) clone() *shardedBucket {
+	var c shardedBucket
+	for i, part := range b {
+		if part != nil {
+			c[i] = maps.Clone(part)
+		}
+	}
+
+	return &c
+}
+
+// recency is the keys of a shard in the order they were last used, least
+// recently first, with the bytes they take. It has a lock of its own, since
+// reads holding the read lock of the shard, or the store's, mark keys used
+// too.
+type recency struct {
+	mu    sync.Mutex
+	order *list.List // Of *recentKey
+	keys  map[watchKey]*list.Element
+	bytes int64 // Of the keys, as quotas count them
+}
+
+// recentKey is a key with the time of its last use.
+type recentKey struct {
+	key  watchKey
+	size int64
+	used int64
+}
+
+func newRecency() *recency {
+	return &recency{order: list.New(), keys: make(map[watchKey]*list.Element)}
+}
+
+// add marks k, now taking size bytes, used at the next time of clock,
+// adding it if it's new.
+func (r *recency) add(k watchKey, size int64, clock *atomic.Int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.keys[k]
+	if !ok {
+		el = r.order.PushBack(&recentKey{key: k})
+		r.keys[k] = el
+	}
+
+	rk := el.Value.(*recentKey)
+	r.bytes += size - rk.size
+	rk.size, rk.used = size, clock.Add(1)
+	r.order.MoveToBack(el)
+}
+
+// use marks k used at the next time of clock, if it has k. The time is
+// taken under the lock, so the keys stay in the order of their times.
+func (r *recency) use(k watchKey, clock *atomic.Int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if el, ok := r.keys[k]; ok {
+		el.Value.(*recentKey).used = clock.Add(1)
+		r.order.MoveToBack(el)
+	}
+}
+
+// forget removes k.
+func (r *recency) forget(k watchKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if el, ok := r.keys[k]; ok {
+		r.bytes -= el.Value.(*recentKey).size
+		r.order.Remove(el)
+		delete(r.keys, k)
+	}
+}
+
+// first returns the key used longest ago, with the time of its last use.
+func (r *recency) first() (watchKey, int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el := r.order.Front()
+	if el == nil {
+		return watchKey{}, 0, false
+	}
+
+	rk := el.Value.(*recentKey)
+
+	return rk.key, rk.used, true
+}
+
+// size returns the bytes of the keys of r.
+func (r *recency) size() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.bytes
+}
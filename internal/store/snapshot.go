@@ -0,0 +1,234 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"io"
+	"slices"
+	"time"
+)
+
+// SnapshotHeader is the first line of a snapshot.
+type SnapshotHeader struct {
+	Sequence uint64    `json:"sequence"` // Last event included in the snapshot
+	Time     time.Time `json:"time"`     // When the snapshot was taken
+}
+
+// Checkpoint is a snapshot the store was restored from.
+type Checkpoint struct {
+	Sequence uint64    `json:"sequence"` // Last event included in the snapshot
+	Taken    time.Time `json:"taken"`    // When the snapshot was taken
+	Restored time.Time `json:"restored"` // When the store was restored from it
+}
+
+// maxCheckpoints is the most checkpoints the store remembers. The first is
+// kept, as the one the store was loaded from, then the most recent.
+const maxCheckpoints = 16
+
+// snapshotRecord is one line of a snapshot. Values are kept as stored,
+// compressed with Codec, except that values kept in a blob directory are
+// read back into the snapshot, and metadata is preserved so a restored store
+// is indistinguishable from the original.
+type snapshotRecord struct {
+	Bucket   string         `json:"bucket"`
+	Key      string         `json:"key"`
+	Value    []byte         `json:"value"`
+	Codec    compress.Codec `json:"codec,omitempty"`
+	Version  uint64         `json:"version"`
+	Created  time.Time      `json:"created"`
+	Modified time.Time      `json:"modified"`
+
+	OriginalKey string    `json:"original_key,omitempty"`
+	Immutable   bool      `json:"immutable,omitempty"`
+	Expires     time.Time `json:"expires,omitzero"`
+	ContentType string    `json:"content_type,omitempty"`
+
+	LeaseOwner   string    `json:"lease_owner,omitempty"`
+	LeaseExpires time.Time `json:"lease_expires,omitzero"`
+
+	page *pageRef // Where to read Value from, if it's paged in
+}
+
+// Snapshot writes the whole store to w as JSON lines: a SnapshotHeader,
+// then one line per key. The contents are copied under the read lock, so the
+// snapshot is consistent even while writes continue, and it includes exactly
+// the events up to the header's sequence.
+func (s *Store) Snapshot(w io.Writer) error {
+	var records []snapshotRecord
+
+	if err := s.loadAll(context.Background()); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	header := SnapshotHeader{Sequence: s.seq.load(), Time: time.Now().UTC()}
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			// Leases are kept until they expire, so a restore doesn't
+			// grant them again
+			var lease Lease
+			if e.lease.live(header.Time) {
+				lease = e.lease
+			}
+
+			records = append(records, snapshotRecord{
+				Bucket:   bucket,
+				Key:      key,
+				Value:    []byte(e.value),
+				Codec:    e.codec,
+				Version:  e.meta.Version,
+				Created:  e.meta.Created,
+				Modified: e.meta.Modified,
+
+				OriginalKey: e.meta.OriginalKey,
+				Immutable:   e.meta.Immutable,
+				Expires:     e.meta.Expires,
+				ContentType: e.meta.ContentType,
+
+				LeaseOwner:   lease.Owner,
+				LeaseExpires: lease.Expires,
+
+				page: e.page,
+			})
+		}
+	}
+	s.runlockScan()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		// Paged values are read as they're written, outside the lock
+		if r.page != nil {
+			value, err := r.page.read()
+			if err != nil {
+				return err
+			}
+			r.Value = []byte(value)
+		}
+
+		// A store without blob directory can only pass references on
+		if s.opts.Blobs != nil && r.Codec.IsBlob() {
+			value, codec, err := s.inline(string(r.Value), r.Codec)
+			if err != nil {
+				return blobError(r.Bucket, r.Key, err)
+			}
+			r.Value, r.Codec = []byte(value), codec
+		}
+
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Restore replaces the contents of the store with a snapshot written by
+// Snapshot, and resets its sequence to the snapshot's. Like ApplyEvent, it
+// doesn't log anything, and checks the blobs values refer to. Large values
+// go to the blob directory, if the store has one. The store is left
+// unchanged if the snapshot can't be read.
+func (s *Store) Restore(r io.Reader) error {
+	_, err := s.restore(r)
+
+	return err
+}
+
+// restore is Restore, returning the snapshot's header.
+func (s *Store) restore(r io.Reader) (SnapshotHeader, error) {
+	m := newShardedMap(s.opts.InitialCapacity)
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header SnapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return header, fmt.Errorf("invalid snapshot header: %w", err)
+	}
+
+	for {
+		var rec snapshotRecord
+
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return header, fmt.Errorf("invalid snapshot: %w", err)
+		}
+
+		value, codec := string(rec.Value), rec.Codec
+
+		if s.opts.Blobs != nil {
+			var err error
+			if codec.IsBlob() {
+				_, err = s.opts.Blobs.Resolve(value)
+			} else {
+				value, codec, err = s.offload(value, codec)
+			}
+			if err != nil {
+				return header, blobError(rec.Bucket, rec.Key, err)
+			}
+		}
+
+		m.set(rec.Bucket, rec.Key, entry{
+			value: value,
+			codec: codec,
+			meta:  ValueMeta{Version: rec.Version, Created: rec.Created, Modified: rec.Modified, OriginalKey: rec.OriginalKey, Immutable: rec.Immutable, Expires: rec.Expires, ContentType: rec.ContentType},
+			lease: Lease{Owner: rec.LeaseOwner, Expires: rec.LeaseExpires},
+		})
+	}
+
+	s.swap(header, m)
+
+	return header, nil
+}
+
+// swap replaces the contents of the store with m, restored from the
+// snapshot with header.
+func (s *Store) swap(header SnapshotHeader, m *shardedMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.m.buckets()
+	s.m.replace(m)
+	s.seq.set(header.Sequence)
+	s.epoch.Add(1)
+	s.recount()
+
+	if len(s.checkpoints) == maxCheckpoints {
+		s.checkpoints = append(s.checkpoints[:1], s.checkpoints[2:]...)
+	}
+	s.checkpoints = append(s.checkpoints, Checkpoint{Sequence: header.Sequence, Taken: header.Time, Restored: time.Now().UTC()})
+
+	for _, b := range s.m.parts() {
+		for _, e := range b {
+			s.noteBlob(e.value, e.codec)
+		}
+	}
+
+	// Every key may have changed
+	for _, bucket := range old {
+		s.watchers.notifyBucket(bucket)
+	}
+	for _, bucket := range s.m.buckets() {
+		s.watchers.notifyBucket(bucket)
+	}
+}
+
+// Checkpoints returns the snapshots the store was restored from, oldest
+// first: the one it was loaded from, if any, then those restored since, of
+// which only the last maxCheckpoints-1 are remembered.
+func (s *Store) Checkpoints() []Checkpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.checkpoints)
+}
@@ -0,0 +1,1383 @@
+// Package store implements the in-memory key-value store. Mutations are
+// recorded with a transaction logger before they are applied.
+package store
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/crypt"
+	"github.com/sheritzs/key-value-store/internal/hotkeys"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"golang.org/x/sync/singleflight"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultBucket holds the keys written through the unscoped API.
+const DefaultBucket = translog.DefaultBucket
+
+// ValueMeta describes the write history of a key.
+type ValueMeta struct {
+	Version     uint64    // Number of writes since the key was created
+	Created     time.Time // Time of the first write
+	Modified    time.Time // Time of the most recent write
+	OriginalKey string    // Key as the first write gave it, if Options.KeyFolding changed it
+	Immutable   bool      // Whether the key is write-once, as put under WithImmutable
+	Expires     time.Time // When the key expires, as put under WithTTL; zero if it lives forever
+	ContentType string    // Media type of the value, as put under WithContentType; empty if it has none
+}
+
+type entry struct {
+	value string   // Value as stored, compressed with codec, unless paged in
+	page  *pageRef // Where to read the value from, if it's paged in from a snapshot
+	codec compress.Codec
+	meta  ValueMeta
+	lease Lease // Zero unless the key was leased; only holds until it expires
+}
+
+// Logger records the store's mutations. It is satisfied by every
+// translog.TransactionLogger.
+type Logger interface {
+	// WriteEvent enqueues e, or returns an error without enqueueing it.
+	// Events must be persisted in the order they are enqueued.
+	WriteEvent(ctx context.Context, e translog.Event) error
+
+	// Flush waits for the events enqueued so far to be durable, and
+	// returns the first failure to persist one of them. It gives up with
+	// ctx.Err() if ctx is done first; the events are persisted all the same.
+	Flush(ctx context.Context) error
+}
+
+// Options configures a Store.
+type Options struct {
+	Codec             compress.Codec // Compression for large values
+	CompressThreshold int            // Minimum value size in bytes to compress
+	InitialCapacity   int            // Keys to preallocate room for in the default bucket
+	Backing           Backing        // Authoritative contents the map caches; nil if the map is all there is
+	Cipher            crypt.Cipher   // Encryption of values, in the map and in the log; nil stores them in the clear
+	CoalesceReads     bool           // Share one backing lookup among concurrent reads of a key; reads of the map alone don't need it
+	HookTimeout       time.Duration  // How long the put hooks of a write may take; DefaultHookTimeout if 0
+	SkipNoopWrites    bool           // Don't log or apply puts of the value a key already has
+
+	// NotifyRate caps the keys whose watchers a bulk operation, such as a
+	// seed or a deletion by prefix, wakes a second; DefaultNotifyRate if
+	// 0. NotifyWindow is the longest time a summary of its changes covers,
+	// for WatchBatches; DefaultNotifyWindow if 0
+	NotifyRate   int
+	NotifyWindow time.Duration
+
+	// Blobs keeps the values at least as large as its threshold once
+	// compressed and encrypted, which are then stored and logged as a
+	// reference to their blob. Snapshots hold the blobs themselves, so
+	// they stand alone. Nil keeps every value in the map and the log.
+	Blobs *blob.Dir
+
+	// HotKeys counts the reads and writes of each key given to the
+	// store's operations, to find the hot ones. Nil counts nothing.
+	HotKeys *hotkeys.Tracker
+
+	// PageValues makes Load and RestoreFile index the values of the
+	// snapshot rather than read them into memory: they are read from the
+	// snapshot file as they are needed, and the most recently read kept
+	// in memory up to PageCacheBytes, DefaultPageCacheBytes if 0. Values
+	// written since are kept in memory as usual. The snapshot file must
+	// not be written to in place while the store uses it. It is meant for
+	// stores without a Backing, whose map is all there is.
+	PageValues     bool
+	PageCacheBytes int64
+
+	// KeyFolding normalizes the keys given to every read and write, so
+	// that keys differing only in case are one key, and the log holds
+	// them folded. Put hooks see the folded key. A store switched to a
+	// folding with keys already stored needs FoldKeys. It must not change
+	// once the store is in use.
+	KeyFolding KeyFolding
+
+	// StrictWrites makes every write wait for its event to be durable
+	// before it is applied and acknowledged. By default a write is applied
+	// once its event is enqueued, so a crash can lose writes that were
+	// already acknowledged, though never reorder them: the log always
+	// holds a prefix of the acknowledged writes. In strict mode the log
+	// holds every acknowledged write; a write that fails to persist is
+	// reported as failed and not applied, though it may still be replayed
+	// after a restart if it reached the log before the failure.
+	StrictWrites bool
+
+	// Quotas limits the number of keys and bytes of buckets. With a
+	// Backing, every key is loaded by the first put when quotas are
+	// enabled, so that they are all counted.
+	Quotas QuotaPolicy
+
+	// Eviction caps the keys and bytes of the whole store, as quotas count
+	// them: a write that takes the store past it evicts the keys read or
+	// written longest ago, logging the evictions, so the store can serve
+	// as a cache that never outgrows its memory. It is meant for stores
+	// without a Backing, whose map is all there is. A zero limit is no
+	// limit.
+	Eviction Quota
+
+	// ResolveConflict decides the outcome of the events replayed or
+	// replicated for keys modified after the events were logged. Nil
+	// applies every event as it comes.
+	ResolveConflict ConflictResolver
+}
+
+// Store is a set of buckets of keys. It is safe for concurrent use.
+type Store struct {
+	mu   sync.RWMutex
+	m    *shardedMap  // Entries by bucket, then by key
+	keys atomic.Int64 // Entries in m, kept for KeyCount, which doesn't take the lock
+
+	logger Logger
+	opts   Options
+
+	readOnly       bool   // Whether writes are currently rejected
+	readOnlyReason string // Why writes are rejected, for clients
+
+	watchers  watchRegistry   // Waiters for changes to individual keys
+	batches   []*notifyBatch  // Bulk operations coalescing the notifications of their keys
+	summaries summaryRegistry // Subscribers to the summaries of the batches
+	hooks     hookRegistry    // Checks of values before they are written
+
+	seq   sequencer // Numbers of the events logged and applied
+	lanes lanes     // Turns of the writes waiting for the locks
+
+	epoch   atomic.Uint64      // Incremented on every change, to detect races with the backing
+	loaded  bool               // Whether every key in the backing has been cached
+	flights singleflight.Group // Backing lookups in progress, under CoalesceReads
+
+	blobMu   sync.Mutex          // Held to note blobRefs by the writes of single keys, which run at once
+	blobRefs map[string]struct{} // Hashes of the blobs referred to since the store was loaded
+
+	usage map[string]*bucketUsage // Size of the buckets with a quota; nil unless Options.Quotas is enabled
+
+	renameMu sync.Mutex    // Held by RenameBucket throughout
+	renaming *bucketRename // The rename under way, if any
+
+	checkpoints []Checkpoint // Snapshots restored from, for Checkpoints
+}
+
+// New returns an empty store that records its mutations with logger.
+func New(logger Logger, opts Options) *Store {
+	s := &Store{
+		m:      newShardedMap(opts.InitialCapacity),
+		logger: logger,
+		opts:   opts,
+	}
+
+	if opts.Quotas.Enabled() {
+		s.usage = make(map[string]*bucketUsage)
+	}
+	if !opts.Eviction.IsZero() {
+		s.m.track()
+	}
+
+	return s
+}
+
+// encode compresses and encrypts value as configured, and moves it to the
+// blob directory if it is then large enough.
+func (s *Store) encode(value string) (string, compress.Codec, error) {
+	stored, codec, err := crypt.Encode(value, s.opts.Codec, s.opts.CompressThreshold, s.opts.Cipher)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return s.offload(stored, codec)
+}
+
+// decode returns the value of e as it was written by the client. It doesn't
+// need the lock.
+func (s *Store) decode(e entry) (string, error) {
+	value, err := e.stored()
+	if err != nil {
+		return "", err
+	}
+
+	stored, codec, err := s.inline(value, e.codec)
+	if err != nil {
+		return "", err
+	}
+
+	return crypt.Decode(stored, codec, s.opts.Cipher)
+}
+
+// EventValue returns the value of e, a put read back from the log, as it was
+// written by the client, decoding it as the values the store holds are. It
+// doesn't need the lock.
+func (s *Store) EventValue(e translog.Event) (string, error) {
+	stored, codec, err := s.inline(e.Value, e.Codec)
+	if err != nil {
+		return "", err
+	}
+
+	return crypt.Decode(stored, codec, s.opts.Cipher)
+}
+
+// stamp returns the time of a write made now, which its events are logged
+// with: in UTC, to the microsecond, the finest every log backend keeps, so
+// that the metadata the write leaves is the same once its events are
+// replayed.
+func stamp() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// setAt stores value, compressed with codec, under key and updates its
+// metadata, for a write made at now, the time of its event, giving it the
+// media type mediaType, if any. The caller must hold the write lock, or the
+// lock of a write of key.
+func (s *Store) setAt(bucket, key, value string, codec compress.Codec, mediaType string, now time.Time) {
+	e, ok := s.m.get(bucket, key)
+
+	var old *entry
+	if ok {
+		prev := e
+		old = &prev
+	}
+
+	// A key that expired is created afresh, as if it had been deleted
+	if !ok || e.meta.expired(now) {
+		e = entry{meta: ValueMeta{Created: now}}
+	}
+
+	e.value = value
+	e.page = nil
+	e.codec = codec
+	e.meta.Version++
+	s.noteBlob(value, codec)
+	e.meta.Modified = now
+	e.meta.Expires = time.Time{}
+	e.meta.ContentType = mediaType
+
+	s.m.set(bucket, key, e)
+	s.epoch.Add(1)
+	s.accountChange(bucket, key, old, &e)
+
+	s.notify(bucket, key, &e)
+}
+
+// remove deletes key, dropping its bucket once it is empty. The caller must
+// hold the write lock, or the lock of a write of key.
+func (s *Store) remove(bucket, key string) {
+	s.epoch.Add(1) // Even if the key isn't cached, a fetch of it may be under way
+
+	e, ok := s.m.delete(bucket, key)
+	if ok {
+		s.accountChange(bucket, key, &e, nil)
+
+		// Counting the bucket's keys reads every shard, so only quotas,
+		// which the write lock is taken for, do it
+		if s.usage != nil && s.m.len(bucket) == 0 {
+			s.dropUsage(bucket)
+		}
+	}
+
+	s.notify(bucket, key, nil)
+}
+
+// drop deletes every key in bucket. The caller must hold the write lock.
+func (s *Store) drop(bucket string) {
+	s.keys.Add(-int64(s.m.len(bucket)))
+	s.m.drop(bucket)
+	s.dropUsage(bucket)
+	s.epoch.Add(1)
+	s.renaming.invalidate(bucket)
+
+	s.watchers.notifyBucket(bucket)
+}
+
+// lookup returns the entry stored under key, unless it expired. The caller
+// must hold the lock.
+func (s *Store) lookup(bucket, key string) (entry, bool) {
+	e, ok := s.m.get(bucket, key)
+	if ok && e.meta.expired(time.Now()) {
+		return entry{}, false
+	}
+
+	return e, ok
+}
+
+var ErrorNoSuchKey = errors.New("no such key")
+
+var ErrorInvalidBucket = errors.New("invalid bucket name")
+
+var ErrorReadOnly = errors.New("store is read-only")
+
+var ErrorInvalidKey = errors.New("invalid key")
+
+var ErrorNotNumeric = errors.New("value is not an integer")
+
+// ErrorCASMismatch is how a compare-and-swap that didn't swap is reported to
+// clients; BucketCompareAndSwap itself returns false.
+var ErrorCASMismatch = errors.New("value does not match expected")
+
+var bucketNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,63}$`)
+
+// ValidateBucket checks that name can be used as a bucket name: 1 to 63
+// letters, digits, dots, underscores or dashes.
+func ValidateBucket(name string) error {
+	if !bucketNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrorInvalidBucket, name)
+	}
+
+	return nil
+}
+
+// ValidateKey checks that key can be stored: it must be non-empty valid
+// UTF-8 without control characters, which the transaction log can't hold.
+func ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: key is empty", ErrorInvalidKey)
+	}
+
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("%w: key is not valid UTF-8", ErrorInvalidKey)
+	}
+
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: key contains control characters", ErrorInvalidKey)
+		}
+	}
+
+	return nil
+}
+
+// validate checks bucket and key as ValidateBucket and ValidateKey do. Every
+// write logging a key checks it first, since the log can't hold every key.
+func validate(bucket, key string) error {
+	if err := ValidateBucket(bucket); err != nil {
+		return err
+	}
+
+	return ValidateKey(key)
+}
+
+// Put is PutCtx without a deadline.
+func (s *Store) Put(key, value string) error {
+	return s.PutCtx(context.Background(), key, value)
+}
+
+func (s *Store) Get(key string) (string, error) {
+	value, _, err := s.GetWithMeta(key)
+
+	return value, err
+}
+
+// GetWithMeta returns the value stored under key along with its metadata.
+func (s *Store) GetWithMeta(key string) (string, ValueMeta, error) {
+	return s.BucketGetWithMeta(context.Background(), DefaultBucket, key)
+}
+
+// Delete is DeleteCtx without a deadline.
+func (s *Store) Delete(key string) error {
+	return s.DeleteCtx(context.Background(), key)
+}
+
+// ApplyEvent applies an event read from the transaction log to the store
+// without logging it again, as Options.ResolveConflict decides. The blob a
+// put refers to is checked first.
+func (s *Store) ApplyEvent(e translog.Event) error {
+	return s.applyEvent(e, func() error {
+		if err := s.checkBlob(e.Value, e.Codec); err != nil {
+			return blobError(e.Bucket, e.Key, err)
+		}
+
+		return nil
+	})
+}
+
+// Replicate logs and applies an event received from a replication leader,
+// keeping the leader's sequence number, as Options.ResolveConflict decides.
+// Unlike the other writes it is allowed in read-only mode, which is how
+// followers run. Leaders send every value in full, so a large one is moved
+// to the blob directory here.
+func (s *Store) Replicate(ctx context.Context, e translog.Event) error {
+	if e.EventType == translog.EventPut {
+		var err error
+		if e.Value, e.Codec, err = s.offload(e.Value, e.Codec); err != nil {
+			return err
+		}
+	}
+
+	return s.applyEvent(e, func() error {
+		return s.log(ctx, e)
+	})
+}
+
+// log records e with the transaction logger. Events are numbered by the
+// store, so that a snapshot knows exactly which events it includes; events
+// replicated from a leader keep the leader's number. Nothing is logged for
+// writes made under DurabilityNone. The caller must hold the write lock,
+// or the lock of a write of the key of e, and keep holding it until e is
+// applied: enqueueing under the same lock as the change itself is what
+// makes the log replay every key's writes in the order they were applied.
+// The caller applies e unless logged says otherwise of the error.
+func (s *Store) log(ctx context.Context, e translog.Event) error {
+	if unlogged(ctx) {
+		return nil
+	}
+
+	if err := s.enqueue(ctx, e); err != nil {
+		return err
+	}
+
+	if s.strict(ctx) {
+		return s.flushLogged(ctx)
+	}
+
+	return nil
+}
+
+// strict reports whether the writes made under ctx wait for their events
+// to be durable: under StrictWrites, or if they're urgent.
+func (s *Store) strict(ctx context.Context) bool {
+	return s.opts.StrictWrites || isUrgent(ctx)
+}
+
+// logEvents logs events as log does one, and returns how many of them were
+// enqueued, which the caller applies, in order: a failure part way leaves
+// those before it logged. A deadline may stop them before the first, but
+// doesn't split them once it's enqueued. Under StrictWrites, or if they're
+// urgent, they are waited for once, and none applied if that fails, short
+// of ctx ending the wait, as for ErrorNotDurable. Events without a time
+// are given the same one, in place, for the caller to apply them at, even
+// if they aren't logged.
+func (s *Store) logEvents(ctx context.Context, events []translog.Event) (int, error) {
+	now := stamp()
+	for i := range events {
+		if events[i].Time.IsZero() {
+			events[i].Time = now
+		}
+	}
+
+	if unlogged(ctx) {
+		return len(events), nil
+	}
+
+	n := len(events)
+	var err error
+
+	for i, e := range events {
+		ectx := ctx
+		if i > 0 {
+			ectx = context.WithoutCancel(ctx)
+		}
+
+		eerr := s.enqueue(ectx, e)
+		if !logged(eerr) {
+			n, err = i, eerr
+			break
+		}
+		err = cmp.Or(err, eerr)
+	}
+
+	if s.strict(ctx) && n > 0 {
+		ferr := s.flushLogged(ctx)
+		if !logged(ferr) {
+			return 0, ferr
+		}
+		err = cmp.Or(err, ferr)
+	}
+
+	return n, err
+}
+
+// enqueue is log without the wait for durability under StrictWrites, for
+// writes that log several events and wait once for all of them. A context
+// done before e is enqueued leaves it out, with a DeadlineError for
+// PhaseLogEnqueue if its deadline passed. An event without a time is
+// stamped with the current one.
+func (s *Store) enqueue(ctx context.Context, e translog.Event) error {
+	if e.Time.IsZero() {
+		e.Time = stamp()
+	}
+
+	w, _ := ctx.Value(keyWriteKey{}).(*keyWrite)
+
+	var notFlushed error
+	err := s.seq.next(&e, w, func() error {
+		err := s.logger.WriteEvent(ctx, e)
+		if errors.Is(err, translog.ErrorNotFlushed) {
+			notFlushed = err
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return phaseError(PhaseLogEnqueue, err)
+	}
+
+	recordSequence(ctx, e.Sequence)
+
+	if notFlushed != nil {
+		return notDurable(notFlushed)
+	}
+
+	return nil
+}
+
+// flushLogged waits for the events enqueued so far to be durable. If ctx is
+// done first, they are written all the same, so the error is notDurable's,
+// and they must be applied.
+func (s *Store) flushLogged(ctx context.Context) error {
+	err := s.logger.Flush(ctx)
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return notDurable(err)
+	}
+
+	return err
+}
+
+// apply performs e on the maps, as a write made when it was logged.
+// Callers must hold the write lock, or the lock of a write of the key of
+// e, if it's a put, a delete or one of their marks.
+func (s *Store) apply(e translog.Event) error {
+	switch e.EventType {
+	case translog.EventPut:
+		s.setAt(e.Bucket, e.Key, e.Value, e.Codec, e.ContentType, eventTime(e))
+	case translog.EventDelete, translog.EventEvict:
+		s.remove(e.Bucket, e.Key)
+	case translog.EventDropBucket:
+		s.drop(e.Bucket)
+	case translog.EventRenameBucket:
+		s.rename(e.Bucket, e.Value)
+	case translog.EventImmutable:
+		s.setImmutable(e.Bucket, e.Key)
+	case translog.EventOriginalKey:
+		s.noteOriginal(e.Bucket, e.Key, e.Value)
+	case translog.EventExpire:
+		if err := s.applyExpire(e); err != nil {
+			return err
+		}
+	case translog.EventLease:
+		if err := s.applyLease(e); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown event type %d", e.EventType)
+	}
+
+	s.seq.raise(e.Sequence)
+
+	return nil
+}
+
+// Sequence returns the sequence number of the last event applied to the
+// store, every event before it being applied too.
+func (s *Store) Sequence() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.seq.applied()
+}
+
+// Generation returns the sequence of the last event applied, as Sequence
+// does, with a count of the changes made to the store, which also moves on
+// with the changes no event records, such as fsck repairs and restored
+// snapshots. A result computed from the store after the call is still
+// current for as long as both stay the same.
+func (s *Store) Generation() (seq, changes uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.seq.applied(), s.epoch.Load()
+}
+
+// PutCtx stores value under key and records the write with the transaction
+// logger. The event is enqueued while the lock of the write is held, so the
+// log sees the writes of every key in the same order the store applied
+// them.
+//
+// Either both the store and the log change or neither does: if ctx is done
+// before the event can be enqueued, PutCtx returns ctx.Err() without touching
+// the store, and once the event is enqueued the store is always updated.
+func (s *Store) PutCtx(ctx context.Context, key, value string) error {
+	return s.BucketPut(ctx, DefaultBucket, key, value)
+}
+
+// GetCtx is like Get, but gives up once ctx is done, including while the
+// key is being fetched from the backing.
+func (s *Store) GetCtx(ctx context.Context, key string) (string, error) {
+	value, _, err := s.BucketGetWithMeta(ctx, DefaultBucket, key)
+
+	return value, err
+}
+
+// GetWithMetaCtx is like GetWithMeta, but returns ctx.Err() if ctx is
+// already done.
+func (s *Store) GetWithMetaCtx(ctx context.Context, key string) (string, ValueMeta, error) {
+	return s.BucketGetWithMeta(ctx, DefaultBucket, key)
+}
+
+// DeleteCtx removes key and records the deletion with the transaction
+// logger, with the same all-or-nothing semantics as PutCtx.
+func (s *Store) DeleteCtx(ctx context.Context, key string) error {
+	return s.BucketDelete(ctx, DefaultBucket, key)
+}
+
+// BucketPut is like PutCtx for a key in the named bucket.
+//
+// Values over the compression threshold are compressed before the lock is
+// taken; the log records the compressed form so replay needn't recompress.
+// Put hooks run before that.
+func (s *Store) BucketPut(ctx context.Context, bucket, key, value string) error {
+	_, err := s.BucketPutChanged(ctx, bucket, key, value)
+	return err
+}
+
+// BucketPutChanged is like BucketPut, and reports whether the put changed
+// anything. Under Options.SkipNoopWrites, a put of the value key already has
+// succeeds without being logged or applied, leaving the key's metadata as
+// is, and is reported unchanged; its sequence, for WithSequence, is the
+// store's current one, by which the value was already there. Otherwise
+// every successful put is reported changed.
+func (s *Store) BucketPutChanged(ctx context.Context, bucket, key, value string) (changed bool, err error) {
+	if err := validate(bucket, key); err != nil {
+		return false, err
+	}
+
+	original := key
+	key = s.foldKey(key)
+	s.opts.HotKeys.Observe(bucket, key, true)
+
+	ctx, span := tracing.Start(ctx, "store.Put", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.runPutHooks(ctx, bucket, key, value); err != nil {
+		return false, err
+	}
+
+	if err := s.loadUsage(ctx); err != nil {
+		return false, err
+	}
+
+	stored, codec, err := s.encode(value)
+	if err != nil {
+		return false, err
+	}
+
+	t := timing.Begin("put", bucket, key)
+	defer t.End()
+
+	ctx, unlock, err := s.lockKey(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	t.Phase("lock_wait")
+
+	// A put making the key write-once or setting its expiry changes it even
+	// if the value doesn't, and a conditional one must check its key first
+	if s.opts.SkipNoopWrites && !s.readOnly && !makesImmutable(ctx) && ttlOf(ctx) == 0 && preconditionOf(ctx) == nil {
+		// Compared under the lock, so no write can come in between
+		same, err := s.holds(ctx, bucket, key, value, stored, codec)
+		if err != nil {
+			return false, err
+		}
+
+		if same {
+			t.Phase("lookup")
+			recordSequence(ctx, s.seq.load())
+			return false, nil
+		}
+	}
+
+	if err := s.logPut(ctx, &t, bucket, key, original, stored, codec); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// holds reports whether key already has value, whose encoded form is stored
+// with codec. Encrypted values are encoded differently every time, so they
+// are compared decoded. A key that expires doesn't hold it, since the put
+// would make it permanent, nor does one of another media type than the put
+// gives. The caller must hold the lock of a write of key.
+func (s *Store) holds(ctx context.Context, bucket, key, value, stored string, codec compress.Codec) (bool, error) {
+	e, ok, err := s.lookupForWrite(ctx, bucket, key)
+	if err != nil || !ok || !e.meta.Expires.IsZero() || e.meta.ContentType != contentTypeOf(ctx) {
+		return false, err
+	}
+
+	if e.page == nil && e.value == stored && e.codec == codec {
+		return true, nil
+	}
+
+	current, err := s.decode(e)
+	if err != nil {
+		return false, err
+	}
+
+	return current == value, nil
+}
+
+// logPut records a put of the already compressed value with the transaction
+// logger and applies it, timing the phases with t, which may be nil. key is
+// folded; original is the key as given. The caller must hold the lock of a
+// write of key.
+func (s *Store) logPut(ctx context.Context, t *timing.Op, bucket, key, original, value string, codec compress.Codec) error {
+	if s.readOnly {
+		return ErrorReadOnly
+	}
+
+	mediaType := contentTypeOf(ctx)
+	if mediaType != "" && !translog.ValidContentType(mediaType) {
+		return fmt.Errorf("%w: %q", ErrorInvalidContentType, mediaType)
+	}
+
+	old, ok, err := s.lookupForWrite(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	t.Phase("lookup")
+
+	if err := checkPrecondition(ctx, old, ok); err != nil {
+		return err
+	}
+
+	var prev *entry
+	if ok {
+		if err := checkLease(ctx, bucket, key, old); err != nil {
+			return err
+		}
+		if err := checkImmutable(ctx, bucket, key, old); err != nil {
+			return err
+		}
+		prev = &old
+	}
+
+	if err := s.checkQuota(bucket, key, prev, value, codec); err != nil {
+		return err
+	}
+
+	if IsDryRun(ctx) {
+		return nil
+	}
+
+	// A write-once key is marked by an event of its own, logged with the
+	// put, as are the deadline of a key that expires and the form a folded
+	// key was created in
+	events := []translog.Event{{EventType: translog.EventPut, Bucket: bucket, Key: key, Value: value, Codec: codec, ContentType: mediaType}}
+	if makesImmutable(ctx) {
+		events = append(events, translog.Event{EventType: translog.EventImmutable, Bucket: bucket, Key: key})
+	}
+	if ttl := ttlOf(ctx); ttl > 0 {
+		events = append(events, translog.Event{EventType: translog.EventExpire, Bucket: bucket, Key: key, Value: translog.FormatExpiry(time.Now().Add(ttl))})
+	}
+	if !ok && original != key {
+		events = append(events, translog.Event{EventType: translog.EventOriginalKey, Bucket: bucket, Key: key, Value: original})
+	}
+
+	n, err := s.logEvents(ctx, events)
+	if n == 0 {
+		return err
+	}
+	t.Phase("log_enqueue")
+
+	since := s.m.now()
+	s.setAt(bucket, key, value, codec, mediaType, events[0].Time)
+	for _, mark := range events[1:n] {
+		if err := s.apply(mark); err != nil {
+			return err
+		}
+	}
+	s.warnQuota(ctx, bucket)
+	s.evict(ctx, since)
+	t.Phase("map_update")
+
+	return err
+}
+
+// BucketGetWithMeta is like GetWithMetaCtx for a key in the named bucket.
+func (s *Store) BucketGetWithMeta(ctx context.Context, bucket, key string) (string, ValueMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return "", ValueMeta{}, phaseError(PhaseLockWait, err)
+	}
+
+	key = s.foldKey(key)
+	s.opts.HotKeys.Observe(bucket, key, false)
+
+	ctx, span := tracing.Start(ctx, "store.Get", bucket, key)
+	defer span.End()
+
+	// A cached key is read under the lock of its shard alone, so that reads
+	// don't wait for the writes holding the store's lock to be logged
+	if e, ok := s.m.load(bucket, key); ok && !e.meta.expired(time.Now()) {
+		value, err := s.decode(e)
+		return value, e.meta, err
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return "", ValueMeta{}, err
+	}
+	e, ok := s.lookup(bucket, key)
+	complete, epoch := s.complete(), s.epoch.Load()
+	s.mu.RUnlock()
+
+	if !ok && !complete {
+		var err error
+		if e, ok, err = s.fetch(ctx, bucket, key, epoch); err != nil {
+			return "", ValueMeta{}, err
+		}
+	}
+
+	if !ok {
+		return "", ValueMeta{}, ErrorNoSuchKey
+	}
+
+	value, err := s.decode(e)
+
+	return value, e.meta, err
+}
+
+// BucketDelete is like DeleteCtx for a key in the named bucket.
+func (s *Store) BucketDelete(ctx context.Context, bucket, key string) (err error) {
+	if err := validate(bucket, key); err != nil {
+		return err
+	}
+
+	key = s.foldKey(key)
+	s.opts.HotKeys.Observe(bucket, key, true)
+
+	ctx, span := tracing.Start(ctx, "store.Delete", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	t := timing.Begin("delete", bucket, key)
+	defer t.End()
+
+	ctx, unlock, err := s.lockKey(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	t.Phase("lock_wait")
+
+	return s.logDelete(ctx, &t, bucket, key)
+}
+
+// logDelete records a delete of key with the transaction logger and applies
+// it, timing the phases with t, which may be nil. The caller must hold the
+// lock of a write of key.
+func (s *Store) logDelete(ctx context.Context, t *timing.Op, bucket, key string) error {
+	if s.readOnly {
+		return ErrorReadOnly
+	}
+
+	// Leases are only ever on cached keys, but write-once keys, and those a
+	// precondition checks, may not be
+	old, ok, err := s.lookupForWrite(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := checkPrecondition(ctx, old, ok); err != nil {
+		return err
+	}
+	if ok {
+		if err := checkLease(ctx, bucket, key, old); err != nil {
+			return err
+		}
+		if err := checkImmutable(ctx, bucket, key, old); err != nil {
+			return err
+		}
+	}
+
+	if IsDryRun(ctx) {
+		return nil
+	}
+
+	e := translog.Event{EventType: translog.EventDelete, Bucket: bucket, Key: key}
+	err = s.log(ctx, e)
+	if !logged(err) {
+		return err
+	}
+	t.Phase("log_enqueue")
+
+	s.remove(bucket, key)
+	t.Phase("map_update")
+
+	return err
+}
+
+// Buckets returns the names of all buckets holding at least one key, in
+// lexical order.
+func (s *Store) Buckets() ([]string, error) {
+	if err := s.loadAll(context.Background()); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	defer s.runlockScan()
+
+	return s.m.buckets(), nil
+}
+
+// BucketKeys returns the keys in the named bucket that start with prefix, in
+// lexical order. Under Options.KeyFolding, the prefix is folded and the keys
+// are returned folded.
+func (s *Store) BucketKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+	if err := s.loadAll(ctx); err != nil {
+		return nil, err
+	}
+
+	prefix = s.foldKey(prefix)
+
+	if err := s.rlockScan(ctx); err != nil {
+		return nil, err
+	}
+	defer s.runlockScan()
+
+	var keys []string
+	n, now := 0, time.Now()
+	for key, e := range s.m.bucket(bucket) {
+		if err := scanDeadline(ctx, n); err != nil {
+			return nil, err
+		}
+		n++
+
+		if strings.HasPrefix(key, prefix) && !e.meta.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Keys is BucketKeysPage for the default bucket.
+func (s *Store) Keys(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	return s.BucketKeysPage(ctx, DefaultBucket, prefix, cursor, limit)
+}
+
+// BucketKeysPage returns a page of up to limit of the keys BucketKeys
+// returns, those after cursor, and the cursor of the next page, or "" if
+// this is the last. An empty cursor starts at the first key, and a limit of
+// 0 or less returns every key left. The cursor is the last key of the page,
+// so paging holds while keys come and go, each key present throughout being
+// returned once. It pages through BucketList in key order, as the listings
+// of the API do.
+func (s *Store) BucketKeysPage(ctx context.Context, bucket, prefix, cursor string, limit int) ([]string, string, error) {
+	order := ListOrder{By: OrderKey}
+
+	infos, _, err := s.BucketList(ctx, bucket, prefix, order)
+	if err != nil {
+		return nil, "", err
+	}
+	infos = ListAfter(infos, order, KeyInfo{Key: cursor})
+
+	var next string
+	if limit > 0 && len(infos) > limit {
+		infos = infos[:limit]
+		next = infos[limit-1].Key
+	}
+
+	keys := make([]string, len(infos))
+	for i, info := range infos {
+		keys[i] = info.Key
+	}
+
+	return keys, next, nil
+}
+
+// Record is a key and its value, as exported by Dump.
+type Record struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+}
+
+// Dump returns a consistent copy of every key in the store, ordered by
+// bucket and then key. Values are decompressed after the lock is released.
+func (s *Store) Dump() ([]Record, error) {
+	type stored struct {
+		bucket, key string
+		e           entry
+	}
+
+	if err := s.loadAll(context.Background()); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	s.m.lockWriters()
+	var entries []stored
+	now := time.Now()
+	for bucket, b := range s.m.parts() {
+		for key, e := range b {
+			if !e.meta.expired(now) {
+				entries = append(entries, stored{bucket, key, e})
+			}
+		}
+	}
+	s.runlockScan()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].bucket != entries[j].bucket {
+			return entries[i].bucket < entries[j].bucket
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	records := make([]Record, len(entries))
+	for i, x := range entries {
+		value, err := s.decode(x.e)
+		if err != nil {
+			return nil, err
+		}
+
+		records[i] = Record{Bucket: x.bucket, Key: x.key, Value: value}
+	}
+
+	return records, nil
+}
+
+// DropBucket removes every key in the named bucket with a single logged
+// event and returns the number of keys removed.
+func (s *Store) DropBucket(ctx context.Context, bucket string) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "store.DropBucket", bucket, "")
+	defer func() { tracing.End(span, err) }()
+
+	// The count of keys removed needs every key in the bucket cached
+	if err := s.loadAll(ctx); err != nil {
+		return 0, err
+	}
+
+	ctx = WithUrgency(ctx)
+
+	leave, err := s.lanes.enter(ctx, true, bucket, "")
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return 0, ErrorReadOnly
+	}
+
+	n = s.m.len(bucket)
+	if n == 0 || IsDryRun(ctx) {
+		return n, nil
+	}
+
+	e := translog.Event{EventType: translog.EventDropBucket, Bucket: bucket}
+	if err = s.log(ctx, e); !logged(err) {
+		return 0, err
+	}
+
+	s.drop(bucket)
+
+	return n, err
+}
+
+// prefixDeleteBatch is the most keys DeleteByPrefix removes per hold of the
+// write lock, so that other requests get a turn during a large deletion.
+const prefixDeleteBatch = 1000
+
+// DeleteByPrefix is BucketDeleteByPrefix for the default bucket.
+func (s *Store) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	return s.BucketDeleteByPrefix(ctx, DefaultBucket, prefix)
+}
+
+// BucketDeleteByPrefix removes every key in the named bucket that starts
+// with prefix, logging a delete event for each, and returns the number of
+// keys removed. The keys are those present when it is called; they are
+// removed in batches of prefixDeleteBatch, each logged and applied under
+// one hold of the write lock, so a key written meanwhile by someone else
+// may survive. If it fails part way, the keys of the batches already done
+// stay deleted and are counted. The watchers of the keys are woken at most
+// Options.NotifyRate times a second, and WatchBatches subscribers get a
+// summary of the deletion in place of a notification for each key. Under
+// WithUrgency, each batch goes ahead of the normal writes of other keys
+// waiting for the locks, and is durable once done.
+func (s *Store) BucketDeleteByPrefix(ctx context.Context, bucket, prefix string) (n int, err error) {
+	ctx, span := tracing.Start(ctx, "store.DeleteByPrefix", bucket, prefix)
+	defer func() { tracing.End(span, err) }()
+
+	keys, err := s.BucketKeys(ctx, bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(keys) > 0 && !IsDryRun(ctx) {
+		b := s.openBatch("delete_prefix", bucket, s.foldKey(prefix))
+		defer s.closeBatch(b)
+	}
+
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), prefixDeleteBatch)]
+		keys = keys[len(batch):]
+
+		deleted, err := s.deleteBatch(ctx, bucket, s.foldKey(prefix), batch)
+		n += deleted
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// deleteBatch logs and applies the deletion of the keys still present in
+// bucket, which start with prefix, and returns how many there were. It
+// waits for its turn in the lanes as a write of the keys starting with
+// prefix, ahead of the normal writes of other keys if it's urgent. Under
+// StrictWrites, or if they're urgent, it waits once for all of the events
+// to be durable, and applies none if that fails.
+func (s *Store) deleteBatch(ctx context.Context, bucket, prefix string, keys []string) (int, error) {
+	leave, err := s.lanes.enterPrefix(ctx, isUrgent(ctx), bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return 0, ErrorReadOnly
+	}
+
+	var deleted []string
+
+	for _, key := range keys {
+		if _, ok := s.lookup(bucket, key); !ok {
+			continue
+		}
+
+		if IsDryRun(ctx) {
+			deleted = append(deleted, key)
+			continue
+		}
+
+		e := translog.Event{EventType: translog.EventDelete, Bucket: bucket, Key: key}
+		err = s.enqueue(ctx, e)
+		if logged(err) {
+			deleted = append(deleted, key)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if IsDryRun(ctx) {
+		return len(deleted), nil
+	}
+
+	if s.strict(ctx) && len(deleted) > 0 {
+		ferr := s.flushLogged(ctx)
+		if !logged(ferr) {
+			return 0, ferr
+		}
+		err = cmp.Or(err, ferr)
+	}
+
+	// Events once enqueued are always applied, like any other write
+	for _, key := range deleted {
+		s.remove(bucket, key)
+	}
+
+	return len(deleted), err
+}
+
+// SetReadOnly switches the store into or out of read-only mode, in which
+// every logged write fails with ErrorReadOnly. Writes hold the store's lock
+// from the log append until the store is updated, so SetReadOnly waits for
+// writes already in progress to complete and be logged before it returns.
+func (s *Store) SetReadOnly(on bool, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readOnly = on
+	s.readOnlyReason = reason
+}
+
+// ReadOnly reports whether the store is in read-only mode and why.
+func (s *Store) ReadOnly() (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readOnly, s.readOnlyReason
+}
+
+// Stats is a point-in-time summary of the store's contents.
+type Stats struct {
+	Keys     int  `json:"keys"`
+	Buckets  int  `json:"buckets"`
+	ReadOnly bool `json:"read_only"`
+	Partial  bool `json:"partial,omitempty"` // Counts cover only the keys cached from a backing so far
+}
+
+// Stats returns a summary of the store's contents.
+func (s *Store) Stats() Stats {
+	s.mu.RLock()
+	s.m.lockWriters()
+	defer s.runlockScan()
+
+	stats := Stats{Buckets: len(s.m.buckets()), ReadOnly: s.readOnly, Partial: !s.complete()}
+	for _, b := range s.m.parts() {
+		stats.Keys += len(b)
+	}
+
+	return stats
+}
+
+// KeyCount returns the number of keys, as Stats counts them, without taking
+// the lock, so that it can be polled however busy the store is.
+func (s *Store) KeyCount() int64 {
+	return s.keys.Load()
+}
+
+// CompareAndSwap is BucketCompareAndSwap for a key in the default bucket.
+func (s *Store) CompareAndSwap(ctx context.Context, key, expected, value string) (bool, error) {
+	return s.BucketCompareAndSwap(ctx, DefaultBucket, key, expected, value)
+}
+
+// BucketCompareAndSwap atomically replaces the value of an existing key with
+// value if its current value is expected, and reports whether it did. A
+// missing key never matches. Only a successful swap is logged. Put hooks
+// check value whether or not it ends up swapped in.
+func (s *Store) BucketCompareAndSwap(ctx context.Context, bucket, key, expected, value string) (swapped bool, err error) {
+	if err := validate(bucket, key); err != nil {
+		return false, err
+	}
+
+	key = s.foldKey(key)
+	s.opts.HotKeys.Observe(bucket, key, true)
+
+	ctx, span := tracing.Start(ctx, "store.CompareAndSwap", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.runPutHooks(ctx, bucket, key, value); err != nil {
+		return false, err
+	}
+
+	if err := s.loadUsage(ctx); err != nil {
+		return false, err
+	}
+
+	stored, codec, err := s.encode(value)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, unlock, err := s.lockKey(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	e, ok, err := s.lookupForWrite(ctx, bucket, key)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	current, err := s.decode(e)
+	if err != nil {
+		return false, err
+	}
+
+	if current != expected {
+		return false, nil
+	}
+
+	if err := s.logPut(ctx, nil, bucket, key, key, stored, codec); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Increment is BucketIncrement for a key in the default bucket.
+func (s *Store) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	return s.BucketIncrement(ctx, DefaultBucket, key, delta)
+}
+
+// BucketIncrement atomically adds delta to the base-10 integer stored under
+// key and returns the new value. A missing key counts as 0. A value that
+// isn't an integer, or a result that would overflow, fails with
+// ErrorNotNumeric. Put hooks check the new value under the lock.
+func (s *Store) BucketIncrement(ctx context.Context, bucket, key string, delta int64) (n int64, err error) {
+	if err := validate(bucket, key); err != nil {
+		return 0, err
+	}
+
+	original := key
+	key = s.foldKey(key)
+	s.opts.HotKeys.Observe(bucket, key, true)
+
+	ctx, span := tracing.Start(ctx, "store.Increment", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.loadUsage(ctx); err != nil {
+		return 0, err
+	}
+
+	ctx, unlock, err := s.lockKey(ctx, bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	e, ok, err := s.lookupForWrite(ctx, bucket, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if ok {
+		current, err := s.decode(e)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err = strconv.ParseInt(current, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrorNotNumeric, current)
+		}
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%w: increment overflows", ErrorNotNumeric)
+	}
+
+	n += delta
+	value := strconv.FormatInt(n, 10)
+
+	if err := s.runPutHooks(ctx, bucket, key, value); err != nil {
+		return 0, err
+	}
+
+	stored, codec, err := s.encode(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.logPut(ctx, nil, bucket, key, original, stored, codec); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
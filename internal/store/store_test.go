@@ -0,0 +1,706 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openLogged returns a store loaded from the file log in dir, with its
+// logger running, and a function closing the logger once everything
+// written is durable, after which dir can be opened again to replay it.
+func openLogged(t testing.TB, dir string, opts Options) (*Store, func()) {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(l, opts)
+	if err := s.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := l.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// stubLogger is a Logger that passes each event written to it to write,
+// if set, which decides whether it is enqueued, and records those that are.
+type stubLogger struct {
+	write func(ctx context.Context, e translog.Event) error
+
+	mu     sync.Mutex
+	events []translog.Event
+}
+
+func (l *stubLogger) WriteEvent(ctx context.Context, e translog.Event) error {
+	if l.write != nil {
+		if err := l.write(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, e)
+
+	return nil
+}
+
+func (l *stubLogger) Flush(ctx context.Context) error {
+	return nil
+}
+
+// logged returns the events enqueued so far.
+func (l *stubLogger) logged() []translog.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]translog.Event(nil), l.events...)
+}
+
+func TestWritesRejectKeysTheLogCantHold(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+
+	for _, key := range []string{"line\nbreak", "tab\tbed", "", "\xff"} {
+		if err := s.PutCtx(ctx, key, "v"); !errors.Is(err, ErrorInvalidKey) {
+			t.Errorf("PutCtx(%q) = %v, want ErrorInvalidKey", key, err)
+		}
+		if err := s.DeleteCtx(ctx, key); !errors.Is(err, ErrorInvalidKey) {
+			t.Errorf("DeleteCtx(%q) = %v, want ErrorInvalidKey", key, err)
+		}
+	}
+
+	if _, err := s.Txn(ctx, Txn{Then: []TxnOp{{Type: TxnPut, Key: "a\nb", Value: "v"}}}); !errors.Is(err, ErrorInvalidKey) {
+		t.Errorf("Txn put of a key with a newline = %v, want ErrorInvalidKey", err)
+	}
+	if err := s.BucketPut(ctx, "bad\nbucket", "k", "v"); !errors.Is(err, ErrorInvalidBucket) {
+		t.Errorf("BucketPut to a bucket with a newline = %v, want ErrorInvalidBucket", err)
+	}
+
+	if err := s.PutCtx(ctx, "kept", "v"); err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	// Nothing rejected reached the log, so it replays
+	replayed, closeLog := openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if v, err := replayed.GetCtx(ctx, "kept"); err != nil || v != "v" {
+		t.Errorf("replayed kept = %q, %v; want v", v, err)
+	}
+	if got := replayed.KeyCount(); got != 1 {
+		t.Errorf("replayed %d keys, want 1", got)
+	}
+}
+
+func TestWriteTimesSurviveReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+
+	if err := s.PutCtx(ctx, "put", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Txn(ctx, Txn{Then: []TxnOp{{Type: TxnPut, Key: "txn", Value: "v"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Seed(ctx, []Record{{Key: "seeded", Value: "v"}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"put", "txn", "seeded"}
+	before := make(map[string]ValueMeta)
+	for _, key := range keys {
+		_, meta, err := s.GetWithMetaCtx(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[key] = meta
+	}
+	closeLog()
+
+	replayed, closeLog := openLogged(t, dir, Options{})
+	defer closeLog()
+
+	for _, key := range keys {
+		_, meta, err := replayed.GetWithMetaCtx(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b := before[key]; !meta.Created.Equal(b.Created) || !meta.Modified.Equal(b.Modified) || meta.Version != b.Version {
+			t.Errorf("%s: %+v before replay, %+v after", key, b, meta)
+		}
+	}
+}
+
+func TestWatchCancelReleasesWatcher(t *testing.T) {
+	s, closeLog := openLogged(t, t.TempDir(), Options{})
+	defer closeLog()
+
+	k := watchKey{DefaultBucket, "k"}
+
+	changed, cancel := s.Watch(DefaultBucket, "k", 0)
+	if !s.watchers.watched(k) {
+		t.Fatal("no watcher registered")
+	}
+
+	// A long-polling GET whose client goes away cancels without a change
+	cancel()
+	if s.watchers.watched(k) {
+		t.Error("the watcher outlived its cancel")
+	}
+
+	if err := s.PutCtx(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+		t.Error("a canceled watcher was woken")
+	default:
+	}
+}
+
+func TestReplayMatchesConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+
+	for run := range 5 {
+		dir := t.TempDir()
+
+		s, closeLog := openLogged(t, dir, Options{})
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+
+		// Puts and deletes of one key, interleaved from 100 goroutines
+		for g := range 100 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				for i := range 20 {
+					var err error
+					if (g+i)%3 == 0 {
+						err = s.DeleteCtx(ctx, "k")
+					} else {
+						err = s.PutCtx(ctx, "k", fmt.Sprintf("%d-%d", g, i))
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+
+		want, wantErr := s.GetCtx(ctx, "k")
+		closeLog()
+
+		replayed, closeLog := openLogged(t, dir, Options{})
+
+		got, gotErr := replayed.GetCtx(ctx, "k")
+		if got != want || errors.Is(gotErr, ErrorNoSuchKey) != errors.Is(wantErr, ErrorNoSuchKey) {
+			t.Errorf("run %d: replayed %q, %v; the store had %q, %v", run, got, gotErr, want, wantErr)
+		}
+		closeLog()
+	}
+}
+
+func TestConcurrentWritesOfDifferentKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+
+	const writers, writes = 32, 50
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	// Each goroutine writes keys of its own, while scans read them all
+	for g := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			for i := range writes {
+				key := fmt.Sprintf("k%d-%d", g, i%5)
+
+				var err error
+				switch i % 5 {
+				case 0:
+					_, err = s.Increment(ctx, key, int64(i))
+				case 4:
+					err = s.DeleteCtx(ctx, fmt.Sprintf("k%d-%d", g, (i+1)%5))
+				default:
+					err = s.PutCtx(ctx, key, fmt.Sprintf("%d-%d", g, i))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if _, err := s.Dump(); err != nil {
+				t.Error(err)
+				return
+			}
+			s.Stats()
+		}
+	}()
+
+	close(start)
+	wg.Wait()
+	close(done)
+	<-scanned
+
+	// Every write logged one event, and all of them are applied
+	if seq := s.Sequence(); seq != writers*writes {
+		t.Errorf("sequence %d after %d writes", seq, writers*writes)
+	}
+
+	want, err := s.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeLog()
+
+	// The log holds the events in the order of their numbers
+	var last uint64
+	err = translog.ScanLog(filepath.Join(dir, translog.LogFileName), func(e translog.Event) error {
+		if e.Sequence != last+1 {
+			return fmt.Errorf("event %d follows %d", e.Sequence, last)
+		}
+		last = e.Sequence
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, closeLog := openLogged(t, dir, Options{})
+	defer closeLog()
+
+	got, err := replayed.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed %v; the store had %v", got, want)
+	}
+}
+
+func TestSequenceWaitsForEarlierWrites(t *testing.T) {
+	var q sequencer
+	first, second := &keyWrite{}, &keyWrite{}
+
+	nop := func() error { return nil }
+	for _, w := range []*keyWrite{first, second} {
+		if err := q.next(&translog.Event{}, w, nop); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changed, reached := q.wait(2)
+	if reached {
+		t.Fatal("event 2 applied before its write was done")
+	}
+
+	// The second write is done first: the first still holds it back
+	q.done(second.seqs)
+	if seq := q.applied(); seq != 0 {
+		t.Errorf("applied %d with event 1 outstanding", seq)
+	}
+
+	q.done(first.seqs)
+	if seq := q.applied(); seq != 2 {
+		t.Errorf("applied %d once both writes were done, want 2", seq)
+	}
+
+	select {
+	case <-changed:
+	default:
+		t.Error("waiters weren't woken")
+	}
+}
+
+// benchKeys are the keys the benchmarks read and write in turn, so that the
+// map stays the same size however long they run.
+var benchKeys = func() []string {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}()
+
+func BenchmarkGet(b *testing.B) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(b, b.TempDir(), Options{})
+	defer closeLog()
+
+	for _, key := range benchKeys {
+		if err := s.PutCtx(ctx, key, "value of "+key); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Get(benchKeys[i%len(benchKeys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	ctx := context.Background()
+	value := strings.Repeat("v", 256)
+
+	s, closeLog := openLogged(b, b.TempDir(), Options{})
+	defer closeLog()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := s.PutCtx(ctx, benchKeys[i%len(benchKeys)], value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCanceledWritesChangeNothing(t *testing.T) {
+	dir := t.TempDir()
+
+	s, closeLog := openLogged(t, dir, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.PutCtx(ctx, "k", "v"); !errors.Is(err, context.Canceled) {
+		t.Errorf("PutCtx with a canceled context = %v, want context.Canceled", err)
+	}
+	if _, err := s.Get("k"); err != ErrorNoSuchKey {
+		t.Errorf("Get after a canceled put = %v, want ErrorNoSuchKey", err)
+	}
+
+	if err := s.PutCtx(context.Background(), "kept", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteCtx(ctx, "kept"); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteCtx with a canceled context = %v, want context.Canceled", err)
+	}
+	if _, err := s.Get("kept"); err != nil {
+		t.Errorf("Get after a canceled delete = %v", err)
+	}
+	closeLog()
+
+	var logged []string
+	err := translog.ScanLog(filepath.Join(dir, translog.LogFileName), func(e translog.Event) error {
+		logged = append(logged, e.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 1 || logged[0] != "kept" {
+		t.Errorf("logged events of keys %q, want only the put of kept", logged)
+	}
+}
+
+func TestWriteGivesUpOnAFullQueue(t *testing.T) {
+	// A logger whose queue stays full holds every write until its context
+	// is done
+	l := &stubLogger{write: func(ctx context.Context, e translog.Event) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	s := New(l, Options{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := s.PutCtx(ctx, "k", "v")
+
+	var de *DeadlineError
+	if !errors.As(err, &de) || de.Phase != PhaseLogEnqueue {
+		t.Errorf("PutCtx on a full queue = %v, want a DeadlineError for %s", err, PhaseLogEnqueue)
+	}
+	if _, err := s.Get("k"); err != ErrorNoSuchKey {
+		t.Errorf("Get after a put that wasn't enqueued = %v, want ErrorNoSuchKey", err)
+	}
+	if got := l.logged(); len(got) != 0 {
+		t.Errorf("enqueued %d events, want none", len(got))
+	}
+}
+
+func TestEnqueuedWritesOutliveTheirContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The client goes away just as the event is enqueued
+	l := &stubLogger{write: func(context.Context, translog.Event) error {
+		cancel()
+		return nil
+	}}
+	s := New(l, Options{})
+
+	if err := s.PutCtx(ctx, "k", "v"); err != nil {
+		t.Errorf("PutCtx canceled once enqueued = %v, want nil", err)
+	}
+	if v, err := s.Get("k"); err != nil || v != "v" {
+		t.Errorf("Get after a put canceled once enqueued = %q, %v; want v", v, err)
+	}
+	if got := l.logged(); len(got) != 1 {
+		t.Errorf("enqueued %d events, want 1", len(got))
+	}
+}
+
+// jsonCorpus returns n JSON documents of about 100KB each, like the order
+// histories some clients store: records of the same shape, with ids, names,
+// amounts and times that vary from one to the next.
+func jsonCorpus(n int) []string {
+	r := rand.New(rand.NewPCG(404, 1))
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel", "india", "juliet"}
+	statuses := []string{"pending", "paid", "shipped", "delivered", "refunded"}
+
+	docs := make([]string, n)
+	for i := range docs {
+		var b strings.Builder
+
+		fmt.Fprintf(&b, `{"customer":"%s-%d","orders":[`, words[r.IntN(len(words))], r.IntN(1e6))
+		for j := 0; b.Len() < 100<<10; j++ {
+			if j > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, `{"id":"%016x","status":"%s","placed":"%s","items":[{"sku":"%s-%04d","qty":%d,"price":%d.%02d}],"note":"%s %s"}`,
+				r.Uint64(), statuses[r.IntN(len(statuses))],
+				time.Unix(1.7e9+r.Int64N(1e7), 0).UTC().Format(time.RFC3339),
+				words[r.IntN(len(words))], r.IntN(1e4), 1+r.IntN(5), r.IntN(500), r.IntN(100),
+				words[r.IntN(len(words))], words[r.IntN(len(words))])
+		}
+		b.WriteString("]}")
+
+		docs[i] = b.String()
+	}
+
+	return docs
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// More tenant keys than fit in one batch, and some others
+	s, closeLog := openLogged(t, dir, Options{})
+	for i := range prefixDeleteBatch + 500 {
+		if err := s.PutCtx(ctx, fmt.Sprintf("tenant/%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"tenant", "other/1", "other/2"} {
+		if err := s.PutCtx(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BucketPut(ctx, "b", "tenant/1", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.DeleteByPrefix(ctx, "nothing/"); n != 0 || err != nil {
+		t.Errorf("deleting a prefix matching nothing: %d, %v", n, err)
+	}
+	seq := s.Sequence()
+
+	n, err := s.DeleteByPrefix(ctx, "tenant/")
+	if n != prefixDeleteBatch+500 || err != nil {
+		t.Fatalf("deleting tenant/: %d, %v; want %d", n, err, prefixDeleteBatch+500)
+	}
+	if s.Sequence() != seq+uint64(n) {
+		t.Errorf("deleting %d keys took the sequence from %d to %d", n, seq, s.Sequence())
+	}
+
+	keys, _ := s.BucketKeys(ctx, DefaultBucket, "")
+	want := fmt.Sprint(keys)
+	if want != "[other/1 other/2 tenant]" {
+		t.Errorf("keys left after deleting tenant/: %v", keys)
+	}
+	closeLog()
+
+	// A restart replays the deletes to the same keys, the other bucket's
+	// included
+	s, closeLog = openLogged(t, dir, Options{})
+	defer closeLog()
+
+	if keys, _ := s.BucketKeys(ctx, DefaultBucket, ""); fmt.Sprint(keys) != want {
+		t.Errorf("keys after replay: %v, want %s", keys, want)
+	}
+	if v, _, err := s.BucketGetWithMeta(ctx, "b", "tenant/1"); v != "v" || err != nil {
+		t.Errorf("b's tenant/1 after replay: %q, %v", v, err)
+	}
+
+	// A prefix every key starts with deletes them all
+	if n, err := s.DeleteByPrefix(ctx, "t"); n != 1 || err != nil {
+		t.Errorf("deleting t: %d, %v", n, err)
+	}
+	if n, err := s.DeleteByPrefix(ctx, "o"); n != 2 || err != nil {
+		t.Errorf("deleting o: %d, %v", n, err)
+	}
+	if n := s.Stats().Keys; n != 1 {
+		t.Errorf("%d keys left, want only b's", n)
+	}
+
+	s.SetReadOnly(true, "test")
+	if _, err := s.BucketDeleteByPrefix(ctx, "b", "tenant/"); !errors.Is(err, ErrorReadOnly) {
+		t.Errorf("deleting by prefix in read-only mode: %v", err)
+	}
+}
+
+func TestCompressedValuesSurviveReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{Codec: compress.Gzip, CompressThreshold: 4096}
+
+	doc := jsonCorpus(1)[0]
+	random := make([]byte, 8<<10)
+	for i := range random {
+		random[i] = byte(rand.Uint32())
+	}
+	values := map[string]string{"json": doc, "small": `{"a":1}`, "random": string(random)}
+	want := map[string]compress.Codec{"json": compress.Gzip, "small": compress.None, "random": compress.None}
+
+	s, closeLog := openLogged(t, dir, opts)
+	for key, value := range values {
+		if err := s.PutCtx(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeLog()
+
+	err := translog.ScanLog(filepath.Join(dir, translog.LogFileName), func(e translog.Event) error {
+		if e.Codec != want[e.Key] {
+			t.Errorf("%s logged with %v, want %v", e.Key, e.Codec, want[e.Key])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay decompresses as it goes, whatever the codec is now
+	for _, opts := range []Options{opts, {}} {
+		s, closeLog := openLogged(t, dir, opts)
+
+		for key, value := range values {
+			if got, err := s.Get(key); err != nil || got != value {
+				t.Errorf("replayed %s with %v: %d bytes, %v; want %d", key, opts.Codec, len(got), err, len(value))
+			}
+
+			if e, _ := s.m.get(DefaultBucket, key); e.codec != want[key] {
+				t.Errorf("replayed %s with %v held with %v, want %v", key, opts.Codec, e.codec, want[key])
+			}
+		}
+		closeLog()
+	}
+}
+
+func BenchmarkPutJSON(b *testing.B) {
+	ctx := context.Background()
+	corpus := jsonCorpus(16)
+
+	raw := 0
+	for _, doc := range corpus {
+		raw += len(doc)
+	}
+
+	for _, codec := range []compress.Codec{compress.None, compress.Gzip, compress.Zlib} {
+		b.Run(codec.String(), func(b *testing.B) {
+			dir := b.TempDir()
+			s, closeLog := openLogged(b, dir, Options{Codec: codec, CompressThreshold: 4096})
+
+			b.SetBytes(int64(raw / len(corpus)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := s.PutCtx(ctx, benchKeys[i%len(corpus)], corpus[i%len(corpus)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+			closeLog()
+
+			// What the map holds for the corpus, and how much each put
+			// adds to the log
+			held := 0
+			for _, e := range s.m.bucket(DefaultBucket) {
+				held += len(e.value)
+			}
+
+			info, err := os.Stat(filepath.Join(dir, translog.LogFileName))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportMetric(float64(held)/float64(raw), "held/raw")
+			b.ReportMetric(float64(info.Size())/float64(b.N), "log-B/op")
+		})
+	}
+}
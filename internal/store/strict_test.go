@@ -0,0 +1,228 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// stepLogger is a file log that can be made to fail a write between its
+// steps: enqueueing its event, and waiting for it to be durable.
+type stepLogger struct {
+	translog.TransactionLogger
+
+	mu          sync.Mutex
+	failEnqueue error  // Returned by WriteEvent, which then drops the event
+	failFlush   error  // Returned by Flush once the events are durable
+	flushed     func() // Called once the events are durable, before failFlush is returned
+}
+
+func (l *stepLogger) WriteEvent(ctx context.Context, e translog.Event) error {
+	l.mu.Lock()
+	err := l.failEnqueue
+	l.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return l.TransactionLogger.WriteEvent(ctx, e)
+}
+
+func (l *stepLogger) Flush(ctx context.Context) error {
+	if err := l.TransactionLogger.Flush(ctx); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.flushed != nil {
+		l.flushed()
+	}
+
+	return l.failFlush
+}
+
+// openSteps returns a store with opts loaded from the file log in dir,
+// logging through a stepLogger, which is closed when the test ends.
+func openSteps(t *testing.T, dir string, opts Options) (*Store, *stepLogger) {
+	t.Helper()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl := &stepLogger{TransactionLogger: l}
+	s := New(sl, opts)
+	if err := s.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close(context.Background()) })
+
+	return s, sl
+}
+
+// crash copies the data directory dir as it is on disk now to a new one, as
+// a crash at this point would leave it.
+func crash(t *testing.T, dir string) string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := t.TempDir()
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(copied, e.Name()), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return copied
+}
+
+// restarted returns the store replayed from the data directory dir.
+func restarted(t *testing.T, dir string) *Store {
+	t.Helper()
+
+	s, closeLog := openLogged(t, dir, Options{})
+	closeLog()
+
+	return s
+}
+
+func TestWriteFailuresBetweenSteps(t *testing.T) {
+	failed := errors.New("simulated failure")
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			ctx := context.Background()
+
+			// A write that can't be enqueued fails, and is neither applied
+			// nor replayed, in either mode
+			dir := t.TempDir()
+			s, l := openSteps(t, dir, Options{StrictWrites: strict})
+
+			if err := s.PutCtx(ctx, "k", "v1"); err != nil {
+				t.Fatal(err)
+			}
+			l.failEnqueue = failed
+
+			if err := s.PutCtx(ctx, "k", "v2"); !errors.Is(err, failed) {
+				t.Errorf("put failing to enqueue: %v, want the failure", err)
+			}
+			if v, _ := s.Get("k"); v != "v1" {
+				t.Errorf("k is %q after a put failing to enqueue, want v1", v)
+			}
+			if err := s.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := restarted(t, crash(t, dir)).Get("k"); v != "v1" {
+				t.Errorf("k replays as %q after a put failing to enqueue, want v1", v)
+			}
+
+			// A write whose event is durable, but fails before it's applied:
+			// strict mode reports it failed and doesn't apply it, though
+			// it replays; the default mode doesn't wait for it at all
+			dir = t.TempDir()
+			s, l = openSteps(t, dir, Options{StrictWrites: strict})
+
+			if err := s.PutCtx(ctx, "k", "v1"); err != nil {
+				t.Fatal(err)
+			}
+
+			var crashed string
+			l.flushed = func() { crashed = crash(t, dir) }
+			l.failFlush = failed
+
+			err := s.PutCtx(ctx, "k", "v2")
+			v, _ := s.Get("k")
+
+			if strict {
+				if !errors.Is(err, failed) || v != "v1" {
+					t.Errorf("strict put failing after its flush: %v, k is %q; want the failure and v1", err, v)
+				}
+				if v, _ := restarted(t, crashed).Get("k"); v != "v2" {
+					t.Errorf("k replays as %q after its durable put failed, want v2", v)
+				}
+			} else {
+				if err != nil || v != "v2" || crashed != "" {
+					t.Errorf("put: %v, k is %q, flushed %v; want it acknowledged and applied without a flush", err, v, crashed != "")
+				}
+			}
+		})
+	}
+}
+
+func TestCrashAfterAcknowledgement(t *testing.T) {
+	const keys, writes = 10, 200
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			dir := t.TempDir()
+			s, _ := openSteps(t, dir, Options{StrictWrites: strict})
+			ctx := context.Background()
+
+			// states[i] is the contents once the first i writes are applied
+			states := []map[string]string{{}}
+
+			for i := range writes {
+				key := fmt.Sprintf("k%d", i%keys)
+
+				state := make(map[string]string)
+				for k, v := range states[i] {
+					state[k] = v
+				}
+
+				var err error
+				if i%7 == 6 {
+					err = s.DeleteCtx(ctx, key)
+					delete(state, key)
+				} else {
+					err = s.PutCtx(ctx, key, fmt.Sprint(i))
+					state[key] = fmt.Sprint(i)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				states = append(states, state)
+
+				if i%25 != 24 {
+					continue
+				}
+
+				// The process dies once the write is acknowledged
+				r := restarted(t, crash(t, dir))
+
+				n := int(r.Sequence())
+				if n > i+1 || strict && n != i+1 {
+					t.Fatalf("after %d acknowledged writes, %d replay", i+1, n)
+				}
+
+				// What replays is the writes acknowledged first, in order
+				for k := range keys {
+					key := fmt.Sprintf("k%d", k)
+					want, wantOK := states[n][key]
+					if v, err := r.Get(key); v != want || (err == nil) != wantOK {
+						t.Fatalf("after %d writes, %s replays as %q, %v; want %q", n, key, v, err, want)
+					}
+				}
+			}
+		})
+	}
+}
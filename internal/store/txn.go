@@ -0,0 +1,435 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"github.com/sheritzs/key-value-store/internal/translog"
+)
+
+// ErrorInvalidTxn is returned for transactions that can't be run as given,
+// such as one writing a key twice.
+var ErrorInvalidTxn = errors.New("invalid transaction")
+
+// CompareTarget is what a Compare checks of its key.
+type CompareTarget int
+
+const (
+	CompareVersion CompareTarget = iota + 1 // The key exists, at Version
+	CompareValue                            // The key exists, with Value
+	CompareExists                           // The key exists
+	CompareAbsent                           // The key doesn't exist
+)
+
+// ParseCompareTarget returns the CompareTarget named version, value, exists
+// or absent.
+func ParseCompareTarget(name string) (CompareTarget, error) {
+	switch name {
+	case "version":
+		return CompareVersion, nil
+	case "value":
+		return CompareValue, nil
+	case "exists":
+		return CompareExists, nil
+	case "absent":
+		return CompareAbsent, nil
+	default:
+		return 0, fmt.Errorf("unknown comparison %q: must be version, value, exists or absent", name)
+	}
+}
+
+func (t CompareTarget) String() string {
+	switch t {
+	case CompareVersion:
+		return "version"
+	case CompareValue:
+		return "value"
+	case CompareExists:
+		return "exists"
+	case CompareAbsent:
+		return "absent"
+	default:
+		return fmt.Sprintf("CompareTarget(%d)", int(t))
+	}
+}
+
+// MarshalText names t as ParseCompareTarget reads it.
+func (t CompareTarget) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText sets t to the CompareTarget named by text.
+func (t *CompareTarget) UnmarshalText(text []byte) error {
+	parsed, err := ParseCompareTarget(string(text))
+	if err != nil {
+		return err
+	}
+
+	*t = parsed
+	return nil
+}
+
+// TxnOpType is what a TxnOp does to its key.
+type TxnOpType int
+
+const (
+	TxnGet    TxnOpType = iota + 1 // Reads the key
+	TxnPut                         // Sets the key to Value
+	TxnDelete                      // Deletes the key
+)
+
+// ParseTxnOpType returns the TxnOpType named get, put or delete.
+func ParseTxnOpType(name string) (TxnOpType, error) {
+	switch name {
+	case "get":
+		return TxnGet, nil
+	case "put":
+		return TxnPut, nil
+	case "delete":
+		return TxnDelete, nil
+	default:
+		return 0, fmt.Errorf("unknown operation %q: must be get, put or delete", name)
+	}
+}
+
+func (t TxnOpType) String() string {
+	switch t {
+	case TxnGet:
+		return "get"
+	case TxnPut:
+		return "put"
+	case TxnDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("TxnOpType(%d)", int(t))
+	}
+}
+
+// MarshalText names t as ParseTxnOpType reads it.
+func (t TxnOpType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText sets t to the TxnOpType named by text.
+func (t *TxnOpType) UnmarshalText(text []byte) error {
+	parsed, err := ParseTxnOpType(string(text))
+	if err != nil {
+		return err
+	}
+
+	*t = parsed
+	return nil
+}
+
+// Compare is a condition of a Txn on a key.
+type Compare struct {
+	Bucket  string // DefaultBucket if empty
+	Key     string
+	Target  CompareTarget
+	Version uint64 // Compared under CompareVersion
+	Value   string // Compared under CompareValue
+}
+
+// TxnOp is an operation of a Txn on a key.
+type TxnOp struct {
+	Type   TxnOpType
+	Bucket string // DefaultBucket if empty
+	Key    string
+	Value  string // Written by TxnPut
+}
+
+// Txn is a transaction: Then runs if every condition in If holds, and Else
+// otherwise. Else only reads, as a failed transaction writes nothing.
+type Txn struct {
+	If   []Compare
+	Then []TxnOp
+	Else []TxnOp
+}
+
+// TxnResult is the outcome of a TxnOp. Found is whether the key existed
+// before the branch ran. A get returns the value and metadata the key had
+// then; a put returns the metadata the key has after it.
+type TxnResult struct {
+	Bucket string
+	Key    string
+	Found  bool
+	Value  string
+	Meta   ValueMeta
+}
+
+// TxnOutcome is what a Txn did: which branch ran, and the result of each
+// of its operations, in order.
+type TxnOutcome struct {
+	Succeeded bool // Whether every condition held, so Then ran
+	Results   []TxnResult
+}
+
+// txnWrite is a write of a Txn, as it is logged.
+type txnWrite struct {
+	op       *TxnOp
+	index    int // Of op in its branch
+	bucket   string
+	key      string // Folded
+	stored   string // Value of a put, encoded
+	codec    compress.Codec
+	existing *entry // Of the key before the write, nil if it had none
+}
+
+// Txn runs t atomically: its conditions are evaluated, and the branch they
+// select run, under one hold of the write lock, so no other write comes in
+// between. The writes of the branch are logged together, one event each,
+// and under StrictWrites waited for once, and applied only if that
+// succeeds. A crash can still leave a prefix of them in the log, as with
+// BucketDeleteByPrefix. Gets in a branch read the keys as they were when
+// the conditions were evaluated, not as the branch's own writes leave them,
+// so a branch may write a key only once. Put hooks check every value Then
+// would write, whichever branch runs. Quotas are checked for each put on
+// its own, against the usage before the transaction.
+//
+// The sequence recorded for WithSequence is that of the last write, or the
+// store's current one if the branch writes nothing.
+func (s *Store) Txn(ctx context.Context, t Txn) (outcome TxnOutcome, err error) {
+	ctx, span := tracing.Start(ctx, "store.Txn", "", "")
+	defer func() { tracing.End(span, err) }()
+
+	for _, op := range t.Else {
+		if op.Type != TxnGet {
+			return outcome, fmt.Errorf("%w: the else branch may only get keys", ErrorInvalidTxn)
+		}
+	}
+
+	writes, err := s.prepareTxn(ctx, t.Then)
+	if err != nil {
+		return outcome, err
+	}
+
+	if err := s.loadUsage(ctx); err != nil {
+		return outcome, err
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return outcome, err
+	}
+	defer s.mu.Unlock()
+
+	outcome.Succeeded = true
+	for _, c := range t.If {
+		holds, err := s.compare(ctx, c)
+		if err != nil {
+			return TxnOutcome{}, err
+		}
+		if !holds {
+			outcome.Succeeded = false
+			break
+		}
+	}
+
+	ops := t.Then
+	if !outcome.Succeeded {
+		ops, writes = t.Else, nil
+	}
+
+	// Reads come first, so they see the keys before the branch's writes
+	outcome.Results = make([]TxnResult, len(ops))
+	for i, op := range ops {
+		bucket := bucketOr(op.Bucket)
+		outcome.Results[i] = TxnResult{Bucket: bucket, Key: op.Key}
+
+		e, ok, err := s.lookupForWrite(ctx, bucket, s.foldKey(op.Key))
+		if err != nil {
+			return TxnOutcome{}, err
+		}
+
+		outcome.Results[i].Found = ok
+		if ok && op.Type == TxnGet {
+			if outcome.Results[i].Value, err = s.decode(e); err != nil {
+				return TxnOutcome{}, err
+			}
+			outcome.Results[i].Meta = e.meta
+		}
+	}
+
+	if len(writes) == 0 {
+		recordSequence(ctx, s.seq.load())
+		return outcome, nil
+	}
+
+	if err := s.logTxn(ctx, writes); err != nil {
+		return TxnOutcome{}, err
+	}
+
+	for _, w := range writes {
+		if w.op.Type != TxnPut {
+			continue
+		}
+
+		r := &outcome.Results[w.index]
+		if IsDryRun(ctx) {
+			var old entry
+			if w.existing != nil {
+				old = *w.existing
+			}
+			r.Meta = dryRunMeta(old, w.existing != nil, w.key, w.op.Key)
+			continue
+		}
+
+		e, _ := s.lookup(w.bucket, w.key)
+		r.Meta = e.meta
+	}
+
+	return outcome, nil
+}
+
+// prepareTxn checks the writes of ops, and encodes the values of the puts,
+// running their put hooks. It doesn't need the lock.
+func (s *Store) prepareTxn(ctx context.Context, ops []TxnOp) ([]txnWrite, error) {
+	var writes []txnWrite
+	written := make(map[[2]string]bool)
+
+	for i := range ops {
+		op := &ops[i]
+
+		switch op.Type {
+		case TxnGet:
+			continue
+		case TxnPut, TxnDelete:
+		default:
+			return nil, fmt.Errorf("%w: unknown operation %d", ErrorInvalidTxn, op.Type)
+		}
+
+		if err := validate(bucketOr(op.Bucket), op.Key); err != nil {
+			return nil, err
+		}
+
+		w := txnWrite{op: op, index: i, bucket: bucketOr(op.Bucket), key: s.foldKey(op.Key)}
+		s.opts.HotKeys.Observe(w.bucket, w.key, true)
+
+		k := [2]string{w.bucket, w.key}
+		if written[k] {
+			return nil, fmt.Errorf("%w: key %q in bucket %q is written twice", ErrorInvalidTxn, w.key, w.bucket)
+		}
+		written[k] = true
+
+		if op.Type == TxnPut {
+			if err := s.runPutHooks(ctx, w.bucket, w.key, op.Value); err != nil {
+				return nil, err
+			}
+
+			var err error
+			if w.stored, w.codec, err = s.encode(op.Value); err != nil {
+				return nil, err
+			}
+		}
+
+		writes = append(writes, w)
+	}
+
+	return writes, nil
+}
+
+// compare reports whether c holds. The caller must hold the write lock.
+func (s *Store) compare(ctx context.Context, c Compare) (bool, error) {
+	e, ok, err := s.lookupForWrite(ctx, bucketOr(c.Bucket), s.foldKey(c.Key))
+	if err != nil {
+		return false, err
+	}
+
+	switch c.Target {
+	case CompareVersion:
+		return ok && e.meta.Version == c.Version, nil
+	case CompareValue:
+		if !ok {
+			return false, nil
+		}
+
+		value, err := s.decode(e)
+
+		return err == nil && value == c.Value, err
+	case CompareExists:
+		return ok, nil
+	case CompareAbsent:
+		return !ok, nil
+	default:
+		return false, fmt.Errorf("%w: unknown comparison %d", ErrorInvalidTxn, c.Target)
+	}
+}
+
+// logTxn checks, logs and applies writes: every write is checked before
+// any is logged, and their events are logged together by logEvents, which
+// says how many of them to apply. The caller must hold the write lock.
+func (s *Store) logTxn(ctx context.Context, writes []txnWrite) error {
+	if s.readOnly {
+		return ErrorReadOnly
+	}
+
+	for i := range writes {
+		w := &writes[i]
+
+		old, ok, err := s.lookupForWrite(ctx, w.bucket, w.key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := checkLease(ctx, w.bucket, w.key, old); err != nil {
+				return err
+			}
+			if err := checkImmutable(ctx, w.bucket, w.key, old); err != nil {
+				return err
+			}
+			w.existing = &old
+		}
+
+		if w.op.Type == TxnPut {
+			if err := s.checkQuota(w.bucket, w.key, w.existing, w.stored, w.codec); err != nil {
+				return err
+			}
+		}
+	}
+
+	if IsDryRun(ctx) {
+		return nil
+	}
+
+	events := make([]translog.Event, 0, len(writes))
+	for _, w := range writes {
+		if w.op.Type != TxnPut {
+			events = append(events, translog.Event{EventType: translog.EventDelete, Bucket: w.bucket, Key: w.key})
+			continue
+		}
+
+		events = append(events, translog.Event{EventType: translog.EventPut, Bucket: w.bucket, Key: w.key, Value: w.stored, Codec: w.codec})
+		if w.existing == nil && w.op.Key != w.key {
+			events = append(events, translog.Event{EventType: translog.EventOriginalKey, Bucket: w.bucket, Key: w.key, Value: w.op.Key})
+		}
+	}
+
+	n, err := s.logEvents(ctx, events)
+	since := s.m.now()
+
+	// Events once enqueued are always applied, like any other write
+	for _, e := range events[:n] {
+		switch e.EventType {
+		case translog.EventPut:
+			s.setAt(e.Bucket, e.Key, e.Value, e.Codec, e.ContentType, e.Time)
+			s.warnQuota(ctx, e.Bucket)
+		case translog.EventOriginalKey:
+			s.noteOriginal(e.Bucket, e.Key, e.Value)
+		default:
+			s.remove(e.Bucket, e.Key)
+		}
+	}
+	s.evict(ctx, since)
+
+	return err
+}
+
+// bucketOr returns bucket, or DefaultBucket if it's empty.
+func bucketOr(bucket string) string {
+	if bucket == "" {
+		return DefaultBucket
+	}
+
+	return bucket
+}
@@ -0,0 +1,308 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// values returns the value of every key in s, by bucket and key.
+func values(t *testing.T, s *Store) map[string]string {
+	t.Helper()
+
+	records, err := s.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make(map[string]string, len(records))
+	for _, r := range records {
+		m[r.Bucket+"/"+r.Key] = r.Value
+	}
+	return m
+}
+
+func TestTxnBranches(t *testing.T) {
+	ctx := context.Background()
+	s := New(&stubLogger{}, Options{})
+
+	if err := s.PutCtx(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutCtx(ctx, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		cond  Compare
+		holds bool
+	}{
+		{"version", Compare{Key: "a", Target: CompareVersion, Version: 2}, true},
+		{"older version", Compare{Key: "a", Target: CompareVersion, Version: 1}, false},
+		{"version of a missing key", Compare{Key: "x", Target: CompareVersion}, false},
+		{"value", Compare{Key: "a", Target: CompareValue, Value: "2"}, true},
+		{"other value", Compare{Key: "a", Target: CompareValue, Value: "1"}, false},
+		{"empty value of a missing key", Compare{Key: "x", Target: CompareValue}, false},
+		{"exists", Compare{Key: "a", Target: CompareExists}, true},
+		{"exists, missing", Compare{Key: "x", Target: CompareExists}, false},
+		{"absent", Compare{Key: "x", Target: CompareAbsent}, true},
+		{"absent, present", Compare{Key: "a", Target: CompareAbsent}, false},
+		{"another bucket", Compare{Bucket: "b", Key: "a", Target: CompareExists}, false},
+	} {
+		outcome, err := s.Txn(ctx, Txn{
+			If:   []Compare{tt.cond},
+			Then: []TxnOp{{Type: TxnGet, Key: "a"}},
+			Else: []TxnOp{{Type: TxnGet, Key: "x"}},
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if outcome.Succeeded != tt.holds {
+			t.Errorf("%s: succeeded %v, want %v", tt.name, outcome.Succeeded, tt.holds)
+		}
+		if want := map[bool]string{true: "a", false: "x"}[tt.holds]; len(outcome.Results) != 1 || outcome.Results[0].Key != want {
+			t.Errorf("%s: results %+v, want a get of %s", tt.name, outcome.Results, want)
+		}
+	}
+
+	// Gets in a branch see the keys as they were before its writes, and
+	// puts report the metadata they leave
+	outcome, err := s.Txn(ctx, Txn{
+		If: []Compare{{Key: "a", Target: CompareValue, Value: "2"}, {Key: "c", Target: CompareAbsent}},
+		Then: []TxnOp{
+			{Type: TxnPut, Key: "a", Value: "3"},
+			{Type: TxnGet, Key: "a"},
+			{Type: TxnPut, Key: "c", Value: "v"},
+			{Type: TxnDelete, Key: "x"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TxnResult{
+		{Bucket: DefaultBucket, Key: "a", Found: true},
+		{Bucket: DefaultBucket, Key: "a", Found: true, Value: "2"},
+		{Bucket: DefaultBucket, Key: "c"},
+		{Bucket: DefaultBucket, Key: "x"},
+	}
+	for i, r := range outcome.Results {
+		if r.Bucket != want[i].Bucket || r.Key != want[i].Key || r.Found != want[i].Found || r.Value != want[i].Value {
+			t.Errorf("result %d: %+v, want %+v", i, r, want[i])
+		}
+	}
+	if !outcome.Succeeded || outcome.Results[0].Meta.Version != 3 || outcome.Results[1].Meta.Version != 2 || outcome.Results[2].Meta.Version != 1 {
+		t.Errorf("outcome: %+v", outcome)
+	}
+
+	// A transaction that can't run as given changes nothing
+	before := values(t, s)
+	for _, tt := range []struct {
+		name string
+		txn  Txn
+	}{
+		{"a put in else", Txn{Else: []TxnOp{{Type: TxnPut, Key: "a", Value: "4"}}}},
+		{"a key written twice", Txn{Then: []TxnOp{{Type: TxnPut, Key: "d", Value: "v"}, {Type: TxnDelete, Key: "d"}}}},
+		{"an unknown operation", Txn{Then: []TxnOp{{Type: TxnPut, Key: "e", Value: "v"}, {Key: "a"}}}},
+		{"an unknown comparison", Txn{If: []Compare{{Key: "a"}}, Then: []TxnOp{{Type: TxnPut, Key: "e", Value: "v"}}}},
+	} {
+		if _, err := s.Txn(ctx, tt.txn); !errors.Is(err, ErrorInvalidTxn) {
+			t.Errorf("%s: %v, want %v", tt.name, err, ErrorInvalidTxn)
+		}
+	}
+	if after := values(t, s); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("invalid transactions changed the store: %v, was %v", after, before)
+	}
+}
+
+// committedTxn is a transaction that succeeded, with the sequence of its
+// last write.
+type committedTxn struct {
+	seq uint64
+	txn Txn
+}
+
+func TestContendingTxnsAreSerializable(t *testing.T) {
+	ctx := context.Background()
+	l := &stubLogger{}
+	s := New(l, Options{})
+
+	const workers, rounds, total = 8, 200, 100
+
+	if err := s.PutCtx(ctx, "counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := s.PutCtx(ctx, key, strconv.Itoa(total/2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initial := values(t, s)
+
+	var mu sync.Mutex
+	var committed []committedTxn
+	var failed atomic.Int64
+
+	// run runs txn, recording it if it succeeded. It checks that a
+	// transaction that failed did so against a state where its conditions
+	// didn't hold, as its else branch read it
+	run := func(txn Txn) (TxnOutcome, bool) {
+		var seq uint64
+		outcome, err := s.Txn(WithSequence(ctx, &seq), txn)
+		if err != nil {
+			t.Error(err)
+			return outcome, false
+		}
+
+		if outcome.Succeeded {
+			mu.Lock()
+			committed = append(committed, committedTxn{seq, txn})
+			mu.Unlock()
+			return outcome, true
+		}
+
+		failed.Add(1)
+		for i, c := range txn.If {
+			r := outcome.Results[i]
+			if r.Found && (c.Target == CompareVersion && r.Meta.Version == c.Version || c.Target == CompareValue && r.Value == c.Value) {
+				continue
+			}
+			return outcome, false
+		}
+		t.Errorf("a transaction failed though its else branch read every condition holding: %+v, %+v", txn, outcome.Results)
+		return outcome, false
+	}
+
+	// read returns the values of keys, read together
+	read := func(keys ...string) []TxnResult {
+		var ops []TxnOp
+		for _, key := range keys {
+			ops = append(ops, TxnOp{Type: TxnGet, Key: key})
+		}
+		outcome, err := s.Txn(ctx, Txn{Then: ops})
+		if err != nil {
+			t.Error(err)
+		}
+		return outcome.Results
+	}
+
+	// Half the workers claim numbers off the counter, conditioned on its
+	// version; the others move units between a and b, conditioned on both
+	// values, checking as they go that no read sees a move half done
+	claims := make([][]int, workers)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range rounds {
+				if w%2 == 0 {
+					r := read("counter")[0]
+					n, _ := strconv.Atoi(r.Value)
+					next := strconv.Itoa(n + 1)
+					runtime.Gosched() // Let others in between the read and the write
+
+					if _, ok := run(Txn{
+						If:   []Compare{{Key: "counter", Target: CompareVersion, Version: r.Meta.Version}},
+						Then: []TxnOp{{Type: TxnPut, Key: "counter", Value: next}, {Type: TxnPut, Key: "claim/" + next, Value: strconv.Itoa(w)}},
+						Else: []TxnOp{{Type: TxnGet, Key: "counter"}},
+					}); ok {
+						claims[w] = append(claims[w], n+1)
+					}
+					continue
+				}
+
+				rs := read("a", "b")
+				a, _ := strconv.Atoi(rs[0].Value)
+				b, _ := strconv.Atoi(rs[1].Value)
+				if a+b != total {
+					t.Errorf("a read of a and b: %d and %d", a, b)
+					return
+				}
+
+				move := 1 - 2*(i%2)
+				runtime.Gosched()
+				run(Txn{
+					If:   []Compare{{Key: "a", Target: CompareValue, Value: rs[0].Value}, {Key: "b", Target: CompareValue, Value: rs[1].Value}},
+					Then: []TxnOp{{Type: TxnPut, Key: "a", Value: strconv.Itoa(a - move)}, {Type: TxnPut, Key: "b", Value: strconv.Itoa(b + move)}},
+					Else: []TxnOp{{Type: TxnGet, Key: "a"}, {Type: TxnGet, Key: "b"}},
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	final := values(t, s)
+
+	// Every number was claimed once, by the worker told it claimed it
+	n, _ := strconv.Atoi(final[DefaultBucket+"/counter"])
+	var all []int
+	for w, nums := range claims {
+		for _, num := range nums {
+			if v := final[fmt.Sprintf("%s/claim/%d", DefaultBucket, num)]; v != strconv.Itoa(w) {
+				t.Errorf("claim/%d: %q, claimed by %d", num, v, w)
+			}
+		}
+		all = append(all, nums...)
+	}
+	slices.Sort(all)
+	if len(all) != n || len(all) > 0 && (all[0] != 1 || all[len(all)-1] != n || len(slices.Compact(all)) != n) {
+		t.Errorf("counter at %d, with %d numbers claimed", n, len(all))
+	}
+	if n == 0 || failed.Load() == 0 {
+		t.Errorf("%d numbers claimed, %d transactions failed: no contention", n, failed.Load())
+	}
+
+	// The committed transactions, run one at a time in the order of their
+	// sequences, all succeed again and leave the same store
+	slices.SortFunc(committed, func(a, b committedTxn) int { return cmp.Compare(a.seq, b.seq) })
+	serial := New(&stubLogger{}, Options{})
+	for key, v := range initial {
+		bucket, key, _ := strings.Cut(key, "/")
+		if err := serial.BucketPut(ctx, bucket, key, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range committed {
+		if outcome, err := serial.Txn(ctx, c.txn); err != nil || !outcome.Succeeded {
+			t.Fatalf("the transaction committed at sequence %d, run serially: %+v, %v", c.seq, outcome, err)
+		}
+	}
+	if got := values(t, serial); fmt.Sprint(got) != fmt.Sprint(final) {
+		t.Error("the committed transactions run serially leave a different store")
+	}
+
+	// The log holds the writes of each transaction together, so replaying
+	// it leaves the same store too
+	replayed := New(&stubLogger{}, Options{})
+	events := l.logged()
+	for _, e := range events {
+		if err := replayed.ApplyEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := values(t, replayed); fmt.Sprint(got) != fmt.Sprint(final) {
+		t.Error("the replayed log leaves a different store")
+	}
+
+	bySeq := make(map[uint64]string, len(events))
+	for _, e := range events {
+		bySeq[e.Sequence] = e.Key + "=" + e.Value
+	}
+	for _, c := range committed {
+		first, last := c.txn.Then[0], c.txn.Then[1]
+		if bySeq[c.seq-1] != first.Key+"="+first.Value || bySeq[c.seq] != last.Key+"="+last.Value {
+			t.Fatalf("the writes of the transaction committed at sequence %d aren't logged together: %q, %q", c.seq, bySeq[c.seq-1], bySeq[c.seq])
+		}
+	}
+}
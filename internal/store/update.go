@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+)
+
+// UpdateFunc computes what becomes of a key from its current value and
+// metadata; exists is false if the key doesn't exist, old then being empty.
+// It returns the key's new value, or del true to delete the key. An error
+// leaves the key as it is.
+//
+// An UpdateFunc is called under the lock of the write of its key, which
+// holds up the other writes of the keys in its shard meanwhile, and every
+// write under quotas, so it must be fast, and free of side effects other
+// than capturing its result.
+type UpdateFunc func(old string, meta ValueMeta, exists bool) (value string, del bool, err error)
+
+// Update is BucketUpdate for a key in the default bucket.
+func (s *Store) Update(ctx context.Context, key string, fn UpdateFunc) (string, ValueMeta, error) {
+	return s.BucketUpdate(ctx, DefaultBucket, key, fn)
+}
+
+// BucketUpdate atomically applies fn to key: no other write of the key can
+// come in between reading it and writing what fn returns. The
+// outcome is logged as a single event, a put of the whole new value or a
+// delete. A new value equal to the current one, or a delete of a missing
+// key, changes nothing and logs nothing; its sequence, for WithSequence, is
+// the store's current one. An error from fn is returned as it is, and
+// nothing is written. Put hooks run on a new value under the lock too.
+//
+// BucketUpdate returns the key's value and metadata after the update, or
+// an empty value and zero metadata if the key no longer exists.
+func (s *Store) BucketUpdate(ctx context.Context, bucket, key string, fn UpdateFunc) (value string, meta ValueMeta, err error) {
+	if err := validate(bucket, key); err != nil {
+		return "", ValueMeta{}, err
+	}
+
+	original := key
+	key = s.foldKey(key)
+	s.opts.HotKeys.Observe(bucket, key, true)
+
+	ctx, span := tracing.Start(ctx, "store.Update", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.loadUsage(ctx); err != nil {
+		return "", ValueMeta{}, err
+	}
+
+	ctx, unlock, err := s.lockKey(ctx, bucket, key)
+	if err != nil {
+		return "", ValueMeta{}, err
+	}
+	defer unlock()
+
+	if s.readOnly {
+		return "", ValueMeta{}, ErrorReadOnly
+	}
+
+	e, ok, err := s.lookupForWrite(ctx, bucket, key)
+	if err != nil {
+		return "", ValueMeta{}, err
+	}
+
+	var current string
+	if ok {
+		if current, err = s.decode(e); err != nil {
+			return "", ValueMeta{}, err
+		}
+	}
+
+	value, del, err := fn(current, e.meta, ok)
+	switch {
+	case err != nil:
+		return "", ValueMeta{}, err
+	case del && !ok:
+		recordSequence(ctx, s.seq.load())
+		return "", ValueMeta{}, nil
+	case del:
+		return "", ValueMeta{}, s.logDelete(ctx, nil, bucket, key)
+	case ok && value == current:
+		recordSequence(ctx, s.seq.load())
+		return current, e.meta, nil
+	}
+
+	if err := s.runPutHooks(ctx, bucket, key, value); err != nil {
+		return "", ValueMeta{}, err
+	}
+
+	stored, codec, err := s.encode(value)
+	if err != nil {
+		return "", ValueMeta{}, err
+	}
+
+	if err := s.logPut(ctx, nil, bucket, key, original, stored, codec); err != nil {
+		return "", ValueMeta{}, err
+	}
+
+	if IsDryRun(ctx) {
+		return value, dryRunMeta(e, ok, key, original), nil
+	}
+
+	e, _ = s.lookup(bucket, key)
+
+	return value, e.meta, nil
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentUpdatesApplyInSomeOrder(t *testing.T) {
+	ctx := context.Background()
+
+	l := &stubLogger{}
+	s := New(l, Options{})
+
+	const updates = 500
+
+	// Each update appends its number, so the value lists the order the
+	// updates were applied in
+	var wg sync.WaitGroup
+	for i := range updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, _, err := s.Update(ctx, "k", func(old string, _ ValueMeta, exists bool) (string, bool, error) {
+				if !exists {
+					return strconv.Itoa(i), false, nil
+				}
+				return old + "," + strconv.Itoa(i), false, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, meta, err := s.GetWithMeta("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No update was lost, nor applied twice
+	order := strings.Split(value, ",")
+	applied := make([]int, len(order))
+	for i, n := range order {
+		if applied[i], err = strconv.Atoi(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slices.Sort(applied)
+	for i, n := range applied {
+		if n != i {
+			t.Fatalf("the updates applied, in order: %v", applied)
+		}
+	}
+	if meta.Version != updates {
+		t.Errorf("version %d after %d updates", meta.Version, updates)
+	}
+
+	// The log holds one event per update, each the previous value with the
+	// next update applied, so replaying it applies them in the same order
+	events := l.logged()
+	if len(events) != updates {
+		t.Fatalf("%d events logged for %d updates", len(events), updates)
+	}
+
+	want := ""
+	for i, e := range events {
+		if i > 0 {
+			want += ","
+		}
+		want += order[i]
+
+		if e.EventType != translog.EventPut || e.Value != want || e.Sequence != uint64(i+1) {
+			t.Fatalf("event %d: %+v, want a put of %q", i, e, want)
+		}
+	}
+}
+
+func TestUpdateOutcomes(t *testing.T) {
+	ctx := context.Background()
+
+	l := &stubLogger{}
+	s := New(l, Options{})
+
+	// update applies fn to key, returning how many events it logged
+	update := func(key string, fn UpdateFunc) (string, int, error) {
+		t.Helper()
+
+		before := len(l.logged())
+		value, _, err := s.Update(ctx, key, fn)
+
+		return value, len(l.logged()) - before, err
+	}
+
+	// A missing key is seen as such, and created
+	value, n, err := update("k", func(old string, meta ValueMeta, exists bool) (string, bool, error) {
+		if exists || old != "" || meta.Version != 0 {
+			t.Errorf("a missing key updated as %q, %+v, %v", old, meta, exists)
+		}
+		return "v1", false, nil
+	})
+	if err != nil || value != "v1" || n != 1 {
+		t.Errorf("creating k: %q, %d events, %v", value, n, err)
+	}
+
+	// An error aborts the update, writing nothing
+	failed := errors.New("failed")
+	if _, n, err := update("k", func(string, ValueMeta, bool) (string, bool, error) {
+		return "v2", false, failed
+	}); !errors.Is(err, failed) || n != 0 {
+		t.Errorf("a failed update: %d events, %v", n, err)
+	}
+	if got, _ := s.Get("k"); got != "v1" {
+		t.Errorf("k after a failed update: %q", got)
+	}
+
+	// Returning the current value changes nothing
+	if value, n, err := update("k", func(old string, _ ValueMeta, _ bool) (string, bool, error) {
+		return old, false, nil
+	}); err != nil || value != "v1" || n != 0 {
+		t.Errorf("an update to the same value: %q, %d events, %v", value, n, err)
+	}
+
+	// A delete is logged as one event, and of a missing key as none
+	for i, want := range []int{1, 0} {
+		if value, n, err := update("k", func(string, ValueMeta, bool) (string, bool, error) {
+			return "", true, nil
+		}); err != nil || value != "" || n != want {
+			t.Errorf("delete #%d: %q, %d events, %v", i, value, n, err)
+		}
+	}
+	if _, err := s.Get("k"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Get of k after its delete: %v", err)
+	}
+
+	if events := l.logged(); len(events) != 2 || events[1].EventType != translog.EventDelete {
+		t.Errorf("the events logged: %+v", events)
+	}
+}
@@ -0,0 +1,364 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type watchKey struct {
+	bucket, key string
+}
+
+// WatchChanges selects the kinds of change a WatchFilter matches.
+type WatchChanges int
+
+const (
+	AllChanges  WatchChanges = iota // Puts and deletes
+	PutsOnly                        // Writes of a value, including the creation of the key
+	DeletesOnly                     // Deletes of the key
+)
+
+var watchChangesNames = []string{"all", "puts", "deletes"}
+
+func (c WatchChanges) String() string {
+	if int(c) < len(watchChangesNames) {
+		return watchChangesNames[c]
+	}
+
+	return fmt.Sprintf("WatchChanges(%d)", int(c))
+}
+
+// ParseWatchChanges returns the WatchChanges named by name: all, puts or
+// deletes.
+func ParseWatchChanges(name string) (WatchChanges, error) {
+	for i, n := range watchChangesNames {
+		if n == name {
+			return WatchChanges(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown watch changes %q, expected one of %v", name, watchChangesNames)
+}
+
+// FieldMatch matches JSON values whose field at Path equals Value, as JSON:
+// the number 1 equals 1.0, and a string never equals a number.
+type FieldMatch struct {
+	Path  []string // Field names from the top-level object down
+	Value any      // As decoded by encoding/json
+}
+
+// ParseFieldMatch parses a match such as `status=="failed"` or
+// `job.attempts==3`: a dot-separated path to a field, "==", and the JSON the
+// field must equal.
+func ParseFieldMatch(s string) (FieldMatch, error) {
+	var m FieldMatch
+
+	path, value, ok := strings.Cut(s, "==")
+	if !ok || path == "" {
+		return m, fmt.Errorf("field match %q: expected field==json", s)
+	}
+
+	m.Path = strings.Split(path, ".")
+	if err := json.Unmarshal([]byte(value), &m.Value); err != nil {
+		return m, fmt.Errorf("field match %q: invalid JSON %q: %w", s, value, err)
+	}
+
+	return m, nil
+}
+
+// matches reports whether value is a JSON object whose field at m.Path
+// equals m.Value.
+func (m FieldMatch) matches(value string) bool {
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return false
+	}
+
+	for _, name := range m.Path {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return false
+		}
+		if v, ok = obj[name]; !ok {
+			return false
+		}
+	}
+
+	return reflect.DeepEqual(v, m.Value)
+}
+
+// WatchFilter narrows the changes a watcher is woken for. The zero filter
+// matches every change.
+type WatchFilter struct {
+	Changes WatchChanges
+	Equals  *string     // If set, only puts of this value match
+	Field   *FieldMatch // If set, only puts of JSON values it matches match
+}
+
+// IsZero reports whether f matches every change.
+func (f WatchFilter) IsZero() bool {
+	return f.Changes == AllChanges && f.Equals == nil && f.Field == nil
+}
+
+// Validate checks that f can match a change at all.
+func (f WatchFilter) Validate() error {
+	if f.Changes == DeletesOnly && (f.Equals != nil || f.Field != nil) {
+		return errors.New("value filters only match puts, not deletes")
+	}
+
+	return nil
+}
+
+// needsValue reports whether f looks at the value a key is put.
+func (f WatchFilter) needsValue() bool {
+	return f.Equals != nil || f.Field != nil
+}
+
+// matches reports whether f matches a change: a put of value, or a delete.
+func (f WatchFilter) matches(deleted bool, value string) bool {
+	switch {
+	case f.Changes == PutsOnly && deleted, f.Changes == DeletesOnly && !deleted:
+		return false
+	case deleted:
+		return !f.needsValue()
+	case f.Equals != nil && value != *f.Equals:
+		return false
+	case f.Field != nil && !f.Field.matches(value):
+		return false
+	default:
+		return true
+	}
+}
+
+// watchRegistry tracks the channels waiting for a change to each key, with
+// their filters. A channel is closed, and forgotten, on the first change
+// after it was registered that its filter matches.
+type watchRegistry struct {
+	mu sync.Mutex
+	m  map[watchKey]map[chan struct{}]WatchFilter
+}
+
+func (w *watchRegistry) add(k watchKey, f WatchFilter) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.m == nil {
+		w.m = make(map[watchKey]map[chan struct{}]WatchFilter)
+	}
+
+	chans, ok := w.m[k]
+	if !ok {
+		chans = make(map[chan struct{}]WatchFilter)
+		w.m[k] = chans
+	}
+
+	ch := make(chan struct{})
+	chans[ch] = f
+
+	return ch
+}
+
+func (w *watchRegistry) remove(k watchKey, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	chans := w.m[k]
+	delete(chans, ch)
+
+	if len(chans) == 0 {
+		delete(w.m, k)
+	}
+}
+
+// notify wakes every watcher of k without a filter, and returns those with
+// one, which are left waiting.
+func (w *watchRegistry) notify(k watchKey) map[chan struct{}]WatchFilter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var filtered map[chan struct{}]WatchFilter
+
+	for ch, f := range w.m[k] {
+		if !f.IsZero() {
+			if filtered == nil {
+				filtered = make(map[chan struct{}]WatchFilter)
+			}
+			filtered[ch] = f
+			continue
+		}
+
+		close(ch)
+		delete(w.m[k], ch)
+	}
+
+	if len(w.m[k]) == 0 {
+		delete(w.m, k)
+	}
+
+	return filtered
+}
+
+// watched reports whether k has watchers.
+func (w *watchRegistry) watched(k watchKey) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.m[k]) > 0
+}
+
+// wake wakes the watcher ch of k, unless it was woken or removed already.
+func (w *watchRegistry) wake(k watchKey, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	chans := w.m[k]
+	if _, ok := chans[ch]; !ok {
+		return
+	}
+
+	close(ch)
+	delete(chans, ch)
+
+	if len(chans) == 0 {
+		delete(w.m, k)
+	}
+}
+
+// notifyBucket wakes every watcher of a key in bucket, whatever its filter:
+// dropping a bucket or restoring a snapshot changes keys wholesale.
+func (w *watchRegistry) notifyBucket(bucket string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for k, chans := range w.m {
+		if k.bucket != bucket {
+			continue
+		}
+
+		for ch := range chans {
+			close(ch)
+		}
+
+		delete(w.m, k)
+	}
+}
+
+// notifyPrefix wakes every watcher of a key in bucket, or in any bucket if
+// it is empty, that starts with prefix, whatever its filter.
+func (w *watchRegistry) notifyPrefix(bucket, prefix string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for k, chans := range w.m {
+		if bucket != "" && k.bucket != bucket || !strings.HasPrefix(k.key, prefix) {
+			continue
+		}
+
+		for ch := range chans {
+			close(ch)
+		}
+
+		delete(w.m, k)
+	}
+}
+
+// notify wakes the watchers of key for its change to e, or its deletion if e
+// is nil, unless a bulk operation's batch covers key: the batch then wakes
+// them in its own time. The caller must hold the write lock, or the lock of
+// a write of key.
+func (s *Store) notify(bucket, key string, e *entry) {
+	k := watchKey{bucket, key}
+
+	c := change{deleted: e == nil}
+	if e != nil {
+		c.e = *e
+	}
+
+	if b := s.batchOf(bucket, key); b != nil {
+		b.record(k, c, s.seq.load(), s.watchers.watched(k))
+		return
+	}
+
+	s.wake(k, c)
+}
+
+// wake wakes the watchers of k for c. Watchers with a filter are woken in
+// the background if it matches the change, so that values are decoded and
+// filters evaluated outside the lock.
+func (s *Store) wake(k watchKey, c change) {
+	filtered := s.watchers.notify(k)
+	if len(filtered) == 0 {
+		return
+	}
+
+	go s.wakeMatching(k, c.deleted, c.e, filtered)
+}
+
+// wakeMatching wakes the watchers among filtered whose filter matches a
+// change of k to e, or its deletion. A value that can't be decoded wakes
+// every watcher, for it to find the error when it reads the key. The
+// caller must not hold the lock.
+func (s *Store) wakeMatching(k watchKey, deleted bool, e entry, filtered map[chan struct{}]WatchFilter) {
+	var value string
+	var err error
+	decoded := false
+
+	for ch, f := range filtered {
+		if !deleted && f.needsValue() && !decoded {
+			value, err = s.decode(e)
+			decoded = true
+		}
+
+		if err != nil || f.matches(deleted, value) {
+			s.watchers.wake(k, ch)
+		}
+	}
+}
+
+// Watch is WatchMatching for every change.
+func (s *Store) Watch(bucket, key string, version uint64) (changed <-chan struct{}, cancel func()) {
+	return s.WatchMatching(bucket, key, version, WatchFilter{})
+}
+
+// WatchMatching returns a channel that is closed the next time key is
+// written or deleted in a way f matches. If the key's version already
+// differs from version, its current state counts as a change: a put of its
+// value if it exists, a delete otherwise. A missing key has version 0. The
+// caller must call cancel once it stops waiting to release the watcher.
+func (s *Store) WatchMatching(bucket, key string, version uint64, f WatchFilter) (changed <-chan struct{}, cancel func()) {
+	key = s.foldKey(key)
+	k := watchKey{bucket, key}
+
+	// The read lock, with the writer lock of the key's shard, keeps writers
+	// out between the version check and the registration, so no change can
+	// slip through unnoticed
+	wmu := s.m.writer(key)
+	s.mu.RLock()
+	wmu.Lock()
+
+	e, ok := s.lookup(bucket, key)
+	if e.meta.Version != version && f.IsZero() {
+		wmu.Unlock()
+		s.mu.RUnlock()
+
+		ch := make(chan struct{})
+		close(ch)
+
+		return ch, func() {}
+	}
+
+	ch := s.watchers.add(k, f)
+
+	wmu.Unlock()
+	s.mu.RUnlock()
+
+	if e.meta.Version != version {
+		s.wakeMatching(k, !ok, e, map[chan struct{}]WatchFilter{ch: f})
+	}
+
+	return ch, func() { s.watchers.remove(k, ch) }
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatchFilterMatches(t *testing.T) {
+	// field parses a field match, failing the test if it can't
+	field := func(s string) *FieldMatch {
+		t.Helper()
+
+		m, err := ParseFieldMatch(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &m
+	}
+	failed := "failed"
+
+	// The changes each filter is tried against: puts of JSON objects, of
+	// JSON that isn't an object, of plain text, and a delete
+	changes := []struct {
+		name    string
+		deleted bool
+		value   string
+	}{
+		{"failed job", false, `{"status":"failed","job":{"attempts":3}}`},
+		{"done job", false, `{"status":"done","job":{"attempts":1}}`},
+		{"JSON string", false, `"failed"`},
+		{"JSON array", false, `[{"status":"failed"}]`},
+		{"plain text", false, "failed"},
+		{"invalid JSON", false, `{"status":"failed"`},
+		{"delete", true, ""},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		filter WatchFilter
+		want   []bool // Whether each of changes matches
+	}{
+		{"none", WatchFilter{}, []bool{true, true, true, true, true, true, true}},
+		{"puts", WatchFilter{Changes: PutsOnly}, []bool{true, true, true, true, true, true, false}},
+		{"deletes", WatchFilter{Changes: DeletesOnly}, []bool{false, false, false, false, false, false, true}},
+		{"equals", WatchFilter{Equals: &failed}, []bool{false, false, false, false, true, false, false}},
+		{"field", WatchFilter{Field: field(`status=="failed"`)}, []bool{true, false, false, false, false, false, false}},
+		{"nested field", WatchFilter{Field: field("job.attempts==3.0")}, []bool{true, false, false, false, false, false, false}},
+		{"field of another type", WatchFilter{Field: field("status==3")}, []bool{false, false, false, false, false, false, false}},
+		{"missing field", WatchFilter{Field: field("owner==null")}, []bool{false, false, false, false, false, false, false}},
+		{"puts of a field", WatchFilter{Changes: PutsOnly, Field: field(`job.attempts==1`)}, []bool{false, true, false, false, false, false, false}},
+	} {
+		if err := tt.filter.Validate(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		for i, c := range changes {
+			if got := tt.filter.matches(c.deleted, c.value); got != tt.want[i] {
+				t.Errorf("the %s filter matching a %s: %v, want %v", tt.name, c.name, got, tt.want[i])
+			}
+		}
+	}
+
+	if err := (WatchFilter{Changes: DeletesOnly, Equals: &failed}).Validate(); err == nil {
+		t.Error("a filter of deletes of a value validated")
+	}
+
+	for _, s := range []string{"status", `=="failed"`, "status==failed", "status="} {
+		if _, err := ParseFieldMatch(s); err == nil {
+			t.Errorf("ParseFieldMatch(%q) succeeded", s)
+		}
+	}
+}
+
+func TestWatchMatchingWakesOnlyOnMatches(t *testing.T) {
+	ctx := context.Background()
+
+	s, closeLog := openLogged(t, t.TempDir(), Options{})
+	defer closeLog()
+
+	if err := s.PutCtx(ctx, "job", `{"status":"queued"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseFieldMatch(`status=="failed"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := WatchFilter{Field: &m}
+
+	// woken reports whether ch is closed within a while
+	woken := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	changed, cancel := s.WatchMatching(DefaultBucket, "job", 1, f)
+	defer cancel()
+
+	// Changes the filter doesn't match leave the watcher waiting, and
+	// registered
+	for _, value := range []string{`{"status":"running"}`, "failed", `{"status":"done"}`} {
+		if err := s.PutCtx(ctx, "job", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteCtx(ctx, "job"); err != nil {
+		t.Fatal(err)
+	}
+	if woken(changed) {
+		t.Fatal("woken by changes its filter doesn't match")
+	}
+	if !s.watchers.watched(watchKey{DefaultBucket, "job"}) {
+		t.Fatal("the watcher was dropped by changes its filter doesn't match")
+	}
+
+	if err := s.PutCtx(ctx, "job", `{"status":"failed","error":"timeout"}`); err != nil {
+		t.Fatal(err)
+	}
+	if !woken(changed) {
+		t.Fatal("not woken by a put its filter matches")
+	}
+
+	// A key already changed in a way the filter matches wakes the watcher
+	// at once, and one changed otherwise doesn't
+	_, meta, _ := s.GetWithMeta("job")
+	if changed, cancel := s.WatchMatching(DefaultBucket, "job", meta.Version-1, f); !woken(changed) {
+		t.Error("a watcher of a version before a matching put wasn't woken")
+	} else {
+		cancel()
+	}
+
+	deletes := WatchFilter{Changes: DeletesOnly}
+	changed, cancel = s.WatchMatching(DefaultBucket, "job", meta.Version-1, deletes)
+	defer cancel()
+	if woken(changed) {
+		t.Error("a watcher of deletes was woken by a put")
+	}
+	if err := s.DeleteCtx(ctx, "job"); err != nil {
+		t.Fatal(err)
+	}
+	if !woken(changed) {
+		t.Error("a watcher of deletes wasn't woken by a delete")
+	}
+}
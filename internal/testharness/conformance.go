@@ -0,0 +1,40 @@
+package testharness
+
+import (
+	"context"
+	"testing"
+)
+
+// Conformance runs the scenario against a server in the calling process
+// whose store is logged as cfg says, in a temporary data directory unless
+// cfg.DataDir is set, and fails t at the first step that fails. The tests
+// of each transaction log backend call it, so that every backend is held to
+// the same scenario.
+func Conformance(t testing.TB, name string, cfg InProcessConfig) {
+	t.Helper()
+
+	if cfg.DataDir == "" {
+		cfg.DataDir = t.TempDir()
+	}
+
+	ctx := context.Background()
+
+	p, err := StartInProcess(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := p.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	report := Run(ctx, name, p)
+	for _, s := range report.Steps {
+		t.Logf("%s: %s", s.Name, s.Duration)
+	}
+
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
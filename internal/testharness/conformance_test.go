@@ -0,0 +1,21 @@
+package testharness
+
+import (
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		Conformance(t, "file", InProcessConfig{AdminKey: "conformance"})
+	})
+
+	t.Run("none", func(t *testing.T) {
+		Conformance(t, "none", InProcessConfig{
+			AdminKey: "conformance",
+			NewLogger: func() (translog.TransactionLogger, error) {
+				return translog.NewNopTransactionLogger(), nil
+			},
+		})
+	})
+}
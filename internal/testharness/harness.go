@@ -0,0 +1,387 @@
+// Package testharness runs a scripted end-to-end scenario against a running
+// key-value store: writes over HTTP, restarts, and checks what the store
+// recovers. The same scenario runs against a built binary, for "kvstore
+// verify-install", and against a server in the calling process, so that
+// every transaction log backend can be put through the same conformance
+// run from Go code.
+package testharness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/kvclient"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Target is a server the scenario runs against.
+type Target interface {
+	// URL is the base URL of the server, which may change on Restart
+	URL() string
+
+	// AdminKey is the admin API key the server was started with
+	AdminKey() string
+
+	// Durable reports whether the server's writes survive a restart
+	Durable() bool
+
+	// Restart stops the server, letting it flush its writes, and starts
+	// it again on the same data
+	Restart(ctx context.Context) error
+
+	// Close stops the server for good
+	Close() error
+}
+
+// Report is the outcome of Run.
+type Report struct {
+	Target   string        `json:"target"`
+	Passed   bool          `json:"passed"`
+	Steps    []Step        `json:"steps"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Step is the outcome of a step of the scenario. The scenario stops at the
+// first step that fails.
+type Step struct {
+	Name     string        `json:"name"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Err returns an error naming the step that failed, or nil if every step
+// passed.
+func (r Report) Err() error {
+	for _, s := range r.Steps {
+		if s.Error != "" {
+			return fmt.Errorf("%s: step %s failed: %s", r.Target, s.Name, s.Error)
+		}
+	}
+
+	if !r.Passed {
+		return fmt.Errorf("%s: scenario didn't complete", r.Target)
+	}
+
+	return nil
+}
+
+// harnessBucket is the bucket the scenario writes besides the default one.
+const harnessBucket = "harness"
+
+// ref is a key of the scenario, in a bucket.
+type ref struct {
+	bucket, key string
+}
+
+func (r ref) String() string {
+	return fmt.Sprintf("%s/%q", r.bucket, r.key)
+}
+
+// scenario holds what the server is expected to hold as the steps run.
+type scenario struct {
+	target Target
+	client *kvclient.Client
+	want   map[ref]string
+}
+
+// Run runs the scenario against target, named name in the report:
+//
+//   - write keys and values that are awkward to carry over HTTP and to log,
+//     in two buckets, and read them back
+//   - compare-and-swap, increment and merge-patch keys, including writes
+//     that must be refused
+//   - read every key at once, and delete keys by prefix
+//   - restart, and check that exactly the expected keys were recovered, or
+//     that none were for a target that isn't durable
+//   - delete keys, restart again and check they stay deleted
+func Run(ctx context.Context, name string, target Target) Report {
+	sc := &scenario{target: target, want: make(map[ref]string)}
+	sc.connect()
+
+	report := Report{Target: name}
+	start := time.Now()
+
+	steps := []struct {
+		name string
+		fn   func(context.Context) error
+	}{
+		{"write", sc.write},
+		{"read", sc.verify},
+		{"conditional", sc.conditional},
+		{"batch", sc.batch},
+		{"restart", sc.restart},
+		{"recovery", sc.verify},
+		{"delete", sc.delete},
+		{"restart", sc.restart},
+		{"recovery", sc.verify},
+	}
+
+	report.Passed = true
+
+	for _, step := range steps {
+		stepStart := time.Now()
+		err := step.fn(ctx)
+
+		s := Step{Name: step.name, Duration: time.Since(stepStart)}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		report.Steps = append(report.Steps, s)
+
+		if err != nil {
+			report.Passed = false
+			break
+		}
+	}
+
+	report.Duration = time.Since(start)
+
+	return report
+}
+
+// connect makes a client for the target's current URL.
+func (sc *scenario) connect() {
+	sc.client = kvclient.New(sc.target.URL(), kvclient.WithAPIKey(sc.target.AdminKey()), kvclient.WithTimeout(30*time.Second))
+}
+
+// awkwardKeys are keys that are easy to mangle on the way to the log and
+// back.
+var awkwardKeys = []string{
+	"plain",
+	"slashes/in/the/key",
+	" leading and trailing spaces ",
+	"percent%2Fencoded",
+	"quotes \"'` and \\backslashes\\",
+	"ключ-日本語-🔑",
+	"query?and#fragment&amp=",
+	strings.Repeat("long-key-", 50),
+}
+
+// awkwardValues are values that are easy to mangle in the same way.
+var awkwardValues = []string{
+	"",
+	" ",
+	"multi\nline\r\nvalue\n",
+	"tab\tseparated\tvalue",
+	"unicode ☃ ключ 日本語 🔑",
+	`{"json": [1, 2.5, null, "x"], "nested": {"a": "b"}}`,
+	strings.Repeat("0123456789abcdef", 16<<10),
+	"trailing newline\n",
+}
+
+func (sc *scenario) write(ctx context.Context) error {
+	for i, key := range awkwardKeys {
+		for _, bucket := range []string{"", harnessBucket} {
+			value := awkwardValues[i%len(awkwardValues)]
+			if bucket != "" {
+				value = awkwardValues[(i+1)%len(awkwardValues)]
+			}
+
+			if err := sc.put(ctx, ref{bucket, key}, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Overwrites must win over what they replace
+	overwritten := ref{"", "overwritten"}
+	for i := range 10 {
+		if err := sc.put(ctx, overwritten, fmt.Sprintf("version %d", i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sc *scenario) put(ctx context.Context, r ref, value string) error {
+	if err := sc.client.BucketPut(ctx, r.bucket, r.key, value); err != nil {
+		return fmt.Errorf("put %s: %w", r, err)
+	}
+
+	sc.want[r] = value
+
+	return nil
+}
+
+func (sc *scenario) del(ctx context.Context, r ref) error {
+	if err := sc.client.BucketDelete(ctx, r.bucket, r.key); err != nil {
+		return fmt.Errorf("delete %s: %w", r, err)
+	}
+
+	delete(sc.want, r)
+
+	return nil
+}
+
+func (sc *scenario) conditional(ctx context.Context) error {
+	swapped := ref{"", "cas"}
+	if err := sc.put(ctx, swapped, "old"); err != nil {
+		return err
+	}
+
+	if err := sc.client.CompareAndSwap(ctx, swapped.key, "not the value", "new"); !errors.Is(err, kvclient.ErrorConflict) {
+		return fmt.Errorf("compare-and-swap of a mismatched value: got %v, expected a conflict", err)
+	}
+	if err := sc.client.CompareAndSwap(ctx, swapped.key, "old", "new"); err != nil {
+		return fmt.Errorf("compare-and-swap: %w", err)
+	}
+	sc.want[swapped] = "new"
+
+	counter := ref{harnessBucket, "counter"}
+	for _, delta := range []int64{3, 4, -2} {
+		if _, err := sc.client.BucketIncrement(ctx, counter.bucket, counter.key, delta); err != nil {
+			return fmt.Errorf("increment: %w", err)
+		}
+	}
+	sc.want[counter] = "5"
+
+	if _, err := sc.client.BucketIncrement(ctx, "", "plain", 1); !errors.Is(err, kvclient.ErrorNotNumeric) {
+		return fmt.Errorf("increment of a value that isn't a number: got %v, expected it refused", err)
+	}
+
+	doc := ref{"", "document"}
+	if err := sc.put(ctx, doc, `{"name":"a","tags":["x"],"nested":{"keep":1,"drop":2}}`); err != nil {
+		return err
+	}
+
+	patched, err := sc.client.Patch(ctx, doc.key, `{"name":"b","nested":{"drop":null}}`)
+	if err != nil {
+		return fmt.Errorf("patch: %w", err)
+	}
+	if want := `{"name":"b","nested":{"keep":1},"tags":["x"]}`; patched != want {
+		return fmt.Errorf("patch: got %s, expected %s", patched, want)
+	}
+	sc.want[doc] = patched
+
+	if _, err := sc.client.BucketPatch(ctx, "", " leading and trailing spaces ", `{"a":1}`); !errors.Is(err, kvclient.ErrorNotJSON) {
+		return fmt.Errorf("patch of a value that isn't JSON: got %v, expected it refused", err)
+	}
+
+	return nil
+}
+
+func (sc *scenario) batch(ctx context.Context) error {
+	var keys []string
+	for r := range sc.want {
+		if r.bucket == "" {
+			keys = append(keys, r.key)
+		}
+	}
+	slices.Sort(keys)
+
+	read, err := sc.client.GetMany(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("read of every key at once: %w", err)
+	}
+
+	for _, v := range read.Values {
+		if want := sc.want[ref{"", v.Key}]; !v.Found || v.Value != want {
+			return fmt.Errorf("read of every key at once: %s: got %q (found %t), expected %q", ref{"", v.Key}, abbreviate(v.Value), v.Found, abbreviate(want))
+		}
+	}
+
+	for i := range 20 {
+		if err := sc.put(ctx, ref{harnessBucket, fmt.Sprintf("batch/%02d", i)}, fmt.Sprint(i)); err != nil {
+			return err
+		}
+	}
+
+	n, err := sc.client.BucketDeleteByPrefix(ctx, harnessBucket, "batch/")
+	if err != nil {
+		return fmt.Errorf("delete by prefix: %w", err)
+	}
+	if n != 20 {
+		return fmt.Errorf("delete by prefix: deleted %d keys, expected 20", n)
+	}
+
+	for r := range sc.want {
+		if r.bucket == harnessBucket && strings.HasPrefix(r.key, "batch/") {
+			delete(sc.want, r)
+		}
+	}
+
+	return sc.verify(ctx)
+}
+
+func (sc *scenario) delete(ctx context.Context) error {
+	refs := slices.SortedFunc(maps.Keys(sc.want), func(a, b ref) int {
+		return strings.Compare(a.String(), b.String())
+	})
+
+	for i, r := range refs {
+		if i%2 == 0 {
+			if err := sc.del(ctx, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Deleting a missing key isn't an error
+	return sc.del(ctx, ref{"", "never written"})
+}
+
+func (sc *scenario) restart(ctx context.Context) error {
+	if err := sc.target.Restart(ctx); err != nil {
+		return err
+	}
+
+	sc.connect()
+
+	// What a target that isn't durable held is gone
+	if !sc.target.Durable() {
+		clear(sc.want)
+	}
+
+	return nil
+}
+
+// verify checks that the server holds exactly the expected keys and values.
+func (sc *scenario) verify(ctx context.Context) error {
+	for r, want := range sc.want {
+		got, err := sc.client.BucketGet(ctx, r.bucket, r.key)
+		if err != nil {
+			return fmt.Errorf("get %s: %w", r, err)
+		}
+		if got != want {
+			return fmt.Errorf("get %s: got %q, expected %q", r, abbreviate(got), abbreviate(want))
+		}
+	}
+
+	buckets, err := sc.client.Buckets(ctx)
+	if err != nil {
+		return fmt.Errorf("list buckets: %w", err)
+	}
+
+	for _, bucket := range buckets {
+		name := bucket
+		if name == "default" {
+			name = ""
+		}
+
+		keys, err := sc.client.BucketKeys(ctx, name, "")
+		if err != nil {
+			return fmt.Errorf("list keys of %s: %w", bucket, err)
+		}
+
+		for _, key := range keys {
+			if _, ok := sc.want[ref{name, key}]; !ok {
+				return fmt.Errorf("%s exists, but was never written or was deleted", ref{name, key})
+			}
+		}
+	}
+
+	return nil
+}
+
+// abbreviate shortens long values for error messages.
+func abbreviate(s string) string {
+	if len(s) <= 64 {
+		return s
+	}
+
+	return fmt.Sprintf("%s... (%d bytes)", s[:64], len(s))
+}
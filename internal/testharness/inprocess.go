@@ -0,0 +1,113 @@
+package testharness
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http/httptest"
+	"path/filepath"
+)
+
+// InProcessConfig describes a server for StartInProcess to run.
+type InProcessConfig struct {
+	DataDir  string // Data directory of the store; must exist
+	AdminKey string
+
+	// NewLogger opens the transaction log the store is loaded from and
+	// writes to, afresh on every start; the file log in DataDir if nil.
+	// Durable tells whether what it logs survives a restart
+	NewLogger func() (translog.TransactionLogger, error)
+	Durable   bool
+
+	Options store.Options
+}
+
+// InProcess is a server running in the calling process, on a port of the
+// loopback interface picked at random, as in a Go test. It serves the same
+// API as the binary, though without the binary's flags and startup.
+type InProcess struct {
+	cfg    InProcessConfig
+	logger translog.TransactionLogger
+	api    *api.Server
+	http   *httptest.Server
+}
+
+// StartInProcess loads the store from its log and starts serving it.
+func StartInProcess(ctx context.Context, cfg InProcessConfig) (*InProcess, error) {
+	if cfg.NewLogger == nil {
+		path := filepath.Join(cfg.DataDir, translog.LogFileName)
+		cfg.NewLogger = func() (translog.TransactionLogger, error) {
+			return translog.NewFileTransactionLogger(path, nil)
+		}
+		cfg.Durable = true
+	}
+
+	p := &InProcess{cfg: cfg}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *InProcess) URL() string      { return p.http.URL }
+func (p *InProcess) AdminKey() string { return p.cfg.AdminKey }
+func (p *InProcess) Durable() bool    { return p.cfg.Durable }
+
+// Restart stops serving, closes the log once everything written is flushed,
+// and loads a new store from it.
+func (p *InProcess) Restart(ctx context.Context) error {
+	if err := p.stop(ctx); err != nil {
+		return err
+	}
+
+	return p.start()
+}
+
+// Close stops serving and closes the log.
+func (p *InProcess) Close() error {
+	return p.stop(context.Background())
+}
+
+func (p *InProcess) start() error {
+	logger, err := p.cfg.NewLogger()
+	if err != nil {
+		return fmt.Errorf("failed to create event logger: %w", err)
+	}
+
+	st := store.New(logger, p.cfg.Options)
+
+	if err := st.Load(p.cfg.DataDir, logger); err != nil {
+		logger.Close(context.Background())
+		return fmt.Errorf("failed to load the store: %w", err)
+	}
+
+	if err := logger.Run(); err != nil {
+		logger.Close(context.Background())
+		return fmt.Errorf("failed to start the transaction log: %w", err)
+	}
+
+	p.logger = logger
+	p.api = api.NewServer(st, api.Config{AdminKey: p.cfg.AdminKey, DataDir: p.cfg.DataDir})
+	p.http = httptest.NewServer(api.NewRouter(p.api))
+
+	return nil
+}
+
+func (p *InProcess) stop(ctx context.Context) error {
+	if p.logger == nil {
+		return nil
+	}
+
+	p.api.CloseStreams()
+	p.http.Close()
+
+	err := p.logger.Flush(ctx)
+	err = cmp.Or(err, p.logger.Close(ctx))
+	p.logger = nil
+
+	return err
+}
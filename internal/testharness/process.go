@@ -0,0 +1,193 @@
+package testharness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readyTimeout bounds how long a server may take to start serving.
+const readyTimeout = time.Minute
+
+// stopTimeout bounds how long a server may take to shut down on SIGTERM
+// before it is killed.
+const stopTimeout = 30 * time.Second
+
+// ProcessConfig describes a kvstore binary for StartProcess to run.
+type ProcessConfig struct {
+	Binary   string    // Path of the kvstore binary
+	DataDir  string    // Passed as -data-dir; must exist
+	AdminKey string    // Passed as -admin-key
+	Args     []string  // Further flags, such as -log-backend
+	Env      []string  // Further environment variables, as KEY=value
+	Durable  bool      // Whether the flags keep writes across restarts
+	Output   io.Writer // Receives the server's stdout and stderr; discarded if nil
+}
+
+// Process is a kvstore server running as a child process, on a port of the
+// loopback interface picked at random.
+type Process struct {
+	cfg  ProcessConfig
+	url  string
+	cmd  *exec.Cmd
+	done chan error // Receives the process's exit status
+}
+
+// StartProcess starts the binary and waits until it's ready to serve.
+// Environment variables that would configure it, KV_*, are left out, so
+// that only cfg does.
+func StartProcess(ctx context.Context, cfg ProcessConfig) (*Process, error) {
+	p := &Process{cfg: cfg}
+	if p.cfg.Output == nil {
+		p.cfg.Output = io.Discard
+	}
+
+	if err := p.start(ctx); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Process) URL() string      { return p.url }
+func (p *Process) AdminKey() string { return p.cfg.AdminKey }
+func (p *Process) Durable() bool    { return p.cfg.Durable }
+
+// Restart stops the server with SIGTERM, which has it flush its log, and
+// starts it again on another port.
+func (p *Process) Restart(ctx context.Context) error {
+	if err := p.stop(); err != nil {
+		return err
+	}
+
+	return p.start(ctx)
+}
+
+// Signal sends sig to the server.
+func (p *Process) Signal(sig os.Signal) error {
+	if p.cmd == nil {
+		return errors.New("server not running")
+	}
+
+	return p.cmd.Process.Signal(sig)
+}
+
+// Close stops the server with SIGTERM.
+func (p *Process) Close() error {
+	return p.stop()
+}
+
+func (p *Process) start(ctx context.Context) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"-listen", addr, "-data-dir", p.cfg.DataDir, "-admin-key", p.cfg.AdminKey}, p.cfg.Args...)
+
+	cmd := exec.Command(p.cfg.Binary, args...)
+	cmd.Stdout = p.cfg.Output
+	cmd.Stderr = p.cfg.Output
+
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "KV_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, p.cfg.Env...)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", p.cfg.Binary, err)
+	}
+
+	p.cmd = cmd
+	p.url = "http://" + addr
+	p.done = make(chan error, 1)
+
+	go func() { p.done <- cmd.Wait() }()
+
+	if err := p.waitReady(ctx); err != nil {
+		p.cmd.Process.Kill()
+		<-p.done
+		p.cmd = nil
+		return err
+	}
+
+	return nil
+}
+
+// waitReady polls /readyz until it answers 200.
+func (p *Process) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"/readyz", nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case err := <-p.done:
+			p.done <- err // For start to receive
+			return fmt.Errorf("server exited before it was ready: %v", err)
+		case <-ctx.Done():
+			return fmt.Errorf("server wasn't ready at %s: %w", p.url, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop sends SIGTERM and waits for the server to exit, killing it after
+// stopTimeout. A server that had to be killed, or exited with an error,
+// didn't shut down cleanly, which is an error.
+func (p *Process) stop() error {
+	if p.cmd == nil {
+		return nil
+	}
+
+	cmd := p.cmd
+	p.cmd = nil
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+
+	select {
+	case err := <-p.done:
+		if err != nil {
+			return fmt.Errorf("server didn't shut down cleanly: %w", err)
+		}
+		return nil
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+		<-p.done
+		return fmt.Errorf("server didn't shut down within %s, and was killed", stopTimeout)
+	}
+}
+
+// freeAddr returns an address of the loopback interface with a port that
+// was free a moment ago.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+
+	return l.Addr().String(), nil
+}
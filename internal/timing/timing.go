@@ -0,0 +1,159 @@
+// Package timing measures the phases of store operations and transaction log
+// writes, records them in latency histograms and logs the operations with a
+// slow phase.
+package timing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// enabled is set once Setup turns on the histograms or the slow-operation
+// log. Until then Begin doesn't read the clock, so that timing costs an
+// atomic load per operation.
+var enabled atomic.Bool
+
+// Settings written by Setup before it sets enabled, and only read after
+// enabled has been seen set
+var (
+	histograms    bool
+	slowThreshold time.Duration
+	hashKeys      bool
+)
+
+var phaseSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "kv_operation_phase_seconds",
+	Help:    "Time spent in each phase of store operations and transaction log writes.",
+	Buckets: prometheus.ExponentialBuckets(1e-6, 4, 12), // 1µs to about 4s
+}, []string{"op", "phase"})
+
+// Options configures timing.
+type Options struct {
+	Histograms    bool          // Record every phase in kv_operation_phase_seconds
+	SlowThreshold time.Duration // Log operations with a phase at least this long; 0 disables the log
+	HashKeys      bool          // Log a hash of the key of slow operations instead of the key
+}
+
+// Setup turns timing on as configured. It must be called before the store
+// and the logger are in use, and at most once.
+func Setup(opts Options) {
+	if !opts.Histograms && opts.SlowThreshold <= 0 {
+		return
+	}
+
+	histograms = opts.Histograms
+	slowThreshold = opts.SlowThreshold
+	hashKeys = opts.HashKeys
+
+	enabled.Store(true)
+}
+
+// Collectors returns the histograms, for the metrics registry.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{phaseSeconds}
+}
+
+// maxPhases bounds the phases an Op records; there are no more than a put
+// has.
+const maxPhases = 4
+
+type phase struct {
+	name string
+	d    time.Duration
+}
+
+// Op times the phases of an operation on a key. The zero Op, which Begin
+// returns while timing is off, and a nil *Op ignore every call.
+type Op struct {
+	name, bucket, key string
+	start, mark       time.Time
+	phases            [maxPhases]phase
+	n                 int
+}
+
+// Begin starts timing the operation name on key in bucket. Its first phase
+// starts now.
+func Begin(name, bucket, key string) Op {
+	if !enabled.Load() {
+		return Op{}
+	}
+
+	now := time.Now()
+
+	return Op{name: name, bucket: bucket, key: key, start: now, mark: now}
+}
+
+// Phase ends the current phase, naming it, and starts the next one.
+func (o *Op) Phase(name string) {
+	if o == nil || o.start.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	d := now.Sub(o.mark)
+	o.mark = now
+
+	if o.n < maxPhases {
+		o.phases[o.n] = phase{name, d}
+		o.n++
+	}
+
+	if histograms {
+		phaseSeconds.WithLabelValues(o.name, name).Observe(d.Seconds())
+	}
+}
+
+// End ends the operation, and logs it if one of its phases was slow. It
+// should be called once the operation has released its locks, since logging
+// may block.
+func (o *Op) End() {
+	if o == nil || o.start.IsZero() || slowThreshold <= 0 {
+		return
+	}
+
+	slow := false
+	for _, p := range o.phases[:o.n] {
+		slow = slow || p.d >= slowThreshold
+	}
+
+	if !slow {
+		return
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "SLOW op=%s", o.name)
+	if o.key != "" {
+		fmt.Fprintf(&b, " bucket=%s key=%s", o.bucket, logKey(o.key))
+	}
+	fmt.Fprintf(&b, " total=%s", o.mark.Sub(o.start))
+	for _, p := range o.phases[:o.n] {
+		fmt.Fprintf(&b, " %s=%s", p.name, p.d)
+	}
+
+	log.Println(b.String())
+}
+
+// logKey returns key as slow operations log it: the first 8 bytes of its
+// SHA-256 in hex if keys are hashed, quoted otherwise.
+func logKey(key string) string {
+	if !hashKeys {
+		return fmt.Sprintf("%q", key)
+	}
+
+	return HashKey(key)
+}
+
+// HashKey returns the first 8 bytes of the SHA-256 of key in hex, for logs
+// that mustn't hold keys.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,144 @@
+package timing
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enable turns timing on as Setup does, and back off at the end of the
+// test.
+func enable(t testing.TB, opts Options) {
+	t.Helper()
+
+	Setup(opts)
+	t.Cleanup(func() {
+		enabled.Store(false)
+		histograms, slowThreshold, hashKeys = false, 0, false
+	})
+}
+
+// observations returns the number of times phase of op was recorded.
+func observations(t *testing.T, op, phase string) uint64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := phaseSeconds.WithLabelValues(op, phase).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetHistogram().GetSampleCount()
+}
+
+// put times an operation with the phases of a put.
+func put(key string) {
+	t := Begin("put", "default", key)
+	t.Phase("lock_wait")
+	t.Phase("lookup")
+	t.Phase("log_enqueue")
+	t.Phase("map_update")
+	t.End()
+}
+
+func TestHistogramsCountEveryPhase(t *testing.T) {
+	phases := []string{"lock_wait", "lookup", "log_enqueue", "map_update"}
+
+	before := make(map[string]uint64)
+	for _, phase := range phases {
+		before[phase] = observations(t, "put", phase)
+	}
+
+	// While off, nothing is recorded
+	for range 10 {
+		put("k")
+	}
+	for _, phase := range phases {
+		if n := observations(t, "put", phase) - before[phase]; n != 0 {
+			t.Errorf("%s recorded %d times while timing was off", phase, n)
+		}
+	}
+
+	enable(t, Options{Histograms: true})
+
+	for range 100 {
+		put("k")
+	}
+	for _, phase := range phases {
+		if n := observations(t, "put", phase) - before[phase]; n != 100 {
+			t.Errorf("%s recorded %d times for 100 puts", phase, n)
+		}
+	}
+
+	// A nil Op is ignored
+	var op *Op
+	op.Phase("lookup")
+	op.End()
+}
+
+func TestSlowOperationsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	// slow times an operation on key with a phase of d
+	slow := func(key string, d time.Duration) string {
+		buf.Reset()
+
+		t := Begin("put", "default", key)
+		t.Phase("lock_wait")
+		time.Sleep(d)
+		t.Phase("log_enqueue")
+		t.End()
+
+		return buf.String()
+	}
+
+	// Nothing is logged while timing is off
+	if out := slow("k", 20*time.Millisecond); out != "" {
+		t.Errorf("logged while timing was off: %s", out)
+	}
+
+	enable(t, Options{SlowThreshold: 10 * time.Millisecond})
+
+	if out := slow("k", 0); out != "" {
+		t.Errorf("logged an operation faster than the threshold: %s", out)
+	}
+
+	out := slow("secret", 20*time.Millisecond)
+	for _, want := range []string{"SLOW op=put", `bucket=default key="secret"`, "lock_wait=", "log_enqueue="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the slow operation's log line doesn't have %s: %s", want, out)
+		}
+	}
+
+	hashKeys = true
+	out = slow("secret", 20*time.Millisecond)
+	if strings.Contains(out, "secret") || !strings.Contains(out, "key="+HashKey("secret")) {
+		t.Errorf("the slow operation's log line doesn't hash its key: %s", out)
+	}
+}
+
+// BenchmarkOp compares the cost of timing a put while timing is off, which
+// is what the store pays by default, against recording its histograms.
+func BenchmarkOp(b *testing.B) {
+	b.Run("off", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			put("k")
+		}
+	})
+
+	b.Run("histograms", func(b *testing.B) {
+		enable(b, Options{Histograms: true})
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			put("k")
+		}
+	})
+}
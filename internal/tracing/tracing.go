@@ -0,0 +1,122 @@
+// Package tracing configures OpenTelemetry tracing and starts the spans for
+// store operations and transaction log writes.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"os"
+	"sync/atomic"
+)
+
+// instrumentationName names the tracer of the spans for store operations
+// and transaction log writes.
+const instrumentationName = "github.com/sheritzs/key-value-store"
+
+// tracer creates the spans for store operations and transaction log writes,
+// from the provider Install was last given. It is nil until then.
+var tracer atomic.Pointer[trace.Tracer]
+
+// propagator carries the W3C trace context and baggage of requests.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// enabled is set while a provider is installed. Until then Start skips the
+// tracer entirely, since building span attributes allocates on every call.
+var enabled atomic.Bool
+
+// noopSpan is returned by Start while tracing is disabled.
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The exporter is chosen by OTEL_TRACES_EXPORTER: "otlp" exports
+// over OTLP/HTTP as configured by the standard OTEL_EXPORTER_OTLP_*
+// variables, "console" prints spans to stdout, and "none" or unset keeps the
+// no-op provider. The returned function flushes pending spans.
+func Setup(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exporter sdktrace.SpanExporter
+
+	switch name := os.Getenv("OTEL_TRACES_EXPORTER"); name {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q", name)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default
+	// service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "kvstore")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res))
+
+	Install(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Install makes tp the global tracer provider, with the W3C propagators,
+// which the spans Start starts
+// and the request spans of the API come from, as Setup does with the
+// provider of its exporter. It is for embedders and tests that configure
+// their own. Installing nil turns tracing back off.
+func Install(tp trace.TracerProvider) {
+	if tp == nil {
+		enabled.Store(false)
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		return
+	}
+
+	t := tp.Tracer(instrumentationName)
+	tracer.Store(&t)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	enabled.Store(true)
+}
+
+// Start starts a span for an operation on key.
+func Start(ctx context.Context, name, bucket, key string) (context.Context, trace.Span) {
+	if !enabled.Load() {
+		return ctx, noopSpan
+	}
+
+	return (*tracer.Load()).Start(ctx, name, trace.WithAttributes(
+		attribute.String("kv.bucket", bucket),
+		attribute.String("kv.key", key)))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,231 @@
+package translog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrorCompacted is wrapped by the CompactedError of a read of events a
+// compaction removed from the log.
+var ErrorCompacted = errors.New("events compacted")
+
+// CompactedError is returned for a read of the events after a sequence when
+// some of them were compacted into a snapshot, so that only a full resync
+// can catch up.
+type CompactedError struct {
+	After    uint64 // Sequence the read asked for the events after
+	Earliest uint64 // First sequence the log can still hold
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("%v: the events after %d are gone, the log starts at %d", ErrorCompacted, e.After, e.Earliest)
+}
+
+func (e *CompactedError) Unwrap() error {
+	return ErrorCompacted
+}
+
+// ChangeReader is implemented by loggers that can read their events from
+// any sequence on, a page at a time, for clients catching up with the
+// changes without following the log.
+type ChangeReader interface {
+	// ReadChanges returns the first limit events logged after sequence
+	// after, in order, or fewer if the log holds no more yet. It fails
+	// with a CompactedError if some of them were compacted.
+	ReadChanges(ctx context.Context, after uint64, limit int) ([]Event, error)
+}
+
+// indexInterval is the fewest bytes of a log file between two entries of
+// its sparse index.
+const indexInterval = 64 << 10
+
+// indexEntry is where the event of a sequence starts in a log file.
+type indexEntry struct {
+	seq    uint64
+	offset int64
+}
+
+// seqIndex maps the sequences of a file log to offsets in its files,
+// sparsely: each file has an entry for its first event, then one for the
+// first event at least indexInterval bytes past the previous. A read
+// seeks to the last entry before the events it wants and scans from
+// there. It is kept as the log is replayed and written, and follows the
+// files it indexes when they are rotated.
+type seqIndex struct {
+	mu    sync.Mutex              // Also held across a rotation's rename, so readers see the files of the log either before it or after
+	files map[string][]indexEntry // Entries by file name, in the order of their sequences
+}
+
+func newSeqIndex() *seqIndex {
+	return &seqIndex{files: make(map[string][]indexEntry)}
+}
+
+// note records that the event of sequence seq starts at offset in the file
+// name, if the file's entries are far enough behind.
+func (x *seqIndex) note(name string, seq uint64, offset int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entries := x.files[name]
+	if n := len(entries); n > 0 && (offset < entries[n-1].offset+indexInterval || seq <= entries[n-1].seq) {
+		return
+	}
+
+	x.files[name] = append(entries, indexEntry{seq, offset})
+}
+
+// move gives the entries of the file from to the file to, which it was
+// renamed to. The caller must hold x.mu.
+func (x *seqIndex) move(from, to string) {
+	x.files[to] = x.files[from]
+	delete(x.files, from)
+}
+
+// seek returns the offset in the file name to read the events after
+// sequence after from: that of the last entry of an earlier event, or the
+// start of the file. The caller must hold x.mu.
+func (x *seqIndex) seek(name string, after uint64) int64 {
+	entries := x.files[name]
+
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].seq > after })
+	if i == 0 {
+		return 0
+	}
+
+	return entries[i-1].offset
+}
+
+// ReadChanges implements ChangeReader. The events compacted are those up to
+// where the log's MetaFileName says it starts. Rotated segments ending
+// before after are skipped, and each file is read from its sparse index's
+// entry before after, so a page costs about the same wherever it starts.
+// Damaged records are skipped, as replay reported them already.
+func (l *FileTransactionLogger) ReadChanges(ctx context.Context, after uint64, limit int) ([]Event, error) {
+	meta, err := ReadLogMeta(l.path)
+	if err != nil {
+		return nil, err
+	}
+	if after < meta.After {
+		return nil, &CompactedError{After: after, Earliest: meta.After + 1}
+	}
+
+	files, offsets, err := l.openChanges(after)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var events []Event
+
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if events, err = readChangesFrom(f, offsets[i], after, limit, events); err != nil {
+			return nil, err
+		}
+		if len(events) == limit {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// openChanges opens the files of the log that may hold events after
+// sequence after, oldest first, and returns them with the offsets to read
+// them from. They are opened under the index's lock, so a rotation can't
+// move the log between the listing and the opening; the files opened are
+// read as they were then, rotated or not.
+func (l *FileTransactionLogger) openChanges(after uint64) ([]*os.File, []int64, error) {
+	l.index.mu.Lock()
+	defer l.index.mu.Unlock()
+
+	names, err := SegmentFiles(l.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []*os.File
+	var offsets []int64
+
+	for _, name := range names {
+		if last, ok := segmentSequence(l.path, name); ok && last <= after {
+			continue
+		}
+
+		f, err := os.Open(name)
+		if errors.Is(err, fs.ErrNotExist) && name == l.path {
+			continue // Rotated, and the new log isn't created yet
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("cannot open transaction log file: %w", err)
+		}
+
+		files = append(files, f)
+		offsets = append(offsets, l.index.seek(name, after))
+	}
+
+	return files, offsets, nil
+}
+
+// readChangesFrom appends to events those after sequence after in f, read
+// from offset, until it holds limit of them. A last line not yet
+// complete is left for a later read.
+func readChangesFrom(f *os.File, offset int64, after uint64, limit int, events []Event) ([]Event, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return events, err
+	}
+
+	reader := bufio.NewReader(f)
+
+	for len(events) < limit {
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return events, fmt.Errorf("%s: transaction log read failure: %w", f.Name(), err)
+		}
+
+		e, err := parseEvent(strings.TrimSuffix(line, "\n"))
+		if errors.Is(err, ErrorNewerVersion) {
+			return events, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		if err != nil || e.Sequence <= after {
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// ReadChanges implements ChangeReader. The table is never compacted, so it
+// never fails with a CompactedError.
+func (l *PostgresTransactionLogger) ReadChanges(ctx context.Context, after uint64, limit int) ([]Event, error) {
+	query := fmt.Sprintf(`SELECT %s
+			  FROM %s
+			  WHERE sequence > $1
+			  ORDER BY sequence
+			  LIMIT %d`, eventColumns, l.table, limit)
+
+	return l.readEventsAfter(ctx, query, after)
+}
@@ -0,0 +1,178 @@
+package translog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readAllChanges reads every event of l after sequence after, limit at a
+// time, returning their sequences.
+func readAllChanges(t *testing.T, l TransactionLogger, after uint64, limit int) []uint64 {
+	t.Helper()
+
+	var seqs []uint64
+	for {
+		events, err := l.(ChangeReader).ReadChanges(context.Background(), after, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) > limit {
+			t.Fatalf("a page of %d events, limit %d", len(events), limit)
+		}
+
+		seqs = append(seqs, sequences(events)...)
+		if len(events) < limit {
+			return seqs
+		}
+		after = events[len(events)-1].Sequence
+	}
+}
+
+func TestReadChangesAcrossRotations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), LogFileName)
+
+	l, _ := openFileLog(t, path)
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values of 1KB give each file several index entries
+	const perFile = 200
+	value := strings.Repeat("v", 1<<10)
+
+	for file := range 3 {
+		for i := range perFile {
+			if err := l.WritePutCtx(ctx, fmt.Sprintf("k%d-%d", file, i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if file < 2 {
+			if err := l.(Rotator).Rotate(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if files, err := SegmentFiles(path); err != nil || len(files) != 3 {
+		t.Fatalf("log files %v, %v, want two segments and the log", files, err)
+	}
+
+	// check reads the log a page at a time from several sequences, each
+	// page ending, and the next starting, wherever the limit falls
+	check := func(t *testing.T, l TransactionLogger, when string) {
+		t.Helper()
+
+		index := l.(*FileTransactionLogger).index
+		files, _ := SegmentFiles(path)
+		for _, name := range files {
+			if n := len(index.files[name]); n < 2 {
+				t.Errorf("%s: %s has %d index entries, want several", when, filepath.Base(name), n)
+			}
+		}
+
+		for _, after := range []uint64{0, 1, 150, perFile - 1, perFile, 2*perFile + 7, 3*perFile - 1} {
+			for _, limit := range []int{1, 37, 500} {
+				seqs := readAllChanges(t, l, after, limit)
+
+				want := 3*perFile - int(after)
+				if len(seqs) != want || (want > 0 && (seqs[0] != after+1 || seqs[len(seqs)-1] != 3*perFile)) {
+					t.Errorf("%s: after %d, %d at a time: %d events, want %d from %d", when, after, limit, len(seqs), want, after+1)
+					continue
+				}
+				for i := 1; i < len(seqs); i++ {
+					if seqs[i] != seqs[i-1]+1 {
+						t.Errorf("%s: after %d, %d at a time: %d follows %d", when, after, limit, seqs[i], seqs[i-1])
+						break
+					}
+				}
+			}
+		}
+
+		if seqs := readAllChanges(t, l, 3*perFile, 10); len(seqs) != 0 {
+			t.Errorf("%s: after the last event: %v", when, seqs)
+		}
+	}
+
+	check(t, l, "as written")
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay rebuilds the index of every file
+	l, replayed := openFileLog(t, path)
+	defer l.Close(ctx)
+	if len(replayed) != 3*perFile {
+		t.Fatalf("replayed %d events, want %d", len(replayed), 3*perFile)
+	}
+
+	check(t, l, "after a reopen")
+}
+
+func TestReadChangesCompacted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), LogFileName)
+
+	if err := WriteLogMeta(path, LogMeta{After: 50}); err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, path, 51, 52, 53)
+
+	l, _ := openFileLog(t, path)
+	defer l.Close(ctx)
+
+	for _, after := range []uint64{0, 49} {
+		_, err := l.(ChangeReader).ReadChanges(ctx, after, 10)
+
+		var compacted *CompactedError
+		if !errors.As(err, &compacted) || !errors.Is(err, ErrorCompacted) || compacted.After != after || compacted.Earliest != 51 {
+			t.Errorf("reading after %d: %v, want the log to start at 51", after, err)
+		}
+	}
+
+	// The snapshot's own sequence is the last compacted, so the events
+	// after it are all there
+	if seqs := readAllChanges(t, l, 50, 10); fmt.Sprint(seqs) != "[51 52 53]" {
+		t.Errorf("after the snapshot: %v, want [51 52 53]", seqs)
+	}
+}
+
+func TestReadChangesLeavesAPartialLine(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), LogFileName)
+	writeLines(t, path, 1, 2, 3)
+
+	l, _ := openFileLog(t, path)
+	defer l.Close(ctx)
+
+	// A line being written shows up once it's complete
+	line := string(appendEvent(nil, Event{Sequence: 4, EventType: EventPut, Bucket: DefaultBucket, Key: "k4", Value: "v"}))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(line[:len(line)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if seqs := readAllChanges(t, l, 0, 10); fmt.Sprint(seqs) != "[1 2 3]" {
+		t.Errorf("with half a line: %v, want [1 2 3]", seqs)
+	}
+
+	if _, err := f.WriteString(line[len(line)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	if seqs := readAllChanges(t, l, 0, 10); fmt.Sprint(seqs) != "[1 2 3 4]" {
+		t.Errorf("with the line complete: %v, want [1 2 3 4]", seqs)
+	}
+}
@@ -0,0 +1,46 @@
+package translog
+
+import "fmt"
+
+// Damage describes a record of a log that replay couldn't use.
+type Damage struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Problem string `json:"problem"`
+	Torn    bool   `json:"torn,omitempty"` // A last line cut short by a crash, which is expected
+}
+
+func (d Damage) String() string {
+	return fmt.Sprintf("%s line %d: %s", d.File, d.Line, d.Problem)
+}
+
+// DamageReporter is implemented by loggers that can tell which of their
+// records are damaged, and skip them.
+type DamageReporter interface {
+	// ReportDamage has ReadEvents call report for each damaged record it
+	// finds. With skip set, a record that can't be parsed, or whose
+	// sequence doesn't follow the one before, is left out and reading goes
+	// on; otherwise the first one still fails the read, after being
+	// reported. A torn last line is always discarded, and reported too.
+	ReportDamage(report func(Damage), skip bool)
+}
+
+// ReportDamage implements DamageReporter. It must be called before
+// ReadEvents.
+func (l *FileTransactionLogger) ReportDamage(report func(Damage), skip bool) {
+	l.damage, l.skipDamage = report, skip
+}
+
+// reportDamage passes d to the reporter, if there is one, and returns the
+// error that fails the read unless damaged records are skipped.
+func (l *FileTransactionLogger) reportDamage(d Damage) error {
+	if l.damage != nil {
+		l.damage(d)
+	}
+
+	if l.skipDamage {
+		return nil
+	}
+
+	return fmt.Errorf("damaged transaction log record: %s", d)
+}
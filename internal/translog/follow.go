@@ -0,0 +1,263 @@
+package translog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// followPollInterval is how often a follow checks the log for new events
+// once it has caught up.
+const followPollInterval = 200 * time.Millisecond
+
+// Source is implemented by loggers whose events can be streamed to a
+// replication follower.
+type Source interface {
+	// Follow sends every event logged after sequence after, first those
+	// already in the log and then new ones as they are written, until ctx
+	// is done or reading fails.
+	Follow(ctx context.Context, after uint64) (<-chan Event, <-chan error)
+}
+
+// Follow tails the log file through handles of its own, so it doesn't
+// disturb the logger's writes, as a FileTail does.
+func (l *FileTransactionLogger) Follow(ctx context.Context, after uint64) (<-chan Event, <-chan error) {
+	return NewFileTail(l.path).Follow(ctx, after)
+}
+
+// FileTail reads a file log without ever writing to it, so it can follow
+// the log of a logger in another process.
+type FileTail struct {
+	path string
+
+	read atomic.Int64 // Bytes of the file being tailed read up to its last complete line
+	size atomic.Int64 // Size of the file being tailed when last checked
+}
+
+// NewFileTail returns a tail of the file log at path.
+func NewFileTail(path string) *FileTail {
+	return &FileTail{path: path}
+}
+
+// Behind returns the bytes of the log file being tailed that are yet to be
+// read, as of its last check for new events. Rotated segments being caught
+// up on aren't counted.
+func (t *FileTail) Behind() int64 {
+	return max(0, t.size.Load()-t.read.Load())
+}
+
+// Follow implements Source. Rotated segments are read first, skipping those
+// that end before after, and a rotation of the file being tailed is
+// followed to the new file once the old one is read to its end.
+func (t *FileTail) Follow(ctx context.Context, after uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		for {
+			name, err := nextSegment(t.path, after)
+			if err != nil {
+				outError <- err
+				return
+			}
+
+			if after, err = t.followFile(ctx, name, after, outEvent); err != nil {
+				outError <- err
+				return
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// followFile sends the events after sequence after in the file name, and
+// returns the sequence of the last one sent. It returns at the end of a
+// rotated segment, or once the log it tails has been rotated and fully read,
+// or when ctx is done.
+func (t *FileTail) followFile(ctx context.Context, name string, after uint64, outEvent chan<- Event) (uint64, error) {
+	active := name == t.path
+
+	file, err := os.Open(name)
+	if active && errors.Is(err, fs.ErrNotExist) {
+		// Rotated, and the new log isn't created yet
+		select {
+		case <-time.After(followPollInterval):
+		case <-ctx.Done():
+		}
+		return after, nil
+	}
+	if err != nil {
+		return after, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer file.Close()
+
+	t.read.Store(0)
+	t.size.Store(0)
+	if info, err := file.Stat(); err == nil && active {
+		t.size.Store(info.Size())
+	}
+
+	rotated := false
+
+	reader := bufio.NewReader(file)
+	var line string
+
+	for {
+		chunk, err := reader.ReadString('\n')
+		line += chunk
+
+		if errors.Is(err, io.EOF) {
+			if !active || rotated {
+				return after, nil
+			}
+
+			if info, err := file.Stat(); err == nil {
+				t.size.Store(info.Size())
+			}
+
+			// The file may have been rotated after the last read, so
+			// it's read to its end once more before moving on
+			if rotated, err = t.wasRotated(file); err != nil {
+				return after, err
+			}
+			if rotated {
+				continue
+			}
+
+			// Caught up, or in the middle of a line still being
+			// written; keep what was read and wait for more
+			select {
+			case <-time.After(followPollInterval):
+				continue
+			case <-ctx.Done():
+				return after, nil
+			}
+		}
+		if err != nil {
+			return after, fmt.Errorf("transaction log read failure: %w", err)
+		}
+
+		t.read.Add(int64(len(line)))
+
+		e, err := parseEvent(strings.TrimSuffix(line, "\n"))
+		line = ""
+		if err != nil {
+			return after, fmt.Errorf("input parse error: %w", err)
+		}
+
+		if e.Sequence <= after {
+			continue
+		}
+
+		select {
+		case outEvent <- e:
+			after = e.Sequence
+		case <-ctx.Done():
+			return after, nil
+		}
+	}
+}
+
+// wasRotated reports whether file is no longer the log, having been renamed
+// to a segment.
+func (t *FileTail) wasRotated(file *os.File) (bool, error) {
+	current, err := os.Stat(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil // Between the rename and the new log's creation
+	}
+	if err != nil {
+		return false, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(info, current), nil
+}
+
+// Follow polls the log's table for rows past the last one sent.
+func (l *PostgresTransactionLogger) Follow(ctx context.Context, after uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		query := fmt.Sprintf(`SELECT %s
+				  FROM %s
+				  WHERE sequence > $1
+				  ORDER BY sequence`, eventColumns, l.table)
+
+		for {
+			events, err := l.readEventsAfter(ctx, query, after)
+			if err != nil {
+				if ctx.Err() == nil {
+					outError <- err
+				}
+				return
+			}
+
+			for _, e := range events {
+				select {
+				case outEvent <- e:
+					after = e.Sequence
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-time.After(followPollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// readEventsAfter runs query, which selects the events after a sequence,
+// and decodes the rows.
+func (l *PostgresTransactionLogger) readEventsAfter(ctx context.Context, query string, after uint64) ([]Event, error) {
+	rows, err := l.db.QueryContext(ctx, query, after)
+	if err != nil {
+		return nil, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,210 @@
+package translog
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrorUnhealthy is returned for events refused because the transaction log
+// has stopped persisting them.
+var ErrorUnhealthy = errors.New("transaction log is failing; writes are disabled")
+
+// probeInterval is how often an unhealthy log that refuses writes checks
+// whether it could write again.
+const probeInterval = time.Second
+
+// Health follows the outcome of every write made by a logger. The log is
+// unhealthy once threshold writes in a row have failed, and healthy again as
+// soon as one succeeds. A log that refuses writes while it's unhealthy has
+// none left to succeed, so its logger's probe is run every probeInterval
+// instead, until it succeeds. A nil *Health is always healthy.
+type Health struct {
+	mu         sync.Mutex
+	threshold  int          // Consecutive failures before the log is unhealthy
+	failClosed bool         // Whether writes are refused while the log is unhealthy
+	failures   int          // Current run of consecutive failures
+	lastErr    error        // Most recent failure, if the run is ongoing
+	probe      func() error // Checks whether the log could write again; nil if the logger has none
+	probing    bool         // Whether probe is being run
+}
+
+// NewHealth returns a Health that reports the log unhealthy after threshold
+// consecutive failures. While it is unhealthy, new events are refused with
+// ErrorUnhealthy if failClosed is set, until a probe of the logger
+// succeeds, and accepted with a warning if not.
+func NewHealth(threshold int, failClosed bool) *Health {
+	return &Health{threshold: threshold, failClosed: failClosed}
+}
+
+// record notes the result of a single write by a logger's writer goroutine.
+func (h *Health) record(err error) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		if h.failures >= h.threshold {
+			log.Println("transaction log recovered, writes are persisted again")
+		}
+
+		h.failures = 0
+		h.lastErr = nil
+
+		return
+	}
+
+	h.failures++
+	h.lastErr = err
+
+	if h.failures == h.threshold {
+		log.Printf("transaction log unhealthy after %d consecutive failures: %v\n", h.failures, err)
+	}
+
+	if h.failures >= h.threshold && h.failClosed && h.probe != nil && !h.probing {
+		h.probing = true
+		go h.probeUntilHealthy(h.probe)
+	}
+}
+
+// setProbe has probe run while the log refuses writes, to find when it
+// could write again. A probe returning ErrorClosed stops being run.
+func (h *Health) setProbe(probe func() error) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.probe = probe
+}
+
+// probeUntilHealthy runs probe every probeInterval until the log is healthy
+// again, recording the first success, or the probe reports its logger
+// closed.
+func (h *Health) probeUntilHealthy(probe func() error) {
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.probing = false
+	}()
+
+	for {
+		time.Sleep(probeInterval)
+
+		if ok, _ := h.Healthy(); ok {
+			return
+		}
+
+		err := probe()
+		if errors.Is(err, ErrorClosed) {
+			return
+		}
+		if err == nil {
+			h.record(nil)
+			return
+		}
+	}
+}
+
+// Healthy reports whether the log is persisting events and, if it isn't,
+// the last error.
+func (h *Health) Healthy() (bool, error) {
+	if h == nil {
+		return true, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failures < h.threshold {
+		return true, nil
+	}
+
+	return false, h.lastErr
+}
+
+// checkWrite returns ErrorUnhealthy if new events should be refused. Under
+// the accept-and-warn policy, events are let through and a warning logged.
+func (h *Health) checkWrite() error {
+	if ok, _ := h.Healthy(); ok {
+		return nil
+	}
+
+	if h.failClosed {
+		return ErrorUnhealthy
+	}
+
+	log.Println("WARNING: accepting write while the transaction log is unhealthy; it may not be persisted")
+
+	return nil
+}
+
+// DrainErrors logs every error reported by a logger. The loggers block on a
+// full error channel, so it must keep running for as long as the logger
+// does.
+func DrainErrors(errs <-chan error) {
+	var h *ErrorHistory
+	h.Drain(errs)
+}
+
+// RecordedError is an error reported by a logger, as kept by ErrorHistory.
+type RecordedError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// ErrorHistory keeps the last errors reported by a logger, for diagnostics.
+// A nil *ErrorHistory keeps none.
+type ErrorHistory struct {
+	mu     sync.Mutex
+	size   int
+	errors []RecordedError // Oldest first
+}
+
+// NewErrorHistory returns a history of the last size errors.
+func NewErrorHistory(size int) *ErrorHistory {
+	return &ErrorHistory{size: size}
+}
+
+// Drain is DrainErrors, also keeping the errors in h.
+func (h *ErrorHistory) Drain(errs <-chan error) {
+	for err := range errs {
+		log.Printf("transaction log write failed: %v\n", err)
+		h.add(err)
+	}
+}
+
+func (h *ErrorHistory) add(err error) {
+	if h == nil || h.size <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.errors) == h.size {
+		h.errors = h.errors[1:]
+	}
+
+	h.errors = append(h.errors, RecordedError{Time: time.Now().UTC(), Error: err.Error()})
+}
+
+// Recent returns the errors kept, oldest first.
+func (h *ErrorHistory) Recent() []RecordedError {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return slices.Clone(h.errors)
+}
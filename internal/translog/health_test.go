@@ -0,0 +1,97 @@
+package translog
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthFollowsConsecutiveFailures(t *testing.T) {
+	h := NewHealth(3, false)
+	failure := errors.New("disk full")
+
+	for i := 0; i < 2; i++ {
+		h.record(failure)
+	}
+	if ok, _ := h.Healthy(); !ok {
+		t.Error("unhealthy after 2 failures, with a threshold of 3")
+	}
+
+	h.record(failure)
+	if ok, err := h.Healthy(); ok || err != failure {
+		t.Errorf("Healthy() = %t, %v after 3 failures; want false, the failure", ok, err)
+	}
+
+	// Under accept-and-warn, writes go on, and the first to succeed
+	// recovers the log
+	if err := h.checkWrite(); err != nil {
+		t.Errorf("checkWrite accepting while unhealthy = %v", err)
+	}
+
+	h.record(nil)
+	if ok, err := h.Healthy(); !ok || err != nil {
+		t.Errorf("Healthy() = %t, %v after a success; want true, nil", ok, err)
+	}
+
+	var nilHealth *Health
+	nilHealth.record(failure)
+	if ok, _ := nilHealth.Healthy(); !ok || nilHealth.checkWrite() != nil {
+		t.Error("a nil Health isn't always healthy")
+	}
+}
+
+func TestFailClosedHealthRecoversThroughItsProbe(t *testing.T) {
+	h := NewHealth(1, true)
+
+	var probes atomic.Int32
+	var fixed atomic.Bool
+	h.setProbe(func() error {
+		probes.Add(1)
+		if !fixed.Load() {
+			return errors.New("still full")
+		}
+		return nil
+	})
+
+	h.record(errors.New("disk full"))
+	if err := h.checkWrite(); !errors.Is(err, ErrorUnhealthy) {
+		t.Fatalf("checkWrite while unhealthy = %v, want ErrorUnhealthy", err)
+	}
+
+	// No write is let through to succeed, so only the probe can tell
+	// that the log recovered
+	time.Sleep(probeInterval + probeInterval/2)
+	if ok, _ := h.Healthy(); ok || probes.Load() == 0 {
+		t.Fatalf("healthy %t after %d failed probes", ok, probes.Load())
+	}
+
+	fixed.Store(true)
+
+	deadline := time.Now().Add(3 * probeInterval)
+	for ok, _ := h.Healthy(); !ok; ok, _ = h.Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("still unhealthy once the probe succeeds")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := h.checkWrite(); err != nil {
+		t.Errorf("checkWrite once recovered = %v", err)
+	}
+}
+
+func TestProbeStopsOnceClosed(t *testing.T) {
+	h := NewHealth(1, true)
+	h.setProbe(func() error { return ErrorClosed })
+
+	h.record(errors.New("disk full"))
+	time.Sleep(probeInterval + probeInterval/2)
+
+	h.mu.Lock()
+	probing := h.probing
+	h.mu.Unlock()
+
+	if probing {
+		t.Error("still probing a closed logger")
+	}
+}
@@ -0,0 +1,211 @@
+package translog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrorClosed is returned for calls made on a logger after Close.
+var ErrorClosed = errors.New("transaction logger is closed")
+
+// ErrorLifecycle is returned for calls made on a logger out of the order
+// TransactionLogger documents, such as writing before Run.
+var ErrorLifecycle = errors.New("transaction logger used out of order")
+
+// state is a place in a logger's lifecycle. A logger only moves forward
+// through the states, though it may be closed from any of them.
+type state int
+
+const (
+	stateConstructed state = iota
+	stateReplaying         // ReadEvents is reading
+	stateReplayed          // ReadEvents has finished
+	stateRunning           // Run has started the writer
+	stateClosed
+)
+
+func (s state) String() string {
+	switch s {
+	case stateConstructed:
+		return "constructed"
+	case stateReplaying:
+		return "replaying"
+	case stateReplayed:
+		return "replayed"
+	case stateRunning:
+		return "running"
+	default:
+		return "closed"
+	}
+}
+
+// lifecycle moves a queued logger through its states, and owns its event
+// queue, so that nothing is sent on the queue before Run creates it or
+// after Close closes it.
+type lifecycle struct {
+	mu        sync.RWMutex // Held for reading while enqueueing, for writing by transitions
+	state     state
+	replayErr error         // Why the replay failed, if it did
+	events    chan Event    // Created by start, closed by stop
+	replayed  chan struct{} // Closed once the replay reader exits
+	closing   chan struct{} // Closed when Close begins, releasing blocked senders and the replay reader
+	closeOnce sync.Once
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{closing: make(chan struct{})}
+}
+
+// misuse returns the error for call being made in the current state, which
+// doesn't allow it. The caller holds mu.
+func (lc *lifecycle) misuse(call string) error {
+	if lc.state == stateClosed {
+		return fmt.Errorf("%s: %w", call, ErrorClosed)
+	}
+
+	return fmt.Errorf("%w: %s while %s", ErrorLifecycle, call, lc.state)
+}
+
+// beginReplay moves a constructed logger to replaying, for ReadEvents.
+func (lc *lifecycle) beginReplay() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.state != stateConstructed {
+		return lc.misuse("ReadEvents")
+	}
+
+	lc.state = stateReplaying
+	lc.replayed = make(chan struct{})
+
+	return nil
+}
+
+// endReplay records that the replay reader has exited, having failed with
+// err if it isn't nil.
+func (lc *lifecycle) endReplay(err error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.state == stateReplaying {
+		lc.state, lc.replayErr = stateReplayed, err
+	}
+
+	close(lc.replayed)
+}
+
+// replay sends e to the replay's reader, unless Close is called first.
+func (lc *lifecycle) replay(out chan<- Event, e Event) error {
+	select {
+	case out <- e:
+		return nil
+	case <-lc.closing:
+		return ErrorClosed
+	}
+}
+
+// start moves a replayed logger to running and returns its new event queue.
+// A logger whose replay failed doesn't know where its log ends, so it can't
+// be started. Run's preparations, if prepare isn't nil, are made once the
+// move is allowed, by the one Run making it; if they fail, the logger stays
+// replayed.
+func (lc *lifecycle) start(prepare func() error) (<-chan Event, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.state != stateReplayed {
+		return nil, lc.misuse("Run")
+	}
+
+	if lc.replayErr != nil {
+		return nil, fmt.Errorf("%w: Run after a failed replay: %v", ErrorLifecycle, lc.replayErr)
+	}
+
+	if prepare != nil {
+		if err := prepare(); err != nil {
+			return nil, err
+		}
+	}
+
+	lc.state = stateRunning
+	lc.events = make(chan Event, 16)
+
+	return lc.events, nil
+}
+
+// send enqueues e for the writer, unless ctx is done or Close is called
+// first.
+func (lc *lifecycle) send(ctx context.Context, e Event) error {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	if lc.state != stateRunning {
+		return lc.misuse("write")
+	}
+
+	// Counted before it is sent, so that the writer can't uncount it first;
+	// senders waiting for room count as queued
+	enqueued(e)
+
+	select {
+	case lc.events <- e:
+		return nil
+	case <-ctx.Done():
+		dequeued(e)
+		return ctx.Err()
+	case <-lc.closing:
+		dequeued(e)
+		return ErrorClosed
+	}
+}
+
+// closed reports whether the logger has been closed.
+func (lc *lifecycle) closed() bool {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return lc.state == stateClosed
+}
+
+// stop closes the logger and returns the state it was in. The queue of a
+// running logger is closed, so the writer ends once it has drained it. An
+// unfinished replay is stopped, and waited for, so that the log can be
+// released. Closing twice is an error.
+func (lc *lifecycle) stop() (state, error) {
+	// Senders blocked on a full queue hold mu, so they are released first
+	lc.closeOnce.Do(func() { close(lc.closing) })
+
+	lc.mu.Lock()
+	prev := lc.state
+	if prev == stateClosed {
+		lc.mu.Unlock()
+		return prev, lc.misuse("Close")
+	}
+
+	lc.state = stateClosed
+	if prev == stateRunning {
+		close(lc.events)
+	}
+	lc.mu.Unlock()
+
+	if prev == stateReplaying {
+		<-lc.replayed
+	}
+
+	return prev, nil
+}
+
+// failedRead returns the channels of a ReadEvents that fails at once with
+// err.
+func failedRead(err error) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	outError <- err
+	close(outEvent)
+	close(outError)
+
+	return outEvent, outError
+}
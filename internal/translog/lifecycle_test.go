@@ -0,0 +1,318 @@
+package translog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runningLifecycle returns a lifecycle moved through its replay to running,
+// with its queue, which nothing reads. It is stopped once the test ends, and
+// what is left in its queue uncounted.
+func runningLifecycle(t *testing.T) (*lifecycle, <-chan Event) {
+	t.Helper()
+
+	lc := newLifecycle()
+	if err := lc.beginReplay(); err != nil {
+		t.Fatal(err)
+	}
+	lc.endReplay(nil)
+
+	events, err := lc.start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		lc.stop()
+		for e := range events {
+			dequeued(e)
+		}
+	})
+
+	return lc, events
+}
+
+func TestSendGivesUpOnAFullQueue(t *testing.T) {
+	lc, events := runningLifecycle(t)
+
+	depth, _ := QueueState()
+
+	for i := 0; i < cap(events); i++ {
+		if err := lc.send(context.Background(), Event{Key: "k"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := lc.send(ctx, Event{Key: "k"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("send to a full queue = %v, want context.DeadlineExceeded", err)
+	}
+	if got, _ := QueueState(); got != depth+int64(cap(events)) {
+		t.Errorf("queue depth %d after a send gave up, want %d", got, depth+int64(cap(events)))
+	}
+
+	// A context that is already done never enqueues, even with room
+	<-events
+
+	if err := sendEvent(ctx, lc, nil, Event{Key: "k"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sendEvent with a done context = %v, want context.DeadlineExceeded", err)
+	}
+	if len(events) != cap(events)-1 {
+		t.Errorf("%d events queued, want %d", len(events), cap(events)-1)
+	}
+}
+
+// newFileLog returns a file log in a new directory holding n puts, not yet
+// replayed.
+func newFileLog(t *testing.T, n int) (TransactionLogger, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), LogFileName)
+
+	seqs := make([]uint64, n)
+	for i := range seqs {
+		seqs[i] = uint64(i + 1)
+	}
+	writeLines(t, path, seqs...)
+
+	l, err := NewFileTransactionLogger(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l, path
+}
+
+func TestConcurrentWritesDuringStartup(t *testing.T) {
+	for range 20 {
+		l, path := newFileLog(t, 100)
+
+		// Writers start before the log is replayed, and keep going while
+		// it's started: until then their writes fail rather than block
+		var mu sync.Mutex
+		var written []string
+		var early int
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					key := fmt.Sprintf("w%d-%d", w, i)
+					err := l.WritePutCtx(context.Background(), key, "v")
+
+					mu.Lock()
+					switch {
+					case err == nil:
+						written = append(written, key)
+					case errors.Is(err, ErrorLifecycle):
+						early++
+					default:
+						t.Errorf("write during startup: %v", err)
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+
+		if _, err := replaySequences(l); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Run(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		close(stop)
+		wg.Wait()
+
+		if err := l.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every write that succeeded is logged once, numbered after the
+		// replayed events
+		l, replayed := openFileLog(t, path)
+		l.Close(context.Background())
+
+		logged := make(map[string]bool)
+		for _, e := range replayed[100:] {
+			logged[e.Key] = true
+		}
+		if len(replayed) != 100+len(written) || len(logged) != len(written) {
+			t.Fatalf("%d events logged after the replayed ones, %d writes succeeded", len(replayed)-100, len(written))
+		}
+		for _, key := range written {
+			if !logged[key] {
+				t.Fatalf("the write of %s succeeded but isn't logged", key)
+			}
+		}
+		if early == 0 {
+			t.Log("no write was made before Run")
+		}
+	}
+}
+
+func TestRunOnlyOnce(t *testing.T) {
+	l, _ := newFileLog(t, 10)
+	defer l.Close(context.Background())
+
+	if err := l.Run(); !errors.Is(err, ErrorLifecycle) {
+		t.Errorf("Run before ReadEvents: %v, want ErrorLifecycle", err)
+	}
+	if _, err := replaySequences(l); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replaySequences(l); !errors.Is(err, ErrorLifecycle) {
+		t.Errorf("a second ReadEvents: %v, want ErrorLifecycle", err)
+	}
+
+	// Of many concurrent Runs, one starts the writer
+	errs := make(chan error, 10)
+	for range cap(errs) {
+		go func() { errs <- l.Run() }()
+	}
+
+	started := 0
+	for range cap(errs) {
+		err := <-errs
+		switch {
+		case err == nil:
+			started++
+		case !errors.Is(err, ErrorLifecycle):
+			t.Errorf("Run: %v", err)
+		}
+	}
+	if started != 1 {
+		t.Errorf("%d concurrent Runs started the writer, want 1", started)
+	}
+
+	if err := l.WritePutCtx(context.Background(), "k", "v"); err != nil {
+		t.Errorf("write after Run: %v", err)
+	}
+	if err := l.Flush(context.Background()); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+}
+
+func TestWritesRacingClose(t *testing.T) {
+	for range 20 {
+		l, path := newFileLog(t, 0)
+		if _, err := replaySequences(l); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Writes racing Close either succeed, and are logged, or fail
+		// with ErrorClosed; none blocks, and none panics sending on the
+		// closed queue
+		var mu sync.Mutex
+		written := 0
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					err := l.WritePutCtx(context.Background(), "k", "v")
+					if errors.Is(err, ErrorClosed) {
+						return
+					}
+					if err != nil {
+						t.Errorf("write racing Close: %v", err)
+						return
+					}
+
+					mu.Lock()
+					written++
+					mu.Unlock()
+				}
+			}()
+		}
+
+		time.Sleep(time.Millisecond)
+		if err := l.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		// Whatever is called after Close fails the same way
+		if err := l.WritePutCtx(context.Background(), "k", "v"); !errors.Is(err, ErrorClosed) {
+			t.Errorf("write after Close: %v, want ErrorClosed", err)
+		}
+		if err := l.Flush(context.Background()); !errors.Is(err, ErrorClosed) {
+			t.Errorf("Flush after Close: %v, want ErrorClosed", err)
+		}
+		if err := l.Run(); !errors.Is(err, ErrorClosed) {
+			t.Errorf("Run after Close: %v, want ErrorClosed", err)
+		}
+		if err := l.Close(context.Background()); !errors.Is(err, ErrorClosed) {
+			t.Errorf("a second Close: %v, want ErrorClosed", err)
+		}
+
+		_, replayed := openFileLog(t, path)
+		if len(replayed) != written {
+			t.Fatalf("%d writes succeeded, %d are logged", written, len(replayed))
+		}
+	}
+}
+
+func TestCloseDuringReplay(t *testing.T) {
+	for range 20 {
+		l, path := newFileLog(t, 1000)
+
+		// The replay is read slowly, and closed part way through
+		events, errs := l.ReadEvents()
+		<-events
+
+		closed := make(chan error, 1)
+		go func() { closed <- l.Close(context.Background()) }()
+
+		read := 1
+		for range events {
+			read++
+		}
+
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close during replay didn't return")
+		}
+
+		if err := <-errs; err != nil && !errors.Is(err, ErrorClosed) {
+			t.Errorf("the replay closed part way reported %v, want ErrorClosed or nothing", err)
+		}
+		if read > 1000 {
+			t.Errorf("read %d events of 1000", read)
+		}
+		if err := l.Run(); !errors.Is(err, ErrorClosed) {
+			t.Errorf("Run after Close: %v, want ErrorClosed", err)
+		}
+
+		// The log is released whole
+		_, replayed := openFileLog(t, path)
+		if len(replayed) != 1000 {
+			t.Fatalf("%d events replayed after a Close during replay, want 1000", len(replayed))
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package translog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MetaFileName is the name of the file, next to the log, recording where the
+// log starts when a compaction replaced the events before it with a
+// snapshot, and the last sequence it numbered. A log without one starts
+// from the first event.
+const MetaFileName = "transaction.meta"
+
+// LogMeta describes where a log starts, and where its numbering resumes.
+type LogMeta struct {
+	After     uint64    `json:"after"`                // Sequence of the last event before the log's first, held by the snapshot
+	Compacted time.Time `json:"compacted,omitzero"`   // When the events up to After were compacted
+	HighWater uint64    `json:"high_water,omitempty"` // Last sequence numbered, which events lost since may have taken with them
+}
+
+// Sequencer is implemented by loggers that number events past those they
+// replay, such as the file logger, whose numbering resumes after the last
+// sequence it ever numbered even if the events up to it are gone.
+type Sequencer interface {
+	// LastSequence returns the sequence numbering resumes after. It may
+	// only be called while the logger isn't writing: once ReadEvents is
+	// done and before Run, or after Close.
+	LastSequence() uint64
+}
+
+// MetaReader is implemented by loggers whose log has a LogMeta, such as the
+// file logger, to tell where the log they write starts.
+type MetaReader interface {
+	// LogMeta returns the metadata of the log as it is now, which a
+	// snapshot restored since the logger was opened may have replaced
+	LogMeta() (LogMeta, error)
+}
+
+// metaPath returns the path of the metadata of the log at path.
+func metaPath(path string) string {
+	return filepath.Join(filepath.Dir(path), MetaFileName)
+}
+
+// ReadLogMeta returns the metadata of the log at path. A log without any
+// starts from the first event, as the zero LogMeta says.
+func ReadLogMeta(path string) (LogMeta, error) {
+	var m LogMeta
+
+	b, err := os.ReadFile(metaPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("invalid %s: %w", MetaFileName, err)
+	}
+
+	return m, nil
+}
+
+// WriteLogMeta replaces the metadata of the log at path. The file is
+// replaced by a rename, so it is never seen half written.
+func WriteLogMeta(path string, m LogMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	name := metaPath(path)
+
+	if err := os.WriteFile(name+".tmp", append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(name+".tmp", name)
+}
+
+// HighWater returns the last sequence numbered in the log at path: that of
+// its last event, or the one its metadata records if greater. It reads the
+// log without changing it, skipping damaged records, so it can be used on
+// the log of a stopped instance about to be replaced, to carry its
+// numbering over. A missing log has numbered nothing.
+func HighWater(path string) (uint64, error) {
+	m, err := ReadLogMeta(path)
+	if err != nil {
+		return 0, err
+	}
+
+	last := max(m.After, m.HighWater)
+
+	files, err := SegmentFiles(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range append(files, pendingPath(path)) {
+		f, err := os.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		reader := bufio.NewReader(f)
+		for {
+			line, err := reader.ReadString('\n')
+			if e, perr := parseEvent(strings.TrimSuffix(line, "\n")); line != "" && perr == nil {
+				last = max(last, e.Sequence)
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return 0, fmt.Errorf("%s: transaction log read failure: %w", name, err)
+			}
+		}
+
+		f.Close()
+	}
+
+	return last, nil
+}
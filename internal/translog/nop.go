@@ -0,0 +1,70 @@
+package translog
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// NopTransactionLogger discards every event. It backs -log-backend=none, for
+// environments where the data doesn't need to survive a restart. Having
+// nothing to replay or write, it accepts calls in any order, except that it
+// can only be closed once.
+type NopTransactionLogger struct {
+	errors chan error  // Never receives; there is nothing to fail
+	closed atomic.Bool // Set by Close
+}
+
+func NewNopTransactionLogger() TransactionLogger { // construction function
+	return &NopTransactionLogger{errors: make(chan error)}
+}
+
+func (l *NopTransactionLogger) WritePut(key, value string) {}
+
+func (l *NopTransactionLogger) WriteDelete(key string) {}
+
+func (l *NopTransactionLogger) WritePutCtx(ctx context.Context, key, value string) error {
+	return ctx.Err()
+}
+
+func (l *NopTransactionLogger) WriteDeleteCtx(ctx context.Context, key string) error {
+	return ctx.Err()
+}
+
+func (l *NopTransactionLogger) WriteEvent(ctx context.Context, e Event) error {
+	return ctx.Err()
+}
+
+// Flush returns at once, as there is nothing to persist.
+func (l *NopTransactionLogger) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (l *NopTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// ReadEvents returns no events.
+func (l *NopTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error)
+
+	close(outEvent)
+	close(outError)
+
+	return outEvent, outError
+}
+
+func (l *NopTransactionLogger) Run() error {
+	return nil
+}
+
+// Close closes the error channel, ending DrainErrors.
+func (l *NopTransactionLogger) Close(ctx context.Context) error {
+	if l.closed.Swap(true) {
+		return fmt.Errorf("Close: %w", ErrorClosed)
+	}
+
+	close(l.errors)
+	return nil
+}
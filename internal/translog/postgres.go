@@ -0,0 +1,437 @@
+package translog
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"regexp"
+	"time"
+)
+
+// DefaultPostgresTable is the table of a Postgres log, unless configured
+// otherwise.
+const DefaultPostgresTable = "transactions"
+
+type PostgresdDBParams struct {
+	DBName   string
+	Host     string
+	User     string
+	Password string
+	Table    string // Table of the log; DefaultPostgresTable if empty
+}
+
+// table returns the table of the log, checking that it can be named in a
+// query as it is.
+func (p PostgresdDBParams) table() (string, error) {
+	if p.Table == "" {
+		return DefaultPostgresTable, nil
+	}
+
+	if !validTableName.MatchString(p.Table) {
+		return "", fmt.Errorf("invalid table name %q: expected lower-case letters, digits and underscores", p.Table)
+	}
+
+	return p.Table, nil
+}
+
+var validTableName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+type PostgresTransactionLogger struct {
+	life   *lifecycle    // Lifecycle state and the queue of events for the writer
+	errors chan error    // Insert errors; closed once the writer exits, or by Close if it never ran
+	db     *sql.DB       // Database access interface
+	table  string        // Table of the log, a valid name
+	health *Health       // Tracks write failures; may be nil
+	done   chan struct{} // Closed once the writer goroutine exits
+}
+
+func (l *PostgresTransactionLogger) WritePut(key, value string) {
+	dropOnError(l.WritePutCtx(context.Background(), key, value))
+}
+
+func (l *PostgresTransactionLogger) WriteDelete(key string) {
+	dropOnError(l.WriteDeleteCtx(context.Background(), key))
+}
+
+func (l *PostgresTransactionLogger) WritePutCtx(ctx context.Context, key, value string) error {
+	return sendEvent(ctx, l.life, l.health, Event{EventType: EventPut, Bucket: DefaultBucket, Key: key, Value: value})
+}
+
+func (l *PostgresTransactionLogger) WriteDeleteCtx(ctx context.Context, key string) error {
+	return sendEvent(ctx, l.life, l.health, Event{EventType: EventDelete, Bucket: DefaultBucket, Key: key})
+}
+
+func (l *PostgresTransactionLogger) WriteEvent(ctx context.Context, e Event) error {
+	return sendEvent(ctx, l.life, l.health, e)
+}
+
+// Flush waits for the enqueued events to be inserted. Inserts commit as
+// they are made, so there is nothing to sync.
+func (l *PostgresTransactionLogger) Flush(ctx context.Context) error {
+	return sendMarker(ctx, l.life, "translog.Flush", Event{})
+}
+
+func (l *PostgresTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *PostgresTransactionLogger) verifyTableExists() (bool, error) {
+	var result string
+
+	rows, err := l.db.Query(fmt.Sprintf("SELECT to_regclass('public.%s');", l.table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() && result != l.table {
+		rows.Scan(&result)
+	}
+
+	return result == l.table, rows.Err()
+
+}
+
+func (l *PostgresTransactionLogger) createTable() error {
+	var err error
+
+	query := `CREATE TABLE %s (
+			sequence 	BIGSERIAL PRIMARY KEY,
+			event_type 	SMALLINT,
+			bucket 		TEXT NOT NULL DEFAULT 'default',
+			key 		TEXT,
+			value 		TEXT,
+			codec 		SMALLINT NOT NULL DEFAULT 0,
+			logged_at 	TIMESTAMPTZ,
+			record_version	SMALLINT NOT NULL DEFAULT %d,
+			encoded 	BOOLEAN NOT NULL DEFAULT false,
+			content_type	TEXT NOT NULL DEFAULT ''
+			);`
+
+	_, err = l.db.Exec(fmt.Sprintf(query, l.table, legacyRecordVersion))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateTable adds columns introduced after the table was first created.
+// The rows already there, and those inserted by older binaries, which
+// don't know of the record_version column, get legacyRecordVersion.
+func (l *PostgresTransactionLogger) migrateTable() error {
+	query := `ALTER TABLE %s
+			ADD COLUMN IF NOT EXISTS bucket TEXT NOT NULL DEFAULT 'default',
+			ADD COLUMN IF NOT EXISTS codec SMALLINT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS logged_at TIMESTAMPTZ,
+			ADD COLUMN IF NOT EXISTS record_version SMALLINT NOT NULL DEFAULT %d,
+			ADD COLUMN IF NOT EXISTS encoded BOOLEAN NOT NULL DEFAULT false,
+			ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT '';`
+
+	_, err := l.db.Exec(fmt.Sprintf(query, l.table, legacyRecordVersion))
+
+	return err
+}
+
+// openPostgres connects to the database of config.
+func openPostgres(config PostgresdDBParams) (*sql.DB, error) {
+	connStr := fmt.Sprintf("host=%s dbname=%s user=%s password=%s",
+		config.Host, config.DBName, config.User, config.Password)
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+
+	err = db.Ping() // Test the database connection
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open db connection: %w", err)
+	}
+
+	return db, nil
+}
+
+// NewPostgresTransactionLogger connects to the database, creating or
+// migrating the log's table as needed. Write results are reported to
+// health, which may be nil.
+func NewPostgresTransactionLogger(config PostgresdDBParams, health *Health) (TransactionLogger, error) { // construction function
+	table, err := config.table()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openPostgres(config)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := &PostgresTransactionLogger{life: newLifecycle(), errors: make(chan error, 1), db: db, table: table, health: health}
+	health.setProbe(logger.probe)
+
+	exists, err := logger.verifyTableExists()
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify table exists: %w", err)
+	}
+
+	if !exists {
+		if err = logger.createTable(); err != nil {
+			return nil, fmt.Errorf("failed create table: %w", err)
+		}
+	} else if err = logger.migrateTable(); err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %w", err)
+	}
+
+	return logger, nil
+}
+
+// probe checks whether the database can be reached again.
+func (l *PostgresTransactionLogger) probe() error {
+	if l.life.closed() {
+		return ErrorClosed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeInterval)
+	defer cancel()
+
+	return l.db.PingContext(ctx)
+}
+
+// Run starts the writer goroutine. The log must have been replayed first.
+func (l *PostgresTransactionLogger) Run() error {
+	events, err := l.life.start(nil)
+	if err != nil {
+		return err
+	}
+
+	errors := l.errors
+
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+		defer close(errors)
+
+		query := fmt.Sprintf(`INSERT INTO %s 
+						(event_type, bucket, key, value, codec, logged_at, record_version, encoded, content_type)
+						VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, l.table)
+
+		var failed error // First insert failure since the last flush
+
+		for e := range events {
+			dequeued(e)
+
+			if e.flushed != nil {
+				e.flushed <- failed
+				failed = nil
+
+				continue
+			}
+
+			// Compressed values aren't valid text, so they're stored
+			// base64-encoded, as are those that aren't text to begin
+			// with
+			value, encoded := e.Value, e.Codec != compress.None || !IsText(e.Value)
+			if encoded {
+				value = base64.StdEncoding.EncodeToString([]byte(value))
+			}
+
+			if e.Time.IsZero() {
+				e.Time = time.Now().UTC()
+			}
+
+			span := startWriteSpan("translog.PostgresInsert", e)
+
+			t := timing.Begin("postgres_log", e.Bucket, e.Key)
+			_, err := l.db.Exec(
+				query,
+				e.EventType, e.Bucket, e.Key, value, e.Codec, e.Time, RecordVersion, encoded, e.ContentType)
+			t.Phase("insert")
+			t.End()
+
+			tracing.End(span, err)
+			l.health.record(err)
+
+			if err != nil {
+				failed = cmp.Or(failed, err)
+				errors <- err
+			}
+		}
+
+	}()
+
+	return nil
+}
+
+// Close stops the writer once it has inserted every enqueued event, and
+// closes the database. If ctx is done first, the events not yet inserted
+// are abandoned. A replay still reading is stopped first.
+func (l *PostgresTransactionLogger) Close(ctx context.Context) error {
+	prev, err := l.life.stop()
+	if err != nil {
+		return err
+	}
+
+	if prev == stateRunning {
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return fmt.Errorf("closing with events still queued: %w", ctx.Err())
+		}
+	} else {
+		close(l.errors) // The writer never ran to close it
+	}
+
+	return l.db.Close()
+}
+
+func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	if err := l.life.beginReplay(); err != nil {
+		return failedRead(err)
+	}
+
+	outEvent := make(chan Event)    // An unbuffered Event channel
+	outError := make(chan error, 1) // A buffered error channel
+
+	go func() {
+		defer close(outEvent) // Close the channels when the goroutine ends
+		defer close(outError)
+
+		err := l.readAll(func(e Event) error {
+			return l.life.replay(outEvent, e)
+		})
+
+		l.life.endReplay(err)
+
+		if err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// readAll calls fn for every event in the table, for ReadEvents.
+func (l *PostgresTransactionLogger) readAll(fn func(Event) error) error {
+	return scanTable(l.db, l.table, fn)
+}
+
+// ScanPostgres calls fn for each event in the table of the log config
+// names, in order, stopping at the first error fn returns. Like ScanLog it
+// leaves the log untouched, so it can read the log of a running logger; the
+// events are read in a single query, which sees the table as it was when
+// the query started.
+func ScanPostgres(config PostgresdDBParams, fn func(Event) error) error {
+	table, err := config.table()
+	if err != nil {
+		return err
+	}
+
+	db, err := openPostgres(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return scanTable(db, table, fn)
+}
+
+// scanTable calls fn for every event in table, in order.
+func scanTable(db *sql.DB, table string, fn func(Event) error) error {
+	query := fmt.Sprintf(`SELECT %s
+			  FROM %s
+			  ORDER BY sequence`, eventColumns, table)
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("sql query error: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	return nil
+}
+
+// eventColumns are the columns of the log's table scanEvent decodes.
+const eventColumns = "sequence, event_type, bucket, key, value, codec, logged_at, record_version, encoded, content_type"
+
+// scanEvent decodes the event in the current row of rows, which selected
+// eventColumns. The columns added since the first version have defaults
+// for the rows inserted before, so every known version decodes alike; a
+// row of a newer version is an error wrapping ErrorNewerVersion.
+func scanEvent(rows *sql.Rows) (Event, error) {
+	var e Event
+	var logged sql.NullTime // Rows inserted before timestamps have none
+	var version int
+	var encoded bool
+
+	err := rows.Scan(
+		&e.Sequence, &e.EventType,
+		&e.Bucket, &e.Key, &e.Value, &e.Codec, &logged, &version, &encoded, &e.ContentType)
+
+	if err != nil {
+		return e, fmt.Errorf("error reading row: %w", err)
+	}
+
+	if err := CheckRecordVersion(version); err != nil {
+		return e, fmt.Errorf("event %d: %w", e.Sequence, err)
+	}
+
+	if e.Codec != compress.None || encoded {
+		value, err := base64.StdEncoding.DecodeString(e.Value)
+		if err != nil {
+			return e, fmt.Errorf("invalid encoded value: %w", err)
+		}
+		e.Value = string(value)
+	}
+
+	if logged.Valid {
+		e.Time = logged.Time.UTC()
+	}
+
+	return e, nil
+}
+
+// DropPostgresTable drops the table of the log config names, for logs that
+// were only ever meant to be thrown away. The default table is never
+// dropped.
+func DropPostgresTable(config PostgresdDBParams) error {
+	table, err := config.table()
+	if err != nil {
+		return err
+	}
+	if table == DefaultPostgresTable {
+		return fmt.Errorf("refusing to drop the default table %s", DefaultPostgresTable)
+	}
+
+	db, err := openPostgres(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+
+	return err
+}
@@ -0,0 +1,55 @@
+package translog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+var queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "kv_log_queue_depth",
+	Help: "Number of events enqueued for the transaction log writers and not yet taken by them.",
+})
+
+// The queue across loggers, as QueueState reports it
+var (
+	queued   atomic.Int64
+	progress atomic.Int64 // Unix nanoseconds of the last dequeue, or of the enqueue that found the queue empty
+)
+
+// QueueState returns the number of events enqueued for the transaction log
+// writers and not yet taken by them, in every logger, and how long the
+// writers have gone without taking one while there were some: 0 while they
+// keep up. Both are read without locking, for pollers.
+func QueueState() (depth int64, lag time.Duration) {
+	depth = queued.Load()
+	if depth <= 0 {
+		return 0, 0
+	}
+
+	return depth, max(0, time.Since(time.Unix(0, progress.Load())))
+}
+
+// QueueCollectors returns the queue depth gauge, for the metrics registry.
+func QueueCollectors() []prometheus.Collector {
+	return []prometheus.Collector{queueDepth}
+}
+
+// enqueued counts e in the queue depth, unless it's a marker.
+func enqueued(e Event) {
+	if e.flushed == nil {
+		queueDepth.Inc()
+		if queued.Add(1) == 1 {
+			progress.Store(time.Now().UnixNano())
+		}
+	}
+}
+
+// dequeued uncounts e from the queue depth, once the writer took it.
+func dequeued(e Event) {
+	if e.flushed == nil {
+		queueDepth.Dec()
+		queued.Add(-1)
+		progress.Store(time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,546 @@
+package translog
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoutedLogDir is the directory, in a data directory, holding a directory
+// of its own for each log events are routed to, named after the log.
+const RoutedLogDir = "logs"
+
+// Sync policies of a routed log.
+const (
+	SyncOnFlush = "flush"  // Synced when the store flushes, as the default log is
+	SyncAlways  = "always" // Synced after every event, before its write returns
+)
+
+// routeMaintenanceInterval is how often routed logs are checked for
+// rotation and retention.
+const routeMaintenanceInterval = time.Minute
+
+// routeNamePattern is what the name of a routed log may be, as it names its
+// directory.
+var routeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// LogRoute sends the events of the keys starting with any of Prefixes, in
+// any bucket, to a file log of their own, kept as the default log is but
+// with its own policies. A key matching several prefixes, of different
+// routes, goes to the route of the longest.
+type LogRoute struct {
+	Name     string   // Names the log's directory in RoutedLogDir
+	Prefixes []string // Must not be empty, nor be any other route's
+
+	Sync        string        // SyncOnFlush if empty
+	RotateBytes int64         // Size the log is rotated at; 0 never rotates it
+	Retain      time.Duration // Age past which rotated segments are removed; 0 keeps them forever
+}
+
+// LoadLogRoutes reads a JSON array of routes from the file at path, such as
+//
+//	[{"name": "billing", "prefixes": ["billing/"], "sync": "always"},
+//	 {"name": "cache", "prefixes": ["cache/"], "rotate_bytes": 67108864, "retain": "24h"}]
+func LoadLogRoutes(path string) ([]LogRoute, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []struct {
+		Name        string   `json:"name"`
+		Prefixes    []string `json:"prefixes"`
+		Sync        string   `json:"sync"`
+		RotateBytes int64    `json:"rotate_bytes"`
+		Retain      string   `json:"retain"`
+	}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	routes := make([]LogRoute, len(rules))
+	for i, r := range rules {
+		routes[i] = LogRoute{Name: r.Name, Prefixes: r.Prefixes, Sync: r.Sync, RotateBytes: r.RotateBytes}
+
+		if r.Retain != "" {
+			if routes[i].Retain, err = time.ParseDuration(r.Retain); err != nil {
+				return nil, fmt.Errorf("%s: route %s: invalid retain %q", path, r.Name, r.Retain)
+			}
+		}
+	}
+
+	return routes, validateRoutes(routes)
+}
+
+// validateRoutes checks that routes can be opened together.
+func validateRoutes(routes []LogRoute) error {
+	names := make(map[string]bool)
+	prefixes := make(map[string]string)
+
+	for _, r := range routes {
+		if !routeNamePattern.MatchString(r.Name) {
+			return fmt.Errorf("route %q: the name must be lower-case letters, digits, - and _", r.Name)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("route %s: the name is taken by another route", r.Name)
+		}
+		names[r.Name] = true
+
+		if len(r.Prefixes) == 0 {
+			return fmt.Errorf("route %s: no prefixes", r.Name)
+		}
+		for _, p := range r.Prefixes {
+			if p == "" {
+				return fmt.Errorf("route %s: empty prefix; unmatched keys go to the default log", r.Name)
+			}
+			if other, ok := prefixes[p]; ok {
+				return fmt.Errorf("route %s: prefix %q is already routed to %s", r.Name, p, other)
+			}
+			prefixes[p] = r.Name
+		}
+
+		switch r.Sync {
+		case "", SyncOnFlush, SyncAlways:
+		default:
+			return fmt.Errorf("route %s: sync must be %s or %s", r.Name, SyncOnFlush, SyncAlways)
+		}
+
+		if r.RotateBytes < 0 || r.Retain < 0 {
+			return fmt.Errorf("route %s: rotate_bytes and retain can't be negative", r.Name)
+		}
+	}
+
+	return nil
+}
+
+// routedLog is a log of a RoutedLogger: the default one, with a zero
+// route, or a routed one.
+type routedLog struct {
+	route  LogRoute
+	path   string
+	logger TransactionLogger
+}
+
+// RoutedLogger dispatches events to several file logs by the prefix of
+// their key: those of keys no route matches, and those of no key, such as
+// bucket drops, go to the default log. It is a TransactionLogger, and
+// follows the same lifecycle, passing each call on to every log.
+//
+// Events are numbered across the logs, by the store or else by the
+// RoutedLogger, so each log holds an increasing run of the numbers and
+// replay merges them back into a single order: by sequence, then by the
+// order of the logs, the default first, for the equal sequences of logs
+// written by different stores.
+type RoutedLogger struct {
+	logs     []routedLog   // The default log first, then the routes in order
+	prefixes []routePrefix // Longest first
+
+	mu   sync.Mutex // Serializes numbering and enqueueing
+	last uint64     // Last sequence numbered or written
+
+	errors chan error // Every log's write errors; closed once all of theirs are
+
+	closeOnce sync.Once
+	closed    chan struct{} // Closed by Close, to stop the replay merge
+	stop      chan struct{} // Closed by Close, to stop the maintenance
+	done      chan struct{} // Closed once the maintenance stops; nil if it never ran
+}
+
+// NewRoutedLogger opens the routed logs in dataDir, creating their
+// directories as needed, beside fallback, the default log, which is the
+// one in dataDir. Write results are reported to health, which may be nil.
+func NewRoutedLogger(dataDir string, fallback TransactionLogger, routes []LogRoute, health *Health) (*RoutedLogger, error) {
+	if err := validateRoutes(routes); err != nil {
+		return nil, err
+	}
+
+	r := &RoutedLogger{
+		logs:   []routedLog{{path: filepath.Join(dataDir, LogFileName), logger: fallback}},
+		errors: make(chan error, 1),
+		closed: make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+
+	for _, route := range routes {
+		path := RoutedLogPath(dataDir, route.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.closeLogs(context.Background())
+			return nil, err
+		}
+
+		logger, err := NewFileTransactionLogger(path, health)
+		if err != nil {
+			r.closeLogs(context.Background())
+			return nil, fmt.Errorf("route %s: %w", route.Name, err)
+		}
+
+		r.logs = append(r.logs, routedLog{route, path, logger})
+		for _, p := range route.Prefixes {
+			r.prefixes = append(r.prefixes, routePrefix{p, len(r.logs) - 1})
+		}
+	}
+
+	slices.SortStableFunc(r.prefixes, func(a, b routePrefix) int {
+		return cmp.Compare(len(b.prefix), len(a.prefix))
+	})
+
+	// Write errors of every log come out of one channel, which is closed
+	// once every log's is
+	var wg sync.WaitGroup
+	for _, l := range r.logs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for err := range l.logger.Err() {
+				r.errors <- err
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(r.errors)
+	}()
+
+	return r, nil
+}
+
+// routePrefix is a prefix routed to the log at an index of
+// RoutedLogger.logs.
+type routePrefix struct {
+	prefix string
+	log    int
+}
+
+// route returns the log the events of key go to: that of the longest
+// prefix of key routed, or the default log.
+func (r *RoutedLogger) route(key string) *routedLog {
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			return &r.logs[p.log]
+		}
+	}
+
+	return &r.logs[0]
+}
+
+func (r *RoutedLogger) WritePut(key, value string) {
+	dropOnError(r.WritePutCtx(context.Background(), key, value))
+}
+
+func (r *RoutedLogger) WriteDelete(key string) {
+	dropOnError(r.WriteDeleteCtx(context.Background(), key))
+}
+
+func (r *RoutedLogger) WritePutCtx(ctx context.Context, key, value string) error {
+	return r.WriteEvent(ctx, Event{EventType: EventPut, Bucket: DefaultBucket, Key: key, Value: value})
+}
+
+func (r *RoutedLogger) WriteDeleteCtx(ctx context.Context, key string) error {
+	return r.WriteEvent(ctx, Event{EventType: EventDelete, Bucket: DefaultBucket, Key: key})
+}
+
+// ErrorNotFlushed is returned by RoutedLogger.WriteEvent for an event
+// enqueued on a log synced always whose context was done before it was
+// durable. The event is written all the same.
+var ErrorNotFlushed = errors.New("event enqueued but not yet durable")
+
+// WriteEvent enqueues e on the log its key is routed to, numbering it after
+// the last event written to any log if it isn't numbered yet. For a log
+// synced always, it then waits until e is durable, and fails with
+// ErrorNotFlushed, wrapping the context's error, if ctx is done first.
+func (r *RoutedLogger) WriteEvent(ctx context.Context, e Event) error {
+	l := r.route(e.Key)
+
+	r.mu.Lock()
+	if e.Sequence == 0 {
+		e.Sequence = r.last + 1
+	}
+	err := l.logger.WriteEvent(ctx, e)
+	if err == nil {
+		r.last = max(r.last, e.Sequence)
+	}
+	r.mu.Unlock()
+
+	if err != nil || l.route.Sync != SyncAlways {
+		return err
+	}
+
+	if err := l.logger.Flush(ctx); err != nil {
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			return fmt.Errorf("%w: %w", ErrorNotFlushed, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Flush flushes every log, and returns the first failure.
+func (r *RoutedLogger) Flush(ctx context.Context) error {
+	var err error
+	for _, l := range r.logs {
+		err = cmp.Or(err, l.logger.Flush(ctx))
+	}
+
+	return err
+}
+
+func (r *RoutedLogger) Err() <-chan error {
+	return r.errors
+}
+
+// replayCursor is where the replay merge is in one log.
+type replayCursor struct {
+	events <-chan Event
+	errors <-chan error
+	head   Event
+	ok     bool // Whether head holds an event not sent yet
+}
+
+// next reads the cursor's next event, and returns the error its log's read
+// failed with once it runs out.
+func (c *replayCursor) next() error {
+	if c.head, c.ok = <-c.events; c.ok {
+		return nil
+	}
+
+	return <-c.errors
+}
+
+// ReadEvents reads every log, merging their events by sequence. The first
+// read failure stops the merge.
+func (r *RoutedLogger) ReadEvents() (<-chan Event, <-chan error) {
+	cursors := make([]*replayCursor, len(r.logs))
+	for i, l := range r.logs {
+		events, errors := l.logger.ReadEvents()
+		cursors[i] = &replayCursor{events: events, errors: errors}
+	}
+
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		for i, c := range cursors {
+			if err := c.next(); err != nil {
+				outError <- fmt.Errorf("%s: %w", r.logs[i].path, err)
+				return
+			}
+		}
+
+		for {
+			var first *replayCursor
+			index := 0
+			for i, c := range cursors {
+				if c.ok && (first == nil || c.head.Sequence < first.head.Sequence) {
+					first, index = c, i
+				}
+			}
+			if first == nil {
+				return
+			}
+
+			if first.head.Sequence > r.last {
+				r.last = first.head.Sequence
+			}
+
+			select {
+			case outEvent <- first.head:
+			case <-r.closed:
+				outError <- ErrorClosed
+				return
+			}
+
+			if err := first.next(); err != nil {
+				outError <- fmt.Errorf("%s: %w", r.logs[index].path, err)
+				return
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// Run starts every log's writer, and the rotation and retention of the
+// routed logs that have them.
+func (r *RoutedLogger) Run() error {
+	// Numbering resumes after the last sequence any log numbered, read
+	// before their writers start
+	r.last = r.LastSequence()
+
+	for _, l := range r.logs {
+		if err := l.logger.Run(); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range r.logs[1:] {
+		if l.route.RotateBytes > 0 || l.route.Retain > 0 {
+			r.done = make(chan struct{})
+			go r.maintain()
+			break
+		}
+	}
+
+	return nil
+}
+
+// maintain rotates and trims the routed logs every
+// routeMaintenanceInterval until Close.
+func (r *RoutedLogger) maintain() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(routeMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, l := range r.logs[1:] {
+				if err := l.maintain(context.Background()); err != nil {
+					log.Printf("maintenance of log %s failed: %v\n", l.route.Name, err)
+				}
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// maintain rotates l once it reaches its RotateBytes, and removes its
+// rotated segments last written longer than its Retain ago, oldest first.
+// The events of a removed segment are lost to replay, unless a snapshot
+// holds what they wrote.
+func (l *routedLog) maintain(ctx context.Context) error {
+	if l.route.RotateBytes > 0 {
+		info, err := os.Stat(l.path)
+		if err != nil {
+			return err
+		}
+
+		if info.Size() >= l.route.RotateBytes {
+			if err := l.logger.(Rotator).Rotate(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if l.route.Retain == 0 {
+		return nil
+	}
+
+	files, err := SegmentFiles(l.path)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-l.route.Retain)
+
+	for _, name := range files[:len(files)-1] {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			break
+		}
+
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+
+		log.Printf("removed segment %s of log %s, older than %s\n", filepath.Base(name), l.route.Name, l.route.Retain)
+	}
+
+	return nil
+}
+
+// Close stops the maintenance and the replay merge, and closes every log.
+func (r *RoutedLogger) Close(ctx context.Context) error {
+	err := ErrorClosed
+
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		close(r.stop)
+		if r.done != nil {
+			<-r.done
+		}
+
+		err = r.closeLogs(ctx)
+	})
+
+	return err
+}
+
+// closeLogs closes every log, and returns the first failure.
+func (r *RoutedLogger) closeLogs(ctx context.Context) error {
+	var err error
+	for _, l := range r.logs {
+		err = cmp.Or(err, l.logger.Close(ctx))
+	}
+
+	return err
+}
+
+// LastSequence implements Sequencer: the last sequence numbered by any
+// log, or read from one.
+func (r *RoutedLogger) LastSequence() uint64 {
+	last := r.last
+	for _, l := range r.logs {
+		if seq, ok := l.logger.(Sequencer); ok {
+			last = max(last, seq.LastSequence())
+		}
+	}
+
+	return last
+}
+
+// LogMeta implements MetaReader with the metadata of the default log, the
+// only one compacted. A default log without any starts from the first event.
+func (r *RoutedLogger) LogMeta() (LogMeta, error) {
+	if m, ok := r.logs[0].logger.(MetaReader); ok {
+		return m.LogMeta()
+	}
+
+	return LogMeta{}, nil
+}
+
+// Rotate implements Rotator, rotating every log that can be.
+func (r *RoutedLogger) Rotate(ctx context.Context) error {
+	var err error
+	for _, l := range r.logs {
+		if rot, ok := l.logger.(Rotator); ok {
+			err = cmp.Or(err, rot.Rotate(ctx))
+		}
+	}
+
+	return err
+}
+
+// ReportDamage implements DamageReporter, for every log that can report
+// damage. It must be called before ReadEvents.
+func (r *RoutedLogger) ReportDamage(report func(Damage), skip bool) {
+	for _, l := range r.logs {
+		if reporter, ok := l.logger.(DamageReporter); ok {
+			reporter.ReportDamage(report, skip)
+		}
+	}
+}
+
+// RoutedLogPath returns the path of the log of the route named name in
+// dataDir.
+func RoutedLogPath(dataDir, name string) string {
+	return filepath.Join(dataDir, RoutedLogDir, name, LogFileName)
+}
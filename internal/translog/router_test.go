@@ -0,0 +1,289 @@
+package translog
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openRouted opens the routed logs of routes in dir, replays them, and
+// starts them, returning the logger with the events replayed.
+func openRouted(t *testing.T, dir string, routes []LogRoute) (*RoutedLogger, []Event) {
+	t.Helper()
+
+	fallback, err := NewFileTransactionLogger(filepath.Join(dir, LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRoutedLogger(dir, fallback, routes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []Event
+	events, errs := r.ReadEvents()
+	for e := range events {
+		replayed = append(replayed, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return r, replayed
+}
+
+// closeRouted flushes and closes r.
+func closeRouted(t *testing.T, r *RoutedLogger) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := r.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keysIn returns the keys of the events in the log file at path.
+func keysIn(t *testing.T, path string) []string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for line := range strings.Lines(string(b)) {
+		e, err := DecodeEvent(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, e.Key)
+	}
+
+	return keys
+}
+
+func TestValidateRoutes(t *testing.T) {
+	ok := LogRoute{Name: "billing", Prefixes: []string{"billing/"}}
+
+	for _, tt := range []struct {
+		name   string
+		routes []LogRoute
+	}{
+		{"bad name", []LogRoute{{Name: "Billing", Prefixes: []string{"b/"}}}},
+		{"name with a slash", []LogRoute{{Name: "a/b", Prefixes: []string{"b/"}}}},
+		{"taken name", []LogRoute{ok, {Name: "billing", Prefixes: []string{"other/"}}}},
+		{"no prefixes", []LogRoute{{Name: "empty"}}},
+		{"empty prefix", []LogRoute{{Name: "all", Prefixes: []string{""}}}},
+		{"routed prefix", []LogRoute{ok, {Name: "again", Prefixes: []string{"billing/"}}}},
+		{"bad sync", []LogRoute{{Name: "b", Prefixes: []string{"b/"}, Sync: "never"}}},
+		{"negative rotation", []LogRoute{{Name: "b", Prefixes: []string{"b/"}, RotateBytes: -1}}},
+		{"negative retention", []LogRoute{{Name: "b", Prefixes: []string{"b/"}, Retain: -time.Hour}}},
+	} {
+		if err := validateRoutes(tt.routes); err == nil {
+			t.Errorf("%s: valid", tt.name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	content := `[{"name": "billing", "prefixes": ["billing/"], "sync": "always"},
+		{"name": "cache", "prefixes": ["cache/", "tmp/"], "rotate_bytes": 1024, "retain": "24h"}]`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := LoadLogRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LogRoute{
+		{Name: "billing", Prefixes: []string{"billing/"}, Sync: SyncAlways},
+		{Name: "cache", Prefixes: []string{"cache/", "tmp/"}, RotateBytes: 1024, Retain: 24 * time.Hour},
+	}
+	if fmt.Sprint(routes) != fmt.Sprint(want) {
+		t.Errorf("LoadLogRoutes: %+v, want %+v", routes, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"name": "cache", "prefixes": ["c/"], "retain": "a day"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLogRoutes(path); err == nil {
+		t.Error("LoadLogRoutes took an invalid retain")
+	}
+}
+
+func TestRoutedLoggerRoutesAndMergesReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	routes := []LogRoute{
+		{Name: "billing", Prefixes: []string{"billing/"}, Sync: SyncAlways},
+		{Name: "billing-eu", Prefixes: []string{"billing/eu/"}},
+		{Name: "cache", Prefixes: []string{"cache/", "tmp/"}},
+	}
+
+	r, _ := openRouted(t, dir, routes)
+
+	// The longest prefix a key matches wins, billing/eu not matching
+	// billing/eu/; keys matching none, and events of no key, go to the
+	// default log
+	writes := []Event{
+		{EventType: EventPut, Key: "billing/us/1", Value: "a"},
+		{EventType: EventPut, Key: "billing/eu/1", Value: "b"},
+		{EventType: EventPut, Key: "cache/1", Value: "c"},
+		{EventType: EventPut, Key: "user/1", Value: "d"},
+		{EventType: EventDelete, Key: "cache/1"},
+		{EventType: EventPut, Key: "tmp/1", Value: "e"},
+		{EventType: EventDropBucket, Bucket: "old"},
+		{EventType: EventPut, Key: "billing/eu", Value: "f"},
+		{EventType: EventDelete, Key: "billing/us/1"},
+		{EventType: EventPut, Key: "billing/eu/2", Value: "g"},
+	}
+	for i := range writes {
+		writes[i].Bucket = cmp.Or(writes[i].Bucket, DefaultBucket)
+		if err := r.WriteEvent(ctx, writes[i]); err != nil {
+			t.Fatal(err)
+		}
+		writes[i].Sequence = uint64(i + 1)
+	}
+	closeRouted(t, r)
+	if seq := r.LastSequence(); seq != uint64(len(writes)) {
+		t.Errorf("last sequence %d after %d events", seq, len(writes))
+	}
+
+	for path, want := range map[string][]string{
+		filepath.Join(dir, LogFileName):  {"user/1", ""},
+		RoutedLogPath(dir, "billing"):    {"billing/us/1", "billing/eu", "billing/us/1"},
+		RoutedLogPath(dir, "billing-eu"): {"billing/eu/1", "billing/eu/2"},
+		RoutedLogPath(dir, "cache"):      {"cache/1", "cache/1", "tmp/1"},
+	} {
+		if got := keysIn(t, path); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("keys in %s: %q, want %q", path, got, want)
+		}
+	}
+
+	// Replay merges the logs back into the order the events were written,
+	// and numbering goes on after the last of them
+	r, replayed := openRouted(t, dir, routes)
+	if len(replayed) != len(writes) {
+		t.Fatalf("%d events replayed of %d", len(replayed), len(writes))
+	}
+	for i, e := range replayed {
+		w := writes[i]
+		if e.Sequence != w.Sequence || e.EventType != w.EventType || e.Bucket != w.Bucket || e.Key != w.Key || e.Value != w.Value {
+			t.Errorf("replayed #%d: %+v, want %+v", i, e, w)
+		}
+	}
+
+	if err := r.WriteEvent(ctx, Event{EventType: EventPut, Bucket: DefaultBucket, Key: "cache/2", Value: "h"}); err != nil {
+		t.Fatal(err)
+	}
+	closeRouted(t, r)
+	if seq := r.LastSequence(); seq != uint64(len(writes)+1) {
+		t.Errorf("sequence %d numbered after a replay of %d events", seq, len(writes))
+	}
+}
+
+func TestRoutedLogsRotateAndTrimIndependently(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	routes := []LogRoute{
+		{Name: "cache", Prefixes: []string{"cache/"}, RotateBytes: 256, Retain: time.Hour},
+		{Name: "billing", Prefixes: []string{"billing/"}},
+	}
+
+	r, _ := openRouted(t, dir, routes)
+	defer closeRouted(t, r)
+
+	// write puts n values of each of keys, flushing them
+	write := func(n int, keys ...string) {
+		t.Helper()
+
+		for i := range n {
+			for _, key := range keys {
+				if err := r.WriteEvent(ctx, Event{EventType: EventPut, Bucket: DefaultBucket, Key: key, Value: strings.Repeat("v", 50) + fmt.Sprint(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := r.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// maintain runs a round of maintenance of every routed log
+	maintain := func() {
+		t.Helper()
+
+		for _, l := range r.logs[1:] {
+			if err := l.maintain(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// segments returns the rotated segments of the log at path
+	segments := func(path string) []string {
+		t.Helper()
+
+		files, err := SegmentFiles(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return files[:len(files)-1]
+	}
+
+	cache, billing, fallback := RoutedLogPath(dir, "cache"), RoutedLogPath(dir, "billing"), filepath.Join(dir, LogFileName)
+
+	// Only the log past its size is rotated
+	write(10, "cache/k", "billing/k", "other")
+	maintain()
+
+	if n := len(segments(cache)); n != 1 {
+		t.Errorf("%d segments of the cache log after it outgrew its size", n)
+	}
+	for _, path := range []string{billing, fallback} {
+		if n := len(segments(path)); n != 0 {
+			t.Errorf("%d segments of %s, which has no rotation", n, path)
+		}
+	}
+
+	write(10, "cache/k")
+	maintain()
+
+	old := segments(cache)
+	if len(old) != 2 {
+		t.Fatalf("segments of the cache log: %q", old)
+	}
+
+	// Only the segments older than the retention are removed, oldest first
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old[0], past, past); err != nil {
+		t.Fatal(err)
+	}
+	maintain()
+
+	if got := segments(cache); len(got) != 1 || got[0] != old[1] {
+		t.Errorf("segments of the cache log after trimming: %q, want %q", got, old[1:])
+	}
+	if keys := keysIn(t, billing); len(keys) != 10 {
+		t.Errorf("%d events left in the billing log, want 10", len(keys))
+	}
+}
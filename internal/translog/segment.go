@@ -0,0 +1,136 @@
+package translog
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// segmentDigits is the width of the sequence number in a segment's name,
+// zero-padded so that segments sort in the order they were written.
+const segmentDigits = 20
+
+// Rotator is implemented by loggers whose log can be split into segments.
+type Rotator interface {
+	// Rotate closes the segment being written, synced to disk, and starts
+	// a new one. Events enqueued before the call end up in the old one.
+	Rotate(ctx context.Context) error
+}
+
+// segmentName returns the name a segment of the log at path is rotated to:
+// the path followed by the sequence number of its last event.
+func segmentName(path string, last uint64) string {
+	return fmt.Sprintf("%s.%0*d", path, segmentDigits, last)
+}
+
+// segmentSequence returns the sequence of the last event in the rotated
+// segment name of the log at path, or false if name isn't one.
+func segmentSequence(path, name string) (uint64, bool) {
+	suffix, ok := strings.CutPrefix(name, path+".")
+	if !ok || len(suffix) != segmentDigits {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(suffix, 10, 64)
+
+	return seq, err == nil
+}
+
+// SegmentFiles returns the files of the log at path in the order they were
+// written: the segments rotated out of it, then the log itself, which may
+// not exist.
+func SegmentFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, name := range matches {
+		if _, ok := segmentSequence(path, name); ok {
+			files = append(files, name)
+		}
+	}
+
+	sort.Strings(files)
+
+	return append(files, path), nil
+}
+
+// nextSegment returns the first file of the log at path that can hold
+// events after sequence after: the oldest rotated segment ending past it,
+// or else the log itself.
+func nextSegment(path string, after uint64) (string, error) {
+	files, err := SegmentFiles(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range files[:len(files)-1] {
+		if last, _ := segmentSequence(path, name); last > after {
+			return name, nil
+		}
+	}
+
+	return path, nil
+}
+
+// renameIndexed renames the log file from to to, with its entries in the
+// sparse index, under the index's lock.
+func (l *FileTransactionLogger) renameIndexed(from, to string) error {
+	l.index.mu.Lock()
+	defer l.index.mu.Unlock()
+
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	l.index.move(from, to)
+
+	return nil
+}
+
+// Rotate renames the log to a segment named after its last sequence number
+// and starts a new, empty log in its place. Replay reads the segments
+// before the log, so nothing is lost. An empty log isn't rotated.
+func (l *FileTransactionLogger) Rotate(ctx context.Context) error {
+	return sendMarker(ctx, l.life, "translog.Rotate", Event{rotate: true})
+}
+
+// rotate performs a Rotate for the writer goroutine. The old segment is
+// synced and renamed before the new log is opened; if anything fails, the
+// writer carries on with the segment it had.
+func (l *FileTransactionLogger) rotate() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	segment := segmentName(l.path, l.lastSequence)
+	if err := l.renameIndexed(l.path, segment); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		l.renameIndexed(segment, l.path)
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+
+	old := l.file
+	l.file = file
+	l.size = 0
+
+	return cmp.Or(old.Close(), l.saveHighWater())
+}
@@ -0,0 +1,285 @@
+package translog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLines writes a log at path holding puts of the sequences seqs, in
+// order.
+func writeLines(t *testing.T, path string, seqs ...uint64) {
+	t.Helper()
+
+	var b []byte
+	for _, seq := range seqs {
+		b = appendEvent(b, Event{Sequence: seq, EventType: EventPut, Bucket: DefaultBucket, Key: fmt.Sprintf("k%d", seq), Value: "v"})
+	}
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replaySequences reads the log at path with l, returning the sequences of
+// its events and the error that stopped the read.
+func replaySequences(l TransactionLogger) ([]uint64, error) {
+	var seqs []uint64
+
+	events, errs := l.ReadEvents()
+	for e := range events {
+		seqs = append(seqs, e.Sequence)
+	}
+
+	return seqs, <-errs
+}
+
+// writeNext writes a put to the running l, returning the sequence it was
+// given once it's durable.
+func writeNext(t *testing.T, l TransactionLogger) uint64 {
+	t.Helper()
+
+	ctx := context.Background()
+	if err := l.WritePutCtx(ctx, "next", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return l.(Sequencer).LastSequence()
+}
+
+func TestReplayToleratesGaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LogFileName)
+	writeLines(t, path, 1, 2, 5, 9)
+
+	l, replayed := openFileLog(t, path)
+	defer l.Close(context.Background())
+
+	if fmt.Sprint(sequences(replayed)) != "[1 2 5 9]" {
+		t.Errorf("replayed %v, want every event of a log with gaps", sequences(replayed))
+	}
+
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := writeNext(t, l); seq != 10 {
+		t.Errorf("the write after replay got sequence %d, want 10", seq)
+	}
+}
+
+func TestRestartAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, LogFileName)
+
+	// Compaction leaves an empty log continuing from its snapshot's
+	// sequence
+	if err := WriteLogMeta(path, LogMeta{After: 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, replayed := openFileLog(t, path)
+	if len(replayed) != 0 {
+		t.Errorf("an empty compacted log replayed %v", sequences(replayed))
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := writeNext(t, l); seq != 51 {
+		t.Errorf("the first write after compaction got sequence %d, want 51", seq)
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarting replays the tail and carries on numbering after it
+	l, replayed = openFileLog(t, path)
+	if fmt.Sprint(sequences(replayed)) != "[51]" {
+		t.Errorf("the compacted log replayed %v, want [51]", sequences(replayed))
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := writeNext(t, l); seq != 52 {
+		t.Errorf("the write after a restart got sequence %d, want 52", seq)
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tail may start with a gap, but not at or before the compacted
+	// events
+	writeLines(t, path, 55, 56)
+	l, replayed = openFileLog(t, path)
+	l.Close(context.Background())
+	if fmt.Sprint(sequences(replayed)) != "[55 56]" {
+		t.Errorf("the compacted log replayed %v, want [55 56]", sequences(replayed))
+	}
+
+	writeLines(t, path, 40, 56)
+	l, err := NewFileTransactionLogger(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(context.Background())
+
+	if _, err := replaySequences(l); err == nil || !strings.Contains(err.Error(), "sequence 40 out of order, doesn't follow 50") {
+		t.Errorf("replaying a compacted log starting before its snapshot: %v", err)
+	}
+}
+
+func TestReplayRejectsAnOutOfOrderLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LogFileName)
+	writeLines(t, path, 1, 2, 3, 2, 4)
+
+	l, err := NewFileTransactionLogger(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var damage []Damage
+	l.(DamageReporter).ReportDamage(func(d Damage) { damage = append(damage, d) }, false)
+
+	// The log is corrupt, so replay stops at the record out of order
+	seqs, err := replaySequences(l)
+	if err == nil || !strings.Contains(err.Error(), "line 4: sequence 2 out of order, doesn't follow 3") {
+		t.Errorf("replaying an out-of-order log: %v", err)
+	}
+	if fmt.Sprint(seqs) != "[1 2 3]" || len(damage) != 1 || damage[0].Line != 4 {
+		t.Errorf("replayed %v before failing, reporting %v", seqs, damage)
+	}
+	l.Close(context.Background())
+
+	// Told to skip damage, replay leaves the record out and numbering
+	// carries on after the last good one
+	l, err = NewFileTransactionLogger(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close(context.Background())
+
+	damage = nil
+	l.(DamageReporter).ReportDamage(func(d Damage) { damage = append(damage, d) }, true)
+
+	seqs, err = replaySequences(l)
+	if err != nil || fmt.Sprint(seqs) != "[1 2 3 4]" || len(damage) != 1 {
+		t.Errorf("replaying with damage skipped: %v, %v, reporting %v", seqs, err, damage)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := writeNext(t, l); seq != 5 {
+		t.Errorf("the write after replay got sequence %d, want 5", seq)
+	}
+}
+
+// tearLastLine cuts the last line of the log at path short, as a crash
+// while writing it would.
+func tearLastLine(t *testing.T, path string) {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequencesNeverGoBack(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, LogFileName)
+
+	// restart opens the log again and writes n events to it, checking each
+	// is numbered after every sequence numbered before
+	var last uint64
+	restart := func(when string, n int) TransactionLogger {
+		t.Helper()
+
+		l, _ := openFileLog(t, path)
+		if err := l.Run(); err != nil {
+			t.Fatal(err)
+		}
+		for range n {
+			seq := writeNext(t, l)
+			if seq <= last {
+				t.Fatalf("a write %s got sequence %d, after %d was numbered", when, seq, last)
+			}
+			last = seq
+		}
+
+		return l
+	}
+
+	l := restart("to a new log", 3)
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last event is lost to a torn line, but not its number
+	tearLastLine(t, path)
+	l = restart("after a torn last line", 1)
+
+	// A rotated segment archived away takes its events with it
+	if err := l.(Rotator).Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, LogFileName+".*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("rotated segments %v, %v", files, err)
+	}
+	if err := os.Rename(files[0], filepath.Join(t.TempDir(), "archived")); err != nil {
+		t.Fatal(err)
+	}
+	l = restart("after the segment was archived", 2)
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A compaction empties the log after a snapshot of an earlier
+	// sequence, and a crash then tears the first event after it
+	m, err := ReadLogMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.After = last - 1
+	if err := WriteLogMeta(path, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	l = restart("after compaction", 1)
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tearLastLine(t, path)
+	l = restart("after compaction and a torn line", 1)
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if hw, err := HighWater(path); err != nil || hw != last || last != 8 {
+		t.Errorf("the high-water sequence of the stopped log is %d, %v; %d were numbered, want 8", hw, err, last)
+	}
+}
+
+// sequences returns the sequences of events.
+func sequences(events []Event) []uint64 {
+	seqs := make([]uint64, len(events))
+	for i, e := range events {
+		seqs[i] = e.Sequence
+	}
+
+	return seqs
+}
@@ -0,0 +1,128 @@
+package translog
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openFileLog returns the file log at path with its events replayed, and
+// those events.
+func openFileLog(t *testing.T, path string) (TransactionLogger, []Event) {
+	t.Helper()
+
+	l, err := NewFileTransactionLogger(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []Event
+	events, errs := l.ReadEvents()
+	for e := range events {
+		replayed = append(replayed, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	return l, replayed
+}
+
+func TestCloseSpillsWhatASlowLogCantWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LogFileName)
+
+	l, _ := openFileLog(t, path)
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large values make the log slow to write, so the queue is still full
+	// when shutdown gives up on it
+	const writers, perWriter = 4, 12
+	value := strings.Repeat("x", 4<<20)
+
+	var mu sync.Mutex
+	var acknowledged []string
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				key := string(rune('a'+w)) + strings.Repeat("+", i)
+				if err := l.WritePutCtx(context.Background(), key, value); err != nil {
+					return // Closed under it; never acknowledged
+				}
+
+				mu.Lock()
+				acknowledged = append(acknowledged, key)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Shutdown starts once the queue has filled, and allows the log 1ms
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), PendingFileName)); err != nil {
+		t.Fatalf("nothing spilled: %v", err)
+	}
+
+	// The restart replays every acknowledged event, the spilled ones after
+	// the others, and folds them into the log
+	l, replayed := openFileLog(t, path)
+
+	seen := make(map[string]bool)
+	for i, e := range replayed {
+		if e.Sequence != uint64(i+1) {
+			t.Fatalf("event %d replayed with sequence %d", i+1, e.Sequence)
+		}
+		if e.Value != value {
+			t.Fatalf("event %d replayed with a value of %d bytes", e.Sequence, len(e.Value))
+		}
+		seen[e.Key] = true
+	}
+	for _, key := range acknowledged {
+		if !seen[key] {
+			t.Errorf("acknowledged put of %s lost", key)
+		}
+	}
+	if len(replayed) != len(acknowledged) {
+		t.Errorf("replayed %d events, %d were acknowledged", len(replayed), len(acknowledged))
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), PendingFileName)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s left after replay: %v", PendingFileName, err)
+	}
+
+	// Numbering carries on after the spilled events
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WritePutCtx(context.Background(), "after", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, replayed = openFileLog(t, path)
+	if last := replayed[len(replayed)-1]; last.Key != "after" || last.Sequence != uint64(len(acknowledged)+1) {
+		t.Errorf("the write after the restart replayed as %s at %d, want after at %d", last.Key, last.Sequence, len(acknowledged)+1)
+	}
+}
@@ -0,0 +1,255 @@
+package translog
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+)
+
+// DefaultTopChurners is how many of the keys with the most records a
+// LogStats lists, unless asked otherwise.
+const DefaultTopChurners = 10
+
+// LogStats is an analysis of how much of a transaction log is still needed:
+// how its records are spread over the keys, and how large a log holding
+// only the live data would be. Sizes are those of the records as the file
+// log writes them, whichever backend the log is read from.
+type LogStats struct {
+	Sequence      uint64           `json:"sequence"` // Last event counted
+	Records       int64            `json:"records"`
+	RecordsByType map[string]int64 `json:"records_by_type"` // By put, delete, drop_bucket, rename_bucket and lease
+	Bytes         int64            `json:"bytes"`
+
+	DistinctKeys   int64   `json:"distinct_keys"`   // Keys with any record
+	LiveKeys       int64   `json:"live_keys"`       // Keys that exist after the last event
+	Overwrites     int64   `json:"overwrites"`      // Puts of keys that already existed
+	OverwriteRatio float64 `json:"overwrite_ratio"` // Overwrites per put
+
+	DeletedKeyBytes int64 `json:"deleted_key_bytes"` // Records of the keys that no longer exist, and of the drops of their buckets
+
+	// EstimatedCompactedBytes is the size of a log holding only the last
+	// put of every live key, and the lease it's held under, if any.
+	// Amplification is Bytes over it
+	EstimatedCompactedBytes int64   `json:"estimated_compacted_bytes"`
+	Amplification           float64 `json:"amplification"`
+
+	TopChurners []KeyChurn `json:"top_churners"` // The keys with the most records, most first
+}
+
+// KeyChurn counts the records of a key.
+type KeyChurn struct {
+	Bucket         string  `json:"bucket"`
+	Key            string  `json:"key"`
+	Records        int64   `json:"records"`
+	Puts           int64   `json:"puts"`
+	Overwrites     int64   `json:"overwrites"`
+	OverwriteRatio float64 `json:"overwrite_ratio"`
+	Bytes          int64   `json:"bytes"`
+	Live           bool    `json:"live"`
+}
+
+// keyTally is what a LogAnalyzer keeps of a key: counts, not values.
+type keyTally struct {
+	records, puts, overwrites, bytes int64
+
+	put   int64 // Size of the last put while the key exists
+	lease int64 // Size of the last lease granted while the key exists
+	live  bool
+}
+
+// LogAnalyzer computes the LogStats of a log from its events, one at a
+// time, so that the log is streamed rather than loaded. It keeps counts for
+// every distinct key, so its memory grows with the keys, not the records
+// or their values.
+type LogAnalyzer struct {
+	upTo  uint64
+	stats LogStats
+	keys  map[string]map[string]*keyTally // By bucket and key
+	buf   []byte                          // Reused to size records
+}
+
+// NewLogAnalyzer returns an analyzer counting the events up to sequence
+// upTo, or every event if 0.
+func NewLogAnalyzer(upTo uint64) *LogAnalyzer {
+	return &LogAnalyzer{
+		upTo:  upTo,
+		stats: LogStats{RecordsByType: make(map[string]int64)},
+		keys:  make(map[string]map[string]*keyTally),
+	}
+}
+
+// Add counts e, unless it comes after the analyzer's last sequence. Its
+// signature suits ScanLog and ScanPostgres.
+func (a *LogAnalyzer) Add(e Event) error {
+	if a.upTo != 0 && e.Sequence > a.upTo {
+		return nil
+	}
+
+	a.buf = appendEvent(a.buf[:0], e)
+	size := int64(len(a.buf))
+
+	a.stats.Sequence = max(a.stats.Sequence, e.Sequence)
+	a.stats.Records++
+	a.stats.RecordsByType[eventTypeName(e.EventType)]++
+	a.stats.Bytes += size
+
+	bucket := cmp.Or(e.Bucket, DefaultBucket)
+
+	if e.EventType == EventDropBucket {
+		for _, t := range a.keys[bucket] {
+			t.live, t.put, t.lease = false, 0, 0
+		}
+		a.stats.DeletedKeyBytes += size
+		return nil
+	}
+
+	if e.EventType == EventRenameBucket {
+		// The keys live on in the other bucket, where a compacted log
+		// would have put them in the first place
+		for key, t := range a.keys[bucket] {
+			if t.live {
+				moved := a.tally(e.Value, key)
+				moved.live, moved.put, moved.lease = true, t.put, t.lease
+				t.live, t.put, t.lease = false, 0, 0
+			}
+		}
+		return nil
+	}
+
+	t := a.tally(bucket, e.Key)
+	t.records++
+	t.bytes += size
+
+	switch e.EventType {
+	case EventPut:
+		t.puts++
+		if t.live {
+			t.overwrites++
+		}
+		t.live, t.put = true, size
+	case EventDelete, EventEvict:
+		t.live, t.put, t.lease = false, 0, 0
+	case EventLease:
+		t.lease = 0
+		if t.live && e.Value != "" {
+			t.lease = size
+		}
+	}
+
+	return nil
+}
+
+// tally returns the counts of key, adding them if it's new.
+func (a *LogAnalyzer) tally(bucket, key string) *keyTally {
+	b, ok := a.keys[bucket]
+	if !ok {
+		b = make(map[string]*keyTally)
+		a.keys[bucket] = b
+	}
+
+	t, ok := b[key]
+	if !ok {
+		t = &keyTally{}
+		b[key] = t
+	}
+
+	return t
+}
+
+// Stats returns the stats of the events added, with the top keys by number
+// of records, or none if top is 0.
+func (a *LogAnalyzer) Stats(top int) LogStats {
+	stats := a.stats
+	stats.TopChurners = []KeyChurn{}
+
+	var puts int64
+	for bucket, keys := range a.keys {
+		for key, t := range keys {
+			if t.records > 0 { // Unless only moved there by a bucket rename
+				stats.DistinctKeys++
+			}
+			stats.Overwrites += t.overwrites
+			puts += t.puts
+
+			if t.live {
+				stats.LiveKeys++
+				stats.EstimatedCompactedBytes += t.put + t.lease
+			} else {
+				stats.DeletedKeyBytes += t.bytes
+			}
+
+			if top > 0 && t.records > 0 {
+				stats.TopChurners = topChurners(stats.TopChurners, churn(bucket, key, t), top)
+			}
+		}
+	}
+
+	stats.OverwriteRatio = ratio(stats.Overwrites, puts)
+	stats.Amplification = ratio(stats.Bytes, stats.EstimatedCompactedBytes)
+
+	return stats
+}
+
+func churn(bucket, key string, t *keyTally) KeyChurn {
+	return KeyChurn{
+		Bucket:         bucket,
+		Key:            key,
+		Records:        t.records,
+		Puts:           t.puts,
+		Overwrites:     t.overwrites,
+		OverwriteRatio: ratio(t.overwrites, t.puts),
+		Bytes:          t.bytes,
+		Live:           t.live,
+	}
+}
+
+// topChurners adds c to top, which holds the top keys so far in order,
+// keeping at most n of them.
+func topChurners(top []KeyChurn, c KeyChurn, n int) []KeyChurn {
+	before := func(a, b KeyChurn) int {
+		return cmp.Or(cmp.Compare(b.Records, a.Records), cmp.Compare(a.Bucket, b.Bucket), cmp.Compare(a.Key, b.Key))
+	}
+
+	i, _ := slices.BinarySearchFunc(top, c, before)
+	if i >= n {
+		return top
+	}
+
+	top = slices.Insert(top, i, c)
+
+	return top[:min(len(top), n)]
+}
+
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+
+	return float64(a) / float64(b)
+}
+
+// eventTypeName names t in LogStats.
+func eventTypeName(t EventType) string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventDropBucket:
+		return "drop_bucket"
+	case EventRenameBucket:
+		return "rename_bucket"
+	case EventLease:
+		return "lease"
+	case EventImmutable:
+		return "immutable"
+	case EventExpire:
+		return "expire"
+	case EventEvict:
+		return "evict"
+	case EventOriginalKey:
+		return "original_key"
+	default:
+		return strconv.Itoa(int(t))
+	}
+}
@@ -0,0 +1,1080 @@
+// Package translog records the store's mutations in a transaction log and
+// reads them back for replay. Events can be logged to a file, to Postgres,
+// or discarded.
+package translog
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/timing"
+	"github.com/sheritzs/key-value-store/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultBucket is the bucket of events that don't name one. Events in it
+// are logged in the format used before buckets existed.
+const DefaultBucket = "default"
+
+// LogFileName is the name of the file backend's log in a data directory.
+const LogFileName = "transaction.log"
+
+// PendingFileName is the name of the file, next to the log, that Close
+// spills the events it had no time to write to. They are appended to the
+// log when it is next read.
+const PendingFileName = "transaction.pending"
+
+// ProbeFileName is the name of the file, next to the log, that a log
+// refusing writes while it is unhealthy writes now and then, to find when it
+// could write again. It is removed straight away.
+const ProbeFileName = "transaction.probe"
+
+// ErrorOutOfOrder is reported for an event numbered at or below one already
+// in the log. Replay would apply it before the events it came after, so it
+// is refused rather than written.
+var ErrorOutOfOrder = errors.New("event out of order")
+
+type EventType byte
+
+const (
+	_                     = iota
+	EventDelete EventType = iota
+	EventPut
+	EventDropBucket
+	EventLease        // Value is a lease formatted by FormatLease, or empty for a release
+	EventRenameBucket // Value is the bucket the keys of Bucket move to, over those it has
+	EventImmutable    // Makes Key write-once, as it was just put; Value is empty
+	EventExpire       // Sets the time Key expires, as it was just put; Value is formatted by FormatExpiry
+	EventEvict        // Deletes Key to keep the store under its size cap; Value is empty
+	EventOriginalKey  // Records the form Key was given in, as it was just created under a key folding; Value is that form
+)
+
+// FormatLease returns the value of the lease event granting key to owner
+// until deadline: the deadline in RFC 3339 format with nanoseconds, in UTC,
+// a space, and the owner.
+func FormatLease(owner string, deadline time.Time) string {
+	return deadline.UTC().Format(time.RFC3339Nano) + " " + owner
+}
+
+// ParseLease parses a lease written by FormatLease.
+func ParseLease(value string) (owner string, deadline time.Time, err error) {
+	deadlineField, owner, ok := strings.Cut(value, " ")
+	if !ok || owner == "" {
+		return "", deadline, fmt.Errorf("invalid lease %q: expected deadline and owner", value)
+	}
+
+	if deadline, err = time.Parse(time.RFC3339Nano, deadlineField); err != nil {
+		return "", deadline, fmt.Errorf("invalid lease deadline: %w", err)
+	}
+
+	return owner, deadline, nil
+}
+
+// FormatExpiry returns the value of the expiry event of a key expiring at
+// deadline: the deadline in RFC 3339 format with nanoseconds, in UTC, as
+// for a lease.
+func FormatExpiry(deadline time.Time) string {
+	return deadline.UTC().Format(time.RFC3339Nano)
+}
+
+// ParseExpiry parses an expiry written by FormatExpiry.
+func ParseExpiry(value string) (time.Time, error) {
+	deadline, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return deadline, fmt.Errorf("invalid expiry: %w", err)
+	}
+
+	return deadline, nil
+}
+
+// ValidContentType reports whether mediaType can be logged as the media
+// type of a put: it is text, as IsText decides, without control characters.
+func ValidContentType(mediaType string) bool {
+	return IsText(mediaType) && strings.IndexFunc(mediaType, unicode.IsControl) < 0
+}
+
+// IsText reports whether value can be kept as is where text is expected,
+// such as in the file log or a TEXT column of Postgres: it is valid UTF-8,
+// without NUL bytes. Other values are base64-encoded there.
+func IsText(value string) bool {
+	return utf8.ValidString(value) && strings.IndexByte(value, 0) < 0
+}
+
+type Event struct {
+	Sequence  uint64         // Unique record ID
+	EventType EventType      // Action taken
+	Bucket    string         // Bucket the key belongs to
+	Key       string         // Key affected by the transaction
+	Value     string         // Value of the transaction, compressed with Codec
+	Codec     compress.Codec // Compression applied to Value
+	Time      time.Time      // When the write was made; zero in logs older than timestamps
+
+	ContentType string // Media type of the value of a put; empty if it has none
+
+	spanContext trace.SpanContext // Span that enqueued the event, if traced
+	flushed     chan<- error      // Set on the markers enqueued by Flush and Rotate
+	rotate      bool              // Whether a marker is for Rotate
+}
+
+// TransactionLogger is a transaction log. Each logger goes through its
+// lifecycle once, in order:
+//
+//  1. Constructed: ReadEvents may be called, once.
+//  2. Replayed, once the ReadEvents channels are closed: Run may be called,
+//     once, unless reading failed.
+//  3. Running: events may be written, and Flush called.
+//  4. Closed, by Close, which may be called in any state, once.
+//
+// Calls out of this order return an error wrapping ErrorLifecycle, or
+// ErrorClosed after Close, rather than blocking; WritePut and WriteDelete,
+// which can't return one, drop the event with a warning. Close during
+// replay stops the reader, whose error channel then reports ErrorClosed.
+// The write methods, Flush and Err are safe for concurrent use, including
+// with Close.
+type TransactionLogger interface {
+	WriteDelete(key string)
+	WritePut(key, value string)
+
+	// Err returns the channel write failures are reported on once the
+	// logger runs. It is closed when the logger is.
+	Err() <-chan error
+
+	// WriteDeleteCtx and WritePutCtx are like WriteDelete and WritePut, but
+	// give up with ctx.Err() if ctx is done before the event is enqueued.
+	// An event that was not enqueued is never written.
+	WriteDeleteCtx(ctx context.Context, key string) error
+	WritePutCtx(ctx context.Context, key, value string) error
+
+	// WriteEvent enqueues an arbitrary event, with the same cancellation
+	// semantics as WritePutCtx. The logger assigns the sequence number,
+	// unless e.Sequence is already set, as it is for events replicated
+	// from a leader; it must then be above every sequence logged so far.
+	//
+	// Events are written in the order they are enqueued, by a single
+	// writer, so callers that enqueue while holding a lock over the state
+	// they change get a log that replays in the order they applied it.
+	WriteEvent(ctx context.Context, e Event) error
+
+	// Flush waits until every event enqueued before it is durable: written
+	// and, for the file backend, synced to disk. It returns the first write
+	// failure since the previous Flush, if any. It gives up with ctx.Err()
+	// if ctx is done first, which leaves the events ahead of it to be
+	// persisted regardless: they must be taken as written, only not yet
+	// known to be durable.
+	Flush(ctx context.Context) error
+
+	ReadEvents() (<-chan Event, <-chan error)
+
+	// Run starts writing the events enqueued from now on, numbering them
+	// after the last one read by ReadEvents.
+	Run() error
+
+	// Close waits for the events already enqueued to be written, then
+	// releases the log. Nothing may be written once Close is called. If
+	// ctx is done first, the file backend spills the remaining events to
+	// PendingFileName; the others give up on them.
+	Close(ctx context.Context) error
+}
+
+type FileTransactionLogger struct {
+	life         *lifecycle    // Lifecycle state and the queue of events for the writer
+	errors       chan error    // Write errors; closed once the writer exits, or by Close if it never ran
+	lastSequence uint64        // Last used event sequence number
+	file         *os.File      // Transaction log	location
+	path         string        // Name of the log; rotated segments are named after it
+	health       *Health       // Tracks write failures; may be nil
+	done         chan struct{} // Closed once the writer goroutine exits
+	spill        chan struct{} // Closed to have the writer spill what's left
+	damage       func(Damage)  // Told of damaged records by ReadEvents; may be nil
+	skipDamage   bool          // Whether ReadEvents skips damaged records instead of failing
+	highWater    uint64        // High-water sequence last read from or written to the log's metadata
+	index        *seqIndex     // Offsets of the events in the log's files, for ReadChanges
+	size         int64         // Of the log file, where the writer writes the next event
+}
+
+func (l *FileTransactionLogger) WritePut(key, value string) {
+	dropOnError(l.WritePutCtx(context.Background(), key, value))
+}
+
+func (l *FileTransactionLogger) WriteDelete(key string) {
+	dropOnError(l.WriteDeleteCtx(context.Background(), key))
+}
+
+func (l *FileTransactionLogger) WritePutCtx(ctx context.Context, key, value string) error {
+	return sendEvent(ctx, l.life, l.health, Event{EventType: EventPut, Bucket: DefaultBucket, Key: key, Value: value})
+}
+
+func (l *FileTransactionLogger) WriteDeleteCtx(ctx context.Context, key string) error {
+	return sendEvent(ctx, l.life, l.health, Event{EventType: EventDelete, Bucket: DefaultBucket, Key: key})
+}
+
+func (l *FileTransactionLogger) WriteEvent(ctx context.Context, e Event) error {
+	return sendEvent(ctx, l.life, l.health, e)
+}
+
+func (l *FileTransactionLogger) Flush(ctx context.Context) error {
+	return sendMarker(ctx, l.life, "translog.Flush", Event{})
+}
+
+func (l *FileTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// dropOnError warns that an event given to WritePut or WriteDelete, which
+// can't return an error, was dropped for err.
+func dropOnError(err error) {
+	if err != nil {
+		log.Printf("WARNING: transaction log event dropped: %v\n", err)
+	}
+}
+
+// sendEvent enqueues e on the queue of the logger with lifecycle lc unless
+// ctx is done first. A context that is already done never enqueues, even if
+// the queue has room. Events are refused with ErrorUnhealthy while health
+// says writes should be rejected, and with ErrorLifecycle or ErrorClosed
+// unless the logger is running.
+func sendEvent(ctx context.Context, lc *lifecycle, health *Health, e Event) (err error) {
+	ctx, span := tracing.Start(ctx, "translog.Enqueue", e.Bucket, e.Key)
+	defer func() { tracing.End(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := health.checkWrite(); err != nil {
+		return err
+	}
+
+	e.spanContext = span.SpanContext()
+
+	return lc.send(ctx, e)
+}
+
+// sendMarker enqueues the Flush or Rotate marker m on the queue of the
+// logger with lifecycle lc and waits for the writer to act on it, unless ctx
+// is done first; the writer then acts on it all the same.
+func sendMarker(ctx context.Context, lc *lifecycle, name string, m Event) (err error) {
+	ctx, span := tracing.Start(ctx, name, "", "")
+	defer func() { tracing.End(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	flushed := make(chan error, 1)
+	m.flushed = flushed
+
+	if err := lc.send(ctx, m); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-flushed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startWriteSpan starts the span covering the backend write of e, as a child
+// of the span that enqueued it.
+func startWriteSpan(name string, e Event) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), e.spanContext)
+	_, span := tracing.Start(ctx, name, e.Bucket, e.Key)
+
+	return span
+}
+
+// NewFileTransactionLogger opens the transaction log file, creating it if
+// needed. Write results are reported to health, which may be nil. Numbering
+// continues from where the log's MetaFileName says it starts, so that after
+// a compaction the first event read, or written to an empty log, must come
+// after the compacted ones, and once the log is replayed, from its recorded
+// high-water sequence if that is further: events skipped as damaged, or
+// moved aside by a recovery, keep their numbers.
+func NewFileTransactionLogger(filename string, health *Health) (TransactionLogger, error) { // construction function
+	meta, err := ReadLogMeta(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+
+	l := &FileTransactionLogger{
+		life:         newLifecycle(),
+		errors:       make(chan error, 1),
+		file:         file,
+		path:         filename,
+		health:       health,
+		lastSequence: meta.After,
+		highWater:    meta.HighWater,
+		index:        newSeqIndex(),
+	}
+	health.setProbe(l.probe)
+
+	return l, nil
+}
+
+// probe checks whether the log's directory takes writes again, by writing a
+// block to ProbeFileName, syncing it, and removing it.
+func (l *FileTransactionLogger) probe() error {
+	if l.life.closed() {
+		return ErrorClosed
+	}
+
+	path := filepath.Join(filepath.Dir(l.path), ProbeFileName)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	_, err = f.Write(make([]byte, 4096))
+
+	return cmp.Or(err, f.Sync(), f.Close())
+}
+
+// Close stops the writer once it has written every enqueued event, records
+// the last sequence numbered in MetaFileName, and closes the file. If ctx
+// is done first, the writer finishes the write in progress and spills the
+// rest to PendingFileName, which is much faster than waiting on a slow
+// log. A replay still reading is stopped first.
+func (l *FileTransactionLogger) Close(ctx context.Context) error {
+	prev, err := l.life.stop()
+	if err != nil {
+		return err
+	}
+
+	if prev != stateRunning {
+		close(l.errors) // The writer never ran to close it
+
+		return l.file.Close()
+	}
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		close(l.spill)
+		<-l.done
+	}
+
+	return cmp.Or(l.saveHighWater(), l.file.Close())
+}
+
+// LastSequence implements Sequencer.
+func (l *FileTransactionLogger) LastSequence() uint64 {
+	return l.lastSequence
+}
+
+// LogMeta implements MetaReader. It reads the metadata again, so it may be
+// called at any time.
+func (l *FileTransactionLogger) LogMeta() (LogMeta, error) {
+	return ReadLogMeta(l.path)
+}
+
+// saveHighWater records the last sequence numbered in the log's metadata,
+// if it is past the recorded one. It is called on rotation and when Close
+// stops the writer, since the log's own events may stop showing it: a later
+// replay may skip the last of them as damaged, or a recovery move them aside.
+// The metadata is read again first, as a snapshot restored meanwhile may
+// have replaced it.
+func (l *FileTransactionLogger) saveHighWater() error {
+	if l.lastSequence <= l.highWater {
+		return nil
+	}
+
+	m, err := ReadLogMeta(l.path)
+	if err == nil && m.HighWater < l.lastSequence {
+		m.HighWater = l.lastSequence
+		err = WriteLogMeta(l.path, m)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot record the high-water sequence: %w", err)
+	}
+
+	l.highWater = m.HighWater
+
+	return nil
+}
+
+// pendingPath returns the path of the spill file of the log at path.
+func pendingPath(path string) string {
+	return filepath.Join(filepath.Dir(path), PendingFileName)
+}
+
+// maxRetainedLine is the largest line buffer the writer keeps for reuse.
+const maxRetainedLine = 1 << 20
+
+// noteWrite indexes the event of sequence seq, written to the log file in n
+// bytes, and moves the offset of the next event past them. A failed write
+// may have left part of its line, so the offset is read again.
+func (l *FileTransactionLogger) noteWrite(seq uint64, n int, err error) {
+	if err != nil {
+		if info, err := l.file.Stat(); err == nil {
+			l.size = info.Size()
+		}
+		return
+	}
+
+	l.index.note(l.path, seq, l.size)
+	l.size += int64(n)
+}
+
+// Run starts the writer goroutine. The log must have been replayed first.
+func (l *FileTransactionLogger) Run() error {
+	// The events are indexed from the end of those replayed
+	events, err := l.life.start(func() error {
+		info, err := l.file.Stat()
+		if err != nil {
+			return err
+		}
+		l.size = info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	errors := l.errors // Buffered, so one error can be sent without blocking
+
+	l.done = make(chan struct{})
+	l.spill = make(chan struct{})
+
+	go func() { // goroutine to retrieve Event values
+		defer close(l.done)
+		defer close(errors)
+
+		var line []byte
+		var failed error   // First write failure since the last flush
+		var spill *os.File // Where events go once Close runs out of time
+		spilled := 0
+
+		for e := range events {
+			dequeued(e)
+
+			if spill == nil {
+				select {
+				case <-l.spill:
+					var err error
+					if spill, err = os.OpenFile(pendingPath(l.path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+						log.Printf("cannot open %s, still writing to the log: %v\n", PendingFileName, err)
+					}
+				default:
+				}
+			}
+
+			if e.rotate {
+				e.flushed <- l.rotate()
+				continue
+			}
+
+			if e.flushed != nil {
+				t := timing.Begin("file_log", "", "")
+				err := l.file.Sync()
+				t.Phase("sync")
+				t.End()
+
+				if err != nil {
+					l.health.record(err)
+					errors <- err
+				}
+
+				e.flushed <- cmp.Or(failed, err)
+				failed = nil
+
+				continue
+			}
+
+			span := startWriteSpan("translog.FileWrite", e)
+
+			if e.Sequence != 0 && e.Sequence <= l.lastSequence {
+				// Writing it would corrupt replay, which is worse
+				// than losing it
+				err := fmt.Errorf("%w: sequence %d after %d", ErrorOutOfOrder, e.Sequence, l.lastSequence)
+				tracing.End(span, err)
+
+				failed = cmp.Or(failed, err)
+				errors <- err
+
+				continue
+			}
+
+			if e.Sequence == 0 {
+				l.lastSequence++ // Increment sequence number
+				e.Sequence = l.lastSequence
+			} else {
+				l.lastSequence = e.Sequence // Numbered by the store or a leader
+			}
+
+			if e.Time.IsZero() {
+				e.Time = time.Now().UTC() // Unless the store or a leader stamped it
+			}
+
+			// The line buffer is reused across events, and written with
+			// a single call so a line is never interleaved or split
+			line = appendEvent(line[:0], e)
+
+			out := l.file
+			if spill != nil {
+				out = spill
+				spilled++
+			}
+			t := timing.Begin("file_log", e.Bucket, e.Key)
+			n, err := out.Write(line) // Write event to the log
+			t.Phase("write")
+			t.End()
+
+			if spill == nil {
+				l.noteWrite(e.Sequence, n, err)
+			}
+
+			if cap(line) > maxRetainedLine {
+				line = nil // Don't pin the memory of an outsized value
+			}
+
+			tracing.End(span, err)
+			l.health.record(err)
+
+			if err != nil {
+				// Keep going: a later write may succeed once the
+				// cause (a full disk, say) is cleared
+				failed = cmp.Or(failed, err)
+				errors <- err
+			}
+		}
+
+		if spill != nil {
+			if err := cmp.Or(spill.Sync(), spill.Close()); err != nil {
+				errors <- err
+			}
+
+			log.Printf("WARNING: transaction log too slow to close, %d events spilled to %s\n", spilled, PendingFileName)
+		}
+	}()
+
+	return nil
+}
+
+// appendEvent appends e to dst as a single log line, including the trailing
+// newline:
+//
+//	vversion \t sequence[@time] \t type[+codec][/bucket][;content type] \t key \t value
+//
+// The version is RecordVersion. The time is in RFC 3339 format with
+// nanoseconds, in UTC. Events in the default bucket omit the bucket, and
+// uncompressed values omit the codec. Compressed values are base64-encoded,
+// as are uncompressed values that would break the line or aren't text, as
+// IsText decides, which are marked with the "none" codec. So any value,
+// binary included, replays as it was written. Puts without a media type
+// omit the content type.
+//
+// Lines of the versions before 10 have no content type, and those before 5
+// no version field; those written before timestamps existed have no time,
+// and those written before buckets and compression existed, no bucket or
+// codec.
+func appendEvent(dst []byte, e Event) []byte {
+	encode := e.Codec != compress.None || strings.ContainsAny(e.Value, "\r\n") || !IsText(e.Value)
+
+	dst = appendVersion(dst)
+	dst = strconv.AppendUint(dst, e.Sequence, 10)
+
+	if !e.Time.IsZero() {
+		dst = append(dst, '@')
+		dst = e.Time.UTC().AppendFormat(dst, time.RFC3339Nano)
+	}
+
+	dst = append(dst, '\t')
+	dst = strconv.AppendUint(dst, uint64(e.EventType), 10)
+
+	if encode {
+		dst = append(dst, '+')
+		dst = append(dst, e.Codec.String()...)
+	}
+
+	if e.Bucket != "" && e.Bucket != DefaultBucket {
+		dst = append(dst, '/')
+		dst = append(dst, e.Bucket...)
+	}
+
+	if e.ContentType != "" {
+		dst = append(dst, ';')
+		dst = append(dst, e.ContentType...)
+	}
+
+	dst = append(dst, '\t')
+	dst = append(dst, e.Key...)
+	dst = append(dst, '\t')
+
+	if encode {
+		dst = base64.StdEncoding.AppendEncode(dst, []byte(e.Value))
+	} else {
+		dst = append(dst, e.Value...)
+	}
+
+	return append(dst, '\n')
+}
+
+// parseEvent decodes a line written by appendEvent, or by that of any
+// earlier RecordVersion, without its newline. It is strict: anything
+// appendEvent wouldn't have written is an error, rather than an event that
+// replays differently from the one logged. A line of a later version is
+// an error wrapping ErrorNewerVersion.
+func parseEvent(line string) (Event, error) {
+	var e Event
+
+	version, line, err := cutVersion(line)
+	if err != nil {
+		return e, err
+	}
+
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) != 4 {
+		return e, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+
+	seqField, timeField, timed := strings.Cut(fields[0], "@")
+
+	seq, err := strconv.ParseUint(seqField, 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid sequence: %w", err)
+	}
+	if seq == 0 {
+		return e, fmt.Errorf("invalid sequence 0")
+	}
+
+	if timed {
+		if e.Time, err = time.Parse(time.RFC3339Nano, timeField); err != nil {
+			return e, fmt.Errorf("invalid time: %w", err)
+		}
+		// Times are written in UTC; in another zone, one could be in a year
+		// that can't be written back
+		if !strings.HasSuffix(timeField, "Z") {
+			return e, fmt.Errorf("invalid time %q: not in UTC", timeField)
+		}
+	}
+
+	// Media types hold slashes, so the content type is cut off before the
+	// bucket
+	kind := fields[1]
+	if version >= 10 {
+		var typed bool
+		if kind, e.ContentType, typed = strings.Cut(kind, ";"); typed && (e.ContentType == "" || !ValidContentType(e.ContentType)) {
+			return e, fmt.Errorf("invalid content type %q", e.ContentType)
+		}
+	}
+
+	kind, bucket, scoped := strings.Cut(kind, "/")
+	if !scoped {
+		bucket = DefaultBucket
+	} else if bucket == "" || bucket == DefaultBucket || strings.ContainsAny(bucket, "/+") {
+		return e, fmt.Errorf("invalid bucket %q", bucket)
+	}
+
+	kind, codecName, encoded := strings.Cut(kind, "+")
+
+	t, err := strconv.ParseUint(kind, 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("invalid event type: %w", err)
+	}
+
+	e.Sequence = seq
+	e.EventType = EventType(t)
+	e.Bucket = bucket
+	e.Key = fields[2]
+	e.Value = fields[3]
+
+	if encoded {
+		if e.Codec, err = compress.Parse(codecName); err != nil {
+			return e, err
+		}
+
+		value, err := base64.StdEncoding.DecodeString(e.Value)
+		if err != nil {
+			return e, fmt.Errorf("invalid encoded value: %w", err)
+		}
+		e.Value = string(value)
+	}
+
+	switch e.EventType {
+	case EventPut:
+		if e.Key == "" {
+			return e, fmt.Errorf("put with an empty key")
+		}
+	case EventDelete:
+		if e.Key == "" || e.Value != "" || encoded {
+			return e, fmt.Errorf("delete must have a key and no value")
+		}
+	case EventEvict:
+		if e.Key == "" || e.Value != "" || encoded {
+			return e, fmt.Errorf("eviction must have a key and no value")
+		}
+	case EventDropBucket:
+		if e.Key != "" || e.Value != "" || encoded {
+			return e, fmt.Errorf("bucket drop must have no key or value")
+		}
+	case EventRenameBucket:
+		if e.Key != "" || encoded {
+			return e, fmt.Errorf("bucket rename must have no key, and an unencoded value")
+		}
+		if e.Value == "" || e.Value == e.Bucket || strings.ContainsAny(e.Value, "/+\t\r") || !IsText(e.Value) {
+			return e, fmt.Errorf("invalid bucket rename from %q to %q", e.Bucket, e.Value)
+		}
+	case EventImmutable:
+		if e.Key == "" || e.Value != "" || encoded {
+			return e, fmt.Errorf("immutability mark must have a key and no value")
+		}
+	case EventExpire:
+		if e.Key == "" || encoded {
+			return e, fmt.Errorf("expiry must have a key and an uncompressed value")
+		}
+		if _, err := ParseExpiry(e.Value); err != nil {
+			return e, err
+		}
+	case EventOriginalKey:
+		if e.Key == "" || e.Value == "" || encoded || !IsText(e.Value) {
+			return e, fmt.Errorf("original key must have a key and an unencoded value")
+		}
+	case EventLease:
+		if e.Key == "" || e.Codec != compress.None {
+			return e, fmt.Errorf("lease must have a key and an uncompressed value")
+		}
+		if e.Value != "" {
+			if _, _, err := ParseLease(e.Value); err != nil {
+				return e, err
+			}
+		}
+	default:
+		return e, fmt.Errorf("unknown event type %d", e.EventType)
+	}
+
+	if e.ContentType != "" && e.EventType != EventPut {
+		return e, fmt.Errorf("only puts have a content type")
+	}
+
+	return e, nil
+}
+
+// LineSequence returns the sequence of a log line, of any RecordVersion up
+// to the current one, without decoding the rest of it.
+func LineSequence(line string) (uint64, error) {
+	_, line, err := cutVersion(line)
+	if err != nil {
+		return 0, err
+	}
+
+	field, _, _ := strings.Cut(line, "\t")
+	field, _, _ = strings.Cut(field, "@")
+
+	seq, err := strconv.ParseUint(field, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sequence: %w", err)
+	}
+
+	return seq, nil
+}
+
+// EncodeEvent returns the line of the file log holding e, without its
+// newline, for logs kept elsewhere, such as the Raft log of a cluster.
+func EncodeEvent(e Event) []byte {
+	b := appendEvent(nil, e)
+
+	return b[:len(b)-1]
+}
+
+// DecodeEvent decodes a line returned by EncodeEvent, or read from a file
+// log without its newline, as strictly as replay does.
+func DecodeEvent(line string) (Event, error) {
+	return parseEvent(line)
+}
+
+// ReadEvents reads the log from the start, beginning with the segments
+// rotated out of it. Lines have no length limit. A final line without a
+// newline is a write torn by a crash; it is discarded with a warning and cut
+// from the file, so the next event doesn't get appended to it.
+func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	if err := l.life.beginReplay(); err != nil {
+		return failedRead(err)
+	}
+
+	outEvent := make(chan Event)    // An unbuffered Event channel
+	outError := make(chan error, 1) // A buffered error channel
+
+	go func() {
+		defer close(outEvent) // Close the channels when the goroutine ends
+		defer close(outError)
+
+		err := l.readAll(func(e Event) error {
+			return l.life.replay(outEvent, e)
+		})
+
+		l.life.endReplay(err)
+
+		if err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// readAll calls fn for every event in the log, for ReadEvents.
+func (l *FileTransactionLogger) readAll(fn func(Event) error) error {
+	files, err := SegmentFiles(l.path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range files[:len(files)-1] {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("cannot open transaction log segment: %w", err)
+		}
+
+		err = l.readSegment(f, fn)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := l.readSegment(l.file, fn); err != nil {
+		return err
+	}
+
+	if err := l.mergePending(fn); err != nil {
+		return fmt.Errorf("%s: %w", PendingFileName, err)
+	}
+
+	// The events numbered last may be gone, but not their numbers
+	l.lastSequence = max(l.lastSequence, l.highWater)
+
+	return nil
+}
+
+// readSegment calls fn for the events in f, checking that their sequence
+// numbers keep increasing from the previous segment's. Damaged records fail
+// the read unless the logger was told to skip them.
+func (l *FileTransactionLogger) readSegment(f *os.File, fn func(Event) error) error {
+	reader := bufio.NewReader(f)
+
+	var offset int64 // End of the last complete line
+
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			if line != "" {
+				log.Printf("WARNING: discarding torn last line %d of %s (%d bytes)\n", lineNo, f.Name(), len(line))
+
+				if l.damage != nil {
+					l.damage(Damage{File: f.Name(), Line: lineNo, Problem: fmt.Sprintf("torn last line of %d bytes discarded", len(line)), Torn: true})
+				}
+
+				if err := f.Truncate(offset); err != nil {
+					return fmt.Errorf("cannot truncate torn transaction log: %w", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: transaction log read failure: %w", f.Name(), err)
+		}
+
+		start := offset
+		offset += int64(len(line))
+
+		e, err := parseEvent(strings.TrimSuffix(line, "\n"))
+		if errors.Is(err, ErrorNewerVersion) {
+			// Not damage, so never skipped: what the record holds
+			// is only unknown to this binary
+			return fmt.Errorf("%s: line %d: %w", f.Name(), lineNo, err)
+		}
+		if err != nil {
+			if err := l.reportDamage(Damage{File: f.Name(), Line: lineNo, Problem: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Sequence numbers must increase, though not necessarily by
+		// one: an event that failed to be written leaves a gap, and a
+		// compacted log starts after its snapshot
+		if l.lastSequence >= e.Sequence {
+			problem := fmt.Sprintf("sequence %d out of order, doesn't follow %d", e.Sequence, l.lastSequence)
+			if err := l.reportDamage(Damage{File: f.Name(), Line: lineNo, Problem: problem}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		l.lastSequence = e.Sequence // Update last used sequence #
+		l.index.note(f.Name(), e.Sequence, start)
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// mergePending appends the events spilled by the last Close to the log,
+// calling fn for each, then removes the spill file. Events already in the
+// log, from a merge cut short by a crash, are skipped.
+func (l *FileTransactionLogger) mergePending(fn func(Event) error) error {
+	name := pendingPath(l.path)
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	err := scanFile(name, func(e Event) error {
+		if e.Sequence <= l.lastSequence {
+			return nil
+		}
+
+		if _, err := l.file.Write(appendEvent(nil, e)); err != nil {
+			return err
+		}
+		l.lastSequence = e.Sequence
+
+		return fn(e)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// ScanLog calls fn for each event in the log at path, including the
+// segments rotated out of it, stopping at the first error fn returns. Unlike
+// ReadEvents it leaves the files untouched, so it can read the log of a
+// running logger: a torn last line, which may be an event still being
+// written, is skipped rather than cut.
+func ScanLog(path string, fn func(Event) error) error {
+	files, err := SegmentFiles(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		if err := scanFile(name, fn); err != nil {
+			return err
+		}
+	}
+
+	// Events spilled by a Close only exist while the logger is stopped
+	if _, err := os.Stat(pendingPath(path)); err == nil {
+		return scanFile(pendingPath(path), fn)
+	}
+
+	return nil
+}
+
+// scanFile calls fn for each event in a single file of a log.
+func scanFile(name string, fn func(Event) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("transaction log read failure: %w", err)
+		}
+
+		e, err := parseEvent(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return fmt.Errorf("%s: input parse error on line %d: %w", name, lineNo, err)
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadLogTail returns the events in the last maxBytes of the log at path,
+// leaving out the segments rotated out of it, in the order they were
+// logged. Like ScanLog it can read the log of a running logger: the line
+// cut by the start of the window and a torn last line are left out, as are
+// damaged records, which replay and fsck report. Records of a newer version
+// than RecordVersion fail the read.
+func ReadLogTail(path string, maxBytes int64) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	start := max(info.Size()-maxBytes, 0)
+
+	buf := make([]byte, info.Size()-start)
+	if _, err := f.ReadAt(buf, start); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	window := string(buf)
+
+	// A window starting mid-log starts mid-line, unless it's right after a
+	// newline, which only the byte before it can tell
+	if start > 0 {
+		before := make([]byte, 1)
+		if _, err := f.ReadAt(before, start-1); err != nil {
+			return nil, fmt.Errorf("transaction log read failure: %w", err)
+		}
+		if before[0] != '\n' {
+			_, window, _ = strings.Cut(window, "\n")
+		}
+	}
+
+	var events []Event
+
+	for {
+		line, rest, ok := strings.Cut(window, "\n")
+		if !ok {
+			return events, nil // Torn, or empty
+		}
+		window = rest
+
+		e, err := parseEvent(line)
+		if errors.Is(err, ErrorNewerVersion) {
+			return nil, err
+		}
+		if err == nil {
+			events = append(events, e)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package translog
+
+import (
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sameEvent reports whether a and b are the same event, their times
+// compared as instants.
+func sameEvent(a, b Event) bool {
+	if !a.Time.Equal(b.Time) {
+		return false
+	}
+	a.Time, b.Time = time.Time{}, time.Time{}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func FuzzEvent(f *testing.F) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC)
+
+	for _, e := range []Event{
+		{Sequence: 1, EventType: EventPut, Key: "k", Value: "v"},
+		{Sequence: 2, EventType: EventPut, Key: "k", Value: "a b\tc", Time: at},
+		{Sequence: 3, EventType: EventPut, Bucket: "b", Key: "k", Value: "line\nbreak"},
+		{Sequence: 4, EventType: EventPut, Key: "k", Value: "\xff\x00", Codec: compress.Gzip | compress.Encrypted},
+		{Sequence: 5, EventType: EventDelete, Bucket: "b", Key: "k"},
+		{Sequence: 6, EventType: EventEvict, Key: "k"},
+		{Sequence: 7, EventType: EventDropBucket, Bucket: "b"},
+		{Sequence: 8, EventType: EventRenameBucket, Bucket: "b", Value: "c"},
+		{Sequence: 9, EventType: EventImmutable, Key: "k"},
+		{Sequence: 10, EventType: EventExpire, Key: "k", Value: FormatExpiry(at)},
+		{Sequence: 11, EventType: EventPut, Key: "k", Value: "\x00\xff", ContentType: "text/plain; charset=utf-8"},
+		{Sequence: 12, EventType: EventLease, Key: "k", Value: FormatLease("me", at)},
+		{Sequence: 13, EventType: EventLease, Key: "k"},
+		{Sequence: 14, EventType: EventOriginalKey, Key: "k", Value: "K"},
+	} {
+		f.Add(string(EncodeEvent(e)))
+	}
+
+	// Lines of the versions before the version field, of a later version,
+	// and with a time outside UTC
+	f.Add("1\t1\tk\tv")
+	f.Add("2@2024-05-01T12:30:00Z\t1+gzip/b\tk\tdg==")
+	f.Add("v99\t1\t1\tk\tv")
+	f.Add("v10\t1@0000-01-01T00:30:00+01:00\t1\tk\tv")
+
+	f.Fuzz(func(t *testing.T, line string) {
+		e, err := DecodeEvent(line)
+		if err != nil {
+			return
+		}
+
+		// What decodes encodes to a line that decodes to the same event, and
+		// encodes the same again
+		encoded := EncodeEvent(e)
+
+		again, err := DecodeEvent(string(encoded))
+		if err != nil {
+			t.Fatalf("%q decodes to %+v, whose line %q doesn't decode: %v", line, e, encoded, err)
+		}
+		if !sameEvent(e, again) {
+			t.Fatalf("%q decodes to %+v, and its line %q to %+v", line, e, encoded, again)
+		}
+		if reencoded := EncodeEvent(again); string(reencoded) != string(encoded) {
+			t.Fatalf("%+v encodes to %q, then to %q", e, encoded, reencoded)
+		}
+
+		if seq, err := LineSequence(line); err != nil || seq != e.Sequence {
+			t.Fatalf("LineSequence of %q: %d, %v; the event has %d", line, seq, err, e.Sequence)
+		}
+	})
+}
+
+func FuzzEventRoundTrip(f *testing.F) {
+	f.Add(uint64(1), int64(0), false, byte(0), "", "k", "v")
+	f.Add(uint64(2), time.Now().UnixNano(), false, byte(0), "b", "a b", "a b\tc")
+	f.Add(uint64(3), int64(-1), false, byte(compress.Gzip|compress.Encrypted|compress.Blob), "b", "k", "\xff\x00")
+	f.Add(uint64(1<<64-1), int64(1), true, byte(0), "b", "k", "")
+
+	f.Fuzz(func(t *testing.T, seq uint64, nanos int64, del bool, codec byte, bucket, key, value string) {
+		c := compress.Codec(codec)
+
+		// Only what the store would log: a key and bucket that fit their
+		// fields, and a known codec
+		switch {
+		case seq == 0 || key == "" || strings.ContainsAny(key, "\t\r\n"):
+			return
+		case strings.ContainsAny(bucket, "/+\t\r\n"):
+			return
+		case c.Compression()&^compress.Blob > compress.Zlib:
+			return
+		}
+
+		e := Event{Sequence: seq, EventType: EventPut, Bucket: bucket, Key: key, Value: value, Codec: c}
+		if nanos != 0 {
+			e.Time = time.Unix(0, nanos)
+		}
+		if del {
+			e.EventType, e.Value, e.Codec = EventDelete, "", compress.None
+		}
+
+		line := EncodeEvent(e)
+		if strings.ContainsAny(string(line), "\r\n") {
+			t.Fatalf("%+v encodes to more than a line: %q", e, line)
+		}
+
+		got, err := DecodeEvent(string(line))
+		if err != nil {
+			t.Fatalf("%+v encodes to %q, which doesn't decode: %v", e, line, err)
+		}
+
+		if e.Bucket == "" {
+			e.Bucket = DefaultBucket
+		}
+		if !sameEvent(got, e) {
+			t.Fatalf("%+v encodes to %q, which decodes to %+v", e, line, got)
+		}
+	})
+}
+
+func TestBinaryValuesRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	for _, e := range []Event{
+		{Sequence: 1, EventType: EventPut, Key: "k", Value: "nul\x00byte"},
+		{Sequence: 2, EventType: EventPut, Key: "k", Value: "\xff\xfe invalid utf-8 \xc3"},
+		{Sequence: 3, EventType: EventPut, Key: "k", Value: "cr\rlf\ncrlf\r\n"},
+		{Sequence: 4, EventType: EventPut, Key: "k", Value: "tab\tseparated\t"},
+		{Sequence: 5, EventType: EventPut, Bucket: "b", Key: "k", Value: "\x89PNG\r\n\x1a\n\x00", ContentType: "image/png", Time: at},
+		{Sequence: 6, EventType: EventPut, Key: "k", Value: "", ContentType: "text/plain; charset=utf-8"},
+		{Sequence: 7, EventType: EventPut, Key: "k", Value: "\x00", Codec: compress.Gzip, ContentType: "application/octet-stream"},
+	} {
+		line := appendEvent(nil, e)
+		if strings.Count(string(line), "\n") != 1 || !strings.HasSuffix(string(line), "\n") {
+			t.Errorf("%+v written as more than a line: %q", e, line)
+			continue
+		}
+
+		got, err := parseEvent(strings.TrimSuffix(string(line), "\n"))
+		if e.Bucket == "" {
+			e.Bucket = DefaultBucket
+		}
+		if err != nil || !sameEvent(got, e) {
+			t.Errorf("%+v written as %q, which reads back as %+v, %v", e, line, got, err)
+		}
+	}
+}
+
+func TestContentTypeMustBeOfAPut(t *testing.T) {
+	for _, line := range []string{
+		"v10\t1\t2;\tk\tv",               // Empty
+		"v10\t1\t2;text/plain\x01\tk\tv", // Control character
+		"v10\t1\t2;\xff\tk\tv",           // Not text
+		"v10\t1\t1;text/plain\tk\t",      // Of a delete
+		"v10\t1\t6/b;text/plain\tk\t",    // Of a write-once mark
+		"v9\t1\t2;text/plain\tk\tv",      // Before version 10
+		"1\t2;text/plain\tk\tv",          // Before the version field
+	} {
+		if e, err := parseEvent(line); err == nil {
+			t.Errorf("%q read as %+v, want an error", line, e)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package translog
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RecordVersion is the version of the format events are serialized in, in
+// the file log, the Postgres table and the replication stream alike. Each
+// version adds to the one before:
+//
+//  1. sequence, type, key and value, of the default bucket only
+//  2. the bucket, and bucket drops
+//  3. the codec of compressed values, which are base64-encoded
+//  4. the time the event was logged
+//  5. the version itself, recorded with every event
+//  6. bucket renames
+//  7. write-once keys, marked by an event after their put
+//  8. key expiry, set by an event after the put
+//  9. evictions, logged as events of their own
+//  10. the media types of values, a field of their put, and values that
+//     aren't text, base64-encoded in the Postgres log
+//
+// Events are decoded from any version up to RecordVersion, the fields an
+// older one lacks taking their defaults: the default bucket, no codec, no
+// time and no media type. A newer version is refused with
+// ErrorNewerVersion, as this binary can't know what it added.
+const RecordVersion = 10
+
+// legacyRecordVersion is the version taken for records that carry none, as
+// versions 1 to 4 didn't. Each of them is a subset of the next, so they are
+// all decoded as the last.
+const legacyRecordVersion = 4
+
+// ErrorNewerVersion is returned for records of a version past
+// RecordVersion, which only a newer binary can read.
+var ErrorNewerVersion = errors.New("log written by newer version")
+
+// CheckRecordVersion returns an error wrapping ErrorNewerVersion if records
+// of version v can't be read, and nil otherwise. 0 stands for a record
+// without a version, such as a replicated event from an older leader.
+func CheckRecordVersion(v int) error {
+	if v > RecordVersion {
+		return fmt.Errorf("%w: record version %d, this binary reads up to %d; upgrade it", ErrorNewerVersion, v, RecordVersion)
+	}
+
+	return nil
+}
+
+// appendVersion appends the version field that starts a log line.
+func appendVersion(dst []byte) []byte {
+	dst = append(dst, 'v')
+	dst = strconv.AppendInt(dst, RecordVersion, 10)
+
+	return append(dst, '\t')
+}
+
+// cutVersion returns the version of a log line, and the rest of the line.
+// A line without a version field is legacyRecordVersion, whole.
+func cutVersion(line string) (int, string, error) {
+	rest, ok := strings.CutPrefix(line, "v")
+	if !ok {
+		return legacyRecordVersion, line, nil
+	}
+
+	field, rest, ok := strings.Cut(rest, "\t")
+	if !ok {
+		return 0, "", fmt.Errorf("invalid record version %q", line)
+	}
+
+	v, err := strconv.Atoi(field)
+	if err != nil || v <= legacyRecordVersion {
+		return 0, "", fmt.Errorf("invalid record version %q", field)
+	}
+
+	if err := CheckRecordVersion(v); err != nil {
+		return 0, "", err
+	}
+
+	return v, rest, nil
+}
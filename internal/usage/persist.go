@@ -0,0 +1,163 @@
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileName is the name of the usage file in a data directory.
+const FileName = "usage.json"
+
+// FileStore keeps the counters in a JSON file, replaced as a whole on every
+// save.
+type FileStore struct {
+	Path string
+}
+
+func (f FileStore) Load(ctx context.Context, since time.Time) ([]Hour, error) {
+	b, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hours []Hour
+	if err := json.Unmarshal(b, &hours); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+
+	return hours, nil
+}
+
+func (f FileStore) Save(ctx context.Context, hours []Hour) error {
+	b, err := json.Marshal(hours)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Once renamed into place, there's nothing left to remove
+	defer tmp.Close()
+
+	if _, err := tmp.Write(b); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// PostgresStore keeps the counters in the kv_usage table, one row per
+// principal and hour. Each save replaces the rows of the hours saved, so
+// the table holds the counters of a single server.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to the database and creates the kv_usage table
+// if needed.
+func NewPostgresStore(config translog.PostgresdDBParams) (*PostgresStore, error) {
+	connStr := fmt.Sprintf("host=%s dbname=%s user=%s password=%s",
+		config.Host, config.DBName, config.User, config.Password)
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+
+	if err := db.Ping(); err != nil { // Test the database connection
+		return nil, fmt.Errorf("failed to open db connection: %w", err)
+	}
+
+	query := `CREATE TABLE IF NOT EXISTS kv_usage (
+			principal		TEXT NOT NULL,
+			hour			TIMESTAMPTZ NOT NULL,
+			requests		BIGINT NOT NULL,
+			bytes_written		BIGINT NOT NULL,
+			bytes_read		BIGINT NOT NULL,
+			storage_byte_seconds	BIGINT NOT NULL,
+			PRIMARY KEY (principal, hour)
+			);`
+
+	if _, err := db.Exec(query); err != nil {
+		return nil, fmt.Errorf("failed create table: %w", err)
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+func (p *PostgresStore) Load(ctx context.Context, since time.Time) ([]Hour, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT principal, hour, requests, bytes_written, bytes_read, storage_byte_seconds
+		FROM kv_usage WHERE hour >= $1`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours []Hour
+	for rows.Next() {
+		var h Hour
+		if err := rows.Scan(&h.Principal, &h.Start, &h.Requests, &h.BytesWritten, &h.BytesRead, &h.StorageByteSeconds); err != nil {
+			return nil, err
+		}
+		hours = append(hours, h)
+	}
+
+	return hours, rows.Err()
+}
+
+// Save upserts every hour in one transaction. Hours pruned from memory are
+// deleted from the table too, as they are past the retention window.
+func (p *PostgresStore) Save(ctx context.Context, hours []Hour) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO kv_usage (principal, hour, requests, bytes_written, bytes_read, storage_byte_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (principal, hour) DO UPDATE SET requests = EXCLUDED.requests, bytes_written = EXCLUDED.bytes_written,
+			bytes_read = EXCLUDED.bytes_read, storage_byte_seconds = EXCLUDED.storage_byte_seconds`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	oldest := time.Now()
+	for _, h := range hours {
+		if _, err := stmt.ExecContext(ctx, h.Principal, h.Start, h.Requests, h.BytesWritten, h.BytesRead, h.StorageByteSeconds); err != nil {
+			return err
+		}
+		if h.Start.Before(oldest) {
+			oldest = h.Start
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM kv_usage WHERE hour < $1`, oldest); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the connection to the database.
+func (p *PostgresStore) Close() error {
+	return p.db.Close()
+}
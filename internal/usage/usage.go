@@ -0,0 +1,320 @@
+// Package usage accounts for what each principal uses of the store, for
+// billing: the requests they make, the bytes they write and read, and the
+// bytes they store over time, aggregated into hourly buckets. The counters
+// are kept in memory for a retention window and persisted periodically, so
+// that a restart loses at most the last interval.
+package usage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRetention is how long hourly counters are kept by default.
+const DefaultRetention = 90 * 24 * time.Hour
+
+// Counters is what a principal used in an hour.
+type Counters struct {
+	Requests           int64 `json:"requests"`
+	BytesWritten       int64 `json:"bytes_written"`        // Of request bodies
+	BytesRead          int64 `json:"bytes_read"`           // Of response bodies
+	StorageByteSeconds int64 `json:"storage_byte_seconds"` // Bytes stored, times the seconds they were
+}
+
+// Add adds c2 to c.
+func (c *Counters) Add(c2 Counters) {
+	c.Requests += c2.Requests
+	c.BytesWritten += c2.BytesWritten
+	c.BytesRead += c2.BytesRead
+	c.StorageByteSeconds += c2.StorageByteSeconds
+}
+
+// Hour is the usage of a principal in the hour starting at Start.
+type Hour struct {
+	Principal string    `json:"principal"`
+	Start     time.Time `json:"start"`
+	Counters
+}
+
+// Meter accumulates the usage of every principal. It is safe for
+// concurrent use.
+type Meter struct {
+	retention time.Duration
+	now       func() time.Time
+
+	mu      sync.Mutex
+	hours   map[string]map[time.Time]*Counters // Usage by principal, then hour
+	sampled time.Time                          // When storage was last sampled; zero before the first sample
+	dirty   bool                               // Whether anything changed since the counters were last saved
+}
+
+// NewMeter returns a Meter keeping hourly counters for retention, or
+// DefaultRetention if 0. now tells the time, time.Now if nil.
+func NewMeter(retention time.Duration, now func() time.Time) *Meter {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	if now == nil {
+		now = time.Now
+	}
+
+	return &Meter{retention: retention, now: now, hours: make(map[string]map[time.Time]*Counters)}
+}
+
+// hour returns the start of the hour of t.
+func hour(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+// counters returns the counters of principal in the hour starting at h,
+// creating them. The caller must hold m.mu.
+func (m *Meter) counters(principal string, h time.Time) *Counters {
+	hours, ok := m.hours[principal]
+	if !ok {
+		hours = make(map[time.Time]*Counters)
+		m.hours[principal] = hours
+	}
+
+	c, ok := hours[h]
+	if !ok {
+		c = &Counters{}
+		hours[h] = c
+	}
+
+	m.dirty = true
+
+	return c
+}
+
+// Record accounts for a request by principal that wrote and read the given
+// bytes.
+func (m *Meter) Record(principal string, written, read int64) {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.counters(principal, hour(now))
+	c.Requests++
+	c.BytesWritten += written
+	c.BytesRead += read
+}
+
+// SampleStorage accounts for the bytes each principal stores now, as if they
+// had stored them since the previous sample, split between the hours the
+// time in between falls in. The first sample only starts the clock.
+func (m *Meter) SampleStorage(bytes map[string]int64) {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from := m.sampled
+	m.sampled = now
+
+	if from.IsZero() || !now.After(from) {
+		return
+	}
+
+	for start := from; start.Before(now); {
+		end := hour(start).Add(time.Hour)
+		if end.After(now) {
+			end = now
+		}
+		seconds := int64(end.Sub(start) / time.Second)
+
+		for principal, n := range bytes {
+			if n > 0 && seconds > 0 {
+				m.counters(principal, hour(start)).StorageByteSeconds += n * seconds
+			}
+		}
+
+		start = end
+	}
+}
+
+// Owners maps buckets to the principals whose storage they are billed as.
+type Owners map[string]string
+
+// ParseOwners parses a comma-separated list of bucket=principal pairs, such
+// as "sessions=web,metrics=ops".
+func ParseOwners(s string) (Owners, error) {
+	owners := make(Owners)
+
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		bucket, principal, ok := strings.Cut(field, "=")
+		bucket, principal = strings.TrimSpace(bucket), strings.TrimSpace(principal)
+		if !ok || bucket == "" || principal == "" {
+			return nil, fmt.Errorf("bucket owner %q: expected bucket=principal", field)
+		}
+		if _, dup := owners[bucket]; dup {
+			return nil, fmt.Errorf("bucket owner %q: bucket %q has another owner", field, bucket)
+		}
+
+		owners[bucket] = principal
+	}
+
+	return owners, nil
+}
+
+// Storage sums the bytes of each bucket, such as Store.BucketBytes returns,
+// by owner, for SampleStorage. Buckets without an owner are left out.
+func (o Owners) Storage(buckets map[string]int64) map[string]int64 {
+	bytes := make(map[string]int64)
+
+	for bucket, n := range buckets {
+		if principal, ok := o[bucket]; ok {
+			bytes[principal] += n
+		}
+	}
+
+	return bytes
+}
+
+// Prune forgets the hours past the retention window.
+func (m *Meter) Prune() {
+	oldest := hour(m.now().Add(-m.retention))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for principal, hours := range m.hours {
+		for h := range hours {
+			if h.Before(oldest) {
+				delete(hours, h)
+				m.dirty = true
+			}
+		}
+
+		if len(hours) == 0 {
+			delete(m.hours, principal)
+		}
+	}
+}
+
+// Report returns the hours of principal, or of every principal if empty,
+// that start from from and before to, ordered by principal, then by hour.
+func (m *Meter) Report(principal string, from, to time.Time) []Hour {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	principals := slices.Sorted(maps.Keys(m.hours))
+	if principal != "" {
+		principals = []string{principal}
+	}
+
+	var report []Hour
+	for _, p := range principals {
+		hours := m.hours[p]
+
+		for _, h := range slices.SortedFunc(maps.Keys(hours), time.Time.Compare) {
+			if !h.Before(hour(from)) && h.Before(to) {
+				report = append(report, Hour{Principal: p, Start: h, Counters: *hours[h]})
+			}
+		}
+	}
+
+	return report
+}
+
+// Store keeps the counters of a Meter across restarts.
+type Store interface {
+	// Load returns the hours saved, of which it may leave out those
+	// starting before since
+	Load(ctx context.Context, since time.Time) ([]Hour, error)
+
+	// Save replaces the hours saved with hours, the counters of every
+	// hour kept in memory
+	Save(ctx context.Context, hours []Hour) error
+}
+
+// Load adds the hours saved in st, within the retention window, to the
+// counters, as when the process starts.
+func (m *Meter) Load(ctx context.Context, st Store) error {
+	oldest := hour(m.now().Add(-m.retention))
+
+	hours, err := st.Load(ctx, oldest)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, h := range hours {
+		if !h.Start.Before(oldest) {
+			m.counters(h.Principal, hour(h.Start)).Add(h.Counters)
+		}
+	}
+
+	return nil
+}
+
+// Save writes the counters to st, if they changed since they were last
+// saved.
+func (m *Meter) Save(ctx context.Context, st Store) error {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	m.dirty = false
+	m.mu.Unlock()
+
+	hours := m.Report("", time.Time{}, m.now().Add(time.Hour))
+
+	if err := st.Save(ctx, hours); err != nil {
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// Run samples the bytes each principal stores with storage, which may be
+// nil, prunes the counters and saves them to st every interval, until ctx
+// is done, when it samples and saves them a last time.
+func (m *Meter) Run(ctx context.Context, st Store, interval time.Duration, storage func() map[string]int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if storage != nil {
+		m.SampleStorage(storage())
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if storage != nil {
+				m.SampleStorage(storage())
+			}
+			if err := m.Save(context.Background(), st); err != nil {
+				log.Printf("USAGE save failed: %v\n", err)
+			}
+			return
+		}
+
+		if storage != nil {
+			m.SampleStorage(storage())
+		}
+		m.Prune()
+
+		if err := m.Save(ctx, st); err != nil {
+			log.Printf("USAGE save failed: %v\n", err)
+		}
+	}
+}
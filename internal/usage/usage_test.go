@@ -0,0 +1,207 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clock is a simulated time, moved on by the test.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) set(hh, mm int) {
+	c.t = time.Date(2026, 3, 1, hh, mm, 0, 0, time.UTC)
+}
+
+func TestMeterAggregatesHourly(t *testing.T) {
+	c := &clock{}
+	c.set(9, 50)
+	m := NewMeter(0, c.now)
+
+	// Storage is sampled from 9:50, and requests come in over three hours
+	// and a bit
+	m.SampleStorage(map[string]int64{"web": 1000})
+
+	c.set(10, 5)
+	m.Record("web", 100, 10)
+	m.Record("ops", 0, 50)
+	m.SampleStorage(map[string]int64{"web": 1000, "ops": 10})
+
+	c.set(10, 59)
+	m.Record("web", 20, 2)
+
+	c.set(12, 15)
+	m.Record("web", 1, 1)
+	m.SampleStorage(map[string]int64{"web": 2000, "ops": 10})
+
+	at := func(hh int) time.Time {
+		return time.Date(2026, 3, 1, hh, 0, 0, 0, time.UTC)
+	}
+
+	want := []Hour{
+		// Each sample counts the bytes as stored since the one before, so
+		// ops stores 10 bytes from 9:50, and web 1000 until 10:05 and 2000
+		// from then to 12:15, split by hour
+		{"ops", at(9), Counters{StorageByteSeconds: 10 * 10 * 60}},
+		{"ops", at(10), Counters{Requests: 1, BytesRead: 50, StorageByteSeconds: 10 * 3600}},
+		{"ops", at(11), Counters{StorageByteSeconds: 10 * 3600}},
+		{"ops", at(12), Counters{StorageByteSeconds: 10 * 15 * 60}},
+		{"web", at(9), Counters{StorageByteSeconds: 1000 * 10 * 60}},
+		{"web", at(10), Counters{Requests: 2, BytesWritten: 120, BytesRead: 12, StorageByteSeconds: 1000*5*60 + 2000*55*60}},
+		{"web", at(11), Counters{StorageByteSeconds: 2000 * 3600}},
+		{"web", at(12), Counters{Requests: 1, BytesWritten: 1, BytesRead: 1, StorageByteSeconds: 2000 * 15 * 60}},
+	}
+	if got := m.Report("", time.Time{}, at(13)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("report:\n%v\nwant\n%v", got, want)
+	}
+
+	for _, tt := range []struct {
+		principal string
+		from, to  time.Time
+		want      []Hour
+	}{
+		{"web", time.Time{}, at(13), want[4:]},
+		{"ops", at(11), at(12), want[2:3]},
+		// from is taken from the start of its hour, to isn't
+		{"ops", at(11).Add(30 * time.Minute), at(12).Add(time.Minute), want[2:4]},
+		{"nobody", time.Time{}, at(13), nil},
+	} {
+		if got := m.Report(tt.principal, tt.from, tt.to); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("report of %q from %s to %s: %v, want %v", tt.principal, tt.from.Format(time.Kitchen), tt.to.Format(time.Kitchen), got, tt.want)
+		}
+	}
+}
+
+func TestMeterPrunesPastRetention(t *testing.T) {
+	c := &clock{}
+	m := NewMeter(2*time.Hour, c.now)
+
+	for hh := 8; hh <= 12; hh++ {
+		c.set(hh, 30)
+		m.Record("web", 1, 1)
+	}
+	c.set(13, 0)
+	m.Record("ops", 1, 1)
+
+	m.Prune()
+
+	// 11:00 to 13:00 are within two hours of 13:00
+	report := m.Report("", time.Time{}, c.now().Add(time.Hour))
+	if len(report) != 3 || report[0].Principal != "ops" || report[1].Start.Hour() != 11 || report[2].Start.Hour() != 12 {
+		t.Errorf("after pruning: %v", report)
+	}
+
+	// A principal left with no hours is forgotten
+	c.set(16, 0)
+	m.Prune()
+	if report := m.Report("", time.Time{}, c.now()); len(report) != 0 || len(m.hours) != 0 {
+		t.Errorf("after pruning every hour: %v, %d principals", report, len(m.hours))
+	}
+}
+
+func TestMeterPersistsAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st := FileStore{Path: filepath.Join(dir, FileName)}
+
+	c := &clock{}
+	c.set(10, 0)
+	m := NewMeter(24*time.Hour, c.now)
+
+	m.SampleStorage(map[string]int64{"web": 10})
+	c.set(11, 30)
+	m.Record("web", 5, 7)
+	m.Record("ops", 1, 2)
+	m.SampleStorage(map[string]int64{"web": 10})
+
+	if err := m.Save(ctx, st); err != nil {
+		t.Fatal(err)
+	}
+	saved := m.Report("", time.Time{}, c.now().Add(time.Hour))
+
+	// Nothing changed, so nothing is written
+	if err := os.Remove(st.Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(ctx, st); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(st.Path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a save with nothing changed wrote the file: %v", err)
+	}
+
+	// A failed save is retried by the next
+	m.Record("web", 0, 0)
+	if err := m.Save(ctx, FileStore{Path: filepath.Join(dir, "missing", FileName)}); err == nil {
+		t.Fatal("a save to a missing directory succeeded")
+	}
+	if err := m.Save(ctx, st); err != nil {
+		t.Fatal(err)
+	}
+	saved[len(saved)-1].Requests++
+
+	// A meter started after a restart has the counters saved, and adds to
+	// them
+	restarted := NewMeter(24*time.Hour, c.now)
+	if err := restarted.Load(ctx, st); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.Report("", time.Time{}, c.now().Add(time.Hour)); fmt.Sprint(got) != fmt.Sprint(saved) {
+		t.Errorf("after a restart:\n%v\nwant\n%v", got, saved)
+	}
+
+	restarted.Record("ops", 1, 2)
+	if got := restarted.Report("ops", time.Time{}, c.now().Add(time.Hour)); len(got) != 1 || got[0].Requests != 2 || got[0].BytesRead != 4 {
+		t.Errorf("ops after a restart and another request: %v", got)
+	}
+
+	// Hours saved past the retention window aren't loaded
+	c.set(23, 0)
+	late := NewMeter(12*time.Hour, c.now)
+	if err := late.Load(ctx, st); err != nil {
+		t.Fatal(err)
+	}
+	if got := late.Report("", time.Time{}, c.now()); len(got) != 2 || got[0].Start.Hour() != 11 || got[1].Start.Hour() != 11 {
+		t.Errorf("loaded with the 10:00 hour past retention: %v", got)
+	}
+
+	// A missing file is no usage yet; a corrupt one is an error
+	if hours, err := (FileStore{Path: filepath.Join(dir, "none")}).Load(ctx, time.Time{}); err != nil || hours != nil {
+		t.Errorf("loading a missing file: %v, %v", hours, err)
+	}
+	if err := os.WriteFile(st.Path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMeter(0, c.now).Load(ctx, st); err == nil {
+		t.Error("loading a corrupt file succeeded")
+	}
+}
+
+func TestOwners(t *testing.T) {
+	owners, err := ParseOwners(" sessions=web, metrics = ops,,cache=web ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := owners.Storage(map[string]int64{"sessions": 10, "cache": 5, "metrics": 7, "unowned": 100})
+	if len(got) != 2 || got["web"] != 15 || got["ops"] != 7 {
+		t.Errorf("storage by owner: %v", got)
+	}
+
+	for _, s := range []string{"sessions", "sessions=", "=web", "a=web,a=ops"} {
+		if _, err := ParseOwners(s); err == nil {
+			t.Errorf("ParseOwners(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Package version identifies the build of the binary. Version, Commit and
+// Date are set at link time, as in
+//
+//	go build -ldflags "\
+//	  -X github.com/sheritzs/key-value-store/internal/version.Version=v1.4.0 \
+//	  -X github.com/sheritzs/key-value-store/internal/version.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/sheritzs/key-value-store/internal/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+//	  ./cmd/kvstore
+//
+// Those left unset fall back to what the Go toolchain records in the
+// binary: the module's version, for a binary installed with go install, and
+// the revision and time of the commit, for one built in a git checkout.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set with -ldflags -X; empty falls back to the build info.
+var (
+	Version string // Release version, such as v1.4.0
+	Commit  string // Revision of the source the binary was built from
+	Date    string // When the binary was built, in RFC 3339 format
+)
+
+// Unknown stands for the parts of Info a build doesn't record.
+const Unknown = "unknown"
+
+// Info describes a build of the binary.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`               // Of the build, or else of the commit
+	Modified  bool   `json:"modified,omitempty"` // Whether the checkout had uncommitted changes, as far as the toolchain knows
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build of the running binary.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = Commit == "" && s.Value == "true"
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = Unknown
+	}
+	if info.Date == "" {
+		info.Date = Unknown
+	}
+
+	return info
+}
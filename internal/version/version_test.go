@@ -0,0 +1,23 @@
+package version
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	// A test binary has no version, and may have no revision, so the
+	// fallbacks are taken
+	got := Get()
+	if got.Version == "" || got.Commit == "" || got.Date == "" || got.GoVersion != runtime.Version() {
+		t.Errorf("without -ldflags: %+v", got)
+	}
+
+	// Those set at link time are taken as they are
+	defer func(v, c, d string) { Version, Commit, Date = v, c, d }(Version, Commit, Date)
+	Version, Commit, Date = "v1.2.3", "abc", "2026-01-02T03:04:05Z"
+
+	if got := Get(); got != (Info{Version: "v1.2.3", Commit: "abc", Date: "2026-01-02T03:04:05Z", GoVersion: runtime.Version()}) {
+		t.Errorf("with -ldflags: %+v", got)
+	}
+}
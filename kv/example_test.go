@@ -0,0 +1,119 @@
+package kv_test
+
+import (
+	"fmt"
+	"github.com/sheritzs/key-value-store/kv"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+// A host program mounts the KV under /kv/ next to routes of its own.
+func Example() {
+	dir, err := os.MkdirTemp("", "kv-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := kv.New(kv.Config{DataDir: dir})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", http.StripPrefix("/kv", store.Handler()))
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from the host")
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, err := http.NewRequest("PUT", srv.URL+"/kv/v1/key/greeting", strings.NewReader("hello from the store"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	fmt.Println("PUT /kv/v1/key/greeting:", resp.StatusCode)
+
+	for _, path := range []string{"/kv/v1/key/greeting", "/hello"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		fmt.Printf("GET %s: %d %s\n", path, resp.StatusCode, body)
+	}
+
+	// Writes through the API and through the Store are the same writes
+	v, err := store.Store().Get("greeting")
+	fmt.Println(v, err)
+
+	// Output:
+	// PUT /kv/v1/key/greeting: 201
+	// GET /kv/v1/key/greeting: 200 hello from the store
+	// GET /hello: 200 hello from the host
+	// hello from the store <nil>
+}
+
+// A put hook enforces a rule of the host's: values under config. must be
+// valid YAML. Writes breaking it are refused with 422 and the hook's
+// message, and leave the key as it was.
+func ExampleStore_RegisterPutHook() {
+	dir, err := os.MkdirTemp("", "kv-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := kv.New(kv.Config{DataDir: dir})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	store.Store().RegisterPutHook("config.", func(key, value string) error {
+		if err := yaml.Unmarshal([]byte(value), new(any)); err != nil {
+			return fmt.Errorf("%s must be YAML", key)
+		}
+		return nil
+	})
+
+	srv := httptest.NewServer(store.Handler())
+	defer srv.Close()
+
+	for _, value := range []string{"replicas: 3", "replicas: [3"} {
+		req, err := http.NewRequest("PUT", srv.URL+"/v1/key/config.app", strings.NewReader(value))
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		fmt.Println(strings.TrimSpace(fmt.Sprintf("PUT %q: %d %s", value, resp.StatusCode, body)))
+	}
+
+	v, err := store.Store().Get("config.app")
+	fmt.Println(v, err)
+
+	// Output:
+	// PUT "replicas: 3": 201
+	// PUT "replicas: [3": 422 write rejected: config.app must be YAML
+	// replicas: 3 <nil>
+}
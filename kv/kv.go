@@ -0,0 +1,403 @@
+// Package kv embeds the key-value store in another Go program. A KV serves
+// the same HTTP API as the kvstore command, and the host decides where to
+// mount it:
+//
+//	store, err := kv.New(kv.Config{DataDir: "/var/lib/myapp/kv"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer store.Close()
+//
+//	mux := http.NewServeMux()
+//	mux.Handle("/kv/", http.StripPrefix("/kv", store.Handler()))
+//
+// Tracing follows the host's global OpenTelemetry tracer provider.
+package kv
+
+import (
+	"context"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/blob"
+	"github.com/sheritzs/key-value-store/internal/compress"
+	"github.com/sheritzs/key-value-store/internal/crypt"
+	"github.com/sheritzs/key-value-store/internal/pgstate"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Store is the in-memory store behind a KV, for hosts that want to read and
+// write it directly rather than over HTTP.
+type Store = store.Store
+
+// ValueMeta is the metadata the store keeps with each value.
+type ValueMeta = store.ValueMeta
+
+// Event is an event of the transaction log.
+type Event = translog.Event
+
+// ConflictResolver decides the outcome of an event replayed or replicated
+// for a key modified after the event was logged; see Config.ResolveConflict.
+type ConflictResolver = store.ConflictResolver
+
+// Resolution is the outcome of a conflict.
+type Resolution = store.Resolution
+
+// The outcomes a ConflictResolver can choose.
+const (
+	TakeIncoming = store.TakeIncoming // Apply the event
+	KeepLocal    = store.KeepLocal    // Skip the event
+	MergeValue   = store.MergeValue   // Put Resolution.Value instead
+)
+
+// LastWriterWins keeps the write made last, by the clocks of the instances
+// that made them.
+var LastWriterWins ConflictResolver = store.LastWriterWins
+
+// Lease is a time-boxed claim on a key, taken with Store.AcquireLease.
+type Lease = store.Lease
+
+// ErrorLeased is returned for writes to a key leased to another owner.
+var ErrorLeased = store.ErrorLeased
+
+// ErrorInvalidKey is returned for writes to a key the log can't hold: an
+// empty one, or one that isn't UTF-8 or has control characters.
+var ErrorInvalidKey = store.ErrorInvalidKey
+
+// ErrorInvalidBucket is returned for writes to a bucket whose name isn't 1
+// to 63 letters, digits, dots, underscores or dashes.
+var ErrorInvalidBucket = store.ErrorInvalidBucket
+
+// WithLeaseOwner returns a context under which the Store's writes are made
+// by owner, and so are allowed to the keys it leases.
+func WithLeaseOwner(ctx context.Context, owner string) context.Context {
+	return store.WithLeaseOwner(ctx, owner)
+}
+
+// Authenticator establishes who made each request; see Config.Authenticator.
+type Authenticator = api.Authenticator
+
+// Principal is who made a request, as an Authenticator established it.
+type Principal = api.Principal
+
+// APIKeyAuthenticator authenticates requests by the API key in their
+// X-API-Key header, rejecting those with a key it doesn't know.
+type APIKeyAuthenticator = api.APIKeyAuthenticator
+
+// MTLSAuthenticator authenticates requests by their client certificate,
+// which the host's TLS listener must have verified.
+type MTLSAuthenticator = api.MTLSAuthenticator
+
+// The scopes a Principal may hold beyond the key API.
+const (
+	ScopeAdmin     = api.ScopeAdmin     // May use the admin endpoints
+	ScopeUnlimited = api.ScopeUnlimited // Isn't held to the concurrency limits
+)
+
+// PrincipalFrom returns the principal of the request whose context is ctx,
+// for Config.Authorize hooks, or the anonymous principal.
+func PrincipalFrom(ctx context.Context) Principal {
+	return api.PrincipalFrom(ctx)
+}
+
+// PostgresParams are the connection settings of the Postgres log backend.
+type PostgresParams = translog.PostgresdDBParams
+
+// Config configures a KV. The zero value keeps a file log in the current
+// directory with no limits and the admin endpoints disabled.
+type Config struct {
+	LogBackend string         // "file" (the default), "postgres", "postgres-state" or "none"
+	DataDir    string         // Directory of the file log and snapshot; "." if empty
+	Postgres   PostgresParams // Used by the postgres backend
+
+	LogFailureThreshold int  // Consecutive write failures before the log is unhealthy; 3 if 0
+	LogFailOpen         bool // Accept writes with a warning while the log is unhealthy, rather than reject them
+	StrictWrites        bool // Acknowledge writes only once they are durable in the log
+	SkipNoopWrites      bool // Don't log puts of the value a key already has
+
+	// KeyFolding normalizes keys so that keys differing only in case are
+	// one key: "none" (the default), "ascii" or "unicode". Open renames the
+	// keys stored before it was turned on, and fails if some collide.
+	KeyFolding string
+
+	Compression       string // "none" (the default), "gzip" or "zlib"
+	CompressThreshold int    // Minimum value size in bytes to compress; 4096 if 0
+	InitialKeys       int    // Keys to preallocate room for
+
+	BlobThreshold int    // Size of a value, once compressed and encrypted, from which it is kept as a file and only referred to in the log; 0 disables blobs
+	BlobDir       string // Directory of those files; "blobs" in DataDir if empty
+
+	MasterKey string // Base64 or hex 256-bit key wrapping the data keys in DataDir's keyring; empty disables encryption
+
+	HookTimeout time.Duration // How long the put hooks registered on the Store may take per write; 1s if 0
+
+	// Quotas limits buckets, as a comma-separated list of bucket=keys/bytes
+	// quotas where 0 is no limit and the bucket * stands for the others,
+	// such as "sessions=10000/0,*=1000/1048576". Puts past a quota fail,
+	// and those that leave a bucket at QuotaWarnRatio of it or past it
+	// carry a warning.
+	Quotas            string
+	QuotaWarnRatio    float64       // 0.8 if 0
+	QuotaWarnInterval time.Duration // Minimum time between the warnings logged for a bucket; 1m if 0
+
+	// ResolveConflict decides the outcome of the events replayed from the
+	// log, or replicated, for keys modified after the events were logged,
+	// as when instances share a Postgres log; nil applies every event, and
+	// LastWriterWins keeps the later write. It is called without the
+	// store's lock, and must decide the same way every time for the same
+	// arguments, since replays decide again.
+	ResolveConflict ConflictResolver
+
+	MaxInflightReads  int           // Concurrent GET/HEAD requests; 0 is unlimited
+	MaxInflightWrites int           // Concurrent write requests; 0 is unlimited
+	LimitWait         time.Duration // How long a request over a limit waits; 0 rejects it
+
+	AdminKey  string                      // API key required by admin endpoints; empty disables them, unless Authenticator grants ScopeAdmin
+	Authorize func(r *http.Request) error // Called for every request once it's authenticated; an error rejects it with 403
+
+	// Authenticator establishes who made each request, for the admin
+	// endpoints, audit records, concurrency limits and lease owners; an
+	// error rejects the request with 401. AdminKey is checked before it,
+	// and grants ScopeAdmin whatever it says. Nil takes requests to be
+	// anonymous, unless they present AdminKey or Principal names them.
+	Authenticator Authenticator
+
+	// Principal names who made a request, if Authenticator is nil.
+	//
+	// Deprecated: Use Authenticator.
+	Principal func(r *http.Request) string
+
+	// SeparateAdmin moves readiness, metrics, stats and the admin, export
+	// and replication endpoints from Handler to AdminHandler, which also
+	// serves runtime profiles, for hosts that serve them on a port of
+	// their own.
+	SeparateAdmin bool
+}
+
+// KV is an embedded key-value store and its HTTP API.
+type KV struct {
+	store   *store.Store
+	logger  translog.TransactionLogger
+	server  *api.Server
+	handler http.Handler
+	admin   http.Handler // nil unless Config.SeparateAdmin
+}
+
+// New opens the store described by cfg, loading any data already in its
+// log before returning.
+func New(cfg Config) (*KV, error) {
+	codecName := cfg.Compression
+	if codecName == "" {
+		codecName = "none"
+	}
+
+	codec, err := compress.Parse(codecName)
+	if err != nil {
+		return nil, err
+	}
+
+	folding := store.FoldNone
+	if cfg.KeyFolding != "" {
+		if folding, err = store.ParseKeyFolding(cfg.KeyFolding); err != nil {
+			return nil, err
+		}
+	}
+
+	quotas, err := store.ParseQuotas(cfg.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	quotas.WarnRatio, quotas.WarnInterval = cfg.QuotaWarnRatio, cfg.QuotaWarnInterval
+
+	if cfg.CompressThreshold == 0 {
+		cfg.CompressThreshold = 4096
+	}
+
+	if cfg.LogFailureThreshold == 0 {
+		cfg.LogFailureThreshold = 3
+	}
+
+	if cfg.DataDir == "" {
+		cfg.DataDir = "."
+	}
+
+	var blobs *blob.Dir
+
+	if cfg.BlobThreshold > 0 {
+		if cfg.BlobDir == "" {
+			cfg.BlobDir = filepath.Join(cfg.DataDir, blob.DirName)
+		}
+
+		if blobs, err = blob.Open(cfg.BlobDir, cfg.BlobThreshold); err != nil {
+			return nil, err
+		}
+	}
+
+	var keyring *crypt.Keyring
+	var cipher crypt.Cipher
+
+	if cfg.MasterKey != "" {
+		master, err := crypt.ParseMasterKey(cfg.MasterKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			return nil, err
+		}
+
+		if keyring, err = crypt.OpenKeyring(filepath.Join(cfg.DataDir, crypt.KeyringFileName), master); err != nil {
+			return nil, fmt.Errorf("failed to open the keyring: %w", err)
+		}
+
+		cipher = keyring
+	}
+
+	var logger translog.TransactionLogger
+	var health *translog.Health
+	var backing store.Backing
+
+	switch cfg.LogBackend {
+	case "", "file":
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			return nil, err
+		}
+
+		health = translog.NewHealth(cfg.LogFailureThreshold, !cfg.LogFailOpen)
+		logger, err = translog.NewFileTransactionLogger(filepath.Join(cfg.DataDir, translog.LogFileName), health)
+	case "postgres":
+		health = translog.NewHealth(cfg.LogFailureThreshold, !cfg.LogFailOpen)
+		logger, err = translog.NewPostgresTransactionLogger(cfg.Postgres, health)
+	case "postgres-state":
+		var b *pgstate.Backend
+		if b, err = pgstate.New(cfg.Postgres); err == nil {
+			logger, backing = b, b
+		}
+	case "none":
+		logger = translog.NewNopTransactionLogger()
+	default:
+		return nil, fmt.Errorf("unknown log backend %q", cfg.LogBackend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event logger: %w", err)
+	}
+
+	st := store.New(logger, store.Options{
+		Codec:             codec,
+		CompressThreshold: cfg.CompressThreshold,
+		InitialCapacity:   cfg.InitialKeys,
+		Backing:           backing,
+		CoalesceReads:     backing != nil,
+		StrictWrites:      cfg.StrictWrites,
+		SkipNoopWrites:    cfg.SkipNoopWrites,
+		Cipher:            cipher,
+		HookTimeout:       cfg.HookTimeout,
+		KeyFolding:        folding,
+		Blobs:             blobs,
+		Quotas:            quotas,
+		ResolveConflict:   cfg.ResolveConflict,
+	})
+
+	if err := st.Load(cfg.DataDir, logger); err != nil {
+		logger.Close(context.Background())
+		return nil, err
+	}
+
+	if err := st.VerifyEncryption(); err != nil {
+		logger.Close(context.Background())
+		return nil, fmt.Errorf("stored values can't be decrypted: %w", err)
+	}
+
+	if _, _, err := st.CollectBlobs(context.Background()); err != nil {
+		logger.Close(context.Background())
+		return nil, fmt.Errorf("failed to collect unreferenced blobs: %w", err)
+	}
+
+	if err := logger.Run(); err != nil {
+		logger.Close(context.Background())
+		return nil, err
+	}
+
+	if _, collisions, err := st.FoldKeys(context.Background()); err != nil {
+		logger.Close(context.Background())
+		if len(collisions) > 0 {
+			return nil, fmt.Errorf("%w, such as %s", err, collisions[0])
+		}
+		return nil, err
+	}
+
+	go translog.DrainErrors(logger.Err())
+
+	apiCfg := api.Config{
+		AdminKey:          cfg.AdminKey,
+		Authenticator:     cfg.Authenticator,
+		Authorize:         cfg.Authorize,
+		Principal:         cfg.Principal,
+		MaxInflightReads:  cfg.MaxInflightReads,
+		MaxInflightWrites: cfg.MaxInflightWrites,
+		LimitWait:         cfg.LimitWait,
+		LogHealth:         health,
+		Keyring:           keyring,
+	}
+
+	if src, ok := logger.(translog.Source); ok {
+		if blobs != nil {
+			src = blob.Inline(src, blobs)
+		}
+		apiCfg.EventSource = src
+	}
+
+	if cfg.LogBackend == "" || cfg.LogBackend == "file" {
+		apiCfg.DataDir = cfg.DataDir
+	}
+
+	server := api.NewServer(st, apiCfg)
+
+	k := &KV{
+		store:   st,
+		logger:  logger,
+		server:  server,
+		handler: api.NewRouter(server),
+	}
+
+	if cfg.SeparateAdmin {
+		k.handler = api.NewRouterFor(server, api.DataRoutes)
+		k.admin = api.NewRouterFor(server, api.AdminRoutes)
+	}
+
+	return k, nil
+}
+
+// Handler returns the handler serving the HTTP API. Its routes start at
+// /v1, so a host mounting it under a prefix should strip the prefix first.
+func (k *KV) Handler() http.Handler {
+	return k.handler
+}
+
+// AdminHandler returns the handler serving the operational endpoints, or
+// nil unless Config.SeparateAdmin is set, in which case Handler serves only
+// the key API.
+func (k *KV) AdminHandler() http.Handler {
+	return k.admin
+}
+
+// Store returns the store served by the KV. Its writes are logged, and
+// check keys and bucket names as the HTTP API does, failing with
+// ErrorInvalidKey or ErrorInvalidBucket.
+func (k *KV) Store() *Store {
+	return k.store
+}
+
+// Close makes the store read-only, ends open replication streams, and
+// closes the log once every accepted write has been persisted. The host
+// should stop serving the handler before calling it.
+func (k *KV) Close() error {
+	k.store.SetReadOnly(true, "closed")
+	k.server.CloseStreams()
+
+	return k.logger.Close(context.Background())
+}
@@ -0,0 +1,108 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEmbeddedWritesAreValidated(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{DataDir: t.TempDir()}
+
+	k, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.Store().PutCtx(ctx, "line\nbreak", "v"); !errors.Is(err, ErrorInvalidKey) {
+		t.Errorf("PutCtx of a key with a newline = %v, want ErrorInvalidKey", err)
+	}
+	if err := k.Store().BucketPut(ctx, "no/slashes", "k", "v"); !errors.Is(err, ErrorInvalidBucket) {
+		t.Errorf("BucketPut to an invalid bucket = %v, want ErrorInvalidBucket", err)
+	}
+	if err := k.Store().Put("line\nbreak", "v"); !errors.Is(err, ErrorInvalidKey) {
+		t.Errorf("Put of a key with a newline = %v, want ErrorInvalidKey", err)
+	}
+	if err := k.Store().PutCtx(ctx, "kept", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The methods without a context log their writes too
+	if err := k.Store().Put("put", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Store().Put("deleted", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Store().Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log holds nothing it can't replay
+	k, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+
+	for _, key := range []string{"kept", "put"} {
+		if v, err := k.Store().GetCtx(ctx, key); err != nil || v != "v" {
+			t.Errorf("%s = %q, %v after reopening; want v", key, v, err)
+		}
+	}
+	if _, err := k.Store().GetCtx(ctx, "deleted"); err == nil {
+		t.Error("deleted is back after reopening")
+	}
+}
+
+func TestConfigAuthenticator(t *testing.T) {
+	var seen Principal
+
+	k, err := New(Config{
+		DataDir:  t.TempDir(),
+		AdminKey: "sekret",
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]Principal{
+			"user-key": {ID: "user"},
+		}},
+		Authorize: func(r *http.Request) error {
+			seen = PrincipalFrom(r.Context())
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+
+	tests := []struct {
+		key    string
+		path   string
+		status int
+		id     string
+	}{
+		{"user-key", "/v1/key/k", http.StatusNotFound, "user"},
+		{"sekret", "/v1/export", http.StatusOK, "admin"},
+		{"user-key", "/v1/export", http.StatusForbidden, "user"},
+		{"guess", "/v1/key/k", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		seen = Principal{}
+
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("X-API-Key", tt.key)
+		w := httptest.NewRecorder()
+		k.Handler().ServeHTTP(w, r)
+
+		if w.Code != tt.status || seen.ID != tt.id {
+			t.Errorf("GET %s with %s: %d as %q, want %d as %q", tt.path, tt.key, w.Code, seen.ID, tt.status, tt.id)
+		}
+	}
+}
@@ -0,0 +1,952 @@
+// Package kvclient is a client for the key-value store's HTTP API.
+package kvclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorNoSuchKey is returned for keys that don't exist.
+var ErrorNoSuchKey = errors.New("no such key")
+
+// ErrorConflict is returned by CompareAndSwap when the current value didn't
+// match the expected one.
+var ErrorConflict = errors.New("value does not match expected")
+
+// The errors below are wrapped by the StatusError of a response whose body
+// carries their code, and can be tested for with errors.Is.
+var (
+	ErrorInvalidKey        = errors.New("invalid key")
+	ErrorInvalidBucket     = errors.New("invalid bucket name")
+	ErrorInvalidRequest    = errors.New("invalid request")
+	ErrorNotNumeric        = errors.New("value is not an integer")
+	ErrorRejected          = errors.New("write rejected")
+	ErrorValueTooLarge     = errors.New("request body too large")
+	ErrorReadOnly          = errors.New("store is read-only")
+	ErrorRateLimited       = errors.New("too many concurrent requests")
+	ErrorOverQuota         = errors.New("bucket quota exceeded")
+	ErrorLoggerUnavailable = errors.New("transaction log is failing; writes are disabled")
+	ErrorLeased            = errors.New("key is leased to another owner")
+	ErrorInvalidLease      = errors.New("invalid lease")
+	ErrorUnauthenticated   = errors.New("request has no authenticated principal")
+	ErrorTooManyKeys       = errors.New("too many keys")
+	ErrorNotJSON           = errors.New("stored value is not JSON")
+	ErrorInvalidTxn        = errors.New("invalid transaction")
+	ErrorNoSuchBucket      = errors.New("no such bucket")
+	ErrorBucketExists      = errors.New("bucket already exists")
+	ErrorImmutable         = errors.New("key is immutable")
+)
+
+// errorsByCode maps the codes of error bodies to the errors above.
+var errorsByCode = map[string]error{
+	"no_such_key":        ErrorNoSuchKey,
+	"cas_mismatch":       ErrorConflict,
+	"invalid_key":        ErrorInvalidKey,
+	"invalid_bucket":     ErrorInvalidBucket,
+	"invalid_request":    ErrorInvalidRequest,
+	"not_numeric":        ErrorNotNumeric,
+	"write_rejected":     ErrorRejected,
+	"value_too_large":    ErrorValueTooLarge,
+	"read_only":          ErrorReadOnly,
+	"rate_limited":       ErrorRateLimited,
+	"over_quota":         ErrorOverQuota,
+	"logger_unavailable": ErrorLoggerUnavailable,
+	"leased":             ErrorLeased,
+	"invalid_lease":      ErrorInvalidLease,
+	"unauthenticated":    ErrorUnauthenticated,
+	"too_many_keys":      ErrorTooManyKeys,
+	"not_json":           ErrorNotJSON,
+	"invalid_txn":        ErrorInvalidTxn,
+	"no_such_bucket":     ErrorNoSuchBucket,
+	"bucket_exists":      ErrorBucketExists,
+	"immutable":          ErrorImmutable,
+}
+
+// StatusError is returned for responses with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Code       string // The machine-readable code of the error body, if it has one
+	Message    string
+
+	err error // The error Code maps to, if any
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kvclient: server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Unwrap returns the error e's code maps to, such as ErrorReadOnly.
+func (e *StatusError) Unwrap() error {
+	return e.err
+}
+
+// RetryPolicy controls how requests that fail with a connection error, a
+// 5xx status or 429 are retried. Only idempotent requests are retried. The delay
+// doubles after each attempt, starting at MinBackoff and capped at
+// MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts int // Total attempts, including the first; < 2 disables retries
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// Client talks to a single key-value store server. It is safe for
+// concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	apiKey  string
+	retry   RetryPolicy
+
+	readYourWrites bool          // Whether reads ask for at least seq
+	seq            atomic.Uint64 // Highest sequence of a write seen
+
+	ringReplicas int // Points per server on a ShardedClient's ring
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithTimeout sets the timeout of each HTTP request.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.http.Timeout = d }
+}
+
+// WithAPIKey sends key in the X-API-Key header of every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTLSConfig sets the TLS configuration used for https URLs.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		c.http.Transport = t
+	}
+}
+
+// WithRetry sets the retry policy.
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// WithReadYourWrites makes every read ask the server for a view at least
+// as new as the client's Sequence, so it sees the client's own writes even
+// when served by a follower. A server that can't catch up in time answers
+// 503, which is retried like any other.
+func WithReadYourWrites() Option {
+	return func(c *Client) { c.readYourWrites = true }
+}
+
+// WithHTTPClient replaces the underlying HTTP client. Options applied after
+// it adjust the given client.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// New returns a client for the server at baseURL, such as
+// "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Timeout: 10 * time.Second},
+		retry:   RetryPolicy{MaxAttempts: 3, MinBackoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Sequence returns the highest sequence number the server assigned to a
+// write made through the client, or given to ObserveSequence.
+func (c *Client) Sequence() uint64 {
+	return c.seq.Load()
+}
+
+// ObserveSequence raises the client's Sequence to seq, so reads made with
+// WithReadYourWrites see the writes another client made up to seq.
+func (c *Client) ObserveSequence(seq uint64) {
+	for {
+		current := c.seq.Load()
+		if seq <= current || c.seq.CompareAndSwap(current, seq) {
+			return
+		}
+	}
+}
+
+// keyPath returns the path of key in bucket, or in the default bucket if
+// bucket is empty.
+func keyPath(bucket, key string) string {
+	if bucket == "" {
+		return "/v2/key/" + url.PathEscape(key)
+	}
+
+	return "/v2/buckets/" + url.PathEscape(bucket) + "/key/" + url.PathEscape(key)
+}
+
+// Get returns the value of key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.BucketGet(ctx, "", key)
+}
+
+// Put stores value under key.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.BucketPut(ctx, "", key, value)
+}
+
+// GetContent returns the value of key as bytes, with its media type.
+func (c *Client) GetContent(ctx context.Context, key string) ([]byte, string, error) {
+	return c.BucketGetContent(ctx, "", key)
+}
+
+// PutContent stores value, which may hold any bytes, under key, with the
+// media type contentType, if it isn't empty, for reads to serve it as.
+func (c *Client) PutContent(ctx context.Context, key string, value []byte, contentType string) error {
+	return c.BucketPutContent(ctx, "", key, value, contentType)
+}
+
+// PutTTL stores value under key, which expires ttl later: it is gone for
+// reads once it does, and deleted by the server soon after. A later put of
+// key without a TTL makes it permanent.
+func (c *Client) PutTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	return c.BucketPutTTL(ctx, "", key, value, ttl)
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.BucketDelete(ctx, "", key)
+}
+
+// CompareAndSwap sets key to value if its current value is expected, and
+// returns ErrorConflict otherwise.
+func (c *Client) CompareAndSwap(ctx context.Context, key, expected, value string) error {
+	return c.BucketCompareAndSwap(ctx, "", key, expected, value)
+}
+
+// Increment adds delta to the integer value of key and returns the result.
+func (c *Client) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	return c.BucketIncrement(ctx, "", key, delta)
+}
+
+// Patch applies the JSON merge patch of RFC 7386 to the JSON document
+// stored under key, atomically, and returns the patched document. Fields
+// the patch sets to null are removed. A value that isn't JSON gets
+// ErrorNotJSON, and a missing key ErrorNoSuchKey.
+func (c *Client) Patch(ctx context.Context, key, patch string) (string, error) {
+	return c.BucketPatch(ctx, "", key, patch)
+}
+
+// Lease is a time-boxed claim on a key, granted to the client's principal,
+// with the key's value when it was granted.
+type Lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+	Value   string    `json:"value"`
+}
+
+// AcquireLease leases key to the client's principal for ttl, renewing the
+// lease if the principal holds it already, and returns ErrorLeased if
+// another principal does. Only the owner can write the key until the lease
+// expires or is released. Anonymous clients get ErrorUnauthenticated.
+func (c *Client) AcquireLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	return c.BucketAcquireLease(ctx, "", key, ttl)
+}
+
+// ReleaseLease ends the lease the client's principal holds on key.
+func (c *Client) ReleaseLease(ctx context.Context, key string) error {
+	return c.BucketReleaseLease(ctx, "", key)
+}
+
+// BucketGet is like Get for a key in the named bucket.
+func (c *Client) BucketGet(ctx context.Context, bucket, key string) (string, error) {
+	body, err := c.do(ctx, http.MethodGet, keyPath(bucket, key), nil, "")
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// BucketPut is like Put for a key in the named bucket.
+func (c *Client) BucketPut(ctx context.Context, bucket, key, value string) error {
+	_, err := c.do(ctx, http.MethodPut, keyPath(bucket, key), []byte(value), "")
+	return err
+}
+
+// BucketGetContent is like GetContent for a key in the named bucket. The
+// media type is the one the value was put with, or the one the server
+// sniffed from it if it was put with none.
+func (c *Client) BucketGetContent(ctx context.Context, bucket, key string) ([]byte, string, error) {
+	resp, err := c.request(ctx, http.MethodGet, keyPath(bucket, key), nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.body, resp.contentType, nil
+}
+
+// BucketPutContent is like PutContent for a key in the named bucket.
+func (c *Client) BucketPutContent(ctx context.Context, bucket, key string, value []byte, contentType string) error {
+	_, err := c.do(ctx, http.MethodPut, keyPath(bucket, key), value, contentType)
+	return err
+}
+
+// BucketPutTTL is like PutTTL for a key in the named bucket.
+func (c *Client) BucketPutTTL(ctx context.Context, bucket, key, value string, ttl time.Duration) error {
+	_, err := c.do(ctx, http.MethodPut, keyPath(bucket, key)+"?ttl="+ttl.String(), []byte(value), "")
+	return err
+}
+
+// BucketDelete is like Delete for a key in the named bucket.
+func (c *Client) BucketDelete(ctx context.Context, bucket, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, keyPath(bucket, key), nil, "")
+	return err
+}
+
+// BucketDeleteUrgent is like BucketDelete, but the delete goes ahead of the
+// writes waiting on the server, and is durable once it returns: for a key
+// that must be erased now rather than soon.
+func (c *Client) BucketDeleteUrgent(ctx context.Context, bucket, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, keyPath(bucket, key)+"?urgent=true", nil, "")
+	return err
+}
+
+// BucketPatch is like Patch for a key in the named bucket.
+func (c *Client) BucketPatch(ctx context.Context, bucket, key, patch string) (string, error) {
+	body, err := c.do(ctx, http.MethodPatch, keyPath(bucket, key), []byte(patch), "application/merge-patch+json")
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// BucketCompareAndSwap is like CompareAndSwap for a key in the named bucket.
+func (c *Client) BucketCompareAndSwap(ctx context.Context, bucket, key, expected, value string) error {
+	values, encoding := encodeValues(expected, value)
+
+	req, _ := json.Marshal(struct {
+		Expected string `json:"expected"`
+		Value    string `json:"value"`
+		Encoding string `json:"encoding,omitempty"`
+	}{values[0], values[1], encoding})
+
+	_, err := c.do(ctx, http.MethodPost, keyPath(bucket, key)+"/cas", req, "application/json")
+	return err
+}
+
+// BucketIncrement is like Increment for a key in the named bucket.
+func (c *Client) BucketIncrement(ctx context.Context, bucket, key string, delta int64) (int64, error) {
+	req, _ := json.Marshal(struct {
+		Delta int64 `json:"delta"`
+	}{delta})
+
+	body, err := c.do(ctx, http.MethodPost, keyPath(bucket, key)+"/incr", req, "application/json")
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		Value int64 `json:"value"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, fmt.Errorf("kvclient: invalid increment response: %w", err)
+	}
+
+	return resp.Value, nil
+}
+
+// BucketAcquireLease is like AcquireLease for a key in the named bucket.
+func (c *Client) BucketAcquireLease(ctx context.Context, bucket, key string, ttl time.Duration) (Lease, error) {
+	var lease Lease
+
+	req, _ := json.Marshal(struct {
+		TTL string `json:"ttl"`
+	}{ttl.String()})
+
+	body, err := c.do(ctx, http.MethodPost, keyPath(bucket, key)+"/lease", req, "application/json")
+	if err != nil {
+		return lease, err
+	}
+
+	if err := json.Unmarshal(body, &lease); err != nil {
+		return lease, fmt.Errorf("kvclient: invalid lease response: %w", err)
+	}
+
+	return lease, nil
+}
+
+// BucketReleaseLease is like ReleaseLease for a key in the named bucket.
+func (c *Client) BucketReleaseLease(ctx context.Context, bucket, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, keyPath(bucket, key)+"/lease", nil, "")
+	return err
+}
+
+// Buckets returns the names of the buckets holding at least one key.
+func (c *Client) Buckets(ctx context.Context) ([]string, error) {
+	body, err := c.do(ctx, http.MethodGet, "/v2/buckets", nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []string
+	if err := json.Unmarshal(body, &buckets); err != nil {
+		return nil, fmt.Errorf("kvclient: invalid buckets response: %w", err)
+	}
+
+	return buckets, nil
+}
+
+// Keys returns the keys in the default bucket that start with prefix, in
+// lexical order.
+func (c *Client) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return c.BucketKeys(ctx, "", prefix)
+}
+
+// BucketKeys is like Keys for the named bucket.
+func (c *Client) BucketKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	if bucket != "" {
+		q.Set("bucket", bucket)
+	}
+
+	body, err := c.do(ctx, http.MethodGet, "/v2/keys?"+q.Encode(), nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return nil, fmt.Errorf("kvclient: invalid keys response: %w", err)
+	}
+
+	return keys, nil
+}
+
+// BucketDeleteByPrefix deletes the keys in the named bucket that start with
+// prefix, which must not be empty, and returns how many were deleted.
+func (c *Client) BucketDeleteByPrefix(ctx context.Context, bucket, prefix string) (int, error) {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	q.Set("confirm", "true")
+	if bucket != "" {
+		q.Set("bucket", bucket)
+	}
+
+	body, err := c.do(ctx, http.MethodDelete, "/v2/keys?"+q.Encode(), nil, "")
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, fmt.Errorf("kvclient: invalid delete response: %w", err)
+	}
+
+	return resp.Deleted, nil
+}
+
+// RenameBucket renames the bucket from to to, and returns how many keys it
+// moved. It fails with ErrorBucketExists if to has keys, unless merge is
+// set, in which case the keys of from replace those of to. It requires the
+// admin API key.
+func (c *Client) RenameBucket(ctx context.Context, from, to string, merge bool) (int, error) {
+	req, _ := json.Marshal(struct {
+		Name  string `json:"name"`
+		Merge bool   `json:"merge"`
+	}{to, merge})
+
+	body, err := c.do(ctx, http.MethodPost, "/v1/admin/buckets/"+url.PathEscape(from)+"/rename", req, "application/json")
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		Moved int `json:"moved"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, fmt.Errorf("kvclient: invalid rename response: %w", err)
+	}
+
+	return resp.Moved, nil
+}
+
+// KeyInfo is a key listed by BucketListKeys, with the size of its value as
+// stored and its metadata.
+type KeyInfo struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Version  uint64    `json:"version"`
+	Modified time.Time `json:"modified"`
+}
+
+// ListOptions selects a page of keys for BucketListKeys.
+type ListOptions struct {
+	Prefix     string
+	Sort       string // key, size or modified; key if empty
+	Descending bool
+	Limit      int    // Keys per page; the server's default if 0
+	Cursor     string // NextCursor of the previous page; empty for the first
+}
+
+// KeyPage is a page of keys returned by BucketListKeys, taken from the
+// snapshot the first page of the listing was.
+type KeyPage struct {
+	Sequence   uint64    `json:"sequence"` // Of the snapshot
+	Keys       []KeyInfo `json:"keys"`
+	NextCursor string    `json:"next_cursor"` // Empty on the last page
+}
+
+// BucketListKeys returns a page of the keys in the named bucket that start
+// with opts.Prefix, sorted by opts.Sort. The pages of a listing follow one
+// another through NextCursor, which is passed as the opts.Cursor of the
+// same listing.
+func (c *Client) BucketListKeys(ctx context.Context, bucket string, opts ListOptions) (KeyPage, error) {
+	q := url.Values{}
+	q.Set("prefix", opts.Prefix)
+	q.Set("meta", "true")
+	if bucket != "" {
+		q.Set("bucket", bucket)
+	}
+	if opts.Sort != "" {
+		q.Set("sort", opts.Sort)
+	}
+	if opts.Descending {
+		q.Set("order", "desc")
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		q.Set("cursor", opts.Cursor)
+	}
+
+	body, err := c.do(ctx, http.MethodGet, "/v2/keys?"+q.Encode(), nil, "")
+	if err != nil {
+		return KeyPage{}, err
+	}
+
+	var page KeyPage
+	if err := json.Unmarshal(body, &page); err != nil {
+		return KeyPage{}, fmt.Errorf("kvclient: invalid keys response: %w", err)
+	}
+
+	return page, nil
+}
+
+// snapshotReadPath is the endpoint of GetMany and its variants.
+const snapshotReadPath = "/v2/snapshot-read"
+
+// SnapshotRead is the result of GetMany: keys as they all were at a single
+// point between two writes, and the sequence of the last write before it.
+type SnapshotRead struct {
+	Sequence uint64          `json:"sequence"`
+	Values   []SnapshotValue `json:"values"`
+}
+
+// SnapshotValue is a key read by GetMany.
+type SnapshotValue struct {
+	Key      string    `json:"key"`
+	Found    bool      `json:"found"` // Whether the key existed; the other fields are zero if not
+	Value    string    `json:"value"`
+	Version  uint64    `json:"version"`
+	Modified time.Time `json:"modified"`
+}
+
+// GetMany reads keys at once, so that no write falls between the reads of
+// two of them. Keys that don't exist are returned with Found false; the
+// server bounds how many keys may be read.
+func (c *Client) GetMany(ctx context.Context, keys []string) (SnapshotRead, error) {
+	return c.BucketGetMany(ctx, "", keys)
+}
+
+// BucketGetMany is like GetMany for keys in the named bucket.
+func (c *Client) BucketGetMany(ctx context.Context, bucket string, keys []string) (SnapshotRead, error) {
+	if keys == nil {
+		keys = []string{}
+	}
+
+	return c.snapshotRead(ctx, struct {
+		Bucket string   `json:"bucket,omitempty"`
+		Keys   []string `json:"keys"`
+	}{bucket, keys})
+}
+
+// BucketGetPrefix is like BucketGetMany for the keys in the named bucket,
+// or the default bucket if empty, that start with prefix, in lexical order.
+func (c *Client) BucketGetPrefix(ctx context.Context, bucket, prefix string) (SnapshotRead, error) {
+	return c.snapshotRead(ctx, struct {
+		Bucket string `json:"bucket,omitempty"`
+		Prefix string `json:"prefix"`
+	}{bucket, prefix})
+}
+
+func (c *Client) snapshotRead(ctx context.Context, req any) (SnapshotRead, error) {
+	var read SnapshotRead
+
+	b, _ := json.Marshal(req)
+
+	body, err := c.do(ctx, http.MethodPost, snapshotReadPath, b, "application/json")
+	if err != nil {
+		return read, err
+	}
+
+	if err := json.Unmarshal(body, &read); err != nil {
+		return read, fmt.Errorf("kvclient: invalid snapshot read response: %w", err)
+	}
+
+	return read, nil
+}
+
+// bulkPath is the endpoint of PutMany and DeleteMany.
+const bulkPath = "/v2/keys"
+
+// PutMany stores each value under its key at once: every value is written,
+// or none if one of them is refused. The server bounds how many keys may be
+// written.
+func (c *Client) PutMany(ctx context.Context, values map[string]string) error {
+	return c.BucketPutMany(ctx, "", values)
+}
+
+// BucketPutMany is like PutMany for keys in the named bucket.
+func (c *Client) BucketPutMany(ctx context.Context, bucket string, values map[string]string) error {
+	keys := slices.Collect(maps.Keys(values))
+
+	plain := make([]string, len(keys))
+	for i, key := range keys {
+		plain[i] = values[key]
+	}
+	encoded, encoding := encodeValues(plain...)
+
+	put := make(map[string]string, len(values))
+	for i, key := range keys {
+		put[key] = encoded[i]
+	}
+
+	return c.bulk(ctx, struct {
+		Bucket   string            `json:"bucket,omitempty"`
+		Put      map[string]string `json:"put"`
+		Encoding string            `json:"encoding,omitempty"`
+	}{bucket, put, encoding})
+}
+
+// DeleteMany removes keys at once, as PutMany writes them. Deleting a
+// missing key is not an error.
+func (c *Client) DeleteMany(ctx context.Context, keys []string) error {
+	return c.BucketDeleteMany(ctx, "", keys)
+}
+
+// BucketDeleteMany is like DeleteMany for keys in the named bucket.
+func (c *Client) BucketDeleteMany(ctx context.Context, bucket string, keys []string) error {
+	return c.bulk(ctx, struct {
+		Bucket string   `json:"bucket,omitempty"`
+		Delete []string `json:"delete"`
+	}{bucket, keys})
+}
+
+func (c *Client) bulk(ctx context.Context, req any) error {
+	b, _ := json.Marshal(req)
+
+	_, err := c.do(ctx, http.MethodPost, bulkPath, b, "application/json")
+	return err
+}
+
+// txnPath is the endpoint of Txn.
+const txnPath = "/v2/txn"
+
+// Compare is a condition of a Txn on a key: Target is version, value,
+// exists or absent, and Version or Value what the key must have for the
+// first two.
+type Compare struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Target  string `json:"target"`
+	Version uint64 `json:"version,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+// TxnOp is an operation of a Txn on a key: Op is get, put or delete, and
+// Value what a put writes.
+type TxnOp struct {
+	Op     string  `json:"op"`
+	Bucket string  `json:"bucket,omitempty"`
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`
+}
+
+// Txn is a transaction: Then runs if every condition in If holds, and Else,
+// which may only get keys, otherwise.
+type Txn struct {
+	If   []Compare `json:"if"`
+	Then []TxnOp   `json:"then"`
+	Else []TxnOp   `json:"else"`
+}
+
+// TxnResponse is what a Txn did.
+type TxnResponse struct {
+	Succeeded bool        `json:"succeeded"` // Whether every condition held, so Then ran
+	Sequence  uint64      `json:"sequence"`
+	Results   []TxnResult `json:"results"` // Of the operations of the branch that ran, in order
+}
+
+// TxnResult is the result of an operation of a Txn. Found is whether the
+// key existed before the branch ran; a get returns the value, version and
+// modification time it had then, and a put the version and time it gave.
+type TxnResult struct {
+	Op       string    `json:"op"`
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Found    bool      `json:"found"`
+	Value    string    `json:"value"`
+	Version  uint64    `json:"version"`
+	Modified time.Time `json:"modified"`
+}
+
+// Txn runs t atomically: no other write comes in between evaluating its
+// conditions and running the branch they select. Gets in a branch see the
+// keys as they were before its writes, and a branch may write a key once.
+// A transaction that can't run, such as one with too many operations for
+// the server, gets ErrorInvalidTxn and changes nothing.
+func (c *Client) Txn(ctx context.Context, t Txn) (TxnResponse, error) {
+	var resp TxnResponse
+
+	b, _ := json.Marshal(t)
+
+	body, err := c.do(ctx, http.MethodPost, txnPath, b, "application/json")
+	if err != nil {
+		return resp, err
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return resp, fmt.Errorf("kvclient: invalid transaction response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// Export copies a dump of the whole store to w, as JSON lines of the form
+// {"bucket":"default","key":"k","value":"v"}. It requires the admin API key.
+func (c *Client) Export(ctx context.Context, w io.Writer) error {
+	body, err := c.do(ctx, http.MethodGet, "/v1/export", nil, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// ExportRESP copies the keys of bucket, or of the default bucket if empty,
+// to w as a Redis mass-insert file: a stream of SET commands in RESP, for
+// "redis-cli --pipe". It requires the admin API key.
+func (c *Client) ExportRESP(ctx context.Context, bucket string, w io.Writer) error {
+	q := url.Values{"format": {"resp"}}
+	if bucket != "" {
+		q.Set("bucket", bucket)
+	}
+
+	body, err := c.do(ctx, http.MethodGet, "/v1/export?"+q.Encode(), nil, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// Snapshot copies a consistent snapshot of the store to w, in the format the
+// server restores from backups. It requires the admin API key.
+func (c *Client) Snapshot(ctx context.Context, w io.Writer) error {
+	body, err := c.do(ctx, http.MethodGet, "/v1/snapshot", nil, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// Fsck has the server compare its store to its transaction log, and copies
+// the JSON report to w. With repair set, the server also resets the keys
+// that diverge to the log's values. It requires the admin API key.
+func (c *Client) Fsck(ctx context.Context, repair bool, w io.Writer) error {
+	method := http.MethodGet
+	if repair {
+		method = http.MethodPost
+	}
+
+	body, err := c.do(ctx, method, "/v1/admin/fsck", nil, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// LogStats has the server analyze its transaction log, and copies the JSON
+// stats to w, listing top keys as churners. It requires the admin API key.
+func (c *Client) LogStats(ctx context.Context, top int, w io.Writer) error {
+	body, err := c.do(ctx, http.MethodGet, "/v1/admin/log-stats?top="+strconv.Itoa(top), nil, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// Diag copies a diagnostics bundle of the server to w: a tar.gz holding no
+// key or value, with the last events log events, obfuscated. It requires
+// the admin API key.
+func (c *Client) Diag(ctx context.Context, events int, w io.Writer) error {
+	body, err := c.do(ctx, http.MethodGet, "/v1/admin/diag?events="+strconv.Itoa(events), nil, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// do sends a request, retrying idempotent ones according to the retry
+// policy, and returns the body of a 2xx response.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, contentType string) ([]byte, error) {
+	resp, err := c.request(ctx, method, path, body, contentType)
+	return resp.body, err
+}
+
+// request is do, returning the whole response.
+func (c *Client) request(ctx context.Context, method, path string, body []byte, contentType string) (response, error) {
+	attempts := 1
+	if method != http.MethodPost && c.retry.MaxAttempts > 1 {
+		attempts = c.retry.MaxAttempts
+	}
+
+	backoff := c.retry.MinBackoff
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, method, path, body, contentType)
+
+		retryable := err != nil || resp.statusCode >= 500 || resp.statusCode == http.StatusTooManyRequests
+		if !retryable || attempt >= attempts || ctx.Err() != nil {
+			if err != nil {
+				return response{}, err
+			}
+			return resp, resp.err()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return response{}, ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > c.retry.MaxBackoff {
+			backoff = c.retry.MaxBackoff
+		}
+	}
+}
+
+type response struct {
+	statusCode  int
+	body        []byte
+	contentType string
+}
+
+// err maps the response to an error: by the code of its JSON error body,
+// or by its status for servers that don't send one and bodiless responses
+// to HEAD.
+func (r response) err() error {
+	if r.statusCode >= 200 && r.statusCode < 300 {
+		return nil
+	}
+
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if json.Unmarshal(r.body, &body) != nil || body.Code == "" {
+		body.Code, body.Error = "", strings.TrimSpace(string(r.body))
+	}
+
+	err := errorsByCode[body.Code]
+
+	switch {
+	case err == ErrorNoSuchKey || err == ErrorConflict:
+		return err
+	case body.Code == "" && r.statusCode == http.StatusNotFound:
+		return ErrorNoSuchKey
+	case body.Code == "" && r.statusCode == http.StatusConflict:
+		return ErrorConflict
+	default:
+		return &StatusError{StatusCode: r.statusCode, Code: body.Code, Message: body.Error, err: err}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte, contentType string) (response, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, rd)
+	if err != nil {
+		return response{}, fmt.Errorf("kvclient: %w", err)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	read := method == http.MethodGet || method == http.MethodHead || path == snapshotReadPath
+
+	if c.readYourWrites && read {
+		if seq := c.seq.Load(); seq != 0 {
+			req.Header.Set("X-KV-Min-Sequence", strconv.FormatUint(seq, 10))
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return response{}, fmt.Errorf("kvclient: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Reads report how far a lagging server got, which isn't a write
+	if !read && resp.StatusCode < 300 {
+		if seq, err := strconv.ParseUint(resp.Header.Get("X-KV-Sequence"), 10, 64); err == nil {
+			c.ObserveSequence(seq)
+		}
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return response{}, fmt.Errorf("kvclient: failed to read response: %w", err)
+	}
+
+	return response{statusCode: resp.StatusCode, body: b, contentType: resp.Header.Get("Content-Type")}, nil
+}
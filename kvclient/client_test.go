@@ -0,0 +1,290 @@
+package kvclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"github.com/sheritzs/key-value-store/internal/store"
+	"github.com/sheritzs/key-value-store/internal/translog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHandler returns the real router of a server configured by cfg, over a
+// store logged to a file in a temporary directory.
+func newHandler(t *testing.T, cfg api.Config) http.Handler {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := translog.NewFileTransactionLogger(filepath.Join(dir, translog.LogFileName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.New(l, store.Options{})
+	if err := st.Load(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close(context.Background()) })
+
+	return api.NewRouter(api.NewServer(st, cfg))
+}
+
+// fastRetry retries quickly, so tests of retries don't wait long.
+var fastRetry = WithRetry(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+func TestGetPutDelete(t *testing.T) {
+	srv := httptest.NewServer(newHandler(t, api.Config{}))
+	defer srv.Close()
+
+	c := New(srv.URL + "/")
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "a/b"); err != ErrorNoSuchKey {
+		t.Fatalf("Get of a missing key: %v, want ErrorNoSuchKey", err)
+	}
+
+	if err := c.Put(ctx, "a/b", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "a/b"); err != nil || v != "hello" {
+		t.Fatalf("Get: %q, %v, want hello", v, err)
+	}
+
+	if err := c.Delete(ctx, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "a/b"); err != ErrorNoSuchKey {
+		t.Errorf("Get after Delete: %v, want ErrorNoSuchKey", err)
+	}
+
+	// Other errors carry the status and code of the server's error body
+	err := c.Put(ctx, "", "v")
+
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest || !errors.Is(err, ErrorInvalidKey) {
+		t.Errorf("Put of an empty key: %v, want a 400 StatusError wrapping ErrorInvalidKey", err)
+	}
+}
+
+func TestBatchAndList(t *testing.T) {
+	srv := httptest.NewServer(newHandler(t, api.Config{}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	if err := c.PutMany(ctx, map[string]string{"p/1": "one", "p/2": "two", "q": "three"}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := c.Keys(ctx, "p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, []string{"p/1", "p/2"}) {
+		t.Errorf("Keys(p/): %q, want p/1 and p/2", keys)
+	}
+
+	read, err := c.GetMany(ctx, []string{"p/1", "missing", "q"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Values) != 3 || read.Values[0].Value != "one" || read.Values[1].Found || read.Values[2].Value != "three" {
+		t.Errorf("GetMany: %+v, want one, a missing key, and three", read.Values)
+	}
+
+	if err := c.DeleteMany(ctx, []string{"p/1", "p/2", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := c.Keys(ctx, ""); err != nil || !slices.Equal(keys, []string{"q"}) {
+		t.Errorf("Keys after DeleteMany: %q, %v, want q", keys, err)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	srv := httptest.NewServer(newHandler(t, api.Config{}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	const binary = "nul\x00 and \xff\xfe"
+
+	if err := c.PutMany(ctx, map[string]string{"bin": binary, "text": "plain ☃"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "bin"); err != nil || v != binary {
+		t.Fatalf("Get after PutMany: %q, %v, want %q", v, err, binary)
+	}
+
+	read, err := c.GetMany(ctx, []string{"bin", "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Values[0].Value != binary || read.Values[1].Value != "plain ☃" {
+		t.Errorf("GetMany: %+v, want the values as written", read.Values)
+	}
+
+	if err := c.CompareAndSwap(ctx, "bin", binary, binary+"\x00"); err != nil {
+		t.Fatal(err)
+	}
+
+	put := binary + "\x01"
+	resp, err := c.Txn(ctx, Txn{
+		If:   []Compare{{Key: "bin", Target: "value", Value: binary + "\x00"}},
+		Then: []TxnOp{{Op: "put", Key: "txn", Value: &put}, {Op: "get", Key: "bin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Succeeded || resp.Results[1].Value != binary+"\x00" {
+		t.Errorf("Txn: %+v, want it to succeed and get the swapped value", resp)
+	}
+	if v, err := c.Get(ctx, "txn"); err != nil || v != put {
+		t.Errorf("Get after Txn: %q, %v, want %q", v, err, put)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	srv := httptest.NewServer(newHandler(t, api.Config{AdminKey: "sekret"}))
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	var se *StatusError
+	if err := New(srv.URL).Export(ctx, io.Discard); !errors.As(err, &se) || se.StatusCode != http.StatusForbidden {
+		t.Errorf("Export without the admin key: %v, want 403", err)
+	}
+	if err := New(srv.URL, WithAPIKey("sekret")).Export(ctx, io.Discard); err != nil {
+		t.Errorf("Export with the admin key: %v", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(newHandler(t, api.Config{}))
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	if err := New(srv.URL).Put(ctx, "k", "v"); err == nil {
+		t.Error("Put to a server with an unknown certificate succeeded")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	if err := New(srv.URL, WithTLSConfig(&tls.Config{RootCAs: roots})).Put(ctx, "k", "v"); err != nil {
+		t.Errorf("Put trusting the server's certificate: %v", err)
+	}
+}
+
+// flaky answers the first failures requests with 503, and passes the rest
+// on to next.
+func flaky(failures int32, next http.Handler) (http.Handler, *atomic.Int32) {
+	var requests atomic.Int32
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &requests
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("idempotent requests are retried", func(t *testing.T) {
+		h, requests := flaky(2, newHandler(t, api.Config{}))
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		if err := New(srv.URL, fastRetry).Put(ctx, "k", "v"); err != nil {
+			t.Errorf("Put through two failures: %v", err)
+		}
+		if n := requests.Load(); n != 3 {
+			t.Errorf("%d requests, want 3", n)
+		}
+	})
+
+	t.Run("attempts are bounded", func(t *testing.T) {
+		h, requests := flaky(5, newHandler(t, api.Config{}))
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		var se *StatusError
+		if _, err := New(srv.URL, fastRetry).Get(ctx, "k"); !errors.As(err, &se) || se.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Get through five failures: %v, want the last 503", err)
+		}
+		if n := requests.Load(); n != 3 {
+			t.Errorf("%d requests, want 3", n)
+		}
+	})
+
+	t.Run("POST is not retried", func(t *testing.T) {
+		h, requests := flaky(1, newHandler(t, api.Config{}))
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		if _, err := New(srv.URL, fastRetry).Increment(ctx, "n", 1); err == nil {
+			t.Error("Increment through a failure succeeded")
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("%d requests, want 1", n)
+		}
+	})
+
+	t.Run("connection errors are retried", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+
+		var attempts atomic.Int32
+		hc := &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+			attempts.Add(1)
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+
+		if _, err := New(srv.URL, WithHTTPClient(hc), fastRetry).Get(ctx, "k"); err == nil {
+			t.Error("Get from a closed server succeeded")
+		}
+		if n := attempts.Load(); n != 3 {
+			t.Errorf("%d attempts, want 3", n)
+		}
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	_, err := New(srv.URL, WithTimeout(50*time.Millisecond), WithRetry(RetryPolicy{})).Get(context.Background(), "k")
+	if err == nil {
+		t.Fatal("Get from a stuck server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Get gave up after %v, want about 50ms", elapsed)
+	}
+}
@@ -0,0 +1,121 @@
+package kvclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// base64Encoding is the encoding the server gives values of JSON bodies
+// that aren't text, and that the client gives such values it sends. Values
+// are encoded and decoded transparently: callers always see the raw bytes.
+const base64Encoding = "base64"
+
+// isText reports whether value can be sent as a JSON string as it is: it is
+// valid UTF-8, without NUL bytes.
+func isText(value string) bool {
+	return utf8.ValidString(value) && strings.IndexByte(value, 0) < 0
+}
+
+// encodeValues returns values as a JSON body holds them, with their
+// encoding: as they are if they're all text, and all base64-encoded
+// otherwise.
+func encodeValues(values ...string) ([]string, string) {
+	encoding := ""
+	for _, v := range values {
+		if !isText(v) {
+			encoding = base64Encoding
+			break
+		}
+	}
+
+	if encoding == "" {
+		return values, ""
+	}
+
+	encoded := make([]string, len(values))
+	for i, v := range values {
+		encoded[i] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+
+	return encoded, encoding
+}
+
+// decodeValue decodes a value of a response in place, given its encoding.
+func decodeValue(value *string, encoding string) error {
+	switch encoding {
+	case "":
+		return nil
+	case base64Encoding:
+		b, err := base64.StdEncoding.DecodeString(*value)
+		if err != nil {
+			return fmt.Errorf("invalid base64 value: %w", err)
+		}
+		*value = string(b)
+		return nil
+	default:
+		return fmt.Errorf("unknown value encoding %q", encoding)
+	}
+}
+
+func (c Compare) MarshalJSON() ([]byte, error) {
+	type compare Compare
+
+	out := struct {
+		compare
+		Encoding string `json:"encoding,omitempty"`
+	}{compare: compare(c)}
+
+	values, encoding := encodeValues(c.Value)
+	out.Value, out.Encoding = values[0], encoding
+
+	return json.Marshal(out)
+}
+
+func (op TxnOp) MarshalJSON() ([]byte, error) {
+	type txnOp TxnOp
+
+	out := struct {
+		txnOp
+		Encoding string `json:"encoding,omitempty"`
+	}{txnOp: txnOp(op)}
+
+	if op.Value != nil {
+		values, encoding := encodeValues(*op.Value)
+		out.Value, out.Encoding = &values[0], encoding
+	}
+
+	return json.Marshal(out)
+}
+
+func (r *TxnResult) UnmarshalJSON(b []byte) error {
+	type txnResult TxnResult
+
+	var in struct {
+		txnResult
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	*r = TxnResult(in.txnResult)
+	return decodeValue(&r.Value, in.Encoding)
+}
+
+func (v *SnapshotValue) UnmarshalJSON(b []byte) error {
+	type snapshotValue SnapshotValue
+
+	var in struct {
+		snapshotValue
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	*v = SnapshotValue(in.snapshotValue)
+	return decodeValue(&v.Value, in.Encoding)
+}
@@ -0,0 +1,500 @@
+package kvclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRingReplicas is the number of points each server gets on a
+// ShardedClient's ring unless WithRingReplicas says otherwise. More points
+// spread keys more evenly, at the cost of a larger ring.
+const DefaultRingReplicas = 160
+
+// WithRingReplicas sets the number of points each server gets on the ring
+// of a ShardedClient. Plain clients ignore it.
+func WithRingReplicas(n int) Option {
+	return func(c *Client) { c.ringReplicas = n }
+}
+
+// ring is a consistent-hash ring: a key belongs to the server owning the
+// first point at or after the key's hash, wrapping around. Each server owns
+// many points, so adding one takes over about 1/n of the keys, evenly from
+// the others, and leaves the rest where they were.
+type ring struct {
+	points []uint64 // Sorted
+	owners []string // Endpoint owning each point
+}
+
+// newRing returns the ring of endpoints with replicas points each.
+func newRing(endpoints []string, replicas int) ring {
+	var r ring
+
+	type point struct {
+		hash  uint64
+		owner string
+	}
+
+	points := make([]point, 0, len(endpoints)*replicas)
+	for _, endpoint := range endpoints {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{hashString(endpoint + "#" + strconv.Itoa(i)), endpoint})
+		}
+	}
+
+	// Ties, however unlikely, go to the same endpoint in every client
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+
+	return r
+}
+
+// owner returns the endpoint holding key in bucket. The empty bucket is the
+// default one, as it is to the server.
+func (r ring) owner(bucket, key string) string {
+	if bucket == "" {
+		bucket = "default"
+	}
+
+	h := hashString(bucket + "\x00" + key)
+
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[i]
+}
+
+// hashString hashes s with FNV-1a, then mixes the result so that similar
+// strings, such as an endpoint's numbered points, land far apart.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// ShardFailure is a request to one shard of a ShardedClient that failed.
+type ShardFailure struct {
+	Endpoint string   // Server of the shard
+	Keys     []string // Keys the request was for; nil for listings
+	Err      error
+}
+
+// ShardError is returned by a ShardedClient when some of its shards fail,
+// typically because they are down. The results of the other shards are
+// still returned alongside it.
+type ShardError struct {
+	Failures []ShardFailure
+}
+
+func (e *ShardError) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		parts[i] = fmt.Sprintf("%s (%d keys): %v", f.Endpoint, len(f.Keys), f.Err)
+	}
+
+	return "kvclient: shards failed: " + strings.Join(parts, "; ")
+}
+
+// Unwrap returns the failures' errors, so errors.Is and errors.As see
+// through a ShardError.
+func (e *ShardError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+
+	return errs
+}
+
+// Keys returns every key affected by the failures.
+func (e *ShardError) Keys() []string {
+	var keys []string
+	for _, f := range e.Failures {
+		keys = append(keys, f.Keys...)
+	}
+
+	return keys
+}
+
+// shardErr wraps the failure of a single-key request to endpoint. A missing
+// key or a failed swap is an answer from a working shard, so it is
+// returned as is.
+func shardErr(endpoint, key string, err error) error {
+	if err == nil || errors.Is(err, ErrorNoSuchKey) || errors.Is(err, ErrorConflict) {
+		return err
+	}
+
+	return &ShardError{Failures: []ShardFailure{{Endpoint: endpoint, Keys: []string{key}, Err: err}}}
+}
+
+// ShardedClient spreads keys over several independent servers, assigning
+// each key of each bucket to a server with a consistent-hash ring. It is
+// safe for concurrent use, including while endpoints are added or removed.
+type ShardedClient struct {
+	opts     []Option
+	replicas int
+
+	mu      sync.RWMutex
+	clients map[string]*Client // By endpoint
+	ring    ring
+}
+
+// NewShardedClient returns a client sharding keys over the servers at
+// endpoints, each reached by a Client configured with opts.
+func NewShardedClient(endpoints []string, opts ...Option) (*ShardedClient, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("kvclient: no endpoints to shard over")
+	}
+
+	s := &ShardedClient{opts: opts, clients: make(map[string]*Client)}
+
+	for _, endpoint := range endpoints {
+		if _, ok := s.clients[endpoint]; ok {
+			return nil, fmt.Errorf("kvclient: duplicate endpoint %s", endpoint)
+		}
+
+		c := New(endpoint, opts...)
+		s.clients[endpoint] = c
+		s.replicas = c.ringReplicas
+	}
+
+	if s.replicas <= 0 {
+		s.replicas = DefaultRingReplicas
+	}
+
+	s.ring = newRing(endpoints, s.replicas)
+
+	return s, nil
+}
+
+// Endpoints returns the servers keys are sharded over, in lexical order.
+func (s *ShardedClient) Endpoints() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoints := make([]string, 0, len(s.clients))
+	for endpoint := range s.clients {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	sort.Strings(endpoints)
+
+	return endpoints
+}
+
+// AddEndpoint adds a server to the ring. It takes over about a share of the
+// keys of the servers already there; moving their data is up to the
+// caller, since the client doesn't copy anything.
+func (s *ShardedClient) AddEndpoint(endpoint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[endpoint]; ok {
+		return fmt.Errorf("kvclient: duplicate endpoint %s", endpoint)
+	}
+
+	s.clients[endpoint] = New(endpoint, s.opts...)
+	s.rebuild()
+
+	return nil
+}
+
+// RemoveEndpoint removes a server from the ring. Its keys are reassigned to
+// the remaining servers, which don't have them until the caller moves them.
+func (s *ShardedClient) RemoveEndpoint(endpoint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[endpoint]; !ok {
+		return fmt.Errorf("kvclient: unknown endpoint %s", endpoint)
+	}
+	if len(s.clients) == 1 {
+		return errors.New("kvclient: can't remove the last endpoint")
+	}
+
+	delete(s.clients, endpoint)
+	s.rebuild()
+
+	return nil
+}
+
+// rebuild recomputes the ring from the clients. The caller must hold the
+// write lock.
+func (s *ShardedClient) rebuild() {
+	endpoints := make([]string, 0, len(s.clients))
+	for endpoint := range s.clients {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	s.ring = newRing(endpoints, s.replicas)
+}
+
+// Shard returns the server holding key in bucket; an empty bucket is the
+// default one.
+func (s *ShardedClient) Shard(bucket, key string) string {
+	endpoint, _ := s.route(bucket, key)
+
+	return endpoint
+}
+
+// route returns the server holding key in bucket and its client.
+func (s *ShardedClient) route(bucket, key string) (string, *Client) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	endpoint := s.ring.owner(bucket, key)
+
+	return endpoint, s.clients[endpoint]
+}
+
+// all returns the ring and every server's client, consistent with each
+// other even if endpoints are being added or removed.
+func (s *ShardedClient) all() (ring, map[string]*Client) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make(map[string]*Client, len(s.clients))
+	for endpoint, c := range s.clients {
+		clients[endpoint] = c
+	}
+
+	return s.ring, clients
+}
+
+// Get returns the value of key from its shard.
+func (s *ShardedClient) Get(ctx context.Context, key string) (string, error) {
+	return s.BucketGet(ctx, "", key)
+}
+
+// Put stores value under key on its shard.
+func (s *ShardedClient) Put(ctx context.Context, key, value string) error {
+	return s.BucketPut(ctx, "", key, value)
+}
+
+// Delete removes key from its shard.
+func (s *ShardedClient) Delete(ctx context.Context, key string) error {
+	return s.BucketDelete(ctx, "", key)
+}
+
+// CompareAndSwap is Client.CompareAndSwap on the shard of key.
+func (s *ShardedClient) CompareAndSwap(ctx context.Context, key, expected, value string) error {
+	return s.BucketCompareAndSwap(ctx, "", key, expected, value)
+}
+
+// Increment is Client.Increment on the shard of key.
+func (s *ShardedClient) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	return s.BucketIncrement(ctx, "", key, delta)
+}
+
+// AcquireLease is Client.AcquireLease on the shard of key.
+func (s *ShardedClient) AcquireLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	return s.BucketAcquireLease(ctx, "", key, ttl)
+}
+
+// ReleaseLease is Client.ReleaseLease on the shard of key.
+func (s *ShardedClient) ReleaseLease(ctx context.Context, key string) error {
+	return s.BucketReleaseLease(ctx, "", key)
+}
+
+// BucketGet is like Get for a key in the named bucket.
+func (s *ShardedClient) BucketGet(ctx context.Context, bucket, key string) (string, error) {
+	endpoint, c := s.route(bucket, key)
+
+	value, err := c.BucketGet(ctx, bucket, key)
+
+	return value, shardErr(endpoint, key, err)
+}
+
+// BucketPut is like Put for a key in the named bucket.
+func (s *ShardedClient) BucketPut(ctx context.Context, bucket, key, value string) error {
+	endpoint, c := s.route(bucket, key)
+
+	return shardErr(endpoint, key, c.BucketPut(ctx, bucket, key, value))
+}
+
+// BucketDelete is like Delete for a key in the named bucket.
+func (s *ShardedClient) BucketDelete(ctx context.Context, bucket, key string) error {
+	endpoint, c := s.route(bucket, key)
+
+	return shardErr(endpoint, key, c.BucketDelete(ctx, bucket, key))
+}
+
+// BucketCompareAndSwap is like CompareAndSwap for a key in the named bucket.
+func (s *ShardedClient) BucketCompareAndSwap(ctx context.Context, bucket, key, expected, value string) error {
+	endpoint, c := s.route(bucket, key)
+
+	return shardErr(endpoint, key, c.BucketCompareAndSwap(ctx, bucket, key, expected, value))
+}
+
+// BucketIncrement is like Increment for a key in the named bucket.
+func (s *ShardedClient) BucketIncrement(ctx context.Context, bucket, key string, delta int64) (int64, error) {
+	endpoint, c := s.route(bucket, key)
+
+	n, err := c.BucketIncrement(ctx, bucket, key, delta)
+
+	return n, shardErr(endpoint, key, err)
+}
+
+// BucketAcquireLease is like AcquireLease for a key in the named bucket.
+func (s *ShardedClient) BucketAcquireLease(ctx context.Context, bucket, key string, ttl time.Duration) (Lease, error) {
+	endpoint, c := s.route(bucket, key)
+
+	lease, err := c.BucketAcquireLease(ctx, bucket, key, ttl)
+
+	return lease, shardErr(endpoint, key, err)
+}
+
+// BucketReleaseLease is like ReleaseLease for a key in the named bucket.
+func (s *ShardedClient) BucketReleaseLease(ctx context.Context, bucket, key string) error {
+	endpoint, c := s.route(bucket, key)
+
+	return shardErr(endpoint, key, c.BucketReleaseLease(ctx, bucket, key))
+}
+
+// GetMulti returns the values of keys, fetched from their shards in
+// parallel. Missing keys are left out of the result. If shards fail, the
+// values from the others are returned with a *ShardError listing the keys
+// that couldn't be read.
+func (s *ShardedClient) GetMulti(ctx context.Context, keys []string) (map[string]string, error) {
+	return s.BucketGetMulti(ctx, "", keys)
+}
+
+// BucketGetMulti is like GetMulti for keys in the named bucket.
+func (s *ShardedClient) BucketGetMulti(ctx context.Context, bucket string, keys []string) (map[string]string, error) {
+	r, clients := s.all()
+
+	byShard := make(map[string][]string)
+	for _, key := range keys {
+		endpoint := r.owner(bucket, key)
+		byShard[endpoint] = append(byShard[endpoint], key)
+	}
+	values := make(map[string]string, len(keys))
+
+	var mu sync.Mutex
+	var failures []ShardFailure
+
+	var wg sync.WaitGroup
+	for endpoint, shardKeys := range byShard {
+		c := clients[endpoint]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i, key := range shardKeys {
+				value, err := c.BucketGet(ctx, bucket, key)
+				if errors.Is(err, ErrorNoSuchKey) {
+					continue
+				}
+
+				mu.Lock()
+				if err != nil {
+					// A shard that fails once is likely down, so
+					// the rest of its keys aren't tried
+					failures = append(failures, ShardFailure{Endpoint: endpoint, Keys: shardKeys[i:], Err: err})
+				} else {
+					values[key] = value
+				}
+				mu.Unlock()
+
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return values, failuresErr(failures)
+}
+
+// Buckets returns the names of the buckets holding at least one key on any
+// shard. If shards fail, the buckets of the others are returned with a
+// *ShardError.
+func (s *ShardedClient) Buckets(ctx context.Context) ([]string, error) {
+	return s.fanOut(func(c *Client) ([]string, error) { return c.Buckets(ctx) })
+}
+
+// Keys returns the keys in the default bucket that start with prefix, in
+// lexical order, gathered from every shard. If shards fail, the keys of the
+// others are returned with a *ShardError.
+func (s *ShardedClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return s.BucketKeys(ctx, "", prefix)
+}
+
+// BucketKeys is like Keys for the named bucket.
+func (s *ShardedClient) BucketKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+	return s.fanOut(func(c *Client) ([]string, error) { return c.BucketKeys(ctx, bucket, prefix) })
+}
+
+// fanOut calls list on every shard in parallel and merges the results into
+// one sorted list without duplicates.
+func (s *ShardedClient) fanOut(list func(c *Client) ([]string, error)) ([]string, error) {
+	var mu sync.Mutex
+	var merged []string
+	var failures []ShardFailure
+
+	_, clients := s.all()
+
+	var wg sync.WaitGroup
+	for endpoint, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			names, err := list(c)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				failures = append(failures, ShardFailure{Endpoint: endpoint, Err: err})
+				return
+			}
+			merged = append(merged, names...)
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(merged)
+
+	return slices.Compact(merged), failuresErr(failures)
+}
+
+// failuresErr returns a *ShardError for failures, ordered by endpoint, or
+// nil if there are none.
+func failuresErr(failures []ShardFailure) error {
+	if len(failures) == 0 {
+		return nil
+	}
+
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Endpoint < failures[j].Endpoint })
+
+	return &ShardError{Failures: failures}
+}
@@ -0,0 +1,193 @@
+package kvclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sheritzs/key-value-store/internal/api"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestRingSpreadsKeysEvenly(t *testing.T) {
+	endpoints := []string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080", "http://e:8080"}
+	r := newRing(endpoints, DefaultRingReplicas)
+
+	const keys = 100000
+	counts := make(map[string]int)
+	for i := range keys {
+		counts[r.owner("", fmt.Sprintf("user/%d", i))]++
+	}
+
+	mean := keys / len(endpoints)
+	for _, endpoint := range endpoints {
+		if n := counts[endpoint]; n < mean*3/4 || n > mean*5/4 {
+			t.Errorf("%s holds %d of %d keys, want within 25%% of %d", endpoint, n, keys, mean)
+		}
+	}
+}
+
+func TestRingRoutesStably(t *testing.T) {
+	endpoints := []string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080", "http://e:8080"}
+
+	s, err := NewShardedClient(endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients listing the endpoints in any order agree on every key
+	reversed := slices.Clone(endpoints)
+	slices.Reverse(reversed)
+	other, err := NewShardedClient(reversed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const keys = 20000
+	before := make([]string, keys)
+	for i := range keys {
+		key := fmt.Sprintf("k%d", i)
+		before[i] = s.Shard("", key)
+
+		if got := other.Shard("", key); got != before[i] {
+			t.Fatalf("%s routed to %s and %s by clients listing the endpoints in different orders", key, before[i], got)
+		}
+	}
+
+	// An endpoint added takes about its share of the keys, only from the
+	// others, and leaves the rest where they were
+	if err := s.AddEndpoint("http://f:8080"); err != nil {
+		t.Fatal(err)
+	}
+
+	moved := 0
+	for i := range keys {
+		got := s.Shard("", fmt.Sprintf("k%d", i))
+		if got == before[i] {
+			continue
+		}
+		if got != "http://f:8080" {
+			t.Fatalf("k%d moved from %s to %s, not to the new endpoint", i, before[i], got)
+		}
+		moved++
+	}
+	if share := keys / 6; moved < share*3/4 || moved > share*5/4 {
+		t.Errorf("adding a sixth endpoint moved %d of %d keys, want about %d", moved, keys, share)
+	}
+
+	// Removing it puts every key back
+	if err := s.RemoveEndpoint("http://f:8080"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if got := s.Shard("", fmt.Sprintf("k%d", i)); got != before[i] {
+			t.Fatalf("k%d routed to %s after the endpoint was removed, %s before it was added", i, got, before[i])
+		}
+	}
+
+	if _, err := NewShardedClient([]string{"http://a:8080", "http://a:8080"}); err == nil {
+		t.Error("a client was created with a duplicate endpoint")
+	}
+	if err := s.AddEndpoint("http://a:8080"); err == nil {
+		t.Error("a duplicate endpoint was added")
+	}
+}
+
+func TestShardedClient(t *testing.T) {
+	var servers []*httptest.Server
+	var endpoints []string
+	for range 3 {
+		srv := httptest.NewServer(newHandler(t, api.Config{}))
+		defer srv.Close()
+
+		servers = append(servers, srv)
+		endpoints = append(endpoints, srv.URL)
+	}
+
+	s, err := NewShardedClient(endpoints, WithRingReplicas(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	var keys []string
+	for i := range 60 {
+		key := fmt.Sprintf("k%02d", i)
+		keys = append(keys, key)
+
+		if err := s.Put(ctx, key, "v"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each key is on its shard alone
+	for _, key := range keys {
+		for _, endpoint := range endpoints {
+			_, err := New(endpoint).Get(ctx, key)
+			if on := s.Shard("", key) == endpoint; on != (err == nil) {
+				t.Fatalf("%s on %s: %v, but its shard is %s", key, endpoint, err, s.Shard("", key))
+			}
+		}
+	}
+
+	if v, err := s.Get(ctx, "k07"); err != nil || v != "vk07" {
+		t.Errorf("Get: %q, %v", v, err)
+	}
+	if _, err := s.Get(ctx, "missing"); err != ErrorNoSuchKey {
+		t.Errorf("Get of a missing key: %v, want ErrorNoSuchKey", err)
+	}
+
+	// Listings and multi-gets gather every shard's
+	listed, err := s.Keys(ctx, "k")
+	if err != nil || !slices.Equal(listed, keys) {
+		t.Errorf("Keys: %v, %v; want %v", listed, err, keys)
+	}
+
+	values, err := s.GetMulti(ctx, append(keys, "missing"))
+	if err != nil || len(values) != len(keys) || values["k42"] != "vk42" {
+		t.Errorf("GetMulti: %d values, %v", len(values), err)
+	}
+
+	// A shard going down fails only the keys it holds, saying which
+	down := endpoints[1]
+	servers[1].Close()
+
+	var onDown []string
+	for _, key := range keys {
+		if s.Shard("", key) == down {
+			onDown = append(onDown, key)
+		}
+	}
+
+	values, err = s.GetMulti(ctx, keys)
+	var se *ShardError
+	if !errors.As(err, &se) || len(se.Failures) != 1 || se.Failures[0].Endpoint != down {
+		t.Fatalf("GetMulti with %s down: %v", down, err)
+	}
+	failed := se.Keys()
+	sort.Strings(failed)
+	if !slices.Equal(failed, onDown) {
+		t.Errorf("GetMulti failed %v, want the keys on %s: %v", failed, down, onDown)
+	}
+	if len(values) != len(keys)-len(onDown) {
+		t.Errorf("GetMulti returned %d values alongside the failure, want %d", len(values), len(keys)-len(onDown))
+	}
+
+	err = s.Put(ctx, onDown[0], "x")
+	if !errors.As(err, &se) || se.Failures[0].Endpoint != down || !slices.Equal(se.Keys(), onDown[:1]) {
+		t.Errorf("Put to %s while it's down: %v", down, err)
+	}
+	if err := s.Put(ctx, keys[0], "x"); s.Shard("", keys[0]) != down && err != nil {
+		t.Errorf("Put to a shard that's up: %v", err)
+	}
+
+	listed, err = s.Keys(ctx, "k")
+	if !errors.As(err, &se) || len(se.Failures) != 1 || se.Failures[0].Endpoint != down {
+		t.Errorf("Keys with %s down: %v", down, err)
+	}
+	if len(listed) != len(keys)-len(onDown) {
+		t.Errorf("Keys returned %d keys alongside the failure, want %d", len(listed), len(keys)-len(onDown))
+	}
+}
@@ -1,146 +0,0 @@
-package main
-
-import (
-	"errors"
-	"fmt"
-	"github.com/gorilla/mux"
-	"io"
-	"log"
-	"net/http"
-)
-
-var transact *TransactionLogger
-
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.Method, r.RequestURI)
-		next.ServeHTTP(w, r)
-	})
-}
-
-func notAllowedHandler(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Not Allowed", http.StatusMethodNotAllowed)
-}
-
-// putHandler expects to be called with a PUT request for the
-// "v1/key/{key}" resource
-
-func putHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
-
-	value, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w,
-			err.Error(),
-			http.StatusInternalServerError)
-		return
-	}
-
-	defer r.Body.Close()
-
-	err = Put(key, string(value))
-	if err != nil {
-		http.Error(w,
-			err.Error(),
-			http.StatusInternalServerError)
-		return
-	}
-
-	transact.WritePut(key, string(value))
-
-	w.WriteHeader(http.StatusCreated)
-
-	log.Printf("PUT key=%s value=%s\n", key, string(value))
-}
-
-func getHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
-
-	value, err := Get(key)
-	if errors.Is(err, ErrorNoSuchKey) {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Fprint(w, value) // Write the value to the response
-
-	log.Printf("GET key=%s\n", key)
-}
-
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
-
-	err := Delete(key)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	transact.WriteDelete(key)
-
-	log.Printf("DELETE key=%s\n", key)
-}
-
-// Initialize FileTransactionLogger
-
-var logger TransactionLogger
-
-func initializeTransactionLog() error {
-	var err error
-
-	logger, err = NewFileTransactionLogger("transaction.log")
-	if err != nil {
-		return fmt.Errorf("failed to create event logger: %w", err)
-	}
-
-	events, errors := logger.ReadEvents()
-
-	e := Event{}
-	ok := true
-
-	for ok && err == nil {
-		select {
-		case err, ok = <-errors: // Retrieve any errors; ok = false if channel has
-		case e, ok = <-events: // been closed
-			switch e.EventType {
-			case EventDelete:
-				err = Delete(e.Key)
-			case EventPut:
-				err = Put(e.Key, e.Value)
-			}
-		}
-	}
-
-	logger.Run()
-
-	return err
-}
-
-func main() {
-	// Initializes the transaction log and loads existing data, if any.
-	// Blocks until all data is read
-	err := initializeTransactionLog()
-	if err != nil {
-		panic(err)
-	}
-
-	r := mux.NewRouter()
-
-	r.Use(loggingMiddleware)
-
-	r.HandleFunc("/v1/key/{key}", putHandler).Methods("PUT")
-	r.HandleFunc("/v1/key/{key}", getHandler).Methods("GET")
-	r.HandleFunc("/v1/key/{key}", deleteHandler).Methods("DELETE")
-
-	r.HandleFunc("/v1", notAllowedHandler)
-	r.HandleFunc("/v1/key/{key}", notAllowedHandler)
-
-	log.Fatal(http.ListenAndServe(":8080", r))
-}